@@ -0,0 +1,183 @@
+// Package ansible applies Ansible playbooks to the environments, with an
+// inventory generated from their state.
+package ansible
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+// playbookDirs are the directories next to the playbooks they use, hashed
+// with the playbooks to apply them again when they change.
+var playbookDirs = []string{
+	"roles",
+	"tasks",
+	"handlers",
+	"vars",
+	"group_vars",
+	"host_vars",
+	"files",
+	"templates",
+	"library",
+	"module_utils",
+	"filter_plugins",
+}
+
+// Runner applies the playbooks to the environments.
+type Runner struct {
+	Config *config.Ansible
+	// Dir is the directory the playbooks are relative to, the directory of
+	// the config file. ansible-playbook is run in it.
+	Dir string
+	// Out is where the output of ansible-playbook is written.
+	Out io.Writer
+}
+
+// Run applies the playbooks to the host, with a temporary inventory of the
+// host only.
+func (r *Runner) Run(ctx context.Context, h *Host) error {
+	c := r.Config
+	command := strings.Fields(c.Command)
+	if len(command) == 0 {
+		return errors.New("no ansible-playbook command is configured")
+	}
+	dir, err := ioutil.TempDir("", "clouddev-ansible-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	inventory := filepath.Join(dir, "inventory.yml")
+	f, err := os.OpenFile(inventory, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = WriteYAML(f, []*Host{h})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the inventory: %w", err)
+	}
+
+	args := append(command[1:], "-i", inventory, "--limit", h.Name)
+	if len(c.ExtraVars) > 0 {
+		data, err := json.Marshal(c.ExtraVars)
+		if err != nil {
+			return fmt.Errorf("invalid ansible.extra_vars: %w", err)
+		}
+		extraVars := filepath.Join(dir, "extra-vars.json")
+		if err := ioutil.WriteFile(extraVars, data, 0600); err != nil {
+			return err
+		}
+		args = append(args, "--extra-vars", "@"+extraVars)
+	}
+	if len(c.Tags) > 0 {
+		args = append(args, "--tags", strings.Join(c.Tags, ","))
+	}
+	if len(c.SkipTags) > 0 {
+		args = append(args, "--skip-tags", strings.Join(c.SkipTags, ","))
+	}
+	if c.Become {
+		args = append(args, "--become")
+	}
+	args = append(args, c.Playbooks...)
+
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	cmd.Dir = r.Dir
+	cmd.Stdout = r.Out
+	cmd.Stderr = r.Out
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("%s is not installed, install Ansible or set ansible.command: %w", command[0], err)
+		}
+		return fmt.Errorf("failed to apply the playbooks: %w", err)
+	}
+	return nil
+}
+
+// Hash returns a hash of the Ansible configuration, the playbooks and the
+// files of the directories next to them they use, e.g. their roles, to
+// apply them again when one of them changes.
+func (r *Runner) Hash() (string, error) {
+	configHash, err := r.Config.Hash()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", configHash)
+	var dirs []string
+	for _, p := range r.Config.Playbooks {
+		path := p
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(r.Dir, path)
+		}
+		if err := hashFile(h, path); err != nil {
+			return "", fmt.Errorf("failed to read playbook %s: %w", p, err)
+		}
+		if dir := filepath.Dir(path); !contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		for _, name := range playbookDirs {
+			if err := hashDir(h, filepath.Join(dir, name)); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(w, "%s\n", path)
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// hashDir hashes the paths and contents of the regular files of the
+// directory, if it exists, in lexical order.
+func hashDir(w io.Writer, dir string) error {
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return hashFile(w, path)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
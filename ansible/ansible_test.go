@@ -0,0 +1,150 @@
+package ansible_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/ansible"
+	"github.com/darkowlzz/clouddev/config"
+)
+
+// writeFile writes a file under dir, creating its directory.
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerHash(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "site.yml", "- hosts: all\n  roles: [editor]\n")
+	writeFile(t, dir, "roles/editor/tasks/main.yml", "- package: {name: vim}\n")
+	writeFile(t, dir, "README.md", "playbooks\n")
+	r := &ansible.Runner{
+		Config: &config.Ansible{Playbooks: []string{"site.yml"}, Vars: map[string]interface{}{"editor": "vim"}},
+		Dir:    dir,
+	}
+	hash := func() string {
+		t.Helper()
+		h, err := r.Hash()
+		if err != nil {
+			t.Fatalf("Hash() error = %v", err)
+		}
+		return h
+	}
+
+	first := hash()
+	if hash() != first {
+		t.Error("Hash() of the same playbooks changed")
+	}
+	// Files the playbooks don't use don't change it.
+	writeFile(t, dir, "README.md", "the playbooks of the environment\n")
+	if hash() != first {
+		t.Error("Hash() changed with a file the playbooks don't use")
+	}
+
+	changes := []struct {
+		name   string
+		change func()
+	}{
+		{"role", func() { writeFile(t, dir, "roles/editor/tasks/main.yml", "- package: {name: emacs}\n") }},
+		{"playbook", func() { writeFile(t, dir, "site.yml", "- hosts: all\n  become: true\n  roles: [editor]\n") }},
+		{"vars", func() { r.Config.Vars["editor"] = "emacs" }},
+		{"tags", func() { r.Config.Tags = []string{"editor"} }},
+	}
+	previous := first
+	for _, c := range changes {
+		c.change()
+		if h := hash(); h == previous {
+			t.Errorf("Hash() didn't change with the %s", c.name)
+		} else {
+			previous = h
+		}
+	}
+
+	r.Config.Playbooks = []string{"missing.yml"}
+	if _, err := r.Hash(); err == nil || !strings.Contains(err.Error(), "failed to read playbook missing.yml") {
+		t.Errorf("Hash() of a missing playbook error = %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in ansible-playbook is a shell script")
+	}
+	dir := t.TempDir()
+	writeFile(t, dir, "site.yml", "- hosts: all\n")
+	// The stand-in records its arguments and the inventory.
+	writeFile(t, dir, "ansible-playbook", `#!/bin/sh
+echo "$@" > args
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-i) cp "$2" inventory.yml ;;
+	--extra-vars) cp "${2#@}" extra-vars.json ;;
+	esac
+	shift
+done
+`)
+	var out strings.Builder
+	r := &ansible.Runner{
+		Config: &config.Ansible{
+			Playbooks: []string{"site.yml"},
+			ExtraVars: map[string]interface{}{"release": "1.2"},
+			Tags:      []string{"a", "b"},
+			Become:    true,
+			Command:   filepath.Join(dir, "ansible-playbook") + " --diff",
+		},
+		Dir: dir,
+		Out: &out,
+	}
+	h := &ansible.Host{Name: "dev", Address: "203.0.113.10", User: "dev"}
+	if err := r.Run(context.Background(), h); err != nil {
+		t.Fatalf("Run() error = %v\n%s", err, out.String())
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"--diff -i ", " --limit dev --extra-vars @", " --tags a,b --become site.yml"} {
+		if !strings.Contains(string(args), want) {
+			t.Errorf("ansible-playbook arguments = %q, want %q", args, want)
+		}
+	}
+	inventory, err := ioutil.ReadFile(filepath.Join(dir, "inventory.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(inventory), "ansible_host: 203.0.113.10") {
+		t.Errorf("inventory =\n%s\nwant the host", inventory)
+	}
+	extraVars, err := ioutil.ReadFile(filepath.Join(dir, "extra-vars.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(extraVars) != `{"release":"1.2"}` {
+		t.Errorf("extra vars = %s", extraVars)
+	}
+}
+
+func TestRunMissingCommand(t *testing.T) {
+	r := &ansible.Runner{
+		Config: &config.Ansible{Playbooks: []string{"site.yml"}, Command: "clouddev-missing-ansible-playbook"},
+		Dir:    t.TempDir(),
+		Out:    ioutil.Discard,
+	}
+	err := r.Run(context.Background(), &ansible.Host{Name: "dev"})
+	if err == nil || !strings.Contains(err.Error(), "is not installed") {
+		t.Errorf("Run() error = %v, want the missing command", err)
+	}
+}
@@ -0,0 +1,142 @@
+package ansible
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Group is the inventory group of the environments.
+const Group = "clouddev"
+
+// Host is an environment in the inventory.
+type Host struct {
+	// Name is the name of the environment, the inventory hostname.
+	Name    string
+	Address string
+	// Port is the port of the SSH server, 22 if zero.
+	Port int
+	User string
+	// Key is the path of the private key to log in with.
+	Key string
+	// KnownHosts is the path of the known_hosts file with the host keys of
+	// the machine, checked strictly.
+	KnownHosts string
+	// Vars are the variables of the environment. They override the
+	// connection variables.
+	Vars map[string]interface{}
+}
+
+// vars returns the connection variables of the host and its variables.
+func (h *Host) vars() map[string]interface{} {
+	vars := map[string]interface{}{
+		"ansible_host": h.Address,
+		"ansible_user": h.User,
+	}
+	if h.Port != 0 && h.Port != 22 {
+		vars["ansible_port"] = h.Port
+	}
+	if h.Key != "" {
+		vars["ansible_ssh_private_key_file"] = h.Key
+	}
+	if h.KnownHosts != "" {
+		vars["ansible_ssh_common_args"] = fmt.Sprintf("-o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", h.KnownHosts)
+	}
+	for k, v := range h.Vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// WriteYAML writes the YAML inventory of the hosts, in the clouddev group.
+func WriteYAML(w io.Writer, hosts []*Host) error {
+	m := map[string]interface{}{}
+	for _, h := range hosts {
+		m[h.Name] = h.vars()
+	}
+	inventory := map[string]interface{}{
+		"all": map[string]interface{}{
+			"children": map[string]interface{}{
+				Group: map[string]interface{}{"hosts": m},
+			},
+		},
+	}
+	data, err := yaml.Marshal(inventory)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// WriteINI writes the INI inventory of the hosts, in the clouddev group.
+func WriteINI(w io.Writer, hosts []*Host) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s]\n", Group)
+	for _, h := range hosts {
+		b.WriteString(h.Name)
+		vars := h.vars()
+		names := make([]string, 0, len(vars))
+		for k := range vars {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			v, err := iniValue(vars[k])
+			if err != nil {
+				return fmt.Errorf("host %s variable %s: %w", h.Name, k, err)
+			}
+			fmt.Fprintf(&b, " %s=%s", k, v)
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// iniValue formats a variable for a host line of an INI inventory, which is
+// split like a shell command line. Strings that would be split or read as
+// another type are quoted, and lists and maps are written in JSON.
+func iniValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return `""`, nil
+	case string:
+		if v != "" && !strings.ContainsAny(v, " \t\"'\\#;=") && !literal(v) {
+			return v, nil
+		}
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`, nil
+	case bool:
+		if v {
+			return "True", nil
+		}
+		return "False", nil
+	case int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		// JSON has no single quotes once they're escaped.
+		return "'" + strings.ReplaceAll(string(data), "'", `\u0027`) + "'", nil
+	}
+}
+
+// literal returns true if Ansible would read the unquoted string as another
+// type than a string.
+func literal(s string) bool {
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return true
+	}
+	switch s {
+	case "True", "False", "None":
+		return true
+	}
+	return strings.ContainsAny(s[:1], "[{(")
+}
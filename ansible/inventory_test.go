@@ -0,0 +1,121 @@
+package ansible_test
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/darkowlzz/clouddev/ansible"
+)
+
+func TestWriteINIQuoting(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "plain string", value: "vim", want: "vim"},
+		{name: "spaces", value: "hello world", want: `"hello world"`},
+		{name: "quotes and backslashes", value: `say "hi" \ o/`, want: `"say \"hi\" \\ o/"`},
+		{name: "comment", value: "a#b", want: `"a#b"`},
+		{name: "equals", value: "a=b", want: `"a=b"`},
+		{name: "number string", value: "123", want: `"123"`},
+		{name: "float string", value: "1e3", want: `"1e3"`},
+		{name: "boolean string", value: "True", want: `"True"`},
+		{name: "none string", value: "None", want: `"None"`},
+		{name: "list string", value: "[a]", want: `"[a]"`},
+		{name: "dict string", value: "{a}", want: `"{a}"`},
+		{name: "empty string", value: "", want: `""`},
+		{name: "nil", value: nil, want: `""`},
+		{name: "true", value: true, want: "True"},
+		{name: "false", value: false, want: "False"},
+		{name: "int", value: 3, want: "3"},
+		{name: "float", value: 1.5, want: "1.5"},
+		{name: "list", value: []interface{}{"a", 1}, want: `'["a",1]'`},
+		{name: "map with a single quote", value: map[string]interface{}{"name": "o'brien"}, want: `'{"name":"o\u0027brien"}'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &ansible.Host{Name: "dev", Address: "203.0.113.10", User: "dev", Vars: map[string]interface{}{"v": tt.value}}
+			var b strings.Builder
+			if err := ansible.WriteINI(&b, []*ansible.Host{h}); err != nil {
+				t.Fatalf("WriteINI() error = %v", err)
+			}
+			want := "[clouddev]\ndev ansible_host=203.0.113.10 ansible_user=dev v=" + tt.want + "\n"
+			if b.String() != want {
+				t.Errorf("WriteINI() =\n%s\nwant\n%s", b.String(), want)
+			}
+		})
+	}
+}
+
+func TestWriteINIInvalidValue(t *testing.T) {
+	h := &ansible.Host{Name: "dev", Vars: map[string]interface{}{"v": make(chan int)}}
+	var b strings.Builder
+	if err := ansible.WriteINI(&b, []*ansible.Host{h}); err == nil || !strings.Contains(err.Error(), "host dev variable v") {
+		t.Errorf("WriteINI() error = %v, want the invalid variable", err)
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	vars := map[string]interface{}{
+		"number":  "123",
+		"boolean": "True",
+		"yes":     "yes",
+		"empty":   "",
+		"quoted":  `say "hi" \ o/`,
+		"flag":    true,
+		"count":   3,
+		"users":   []interface{}{map[string]interface{}{"name": "o'brien"}},
+		// Variables override the connection variables.
+		"ansible_user": "root",
+	}
+	hosts := []*ansible.Host{
+		{Name: "dev", Address: "203.0.113.10", Port: 2222, User: "dev", Key: "/keys/dev", KnownHosts: "/known_hosts", Vars: vars},
+		{Name: "web", Address: "203.0.113.11", Port: 22, User: "dev"},
+	}
+	var b strings.Builder
+	if err := ansible.WriteYAML(&b, hosts); err != nil {
+		t.Fatalf("WriteYAML() error = %v", err)
+	}
+
+	var inventory struct {
+		All struct {
+			Children map[string]struct {
+				Hosts map[string]map[string]interface{}
+			}
+		}
+	}
+	if err := yaml.Unmarshal([]byte(b.String()), &inventory); err != nil {
+		t.Fatalf("WriteYAML() wrote invalid YAML: %v\n%s", err, b.String())
+	}
+	got := inventory.All.Children[ansible.Group].Hosts
+	if len(got) != 2 {
+		t.Fatalf("WriteYAML() hosts = %v, want dev and web", got)
+	}
+	dev := got["dev"]
+	for _, k := range []string{"number", "boolean", "yes", "empty", "quoted", "flag", "count"} {
+		if dev[k] != vars[k] {
+			t.Errorf("variable %s = %#v, want %#v", k, dev[k], vars[k])
+		}
+	}
+	if users, ok := dev["users"].([]interface{}); !ok || len(users) != 1 {
+		t.Errorf("variable users = %#v, want a list", dev["users"])
+	}
+	want := map[string]interface{}{
+		"ansible_host":                 "203.0.113.10",
+		"ansible_port":                 2222,
+		"ansible_user":                 "root",
+		"ansible_ssh_private_key_file": "/keys/dev",
+		"ansible_ssh_common_args":      "-o UserKnownHostsFile=/known_hosts -o StrictHostKeyChecking=yes",
+	}
+	for k, v := range want {
+		if dev[k] != v {
+			t.Errorf("variable %s = %#v, want %#v", k, dev[k], v)
+		}
+	}
+	if _, ok := got["web"]["ansible_port"]; ok {
+		t.Error("the default SSH port is in the inventory")
+	}
+}
@@ -0,0 +1,273 @@
+// Package bootstrap renders the cloud-init user data that sets up a machine
+// on its first boot from the bootstrap section of the configuration.
+//
+// The user data is a cloud-config document, or a multipart MIME document
+// with the cloud-config and shell script parts when scripts have to run.
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"gopkg.in/yaml.v2"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+// cloudConfig is the subset of the cloud-init cloud-config document clouddev
+// generates.
+type cloudConfig struct {
+	Timezone      string      `yaml:"timezone,omitempty"`
+	Groups        []string    `yaml:"groups,omitempty"`
+	Users         []user      `yaml:"users"`
+	WriteFiles    []writeFile `yaml:"write_files,omitempty"`
+	Swap          *swap       `yaml:"swap,omitempty"`
+	PackageUpdate bool        `yaml:"package_update,omitempty"`
+	Packages      []string    `yaml:"packages,omitempty"`
+	RunCmd        []string    `yaml:"runcmd,omitempty"`
+}
+
+type user struct {
+	Name              string   `yaml:"name"`
+	Groups            string   `yaml:"groups,omitempty"`
+	Sudo              string   `yaml:"sudo,omitempty"`
+	Shell             string   `yaml:"shell"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+type writeFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Encoding    string `yaml:"encoding,omitempty"`
+	Permissions string `yaml:"permissions"`
+	Owner       string `yaml:"owner,omitempty"`
+	// Defer writes the file at the end of the boot, once the users and
+	// packages it may belong to exist.
+	Defer bool `yaml:"defer,omitempty"`
+}
+
+type swap struct {
+	Filename string `yaml:"filename"`
+	Size     int64  `yaml:"size"`
+}
+
+const (
+	sudoAll      = "ALL=(ALL) NOPASSWD:ALL"
+	defaultShell = "/bin/bash"
+	unitDir      = "/etc/systemd/system/"
+)
+
+// Render renders the user data of the configured machine, authorizing the
+// public key for the SSH user. The local files the bootstrap refers to are
+// read relative to dir, the directory of the config file.
+func Render(c *config.Config, publicKey, dir string) ([]byte, error) {
+	b := &c.Bootstrap
+	cc := cloudConfig{
+		Timezone:      b.Timezone,
+		Groups:        b.Groups,
+		Users:         users(c, publicKey),
+		PackageUpdate: len(b.Packages) > 0,
+		Packages:      b.Packages,
+	}
+
+	for _, f := range b.Files {
+		content, err := readContent(f.Content, f.Source, dir)
+		if err != nil {
+			return nil, err
+		}
+		wf := writeFile{
+			Path:        f.Path,
+			Permissions: f.Permissions,
+			Owner:       f.Owner,
+			Defer:       f.Owner != "" && !strings.HasPrefix(f.Owner, "root"),
+		}
+		if wf.Permissions == "" {
+			wf.Permissions = "0644"
+		}
+		if utf8.Valid(content) && bytes.IndexByte(content, 0) < 0 {
+			wf.Content = string(content)
+		} else {
+			wf.Content, wf.Encoding = base64.StdEncoding.EncodeToString(content), "b64"
+		}
+		cc.WriteFiles = append(cc.WriteFiles, wf)
+	}
+	if b.SwapMB > 0 {
+		cc.Swap = &swap{Filename: "/swapfile", Size: int64(b.SwapMB) << 20}
+	}
+
+	var enable []string
+	for _, u := range b.Units {
+		content, err := readContent(u.Content, u.Source, dir)
+		if err != nil {
+			return nil, err
+		}
+		cc.WriteFiles = append(cc.WriteFiles, writeFile{
+			Path:        unitDir + u.Name,
+			Content:     string(content),
+			Permissions: "0644",
+			// The units run programs of the packages and scripts.
+			Defer: true,
+		})
+		if u.Enable {
+			enable = append(enable, u.Name)
+		}
+	}
+	if len(b.Units) > 0 {
+		cc.RunCmd = append(cc.RunCmd, "systemctl daemon-reload")
+	}
+	if len(enable) > 0 {
+		cc.RunCmd = append(cc.RunCmd, "systemctl enable --now "+strings.Join(enable, " "))
+	}
+	cc.RunCmd = append(cc.RunCmd, b.Commands...)
+
+	doc, err := yaml.Marshal(&cc)
+	if err != nil {
+		return nil, err
+	}
+	doc = append([]byte("#cloud-config\n"), doc...)
+
+	scripts, err := scripts(b, dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(scripts) == 0 {
+		return doc, nil
+	}
+	return multipartMIME(append([]part{{
+		filename:    "cloud-config.txt",
+		contentType: "text/cloud-config",
+		content:     doc,
+	}}, scripts...))
+}
+
+// users returns the SSH user, with the additions of its bootstrap entry, and
+// the other users.
+func users(c *config.Config, publicKey string) []user {
+	sshUser := user{
+		Name:              c.SSH.User,
+		Sudo:              sudoAll,
+		Shell:             defaultShell,
+		SSHAuthorizedKeys: []string{publicKey},
+	}
+	var others []user
+	for _, u := range c.Bootstrap.Users {
+		if u.Name == c.SSH.User {
+			sshUser.Groups = strings.Join(u.Groups, ",")
+			if u.Shell != "" {
+				sshUser.Shell = u.Shell
+			}
+			sshUser.SSHAuthorizedKeys = append(sshUser.SSHAuthorizedKeys, u.SSHAuthorizedKeys...)
+			continue
+		}
+		o := user{
+			Name:              u.Name,
+			Groups:            strings.Join(u.Groups, ","),
+			Shell:             u.Shell,
+			SSHAuthorizedKeys: u.SSHAuthorizedKeys,
+		}
+		if o.Shell == "" {
+			o.Shell = defaultShell
+		}
+		if u.Sudo {
+			o.Sudo = sudoAll
+		}
+		others = append(others, o)
+	}
+	return append([]user{sshUser}, others...)
+}
+
+// scripts returns the shell script parts: the installation of the distro
+// specific packages, then the configured scripts. cloud-init runs them in
+// the order of their file names.
+func scripts(b *config.Bootstrap, dir string) ([]part, error) {
+	var parts []part
+	if len(b.AptPackages) > 0 || len(b.DnfPackages) > 0 {
+		parts = append(parts, part{
+			filename:    "000-packages.sh",
+			contentType: "text/x-shellscript",
+			content:     []byte(packagesScript(b.AptPackages, b.DnfPackages)),
+		})
+	}
+	for i, s := range b.Scripts {
+		content, err := readContent(s.Content, s.Source, dir)
+		if err != nil {
+			return nil, err
+		}
+		// cloud-init executes the scripts, which need an interpreter.
+		if !strings.HasPrefix(string(content), "#!") {
+			content = append([]byte("#!/bin/sh\n"), content...)
+		}
+		parts = append(parts, part{
+			filename:    fmt.Sprintf("%03d-%s", i+1, s.Name),
+			contentType: "text/x-shellscript",
+			content:     content,
+		})
+	}
+	return parts, nil
+}
+
+// packagesScript returns a script installing the apt packages on images
+// with apt, and the dnf packages on images with dnf.
+func packagesScript(apt, dnf []string) string {
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\nset -e\n")
+	if len(apt) > 0 {
+		fmt.Fprintf(&sb, "if command -v apt-get >/dev/null 2>&1; then\n  export DEBIAN_FRONTEND=noninteractive\n  apt-get update\n  apt-get install -y %s\nfi\n", quoteAll(apt))
+	}
+	if len(dnf) > 0 {
+		fmt.Fprintf(&sb, "if command -v dnf >/dev/null 2>&1; then\n  dnf install -y %s\nfi\n", quoteAll(dnf))
+	}
+	return sb.String()
+}
+
+func quoteAll(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// readContent returns the inline content, or the content of the source
+// file relative to dir.
+func readContent(content, source, dir string) ([]byte, error) {
+	if source == "" {
+		return []byte(content), nil
+	}
+	path, err := homedir.Expand(source)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bootstrap source: %w", err)
+	}
+	return data, nil
+}
+
+// CheckSize returns an error if the user data is larger than limit bytes,
+// the limit of the named provider. A limit of 0 is no limit.
+func CheckSize(data []byte, limit int, providerName string) error {
+	if limit > 0 && len(data) > limit {
+		return fmt.Errorf("the user data is %s, over the %s limit of %s: read large files from the network in a script instead of bootstrap.files",
+			formatSize(len(data)), formatSize(limit), providerName)
+	}
+	return nil
+}
+
+func formatSize(n int) string {
+	if n < 1024 {
+		return strconv.Itoa(n) + " bytes"
+	}
+	return strconv.FormatFloat(float64(n)/1024, 'f', 1, 64) + " KiB"
+}
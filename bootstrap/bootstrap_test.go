@@ -0,0 +1,108 @@
+package bootstrap_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/bootstrap"
+	"github.com/darkowlzz/clouddev/config"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+const publicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl golden"
+
+// TestRender renders the configs in testdata/<name>.yaml and compares the
+// user data, or the size check error, to testdata/<name>.golden. Run the
+// tests with -update to write the golden files.
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		// limit is the user data size limit of the provider.
+		limit int
+	}{
+		{name: "cloud-config"},
+		{name: "multipart"},
+		{name: "files-base64"},
+		{name: "too-large", limit: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join("testdata", tt.name+".yaml")
+			cfg, err := config.Load(file, config.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := bootstrap.Render(cfg, publicKey, filepath.Dir(file))
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			if err := bootstrap.CheckSize(got, tt.limit, "golden"); err != nil {
+				got = []byte(err.Error() + "\n")
+			} else if tt.limit > 0 {
+				t.Errorf("CheckSize() of %d bytes error = nil, want over the limit of %d", len(got), tt.limit)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("Render() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestRenderIsDeterministic(t *testing.T) {
+	file := filepath.Join("testdata", "multipart.yaml")
+	cfg, err := config.Load(file, config.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := bootstrap.Render(cfg, publicKey, "testdata")
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	second, err := bootstrap.Render(cfg, publicKey, "testdata")
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	if string(first) != string(second) {
+		t.Error("Render() of the same config returned different user data")
+	}
+}
+
+func TestRenderMissingSource(t *testing.T) {
+	cfg := config.Default()
+	cfg.Bootstrap.Scripts = []config.Script{{Name: "missing", Source: "missing.sh"}}
+	if _, err := bootstrap.Render(cfg, publicKey, "testdata"); err == nil {
+		t.Error("Render() with a missing script source error = nil")
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	tests := []struct {
+		size  int
+		limit int
+		ok    bool
+	}{
+		{size: 100, limit: 0, ok: true},
+		{size: 16384, limit: 16384, ok: true},
+		{size: 16385, limit: 16384},
+	}
+	for _, tt := range tests {
+		err := bootstrap.CheckSize(make([]byte, tt.size), tt.limit, "golden")
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckSize() of %d bytes with limit %d error = %v", tt.size, tt.limit, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package bootstrap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+)
+
+// part is a part of a multipart user data document.
+type part struct {
+	filename    string
+	contentType string
+	content     []byte
+}
+
+// multipartMIME returns the multipart/mixed document of the parts that
+// cloud-init splits back into its parts.
+func multipartMIME(parts []part) ([]byte, error) {
+	// Derive the boundary from the content so that the same bootstrap
+	// renders the same user data.
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p.content)
+	}
+	boundary := "clouddev-" + hex.EncodeToString(h.Sum(nil))[:32]
+	for _, p := range parts {
+		if bytes.Contains(p.content, []byte(boundary)) {
+			return nil, fmt.Errorf("bootstrap part %s contains the MIME boundary", p.filename)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\nMIME-Version: 1.0\r\n\r\n", boundary)
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", p.contentType+`; charset="utf-8"`)
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", p.filename))
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(p.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
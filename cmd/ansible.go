@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/darkowlzz/clouddev/ansible"
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/remote"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// applyPlaybooks applies the configured playbooks to the machine of the
+// environment and records it in its state, unless they were already applied
+// with the same playbooks and configuration.
+func applyPlaybooks(ctx context.Context, cfg *config.Config, store state.Backend, env *state.Environment) error {
+	file, err := configFile()
+	if err != nil {
+		return err
+	}
+	r := &ansible.Runner{
+		Config: &cfg.Ansible,
+		Dir:    filepath.Dir(file),
+		Out:    os.Stdout,
+	}
+	hash, err := r.Hash()
+	if err != nil {
+		return err
+	}
+	if env.Ansible == hash {
+		return nil
+	}
+	h, err := ansibleHost(env, cfg.Ansible.Vars)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Applying the Ansible playbooks...")
+	if err := r.Run(ctx, h); err != nil {
+		return err
+	}
+	env.Ansible, env.AnsibleVars = hash, cfg.Ansible.Vars
+	return store.Put(ctx, env)
+}
+
+// ansibleHost returns the inventory host of the environment, with the
+// access details recorded by up and the given variables.
+func ansibleHost(env *state.Environment, vars map[string]interface{}) (*ansible.Host, error) {
+	knownHosts, err := remote.DefaultKnownHosts()
+	if err != nil {
+		return nil, err
+	}
+	return &ansible.Host{
+		Name:       env.Name,
+		Address:    env.Address,
+		Port:       env.SSHPort,
+		User:       env.SSHUser,
+		Key:        env.SSHKey,
+		KnownHosts: knownHosts,
+		Vars:       vars,
+	}, nil
+}
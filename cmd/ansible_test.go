@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+func TestApplyPlaybooksSkipsUnchanged(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in ansible-playbook is a shell script")
+	}
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	viper.SetConfigFile(filepath.Join(dir, "clouddev.yaml"))
+	write := func(name, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("site.yml", "- hosts: all\n")
+	// The stand-in counts its runs.
+	write("ansible-playbook", "#!/bin/sh\necho run >> runs\n")
+	runs := func() int {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "runs"))
+		return strings.Count(string(data), "run")
+	}
+
+	cfg := config.Default()
+	cfg.Provider = "fake"
+	cfg.Ansible.Playbooks = []string{"site.yml"}
+	cfg.Ansible.Command = filepath.Join(dir, "ansible-playbook")
+	cfg.Ansible.Vars = map[string]interface{}{"editor": "vim"}
+	store := state.NewLocal(filepath.Join(dir, "state"))
+	env := &state.Environment{Name: cfg.Name, Provider: cfg.Provider, Address: "203.0.113.10", SSHUser: "dev"}
+	ctx := context.Background()
+
+	steps := []struct {
+		name   string
+		change func()
+		runs   int
+	}{
+		{name: "first up", runs: 1},
+		{name: "nothing changed", runs: 1},
+		{name: "playbook changed", change: func() { write("site.yml", "- hosts: all\n  become: true\n") }, runs: 2},
+		{name: "vars changed", change: func() { cfg.Ansible.Vars["editor"] = "emacs" }, runs: 3},
+		{name: "nothing changed again", runs: 3},
+	}
+	for _, s := range steps {
+		if s.change != nil {
+			s.change()
+		}
+		if err := applyPlaybooks(ctx, cfg, store, env); err != nil {
+			t.Fatalf("%s: applyPlaybooks() error = %v", s.name, err)
+		}
+		if n := runs(); n != s.runs {
+			t.Errorf("%s: the playbooks ran %d times, want %d", s.name, n, s.runs)
+		}
+	}
+
+	recorded, err := store.Get(ctx, cfg.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded.Ansible != env.Ansible || recorded.AnsibleVars["editor"] != "emacs" {
+		t.Errorf("recorded playbooks = %s with %v, want the last ones applied", recorded.Ansible, recorded.AnsibleVars)
+	}
+}
@@ -1,9 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/state"
 )
 
 // cleanCmd represents the clean command
@@ -11,8 +16,57 @@ var cleanCmd = &cobra.Command{
 	Use:   "clean",
 	Short: "Destroy cloud environment",
 	Long:  `Destroy all the provisioned cloud environment.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("clean called")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+		return withLock(cmd.Context(), store, cfg.Name, func(ctx context.Context) error {
+			env, err := store.Get(ctx, cfg.Name)
+			if errors.Is(err, state.ErrNotFound) {
+				fmt.Printf("Environment %s is not provisioned, nothing to clean\n", cfg.Name)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := checkProvider(cfg, env); err != nil {
+				return err
+			}
+			p, err := provider.New(cfg)
+			if err != nil {
+				return err
+			}
+			defer provider.Close(p)
+
+			// Only forget the environment once all its resources are gone, so
+			// that a failed clean can be retried.
+			fmt.Printf("Destroying environment %s...\n", cfg.Name)
+			if err := p.Destroy(ctx, recordedMachine(env)); err != nil {
+				return fmt.Errorf("failed to destroy environment %s: %w", cfg.Name, err)
+			}
+			if err := store.Delete(ctx, cfg.Name); err != nil {
+				return err
+			}
+			if err := forgetAccess(env); err != nil {
+				return err
+			}
+			if managedKey(cfg) {
+				ks, err := openKeys()
+				if err != nil {
+					return err
+				}
+				if err := ks.Delete(cfg.Name); err != nil {
+					return fmt.Errorf("failed to delete the SSH key of environment %s: %w", cfg.Name, err)
+				}
+			}
+			fmt.Printf("Environment %s destroyed\n", cfg.Name)
+			return nil
+		})
 	},
 }
 
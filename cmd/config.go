@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the clouddev configuration",
+	Long: `Manage the clouddev configuration.
+
+The effective configuration is layered, from lowest to highest precedence,
+from the defaults, the config file, CLOUDDEV_ prefixed environment variables
+and --set flags.`,
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+}
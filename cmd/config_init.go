@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+var (
+	initForce    bool
+	initNoPrompt bool
+	initValues   = config.Default()
+)
+
+// configInitCmd represents the config init command
+var configInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Write a starter config file",
+	Long: `Write a commented starter config file to $HOME/.clouddev.yaml, or the
+file passed with --config.
+
+The values are taken from the flags. When run in a terminal, the values not
+set by flags are prompted for, unless --no-prompt is passed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file := cfgFile
+		if file == "" {
+			home, err := homedir.Dir()
+			if err != nil {
+				return err
+			}
+			file = filepath.Join(home, ".clouddev.yaml")
+		}
+		if _, err := os.Stat(file); err == nil && !initForce {
+			return fmt.Errorf("%s already exists, pass --force to overwrite it", file)
+		}
+
+		c := initValues
+		if !initNoPrompt && isTerminal(os.Stdin) {
+			if err := promptConfig(cmd, c); err != nil {
+				return err
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := config.WriteStarter(&buf, c); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote config file: %s\n", file)
+
+		// Point out what's left to fill in, e.g. a missing provider.
+		opts, err := configOptions()
+		if err != nil {
+			return err
+		}
+		if _, err := config.Load(file, opts); err != nil {
+			fmt.Println(err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configInitCmd)
+
+	configInitCmd.Flags().BoolVar(&initForce, "force", false, "overwrite an existing config file")
+	configInitCmd.Flags().BoolVar(&initNoPrompt, "no-prompt", false, "don't prompt for the values not set by flags")
+	configInitCmd.Flags().StringVar(&initValues.Name, "name", initValues.Name, "environment name")
+	configInitCmd.Flags().StringVar(&initValues.Provider, "provider", "", "cloud provider")
+	configInitCmd.Flags().StringVar(&initValues.Region, "region", "", "provider region")
+	configInitCmd.Flags().StringVar(&initValues.MachineType, "machine-type", "", "provider machine type")
+	configInitCmd.Flags().StringVar(&initValues.Image, "image", "", "provider machine image")
+	configInitCmd.Flags().IntVar(&initValues.Disk.SizeGB, "disk-size", initValues.Disk.SizeGB, "boot disk size in GB")
+	configInitCmd.Flags().StringVar(&initValues.SSH.User, "ssh-user", initValues.SSH.User, "SSH login user")
+	configInitCmd.Flags().IntSliceVar(&initValues.Ports, "ports", initValues.Ports, "TCP ports to allow inbound traffic on")
+}
+
+// promptConfig prompts for the values of the config that weren't set by
+// flags.
+func promptConfig(cmd *cobra.Command, c *config.Config) error {
+	in := bufio.NewReader(os.Stdin)
+	prompt := func(flag, label string, value *string) error {
+		if cmd.Flags().Changed(flag) {
+			return nil
+		}
+		fmt.Printf("%s [%s]: ", label, *value)
+		// Take the default when the input ends without an answer.
+		answer, err := in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if answer = strings.TrimSpace(answer); answer != "" {
+			*value = answer
+		}
+		return nil
+	}
+
+	for _, p := range []struct {
+		flag, label string
+		value       *string
+	}{
+		{"name", "Environment name", &c.Name},
+		{"provider", "Provider", &c.Provider},
+		{"region", "Region", &c.Region},
+		{"machine-type", "Machine type", &c.MachineType},
+		{"image", "Image", &c.Image},
+		{"ssh-user", "SSH user", &c.SSH.User},
+	} {
+		if err := prompt(p.flag, p.label, p.value); err != nil {
+			return err
+		}
+	}
+
+	size := strconv.Itoa(c.Disk.SizeGB)
+	if err := prompt("disk-size", "Disk size (GB)", &size); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil {
+		return fmt.Errorf("invalid disk size %q", size)
+	}
+	c.Disk.SizeGB = n
+	return nil
+}
+
+// isTerminal returns true if the file is a terminal. Other character
+// devices, e.g. /dev/null, aren't.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
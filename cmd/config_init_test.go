@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// redirect replaces *f with the file at path until the test ends.
+func redirect(t *testing.T, f **os.File, path string, flag int) *os.File {
+	t.Helper()
+	file, err := os.OpenFile(path, flag, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *f
+	*f = file
+	t.Cleanup(func() {
+		*f = old
+		file.Close()
+	})
+	return file
+}
+
+func TestPromptsWithoutATerminal(t *testing.T) {
+	// /dev/null is a character device, but not a terminal.
+	redirect(t, &os.Stdin, os.DevNull, os.O_RDONLY)
+	if isTerminal(os.Stdin) {
+		t.Fatalf("isTerminal(%s) = true", os.DevNull)
+	}
+	if err := confirm("Apply the plan?"); err == nil || !strings.Contains(err.Error(), "pass --auto-approve") {
+		t.Errorf("confirm() error = %v, want the --auto-approve hint", err)
+	}
+	if _, err := readPassword("Passphrase: "); err == nil || !strings.Contains(err.Error(), "set "+passphraseEnv) {
+		t.Errorf("readPassword() error = %v, want the %s hint", err, passphraseEnv)
+	}
+
+	// config init takes the defaults without prompting.
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	redirect(t, &os.Stdout, out, os.O_WRONLY|os.O_CREATE)
+	old := cfgFile
+	cfgFile = filepath.Join(dir, "clouddev.yaml")
+	defer func() { cfgFile = old }()
+	if err := configInitCmd.RunE(configInitCmd, nil); err != nil {
+		t.Fatalf("config init error = %v", err)
+	}
+	printed, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(printed), "Environment name [") {
+		t.Errorf("config init prompted without a terminal:\n%s", printed)
+	}
+	if _, err := os.Stat(cfgFile); err != nil {
+		t.Errorf("config init didn't write the config file: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/keys"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// placeholderKey stands for the key up generates for the environment.
+const placeholderKey = "ssh-ed25519 <generated by clouddev up>"
+
+// configRenderUserdataCmd represents the config render-userdata command
+var configRenderUserdataCmd = &cobra.Command{
+	Use:   "render-userdata",
+	Short: "Print the cloud-init user data of the environment",
+	Long: `Print the cloud-init user data up passes to the provider, rendered from
+the bootstrap section of the configuration, to inspect it before up.
+
+The size of the user data is checked against the limit of the provider. No
+SSH key is generated: a placeholder stands for it if the environment has none
+yet.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		p, err := provider.New(cfg)
+		if err != nil {
+			return err
+		}
+		defer provider.Close(p)
+
+		publicKey := placeholderKey
+		k, err := existingKey(cfg)
+		switch {
+		case err == nil:
+			publicKey = k.PublicKey
+		case !errors.Is(err, keys.ErrNotFound):
+			return err
+		}
+
+		data, err := userData(cfg, p, publicKey)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
+		}
+		if l, ok := p.(provider.UserDataLimiter); ok {
+			fmt.Fprintf(os.Stderr, "# %d of the %d bytes of user data allowed by %s\n", len(data), l.UserDataLimit(), cfg.Provider)
+		}
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configRenderUserdataCmd)
+}
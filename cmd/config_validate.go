@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Validate a config file",
+	Long: `Validate a config file against the configuration schema.
+
+All the problems found are reported and the command exits non-zero if there
+are any. The config file in use is validated if no file is given.
+
+Every profile in the file is validated unless one is selected with --profile.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var file string
+		if len(args) > 0 {
+			file = args[0]
+		} else {
+			var err error
+			if file, err = configFile(); err != nil {
+				return err
+			}
+		}
+		opts, err := configOptions()
+		if err != nil {
+			return err
+		}
+		opts.Validate = provider.Validate
+
+		profiles := []string{opts.Profile}
+		if opts.Profile == "" {
+			names, err := config.Profiles(file)
+			if err != nil {
+				return err
+			}
+			if len(names) > 0 {
+				profiles = names
+			}
+		}
+
+		invalid := false
+		for _, p := range profiles {
+			opts.Profile = p
+			if _, err := config.Load(file, opts); err != nil {
+				if p != "" {
+					fmt.Printf("profile %s: ", p)
+				}
+				fmt.Println(err)
+				invalid = true
+			}
+		}
+		if invalid {
+			return errors.New("configuration is invalid")
+		}
+		fmt.Printf("%s: configuration is valid\n", file)
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+}
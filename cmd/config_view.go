@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// configViewCmd represents the config view command
+var configViewCmd = &cobra.Command{
+	Use:   "view",
+	Short: "Print the effective configuration",
+	Long: `Print the effective configuration, merged from the defaults, the config
+file, environment variables and --set flags, with the source of every value.
+
+With --profile, the profile section of the config file is merged over the
+defaults section.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := configFile()
+		if err != nil {
+			return err
+		}
+		opts, err := configOptions()
+		if err != nil {
+			return err
+		}
+		opts.Validate = provider.Validate
+
+		r, err := config.Resolve(file, opts)
+		if err != nil {
+			return err
+		}
+		if err := printResolved(os.Stdout, r); err != nil {
+			return err
+		}
+		return r.Err()
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configViewCmd)
+}
+
+// printResolved prints the resolved configuration as YAML with the source of
+// every value in a trailing comment.
+func printResolved(w io.Writer, r *config.Resolved) error {
+	if r.Profile != "" {
+		fmt.Fprintf(w, "# profile: %s\n", r.Profile)
+	}
+	var parents []string
+	for _, key := range config.Keys() {
+		path := strings.Split(key, ".")
+		depth := len(path) - 1
+
+		// Open the parent mappings that differ from the previous key's.
+		common := 0
+		for common < len(parents) && common < depth && parents[common] == path[common] {
+			common++
+		}
+		for i := common; i < depth; i++ {
+			fmt.Fprintf(w, "%s%s:\n", strings.Repeat("  ", i), path[i])
+		}
+		parents = path[:depth]
+
+		indent := strings.Repeat("  ", depth)
+		value := r.Value(key)
+		out, err := yaml.Marshal(value)
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+
+		line := fmt.Sprintf("%s%s:", indent, path[depth])
+		if !isBlock(value) {
+			line += " " + lines[0]
+			lines = nil
+		}
+		fmt.Fprintf(w, "%-40s # %s\n", line, sourceAnnotation(r, key))
+		for _, l := range lines {
+			fmt.Fprintf(w, "%s  %s\n", indent, l)
+		}
+	}
+	return nil
+}
+
+// isBlock returns true if the value is marshalled as a YAML block rather
+// than inline.
+func isBlock(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() > 0
+	}
+	return false
+}
+
+func sourceAnnotation(r *config.Resolved, key string) string {
+	switch src := r.Source(key); src {
+	case config.SourceEnv:
+		return fmt.Sprintf("%s (%s)", src, config.EnvVar(key))
+	case config.SourceFile:
+		if section := r.Section(key); section != "" {
+			return fmt.Sprintf("%s (%s, %s)", src, r.File, section)
+		}
+		return fmt.Sprintf("%s (%s)", src, r.File)
+	case config.SourceFlag:
+		return fmt.Sprintf("%s (--set %s)", src, key)
+	default:
+		return string(src)
+	}
+}
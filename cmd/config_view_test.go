@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+func TestPrintResolved(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "clouddev.yaml")
+	content := "provider: fake\ndefaults:\n  machine_type: small\nprofiles:\n  build:\n    disk:\n      size_gb: 100\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLOUDDEV_REGION", "us-east-1")
+	r, err := config.Resolve(file, config.Options{Profile: "build", Overrides: map[string]string{"ssh.user": "dev"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := printResolved(&b, r); err != nil {
+		t.Fatalf("printResolved() error = %v", err)
+	}
+	out := b.String()
+
+	want := []string{
+		`# profile: build`,
+		`provider: fake +# file \(` + regexp.QuoteMeta(file) + `\)`,
+		`region: us-east-1 +# env \(CLOUDDEV_REGION\)`,
+		`machine_type: small +# file \(` + regexp.QuoteMeta(file) + `, defaults\)`,
+		`  size_gb: 100 +# file \(` + regexp.QuoteMeta(file) + `, profiles.build\)`,
+		`  user: dev +# flag \(--set ssh.user\)`,
+		`  type: "" +# default`,
+	}
+	for _, w := range want {
+		if !regexp.MustCompile(`(?m)^` + w + `$`).MatchString(out) {
+			t.Errorf("printResolved() has no line %q:\n%s", w, out)
+		}
+	}
+
+	// The output is the configuration the way it's written in the file.
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal([]byte(out), &settings); err != nil {
+		t.Fatalf("printResolved() wrote invalid YAML: %v\n%s", err, out)
+	}
+	if settings["name"] != "build" || settings["disk"].(map[interface{}]interface{})["size_gb"] != 100 {
+		t.Errorf("printResolved() = %v, want the resolved configuration", settings)
+	}
+}
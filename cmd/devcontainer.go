@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/devcontainer"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/remote"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// loadDevcontainer loads the devcontainer.json of the repository at path
+// and sizes the configured machine for its hostRequirements. The properties
+// clouddev doesn't support are reported.
+func loadDevcontainer(cfg *config.Config, p provider.Provider, path string) (*devcontainer.Config, error) {
+	dc, err := devcontainer.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(dc.Unsupported) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: clouddev doesn't support these properties of %s, they're ignored: %s\n",
+			dc.Path, strings.Join(dc.Unsupported, ", "))
+	}
+
+	h := dc.HostRequirements
+	if h == nil {
+		return dc, nil
+	}
+	memoryMB, err := h.MemoryMB()
+	if err != nil {
+		return nil, err
+	}
+	if h.CPUs > 0 || memoryMB > 0 {
+		s, ok := p.(provider.Sizer)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Warning: provider %s can't pick a machine type for the hostRequirements of %s, using %s\n",
+				cfg.Provider, dc.Path, cfg.MachineType)
+		} else {
+			machineType, err := provider.MachineTypeFor(s, cfg.MachineType, h.CPUs, memoryMB)
+			if err != nil {
+				return nil, fmt.Errorf("hostRequirements of %s: %w", dc.Path, err)
+			}
+			if machineType != cfg.MachineType {
+				fmt.Printf("Using machine type %s for the hostRequirements of %s\n", machineType, dc.Path)
+				cfg.MachineType = machineType
+			}
+		}
+	}
+	storageGB, err := h.StorageGB()
+	if err != nil {
+		return nil, err
+	}
+	if storageGB > cfg.Disk.SizeGB {
+		fmt.Printf("Using a %d GB disk for the hostRequirements of %s\n", storageGB, dc.Path)
+		cfg.Disk.SizeGB = storageGB
+	}
+	return dc, nil
+}
+
+// runDevcontainer runs the devcontainer on the machine of the environment
+// and records it in its state, with its forwarded ports.
+func runDevcontainer(ctx context.Context, cfg *config.Config, store state.Backend, env *state.Environment, dc *devcontainer.Config) error {
+	target, err := envTarget(ctx, cfg, env)
+	if err != nil {
+		return err
+	}
+	c, err := remote.Dial(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	r := &devcontainer.Runner{
+		Config: dc,
+		Env:    env.Name,
+		Out:    os.Stdout,
+	}
+	if err := r.Up(ctx, c); err != nil {
+		return err
+	}
+	env.Devcontainer = dc.Path
+	env.ForwardPorts = dc.Ports()
+	if err := store.Put(ctx, env); err != nil {
+		return err
+	}
+	if cfg.SSH.WriteConfig {
+		if err := writeHostEntry(env); err != nil {
+			return err
+		}
+	}
+	if len(env.ForwardPorts) > 0 {
+		ports := make([]string, len(env.ForwardPorts))
+		for i, port := range env.ForwardPorts {
+			ports[i] = strconv.Itoa(port)
+		}
+		if cfg.SSH.WriteConfig {
+			fmt.Printf("Ports %s are forwarded to localhost while ssh %s is connected\n", strings.Join(ports, ", "), remote.HostAlias(env.Name))
+		} else {
+			fmt.Printf("Set ssh.write_config to forward ports %s to localhost\n", strings.Join(ports, ", "))
+		}
+	}
+	fmt.Printf("Open a shell in the devcontainer with: clouddev ssh %s -t -- %s\n", env.Name, r.ExecCommand())
+	return nil
+}
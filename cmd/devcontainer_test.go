@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/fake"
+)
+
+func TestLoadDevcontainerSizesTheMachine(t *testing.T) {
+	tests := []struct {
+		name         string
+		requirements string
+		// noSizer is set for a provider that doesn't know the sizes of its
+		// machine types.
+		noSizer     bool
+		machineType string
+		diskGB      int
+		err         string
+	}{
+		{name: "none", requirements: `{}`, machineType: "medium", diskGB: 30},
+		{name: "configured type is enough", requirements: `{"cpus": 2, "memory": "4gb"}`, machineType: "medium", diskGB: 30},
+		{name: "larger type", requirements: `{"cpus": 2, "memory": "8gb"}`, machineType: "large", diskGB: 30},
+		{name: "cpus only", requirements: `{"cpus": 3}`, machineType: "large", diskGB: 30},
+		{name: "larger disk", requirements: `{"storage": "64gb"}`, machineType: "medium", diskGB: 64},
+		{name: "smaller disk", requirements: `{"storage": "16gb"}`, machineType: "medium", diskGB: 30},
+		{name: "too large", requirements: `{"cpus": 64}`, err: "no machine type has 64 CPUs and 0 MiB of memory"},
+		{name: "provider without sizes", requirements: `{"cpus": 64, "storage": "40gb"}`, noSizer: true, machineType: "medium", diskGB: 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, ".devcontainer.json")
+			content := `{"image": "debian", "hostRequirements": ` + tt.requirements + `}`
+			if err := ioutil.WriteFile(file, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &config.Config{Provider: "fake", MachineType: "medium", Disk: config.Disk{SizeGB: 30}}
+			var p provider.Provider = fake.New()
+			if tt.noSizer {
+				p = struct{ provider.Provider }{p}
+			}
+
+			dc, err := loadDevcontainer(cfg, p, dir)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("loadDevcontainer() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadDevcontainer() error = %v", err)
+			}
+			if dc.Path != file {
+				t.Errorf("loadDevcontainer() path = %s, want %s", dc.Path, file)
+			}
+			if cfg.MachineType != tt.machineType || cfg.Disk.SizeGB != tt.diskGB {
+				t.Errorf("machine type %s and %d GB disk, want %s and %d GB", cfg.MachineType, cfg.Disk.SizeGB, tt.machineType, tt.diskGB)
+			}
+		})
+	}
+
+	// A devcontainer.json without hostRequirements keeps the machine.
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, ".devcontainer.json"), []byte(`{"image": "debian"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Provider: "fake", MachineType: "small", Disk: config.Disk{SizeGB: 10}}
+	if _, err := loadDevcontainer(cfg, fake.New(), dir); err != nil || cfg.MachineType != "small" || cfg.Disk.SizeGB != 10 {
+		t.Errorf("loadDevcontainer() = machine type %s, %d GB disk, %v, want them unchanged", cfg.MachineType, cfg.Disk.SizeGB, err)
+	}
+	if _, err := loadDevcontainer(cfg, fake.New(), filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("loadDevcontainer() of a missing repository error = %v", err)
+	}
+}
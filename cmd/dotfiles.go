@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/dotfiles"
+	"github.com/darkowlzz/clouddev/keys"
+	"github.com/darkowlzz/clouddev/remote"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// dotfilesCmd represents the dotfiles command
+var dotfilesCmd = &cobra.Command{
+	Use:   "dotfiles",
+	Short: "Manage the dotfiles of the environments",
+	Long: `Manage the dotfiles of the environments.
+
+The dotfiles section of the configuration is a local directory, uploaded to
+the machine, or a git repository, cloned on the machine. up installs them
+once the machine is ready, with their install script or by symlinking their
+files in the home directory, and again when the dotfiles section changes.`,
+}
+
+func init() {
+	rootCmd.AddCommand(dotfilesCmd)
+}
+
+// installDotfiles installs the configured dotfiles on the machine of the
+// environment and records it in its state.
+func installDotfiles(ctx context.Context, cfg *config.Config, store state.Backend, env *state.Environment) error {
+	file, err := configFile()
+	if err != nil {
+		return err
+	}
+	target, err := envTarget(ctx, cfg, env)
+	if err != nil {
+		return err
+	}
+	c, err := remote.Dial(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	i := &dotfiles.Installer{
+		Config: &cfg.Dotfiles,
+		Dir:    filepath.Dir(file),
+		Out:    os.Stdout,
+	}
+	// Private repositories are cloned with the keys of the user.
+	if cfg.Dotfiles.Repo != "" {
+		a, closeAgent, err := keys.Agent()
+		switch {
+		case err == nil:
+			defer closeAgent()
+			i.Agent = a
+		case !errors.Is(err, keys.ErrNoAgent):
+			return err
+		}
+	}
+	if err := i.Install(ctx, c); err != nil {
+		return err
+	}
+	if env.Dotfiles, err = cfg.Dotfiles.Hash(); err != nil {
+		return err
+	}
+	return store.Put(ctx, env)
+}
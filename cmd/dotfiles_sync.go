@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// dotfilesSyncCmd represents the dotfiles sync command
+var dotfilesSyncCmd = &cobra.Command{
+	Use:   "sync [name]",
+	Short: "Install the dotfiles on a running environment again",
+	Long: `Install the configured dotfiles on a running environment again, e.g. after
+changing them. A local directory is uploaded again and a repository is
+fetched and checked out again before installing. The environment is the
+configured one unless named.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if !cfg.Dotfiles.Enabled() {
+			return errors.New("no dotfiles are configured, set dotfiles.path or dotfiles.repo")
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+		name := envName(cfg, args)
+		return withLock(cmd.Context(), store, name, func(ctx context.Context) error {
+			env, err := store.Get(ctx, name)
+			if errors.Is(err, state.ErrNotFound) {
+				return fmt.Errorf("environment %s is not provisioned", name)
+			}
+			if err != nil {
+				return err
+			}
+			if err := installDotfiles(ctx, cfg, store, env); err != nil {
+				return err
+			}
+			fmt.Printf("Installed the dotfiles on environment %s\n", name)
+			return nil
+		})
+	},
+}
+
+func init() {
+	dotfilesCmd.AddCommand(dotfilesSyncCmd)
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/ansible"
+)
+
+var inventoryOutput string
+
+// inventoryCmd represents the inventory command
+var inventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "Print the Ansible inventory of the environments",
+	Long: `Print the Ansible inventory of the provisioned environments, in the
+clouddev group, with the address, user and key recorded by up and the
+ansible.vars of the environments. The vars are the configured ones for the
+configured environment, and the ones the playbooks were last applied with
+for the others. The environments without a recorded address are left out.`,
+	Example: `  clouddev inventory > inventory.ini
+  clouddev inventory -o yaml
+  ansible -i <(clouddev inventory) clouddev -m ping`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if inventoryOutput != "ini" && inventoryOutput != "yaml" {
+			return fmt.Errorf("invalid output format %q, expected ini or yaml", inventoryOutput)
+		}
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+		envs, err := store.List(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		var hosts []*ansible.Host
+		for _, env := range envs {
+			if env.Address == "" {
+				continue
+			}
+			vars := env.AnsibleVars
+			if env.Name == cfg.Name {
+				vars = cfg.Ansible.Vars
+			}
+			h, err := ansibleHost(env, vars)
+			if err != nil {
+				return err
+			}
+			hosts = append(hosts, h)
+		}
+		if inventoryOutput == "yaml" {
+			return ansible.WriteYAML(os.Stdout, hosts)
+		}
+		return ansible.WriteINI(os.Stdout, hosts)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inventoryCmd)
+
+	inventoryCmd.Flags().StringVarP(&inventoryOutput, "output", "o", "ini", "inventory format, ini or yaml")
+}
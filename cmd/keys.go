@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/keys"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// passphraseEnv is the environment variable the passphrase of a generated
+// key is read from instead of the terminal.
+var passphraseEnv = config.EnvPrefix + "_KEY_PASSPHRASE"
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the SSH keys of the environments",
+	Long: `Manage the SSH keys of the environments.
+
+Unless ssh.public_key or ssh.private_key is set, up generates an ed25519 key
+for the environment in $HOME/.clouddev/keys/<name>, and clean deletes it.
+With ssh.key_passphrase, the key is protected by a passphrase, read from the
+terminal or $` + passphraseEnv + `, and the decrypted key is added to ssh-agent.`,
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+}
+
+// openKeys returns the store of the generated keys.
+func openKeys() (*keys.Store, error) {
+	dir, err := keys.DefaultDir()
+	if err != nil {
+		return nil, err
+	}
+	return keys.NewStore(dir), nil
+}
+
+// managedKey returns true if the key of the environment is generated by
+// clouddev.
+func managedKey(cfg *config.Config) bool {
+	private, _ := cfg.SSH.KeyPaths()
+	return private == ""
+}
+
+// sshKey returns the key to log in to the environment with: the configured
+// one, or the generated one, generating it if needed.
+func sshKey(cfg *config.Config) (*keys.Key, error) {
+	k, err := existingKey(cfg)
+	if errors.Is(err, keys.ErrNotFound) {
+		store, err := openKeys()
+		if err != nil {
+			return nil, err
+		}
+		return generateKey(cfg, store.Generate)
+	}
+	return k, err
+}
+
+// existingKey is like sshKey, but returns keys.ErrNotFound instead of
+// generating the key.
+func existingKey(cfg *config.Config) (*keys.Key, error) {
+	if !managedKey(cfg) {
+		return configuredKey(cfg)
+	}
+	store, err := openKeys()
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(cfg.Name)
+}
+
+// configuredKey returns the key set in the config. Only the public key has
+// to exist, the private key may only be in ssh-agent.
+func configuredKey(cfg *config.Config) (*keys.Key, error) {
+	private, public := cfg.SSH.KeyPaths()
+	private, err := homedir.Expand(private)
+	if err != nil {
+		return nil, err
+	}
+	public, err = homedir.Expand(public)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the SSH public key: %w", err)
+	}
+	return &keys.Key{Path: private, PublicKey: strings.TrimSpace(string(data))}, nil
+}
+
+// generateKey generates a key for the environment with generate, asking for
+// its passphrase if configured.
+func generateKey(cfg *config.Config, generate func(env string, passphrase []byte) (*keys.Key, error)) (*keys.Key, error) {
+	var passphrase []byte
+	if cfg.SSH.KeyPassphrase {
+		var err error
+		if passphrase, err = newPassphrase(); err != nil {
+			return nil, err
+		}
+	}
+	k, err := generate(cfg.Name, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the SSH key: %w", err)
+	}
+	fmt.Printf("Generated SSH key %s\n", k.Path)
+	if k.Encrypted {
+		if err := keys.AddToAgent(k, passphrase); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: the key isn't added to ssh-agent, its passphrase will be asked again: %v\n", err)
+		}
+	}
+	return k, nil
+}
+
+// newPassphrase reads the passphrase of a new key.
+func newPassphrase() ([]byte, error) {
+	if p, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(p), nil
+	}
+	p, err := readPassword("Passphrase of the new SSH key: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := readPassword("Repeat the passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p, again) {
+		return nil, errors.New("the passphrases don't match")
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase, unset ssh.key_passphrase for a key without passphrase")
+	}
+	return p, nil
+}
+
+// keyPassphrase asks for the passphrase of an existing key.
+func keyPassphrase(k *keys.Key) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if p, ok := os.LookupEnv(passphraseEnv); ok {
+			return []byte(p), nil
+		}
+		return readPassword(fmt.Sprintf("Passphrase of %s: ", k.Path))
+	}
+}
+
+// readPassword reads a password from the terminal without echoing it.
+func readPassword(prompt string) ([]byte, error) {
+	if !isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("can't ask for the key passphrase without a terminal, set %s", passphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return p, err
+}
+
+// machineTarget returns the SSH target of a running machine of provider p.
+func machineTarget(ctx context.Context, cfg *config.Config, p provider.Provider, m *provider.Machine, k *keys.Key) (*remote.Target, error) {
+	if m.Status != provider.StatusRunning {
+		return nil, fmt.Errorf("environment %s is %s, run clouddev up", cfg.Name, m.Status)
+	}
+	if m.Address == "" {
+		return nil, fmt.Errorf("environment %s has no address", cfg.Name)
+	}
+	signer, err := keys.Signer(k, keyPassphrase(k))
+	if err != nil {
+		return nil, err
+	}
+	target := &remote.Target{
+		Host:   m.Address,
+		Port:   m.SSHPort,
+		User:   cfg.SSH.User,
+		Signer: signer,
+	}
+	if target.HostKeyCallback, err = hostKeyCallback(ctx, p, m.ID, target.Addr()); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// authorizeKey adds a public key to the authorized keys of the SSH user.
+func authorizeKey(ctx context.Context, c *remote.Client, publicKey string) error {
+	_, err := c.Output(ctx, fmt.Sprintf(`umask 077 && mkdir -p ~/.ssh && echo %s >> ~/.ssh/authorized_keys`, remote.Quote(publicKey)))
+	return err
+}
+
+// revokeKey removes a public key from the authorized keys of the SSH user.
+func revokeKey(ctx context.Context, c *remote.Client, publicKey string) error {
+	// Match the key type and data, not the comment.
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid public key %q", publicKey)
+	}
+	f := "~/.ssh/authorized_keys"
+	_, err := c.Output(ctx, fmt.Sprintf(`umask 077 && { grep -vF -- %s %s || true; } > %s.clouddev && mv %s.clouddev %s`,
+		remote.Quote(fields[0]+" "+fields[1]), f, f, f, f))
+	return err
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/keys"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/remote"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// keysRotateCmd represents the keys rotate command
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace the SSH key of the environment",
+	Long: `Replace the generated SSH key of the environment with a new one.
+
+The new key is authorized on the running machine with the current key, and
+the current key is revoked once the new one logs in. The current key is kept
+if anything fails.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if !managedKey(cfg) {
+			return errors.New("the environment uses the key set in ssh.public_key or ssh.private_key, clouddev only rotates the keys it generated")
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+		return withLock(cmd.Context(), store, cfg.Name, func(ctx context.Context) (err error) {
+			env, err := store.Get(ctx, cfg.Name)
+			if errors.Is(err, state.ErrNotFound) {
+				return fmt.Errorf("environment %s is not provisioned", cfg.Name)
+			}
+			if err != nil {
+				return err
+			}
+			if err := checkProvider(cfg, env); err != nil {
+				return err
+			}
+			p, err := provider.New(cfg)
+			if err != nil {
+				return err
+			}
+			defer provider.Close(p)
+			m, err := p.Get(ctx, env.Resources[provider.ResourceInstance])
+			if err != nil {
+				return err
+			}
+
+			ks, err := openKeys()
+			if err != nil {
+				return err
+			}
+			current, err := ks.Get(cfg.Name)
+			if err != nil {
+				return err
+			}
+			// The key of a rotation that failed after the revoke is the only
+			// one the machine accepts.
+			if left, err := ks.Next(cfg.Name); err == nil {
+				return fmt.Errorf("the new key %s of a previous rotation wasn't committed, move it and its public key over the current key if the machine only accepts it, or delete them", left.Path)
+			}
+			target, err := machineTarget(ctx, cfg, p, m, current)
+			if err != nil {
+				return err
+			}
+			next, err := generateKey(cfg, ks.GenerateNext)
+			if err != nil {
+				return err
+			}
+			// Once the current key is revoked, the new one is the only key the
+			// machine accepts.
+			revoked := false
+			defer func() {
+				if err != nil && !revoked {
+					_ = ks.Discard(cfg.Name)
+				}
+			}()
+
+			fmt.Printf("Authorizing the new key on %s...\n", m.Address)
+			c, err := remote.Dial(ctx, target)
+			if err != nil {
+				return err
+			}
+			err = authorizeKey(ctx, c, next.PublicKey)
+			c.Close()
+			if err != nil {
+				return fmt.Errorf("failed to authorize the new key: %w", err)
+			}
+
+			if target.Signer, err = keys.Signer(next, keyPassphrase(next)); err != nil {
+				return err
+			}
+			c, err = remote.Dial(ctx, target)
+			if err != nil {
+				return fmt.Errorf("failed to log in with the new key, the current key is still authorized: %w", err)
+			}
+			defer c.Close()
+			fmt.Println("Revoking the current key...")
+			if err := revokeKey(ctx, c, current.PublicKey); err != nil {
+				return fmt.Errorf("failed to revoke the current key, both keys are authorized: %w", err)
+			}
+			revoked = true
+			if err := ks.Commit(cfg.Name); err != nil {
+				return fmt.Errorf("failed to replace the current key, the machine only accepts the new key %s: %w", next.Path, err)
+			}
+			fmt.Printf("Rotated the SSH key of environment %s\n", cfg.Name)
+			return nil
+		})
+	},
+}
+
+func init() {
+	keysCmd.AddCommand(keysRotateCmd)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider/plugin"
+)
+
+// pluginsCmd represents the plugins command
+var pluginsCmd = &cobra.Command{
+	Use:   "plugins [name]",
+	Short: "List the provider plugins",
+	Long: `List the provider plugins found in $HOME/.clouddev/plugins and PATH.
+
+The plugin of the provider "foo" is an executable named clouddev-provider-foo.
+Given a plugin name, the plugin is started and the provider_options it
+accepts are printed.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		plugins := plugin.Discover(plugin.Dirs())
+		if len(args) == 0 {
+			if len(plugins) == 0 {
+				fmt.Println("No plugins found")
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tPATH")
+			for _, info := range plugins {
+				fmt.Fprintf(w, "%s\t%s\n", info.Name, info.Path)
+			}
+			return w.Flush()
+		}
+
+		for _, info := range plugins {
+			if info.Name != args[0] {
+				continue
+			}
+			c := config.Default()
+			c.Provider = info.Name
+			p := plugin.New(info, c)
+			defer p.Close()
+			schema, err := p.Schema(cmd.Context())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Plugin %s (%s)\n", info.Name, info.Path)
+			if len(schema.Options) == 0 {
+				fmt.Println("No provider_options")
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "OPTION\tTYPE\tDEFAULT\tDESCRIPTION")
+			for _, o := range schema.Options {
+				def := ""
+				if o.Required {
+					def = "required"
+				} else if o.Default != nil {
+					def = fmt.Sprint(o.Default)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", o.Name, o.Type, def, o.Description)
+			}
+			return w.Flush()
+		}
+		return fmt.Errorf("plugin %s not found, expected an executable named %s%s in $HOME/.clouddev/plugins or PATH", args[0], plugin.Prefix, args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pluginsCmd)
+}
@@ -0,0 +1,23 @@
+package cmd
+
+// The providers available to up and clean.
+import (
+	"github.com/spf13/cobra"
+
+	_ "github.com/darkowlzz/clouddev/provider/aws"
+	_ "github.com/darkowlzz/clouddev/provider/azure"
+	_ "github.com/darkowlzz/clouddev/provider/digitalocean"
+	_ "github.com/darkowlzz/clouddev/provider/docker"
+	_ "github.com/darkowlzz/clouddev/provider/gce"
+	_ "github.com/darkowlzz/clouddev/provider/hetzner"
+	_ "github.com/darkowlzz/clouddev/provider/kubernetes"
+	_ "github.com/darkowlzz/clouddev/provider/libvirt"
+	_ "github.com/darkowlzz/clouddev/provider/openstack"
+	"github.com/darkowlzz/clouddev/provider/plugin"
+	_ "github.com/darkowlzz/clouddev/provider/proxmox"
+)
+
+func init() {
+	// The built in providers take precedence over the plugins.
+	cobra.OnInitialize(plugin.RegisterAll)
+}
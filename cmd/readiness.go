@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/keys"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/readiness"
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// waitReady waits for the running machine to be ready as configured in the
+// readiness section, writing the progress and the cloud-init output to
+// stdout.
+func waitReady(ctx context.Context, cfg *config.Config, p provider.Provider, m *provider.Machine) error {
+	if m.Address == "" {
+		return fmt.Errorf("environment %s has no address", cfg.Name)
+	}
+	k, err := sshKey(cfg)
+	if err != nil {
+		return err
+	}
+	signer, err := keys.Signer(k, keyPassphrase(k))
+	if err != nil {
+		return err
+	}
+	target := &remote.Target{
+		Host:   m.Address,
+		Port:   m.SSHPort,
+		User:   cfg.SSH.User,
+		Signer: signer,
+	}
+	knownHosts, err := remote.DefaultKnownHosts()
+	if err != nil {
+		return err
+	}
+	hostKeys := remote.KnownHosts(knownHosts)
+
+	g := &readiness.Gate{
+		Dial: func(ctx context.Context) (*remote.Client, error) {
+			// cloud-init prints the host keys on the console once it
+			// generated them, which may be after the machine was created.
+			// They're trusted on first use with a warning if they aren't
+			// printed by the time SSH is up.
+			callback := hostKeys
+			if known, err := remote.Known(knownHosts, target.Addr()); err == nil && !known {
+				if err := pinHostKeys(ctx, p, m.ID, target.Addr()); err != nil {
+					callback = warnTOFU(hostKeys, err)
+				}
+			}
+			var keyErr error
+			target.HostKeyCallback = func(hostname string, addr net.Addr, key ssh.PublicKey) error {
+				keyErr = callback(hostname, addr, key)
+				return keyErr
+			}
+			c, err := remote.Dial(ctx, target)
+			if keyErr != nil {
+				return nil, readiness.Permanent(keyErr)
+			}
+			return c, err
+		},
+		Host:   m.Address,
+		Config: &cfg.Readiness,
+		Log:    os.Stdout,
+	}
+	return g.Wait(ctx)
+}
@@ -1,22 +1,37 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
 )
 
-var cfgFile string
+var (
+	cfgFile   string
+	overrides []string
+)
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "clouddev",
 	Short: "clouddev helps with development on cloud",
 	Long:  `clouddev helps with workflows for development on cloud environment.`,
+	// Errors are printed by Execute, and a configuration error report is
+	// more useful without the usage text after it.
+	SilenceErrors: true,
+	SilenceUsage:  true,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
@@ -25,12 +40,30 @@ var rootCmd = &cobra.Command{
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	// Cancel the running provider operations on interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		var exit *exitError
+		if errors.As(err, &exit) {
+			os.Exit(exit.code)
+		}
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
+// exitError exits with the code without printing anything, e.g. with the
+// exit status of a remote command.
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
@@ -39,6 +72,11 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.clouddev.yaml)")
+	rootCmd.PersistentFlags().String("profile", "", "profile in the config file to use (default is $CLOUDDEV_PROFILE)")
+	rootCmd.PersistentFlags().StringArrayVar(&overrides, "set", nil, "override a config value, e.g. --set disk.size_gb=50 (can be repeated)")
+
+	_ = viper.BindPFlag("profile", rootCmd.PersistentFlags().Lookup("profile"))
+	_ = viper.BindEnv("profile", config.EnvPrefix+"_PROFILE")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -63,6 +101,46 @@ func initConfig() {
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	}
+}
+
+// configFile returns the config file found by initConfig.
+func configFile() (string, error) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return "", errors.New("no config file found, run \"clouddev config init\" or pass --config")
+	}
+	return file, nil
+}
+
+// configOptions returns the config loading options set by the flags.
+func configOptions() (config.Options, error) {
+	opts := config.Options{
+		Profile:   viper.GetString("profile"),
+		Overrides: map[string]string{},
+	}
+	for _, o := range overrides {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return opts, fmt.Errorf("invalid --set %q, expected key=value", o)
+		}
+		opts.Overrides[strings.ToLower(kv[0])] = kv[1]
+	}
+	return opts, nil
+}
+
+// loadConfig loads and validates the environment configuration from the
+// config file found by initConfig.
+func loadConfig() (*config.Config, error) {
+	file, err := configFile()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := configOptions()
+	if err != nil {
+		return nil, err
 	}
+	opts.Validate = provider.Validate
+	return config.Load(file, opts)
 }
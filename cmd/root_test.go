@@ -0,0 +1,42 @@
+package cmd
+
+import "testing"
+
+func TestProfileFlagAndEnv(t *testing.T) {
+	flag := rootCmd.PersistentFlags().Lookup("profile")
+	tests := []struct {
+		name string
+		env  string
+		flag string
+		want string
+	}{
+		{name: "neither"},
+		{name: "environment variable", env: "build", want: "build"},
+		{name: "flag", flag: "gpu", want: "gpu"},
+		{name: "flag over environment variable", env: "build", flag: "gpu", want: "gpu"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("CLOUDDEV_PROFILE", tt.env)
+			}
+			if tt.flag != "" {
+				if err := flag.Value.Set(tt.flag); err != nil {
+					t.Fatal(err)
+				}
+				flag.Changed = true
+				t.Cleanup(func() {
+					_ = flag.Value.Set("")
+					flag.Changed = false
+				})
+			}
+			opts, err := configOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Profile != tt.want {
+				t.Errorf("profile = %q, want %q", opts.Profile, tt.want)
+			}
+		})
+	}
+}
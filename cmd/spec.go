@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/darkowlzz/clouddev/bootstrap"
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/keys"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// newSpec returns the spec of the configured environment on provider p.
+func newSpec(cfg *config.Config, p provider.Provider) (*provider.Spec, error) {
+	key, err := sshKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return keySpec(cfg, p, key.PublicKey)
+}
+
+// planSpec is like newSpec, but doesn't generate the key of the environment:
+// the spec has a placeholder key if it isn't generated yet, and placeholder
+// is true. Plans don't depend on the key, only the machines created do.
+func planSpec(cfg *config.Config, p provider.Provider) (spec *provider.Spec, placeholder bool, err error) {
+	key, err := existingKey(cfg)
+	if errors.Is(err, keys.ErrNotFound) {
+		spec, err = keySpec(cfg, p, placeholderKey)
+		return spec, true, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	spec, err = keySpec(cfg, p, key.PublicKey)
+	return spec, false, err
+}
+
+// keySpec returns the spec of the configured environment on provider p, with
+// the public key.
+func keySpec(cfg *config.Config, p provider.Provider, publicKey string) (*provider.Spec, error) {
+	data, err := userData(cfg, p, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &provider.Spec{Config: cfg, SSHPublicKey: publicKey, UserData: data}, nil
+}
+
+// userData renders the cloud-init user data that creates the SSH user and
+// runs the bootstrap of the machine, and checks it fits in the limit of
+// provider p.
+func userData(cfg *config.Config, p provider.Provider, publicKey string) ([]byte, error) {
+	file, err := configFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := bootstrap.Render(cfg, publicKey, filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := p.(provider.UserDataLimiter); ok {
+		if err := bootstrap.CheckSize(data, l.UserDataLimit(), cfg.Provider); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,364 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/keys"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/remote"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+var (
+	sshForceTTY     bool
+	sshNoTTY        bool
+	sshForwardAgent bool
+)
+
+// sshCmd represents the ssh command
+var sshCmd = &cobra.Command{
+	Use:   "ssh [name] [-- command...]",
+	Short: "Log in to an environment over SSH",
+	Long: `Log in to an environment over SSH, or run a command on it.
+
+The address, user and key recorded by up are used, and the host key is
+checked against $HOME/.clouddev/known_hosts, where up pins the host keys
+cloud-init printed on the console of the machine when the provider can read
+it. The environment is the configured one unless named.
+
+With ssh.write_config, up also keeps a "Host clouddev-<name>" entry in
+~/.ssh/config for ssh, scp and editors, and clean removes it.`,
+	Example: `  clouddev ssh
+  clouddev ssh -A
+  clouddev ssh dev -- uname -a`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if n := cmd.ArgsLenAtDash(); n > 1 || n < 0 && len(args) > 1 {
+			return errors.New("expected at most one environment name, pass the command after --")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if sshForceTTY && sshNoTTY {
+			return errors.New("-t and -T can't be used together")
+		}
+		names, command := args, []string(nil)
+		if n := cmd.ArgsLenAtDash(); n >= 0 {
+			names, command = args[:n], args[n:]
+		}
+
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+		ctx := cmd.Context()
+		name := envName(cfg, names)
+		env, err := store.Get(ctx, name)
+		if errors.Is(err, state.ErrNotFound) {
+			return fmt.Errorf("environment %s is not provisioned", name)
+		}
+		if err != nil {
+			return err
+		}
+		target, err := envTarget(ctx, cfg, env)
+		if err != nil {
+			return err
+		}
+		c, err := remote.Dial(ctx, target)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		s := &remote.Session{
+			Command: strings.Join(command, " "),
+			Stdin:   os.Stdin,
+			Stdout:  os.Stdout,
+			Stderr:  os.Stderr,
+		}
+		if sshForwardAgent {
+			a, closeAgent, err := keys.Agent()
+			if err != nil {
+				return err
+			}
+			defer closeAgent()
+			s.ForwardAgent = a
+		}
+
+		fd := int(os.Stdin.Fd())
+		if sshForceTTY || !sshNoTTY && len(command) == 0 && term.IsTerminal(fd) {
+			if !term.IsTerminal(fd) {
+				return errors.New("can't allocate a terminal, stdin is not a terminal")
+			}
+			width, height, err := term.GetSize(fd)
+			if err != nil {
+				return err
+			}
+			old, err := term.MakeRaw(fd)
+			if err != nil {
+				return err
+			}
+			defer term.Restore(fd, old)
+			resize, stop := watchResize(fd)
+			defer stop()
+			s.PTY = &remote.PTY{
+				Term:   os.Getenv("TERM"),
+				Size:   remote.WindowSize{Width: width, Height: height},
+				Resize: resize,
+			}
+		}
+
+		err = c.Attach(ctx, s)
+		var exit *ssh.ExitError
+		if errors.As(err, &exit) {
+			return &exitError{code: exit.ExitStatus()}
+		}
+		var missing *ssh.ExitMissingError
+		if errors.As(err, &missing) {
+			return &exitError{code: 255}
+		}
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshCmd)
+
+	sshCmd.Flags().BoolVarP(&sshForceTTY, "tty", "t", false, "allocate a terminal even for a command")
+	sshCmd.Flags().BoolVarP(&sshNoTTY, "no-tty", "T", false, "don't allocate a terminal")
+	sshCmd.Flags().BoolVarP(&sshForwardAgent, "forward-agent", "A", false, "forward ssh-agent to the machine")
+}
+
+// envTarget returns the SSH target of a provisioned environment, from the
+// access details recorded by up.
+func envTarget(ctx context.Context, cfg *config.Config, env *state.Environment) (*remote.Target, error) {
+	if env.Address == "" || env.SSHUser == "" {
+		return nil, fmt.Errorf("environment %s has no recorded address, run clouddev up", env.Name)
+	}
+	k, err := recordedKey(env)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := keys.Signer(k, keyPassphrase(k))
+	if err != nil {
+		return nil, err
+	}
+	target := &remote.Target{
+		Host: env.Address,
+		Port: env.SSHPort,
+		User: env.SSHUser,
+	}
+	// The host keys of the other environments can't be read with the
+	// configured provider.
+	var p provider.Provider
+	if env.Name == cfg.Name && env.Provider == cfg.Provider {
+		if p, err = provider.New(cfg); err != nil {
+			return nil, err
+		}
+		defer provider.Close(p)
+	}
+	if target.HostKeyCallback, err = hostKeyCallback(ctx, p, env.Resources[provider.ResourceInstance], target.Addr()); err != nil {
+		return nil, err
+	}
+	target.Signer = signer
+	return target, nil
+}
+
+// recordedKey returns the key recorded to log in to the environment.
+func recordedKey(env *state.Environment) (*keys.Key, error) {
+	if env.SSHKey == "" {
+		return nil, fmt.Errorf("environment %s has no recorded SSH key, run clouddev up", env.Name)
+	}
+	k, err := keys.Read(env.SSHKey)
+	if os.IsNotExist(err) {
+		// The private key may only be in ssh-agent.
+		pub, perr := ioutil.ReadFile(env.SSHKey + ".pub")
+		if perr != nil {
+			return nil, fmt.Errorf("SSH key %s of environment %s not found: %w", env.SSHKey, env.Name, err)
+		}
+		return &keys.Key{Path: env.SSHKey, PublicKey: strings.TrimSpace(string(pub))}, nil
+	}
+	return k, err
+}
+
+// hostKeyCallback returns the host key callback of the machine with the
+// given ID at the host:port address. Unless its host keys are known
+// already, they're pinned from the console output when p can read it, and
+// trusted on first use with a warning otherwise. p may be nil.
+func hostKeyCallback(ctx context.Context, p provider.Provider, id, addr string) (ssh.HostKeyCallback, error) {
+	path, err := remote.DefaultKnownHosts()
+	if err != nil {
+		return nil, err
+	}
+	known, err := remote.Known(path, addr)
+	if err != nil {
+		return nil, err
+	}
+	callback := remote.KnownHosts(path)
+	if known {
+		return callback, nil
+	}
+	pinErr := fmt.Errorf("%w: the console of machine %s can't be read with the configured provider", errNotPinned, id)
+	if p != nil {
+		pinErr = pinHostKeys(ctx, p, id, addr)
+	}
+	if pinErr != nil {
+		return warnTOFU(callback, pinErr), nil
+	}
+	return callback, nil
+}
+
+// warnTOFU wraps a host key callback to warn that the host key is trusted
+// on first use, as the host keys couldn't be pinned for err.
+func warnTOFU(callback ssh.HostKeyCallback, err error) ssh.HostKeyCallback {
+	return func(hostname string, addr net.Addr, key ssh.PublicKey) error {
+		fmt.Fprintf(os.Stderr, "Warning: %v, trusting the host key of %s on first use\n", err, hostname)
+		return callback(hostname, addr, key)
+	}
+}
+
+// errNotPinned is returned by pinHostKeys when the provider can't read the
+// console of the machine, or the host keys aren't printed on it.
+var errNotPinned = errors.New("the host keys aren't pinned")
+
+// pinHostKeys pins the host keys cloud-init printed on the console of the
+// machine with the given ID to its host:port address.
+func pinHostKeys(ctx context.Context, p provider.Provider, id, addr string) error {
+	r, ok := p.(provider.ConsoleReader)
+	if !ok {
+		return fmt.Errorf("%w: the provider can't read the console of machine %s", errNotPinned, id)
+	}
+	out, err := r.ConsoleOutput(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to read the console output of machine %s: %w", id, err)
+	}
+	hostKeys := remote.ConsoleHostKeys(out)
+	if len(hostKeys) == 0 {
+		return fmt.Errorf("%w: they aren't on the console of machine %s", errNotPinned, id)
+	}
+	path, err := remote.DefaultKnownHosts()
+	if err != nil {
+		return err
+	}
+	if err := remote.Pin(path, addr, hostKeys); err != nil {
+		return fmt.Errorf("failed to pin the host keys of %s: %w", addr, err)
+	}
+	return nil
+}
+
+// recordAccess records the address, user and key to log in to the machine
+// in the environment state, and pins its host keys if they're not known.
+// The ssh config entry of the environment is updated if configured.
+func recordAccess(ctx context.Context, p provider.Provider, store state.Backend, cfg *config.Config, env *state.Environment, m *provider.Machine) error {
+	k, err := sshKey(cfg)
+	if err != nil {
+		return err
+	}
+	knownHosts, err := remote.DefaultKnownHosts()
+	if err != nil {
+		return err
+	}
+	if env.Address != m.Address || env.SSHPort != m.SSHPort || env.SSHUser != cfg.SSH.User || env.SSHKey != k.Path {
+		if env.Address != m.Address || env.SSHPort != m.SSHPort {
+			// The machine doesn't have the old address anymore, and the
+			// new one may have been another machine's.
+			if env.Address != "" {
+				if err := remote.Forget(knownHosts, envAddr(env)); err != nil {
+					return err
+				}
+			}
+			env.Address, env.SSHPort = m.Address, m.SSHPort
+			if err := remote.Forget(knownHosts, envAddr(env)); err != nil {
+				return err
+			}
+		}
+		env.SSHUser, env.SSHKey = cfg.SSH.User, k.Path
+		if err := store.Put(ctx, env); err != nil {
+			return err
+		}
+	}
+
+	if env.Address != "" && m.Status == provider.StatusRunning {
+		known, err := remote.Known(knownHosts, envAddr(env))
+		if err != nil {
+			return err
+		}
+		// Best effort, cloud-init may not have printed the keys yet. They're
+		// pinned again, or trusted on first use with a warning, when
+		// connecting.
+		if !known {
+			if err := pinHostKeys(ctx, p, m.ID, envAddr(env)); err != nil && !errors.Is(err, errNotPinned) {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
+	}
+	if cfg.SSH.WriteConfig && env.Address != "" {
+		return writeHostEntry(env)
+	}
+	return nil
+}
+
+// envAddr returns the host:port address of the SSH server of the
+// environment.
+func envAddr(env *state.Environment) string {
+	return (&remote.Target{Host: env.Address, Port: env.SSHPort}).Addr()
+}
+
+// writeHostEntry writes the ssh config entry of the environment.
+func writeHostEntry(env *state.Environment) error {
+	path, err := remote.DefaultSSHConfig()
+	if err != nil {
+		return err
+	}
+	knownHosts, err := remote.DefaultKnownHosts()
+	if err != nil {
+		return err
+	}
+	err = remote.WriteHostEntry(path, &remote.HostEntry{
+		Env:           env.Name,
+		Host:          env.Address,
+		Port:          env.SSHPort,
+		User:          env.SSHUser,
+		IdentityFile:  env.SSHKey,
+		KnownHosts:    knownHosts,
+		LocalForwards: env.ForwardPorts,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write the ssh config entry of environment %s: %w", env.Name, err)
+	}
+	return nil
+}
+
+// forgetAccess removes the ssh config entry and the host keys of a
+// destroyed environment.
+func forgetAccess(env *state.Environment) error {
+	path, err := remote.DefaultSSHConfig()
+	if err != nil {
+		return err
+	}
+	if err := remote.RemoveHostEntry(path, env.Name); err != nil {
+		return fmt.Errorf("failed to remove the ssh config entry of environment %s: %w", env.Name, err)
+	}
+	if env.Address == "" {
+		return nil
+	}
+	knownHosts, err := remote.DefaultKnownHosts()
+	if err != nil {
+		return err
+	}
+	return remote.Forget(knownHosts, envAddr(env))
+}
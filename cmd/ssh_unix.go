@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// watchResize returns the new sizes of the terminal when it's resized. The
+// returned function stops watching.
+func watchResize(fd int) (<-chan remote.WindowSize, func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	sizes := make(chan remote.WindowSize, 1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				if width, height, err := term.GetSize(fd); err == nil {
+					select {
+					case sizes <- remote.WindowSize{Width: width, Height: height}:
+					case <-done:
+						return
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return sizes, func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
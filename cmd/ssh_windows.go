@@ -0,0 +1,8 @@
+package cmd
+
+import "github.com/darkowlzz/clouddev/remote"
+
+// watchResize returns no sizes, Windows consoles have no resize signal.
+func watchResize(fd int) (<-chan remote.WindowSize, func()) {
+	return nil, func() {}
+}
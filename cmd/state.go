@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/internal/sigv4"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/state"
+	"github.com/darkowlzz/clouddev/state/s3"
+)
+
+// stateCmd represents the state command
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Manage the state of the provisioned environments",
+	Long: `Manage the state of the provisioned environments.
+
+The state is stored by the backend configured in the state section of the
+config file: in local files, or shared in S3 compatible object storage.`,
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+}
+
+// withLock runs f with the lock of the named environment held, passing it
+// the context of the lock. The error of losing the lock takes precedence, as
+// it's why the work under it was cancelled.
+func withLock(ctx context.Context, store state.Backend, name string, f func(ctx context.Context) error) (err error) {
+	ctx, unlock, err := store.Lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Unlocking may cancel the context, whether the lock was lost is
+		// known before.
+		lost := ctx.Err() != nil
+		if uerr := unlock(); uerr != nil && (err == nil || lost) {
+			err = uerr
+		}
+	}()
+	return f(ctx)
+}
+
+// openState returns the configured state backend.
+func openState(cfg *config.Config) (state.Backend, error) {
+	switch cfg.State.Backend {
+	case "s3":
+		creds, err := sigv4.EnvCredentials()
+		if err != nil {
+			return nil, fmt.Errorf("s3 state backend: %w", err)
+		}
+		return s3.New(s3.Options{
+			Bucket:      cfg.State.S3.Bucket,
+			Prefix:      cfg.State.S3.Prefix,
+			Endpoint:    cfg.State.S3.Endpoint,
+			Region:      cfg.State.S3.Region,
+			PathStyle:   cfg.State.S3.PathStyle,
+			Lease:       cfg.State.S3.Lease,
+			Credentials: creds,
+		})
+	default:
+		dir := cfg.State.Dir
+		if dir == "" {
+			var err error
+			if dir, err = state.DefaultDir(); err != nil {
+				return nil, err
+			}
+		}
+		dir, err := homedir.Expand(dir)
+		if err != nil {
+			return nil, err
+		}
+		return state.NewLocal(dir), nil
+	}
+}
+
+// envName returns the environment name given as the first argument, or the
+// configured one.
+func envName(cfg *config.Config, args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return cfg.Name
+}
+
+// recordedMachine returns the machine recorded in the environment state.
+func recordedMachine(env *state.Environment) *provider.Machine {
+	resources := make(map[string]string, len(env.Resources))
+	for k, v := range env.Resources {
+		resources[k] = v
+	}
+	return &provider.Machine{
+		ID:        env.Resources[provider.ResourceInstance],
+		Name:      env.Name,
+		Resources: resources,
+		CreatedAt: env.CreatedAt,
+	}
+}
+
+// newRecord returns the state of a machine created from the configuration.
+func newRecord(cfg *config.Config, m *provider.Machine) (*state.Environment, error) {
+	hash, err := cfg.Hash()
+	if err != nil {
+		return nil, err
+	}
+	return &state.Environment{
+		Name:       cfg.Name,
+		Provider:   cfg.Provider,
+		Resources:  m.Resources,
+		CreatedAt:  m.CreatedAt,
+		ConfigHash: hash,
+	}, nil
+}
+
+// checkProvider returns an error if the environment was provisioned on
+// another provider than the configured one.
+func checkProvider(cfg *config.Config, env *state.Environment) error {
+	if env.Provider != cfg.Provider {
+		return fmt.Errorf("environment %s was provisioned on %s but the config uses %s, clean it with the original config first", env.Name, env.Provider, cfg.Provider)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// statePullCmd represents the state pull command
+var statePullCmd = &cobra.Command{
+	Use:   "pull [env]",
+	Short: "Print the state of an environment",
+	Long: `Print the state of an environment from the configured backend. The state
+of the configured environment is printed if no environment is given.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+
+		env, err := store.Get(cmd.Context(), envName(cfg, args))
+		if err != nil {
+			return err
+		}
+		data, err := state.Marshal(env)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	},
+}
+
+func init() {
+	stateCmd.AddCommand(statePullCmd)
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/state"
+)
+
+var statePushForce bool
+
+// statePushCmd represents the state push command
+var statePushCmd = &cobra.Command{
+	Use:   "push <file>",
+	Short: "Write the state of an environment",
+	Long: `Write the state of an environment read from a file, or from stdin if the
+file is "-", to the configured backend.
+
+Pushing the files of the local backend, $HOME/.clouddev/state/<env>.json,
+moves the environments to a shared backend. An existing state is replaced
+only with --force.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+
+		var data []byte
+		if args[0] == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(args[0])
+		}
+		if err != nil {
+			return err
+		}
+		env, err := state.Unmarshal(data)
+		if err != nil {
+			return fmt.Errorf("invalid state %s: %w", args[0], err)
+		}
+
+		return withLock(cmd.Context(), store, env.Name, func(ctx context.Context) error {
+			_, err = store.Get(ctx, env.Name)
+			if err == nil && !statePushForce {
+				return fmt.Errorf("environment %s already has a state, pass --force to replace it", env.Name)
+			}
+			if err != nil && !errors.Is(err, state.ErrNotFound) {
+				return err
+			}
+			if err := store.Put(ctx, env); err != nil {
+				return err
+			}
+			fmt.Printf("Pushed the state of environment %s\n", env.Name)
+			return nil
+		})
+	},
+}
+
+func init() {
+	stateCmd.AddCommand(statePushCmd)
+
+	statePushCmd.Flags().BoolVar(&statePushForce, "force", false, "replace an existing state")
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// lockingBackend is a backend whose lock fails, is lost while held, or
+// fails to be released as configured.
+type lockingBackend struct {
+	state.Backend
+	lockErr   error
+	lost      bool
+	unlockErr error
+	unlocked  bool
+}
+
+func (b *lockingBackend) Lock(ctx context.Context, name string) (context.Context, func() error, error) {
+	if b.lockErr != nil {
+		return nil, nil, b.lockErr
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if b.lost {
+		cancel()
+	}
+	return ctx, func() error {
+		cancel()
+		b.unlocked = true
+		return b.unlockErr
+	}, nil
+}
+
+func TestWithLock(t *testing.T) {
+	workErr := errors.New("failed to stop environment dev")
+	lostErr := errors.New("lost the lock of environment dev")
+	tests := []struct {
+		name    string
+		backend *lockingBackend
+		// workErr is returned by the work unless its context is done.
+		workErr error
+		want    error
+	}{
+		{name: "success", backend: &lockingBackend{}},
+		{name: "work fails", backend: &lockingBackend{}, workErr: workErr, want: workErr},
+		{name: "unlock fails", backend: &lockingBackend{unlockErr: lostErr}, want: lostErr},
+		{name: "work and unlock fail", backend: &lockingBackend{unlockErr: lostErr}, workErr: workErr, want: workErr},
+		{name: "lock lost", backend: &lockingBackend{lost: true, unlockErr: lostErr}, want: lostErr},
+		{name: "lock fails", backend: &lockingBackend{lockErr: state.ErrLocked}, want: state.ErrLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			err := withLock(context.Background(), tt.backend, "dev", func(ctx context.Context) error {
+				ran = true
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return tt.workErr
+			})
+			if err != tt.want {
+				t.Errorf("withLock() error = %v, want %v", err, tt.want)
+			}
+			if locked := tt.backend.lockErr == nil; ran != locked || tt.backend.unlocked != locked {
+				t.Errorf("withLock() ran the work %v and unlocked %v, want %v", ran, tt.backend.unlocked, locked)
+			}
+		})
+	}
+}
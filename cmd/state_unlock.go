@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var stateUnlockForce bool
+
+// stateUnlockCmd represents the state unlock command
+var stateUnlockCmd = &cobra.Command{
+	Use:   "unlock [env]",
+	Short: "Release the lock of an environment",
+	Long: `Release the lock of an environment held by another clouddev run, e.g. one
+that crashed. The configured environment is unlocked if no environment is
+given.
+
+Unlocking an environment that is being provisioned or destroyed can corrupt
+its state, so --force is required.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !stateUnlockForce {
+			return errors.New("make sure no other clouddev run uses the environment and pass --force")
+		}
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+
+		name := envName(cfg, args)
+		if err := store.ForceUnlock(cmd.Context(), name); err != nil {
+			return err
+		}
+		fmt.Printf("Unlocked environment %s\n", name)
+		return nil
+	},
+}
+
+func init() {
+	stateCmd.AddCommand(stateUnlockCmd)
+
+	stateUnlockCmd.Flags().BoolVar(&stateUnlockForce, "force", false, "release the lock even if it's held")
+}
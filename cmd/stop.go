@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// stopCmd represents the stop command
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop cloud environment",
+	Long: `Stop the provisioned cloud environment, keeping its disks and other
+resources. up starts it again.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+		return withLock(cmd.Context(), store, cfg.Name, func(ctx context.Context) error {
+			env, err := store.Get(ctx, cfg.Name)
+			if errors.Is(err, state.ErrNotFound) {
+				return fmt.Errorf("environment %s is not provisioned", cfg.Name)
+			}
+			if err != nil {
+				return err
+			}
+			if err := checkProvider(cfg, env); err != nil {
+				return err
+			}
+			p, err := provider.New(cfg)
+			if err != nil {
+				return err
+			}
+			defer provider.Close(p)
+
+			fmt.Printf("Stopping environment %s...\n", cfg.Name)
+			if err := p.Stop(ctx, env.Resources[provider.ResourceInstance]); err != nil {
+				return fmt.Errorf("failed to stop environment %s: %w", cfg.Name, err)
+			}
+			fmt.Printf("Environment %s stopped\n", cfg.Name)
+			return nil
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stopCmd)
+}
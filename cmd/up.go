@@ -1,31 +1,373 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
+
+	"github.com/darkowlzz/clouddev/devcontainer"
+	"github.com/darkowlzz/clouddev/plan"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+var (
+	upPlan         bool
+	upOutput       string
+	upSavePlan     string
+	upFromPlan     string
+	upAutoApprove  bool
+	upNoColor      bool
+	upNoWait       bool
+	upDevcontainer string
 )
 
 // upCmd represents the up command
 var upCmd = &cobra.Command{
 	Use:   "up",
 	Short: "Provision cloud environment",
-	Long:  `Provision cloud environment as per the provided configuration.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("up called")
+	Long: `Provision cloud environment as per the provided configuration.
+
+The configuration is compared with the recorded state of the environment and
+the machine reported by the provider, and the resulting plan of actions is
+printed and applied after confirmation. With --plan, the plan is printed, or
+saved with --save-plan, and nothing is applied. A saved plan is applied with
+--from-plan, as long as the environment state didn't change since.
+
+Once the machine is running, up waits for it to be ready: for SSH, for the
+bootstrap to finish, showing the output of cloud-init, and for the health
+checks of the readiness section of the configuration to pass. up fails with
+the last lines of the cloud-init output if the bootstrap fails or times out.
+The configured Ansible playbooks are then applied, unless they already were
+with the same playbooks and configuration, and the configured dotfiles are
+installed, unless they already were. The wait, the playbooks and the
+dotfiles are skipped with --no-wait.
+
+With --devcontainer, the machine is sized for the hostRequirements of the
+devcontainer.json of the repository, and once it's ready, the repository is
+uploaded to ~/workspaces and its development container is built and run
+with Docker. The forwardPorts are forwarded by the ssh config entry. The
+devcontainer is recorded in the state and run again by the next up, which
+only recreates the container when its image or configuration changed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if upOutput != "text" && upOutput != "json" {
+			return fmt.Errorf("invalid output format %q, expected text or json", upOutput)
+		}
+		if upOutput != "text" && !upPlan {
+			return errors.New("--output is only supported with --plan")
+		}
+		if upFromPlan != "" && (upPlan || upSavePlan != "") {
+			return errors.New("--from-plan can't be used with --plan or --save-plan")
+		}
+
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		p, err := provider.New(cfg)
+		if err != nil {
+			return err
+		}
+		defer provider.Close(p)
+		store, err := openState(cfg)
+		if err != nil {
+			return err
+		}
+		return withLock(cmd.Context(), store, cfg.Name, func(ctx context.Context) error {
+			env, err := store.Get(ctx, cfg.Name)
+			if errors.Is(err, state.ErrNotFound) {
+				env = nil
+			} else if err != nil {
+				return err
+			}
+			dcPath := upDevcontainer
+			if dcPath == "" && env != nil {
+				dcPath = env.Devcontainer
+			}
+			var dc *devcontainer.Config
+			if dcPath != "" {
+				if dc, err = loadDevcontainer(cfg, p, dcPath); err != nil {
+					return err
+				}
+			}
+			// The key isn't generated, nor its passphrase asked, until the plan
+			// is applied.
+			spec, placeholder, err := planSpec(cfg, p)
+			if err != nil {
+				return err
+			}
+
+			var pl *plan.Plan
+			if upFromPlan != "" {
+				if pl, err = loadPlan(upFromPlan, spec, env); err != nil {
+					return err
+				}
+			} else {
+				if pl, err = plan.Build(ctx, p, spec, env); err != nil {
+					return err
+				}
+				if upSavePlan != "" {
+					if err := plan.Save(upSavePlan, pl); err != nil {
+						return err
+					}
+				}
+				if upOutput == "json" {
+					return plan.WriteJSON(os.Stdout, pl)
+				}
+				if err := plan.WriteText(os.Stdout, pl, useColor()); err != nil {
+					return err
+				}
+				if upSavePlan != "" {
+					fmt.Printf("\nSaved the plan to %s, apply it with: clouddev up --from-plan %s\n", upSavePlan, upSavePlan)
+				}
+				if upPlan {
+					return nil
+				}
+				if !pl.Empty() && !upAutoApprove {
+					if err := confirm("\nApply the plan?"); err != nil {
+						return err
+					}
+				}
+			}
+
+			if placeholder {
+				if spec, err = newSpec(cfg, p); err != nil {
+					return err
+				}
+			}
+			return applyPlan(ctx, p, store, spec, env, pl, dc)
+		})
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(upCmd)
 
-	// Here you will define your flags and configuration settings.
+	upCmd.Flags().BoolVar(&upPlan, "plan", false, "print the plan without applying it")
+	upCmd.Flags().StringVarP(&upOutput, "output", "o", "text", "plan output format with --plan, text or json")
+	upCmd.Flags().StringVar(&upSavePlan, "save-plan", "", "save the plan to a file, to apply it later with --from-plan")
+	upCmd.Flags().StringVar(&upFromPlan, "from-plan", "", "apply a plan saved with --save-plan")
+	upCmd.Flags().BoolVar(&upAutoApprove, "auto-approve", false, "apply the plan without asking for confirmation")
+	upCmd.Flags().BoolVar(&upNoColor, "no-color", false, "print the plan without colors")
+	upCmd.Flags().BoolVar(&upNoWait, "no-wait", false, "don't wait for the machine to be ready, nor apply the playbooks, install the dotfiles and run the devcontainer")
+	upCmd.Flags().StringVar(&upDevcontainer, "devcontainer", "", "run the devcontainer of the repository at this path on the machine")
+}
+
+// loadPlan loads a saved plan and checks that it can still be applied.
+func loadPlan(file string, spec *provider.Spec, env *state.Environment) (*plan.Plan, error) {
+	pl, err := plan.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := spec.Config
+	if pl.Environment != cfg.Name || pl.Provider != cfg.Provider {
+		return nil, fmt.Errorf("plan %s is for environment %s on %s, not %s on %s", file, pl.Environment, pl.Provider, cfg.Name, cfg.Provider)
+	}
+	hash, err := cfg.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if pl.ConfigHash != hash {
+		return nil, fmt.Errorf("the configuration changed since plan %s was made, make a new plan", file)
+	}
+	hash, err = plan.StateHash(env)
+	if err != nil {
+		return nil, err
+	}
+	if pl.StateHash != hash {
+		return nil, fmt.Errorf("the state of environment %s changed since plan %s was made, make a new plan", cfg.Name, file)
+	}
+	return pl, nil
+}
+
+// applyPlan applies the actions of the plan, recording the changes in the
+// state as they're made, and runs the devcontainer dc unless nil.
+func applyPlan(ctx context.Context, p provider.Provider, store state.Backend, spec *provider.Spec, env *state.Environment, pl *plan.Plan, dc *devcontainer.Config) error {
+	cfg := spec.Config
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// upCmd.PersistentFlags().String("foo", "", "A help for foo")
+	var m *provider.Machine
+	destroy := func() error {
+		fmt.Printf("Destroying machine %s...\n", env.Resources[provider.ResourceInstance])
+		if err := p.Destroy(ctx, recordedMachine(env)); err != nil {
+			return fmt.Errorf("failed to destroy environment %s: %w", cfg.Name, err)
+		}
+		if err := store.Delete(ctx, cfg.Name); err != nil {
+			return err
+		}
+		if err := forgetAccess(env); err != nil {
+			return err
+		}
+		env = nil
+		return nil
+	}
+
+	for _, a := range pl.Actions {
+		var err error
+		switch a.Type {
+		case plan.Delete:
+			err = destroy()
+		case plan.Replace:
+			if err = destroy(); err == nil {
+				m, env, err = createMachine(ctx, p, store, spec)
+			}
+		case plan.Create:
+			m, env, err = createMachine(ctx, p, store, spec)
+		case plan.Update:
+			m, err = updateMachine(ctx, p, store, spec, env, a.Changes)
+		default:
+			err = fmt.Errorf("unknown plan action %q", a.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if m == nil && env != nil {
+		var err error
+		if m, err = p.Get(ctx, env.Resources[provider.ResourceInstance]); err != nil {
+			return err
+		}
+	}
+	if m != nil {
+		if err := recordAccess(ctx, p, store, cfg, env, m); err != nil {
+			return err
+		}
+		if !upNoWait && m.Status == provider.StatusRunning {
+			if err := waitReady(ctx, cfg, p, m); err != nil {
+				return fmt.Errorf("environment %s isn't ready: %w", cfg.Name, err)
+			}
+			if cfg.Ansible.Enabled() {
+				if err := applyPlaybooks(ctx, cfg, store, env); err != nil {
+					return err
+				}
+			}
+			if cfg.Dotfiles.Enabled() {
+				hash, err := cfg.Dotfiles.Hash()
+				if err != nil {
+					return err
+				}
+				if env.Dotfiles != hash {
+					if err := installDotfiles(ctx, cfg, store, env); err != nil {
+						return err
+					}
+				}
+			}
+			if dc != nil {
+				if err := runDevcontainer(ctx, cfg, store, env, dc); err != nil {
+					return err
+				}
+			}
+		}
+		printMachine(m)
+	}
+	return nil
+}
+
+// createMachine creates a machine and records it in the state. A partially
+// created machine is recorded too, so that clean can destroy it.
+func createMachine(ctx context.Context, p provider.Provider, store state.Backend, spec *provider.Spec) (*provider.Machine, *state.Environment, error) {
+	cfg := spec.Config
+	fmt.Printf("Creating environment %s on %s...\n", cfg.Name, cfg.Provider)
+	m, err := p.Create(ctx, spec)
+	var env *state.Environment
+	if m != nil {
+		var perr error
+		if env, perr = newRecord(cfg, m); perr == nil {
+			perr = store.Put(ctx, env)
+		}
+		if perr != nil && err == nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create environment %s: %w", cfg.Name, err)
+	}
+	return m, env, nil
+}
+
+// updateMachine applies in place changes to the recorded machine and
+// records the configuration they were made for.
+func updateMachine(ctx context.Context, p provider.Provider, store state.Backend, spec *provider.Spec, env *state.Environment, changes []provider.Change) (*provider.Machine, error) {
+	cfg := spec.Config
+	id := env.Resources[provider.ResourceInstance]
+
+	var update []provider.Change
+	for _, ch := range changes {
+		if ch.Field == plan.StatusField {
+			fmt.Printf("Starting machine %s...\n", id)
+			if err := p.Start(ctx, id); err != nil {
+				return nil, fmt.Errorf("failed to start environment %s: %w", cfg.Name, err)
+			}
+			continue
+		}
+		update = append(update, ch)
+	}
+
+	m, err := p.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(update) > 0 {
+		u, ok := p.(provider.Updater)
+		if !ok {
+			return nil, fmt.Errorf("provider %s can't update machines in place", cfg.Provider)
+		}
+		fmt.Printf("Updating machine %s...\n", id)
+		if err := u.Update(ctx, spec, m, update); err != nil {
+			return nil, fmt.Errorf("failed to update environment %s: %w", cfg.Name, err)
+		}
+		if m, err = p.Get(ctx, id); err != nil {
+			return nil, err
+		}
+		if env.ConfigHash, err = cfg.Hash(); err != nil {
+			return nil, err
+		}
+		if err := store.Put(ctx, env); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// confirm asks the user to confirm an action and returns an error unless
+// they answer yes.
+func confirm(question string) error {
+	if !isTerminal(os.Stdin) {
+		return errors.New("can't ask for confirmation without a terminal, pass --auto-approve")
+	}
+	fmt.Printf("%s Only 'yes' will be accepted: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.New("cancelled")
+	}
+	return nil
+}
+
+// useColor returns true if the output should be colored.
+func useColor() bool {
+	if upNoColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(os.Stdout)
+}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// upCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+// printMachine prints the summary of a provisioned environment.
+func printMachine(m *provider.Machine) {
+	fmt.Printf("Environment %s is %s\n", m.Name, m.Status)
+	fmt.Printf("  ID:      %s\n", m.ID)
+	if m.Address != "" {
+		fmt.Printf("  Address: %s\n", m.Address)
+	}
+	if m.SSHPort != 0 {
+		fmt.Printf("  SSH port: %d\n", m.SSHPort)
+	}
 }
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/plan"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/fake"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+func TestLoadPlan(t *testing.T) {
+	ctx := context.Background()
+	p := fake.New()
+	spec := providertest.Spec("fake")
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := func() *state.Environment {
+		return &state.Environment{Name: spec.Config.Name, Provider: "fake", Resources: m.Resources, Address: m.Address}
+	}
+	spec.Config.MachineType = "large"
+	pl, err := plan.Build(ctx, p, spec, recorded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "plan.json")
+	if err := plan.Save(file, pl); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadPlan(file, spec, recorded()); err != nil {
+		t.Errorf("loadPlan() of an unchanged state error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(spec *provider.Spec, env *state.Environment) *state.Environment
+		err    string
+	}{
+		{
+			name: "state changed",
+			change: func(spec *provider.Spec, env *state.Environment) *state.Environment {
+				env.Address = "192.0.2.200"
+				return env
+			},
+			err: "the state of environment conformance changed since plan",
+		},
+		{
+			name: "state deleted",
+			change: func(spec *provider.Spec, env *state.Environment) *state.Environment {
+				return nil
+			},
+			err: "the state of environment conformance changed since plan",
+		},
+		{
+			name: "configuration changed",
+			change: func(spec *provider.Spec, env *state.Environment) *state.Environment {
+				spec.Config.Disk.SizeGB++
+				return env
+			},
+			err: "the configuration changed since plan",
+		},
+		{
+			name: "other environment",
+			change: func(spec *provider.Spec, env *state.Environment) *state.Environment {
+				spec.Config.Name = "web"
+				return env
+			},
+			err: "is for environment conformance on fake, not web on fake",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := providertest.Spec("fake")
+			spec.Config.MachineType = "large"
+			env := tt.change(spec, recorded())
+			_, err := loadPlan(file, spec, env)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("loadPlan() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
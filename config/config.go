@@ -0,0 +1,350 @@
+// Package config defines the clouddev environment configuration and loads it
+// from the clouddev configuration file.
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Config is the definition of a cloud development environment.
+type Config struct {
+	// Name is the name of the environment. It's used to name the resources
+	// created for the environment.
+	Name string `mapstructure:"name"`
+	// Provider is the name of the cloud provider to provision on.
+	Provider string `mapstructure:"provider"`
+	// Region is the provider region to provision in.
+	Region string `mapstructure:"region"`
+	// MachineType is the provider specific machine size.
+	MachineType string `mapstructure:"machine_type"`
+	// Image is the provider specific machine image.
+	Image string `mapstructure:"image"`
+	// Disk is the boot disk configuration.
+	Disk Disk `mapstructure:"disk"`
+	// SSH is the SSH access configuration.
+	SSH SSH `mapstructure:"ssh"`
+	// Ports are the TCP ports to allow inbound traffic on.
+	Ports []int `mapstructure:"ports"`
+	// Bootstrap is the first boot setup of the machine.
+	Bootstrap Bootstrap `mapstructure:"bootstrap"`
+	// Readiness is how up waits for the machine to be ready.
+	Readiness Readiness `mapstructure:"readiness"`
+	// Dotfiles are the dotfiles of the user installed on the machine.
+	Dotfiles Dotfiles `mapstructure:"dotfiles"`
+	// Ansible are the Ansible playbooks applied to the machine.
+	Ansible Ansible `mapstructure:"ansible"`
+	// State is where the state of the provisioned environments is stored.
+	State State `mapstructure:"state"`
+	// ProviderOptions are the provider specific options. They're decoded and
+	// validated by the provider.
+	ProviderOptions map[string]interface{} `mapstructure:"provider_options"`
+}
+
+// Disk is the boot disk configuration.
+type Disk struct {
+	// SizeGB is the size of the disk in gigabytes.
+	SizeGB int `mapstructure:"size_gb"`
+	// Type is the provider specific disk type.
+	Type string `mapstructure:"type"`
+}
+
+// SSH is the SSH access configuration.
+type SSH struct {
+	// User is the login user on the machine.
+	User string `mapstructure:"user"`
+	// PublicKey is the path of the public key authorized to log in, the
+	// private key path with the .pub extension if empty. A key is
+	// generated for the environment if both keys are empty.
+	PublicKey string `mapstructure:"public_key"`
+	// PrivateKey is the path of the private key to log in with, the public
+	// key path without the .pub extension if empty.
+	PrivateKey string `mapstructure:"private_key"`
+	// KeyPassphrase protects the generated key with a passphrase. The
+	// decrypted key is kept in ssh-agent.
+	KeyPassphrase bool `mapstructure:"key_passphrase"`
+	// WriteConfig keeps a Host clouddev-<name> block in ~/.ssh/config, so
+	// that ssh, scp and editors can reach the machine.
+	WriteConfig bool `mapstructure:"write_config"`
+}
+
+// KeyPaths returns the paths of the configured private and public keys, or
+// empty paths if the key is generated.
+func (s *SSH) KeyPaths() (private, public string) {
+	private, public = s.PrivateKey, s.PublicKey
+	if private == "" {
+		private = strings.TrimSuffix(public, ".pub")
+	}
+	if public == "" && private != "" {
+		public = private + ".pub"
+	}
+	return private, public
+}
+
+// Bootstrap is the first boot setup of the machine, rendered to cloud-init
+// user data by the bootstrap package. The system is set up first, then the
+// packages are installed, the scripts run, the units are enabled and the
+// commands run last.
+type Bootstrap struct {
+	// Timezone is the tz database name of the timezone, e.g. Europe/Paris.
+	Timezone string `mapstructure:"timezone"`
+	// Groups are the groups to create.
+	Groups []string `mapstructure:"groups"`
+	// Users are the users to create besides the SSH user. An entry for the
+	// SSH user adds to it, e.g. groups.
+	Users []User `mapstructure:"users"`
+	// Files are the files to write.
+	Files []File `mapstructure:"files"`
+	// SwapMB is the size of the swap file to create in megabytes, none if
+	// zero.
+	SwapMB int `mapstructure:"swap_mb"`
+	// Packages are the OS packages to install with the package manager of
+	// the image.
+	Packages []string `mapstructure:"packages"`
+	// AptPackages are installed on images with apt only, and DnfPackages on
+	// images with dnf only.
+	AptPackages []string `mapstructure:"apt_packages"`
+	DnfPackages []string `mapstructure:"dnf_packages"`
+	// Scripts are shell scripts run in order after the packages are
+	// installed.
+	Scripts []Script `mapstructure:"scripts"`
+	// Units are the systemd units to install and enable after the scripts
+	// ran.
+	Units []Unit `mapstructure:"units"`
+	// Commands are shell commands run in order at the end.
+	Commands []string `mapstructure:"commands"`
+}
+
+// User is a user account to create.
+type User struct {
+	Name string `mapstructure:"name"`
+	// Groups are the supplementary groups of the user.
+	Groups []string `mapstructure:"groups"`
+	// Shell is the login shell, /bin/bash if empty.
+	Shell string `mapstructure:"shell"`
+	// Sudo allows the user to run any command as root without password.
+	Sudo bool `mapstructure:"sudo"`
+	// SSHAuthorizedKeys are the public keys allowed to log in as the user.
+	SSHAuthorizedKeys []string `mapstructure:"ssh_authorized_keys"`
+}
+
+// File is a file to write on the machine. Its content is either inline or
+// read from a local file.
+type File struct {
+	// Path is the absolute path of the file on the machine.
+	Path    string `mapstructure:"path"`
+	Content string `mapstructure:"content"`
+	// Source is the path of a local file with the content, relative to the
+	// directory of the config file.
+	Source string `mapstructure:"source"`
+	// Permissions are the octal permissions, e.g. "0600", 0644 if empty.
+	Permissions string `mapstructure:"permissions"`
+	// Owner is the user:group owner of the file, root if empty.
+	Owner string `mapstructure:"owner"`
+}
+
+// Script is a shell script to run once. Its content is either inline or
+// read from a local file.
+type Script struct {
+	// Name identifies the script in the cloud-init logs.
+	Name string `mapstructure:"name"`
+	// Content is the script, run with /bin/sh unless it has a shebang.
+	Content string `mapstructure:"content"`
+	// Source is the path of a local file with the script, relative to the
+	// directory of the config file.
+	Source string `mapstructure:"source"`
+}
+
+// Unit is a systemd unit to install in /etc/systemd/system. Its content is
+// either inline or read from a local file.
+type Unit struct {
+	// Name is the unit name, e.g. app.service.
+	Name    string `mapstructure:"name"`
+	Content string `mapstructure:"content"`
+	// Source is the path of a local file with the unit, relative to the
+	// directory of the config file.
+	Source string `mapstructure:"source"`
+	// Enable enables and starts the unit.
+	Enable bool `mapstructure:"enable"`
+}
+
+// Readiness is how up waits for the machine to be ready: for SSH, the end
+// of the bootstrap and the health checks, in that order.
+type Readiness struct {
+	// Timeout is the time allowed to wait for SSH and the bootstrap.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Wait is how the end of the bootstrap is detected: "cloud-init" waits
+	// for cloud-init status, "sentinel" for the Sentinel file to exist, and
+	// "none" doesn't wait.
+	Wait string `mapstructure:"wait"`
+	// Sentinel is the path of the file the "sentinel" wait waits for.
+	Sentinel string `mapstructure:"sentinel"`
+	// Checks are the health checks that must pass once the bootstrap is
+	// done.
+	Checks []Check `mapstructure:"checks"`
+}
+
+// Check is a health check of the machine, retried with backoff until it
+// passes or times out. Exactly one of Command, TCP and HTTP is set.
+type Check struct {
+	// Name identifies the check in the output, the check itself if empty.
+	Name string `mapstructure:"name"`
+	// Command is a shell command run on the machine over SSH.
+	Command string `mapstructure:"command"`
+	// ExitCode is the exit code of a passing Command.
+	ExitCode int `mapstructure:"exit_code"`
+	// TCP is a port of the machine that must accept connections.
+	TCP int `mapstructure:"tcp"`
+	// HTTP is a URL that must respond with Status. An empty host is the
+	// address of the machine, e.g. http://:8080/healthz.
+	HTTP string `mapstructure:"http"`
+	// Status is the status code of a passing HTTP request, any 2xx or 3xx
+	// status if zero.
+	Status int `mapstructure:"status"`
+	// Timeout is the time allowed for the check to pass, 2m if zero.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// Dotfiles are the dotfiles of the user, from a local directory or a git
+// repository, installed on the machine once it's ready. At most one of Path
+// and Repo is set.
+type Dotfiles struct {
+	// Path is a local directory of dotfiles, uploaded to the machine.
+	Path string `mapstructure:"path"`
+	// Repo is the URL of a git repository of dotfiles, cloned on the
+	// machine.
+	Repo string `mapstructure:"repo"`
+	// Ref is the branch, tag or commit of Repo to check out, the default
+	// branch if empty.
+	Ref string `mapstructure:"ref"`
+	// Dir is where the dotfiles are put on the machine, relative to the home
+	// directory of the SSH user.
+	Dir string `mapstructure:"dir"`
+	// Install is the script of the dotfiles that installs them, relative to
+	// Dir. If neither Install nor Symlink is set, the first of the usual
+	// install scripts found is run, e.g. install.sh, or the files are
+	// symlinked if there's none.
+	Install string `mapstructure:"install"`
+	// Symlink installs the dotfiles by symlinking their files in the home
+	// directory, instead of running a script.
+	Symlink bool `mapstructure:"symlink"`
+}
+
+// Enabled returns true if dotfiles are configured.
+func (d *Dotfiles) Enabled() bool {
+	return d.Path != "" || d.Repo != ""
+}
+
+// Ansible are the Ansible playbooks applied to the machine once it's ready,
+// with an inventory generated from the state of the environment.
+type Ansible struct {
+	// Playbooks are the paths of the playbooks, relative to the directory
+	// of the config file, run in order.
+	Playbooks []string `mapstructure:"playbooks"`
+	// Vars are the host variables of the environment in the inventory.
+	Vars map[string]interface{} `mapstructure:"vars"`
+	// ExtraVars are passed to the playbooks with --extra-vars.
+	ExtraVars map[string]interface{} `mapstructure:"extra_vars"`
+	// Tags and SkipTags select the tasks to run, all if both are empty.
+	Tags     []string `mapstructure:"tags"`
+	SkipTags []string `mapstructure:"skip_tags"`
+	// Become runs the tasks as root.
+	Become bool `mapstructure:"become"`
+	// Command is the ansible-playbook command.
+	Command string `mapstructure:"command"`
+}
+
+// Enabled returns true if playbooks are configured.
+func (a *Ansible) Enabled() bool {
+	return len(a.Playbooks) > 0
+}
+
+// State is where the state of the provisioned environments is stored.
+type State struct {
+	// Backend is the state backend, "local" or "s3".
+	Backend string `mapstructure:"backend"`
+	// Dir is the directory of the local backend.
+	Dir string `mapstructure:"dir"`
+	// S3 is the configuration of the s3 backend.
+	S3 S3State `mapstructure:"s3"`
+}
+
+// S3State is the configuration of the S3 compatible object storage state
+// backend. The credentials are read from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+type S3State struct {
+	Bucket string `mapstructure:"bucket"`
+	// Prefix is the key prefix of the state objects.
+	Prefix string `mapstructure:"prefix"`
+	// Endpoint is the URL of the object storage, the AWS S3 endpoint of the
+	// region if empty.
+	Endpoint string `mapstructure:"endpoint"`
+	Region   string `mapstructure:"region"`
+	// PathStyle addresses the bucket in the URL path instead of the host
+	// name.
+	PathStyle bool `mapstructure:"path_style"`
+	// Lease is the duration of the environment lock leases.
+	Lease time.Duration `mapstructure:"lease"`
+}
+
+// defaults are the default values of the configuration keys. Keys not listed
+// here default to their zero value.
+var defaults = map[string]interface{}{
+	"name":         "clouddev",
+	"disk.size_gb": 20,
+	"ssh.user":     "clouddev",
+	"ports":        []int{22},
+
+	"readiness.timeout":  15 * time.Minute,
+	"readiness.wait":     "cloud-init",
+	"readiness.sentinel": "/var/lib/cloud/instance/boot-finished",
+
+	"dotfiles.dir": ".dotfiles",
+
+	"ansible.command": "ansible-playbook",
+
+	"state.backend":   "local",
+	"state.s3.prefix": "clouddev",
+	"state.s3.region": "us-east-1",
+	"state.s3.lease":  2 * time.Minute,
+}
+
+// Hash returns a hash of the environment configuration, to detect changes to
+// it. Where the state is stored, the local SSH config, how up waits for the
+// machine, the dotfiles and the playbooks don't change the environment and
+// aren't hashed.
+func (c *Config) Hash() (string, error) {
+	env := *c
+	env.State = State{}
+	env.SSH.WriteConfig = false
+	env.Readiness = Readiness{}
+	env.Dotfiles = Dotfiles{}
+	env.Ansible = Ansible{}
+	return hash(&env)
+}
+
+// Hash returns a hash of the dotfiles configuration, to detect changes to it.
+func (d *Dotfiles) Hash() (string, error) {
+	return hash(d)
+}
+
+// Hash returns a hash of the Ansible configuration, to detect changes to it.
+// The content of the playbooks isn't hashed.
+func (a *Ansible) Hash() (string, error) {
+	return hash(a)
+}
+
+func hash(v interface{}) (string, error) {
+	// Struct fields marshal in a fixed order and map keys sorted, so equal
+	// configurations have equal hashes.
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash the configuration: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
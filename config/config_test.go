@@ -0,0 +1,98 @@
+package config_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+// writeConfig writes a config file to a temporary directory and returns its
+// path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "clouddev.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestNestedSettingsHaveStringKeys(t *testing.T) {
+	file := writeConfig(t, `
+name: dev
+provider: fake
+ansible:
+  playbooks: [site.yml]
+  vars:
+    users:
+      - name: dev
+        groups: [docker]
+    limits:
+      nofile: {soft: 1024}
+  extra_vars:
+    deploy:
+      - {env: dev}
+provider_options:
+  tags:
+    - {key: team, value: dev}
+`)
+	cfg, err := config.Load(file, config.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, ok := cfg.Ansible.Vars["users"].([]interface{})[0].(map[string]interface{})
+	if !ok || user["name"] != "dev" {
+		t.Errorf("ansible.vars.users[0] = %#v, want a map with string keys", cfg.Ansible.Vars["users"])
+	}
+	if _, ok := cfg.Ansible.Vars["limits"].(map[string]interface{})["nofile"].(map[string]interface{}); !ok {
+		t.Errorf("ansible.vars.limits = %#v, want maps with string keys", cfg.Ansible.Vars["limits"])
+	}
+	if _, ok := cfg.Ansible.ExtraVars["deploy"].([]interface{})[0].(map[string]interface{}); !ok {
+		t.Errorf("ansible.extra_vars.deploy = %#v, want maps with string keys", cfg.Ansible.ExtraVars["deploy"])
+	}
+	if _, ok := cfg.ProviderOptions["tags"].([]interface{})[0].(map[string]interface{}); !ok {
+		t.Errorf("provider_options.tags = %#v, want maps with string keys", cfg.ProviderOptions["tags"])
+	}
+
+	if _, err := cfg.Hash(); err != nil {
+		t.Errorf("Hash() error = %v", err)
+	}
+	if _, err := cfg.Ansible.Hash(); err != nil {
+		t.Errorf("Ansible.Hash() error = %v", err)
+	}
+	if _, err := json.Marshal(cfg.Settings()); err != nil {
+		t.Errorf("the settings can't be encoded in JSON: %v", err)
+	}
+}
+
+func TestHash(t *testing.T) {
+	a, b := config.Default(), config.Default()
+	a.Provider, b.Provider = "fake", "fake"
+	// The state, the dotfiles and the playbooks aren't hashed.
+	b.State.Dir = "/tmp/state"
+	b.Ansible.Playbooks = []string{"site.yml"}
+	hashA, err := a.Hash()
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	hashB, err := b.Hash()
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	if hashA != hashB {
+		t.Error("Hash() changed with settings that don't change the environment")
+	}
+	b.Disk.SizeGB++
+	if hashB, _ = b.Hash(); hashA == hashB {
+		t.Error("Hash() didn't change with the disk size")
+	}
+
+	// Settings set in code may hold values JSON can't encode.
+	b.Ansible.Vars = map[string]interface{}{"bad": make(chan int)}
+	if _, err := b.Ansible.Hash(); err == nil {
+		t.Error("Ansible.Hash() of vars JSON can't encode error = nil")
+	}
+}
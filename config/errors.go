@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// optionsKey is the key of the provider options.
+const optionsKey = "provider_options"
+
+// FieldError describes a problem with a single configuration key.
+type FieldError struct {
+	// Path is the dotted key path, e.g. "disk.size_gb" or "ports[1]".
+	Path    string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationError lists all the problems found in a configuration file.
+type ValidationError struct {
+	File   string
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid configuration %s:", e.File)
+	for _, fe := range e.Errors {
+		fmt.Fprintf(&b, "\n  %s", fe)
+	}
+	return b.String()
+}
+
+// sortErrors orders the errors by key path so that reports are stable.
+func sortErrors(errs []*FieldError) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Path < errs[j].Path
+	})
+}
+
+// invalidKeys matches the mapstructure error reported for unknown keys.
+var invalidKeys = regexp.MustCompile(`^'([^']*)' has invalid keys: (.*)$`)
+
+// quotedPath matches the key path mapstructure quotes in its error messages.
+var quotedPath = regexp.MustCompile(`'([^']*)'`)
+
+// decodeErrors converts a mapstructure decoding error into field errors.
+func decodeErrors(err error) []*FieldError {
+	merr, ok := err.(*mapstructure.Error)
+	if !ok {
+		return []*FieldError{{Message: err.Error()}}
+	}
+	errs := make([]*FieldError, 0, len(merr.Errors))
+	for _, msg := range merr.Errors {
+		if m := invalidKeys.FindStringSubmatch(msg); m != nil {
+			for _, k := range strings.Split(m[2], ", ") {
+				if m[1] != "" {
+					k = m[1] + "." + k
+				}
+				errs = append(errs, &FieldError{Path: k, Message: "unknown key"})
+			}
+			continue
+		}
+		fe := &FieldError{Message: msg}
+		if m := quotedPath.FindStringSubmatch(msg); m != nil {
+			// e.g. "cannot parse 'disk.size_gb' as int: ..." or "error
+			// decoding 'readiness.timeout': time: invalid duration ...".
+			fe.Path = m[1]
+			fe.Message = strings.TrimPrefix(msg, "error decoding "+m[0]+": ")
+			fe.Message = strings.Replace(fe.Message, m[0]+" ", "", 1)
+		}
+		errs = append(errs, fe)
+	}
+	return errs
+}
+
+// DecodeOptions decodes the provider options into out, a pointer to a struct
+// with mapstructure tags. Unknown keys and invalid values are returned as
+// field errors.
+func (c *Config) DecodeOptions(out interface{}) []*FieldError {
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           out,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return []*FieldError{{Path: optionsKey, Message: err.Error()}}
+	}
+	if err := d.Decode(c.ProviderOptions); err != nil {
+		errs := decodeErrors(err)
+		for _, fe := range errs {
+			if fe.Path == "" {
+				fe.Path = optionsKey
+			} else {
+				fe.Path = optionsKey + "." + fe.Path
+			}
+		}
+		return errs
+	}
+	return nil
+}
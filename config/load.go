@@ -0,0 +1,322 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is the prefix of the environment variables that override
+// configuration keys, e.g. CLOUDDEV_DISK_SIZE_GB overrides disk.size_gb.
+const EnvPrefix = "CLOUDDEV"
+
+// Source is where the effective value of a configuration key came from.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// Options are the options for loading the configuration.
+type Options struct {
+	// Profile is the name of the profile in the config file to load. The
+	// top level keys and the defaults section are loaded if empty.
+	Profile string
+	// Validate is an additional validation of the decoded configuration, e.g.
+	// of the provider options by the provider.
+	Validate func(c *Config) []*FieldError
+	// Overrides are values set on the command line, keyed by configuration
+	// key. They take precedence over all the other sources.
+	Overrides map[string]string
+}
+
+// Resolved is the effective configuration with the source of every value.
+type Resolved struct {
+	// File is the configuration file the values were read from.
+	File string
+	// Profile is the profile the values were loaded for.
+	Profile string
+	// Config is the decoded configuration. It may be partially decoded if
+	// there are errors.
+	Config *Config
+	// Errors are the problems found in the configuration.
+	Errors []*FieldError
+
+	sources  map[string]Source
+	sections map[string]string
+}
+
+// Err returns a *ValidationError listing all the problems found in the
+// configuration, or nil if it's valid.
+func (r *Resolved) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return &ValidationError{File: r.File, Errors: r.Errors}
+}
+
+// Source returns where the effective value of the given key came from.
+func (r *Resolved) Source(key string) Source {
+	return r.sources[key]
+}
+
+// Section returns the section of the config file the value of the given key
+// was read from, e.g. "defaults" or "profiles.build". It's empty for the top
+// level keys and for values that didn't come from the file.
+func (r *Resolved) Section(key string) string {
+	return r.sections[key]
+}
+
+// Value returns the effective value of the given key, the way it's written
+// in the config file: durations are strings and structs are maps.
+func (r *Resolved) Value(key string) interface{} {
+	v := reflect.ValueOf(r.Config).Elem()
+	for _, name := range strings.Split(key, ".") {
+		v = fieldByTag(v, name)
+		if !v.IsValid() {
+			return nil
+		}
+	}
+	return setting(v)
+}
+
+// fieldByTag returns the struct field with the given mapstructure tag.
+func fieldByTag(v reflect.Value, tag string) reflect.Value {
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("mapstructure") == tag {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// Load reads the configuration file at the given path, applies defaults,
+// environment variable and flag overrides, and validates the result. All the
+// problems found are returned together as a *ValidationError.
+func Load(file string, opts Options) (*Config, error) {
+	r, err := Resolve(file, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return r.Config, nil
+}
+
+// Resolve reads the configuration file at the given path and layers, from
+// lowest to highest precedence, the defaults, the file, environment variables
+// and flag overrides. An error is returned only if the file can't be read;
+// problems with the configuration are reported in Resolved.Errors.
+func Resolve(file string, opts Options) (*Resolved, error) {
+	fv := viper.New()
+	fv.SetConfigFile(file)
+	if err := fv.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", file, err)
+	}
+	profile := strings.ToLower(opts.Profile)
+	layers, errs, err := fileLayers(fv.AllSettings(), profile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	v := viper.New()
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if err := v.MergeConfigMap(mergeLayers(layers)); err != nil {
+		return nil, err
+	}
+
+	r := &Resolved{
+		File:     file,
+		Profile:  profile,
+		Errors:   errs,
+		sources:  map[string]Source{},
+		sections: map[string]string{},
+	}
+
+	// Register every key with viper, even without a default, so that
+	// AutomaticEnv can override keys that aren't in the file.
+	known := map[string]bool{}
+	for _, f := range fields(reflect.TypeOf(Config{}), "") {
+		known[f.key] = true
+		if d, ok := defaults[f.key]; ok {
+			v.SetDefault(f.key, d)
+		} else {
+			v.SetDefault(f.key, reflect.Zero(f.typ).Interface())
+		}
+
+		_, overridden := opts.Overrides[f.key]
+		switch {
+		case overridden:
+			r.sources[f.key] = SourceFlag
+		case hasEnv(f.key):
+			r.sources[f.key] = SourceEnv
+		case sectionOf(layers, f.key) != nil:
+			r.sources[f.key] = SourceFile
+			r.sections[f.key] = sectionOf(layers, f.key).section
+		default:
+			r.sources[f.key] = SourceDefault
+		}
+	}
+	// Environments of different profiles must not share resources, so name
+	// them after the profile unless the file says otherwise.
+	if profile != "" {
+		v.SetDefault("name", profile)
+	}
+
+	for k, val := range opts.Overrides {
+		if !known[k] {
+			r.Errors = append(r.Errors, &FieldError{Path: k, Message: "unknown key"})
+			continue
+		}
+		v.Set(k, val)
+	}
+
+	var verrs []*FieldError
+	r.Config = &Config{}
+	if err := v.UnmarshalExact(r.Config); err != nil {
+		verrs = append(verrs, decodeErrors(err)...)
+	}
+	r.Config.ProviderOptions = stringKeys(r.Config.ProviderOptions)
+	r.Config.Ansible.Vars = stringKeys(r.Config.Ansible.Vars)
+	r.Config.Ansible.ExtraVars = stringKeys(r.Config.Ansible.ExtraVars)
+	// Validate even a partially decoded config to report every problem at
+	// once, skipping keys that already failed to decode, and their nested
+	// keys.
+	failed := func(path string) bool {
+		for _, fe := range verrs {
+			if path == fe.Path || strings.HasPrefix(path, fe.Path+".") || strings.HasPrefix(path, fe.Path+"[") {
+				return true
+			}
+		}
+		return false
+	}
+	valid := r.Config.Validate()
+	if opts.Validate != nil {
+		valid = append(valid, opts.Validate(r.Config)...)
+	}
+	for _, fe := range valid {
+		if !failed(fe.Path) {
+			verrs = append(verrs, fe)
+		}
+	}
+	// Point the errors about file values at the section they were read from.
+	for _, fe := range verrs {
+		if src, ok := r.sources[fe.Path]; ok && src != SourceFile {
+			continue
+		}
+		key := strings.SplitN(fe.Path, "[", 2)[0]
+		if l := sectionOf(layers, key); l != nil && l.section != "" {
+			fe.Path = l.section + "." + fe.Path
+		}
+	}
+	r.Errors = append(r.Errors, verrs...)
+	sortErrors(r.Errors)
+
+	return r, nil
+}
+
+// stringKeys converts the maps nested in a free-form setting, which YAML
+// decodes with interface{} keys, to maps with string keys, so that the
+// setting can be encoded in JSON, e.g. in the state or the inventory.
+func stringKeys(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = stringKeysValue(v)
+	}
+	return out
+}
+
+func stringKeysValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = stringKeysValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		return stringKeys(v)
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, val := range v {
+			items[i] = stringKeysValue(val)
+		}
+		return items
+	default:
+		return v
+	}
+}
+
+// sectionOf returns the highest precedence layer that sets the given key, or
+// nil if none of them does.
+func sectionOf(layers []layer, key string) *layer {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if lookup(layers[i].settings, key) {
+			return &layers[i]
+		}
+	}
+	return nil
+}
+
+// EnvVar returns the name of the environment variable that overrides the
+// given key.
+func EnvVar(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+func hasEnv(key string) bool {
+	_, ok := os.LookupEnv(EnvVar(key))
+	return ok
+}
+
+// Keys returns the dotted paths of all the configuration keys.
+func Keys() []string {
+	var result []string
+	for _, f := range fields(reflect.TypeOf(Config{}), "") {
+		result = append(result, f.key)
+	}
+	return result
+}
+
+// field is a leaf configuration key.
+type field struct {
+	key string
+	typ reflect.Type
+}
+
+// fields walks the mapstructure tags of the given struct type and returns its
+// leaf keys. Slices and maps are leaves.
+func fields(t reflect.Type, prefix string) []field {
+	var result []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("mapstructure")
+		if name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if f.Type.Kind() == reflect.Struct {
+			result = append(result, fields(f.Type, name)...)
+			continue
+		}
+		result = append(result, field{key: name, typ: f.Type})
+	}
+	return result
+}
@@ -0,0 +1,233 @@
+package config_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+func TestResolveErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		opts config.Options
+		want []string
+	}{
+		{
+			name: "unknown key",
+			file: "regoin: eu-west-1\n",
+			want: []string{"regoin: unknown key"},
+		},
+		{
+			name: "unknown nested key",
+			file: "disk:\n  sise_gb: 10\n",
+			want: []string{"disk.sise_gb: unknown key"},
+		},
+		{
+			name: "unknown key in a profile",
+			file: "profiles:\n  build:\n    machine_tpye: large\n",
+			opts: config.Options{Profile: "build"},
+			want: []string{"profiles.build.machine_tpye: unknown key"},
+		},
+		{
+			name: "unknown override",
+			opts: config.Options{Overrides: map[string]string{"disk.sise_gb": "10"}},
+			want: []string{"disk.sise_gb: unknown key"},
+		},
+		{
+			name: "wrong type",
+			file: "disk:\n  size_gb: big\n",
+			want: []string{`disk.size_gb: cannot parse as int: strconv.ParseInt: parsing "big": invalid syntax`},
+		},
+		{
+			name: "wrong duration",
+			file: "readiness:\n  timeout: soon\n",
+			want: []string{`readiness.timeout: time: invalid duration "soon"`},
+		},
+		{
+			name: "wrong type of a section",
+			file: "ssh: dev\n",
+			want: []string{"ssh: expected a map, got 'string'"},
+		},
+		{
+			name: "wrong type in a profile",
+			file: "defaults:\n  disk:\n    size_gb: 50\nprofiles:\n  build:\n    disk:\n      size_gb: huge\n",
+			opts: config.Options{Profile: "build"},
+			want: []string{`profiles.build.disk.size_gb: cannot parse as int: strconv.ParseInt: parsing "huge": invalid syntax`},
+		},
+		{
+			name: "invalid value in the defaults",
+			file: "defaults:\n  ports: [22, 70000]\n",
+			want: []string{"defaults.ports[1]: 70000 is not a valid port number"},
+		},
+		{
+			name: "invalid sections",
+			file: "defaults: [disk]\nprofiles: build\n",
+			want: []string{
+				"defaults: must be a mapping of configuration keys",
+				"profiles: must be a mapping of profile names to configuration keys",
+			},
+		},
+		{
+			name: "all at once",
+			file: `name: Dev
+regoin: eu-west-1
+disk:
+  size_gb: big
+ports: [22, 22]
+ssh:
+  user: Bad User
+readiness:
+  timeout: soon
+`,
+			opts: config.Options{Overrides: map[string]string{"colour": "blue"}},
+			want: []string{
+				`colour: unknown key`,
+				`disk.size_gb: cannot parse as int: strconv.ParseInt: parsing "big": invalid syntax`,
+				`name: "Dev" must be at most 63 lowercase letters, digits or dashes, starting with a letter`,
+				`ports[1]: port 22 is listed more than once`,
+				`readiness.timeout: time: invalid duration "soon"`,
+				`regoin: unknown key`,
+				`ssh.user: "Bad User" is not a valid user name`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeConfig(t, "provider: fake\n"+tt.file)
+			r, err := config.Resolve(file, tt.opts)
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			var got []string
+			for _, fe := range r.Errors {
+				got = append(got, fe.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() errors =\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(tt.want, "\n  "))
+			}
+
+			_, err = config.Load(file, tt.opts)
+			var verr *config.ValidationError
+			if !errors.As(err, &verr) || len(verr.Errors) != len(tt.want) || verr.File != file {
+				t.Errorf("Load() error = %v, want a *ValidationError with all the errors", err)
+			}
+		})
+	}
+}
+
+func TestResolveProfile(t *testing.T) {
+	file := writeConfig(t, `
+provider: fake
+region: eu-west-1
+defaults:
+  machine_type: small
+  disk:
+    size_gb: 50
+    type: ssd
+  provider_options:
+    gpu: none
+    zone: a
+profiles:
+  build:
+    machine_type: large
+    disk:
+      size_gb: 200
+    provider_options:
+      gpu: 1
+  named:
+    name: shared
+`)
+	r, err := config.Resolve(file, config.Options{Profile: "Build"})
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Resolve() errors: %v", err)
+	}
+	c := r.Config
+	if c.Name != "build" || c.Region != "eu-west-1" || c.MachineType != "large" || c.Disk.SizeGB != 200 || c.Disk.Type != "ssd" {
+		t.Errorf("Resolve() = name %q, region %q, machine type %q, disk %+v, want the profile merged over the defaults",
+			c.Name, c.Region, c.MachineType, c.Disk)
+	}
+	// A value replaces the one of a lower section even if it's of another
+	// type.
+	if want := map[string]interface{}{"gpu": 1, "zone": "a"}; !reflect.DeepEqual(c.ProviderOptions, want) {
+		t.Errorf("provider_options = %v, want %v", c.ProviderOptions, want)
+	}
+	sections := map[string]string{
+		"region":       "",
+		"machine_type": "profiles.build",
+		"disk.size_gb": "profiles.build",
+		"disk.type":    "defaults",
+		"name":         "",
+	}
+	for key, want := range sections {
+		if got := r.Section(key); got != want {
+			t.Errorf("Section(%q) = %q, want %q", key, got, want)
+		}
+	}
+
+	// The name of the profile is only a default.
+	if c, err := config.Load(file, config.Options{Profile: "named"}); err != nil || c.Name != "shared" {
+		t.Errorf("Load() of profile named = %+v, %v, want the name of the profile section", c, err)
+	}
+	// Without a profile, the defaults section still applies.
+	if c, err := config.Load(file, config.Options{}); err != nil || c.Name != "clouddev" || c.MachineType != "small" {
+		t.Errorf("Load() without a profile = %+v, %v, want the defaults section", c, err)
+	}
+
+	_, err = config.Resolve(file, config.Options{Profile: "gpu"})
+	if err == nil || !strings.Contains(err.Error(), `profile "gpu" not found, available profiles: build, named`) {
+		t.Errorf("Resolve() of an unknown profile error = %v", err)
+	}
+	profiles, err := config.Profiles(file)
+	if err != nil || !reflect.DeepEqual(profiles, []string{"build", "named"}) {
+		t.Errorf("Profiles() = %v, %v, want build and named", profiles, err)
+	}
+}
+
+func TestResolveSources(t *testing.T) {
+	file := writeConfig(t, `
+provider: fake
+region: eu-west-1
+machine_type: small
+disk:
+  size_gb: 30
+`)
+	t.Setenv(config.EnvVar("disk.size_gb"), "40")
+	t.Setenv(config.EnvVar("region"), "us-east-1")
+	r, err := config.Resolve(file, config.Options{Overrides: map[string]string{"region": "ap-south-1"}})
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Resolve() errors: %v", err)
+	}
+	tests := []struct {
+		key    string
+		source config.Source
+		value  interface{}
+	}{
+		{key: "provider", source: config.SourceFile, value: "fake"},
+		{key: "machine_type", source: config.SourceFile, value: "small"},
+		{key: "disk.size_gb", source: config.SourceEnv, value: 40},
+		{key: "region", source: config.SourceFlag, value: "ap-south-1"},
+		{key: "ssh.user", source: config.SourceDefault, value: "clouddev"},
+		{key: "readiness.timeout", source: config.SourceDefault, value: "15m0s"},
+	}
+	for _, tt := range tests {
+		if got := r.Source(tt.key); got != tt.source {
+			t.Errorf("Source(%q) = %q, want %q", tt.key, got, tt.source)
+		}
+		if got := r.Value(tt.key); !reflect.DeepEqual(got, tt.value) {
+			t.Errorf("Value(%q) = %#v, want %#v", tt.key, got, tt.value)
+		}
+	}
+	if got := r.Section("disk.size_gb"); got != "" {
+		t.Errorf("Section() of a value from the environment = %q, want none", got)
+	}
+}
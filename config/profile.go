@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// defaultsKey is the config file section merged into every profile.
+	defaultsKey = "defaults"
+	// profilesKey is the config file section of the named profiles.
+	profilesKey = "profiles"
+)
+
+// layer is a section of the config file merged into the configuration.
+type layer struct {
+	// section is the key path of the section in the file, empty for the top
+	// level.
+	section  string
+	settings map[string]interface{}
+}
+
+// fileLayers splits the config file settings into the sections that make up
+// the configuration of the given profile, lowest precedence first: the top
+// level keys, the defaults section and the profile section.
+func fileLayers(settings map[string]interface{}, profile string) ([]layer, []*FieldError, error) {
+	var errs []*FieldError
+	base := map[string]interface{}{}
+	for k, v := range settings {
+		if k != defaultsKey && k != profilesKey {
+			base[k] = v
+		}
+	}
+	layers := []layer{{settings: base}}
+
+	if d, ok := settings[defaultsKey]; ok {
+		m, ok := d.(map[string]interface{})
+		if !ok {
+			errs = append(errs, &FieldError{Path: defaultsKey, Message: "must be a mapping of configuration keys"})
+		} else {
+			layers = append(layers, layer{section: defaultsKey, settings: m})
+		}
+	}
+
+	profiles, perrs := profileSettings(settings)
+	errs = append(errs, perrs...)
+	if profile != "" {
+		p, ok := profiles[profile]
+		if !ok {
+			return nil, nil, fmt.Errorf("profile %q not found, available profiles: %s", profile, strings.Join(sortedKeys(profiles), ", "))
+		}
+		layers = append(layers, layer{section: profilesKey + "." + profile, settings: p})
+	}
+	return layers, errs, nil
+}
+
+// mergeLayers deep merges the settings of the layers, the later ones win.
+// Unlike with viper's merge, a value replaces the one of a lower layer even
+// if it's of another type.
+func mergeLayers(layers []layer) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for _, l := range layers {
+		mergeSettings(merged, l.settings)
+	}
+	return merged
+}
+
+func mergeSettings(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]interface{}); ok {
+			dm, ok := dst[k].(map[string]interface{})
+			if !ok {
+				// Copied so that the layers aren't modified.
+				dm = map[string]interface{}{}
+				dst[k] = dm
+			}
+			mergeSettings(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// profileSettings returns the settings of the profiles section by profile
+// name.
+func profileSettings(settings map[string]interface{}) (map[string]map[string]interface{}, []*FieldError) {
+	profiles := map[string]map[string]interface{}{}
+	p, ok := settings[profilesKey]
+	if !ok {
+		return profiles, nil
+	}
+	m, ok := p.(map[string]interface{})
+	if !ok {
+		return profiles, []*FieldError{{Path: profilesKey, Message: "must be a mapping of profile names to configuration keys"}}
+	}
+	var errs []*FieldError
+	for name, v := range m {
+		pm, ok := v.(map[string]interface{})
+		if !ok {
+			errs = append(errs, &FieldError{Path: profilesKey + "." + name, Message: "must be a mapping of configuration keys"})
+			continue
+		}
+		profiles[name] = pm
+	}
+	return profiles, errs
+}
+
+// lookup returns true if the dotted key path is set in the nested settings.
+func lookup(settings map[string]interface{}, key string) bool {
+	path := strings.Split(key, ".")
+	m := settings
+	for i, k := range path {
+		v, ok := m[k]
+		if !ok {
+			return false
+		}
+		if i == len(path)-1 {
+			return true
+		}
+		if m, ok = v.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Profiles returns the names of the profiles in the given config file.
+func Profiles(file string) ([]string, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", file, err)
+	}
+	profiles, _ := profileSettings(v.AllSettings())
+	return sortedKeys(profiles), nil
+}
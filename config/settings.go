@@ -0,0 +1,64 @@
+package config
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Settings returns the configuration as nested maps keyed by configuration
+// key, the way it's written in the config file. Durations are formatted as
+// strings.
+func (c *Config) Settings() map[string]interface{} {
+	return settings(reflect.ValueOf(c).Elem())
+}
+
+func settings(v reflect.Value) map[string]interface{} {
+	m := map[string]interface{}{}
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("mapstructure")
+		if name == "" || name == "-" {
+			continue
+		}
+		m[name] = setting(v.Field(i))
+	}
+	return m
+}
+
+// setting returns the value the way it's written in the config file.
+func setting(v reflect.Value) interface{} {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Struct:
+		return settings(v)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = settings(v.Index(i))
+		}
+		return items
+	default:
+		return v.Interface()
+	}
+}
+
+// FromSettings decodes a configuration returned by Settings, e.g. after a
+// round trip through JSON. Unknown keys are ignored, so that configurations
+// of newer versions of clouddev can be decoded.
+func FromSettings(m map[string]interface{}) (*Config, error) {
+	c := &Config{}
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           c,
+		WeaklyTypedInput: true,
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Decode(m); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
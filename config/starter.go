@@ -0,0 +1,165 @@
+package config
+
+import (
+	"io"
+	"text/template"
+)
+
+// starterTemplate is the commented configuration file written by
+// WriteStarter.
+var starterTemplate = template.Must(template.New("starter").Parse(`# clouddev configuration.
+#
+# Any key can be overridden with a CLOUDDEV_ prefixed environment variable,
+# e.g. CLOUDDEV_DISK_SIZE_GB=50, or on the command line with
+# --set disk.size_gb=50. Run "clouddev config view" to see the effective
+# configuration and "clouddev config validate" to check this file.
+
+# Name of the environment, used to name the provisioned resources.
+name: {{ printf "%q" .Name }}
+
+# Cloud provider to provision the environment on.
+provider: {{ printf "%q" .Provider }}
+
+# Provider specific region, machine size and machine image.
+region: {{ printf "%q" .Region }}
+machine_type: {{ printf "%q" .MachineType }}
+image: {{ printf "%q" .Image }}
+
+# Boot disk of the machine.
+disk:
+  size_gb: {{ .Disk.SizeGB }}
+  # Provider specific disk type, the provider default if empty.
+  # type: pd-ssd
+
+# User to log in as over SSH. An ed25519 key is generated for the
+# environment in ~/.clouddev/keys, optionally protected by a passphrase kept
+# in ssh-agent, unless an existing key is set.
+ssh:
+  user: {{ printf "%q" .SSH.User }}
+  # key_passphrase: false
+  # Keep a "Host clouddev-<name>" entry in ~/.ssh/config.
+  # write_config: false
+  # private_key: ~/.ssh/id_ed25519
+  # public_key: ~/.ssh/id_ed25519.pub
+
+# TCP ports to allow inbound traffic on.
+ports:
+{{- range .Ports }}
+  - {{ . }}
+{{- end }}
+
+# First boot setup of the machine, see the output of
+# "clouddev config render-userdata".
+bootstrap:
+  # timezone: Europe/Paris
+  # groups: [docker]
+  # users:
+  #   - name: ci
+  #     groups: [docker]
+  #     sudo: false
+  #     ssh_authorized_keys: []
+  # Files to write, with inline content or the content of a local file.
+  # files:
+  #   - path: /etc/motd
+  #     content: "Welcome\n"
+  #     permissions: "0644"
+  #     owner: root:root
+  # swap_mb: 2048
+  # OS packages to install.
+  packages: []
+  # apt_packages: []
+  # dnf_packages: []
+  # Shell scripts to run after the packages are installed.
+  # scripts:
+  #   - name: setup.sh
+  #     source: setup.sh
+  # systemd units to install.
+  # units:
+  #   - name: app.service
+  #     source: app.service
+  #     enable: true
+  # Shell commands to run last.
+  commands: []
+
+# How up waits for the machine to be ready after creating it: for SSH, for
+# the bootstrap to finish, then for the health checks to pass. The output of
+# cloud-init is shown meanwhile.
+readiness:
+  timeout: 15m
+  # cloud-init, sentinel (wait for the sentinel file to exist) or none.
+  wait: cloud-init
+  # sentinel: /var/lib/cloud/instance/boot-finished
+  # Commands run on the machine, ports of the machine and URLs, retried
+  # until they pass or time out. An empty URL host is the machine.
+  # checks:
+  #   - command: docker info
+  #   - tcp: 5432
+  #     timeout: 5m
+  #   - name: app
+  #     http: http://:8080/healthz
+  #     status: 200
+
+# Dotfiles installed once the machine is ready, from a local directory or a
+# git repository, with their install script (install.sh, bootstrap.sh,
+# setup.sh, ...) or by symlinking their files in the home directory. Run
+# "clouddev dotfiles sync" to install them again.
+dotfiles:
+  # path: ~/dotfiles
+  # repo: https://github.com/me/dotfiles.git
+  # ref: main
+  dir: {{ printf "%q" .Dotfiles.Dir }}
+  # install: install.sh
+  # symlink: false
+
+# Ansible playbooks applied once the machine is ready, with a generated
+# inventory of the environment and its vars. They're applied again by up when
+# the playbooks, the files next to them or this section change. Print the
+# inventory with "clouddev inventory".
+ansible:
+  # playbooks:
+  #   - ansible/devbox.yml
+  # vars:
+  #   go_version: "1.17"
+  # extra_vars:
+  #   team: platform
+  # tags: []
+  # skip_tags: []
+  # become: true
+  command: {{ printf "%q" .Ansible.Command }}
+
+# Where the state of the provisioned environments is stored. The s3 backend
+# shares it between machines through S3 compatible object storage, with the
+# credentials read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+# environment variables.
+state:
+  backend: local
+  # s3:
+  #   bucket: my-clouddev-state
+  #   endpoint: http://localhost:9000
+  #   path_style: true
+
+# Provider specific options.
+provider_options: {}
+`))
+
+// Default returns a configuration with all the default values set.
+func Default() *Config {
+	return &Config{
+		Name:  defaults["name"].(string),
+		Disk:  Disk{SizeGB: defaults["disk.size_gb"].(int)},
+		SSH:   SSH{User: defaults["ssh.user"].(string)},
+		Ports: append([]int(nil), defaults["ports"].([]int)...),
+		Dotfiles: Dotfiles{
+			Dir: defaults["dotfiles.dir"].(string),
+		},
+		Ansible: Ansible{
+			Command: defaults["ansible.command"].(string),
+		},
+	}
+}
+
+// WriteStarter writes a commented configuration file with the values of the
+// given configuration.
+func WriteStarter(w io.Writer, c *Config) error {
+	return starterTemplate.Execute(w, c)
+}
@@ -0,0 +1,274 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// nameRegexp matches names that are valid resource names on all the
+	// supported providers.
+	nameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	// userRegexp matches valid Linux user names.
+	userRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	// timezoneRegexp matches tz database names.
+	timezoneRegexp = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+	// permissionsRegexp matches octal file permissions.
+	permissionsRegexp = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+	// unitRegexp matches systemd unit names.
+	unitRegexp = regexp.MustCompile(`^[A-Za-z0-9:_.@\\-]+\.(service|socket|timer|mount|automount|path|target|slice)$`)
+)
+
+// ValidName returns an error if name isn't a valid environment name.
+func ValidName(name string) error {
+	if !nameRegexp.MatchString(name) {
+		return fmt.Errorf("%q must be at most 63 lowercase letters, digits or dashes, starting with a letter", name)
+	}
+	return nil
+}
+
+// Validate checks the configuration values and returns all the problems
+// found.
+func (c *Config) Validate() []*FieldError {
+	var errs []*FieldError
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Name == "" {
+		add("name", "is required")
+	} else if err := ValidName(c.Name); err != nil {
+		add("name", "%v", err)
+	}
+	if c.Provider == "" {
+		add("provider", "is required")
+	}
+	if c.Disk.SizeGB <= 0 {
+		add("disk.size_gb", "must be greater than 0, got %d", c.Disk.SizeGB)
+	}
+	if c.SSH.User == "" {
+		add("ssh.user", "is required")
+	} else if !userRegexp.MatchString(c.SSH.User) {
+		add("ssh.user", "%q is not a valid user name", c.SSH.User)
+	}
+	if c.SSH.KeyPassphrase && (c.SSH.PublicKey != "" || c.SSH.PrivateKey != "") {
+		add("ssh.key_passphrase", "only applies to the generated key, not to ssh.public_key or ssh.private_key")
+	}
+
+	seen := map[int]bool{}
+	for i, p := range c.Ports {
+		path := fmt.Sprintf("ports[%d]", i)
+		if p < 1 || p > 65535 {
+			add(path, "%d is not a valid port number", p)
+		} else if seen[p] {
+			add(path, "port %d is listed more than once", p)
+		}
+		seen[p] = true
+	}
+
+	c.Bootstrap.validate(add)
+	c.Readiness.validate(add)
+	c.Dotfiles.validate(add)
+	c.Ansible.validate(add)
+
+	switch c.State.Backend {
+	case "local":
+	case "s3":
+		if c.State.S3.Bucket == "" {
+			add("state.s3.bucket", "is required by the s3 backend")
+		}
+		if c.State.S3.Lease < 10*time.Second {
+			add("state.s3.lease", "must be at least 10s, got %s", c.State.S3.Lease)
+		}
+	default:
+		add("state.backend", "%q is not a state backend, expected local or s3", c.State.Backend)
+	}
+
+	return errs
+}
+
+// validate checks the bootstrap steps, reporting the problems with add.
+func (b *Bootstrap) validate(add func(path, format string, args ...interface{})) {
+	if b.Timezone != "" && !timezoneRegexp.MatchString(b.Timezone) {
+		add("bootstrap.timezone", "%q is not a timezone name, e.g. Europe/Paris", b.Timezone)
+	}
+	for i, g := range b.Groups {
+		if !userRegexp.MatchString(g) {
+			add(fmt.Sprintf("bootstrap.groups[%d]", i), "%q is not a valid group name", g)
+		}
+	}
+	users := map[string]bool{}
+	for i, u := range b.Users {
+		path := fmt.Sprintf("bootstrap.users[%d]", i)
+		switch {
+		case !userRegexp.MatchString(u.Name):
+			add(path+".name", "%q is not a valid user name", u.Name)
+		case users[u.Name]:
+			add(path+".name", "user %s is listed more than once", u.Name)
+		}
+		users[u.Name] = true
+		for j, g := range u.Groups {
+			if !userRegexp.MatchString(g) {
+				add(fmt.Sprintf("%s.groups[%d]", path, j), "%q is not a valid group name", g)
+			}
+		}
+	}
+	files := map[string]bool{}
+	for i, f := range b.Files {
+		path := fmt.Sprintf("bootstrap.files[%d]", i)
+		switch {
+		case !strings.HasPrefix(f.Path, "/"):
+			add(path+".path", "must be an absolute path, got %q", f.Path)
+		case files[f.Path]:
+			add(path+".path", "file %s is listed more than once", f.Path)
+		}
+		files[f.Path] = true
+		validateContent(add, path, f.Content, f.Source)
+		if f.Permissions != "" && !permissionsRegexp.MatchString(f.Permissions) {
+			add(path+".permissions", "%q is not octal permissions, e.g. \"0644\"", f.Permissions)
+		}
+	}
+	if b.SwapMB < 0 {
+		add("bootstrap.swap_mb", "must not be negative, got %d", b.SwapMB)
+	}
+	for key, pkgs := range map[string][]string{"packages": b.Packages, "apt_packages": b.AptPackages, "dnf_packages": b.DnfPackages} {
+		for i, pkg := range pkgs {
+			if strings.TrimSpace(pkg) == "" {
+				add(fmt.Sprintf("bootstrap.%s[%d]", key, i), "must not be empty")
+			}
+		}
+	}
+	scripts := map[string]bool{}
+	for i, sc := range b.Scripts {
+		path := fmt.Sprintf("bootstrap.scripts[%d]", i)
+		switch {
+		case sc.Name == "" || strings.ContainsAny(sc.Name, "/\"\\") || strings.TrimSpace(sc.Name) != sc.Name:
+			add(path+".name", "must be a file name, got %q", sc.Name)
+		case scripts[sc.Name]:
+			add(path+".name", "script %s is listed more than once", sc.Name)
+		}
+		scripts[sc.Name] = true
+		validateContent(add, path, sc.Content, sc.Source)
+	}
+	units := map[string]bool{}
+	for i, u := range b.Units {
+		path := fmt.Sprintf("bootstrap.units[%d]", i)
+		switch {
+		case !unitRegexp.MatchString(u.Name):
+			add(path+".name", "%q is not a systemd unit name, e.g. app.service", u.Name)
+		case units[u.Name]:
+			add(path+".name", "unit %s is listed more than once", u.Name)
+		}
+		units[u.Name] = true
+		validateContent(add, path, u.Content, u.Source)
+	}
+	for i, cmd := range b.Commands {
+		if strings.TrimSpace(cmd) == "" {
+			add(fmt.Sprintf("bootstrap.commands[%d]", i), "must not be empty")
+		}
+	}
+}
+
+func (r *Readiness) validate(add func(path, format string, args ...interface{})) {
+	if r.Timeout <= 0 {
+		add("readiness.timeout", "must be greater than 0, got %s", r.Timeout)
+	}
+	switch r.Wait {
+	case "cloud-init", "none":
+	case "sentinel":
+		if !strings.HasPrefix(r.Sentinel, "/") {
+			add("readiness.sentinel", "must be an absolute path, got %q", r.Sentinel)
+		}
+	default:
+		add("readiness.wait", "%q is not a wait, expected cloud-init, sentinel or none", r.Wait)
+	}
+	for i, c := range r.Checks {
+		path := fmt.Sprintf("readiness.checks[%d]", i)
+		n := 0
+		if c.Command != "" {
+			n++
+			if c.ExitCode < 0 || c.ExitCode > 255 {
+				add(path+".exit_code", "%d is not an exit code", c.ExitCode)
+			}
+		}
+		if c.TCP != 0 {
+			n++
+			if c.TCP < 1 || c.TCP > 65535 {
+				add(path+".tcp", "%d is not a valid port number", c.TCP)
+			}
+		}
+		if c.HTTP != "" {
+			n++
+			if u, err := url.Parse(c.HTTP); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				add(path+".http", "%q is not an http or https URL", c.HTTP)
+			}
+			if c.Status != 0 && (c.Status < 100 || c.Status > 599) {
+				add(path+".status", "%d is not an HTTP status code", c.Status)
+			}
+		}
+		if n != 1 {
+			add(path, "exactly one of command, tcp and http must be set")
+		}
+		if c.Timeout < 0 {
+			add(path+".timeout", "must not be negative, got %s", c.Timeout)
+		}
+	}
+}
+
+func (d *Dotfiles) validate(add func(path, format string, args ...interface{})) {
+	if d.Path != "" && d.Repo != "" {
+		add("dotfiles", "path and repo can't both be set")
+	}
+	if d.Ref != "" && d.Repo == "" {
+		add("dotfiles.ref", "only applies to repo")
+	}
+	if d.Install != "" && d.Symlink {
+		add("dotfiles", "install and symlink can't both be set")
+	}
+	if !relativePath(d.Dir) || path.Clean(d.Dir) == "." {
+		add("dotfiles.dir", "must be a directory relative to the home directory, got %q", d.Dir)
+	}
+	if d.Install != "" && !relativePath(d.Install) {
+		add("dotfiles.install", "must be a path relative to the dotfiles, got %q", d.Install)
+	}
+}
+
+func (a *Ansible) validate(add func(path, format string, args ...interface{})) {
+	for i, p := range a.Playbooks {
+		if strings.TrimSpace(p) == "" {
+			add(fmt.Sprintf("ansible.playbooks[%d]", i), "must not be empty")
+		}
+	}
+	for key, tags := range map[string][]string{"tags": a.Tags, "skip_tags": a.SkipTags} {
+		for i, t := range tags {
+			if t == "" || strings.ContainsAny(t, ", ") {
+				add(fmt.Sprintf("ansible.%s[%d]", key, i), "%q is not a valid tag", t)
+			}
+		}
+	}
+	if a.Enabled() && strings.TrimSpace(a.Command) == "" {
+		add("ansible.command", "is required with playbooks")
+	}
+}
+
+// relativePath returns true if the slash separated path is relative and
+// stays under the directory it's relative to.
+func relativePath(p string) bool {
+	p = path.Clean(p)
+	return p != "" && !path.IsAbs(p) && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// validateContent checks that exactly one of the inline content and the
+// source file is set.
+func validateContent(add func(path, format string, args ...interface{}), path, content, source string) {
+	switch {
+	case content != "" && source != "":
+		add(path, "content and source can't both be set")
+	case content == "" && source == "":
+		add(path, "content or source is required")
+	}
+}
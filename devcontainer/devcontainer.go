@@ -0,0 +1,378 @@
+// Package devcontainer runs the development container of a repository,
+// defined by its devcontainer.json, on a provisioned machine.
+//
+// The container is built and run with Docker on the machine, over SSH, with
+// the repository uploaded to the machine as its workspace. The properties of
+// devcontainer.json that clouddev doesn't support are reported rather than
+// ignored.
+package devcontainer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config is a devcontainer.json, with the properties clouddev supports.
+type Config struct {
+	// Path is the path of the devcontainer.json file.
+	Path string `json:"-"`
+	// Workspace is the local directory of the repository.
+	Workspace string `json:"-"`
+	// Unsupported are the properties of the file clouddev doesn't support,
+	// sorted.
+	Unsupported []string `json:"-"`
+
+	Name              string            `json:"name"`
+	Image             string            `json:"image"`
+	Build             *Build            `json:"build"`
+	Features          Features          `json:"features"`
+	ForwardPorts      []Port            `json:"forwardPorts"`
+	PostCreateCommand *Command          `json:"postCreateCommand"`
+	RemoteUser        string            `json:"remoteUser"`
+	ContainerUser     string            `json:"containerUser"`
+	Mounts            []Mount           `json:"mounts"`
+	ContainerEnv      map[string]string `json:"containerEnv"`
+	HostRequirements  *HostRequirements `json:"hostRequirements"`
+	WorkspaceFolder   string            `json:"workspaceFolder"`
+	WorkspaceMount    string            `json:"workspaceMount"`
+	OverrideCommand   *bool             `json:"overrideCommand"`
+}
+
+// Build is how the image is built from a Dockerfile. The paths are relative
+// to the devcontainer.json file.
+type Build struct {
+	Dockerfile string            `json:"dockerfile"`
+	Context    string            `json:"context"`
+	Args       map[string]string `json:"args"`
+	Target     string            `json:"target"`
+}
+
+// Feature is a feature installed in the image, with its options.
+type Feature struct {
+	// ID is the reference of the feature: an OCI reference, the URL of a
+	// tarball, or a directory relative to the devcontainer.json file.
+	ID      string
+	Options map[string]interface{}
+}
+
+// Features are the features of a devcontainer.json, in the order they're
+// listed in.
+type Features []Feature
+
+// UnmarshalJSON implements json.Unmarshaler, keeping the order of the
+// features.
+func (fs *Features) UnmarshalJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return errors.New("features must be an object")
+	}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		f := Feature{ID: t.(string), Options: map[string]interface{}{}}
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			f.Options = v
+		case string:
+			// A string is the version of the feature.
+			f.Options["version"] = v
+		case bool:
+		default:
+			return fmt.Errorf("the options of feature %s must be an object", f.ID)
+		}
+		*fs = append(*fs, f)
+	}
+	_, err := d.Token()
+	return err
+}
+
+// Port is a port forwarded from the container.
+type Port struct {
+	Port int
+	// Host is the host of a "host:port" port, forwarded from another
+	// container.
+	Host string
+}
+
+// UnmarshalJSON implements json.Unmarshaler for a port number or a
+// "host:port" string.
+func (p *Port) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.Port); err == nil {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid port %s", data)
+	}
+	i := strings.LastIndex(s, ":")
+	port, err := strconv.Atoi(s[i+1:])
+	if err != nil || i < 0 {
+		return fmt.Errorf("invalid port %q, expected a number or host:port", s)
+	}
+	p.Host, p.Port = s[:i], port
+	return nil
+}
+
+// local returns true if the port is a port of the container.
+func (p Port) local() bool {
+	return p.Host == "" || p.Host == "localhost" || p.Host == "127.0.0.1"
+}
+
+// Command is a lifecycle command: a shell command, a command and its
+// arguments, or named commands of either kind run in parallel.
+type Command struct {
+	Shell    string
+	Args     []string
+	Parallel map[string]*Command
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *Command) UnmarshalJSON(data []byte) error {
+	if json.Unmarshal(data, &c.Shell) == nil || json.Unmarshal(data, &c.Args) == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &c.Parallel); err != nil {
+		return errors.New("a command must be a string, an array or an object")
+	}
+	return nil
+}
+
+// Mount is a mount of the container, in the syntax of docker run --mount.
+type Mount string
+
+// UnmarshalJSON implements json.Unmarshaler for the string and the object
+// forms of a mount.
+func (m *Mount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*m = Mount(s)
+		return nil
+	}
+	var o struct {
+		Type   string `json:"type"`
+		Source string `json:"source"`
+		Target string `json:"target"`
+	}
+	if err := json.Unmarshal(data, &o); err != nil {
+		return fmt.Errorf("invalid mount %s", data)
+	}
+	s = "type=" + o.Type
+	if o.Source != "" {
+		s += ",source=" + o.Source
+	}
+	*m = Mount(s + ",target=" + o.Target)
+	return nil
+}
+
+// HostRequirements are the minimum resources of the machine.
+type HostRequirements struct {
+	CPUs    int         `json:"cpus"`
+	Memory  string      `json:"memory"`
+	Storage string      `json:"storage"`
+	GPU     interface{} `json:"gpu"`
+}
+
+// MemoryMB returns the required memory in MiB.
+func (h *HostRequirements) MemoryMB() (int, error) {
+	b, err := parseBytes(h.Memory)
+	return int(math.Ceil(b / (1 << 20))), err
+}
+
+// StorageGB returns the required storage in GiB.
+func (h *HostRequirements) StorageGB() (int, error) {
+	b, err := parseBytes(h.Storage)
+	return int(math.Ceil(b / (1 << 30))), err
+}
+
+var bytesRegexp = regexp.MustCompile(`^(\d+)([tgmk]b)?$`)
+
+// parseBytes parses an amount of bytes with an optional unit, e.g. 4gb.
+func parseBytes(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m := bytesRegexp.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid amount %q, expected e.g. 4gb", s)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	shift := map[string]uint{"": 0, "kb": 10, "mb": 20, "gb": 30, "tb": 40}[m[2]]
+	return n * float64(uint64(1)<<shift), nil
+}
+
+// supported are the properties clouddev supports, with the supported
+// properties of their objects.
+var supported = map[string][]string{
+	"$schema":           nil,
+	"name":              nil,
+	"image":             nil,
+	"build":             {"dockerfile", "context", "args", "target"},
+	"features":          nil,
+	"forwardPorts":      nil,
+	"postCreateCommand": nil,
+	"remoteUser":        nil,
+	"containerUser":     nil,
+	"mounts":            nil,
+	"containerEnv":      nil,
+	"hostRequirements":  {"cpus", "memory", "storage", "gpu"},
+	"workspaceFolder":   nil,
+	"workspaceMount":    nil,
+	"overrideCommand":   nil,
+}
+
+// Find returns the path of the devcontainer.json of a repository, or the
+// path itself if it's a file.
+func Find(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return path, nil
+	}
+	for _, name := range []string{".devcontainer/devcontainer.json", ".devcontainer.json"} {
+		p := filepath.Join(path, name)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no .devcontainer/devcontainer.json or .devcontainer.json", path)
+}
+
+// Load reads the devcontainer.json of the repository at the given path, or
+// the devcontainer.json file at the given path.
+func Load(path string) (*Config, error) {
+	file, err := Find(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err = filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data = standardize(data)
+
+	c := &Config{Path: file, Workspace: filepath.Dir(file)}
+	if filepath.Base(c.Workspace) == ".devcontainer" {
+		c.Workspace = filepath.Dir(c.Workspace)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	var props map[string]json.RawMessage
+	if err := json.Unmarshal(data, &props); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	if _, ok := props["dockerComposeFile"]; ok {
+		return nil, fmt.Errorf("%s uses Docker Compose, which clouddev doesn't support", file)
+	}
+	c.Unsupported = unsupported(props)
+	for _, p := range c.ForwardPorts {
+		if !p.local() {
+			c.Unsupported = append(c.Unsupported, fmt.Sprintf("forwardPorts (%s:%d)", p.Host, p.Port))
+		}
+	}
+	if h := c.HostRequirements; h != nil && h.GPU != nil && h.GPU != false && h.GPU != "optional" {
+		c.Unsupported = append(c.Unsupported, "hostRequirements.gpu")
+	}
+	sort.Strings(c.Unsupported)
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", file, err)
+	}
+	return c, nil
+}
+
+// unsupported returns the unsupported properties of a devcontainer.json.
+func unsupported(props map[string]json.RawMessage) []string {
+	var names []string
+	for name, v := range props {
+		sub, ok := supported[name]
+		if !ok {
+			names = append(names, name)
+			continue
+		}
+		if sub == nil {
+			continue
+		}
+		var o map[string]json.RawMessage
+		if json.Unmarshal(v, &o) != nil {
+			continue
+		}
+		for k := range o {
+			if !contains(sub, k) {
+				names = append(names, name+"."+k)
+			}
+		}
+	}
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validate() error {
+	switch {
+	case c.Image == "" && (c.Build == nil || c.Build.Dockerfile == ""):
+		return errors.New("image or build.dockerfile is required")
+	case c.Image != "" && c.Build != nil && c.Build.Dockerfile != "":
+		return errors.New("image and build.dockerfile can't both be set")
+	}
+	for _, p := range c.ForwardPorts {
+		if p.Port < 1 || p.Port > 65535 {
+			return fmt.Errorf("%d is not a valid port number", p.Port)
+		}
+	}
+	if h := c.HostRequirements; h != nil {
+		if _, err := h.MemoryMB(); err != nil {
+			return fmt.Errorf("hostRequirements.memory: %w", err)
+		}
+		if _, err := h.StorageGB(); err != nil {
+			return fmt.Errorf("hostRequirements.storage: %w", err)
+		}
+	}
+	if c.WorkspaceMount != "" && c.WorkspaceFolder == "" {
+		return errors.New("workspaceMount requires workspaceFolder")
+	}
+	return nil
+}
+
+// Ports returns the ports of the container forwarded to the machine.
+func (c *Config) Ports() []int {
+	var ports []int
+	for _, p := range c.ForwardPorts {
+		if p.local() {
+			ports = append(ports, p.Port)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,228 @@
+package devcontainer_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/devcontainer"
+)
+
+// writeDevcontainer writes the devcontainer.json of a new repository and
+// returns the directory of the repository.
+func writeDevcontainer(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	file := filepath.Join(dir, ".devcontainer", "devcontainer.json")
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadJSONC(t *testing.T) {
+	dir := writeDevcontainer(t, `// The devcontainer of the repository.
+{
+	"name": "Go // not a comment", /* a block
+	comment */
+	"image": "mcr.microsoft.com/devcontainers/go:1", // the image
+	"containerEnv": {
+		"GREETING": "say \"hi\", /* not a comment */",
+		"TRAILING": "a,}",
+	},
+	"forwardPorts": [
+		8080,
+		3000, // the frontend
+	],
+	/* "remoteUser": "root", */
+}
+`)
+	c, err := devcontainer.Load(dir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if c.Name != "Go // not a comment" || c.Image != "mcr.microsoft.com/devcontainers/go:1" || c.RemoteUser != "" {
+		t.Errorf("Load() = name %q, image %q, remote user %q", c.Name, c.Image, c.RemoteUser)
+	}
+	wantEnv := map[string]string{"GREETING": `say "hi", /* not a comment */`, "TRAILING": "a,}"}
+	if !reflect.DeepEqual(c.ContainerEnv, wantEnv) {
+		t.Errorf("containerEnv = %q, want %q", c.ContainerEnv, wantEnv)
+	}
+	if got := c.Ports(); !reflect.DeepEqual(got, []int{8080, 3000}) {
+		t.Errorf("Ports() = %v, want [8080 3000]", got)
+	}
+	if c.Path != filepath.Join(dir, ".devcontainer", "devcontainer.json") || c.Workspace != dir {
+		t.Errorf("Load() path %s, workspace %s, want the file in the workspace %s", c.Path, c.Workspace, dir)
+	}
+
+	// Syntax errors are still reported, with the file.
+	dir = writeDevcontainer(t, "{\n\t// comment\n\t\"image\": \"go\",,\n}\n")
+	_, err = devcontainer.Load(dir)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse") || !strings.Contains(err.Error(), "devcontainer.json") {
+		t.Errorf("Load() of invalid JSON error = %v, want a parse error", err)
+	}
+}
+
+func TestLoadFeatures(t *testing.T) {
+	dir := writeDevcontainer(t, `{
+	"image": "debian",
+	"features": {
+		"ghcr.io/devcontainers/features/node:1": {"version": "20"},
+		"./local-feature": true,
+		"ghcr.io/devcontainers/features/go:1": "1.21",
+		"https://example.com/feature.tgz": {}
+	}
+}`)
+	c, err := devcontainer.Load(dir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	// The features are installed in the order they're listed in.
+	want := devcontainer.Features{
+		{ID: "ghcr.io/devcontainers/features/node:1", Options: map[string]interface{}{"version": "20"}},
+		{ID: "./local-feature", Options: map[string]interface{}{}},
+		{ID: "ghcr.io/devcontainers/features/go:1", Options: map[string]interface{}{"version": "1.21"}},
+		{ID: "https://example.com/feature.tgz", Options: map[string]interface{}{}},
+	}
+	if !reflect.DeepEqual(c.Features, want) {
+		t.Errorf("features = %+v, want %+v", c.Features, want)
+	}
+
+	for _, features := range []string{`["go"]`, `{"go": 1}`} {
+		dir := writeDevcontainer(t, `{"image": "debian", "features": `+features+`}`)
+		if _, err := devcontainer.Load(dir); err == nil {
+			t.Errorf("Load() of features %s error = nil", features)
+		}
+	}
+}
+
+func TestLoadForwardPorts(t *testing.T) {
+	dir := writeDevcontainer(t, `{
+	"image": "debian",
+	"forwardPorts": [3000, "db:5432", "localhost:8080", "127.0.0.1:9000"]
+}`)
+	c, err := devcontainer.Load(dir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	// The ports of other containers can't be forwarded.
+	if got := c.Ports(); !reflect.DeepEqual(got, []int{3000, 8080, 9000}) {
+		t.Errorf("Ports() = %v, want [3000 8080 9000]", got)
+	}
+	if want := []string{"forwardPorts (db:5432)"}; !reflect.DeepEqual(c.Unsupported, want) {
+		t.Errorf("Unsupported = %q, want %q", c.Unsupported, want)
+	}
+
+	tests := []struct {
+		port string
+		err  string
+	}{
+		{port: `"db"`, err: `invalid port "db", expected a number or host:port`},
+		{port: `"db:http"`, err: `invalid port "db:http", expected a number or host:port`},
+		{port: `70000`, err: "70000 is not a valid port number"},
+		{port: `"db:0"`, err: "0 is not a valid port number"},
+		{port: `true`, err: "invalid port true"},
+	}
+	for _, tt := range tests {
+		dir := writeDevcontainer(t, `{"image": "debian", "forwardPorts": [`+tt.port+`]}`)
+		_, err := devcontainer.Load(dir)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Load() of port %s error = %v, want %q", tt.port, err, tt.err)
+		}
+	}
+}
+
+func TestHostRequirements(t *testing.T) {
+	tests := []struct {
+		memory, storage string
+		memoryMB        int
+		storageGB       int
+		err             string
+	}{
+		{},
+		{memory: "4gb", storage: "32gb", memoryMB: 4096, storageGB: 32},
+		{memory: "8GB", storage: "1tb", memoryMB: 8192, storageGB: 1024},
+		// Partial units are rounded up.
+		{memory: "1500kb", storage: "1500mb", memoryMB: 2, storageGB: 2},
+		{memory: "1073741824", storage: "1073741825", memoryMB: 1024, storageGB: 2},
+		{memory: "4 gb", err: `hostRequirements.memory: invalid amount "4 gb", expected e.g. 4gb`},
+		{storage: "1.5gb", err: `hostRequirements.storage: invalid amount "1.5gb", expected e.g. 4gb`},
+	}
+	for _, tt := range tests {
+		dir := writeDevcontainer(t, `{"image": "debian", "hostRequirements": {"cpus": 4, "memory": "`+tt.memory+`", "storage": "`+tt.storage+`"}}`)
+		c, err := devcontainer.Load(dir)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load() of memory %q and storage %q error = %v, want %q", tt.memory, tt.storage, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		h := c.HostRequirements
+		memoryMB, err := h.MemoryMB()
+		if err != nil || memoryMB != tt.memoryMB {
+			t.Errorf("MemoryMB() of %q = %d, %v, want %d", tt.memory, memoryMB, err, tt.memoryMB)
+		}
+		storageGB, err := h.StorageGB()
+		if err != nil || storageGB != tt.storageGB {
+			t.Errorf("StorageGB() of %q = %d, %v, want %d", tt.storage, storageGB, err, tt.storageGB)
+		}
+		if h.CPUs != 4 {
+			t.Errorf("cpus = %d, want 4", h.CPUs)
+		}
+	}
+}
+
+func TestLoadUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []string
+	}{
+		{
+			name: "supported",
+			file: `{"$schema": "x", "image": "debian", "build": {"args": {}}, "hostRequirements": {"gpu": "optional"}}`,
+		},
+		{
+			name: "properties",
+			file: `{
+	"image": "debian",
+	"runArgs": ["--cap-add=SYS_PTRACE"],
+	"customizations": {"vscode": {}},
+	"build": {"cacheFrom": "debian"},
+	"hostRequirements": {"cpus": 2, "gpu": true},
+	"postStartCommand": "make"
+}`,
+			want: []string{"build.cacheFrom", "customizations", "hostRequirements.gpu", "postStartCommand", "runArgs"},
+		},
+		{
+			name: "gpu requirements",
+			file: `{"image": "debian", "hostRequirements": {"gpu": {"cores": 1000}}}`,
+			want: []string{"hostRequirements.gpu"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := devcontainer.Load(writeDevcontainer(t, tt.file))
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if !reflect.DeepEqual(c.Unsupported, tt.want) {
+				t.Errorf("Unsupported = %q, want %q", c.Unsupported, tt.want)
+			}
+		})
+	}
+
+	_, err := devcontainer.Load(writeDevcontainer(t, `{"dockerComposeFile": "compose.yml", "service": "app"}`))
+	if err == nil || !strings.Contains(err.Error(), "uses Docker Compose, which clouddev doesn't support") {
+		t.Errorf("Load() of a Docker Compose devcontainer error = %v", err)
+	}
+}
@@ -0,0 +1,430 @@
+package devcontainer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// featureMetadata is the subset of a devcontainer-feature.json clouddev
+// uses.
+type featureMetadata struct {
+	ID      string `json:"id"`
+	Options map[string]struct {
+		Default interface{} `json:"default"`
+	} `json:"options"`
+	ContainerEnv map[string]string `json:"containerEnv"`
+	Privileged   bool              `json:"privileged"`
+	Init         bool              `json:"init"`
+	CapAdd       []string          `json:"capAdd"`
+	SecurityOpt  []string          `json:"securityOpt"`
+	Mounts       []Mount           `json:"mounts"`
+	Entrypoint   string            `json:"entrypoint"`
+}
+
+// stagedFeatures are the features downloaded in the build context of the
+// image that installs them.
+type stagedFeatures struct {
+	// Dir is the build context, with the Dockerfile.
+	Dir      string
+	metadata []*featureMetadata
+	// unsupported are the properties of the features clouddev doesn't
+	// support.
+	unsupported []string
+}
+
+// runArgs returns the docker run arguments the features need.
+func (s *stagedFeatures) runArgs() []string {
+	var args []string
+	privileged, init := false, false
+	for _, m := range s.metadata {
+		privileged = privileged || m.Privileged
+		init = init || m.Init
+		for _, c := range m.CapAdd {
+			args = append(args, "--cap-add", c)
+		}
+		for _, o := range m.SecurityOpt {
+			args = append(args, "--security-opt", o)
+		}
+		for _, mount := range m.Mounts {
+			args = append(args, "--mount", string(mount))
+		}
+	}
+	if privileged {
+		args = append(args, "--privileged")
+	}
+	if init {
+		args = append(args, "--init")
+	}
+	return args
+}
+
+// stageFeatures downloads the features in a temporary directory and writes
+// the Dockerfile that installs them on the base image, passed as the
+// _DEV_CONTAINERS_BASE_IMAGE build argument.
+func (c *Config) stageFeatures(ctx context.Context) (*stagedFeatures, error) {
+	dir, err := ioutil.TempDir("", "clouddev-features-")
+	if err != nil {
+		return nil, err
+	}
+	s := &stagedFeatures{Dir: dir}
+
+	remoteUser := c.RemoteUser
+	if remoteUser == "" {
+		remoteUser = c.ContainerUser
+	}
+	var df strings.Builder
+	df.WriteString("ARG _DEV_CONTAINERS_BASE_IMAGE\nFROM $_DEV_CONTAINERS_BASE_IMAGE\nARG _DEV_CONTAINERS_IMAGE_USER=root\nUSER root\n")
+	for i, f := range c.Features {
+		name := fmt.Sprintf("%02d", i+1)
+		fdir := filepath.Join(dir, name)
+		if err := c.fetchFeature(ctx, f.ID, fdir); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to fetch feature %s: %w", f.ID, err)
+		}
+		m, err := readFeatureMetadata(fdir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("feature %s: %w", f.ID, err)
+		}
+		if m.Entrypoint != "" {
+			s.unsupported = append(s.unsupported, fmt.Sprintf("the entrypoint of feature %s", f.ID))
+		}
+		s.metadata = append(s.metadata, m)
+
+		env := []string{
+			"_REMOTE_USER=" + shellQuote(userOr(remoteUser, "$_DEV_CONTAINERS_IMAGE_USER")),
+			"_CONTAINER_USER=" + shellQuote(userOr(c.ContainerUser, "$_DEV_CONTAINERS_IMAGE_USER")),
+			`_REMOTE_USER_HOME="$(getent passwd "$_REMOTE_USER" | cut -d: -f6)"`,
+			`_CONTAINER_USER_HOME="$(getent passwd "$_CONTAINER_USER" | cut -d: -f6)"`,
+		}
+		env = append(env, featureOptions(m, f.Options)...)
+		fmt.Fprintf(&df, "COPY %[1]s/ /tmp/clouddev-features/%[1]s/\n", name)
+		// The assignments are exported with set -a, and made in order so
+		// that the homes are of the users.
+		fmt.Fprintf(&df, "RUN cd /tmp/clouddev-features/%s \\\n && set -a \\\n && %s \\\n && set +a \\\n && chmod +x install.sh && ./install.sh\n",
+			name, strings.Join(env, " \\\n && "))
+		for _, k := range sortedKeys(m.ContainerEnv) {
+			fmt.Fprintf(&df, "ENV %s=%s\n", k, strconv.Quote(m.ContainerEnv[k]))
+		}
+	}
+	df.WriteString("USER $_DEV_CONTAINERS_IMAGE_USER\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(df.String()), 0644); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return s, nil
+}
+
+// userOr returns the user, or def if it's empty.
+func userOr(user, def string) string {
+	if user == "" {
+		return def
+	}
+	return user
+}
+
+// shellQuote quotes a string for the shell, keeping the variables.
+func shellQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, `\"`, "`", "\\`", `\`, `\\`).Replace(s) + `"`
+}
+
+var optionNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// featureOptions returns the NAME=value assignments of the options of a
+// feature, the configured ones and the defaults of the others. The names
+// are the option IDs in upper case with the other characters than letters,
+// digits and underscores replaced by underscores.
+func featureOptions(m *featureMetadata, configured map[string]interface{}) []string {
+	values := map[string]interface{}{}
+	for id, o := range m.Options {
+		if o.Default != nil {
+			values[id] = o.Default
+		}
+	}
+	for id, v := range configured {
+		values[id] = v
+	}
+	var opts []string
+	for _, id := range sortedKeys(values) {
+		name := strings.ToUpper(optionNameRegexp.ReplaceAllString(id, "_"))
+		if name != "" && name[0] >= '0' && name[0] <= '9' {
+			name = "_" + name
+		}
+		opts = append(opts, name+"="+shellQuote(fmt.Sprint(values[id])))
+	}
+	return opts
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]interface{}:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func readFeatureMetadata(dir string) (*featureMetadata, error) {
+	if _, err := os.Stat(filepath.Join(dir, "install.sh")); err != nil {
+		return nil, fmt.Errorf("no install.sh: %w", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "devcontainer-feature.json"))
+	if err != nil {
+		return nil, err
+	}
+	m := &featureMetadata{}
+	if err := json.Unmarshal(standardize(data), m); err != nil {
+		return nil, fmt.Errorf("failed to parse devcontainer-feature.json: %w", err)
+	}
+	return m, nil
+}
+
+// fetchFeature puts the files of the feature with the given ID in dir.
+func (c *Config) fetchFeature(ctx context.Context, id, dir string) error {
+	switch {
+	case strings.HasPrefix(id, "./") || strings.HasPrefix(id, "../"):
+		return copyDir(filepath.Join(filepath.Dir(c.Path), filepath.FromSlash(id)), dir)
+	case strings.HasPrefix(id, "https://") || strings.HasPrefix(id, "http://"):
+		data, err := get(ctx, id, "", "")
+		if err != nil {
+			return err
+		}
+		return extractTar(data, dir)
+	case strings.Contains(id, "/"):
+		data, err := pullFeature(ctx, id)
+		if err != nil {
+			return err
+		}
+		return extractTar(data, dir)
+	default:
+		return fmt.Errorf("%s is not an OCI reference, a tarball URL or a ./ directory", id)
+	}
+}
+
+// copyDir copies the regular files of the directory src to dst.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, 0755)
+		case fi.Mode().IsRegular():
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(target, data, fi.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// extractTar extracts the tar archive, gzipped or not, in dir.
+func extractTar(data []byte, dir string) error {
+	var r io.Reader = bytes.NewReader(data)
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(h.Name))
+		if name == "." {
+			continue
+		}
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("the archive has a file outside of its directory, %s", h.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(h.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// pullFeature pulls the layer of the feature with the OCI reference, e.g.
+// ghcr.io/devcontainers/features/go:1, anonymously.
+func pullFeature(ctx context.Context, ref string) ([]byte, error) {
+	i := strings.Index(ref, "/")
+	registry, repo := ref[:i], ref[i+1:]
+	tag := "latest"
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo, tag = repo[:i], repo[i+1:]
+	} else if i := strings.LastIndex(repo, ":"); i >= 0 {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	scheme := "https"
+	// Local registries are trusted without TLS, as by Docker.
+	if host := strings.Split(registry, ":")[0]; host == "localhost" || host == "127.0.0.1" {
+		scheme = "http"
+	}
+	base := scheme + "://" + registry + "/v2/" + repo
+
+	data, err := get(ctx, base+"/manifests/"+tag, "application/vnd.oci.image.manifest.v1+json", "")
+	var auth *authError
+	token := ""
+	if asAuthError(err, &auth) {
+		if token, err = registryToken(ctx, auth.challenge); err != nil {
+			return nil, err
+		}
+		data, err = get(ctx, base+"/manifests/"+tag, "application/vnd.oci.image.manifest.v1+json", token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if len(manifest.Layers) != 1 {
+		return nil, fmt.Errorf("the manifest has %d layers, expected 1", len(manifest.Layers))
+	}
+	return get(ctx, base+"/blobs/"+manifest.Layers[0].Digest, "", token)
+}
+
+// authError is the 401 response of a registry, with the challenge of its
+// WWW-Authenticate header.
+type authError struct {
+	challenge string
+}
+
+func (e *authError) Error() string {
+	return "unauthorized"
+}
+
+func asAuthError(err error, target **authError) bool {
+	e, ok := err.(*authError)
+	if ok {
+		*target = e
+	}
+	return ok
+}
+
+var challengeRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryToken gets an anonymous token for the Bearer challenge of a
+// registry.
+func registryToken(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported registry authentication %q", challenge)
+	}
+	params := map[string]string{}
+	for _, m := range challengeRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid registry authentication %q", challenge)
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			q.Set(k, params[k])
+		}
+	}
+	u.RawQuery = q.Encode()
+	data, err := get(ctx, u.String(), "", "")
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", fmt.Errorf("invalid registry token: %w", err)
+	}
+	if resp.Token != "" {
+		return resp.Token, nil
+	}
+	return resp.AccessToken, nil
+}
+
+// get returns the body of a GET request, with the Accept header and the
+// bearer token if not empty.
+func get(ctx context.Context, u, accept, token string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized && token == "" {
+		return nil, &authError{challenge: resp.Header.Get("WWW-Authenticate")}
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := bufio.NewReader(io.LimitReader(resp.Body, 512)).ReadString('\n')
+		return nil, fmt.Errorf("GET %s: %s %s", u, resp.Status, strings.TrimSpace(msg))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,96 @@
+package devcontainer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// writeFeature writes a local feature with its devcontainer-feature.json.
+func writeFeature(t *testing.T, dir, metadata string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "devcontainer-feature.json"), []byte(metadata), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "install.sh"), []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStageFeaturesInOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeFeature(t, filepath.Join(dir, "zsh"), `{
+	// JSON with comments too.
+	"id": "zsh",
+	"options": {"theme": {"default": "robbyrussell"}, "plugins": {"default": "git"}},
+	"containerEnv": {"SHELL": "/bin/zsh"},
+	"entrypoint": "/usr/local/share/zsh-init.sh",
+}`)
+	writeFeature(t, filepath.Join(dir, "go"), `{"id": "go", "options": {"version": {"default": "latest"}}, "capAdd": ["SYS_PTRACE"]}`)
+	c := &Config{
+		Path:       filepath.Join(dir, "devcontainer.json"),
+		RemoteUser: "vscode",
+		Features: Features{
+			{ID: "./zsh", Options: map[string]interface{}{"theme": "agnoster"}},
+			{ID: "./go", Options: map[string]interface{}{"version": "1.21"}},
+		},
+	}
+	s, err := c.stageFeatures(context.Background())
+	if err != nil {
+		t.Fatalf("stageFeatures() error = %v", err)
+	}
+	defer os.RemoveAll(s.Dir)
+
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	df := string(data)
+	// Each feature is installed after the ones listed before it.
+	zsh, goFeature := strings.Index(df, "COPY 01/"), strings.Index(df, "COPY 02/")
+	if zsh < 0 || goFeature < zsh {
+		t.Fatalf("Dockerfile =\n%s\nwant zsh installed as 01 before go as 02", df)
+	}
+	for _, name := range []string{"01/install.sh", "02/install.sh"} {
+		if _, err := os.Stat(filepath.Join(s.Dir, name)); err != nil {
+			t.Errorf("feature not staged: %v", err)
+		}
+	}
+	for _, want := range []string{
+		`_REMOTE_USER="vscode"`,
+		`PLUGINS="git"`,
+		`THEME="agnoster"`,
+		`ENV SHELL="/bin/zsh"`,
+	} {
+		if i := strings.Index(df, want); i < zsh || i > goFeature {
+			t.Errorf("Dockerfile =\n%s\nwant %s in the install of zsh", df, want)
+		}
+	}
+	if i := strings.Index(df, `VERSION="1.21"`); i < goFeature {
+		t.Errorf("Dockerfile =\n%s\nwant the configured version in the install of go", df)
+	}
+	if !regexp.MustCompile(`^ARG _DEV_CONTAINERS_BASE_IMAGE\nFROM \$_DEV_CONTAINERS_BASE_IMAGE\n`).MatchString(df) ||
+		!strings.HasSuffix(df, "USER $_DEV_CONTAINERS_IMAGE_USER\n") {
+		t.Errorf("Dockerfile =\n%s\nwant the features installed on the base image", df)
+	}
+
+	if got := strings.Join(s.runArgs(), " "); got != "--cap-add SYS_PTRACE" {
+		t.Errorf("runArgs() = %q, want the capabilities of go", got)
+	}
+	if want := "the entrypoint of feature ./zsh"; len(s.unsupported) != 1 || s.unsupported[0] != want {
+		t.Errorf("unsupported = %q, want %q", s.unsupported, want)
+	}
+
+	// A feature that can't be fetched fails the staging.
+	c.Features = append(c.Features, Feature{ID: "./missing"})
+	if _, err := c.stageFeatures(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to fetch feature ./missing") {
+		t.Errorf("stageFeatures() of a missing feature error = %v", err)
+	}
+}
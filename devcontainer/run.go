@@ -0,0 +1,322 @@
+package devcontainer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// WorkspacesDir is the directory of the workspaces on the machine, relative
+// to the home directory of the user.
+const WorkspacesDir = "workspaces"
+
+// ContainerName returns the name of the container of an environment.
+func ContainerName(env string) string {
+	return "clouddev-" + env
+}
+
+// Runner runs the devcontainer on the machine of an environment.
+type Runner struct {
+	Config *Config
+	// Env is the name of the environment.
+	Env string
+	// Out is where the output of the build and the commands is written.
+	Out io.Writer
+}
+
+// Up uploads the workspace to the machine of client c unless it already
+// has it, builds the image and runs the container. The container is only
+// created again when the image or its configuration changed, and the
+// postCreateCommand is run when it's created.
+func (r *Runner) Up(ctx context.Context, c *remote.Client) error {
+	cfg := r.Config
+	out, err := c.Output(ctx, `printf %s "$HOME"`)
+	if err != nil {
+		return fmt.Errorf("failed to get the home directory: %w", err)
+	}
+	home := string(out)
+	name := filepath.Base(cfg.Workspace)
+	dir := path.Join(WorkspacesDir, name)
+	workspace := path.Join(home, dir)
+
+	if err := c.Run(ctx, "test -e "+remote.Quote(dir), nil, nil, nil); err != nil {
+		fmt.Fprintf(r.Out, "Uploading %s...\n", cfg.Workspace)
+		if err := c.Upload(ctx, cfg.Workspace, dir); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(r.Out, "Using the workspace already on the machine, %s\n", workspace)
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "set -e\nname=%s\n", remote.Quote(ContainerName(r.Env)))
+	script.WriteString(dockerScript)
+
+	if cfg.Build != nil {
+		ctxDir, dockerfile, err := r.buildPaths(workspace)
+		if err != nil {
+			return err
+		}
+		args := []string{"-t", "$name", "-f", remote.Quote(dockerfile)}
+		if cfg.Build.Target != "" {
+			args = append(args, "--target", remote.Quote(cfg.Build.Target))
+		}
+		for _, k := range sortedKeys(cfg.Build.Args) {
+			args = append(args, "--build-arg", remote.Quote(k+"="+cfg.Build.Args[k]))
+		}
+		fmt.Fprintf(&script, "echo \"Building the image...\"\n$docker build %s %s\nimage=$name\n",
+			strings.Join(args, " "), remote.Quote(ctxDir))
+	} else {
+		fmt.Fprintf(&script, "image=%s\n$docker image inspect \"$image\" >/dev/null 2>&1 || $docker pull \"$image\"\n",
+			remote.Quote(cfg.Image))
+	}
+
+	var featureArgs []string
+	if len(cfg.Features) > 0 {
+		s, err := cfg.stageFeatures(ctx)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(s.Dir)
+		for _, u := range s.unsupported {
+			fmt.Fprintf(r.Out, "Warning: clouddev doesn't support %s, it's ignored\n", u)
+		}
+		featuresDir := path.Join(".clouddev", "features", r.Env)
+		fmt.Fprintf(r.Out, "Uploading %d features...\n", len(cfg.Features))
+		if err := c.Upload(ctx, s.Dir, featuresDir); err != nil {
+			return err
+		}
+		fmt.Fprintf(&script, featuresScript, remote.Quote(featuresDir))
+		featureArgs = s.runArgs()
+	}
+
+	args := r.runArgs(workspace, featureArgs)
+	sum := sha256.Sum256([]byte(strings.Join(args, "\x00")))
+	fmt.Fprintf(&script, runScript, hex.EncodeToString(sum[:]), strings.Join(args, " "), r.command())
+	if pc := cfg.PostCreateCommand; pc != nil {
+		script.WriteString("if [ \"$created\" ]; then\n  echo \"Running the postCreateCommand...\"\n")
+		script.WriteString(r.execScript(pc))
+		script.WriteString("fi\n")
+	}
+
+	err = c.Attach(ctx, &remote.Session{
+		Command: script.String(),
+		Stdout:  r.Out,
+		Stderr:  r.Out,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to run the devcontainer: %w", err)
+	}
+	return nil
+}
+
+// dockerScript installs Docker if the machine doesn't have it and sets
+// docker to the docker command, run with sudo if the user isn't in the
+// docker group, or not yet in this session.
+const dockerScript = `sudo=
+if [ "$(id -u)" != 0 ]; then
+  sudo="sudo -n"
+fi
+if ! command -v docker >/dev/null 2>&1; then
+  echo "Installing Docker..."
+  if command -v curl >/dev/null 2>&1; then
+    curl -fsSL https://get.docker.com | $sudo sh
+  else
+    wget -qO- https://get.docker.com | $sudo sh
+  fi
+  if [ "$sudo" ]; then
+    $sudo usermod -aG docker "$(id -un)"
+  fi
+fi
+docker=docker
+if ! docker info >/dev/null 2>&1; then
+  docker="$sudo docker"
+fi
+`
+
+// featuresScript builds the image with the features, uploaded in the
+// directory given as argument, on top of $image.
+const featuresScript = `echo "Installing the features..."
+user=$($docker image inspect -f '{{.Config.User}}' "$image")
+$docker build -t "$name-features" --build-arg _DEV_CONTAINERS_BASE_IMAGE="$image" --build-arg _DEV_CONTAINERS_IMAGE_USER="${user:-root}" %s
+image=$name-features
+`
+
+// runScript runs the container of $image, unless it already runs with the
+// same image and the same hash of its run arguments in its clouddev.hash
+// label, given as first argument. The other arguments are the
+// run arguments and the command. created is set if it's created.
+const runScript = `id=$($docker image inspect -f '{{.Id}}' "$image")
+created=
+current=$($docker inspect -f '{{index .Config.Labels "clouddev.hash"}} {{.Image}}' "$name" 2>/dev/null || true)
+if [ "$current" = "%[1]s $id" ]; then
+  echo "Starting the container..."
+  $docker start "$name" >/dev/null
+else
+  if [ "$current" ]; then
+    echo "Replacing the container..."
+    $docker rm -f "$name" >/dev/null
+  else
+    echo "Creating the container..."
+  fi
+  $docker run -d --label clouddev.hash=%[1]s %[2]s "$image" %[3]s >/dev/null
+  created=1
+fi
+`
+
+// buildPaths returns the paths on the machine of the build context and the
+// Dockerfile, which must be in the workspace.
+func (r *Runner) buildPaths(workspace string) (string, string, error) {
+	cfg := r.Config
+	base := filepath.Dir(cfg.Path)
+	ctxDir := cfg.Build.Context
+	if ctxDir == "" {
+		ctxDir = "."
+	}
+	var paths []string
+	for _, p := range []string{ctxDir, cfg.Build.Dockerfile} {
+		rel, err := filepath.Rel(cfg.Workspace, filepath.Join(base, filepath.FromSlash(p)))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", "", fmt.Errorf("build path %s is outside of the workspace %s", p, cfg.Workspace)
+		}
+		paths = append(paths, path.Join(workspace, filepath.ToSlash(rel)))
+	}
+	return paths[0], paths[1], nil
+}
+
+// folder returns the workspace folder in the container.
+func (r *Runner) folder() string {
+	if f := r.Config.WorkspaceFolder; f != "" {
+		return f
+	}
+	return path.Join("/workspaces", filepath.Base(r.Config.Workspace))
+}
+
+// vars returns the variables of the devcontainer.json properties.
+func (r *Runner) vars(workspace string) map[string]string {
+	folder := r.folder()
+	return map[string]string{
+		"localWorkspaceFolder":             workspace,
+		"localWorkspaceFolderBasename":     path.Base(workspace),
+		"containerWorkspaceFolder":         folder,
+		"containerWorkspaceFolderBasename": path.Base(folder),
+	}
+}
+
+// runArgs returns the quoted docker run arguments, but the image and the
+// command.
+func (r *Runner) runArgs(workspace string, featureArgs []string) []string {
+	cfg := r.Config
+	vars := r.vars(workspace)
+	folder := expand(r.folder(), vars)
+	vars["containerWorkspaceFolder"] = folder
+	vars["containerWorkspaceFolderBasename"] = path.Base(folder)
+
+	args := []string{"--name", "\"$name\""}
+	if cfg.ContainerUser != "" {
+		args = append(args, "-u", remote.Quote(cfg.ContainerUser))
+	}
+	for _, k := range sortedKeys(cfg.ContainerEnv) {
+		args = append(args, "-e", remote.Quote(k+"="+expand(cfg.ContainerEnv[k], vars)))
+	}
+	mount := "type=bind,source=" + workspace + ",target=" + folder
+	if cfg.WorkspaceMount != "" {
+		mount = expand(cfg.WorkspaceMount, vars)
+	}
+	args = append(args, "--mount", remote.Quote(mount))
+	for _, m := range cfg.Mounts {
+		args = append(args, "--mount", remote.Quote(expand(string(m), vars)))
+	}
+	args = append(args, "-w", remote.Quote(folder))
+	for _, p := range cfg.Ports() {
+		args = append(args, "-p", fmt.Sprintf("127.0.0.1:%d:%d", p, p))
+	}
+	for _, a := range featureArgs {
+		args = append(args, remote.Quote(expand(a, vars)))
+	}
+	if r.overrideCommand() {
+		args = append(args, "--entrypoint", "/bin/sh")
+	}
+	return args
+}
+
+// overrideCommand returns true if the command of the image is replaced by
+// one that keeps the container running, the default.
+func (r *Runner) overrideCommand() bool {
+	return r.Config.OverrideCommand == nil || *r.Config.OverrideCommand
+}
+
+// command returns the quoted command of the container, empty for the
+// command of the image.
+func (r *Runner) command() string {
+	if !r.overrideCommand() {
+		return ""
+	}
+	return "-c " + remote.Quote(`echo Container started; trap "exit 0" TERM; while sleep 1000 & wait $!; do :; done`)
+}
+
+// execScript returns the script that runs a lifecycle command in the
+// container, as the remote user, in the workspace folder. Parallel commands
+// are run in the background and waited for.
+func (r *Runner) execScript(cmd *Command) string {
+	exec := "$docker exec"
+	user := r.Config.RemoteUser
+	if user == "" {
+		user = r.Config.ContainerUser
+	}
+	if user != "" {
+		exec += " -u " + remote.Quote(user)
+	}
+	exec += " \"$name\""
+
+	single := func(c *Command) string {
+		if c.Args != nil {
+			args := make([]string, len(c.Args))
+			for i, a := range c.Args {
+				args[i] = remote.Quote(a)
+			}
+			return exec + " " + strings.Join(args, " ")
+		}
+		return exec + " /bin/sh -c " + remote.Quote(c.Shell)
+	}
+	if cmd.Parallel == nil {
+		return "  " + single(cmd) + "\n"
+	}
+
+	names := make([]string, 0, len(cmd.Parallel))
+	for n := range cmd.Parallel {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var s strings.Builder
+	s.WriteString("  pids=\n")
+	for _, n := range names {
+		fmt.Fprintf(&s, "  echo %s\n  %s &\n  pids=\"$pids $!\"\n", remote.Quote("Running "+n+"..."), single(cmd.Parallel[n]))
+	}
+	s.WriteString("  failed=\n  for pid in $pids; do wait \"$pid\" || failed=1; done\n")
+	s.WriteString("  if [ \"$failed\" ]; then echo \"the postCreateCommand failed\" >&2; exit 1; fi\n")
+	return s.String()
+}
+
+// ExecCommand returns the command that opens a shell in the container of
+// the environment, run on the machine.
+func (r *Runner) ExecCommand() string {
+	user := r.Config.RemoteUser
+	if user == "" {
+		user = r.Config.ContainerUser
+	}
+	cmd := "docker exec -it"
+	if user != "" {
+		cmd += " -u " + remote.Quote(user)
+	}
+	return cmd + " " + ContainerName(r.Env) + " bash"
+}
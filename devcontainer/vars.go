@@ -0,0 +1,37 @@
+package devcontainer
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// varRegexp matches the ${name} and ${name:argument} variables of
+// devcontainer.json.
+var varRegexp = regexp.MustCompile(`\$\{([A-Za-z]+)(?::([^}]*))?\}`)
+
+// expand replaces the variables of a devcontainer.json property. The local
+// workspace folder is the workspace on the machine, where the container is
+// run, and the local environment variables are the ones of clouddev. The
+// unknown variables are left as they are.
+func expand(s string, vars map[string]string) string {
+	return varRegexp.ReplaceAllStringFunc(s, func(v string) string {
+		m := varRegexp.FindStringSubmatch(v)
+		switch m[1] {
+		case "localEnv", "env":
+			name, def := m[2], ""
+			if i := strings.Index(name, ":"); i >= 0 {
+				name, def = name[:i], name[i+1:]
+			}
+			if value, ok := os.LookupEnv(name); ok {
+				return value
+			}
+			return def
+		default:
+			if value, ok := vars[m[1]]; ok && m[2] == "" {
+				return value
+			}
+			return v
+		}
+	})
+}
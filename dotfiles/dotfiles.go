@@ -0,0 +1,178 @@
+// Package dotfiles installs the dotfiles of the user on the machines, from a
+// local directory uploaded over SSH or from a git repository cloned on the
+// machine.
+package dotfiles
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// installScripts are the scripts run to install the dotfiles if none is
+// configured, in order of preference, the same as GitHub Codespaces.
+var installScripts = []string{
+	"install.sh",
+	"install",
+	"bootstrap.sh",
+	"bootstrap",
+	"script/bootstrap",
+	"setup.sh",
+	"setup",
+	"script/setup",
+}
+
+// Installer installs the dotfiles on the machines.
+type Installer struct {
+	Config *config.Dotfiles
+	// Dir is the directory a relative Path is relative to, the directory of
+	// the config file.
+	Dir string
+	// Agent is forwarded to the machine to clone private repositories over
+	// SSH, unless nil.
+	Agent agent.Agent
+	// Out is where the output of the installation is written.
+	Out io.Writer
+}
+
+// Install puts the dotfiles in their directory on the machine of client c,
+// replacing the ones installed before, and installs them. A local directory
+// is uploaded without its git metadata.
+func (i *Installer) Install(ctx context.Context, c *remote.Client) error {
+	d := i.Config
+	s := &remote.Session{
+		Command: i.script(),
+		Stdout:  i.Out,
+		Stderr:  i.Out,
+	}
+	if d.Path != "" {
+		path, err := i.localPath()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(i.Out, "Uploading %s...\n", path)
+		if err := c.Upload(ctx, path, d.Dir, ".git"); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(i.Out, "Cloning %s...\n", d.Repo)
+		s.ForwardAgent = i.Agent
+	}
+
+	if err := c.Attach(ctx, s); err != nil {
+		return fmt.Errorf("failed to install the dotfiles: %w", err)
+	}
+	return nil
+}
+
+// script returns the shell script run on the machine that clones the
+// dotfiles if they're from a repository, and installs them.
+func (i *Installer) script() string {
+	d := i.Config
+	var script strings.Builder
+	fmt.Fprintf(&script, "set -e\ncd\ndir=%s\n", remote.Quote(d.Dir))
+	if d.Path == "" {
+		ref := d.Ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		fmt.Fprintf(&script, cloneScript, remote.Quote(d.Repo), remote.Quote(ref))
+	}
+
+	script.WriteString("cd \"$dir\"\n")
+	symlink := fmt.Sprintf(symlinkScript, strings.Join(installScripts, "|"))
+	switch {
+	case d.Symlink:
+		script.WriteString(symlink)
+	case d.Install != "":
+		fmt.Fprintf(&script, "run %s\n", remote.Quote(d.Install))
+	default:
+		fmt.Fprintf(&script, findInstallScript, strings.Join(installScripts, " "))
+		script.WriteString(symlink)
+	}
+	return runFunc + script.String()
+}
+
+// localPath returns the path of the local dotfiles directory.
+func (i *Installer) localPath() (string, error) {
+	path, err := homedir.Expand(i.Config.Path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(i.Dir, path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the dotfiles: %w", err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("dotfiles path %s is not a directory", path)
+	}
+	return path, nil
+}
+
+// runFunc defines run, which runs an install script of the dotfiles, with sh
+// if it's not executable.
+const runFunc = `run() {
+  echo "Running $1..."
+  if [ -x "$1" ]; then "./$1"; else sh "$1"; fi
+}
+`
+
+// findInstallScript runs the first of the install scripts given as argument
+// that exists, and exits.
+const findInstallScript = `for s in %s; do
+  if [ -f "$s" ]; then
+    run "$s"
+    exit
+  fi
+done
+`
+
+// cloneScript clones the repository in the directory, or fetches it if it
+// was cloned before, and checks out the ref. The arguments are the URL of
+// the repository and the ref.
+const cloneScript = `if ! command -v git >/dev/null 2>&1; then
+  echo "git is not installed, add it to bootstrap.packages" >&2
+  exit 1
+fi
+if [ -e "$dir/.git" ]; then
+  git -C "$dir" remote set-url origin %[1]s
+else
+  rm -rf "$dir"
+  mkdir -p "$(dirname "$dir")"
+  git clone --quiet --no-checkout %[1]s "$dir"
+fi
+git -C "$dir" fetch --quiet origin %[2]s
+git -C "$dir" checkout --quiet --force FETCH_HEAD
+git -C "$dir" submodule update --quiet --init --recursive
+`
+
+// symlinkScript symlinks the files of the dotfiles in the home directory,
+// except the git metadata, READMEs, licenses and the install scripts given
+// as argument, creating their parent directories. Existing files are moved
+// aside with a .bak suffix.
+const symlinkScript = `find . -name .git -prune -o \( -type f -o -type l \) -print | while IFS= read -r f; do
+  f=${f#./}
+  case "$f" in
+  README*|LICENSE*|%s) continue ;;
+  esac
+  target="$HOME/$f"
+  mkdir -p "$(dirname "$target")"
+  if [ -e "$target" ] && [ ! -L "$target" ]; then
+    mv "$target" "$target.bak"
+  fi
+  ln -sfn "$PWD/$f" "$target"
+  echo "Linked ~/$f"
+done
+`
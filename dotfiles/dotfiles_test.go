@@ -0,0 +1,187 @@
+package dotfiles
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+// writeFiles writes the files, relative to dir, with their content.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// install runs the install script of the dotfiles in home as the home
+// directory, as if the dotfiles were uploaded there, and returns its output.
+func install(t *testing.T, home string, d *config.Dotfiles) string {
+	t.Helper()
+	i := &Installer{Config: d}
+	cmd := exec.Command("sh", "-c", i.script())
+	cmd.Env = append(os.Environ(), "HOME="+home)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("install script error = %v, output:\n%s", err, out)
+	}
+	return string(out)
+}
+
+// links returns the symlinks in home, outside the dotfiles, with their
+// targets relative to home.
+func links(t *testing.T, home string) map[string]string {
+	t.Helper()
+	got := map[string]string{}
+	err := filepath.Walk(home, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(home, path)
+		if rel == ".dotfiles" {
+			return filepath.SkipDir
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			got[rel], _ = filepath.Rel(home, target)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSymlink(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	home := t.TempDir()
+	writeFiles(t, filepath.Join(home, ".dotfiles"), map[string]string{
+		".bashrc":               "alias ll='ls -l'\n",
+		".config/nvim/init.vim": "set number\n",
+		"my file":               "spaces\n",
+		"README.md":             "My dotfiles\n",
+		"LICENSE":               "MIT\n",
+		"install.sh":            "exit 1\n",
+		"script/setup":          "exit 1\n",
+		".git/config":           "[core]\n",
+	})
+	writeFiles(t, home, map[string]string{
+		".bashrc": "the bashrc of the image\n",
+		"old":     "old init.vim\n",
+	})
+	if err := os.MkdirAll(filepath.Join(home, ".config/nvim"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(home, "old"), filepath.Join(home, ".config/nvim/init.vim")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &config.Dotfiles{Path: "dotfiles", Dir: ".dotfiles", Symlink: true}
+	out := install(t, home, d)
+	// Running it again, e.g. on the next up, changes nothing.
+	install(t, home, d)
+
+	want := map[string]string{
+		".bashrc":               ".dotfiles/.bashrc",
+		".config/nvim/init.vim": ".dotfiles/.config/nvim/init.vim",
+		"my file":               ".dotfiles/my file",
+	}
+	if got := links(t, home); !reflect.DeepEqual(got, want) {
+		t.Errorf("links = %v, want %v", got, want)
+	}
+	// A file in the way is kept aside, a symlink is replaced.
+	if data, err := ioutil.ReadFile(filepath.Join(home, ".bashrc.bak")); err != nil || string(data) != "the bashrc of the image\n" {
+		t.Errorf(".bashrc.bak = %q, %v, want the file replaced", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".config/nvim/init.vim.bak")); !os.IsNotExist(err) {
+		t.Errorf("a replaced symlink was kept aside: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	sort.Strings(lines)
+	if want := []string{"Linked ~/.bashrc", "Linked ~/.config/nvim/init.vim", "Linked ~/my file"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("output = %q, want %q", lines, want)
+	}
+}
+
+func TestInstallScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	marker := "echo $0 > \"$HOME/ran\"\n"
+	tests := []struct {
+		name    string
+		files   map[string]string
+		install string
+		// ran is the script run, none if the files are symlinked.
+		ran string
+	}{
+		{
+			name:  "first usual script",
+			files: map[string]string{".bashrc": "", "setup.sh": marker, "bootstrap": marker},
+			ran:   "bootstrap",
+		},
+		{
+			name:  "script in a directory",
+			files: map[string]string{".bashrc": "", "script/setup": marker},
+			ran:   "script/setup",
+		},
+		{
+			name:    "configured script",
+			files:   map[string]string{".bashrc": "", "install.sh": "exit 1\n", "tools/link": marker},
+			install: "tools/link",
+			ran:     "tools/link",
+		},
+		{
+			name:  "no script",
+			files: map[string]string{".bashrc": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			writeFiles(t, filepath.Join(home, ".dotfiles"), tt.files)
+			out := install(t, home, &config.Dotfiles{Path: "dotfiles", Dir: ".dotfiles", Install: tt.install})
+
+			got := links(t, home)
+			data, err := ioutil.ReadFile(filepath.Join(home, "ran"))
+			if tt.ran == "" {
+				if err == nil {
+					t.Errorf("a script ran: %s", data)
+				}
+				if got[".bashrc"] != ".dotfiles/.bashrc" {
+					t.Errorf("links = %v, want the files symlinked", got)
+				}
+				return
+			}
+			// The scripts aren't executable, they're run with sh.
+			if err != nil || string(data) != tt.ran+"\n" {
+				t.Errorf("ran %q, %v, want %s", data, err, tt.ran)
+			}
+			if !strings.Contains(out, "Running "+tt.ran+"...") {
+				t.Errorf("output = %q, want the script run", out)
+			}
+			if len(got) != 0 {
+				t.Errorf("links = %v, want none with an install script", got)
+			}
+		})
+	}
+}
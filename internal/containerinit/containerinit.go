@@ -0,0 +1,51 @@
+// Package containerinit implements the bootstrap of the containers running
+// environments, so that they're set up by cloud-init from the same user
+// data as the machines.
+package containerinit
+
+import "fmt"
+
+// SeedDir is the NoCloud seed directory the user-data and meta-data files
+// must be copied or mounted to.
+const SeedDir = "/var/lib/cloud/seed/nocloud"
+
+// script installs cloud-init and the SSH server if the image lacks them,
+// and runs cloud-init, once per container. The SSH host keys are printed
+// to the logs of the container the way cloud-init prints them on the
+// console of a machine, for clouddev to pin them, and the SSH server then
+// runs in the foreground.
+const script = `if [ ! -e /var/lib/clouddev/bootstrapped ]; then
+  if ! command -v sshd >/dev/null || ! command -v cloud-init >/dev/null; then
+    if command -v apt-get >/dev/null; then
+      apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends openssh-server cloud-init sudo
+    elif command -v dnf >/dev/null; then
+      dnf install -y openssh-server cloud-init sudo
+    elif command -v apk >/dev/null; then
+      apk add --no-cache openssh-server cloud-init sudo bash shadow
+    fi
+  fi
+  mkdir -p /etc/cloud/cloud.cfg.d
+  echo 'datasource_list: [ NoCloud ]' >/etc/cloud/cloud.cfg.d/90-clouddev.cfg
+  cloud-init init --local
+  cloud-init init
+  cloud-init modules --mode=config
+  cloud-init modules --mode=final
+  mkdir -p /var/lib/clouddev && touch /var/lib/clouddev/bootstrapped
+fi
+mkdir -p /run/sshd
+ssh-keygen -A
+echo '-----BEGIN SSH HOST KEY KEYS-----'
+cat /etc/ssh/ssh_host_*_key.pub
+echo '-----END SSH HOST KEY KEYS-----'
+exec "$(command -v sshd || echo /usr/sbin/sshd)" -D -e
+`
+
+// Command returns the command of the containers.
+func Command() []string {
+	return []string{"/bin/sh", "-c", script}
+}
+
+// MetaData returns the NoCloud meta data of a container.
+func MetaData(instanceID, hostname string) []byte {
+	return []byte(fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", instanceID, hostname))
+}
@@ -0,0 +1,134 @@
+// Package rest implements a small client for the JSON REST APIs of the
+// cloud providers.
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Client is a JSON REST API client.
+type Client struct {
+	// BaseURL is prepended to the request paths.
+	BaseURL string
+	// HTTPClient makes the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// Authorize authenticates a request, e.g. sets its Authorization
+	// header.
+	Authorize func(req *http.Request) error
+	// ErrorMessage extracts the error message from the body of an error
+	// response. The body is used as is if nil or if it returns "".
+	ErrorMessage func(body []byte) string
+}
+
+// Error is returned for the responses with a non 2xx status code.
+type Error struct {
+	StatusCode int
+	Method     string
+	URL        string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound returns true if the error is a 404 response.
+func IsNotFound(err error) bool {
+	return HasStatus(err, http.StatusNotFound)
+}
+
+// HasStatus returns true if the error is a response with the given status
+// code.
+func HasStatus(err error, code int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == code
+}
+
+// Do sends a request with in encoded as the JSON body, unless nil, and
+// decodes the JSON response body into out, unless nil. A *[]byte out gets
+// the body as is, e.g. for logs.
+func (c *Client) Do(ctx context.Context, method, path string, in, out interface{}) error {
+	_, err := c.DoResponse(ctx, method, path, in, out)
+	return err
+}
+
+// DoResponse is like Do and returns the response, with its body closed, for
+// the callers that need its headers.
+func (c *Client) DoResponse(ctx context.Context, method, path string, in, out interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.Send(req, out)
+}
+
+// Send sends a prepared request, authorizing it, and decodes the JSON
+// response body into out, unless nil, as Do does.
+func (c *Client) Send(req *http.Request, out interface{}) (*http.Response, error) {
+	if c.Authorize != nil {
+		if err := c.Authorize(req); err != nil {
+			return nil, err
+		}
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := ""
+		if c.ErrorMessage != nil {
+			msg = c.ErrorMessage(data)
+		}
+		if msg == "" {
+			msg = strings.TrimSpace(string(data))
+		}
+		return resp, &Error{StatusCode: resp.StatusCode, Method: req.Method, URL: req.URL.Path, Message: msg}
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = data
+		return resp, nil
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp, fmt.Errorf("%s %s: invalid response: %w", req.Method, req.URL.Path, err)
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) url(path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + path
+}
@@ -0,0 +1,93 @@
+package keys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrNoAgent is returned when ssh-agent isn't running.
+var ErrNoAgent = errors.New("ssh-agent is not running, SSH_AUTH_SOCK is not set")
+
+// Agent connects to the ssh-agent at SSH_AUTH_SOCK. The returned function
+// closes the connection.
+func Agent() (agent.ExtendedAgent, func() error, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, ErrNoAgent
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+	return agent.NewClient(conn), conn.Close, nil
+}
+
+// AddToAgent decrypts the key with the passphrase and adds it to ssh-agent,
+// so that it's used without asking for the passphrase again.
+func AddToAgent(k *Key, passphrase []byte) error {
+	data, err := ioutil.ReadFile(k.Path)
+	if err != nil {
+		return err
+	}
+	raw, err := ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	if err != nil {
+		return err
+	}
+	a, closeAgent, err := Agent()
+	if err != nil {
+		return err
+	}
+	defer closeAgent()
+	return a.Add(agent.AddedKey{PrivateKey: raw, Comment: k.Path})
+}
+
+// Signer returns the signer of the key: ssh-agent's if it holds the key,
+// otherwise the key file's. The passphrase of an encrypted key not in
+// ssh-agent is asked with prompt, and the decrypted key added to ssh-agent
+// when it's running.
+func Signer(k *Key, prompt func() ([]byte, error)) (ssh.Signer, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	if a, closeAgent, err := Agent(); err == nil {
+		signers, _ := a.Signers()
+		for _, s := range signers {
+			if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+				// The agent signs over the connection, which stays open.
+				return s, nil
+			}
+		}
+		closeAgent()
+	}
+
+	data, err := ioutil.ReadFile(k.Path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+	if prompt == nil {
+		return nil, fmt.Errorf("key %s is encrypted and not in ssh-agent", k.Path)
+	}
+	passphrase, err := prompt()
+	if err != nil {
+		return nil, err
+	}
+	if signer, err = ssh.ParsePrivateKeyWithPassphrase(data, passphrase); err != nil {
+		return nil, fmt.Errorf("failed to decrypt key %s: %w", k.Path, err)
+	}
+	// Best effort, the passphrase is asked again next time otherwise.
+	_ = AddToAgent(k, passphrase)
+	return signer, nil
+}
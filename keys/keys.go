@@ -0,0 +1,224 @@
+// Package keys manages the SSH keys clouddev generates for every
+// environment, so that throwaway machines don't get personal keys.
+//
+// The key of an environment is an ed25519 keypair in
+// $HOME/.clouddev/keys/<env>, in the OpenSSH formats, optionally protected by
+// a passphrase and kept decrypted in ssh-agent.
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	keyName = "id_ed25519"
+	// nextName is the name of the key being rotated in.
+	nextName = keyName + ".next"
+	pubExt   = ".pub"
+)
+
+// ErrNotFound is returned when an environment has no key.
+var ErrNotFound = errors.New("key not found")
+
+// DefaultDir returns the default directory of the keys,
+// $HOME/.clouddev/keys.
+func DefaultDir() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".clouddev", "keys"), nil
+}
+
+// Key is an SSH keypair.
+type Key struct {
+	// Path is the path of the private key file.
+	Path string
+	// PublicKey is the public key in the authorized_keys format.
+	PublicKey string
+	// Encrypted is true if the private key is protected by a passphrase.
+	Encrypted bool
+}
+
+// Read reads the keypair of the private key at the given path, and its
+// public key from the path with the .pub extension.
+func Read(path string) (*Key, error) {
+	pub, err := ioutil.ReadFile(path + pubExt)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(pub); err != nil {
+		return nil, fmt.Errorf("invalid public key %s%s: %w", path, pubExt, err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if err != nil && !errors.As(err, &missing) {
+		return nil, fmt.Errorf("invalid private key %s: %w", path, err)
+	}
+	return &Key{Path: path, PublicKey: strings.TrimSpace(string(pub)), Encrypted: missing != nil}, nil
+}
+
+// Store stores the keys of the environments in a directory per
+// environment.
+type Store struct {
+	dir string
+}
+
+// NewStore returns a store in the given directory. The directory is created
+// on the first write.
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Dir returns the directory of the key of the named environment.
+func (s *Store) Dir(env string) string {
+	return filepath.Join(s.dir, env)
+}
+
+// Get returns the key of the named environment, or ErrNotFound.
+func (s *Store) Get(env string) (*Key, error) {
+	k, err := Read(filepath.Join(s.Dir(env), keyName))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return k, err
+}
+
+// Next returns the key generated by GenerateNext and not committed, or
+// ErrNotFound.
+func (s *Store) Next(env string) (*Key, error) {
+	k, err := Read(filepath.Join(s.Dir(env), nextName))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return k, err
+}
+
+// Generate generates the key of the named environment, encrypted with the
+// passphrase unless it's empty. It replaces the existing key.
+func (s *Store) Generate(env string, passphrase []byte) (*Key, error) {
+	return s.generate(env, keyName, passphrase)
+}
+
+// GenerateNext generates the key an environment is rotated to, kept next to
+// the current key until Commit.
+func (s *Store) GenerateNext(env string, passphrase []byte) (*Key, error) {
+	return s.generate(env, nextName, passphrase)
+}
+
+// Commit replaces the current key of the named environment with the one
+// generated by GenerateNext. If it fails, both keys are left as they were.
+func (s *Store) Commit(env string) error {
+	path, next := filepath.Join(s.Dir(env), keyName), filepath.Join(s.Dir(env), nextName)
+	// The public key goes first, and is put back if the private key can't
+	// follow, so that the current public key never belongs to another key.
+	pub, err := ioutil.ReadFile(path + pubExt)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(next+pubExt, path+pubExt); err != nil {
+		return err
+	}
+	if err := os.Rename(next, path); err != nil {
+		if rerr := os.Rename(path+pubExt, next+pubExt); rerr != nil {
+			return fmt.Errorf("%v, and failed to restore the public key: %w", err, rerr)
+		}
+		if pub != nil {
+			if rerr := writeFile(path+pubExt, pub, 0644); rerr != nil {
+				return fmt.Errorf("%v, and failed to restore the public key: %w", err, rerr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Discard removes the key generated by GenerateNext.
+func (s *Store) Discard(env string) error {
+	for _, ext := range []string{"", pubExt} {
+		if err := os.Remove(filepath.Join(s.Dir(env), nextName+ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the key of the named environment.
+func (s *Store) Delete(env string) error {
+	return os.RemoveAll(s.Dir(env))
+}
+
+func (s *Store) generate(env, name string, passphrase []byte) (*Key, error) {
+	dir := s.Dir(env)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// MkdirAll doesn't change the mode of an existing directory.
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	comment := "clouddev-" + env
+	var block *pem.Block
+	if len(passphrase) > 0 {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, comment, passphrase)
+	} else {
+		block, err = ssh.MarshalPrivateKey(priv, comment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment
+
+	path := filepath.Join(dir, name)
+	if err := writeFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	if err := writeFile(path+pubExt, []byte(authorized+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return &Key{Path: path, PublicKey: authorized, Encrypted: len(passphrase) > 0}, nil
+}
+
+// writeFile atomically replaces the file at the given path.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,117 @@
+package keys_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/keys"
+)
+
+func TestGenerateAndGet(t *testing.T) {
+	s := keys.NewStore(t.TempDir())
+	if _, err := s.Get("dev"); !errors.Is(err, keys.ErrNotFound) {
+		t.Errorf("Get() of a missing key error = %v, want %v", err, keys.ErrNotFound)
+	}
+	k, err := s.Generate("dev", []byte("secret"))
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	got, err := s.Get("dev")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if *got != *k || !got.Encrypted {
+		t.Errorf("Get() = %+v, want the encrypted key %+v", got, k)
+	}
+	fi, err := os.Stat(s.Dir("dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o700 {
+		t.Errorf("key directory mode = %v, want 0700", fi.Mode().Perm())
+	}
+}
+
+func TestCommit(t *testing.T) {
+	s := keys.NewStore(t.TempDir())
+	if _, err := s.Generate("dev", nil); err != nil {
+		t.Fatal(err)
+	}
+	next, err := s.GenerateNext("dev", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Next("dev"); err != nil || got.PublicKey != next.PublicKey {
+		t.Errorf("Next() = %+v, %v, want %+v", got, err, next)
+	}
+	if err := s.Commit("dev"); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	got, err := s.Get("dev")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.PublicKey != next.PublicKey {
+		t.Errorf("Get() after Commit() = %q, want the next key %q", got.PublicKey, next.PublicKey)
+	}
+	if _, err := s.Next("dev"); !errors.Is(err, keys.ErrNotFound) {
+		t.Errorf("Next() after Commit() error = %v, want %v", err, keys.ErrNotFound)
+	}
+}
+
+func TestCommitRollsBack(t *testing.T) {
+	s := keys.NewStore(t.TempDir())
+	current, err := s.Generate("dev", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := s.GenerateNext("dev", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The public key can be renamed, the private key can't.
+	if err := os.Rename(next.Path, next.Path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit("dev"); err == nil {
+		t.Fatal("Commit() without the next private key error = nil")
+	}
+	got, err := s.Get("dev")
+	if err != nil {
+		t.Fatalf("Get() after a failed Commit() error = %v", err)
+	}
+	if got.PublicKey != current.PublicKey {
+		t.Errorf("Get() after a failed Commit() = %q, want the current key %q", got.PublicKey, current.PublicKey)
+	}
+	if _, err := os.Stat(next.Path + ".pub"); err != nil {
+		t.Errorf("the next public key isn't put back: %v", err)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	s := keys.NewStore(t.TempDir())
+	current, err := s.Generate("dev", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Discard("dev"); err != nil {
+		t.Errorf("Discard() without a next key error = %v", err)
+	}
+	if _, err := s.GenerateNext("dev", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Discard("dev"); err != nil {
+		t.Fatalf("Discard() error = %v", err)
+	}
+	if _, err := s.Next("dev"); !errors.Is(err, keys.ErrNotFound) {
+		t.Errorf("Next() after Discard() error = %v, want %v", err, keys.ErrNotFound)
+	}
+	if got, err := s.Get("dev"); err != nil || got.PublicKey != current.PublicKey {
+		t.Errorf("Get() after Discard() = %+v, %v, want the current key", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir("dev"), "id_ed25519")); err != nil {
+		t.Errorf("Discard() removed the current key: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ANSI escape codes of the text output colors.
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// symbols are the text output markers of the action types.
+var symbols = map[ActionType]struct{ symbol, color string }{
+	Create:  {"+", colorGreen},
+	Update:  {"~", colorYellow},
+	Replace: {"-/+", colorRed},
+	Delete:  {"-", colorRed},
+}
+
+// WriteText writes the plan in a human readable form, with ANSI colors if
+// color is true.
+func WriteText(w io.Writer, p *Plan, color bool) error {
+	paint := func(c, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+
+	ew := &errWriter{w: w}
+	if p.Empty() {
+		ew.printf("No changes, environment %s is up to date.\n", p.Environment)
+	} else {
+		ew.printf("Plan for environment %s on %s:\n\n", p.Environment, p.Provider)
+		for _, a := range p.Actions {
+			s := symbols[a.Type]
+			ew.printf("  %s %s %s\n", paint(s.color, s.symbol), paint(s.color, string(a.Type)), a.Target)
+			ew.printf("      reason: %s\n", a.Reason)
+			for _, ch := range a.Changes {
+				marker := ""
+				if ch.Replace {
+					marker = paint(colorRed, " (forces replacement)")
+				}
+				ew.printf("      %s: %q => %q%s\n", ch.Field, ch.Old, ch.New, marker)
+			}
+			ew.printf("\n")
+		}
+		ew.printf("Plan: %d to create, %d to update, %d to replace, %d to delete.\n",
+			p.Count(Create), p.Count(Update), p.Count(Replace), p.Count(Delete))
+	}
+	for _, warning := range p.Warnings {
+		ew.printf("%s %s\n", paint(colorYellow, "Warning:"), warning)
+	}
+	return ew.err
+}
+
+// WriteJSON writes the plan as JSON.
+func WriteJSON(w io.Writer, p *Plan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// Save writes the plan to a file, to be applied later.
+func Save(file string, p *Plan) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0600)
+}
+
+// Load reads a plan saved to a file.
+func Load(file string) (*Plan, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p Plan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid plan file %s: %w", file, err)
+	}
+	if p.Version != Version {
+		return nil, fmt.Errorf("plan file %s has version %d, expected %d", file, p.Version, Version)
+	}
+	return &p, nil
+}
+
+// errWriter keeps the first write error, so that the writes don't each have
+// to be checked.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
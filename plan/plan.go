@@ -0,0 +1,195 @@
+// Package plan computes the actions needed to make a provisioned environment
+// match its configuration, from the recorded state and the machine reported
+// by the provider.
+package plan
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// Version is the version of the saved plan format.
+const Version = 1
+
+// ActionType is the type of an action.
+type ActionType string
+
+const (
+	Create  ActionType = "create"
+	Update  ActionType = "update"
+	Replace ActionType = "replace"
+	Delete  ActionType = "delete"
+)
+
+// StatusField is the field of the change that starts a stopped machine.
+const StatusField = "status"
+
+// Action is a change to the provisioned environment.
+type Action struct {
+	Type ActionType `json:"type"`
+	// Target describes what the action applies to, e.g. "machine i-0123".
+	Target string `json:"target"`
+	// Reason explains why the action is needed.
+	Reason string `json:"reason"`
+	// Changes are the differences between the configuration and the machine
+	// that the action applies.
+	Changes []provider.Change `json:"changes,omitempty"`
+}
+
+// Plan is the list of actions needed to make an environment match its
+// configuration.
+type Plan struct {
+	Version     int    `json:"version"`
+	Environment string `json:"environment"`
+	Provider    string `json:"provider"`
+	// ConfigHash is the hash of the configuration the plan was made for.
+	ConfigHash string `json:"config_hash"`
+	// StateHash is the hash of the environment state the plan was made
+	// against, empty if the environment had no state.
+	StateHash string   `json:"state_hash"`
+	Actions   []Action `json:"actions"`
+	// Warnings are the differences the plan can't apply.
+	Warnings  []string  `json:"warnings,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Empty returns true if the plan has no actions.
+func (p *Plan) Empty() bool {
+	return len(p.Actions) == 0
+}
+
+// Count returns the number of actions of the given type.
+func (p *Plan) Count(t ActionType) int {
+	n := 0
+	for _, a := range p.Actions {
+		if a.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// Build compares the spec with the recorded state of the environment, nil
+// if there's none, and the machine reported by the provider, and returns the
+// plan to make them match.
+func Build(ctx context.Context, p provider.Provider, spec *provider.Spec, env *state.Environment) (*Plan, error) {
+	c := spec.Config
+	configHash, err := c.Hash()
+	if err != nil {
+		return nil, err
+	}
+	pl := &Plan{
+		Version:     Version,
+		Environment: c.Name,
+		Provider:    c.Provider,
+		ConfigHash:  configHash,
+		CreatedAt:   time.Now().UTC(),
+	}
+	target := "environment " + c.Name
+
+	if env == nil {
+		pl.Actions = append(pl.Actions, Action{Type: Create, Target: target, Reason: "the environment is not provisioned"})
+		return pl, nil
+	}
+	if pl.StateHash, err = StateHash(env); err != nil {
+		return nil, err
+	}
+	if env.Provider != c.Provider {
+		return nil, fmt.Errorf("environment %s was provisioned on %s but the config uses %s, clean it with the original config first", env.Name, env.Provider, c.Provider)
+	}
+
+	id := env.Resources[provider.ResourceInstance]
+	m, err := p.Get(ctx, id)
+	if errors.Is(err, provider.ErrNotFound) {
+		// Destroy whatever is left of the environment before recreating
+		// it, e.g. the firewall of a machine deleted out of band.
+		pl.Actions = append(pl.Actions,
+			Action{Type: Delete, Target: "remaining resources of " + target, Reason: fmt.Sprintf("machine %s recorded in the state no longer exists", id)},
+			Action{Type: Create, Target: target, Reason: fmt.Sprintf("machine %s recorded in the state no longer exists", id)},
+		)
+		return pl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Providers may not report all the resources of a machine, e.g. its
+	// firewall, fill them in from the state.
+	if m.Resources == nil {
+		m.Resources = map[string]string{}
+	}
+	for kind, id := range env.Resources {
+		if m.Resources[kind] == "" {
+			m.Resources[kind] = id
+		}
+	}
+
+	changes, err := p.Plan(ctx, spec, m)
+	if err != nil {
+		return nil, err
+	}
+	_, canUpdate := p.(provider.Updater)
+	var replace, update []provider.Change
+	for _, ch := range changes {
+		if ch.Replace || !canUpdate {
+			replace = append(replace, ch)
+		} else {
+			update = append(update, ch)
+		}
+	}
+
+	machine := "machine " + m.ID
+	if len(replace) > 0 {
+		// The new machine has the changes that could be updated too.
+		pl.Actions = append(pl.Actions, Action{
+			Type:    Replace,
+			Target:  machine,
+			Reason:  "changes to " + fields(replace) + " require a new machine",
+			Changes: append(replace, update...),
+		})
+		return pl, nil
+	}
+	if m.Status == provider.StatusStopped {
+		update = append([]provider.Change{{Field: StatusField, Old: string(provider.StatusStopped), New: string(provider.StatusRunning)}}, update...)
+	}
+	if len(update) > 0 {
+		pl.Actions = append(pl.Actions, Action{
+			Type:    Update,
+			Target:  machine,
+			Reason:  "changes to " + fields(update) + " can be applied in place",
+			Changes: update,
+		})
+	}
+	if len(changes) == 0 && env.ConfigHash != pl.ConfigHash {
+		pl.Warnings = append(pl.Warnings, "the configuration changed in ways that only apply to new machines, e.g. bootstrap, run clean and up to apply them")
+	}
+	return pl, nil
+}
+
+// StateHash returns the hash of an environment state, empty if env is nil.
+func StateHash(env *state.Environment) (string, error) {
+	if env == nil {
+		return "", nil
+	}
+	data, err := state.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func fields(changes []provider.Change) string {
+	names := make([]string, len(changes))
+	for i, ch := range changes {
+		names[i] = ch.Field
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,235 @@
+package plan_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/plan"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/fake"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+// updater is a fake provider that updates the machine type of machines in
+// place.
+type updater struct {
+	*fake.Provider
+}
+
+func (u updater) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	changes, err := u.Provider.Plan(ctx, spec, m)
+	for i := range changes {
+		changes[i].Replace = changes[i].Field != "machine_type"
+	}
+	return changes, err
+}
+
+func (u updater) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	return nil
+}
+
+// provision creates a machine for the spec and returns its state.
+func provision(t *testing.T, p provider.Provider, spec *provider.Spec) *state.Environment {
+	t.Helper()
+	m, err := p.Create(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := spec.Config.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &state.Environment{Name: spec.Config.Name, Provider: spec.Config.Provider, Resources: m.Resources, ConfigHash: hash}
+}
+
+// summary returns the types and targets of the actions of the plan, with the
+// fields they change.
+func summary(pl *plan.Plan) []string {
+	var s []string
+	for _, a := range pl.Actions {
+		var fields []string
+		for _, ch := range a.Changes {
+			fields = append(fields, ch.Field)
+		}
+		s = append(s, string(a.Type)+" "+a.Target+" "+strings.Join(fields, ","))
+	}
+	return s
+}
+
+func TestBuild(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// setup provisions the environment, changes the spec and returns
+		// the state of the environment.
+		setup    func(p provider.Provider, spec *provider.Spec) *state.Environment
+		updates  bool
+		want     []string
+		warnings int
+	}{
+		{
+			name:  "not provisioned",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment { return nil },
+			want:  []string{"create environment conformance "},
+		},
+		{
+			name: "up to date",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				return provision(t, p, spec)
+			},
+		},
+		{
+			name: "machine deleted",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				env := provision(t, p, spec)
+				if err := p.Destroy(ctx, &provider.Machine{Resources: env.Resources}); err != nil {
+					t.Fatal(err)
+				}
+				return env
+			},
+			want: []string{
+				"delete remaining resources of environment conformance ",
+				"create environment conformance ",
+			},
+		},
+		{
+			name: "stopped",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				env := provision(t, p, spec)
+				if err := p.Stop(ctx, env.Resources[provider.ResourceInstance]); err != nil {
+					t.Fatal(err)
+				}
+				return env
+			},
+			want: []string{"update machine fake-1 status"},
+		},
+		{
+			name: "update",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				env := provision(t, p, spec)
+				spec.Config.MachineType = "large"
+				return env
+			},
+			updates: true,
+			want:    []string{"update machine fake-1 machine_type"},
+		},
+		{
+			name: "update of a stopped machine",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				env := provision(t, p, spec)
+				if err := p.Stop(ctx, env.Resources[provider.ResourceInstance]); err != nil {
+					t.Fatal(err)
+				}
+				spec.Config.MachineType = "large"
+				return env
+			},
+			updates: true,
+			want:    []string{"update machine fake-1 status,machine_type"},
+		},
+		{
+			name: "replace",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				env := provision(t, p, spec)
+				spec.Config.Image = "other-image"
+				return env
+			},
+			updates: true,
+			want:    []string{"replace machine fake-1 image"},
+		},
+		{
+			name: "replace with updates",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				env := provision(t, p, spec)
+				spec.Config.Image = "other-image"
+				spec.Config.MachineType = "large"
+				return env
+			},
+			updates: true,
+			want:    []string{"replace machine fake-1 image,machine_type"},
+		},
+		{
+			name: "replace without updates",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				env := provision(t, p, spec)
+				spec.Config.MachineType = "large"
+				return env
+			},
+			want: []string{"replace machine fake-1 machine_type"},
+		},
+		{
+			name: "changes only for new machines",
+			setup: func(p provider.Provider, spec *provider.Spec) *state.Environment {
+				env := provision(t, p, spec)
+				spec.Config.Bootstrap.Packages = []string{"vim"}
+				return env
+			},
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p provider.Provider = fake.New()
+			if tt.updates {
+				p = updater{fake.New()}
+			}
+			spec := providertest.Spec("fake")
+			env := tt.setup(p, spec)
+
+			pl, err := plan.Build(ctx, p, spec, env)
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if got := summary(pl); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Build() actions = %q, want %q", got, tt.want)
+			}
+			if len(pl.Warnings) != tt.warnings {
+				t.Errorf("Build() warnings = %q, want %d", pl.Warnings, tt.warnings)
+			}
+			for _, a := range pl.Actions {
+				if a.Reason == "" {
+					t.Errorf("action %s %s has no reason", a.Type, a.Target)
+				}
+			}
+			if want, _ := plan.StateHash(env); pl.StateHash != want {
+				t.Errorf("Build() state hash = %q, want %q", pl.StateHash, want)
+			}
+		})
+	}
+}
+
+func TestBuildOtherProvider(t *testing.T) {
+	p := fake.New()
+	spec := providertest.Spec("fake")
+	env := provision(t, p, spec)
+	env.Provider = "other"
+	_, err := plan.Build(context.Background(), p, spec, env)
+	if err == nil || !strings.Contains(err.Error(), "was provisioned on other but the config uses fake") {
+		t.Errorf("Build() error = %v, want the provider mismatch", err)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	p := fake.New()
+	spec := providertest.Spec("fake")
+	env := provision(t, p, spec)
+	spec.Config.MachineType = "large"
+	pl, err := plan.Build(context.Background(), p, spec, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "plan.json")
+	if err := plan.Save(file, pl); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	got, err := plan.Load(file)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, pl) {
+		t.Errorf("Load() = %+v, want %+v", got, pl)
+	}
+}
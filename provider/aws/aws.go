@@ -0,0 +1,815 @@
+// Package aws implements a provider that provisions environments on AWS EC2
+// instances, through the EC2 query API.
+//
+// The credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables.
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "aws"
+
+const (
+	defaultInstanceType = "t3.medium"
+	defaultImage        = "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-*"
+	// defaultImageOwner is Canonical.
+	defaultImageOwner = "099720109477"
+	defaultVolumeType = "gp3"
+	// envTag is the tag holding the environment name of every resource
+	// created for an environment.
+	envTag = "clouddev:env"
+	// imageTag is the instance tag recording the configured image.
+	imageTag = "clouddev:image"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the AWS provider_options.
+type options struct {
+	// ImageOwner is the owner of the images the image name filter is
+	// matched against.
+	ImageOwner string `mapstructure:"image_owner"`
+	// SubnetID is the subnet of the instance, a default subnet if empty.
+	SubnetID string `mapstructure:"subnet_id"`
+	// VPCID is the VPC of the security group, the default VPC if empty. It
+	// must be the VPC of the subnet.
+	VPCID string `mapstructure:"vpc_id"`
+	// IAMInstanceProfile is the name of the instance profile of the
+	// instance.
+	IAMInstanceProfile string `mapstructure:"iam_instance_profile"`
+	Spot               bool   `mapstructure:"spot"`
+	// SpotMaxPrice is the maximum hourly price of a spot instance, the
+	// on-demand price if empty.
+	SpotMaxPrice string `mapstructure:"spot_max_price"`
+	// Endpoint is the URL of the EC2 API, the regional endpoint if empty.
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+// Provider provisions EC2 instances.
+type Provider struct {
+	cfg      *config.Config
+	opts     options
+	region   string
+	endpoint string
+	// PollInterval is the interval between the checks of the state of the
+	// instances.
+	PollInterval time.Duration
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns an AWS provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	if opts.ImageOwner == "" {
+		opts.ImageOwner = defaultImageOwner
+	}
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com/", c.Region)
+	}
+	return &Provider{
+		cfg:          c,
+		opts:         opts,
+		region:       c.Region,
+		endpoint:     endpoint,
+		PollInterval: 5 * time.Second,
+	}
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	if c.Region == "" {
+		errs = append(errs, &config.FieldError{Path: "region", Message: "is required, e.g. us-east-1"})
+	}
+	if opts.SpotMaxPrice != "" {
+		if !opts.Spot {
+			errs = append(errs, &config.FieldError{Path: "provider_options.spot_max_price", Message: "requires spot"})
+		}
+		if price, err := strconv.ParseFloat(opts.SpotMaxPrice, 64); err != nil || price <= 0 {
+			errs = append(errs, &config.FieldError{Path: "provider_options.spot_max_price", Message: "must be a positive price in USD, e.g. 0.05"})
+		}
+	}
+	if opts.Endpoint != "" {
+		if _, err := url.Parse(opts.Endpoint); err != nil {
+			errs = append(errs, &config.FieldError{Path: "provider_options.endpoint", Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+func resourceName(env string) string {
+	return "clouddev-" + env
+}
+
+func (p *Provider) instanceType(c *config.Config) string {
+	if c.MachineType == "" {
+		return defaultInstanceType
+	}
+	return c.MachineType
+}
+
+func (p *Provider) volumeType(c *config.Config) string {
+	if c.Disk.Type == "" {
+		return defaultVolumeType
+	}
+	return c.Disk.Type
+}
+
+// imageFilter returns the configured image, an AMI ID or an AMI name filter.
+func imageFilter(c *config.Config) string {
+	if c.Image == "" {
+		return defaultImage
+	}
+	return c.Image
+}
+
+// image is an AMI.
+type image struct {
+	ImageID        string `xml:"imageId"`
+	Name           string `xml:"name"`
+	CreationDate   string `xml:"creationDate"`
+	RootDeviceName string `xml:"rootDeviceName"`
+}
+
+// resolveImage returns the configured AMI, or the latest AMI of the image
+// owner matching the configured name filter.
+func (p *Provider) resolveImage(ctx context.Context, c *config.Config) (*image, error) {
+	filter := imageFilter(c)
+	req := params{}
+	if strings.HasPrefix(filter, "ami-") {
+		req.list("ImageId", filter)
+	} else {
+		req.list("Owner", p.opts.ImageOwner).filter("name", filter).filter("state", "available")
+	}
+	var resp struct {
+		Images []image `xml:"imagesSet>item"`
+	}
+	if err := p.call(ctx, "DescribeImages", url.Values(req), &resp); err != nil {
+		return nil, fmt.Errorf("failed to find image %s: %w", filter, err)
+	}
+	if len(resp.Images) == 0 {
+		return nil, fmt.Errorf("no image of owner %s matches %s", p.opts.ImageOwner, filter)
+	}
+	sort.Slice(resp.Images, func(i, j int) bool {
+		return resp.Images[i].CreationDate > resp.Images[j].CreationDate
+	})
+	return &resp.Images[0], nil
+}
+
+// instance is an instance as returned by the API.
+type instance struct {
+	InstanceID    string `xml:"instanceId"`
+	ImageID       string `xml:"imageId"`
+	InstanceType  string `xml:"instanceType"`
+	InstanceState struct {
+		Name string `xml:"name"`
+	} `xml:"instanceState"`
+	IPAddress          string `xml:"ipAddress"`
+	RootDeviceName     string `xml:"rootDeviceName"`
+	BlockDeviceMapping []struct {
+		DeviceName string `xml:"deviceName"`
+		VolumeID   string `xml:"ebs>volumeId"`
+	} `xml:"blockDeviceMapping>item"`
+	InstanceLifecycle string `xml:"instanceLifecycle"`
+	Groups            []struct {
+		GroupID string `xml:"groupId"`
+	} `xml:"groupSet>item"`
+	Tags       []tag     `xml:"tagSet>item"`
+	LaunchTime time.Time `xml:"launchTime"`
+}
+
+func (i *instance) machine() *provider.Machine {
+	m := &provider.Machine{
+		ID:        i.InstanceID,
+		Name:      tagValue(i.Tags, envTag),
+		Status:    status(i.InstanceState.Name),
+		Address:   i.IPAddress,
+		Resources: map[string]string{provider.ResourceInstance: i.InstanceID},
+		CreatedAt: i.LaunchTime,
+	}
+	if len(i.Groups) > 0 {
+		m.Resources[provider.ResourceFirewall] = i.Groups[0].GroupID
+	}
+	return m
+}
+
+func (i *instance) rootVolume() string {
+	for _, b := range i.BlockDeviceMapping {
+		if b.DeviceName == i.RootDeviceName {
+			return b.VolumeID
+		}
+	}
+	return ""
+}
+
+// terminated returns true if the instance is gone, or about to be.
+func (i *instance) terminated() bool {
+	return i.InstanceState.Name == "shutting-down" || i.InstanceState.Name == "terminated"
+}
+
+func status(s string) provider.Status {
+	switch s {
+	case "pending":
+		return provider.StatusPending
+	case "running":
+		return provider.StatusRunning
+	case "stopping", "stopped":
+		return provider.StatusStopped
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// UserDataLimit implements provider.UserDataLimiter. EC2 limits the user
+// data to 16 KiB before its base64 encoding.
+func (p *Provider) UserDataLimit() int {
+	return 16384
+}
+
+// MachineSizes implements provider.Sizer with the burstable and general
+// purpose instance types.
+func (p *Provider) MachineSizes() []provider.MachineSize {
+	return []provider.MachineSize{
+		{Name: "t3.small", CPUs: 2, MemoryMB: 2048},
+		{Name: "t3.medium", CPUs: 2, MemoryMB: 4096},
+		{Name: "t3.large", CPUs: 2, MemoryMB: 8192},
+		{Name: "t3.xlarge", CPUs: 4, MemoryMB: 16384},
+		{Name: "t3.2xlarge", CPUs: 8, MemoryMB: 32768},
+		{Name: "m6i.4xlarge", CPUs: 16, MemoryMB: 65536},
+		{Name: "m6i.8xlarge", CPUs: 32, MemoryMB: 131072},
+		{Name: "m6i.12xlarge", CPUs: 48, MemoryMB: 196608},
+		{Name: "m6i.16xlarge", CPUs: 64, MemoryMB: 262144},
+	}
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}, CreatedAt: time.Now().UTC()}
+	name := resourceName(c.Name)
+
+	img, err := p.resolveImage(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.call(ctx, "ImportKeyPair", url.Values(params{}.
+		set("KeyName", name).
+		set("PublicKeyMaterial", base64.StdEncoding.EncodeToString([]byte(spec.SSHPublicKey))).
+		tags("key-pair", c.Name)), nil); err != nil {
+		return m, fmt.Errorf("failed to import key pair: %w", err)
+	}
+	m.Resources[provider.ResourceKey] = name
+
+	sg := params{}.
+		set("GroupName", name).
+		set("GroupDescription", "clouddev environment "+c.Name).
+		tags("security-group", c.Name)
+	if p.opts.VPCID != "" {
+		sg.set("VpcId", p.opts.VPCID)
+	}
+	var group struct {
+		GroupID string `xml:"groupId"`
+	}
+	if err := p.call(ctx, "CreateSecurityGroup", url.Values(sg), &group); err != nil {
+		return m, fmt.Errorf("failed to create security group: %w", err)
+	}
+	m.Resources[provider.ResourceFirewall] = group.GroupID
+	if err := p.authorize(ctx, group.GroupID, c.Ports); err != nil {
+		return m, err
+	}
+
+	run := params{}.
+		set("ImageId", img.ImageID).
+		set("InstanceType", p.instanceType(c)).
+		set("MinCount", "1").
+		set("MaxCount", "1").
+		set("KeyName", name).
+		set("UserData", base64.StdEncoding.EncodeToString(spec.UserData)).
+		set("BlockDeviceMapping.1.DeviceName", img.RootDeviceName).
+		set("BlockDeviceMapping.1.Ebs.VolumeSize", strconv.Itoa(c.Disk.SizeGB)).
+		set("BlockDeviceMapping.1.Ebs.VolumeType", p.volumeType(c)).
+		set("BlockDeviceMapping.1.Ebs.DeleteOnTermination", "true").
+		list("SecurityGroupId", group.GroupID).
+		tags("instance", c.Name).
+		tags("volume", c.Name).
+		set("TagSpecification.1.Tag.3.Key", imageTag).
+		set("TagSpecification.1.Tag.3.Value", imageFilter(c))
+	if p.opts.SubnetID != "" {
+		run.set("SubnetId", p.opts.SubnetID)
+	}
+	if p.opts.IAMInstanceProfile != "" {
+		run.set("IamInstanceProfile.Name", p.opts.IAMInstanceProfile)
+	}
+	if p.opts.Spot {
+		// Persistent requests stopping the instance on interruption, so
+		// that spot environments can be stopped and started.
+		run.set("InstanceMarketOptions.MarketType", "spot").
+			set("InstanceMarketOptions.SpotOptions.SpotInstanceType", "persistent").
+			set("InstanceMarketOptions.SpotOptions.InstanceInterruptionBehavior", "stop").
+			tags("spot-instances-request", c.Name)
+		if p.opts.SpotMaxPrice != "" {
+			run.set("InstanceMarketOptions.SpotOptions.MaxPrice", p.opts.SpotMaxPrice)
+		}
+	}
+	var reservation struct {
+		Instances []instance `xml:"instancesSet>item"`
+	}
+	if err := p.call(ctx, "RunInstances", url.Values(run), &reservation); err != nil {
+		return m, fmt.Errorf("failed to launch instance: %w", err)
+	}
+	if len(reservation.Instances) == 0 {
+		return m, errors.New("failed to launch instance: no instance in the response")
+	}
+	m.ID = reservation.Instances[0].InstanceID
+	m.Resources[provider.ResourceInstance] = m.ID
+
+	if err := p.waitReady(ctx, m.ID); err != nil {
+		return m, err
+	}
+	i, err := p.instance(ctx, m.ID)
+	if err != nil {
+		return m, err
+	}
+	im := i.machine()
+	im.Resources = m.Resources
+	return im, nil
+}
+
+// waitReady waits for the instance to run and pass its status checks.
+func (p *Provider) waitReady(ctx context.Context, id string) error {
+	if err := p.waitState(ctx, id, "running"); err != nil {
+		return err
+	}
+	err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		var resp struct {
+			Statuses []struct {
+				InstanceStatus string `xml:"instanceStatus>status"`
+				SystemStatus   string `xml:"systemStatus>status"`
+			} `xml:"instanceStatusSet>item"`
+		}
+		if err := p.call(ctx, "DescribeInstanceStatus", url.Values(params{}.list("InstanceId", id)), &resp); err != nil {
+			return false, err
+		}
+		return len(resp.Statuses) > 0 && resp.Statuses[0].InstanceStatus == "ok" && resp.Statuses[0].SystemStatus == "ok", nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for the status checks of instance %s: %w", id, err)
+	}
+	return nil
+}
+
+// waitState waits for the instance to be in the state.
+func (p *Provider) waitState(ctx context.Context, id, state string) error {
+	err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		i, err := p.instance(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if i.terminated() {
+			return false, fmt.Errorf("instance %s is %s", id, i.InstanceState.Name)
+		}
+		return i.InstanceState.Name == state, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for instance %s to be %s: %w", id, state, err)
+	}
+	return nil
+}
+
+// permissions returns the parameters of the ingress rules of the ports.
+func permissions(ports []int) params {
+	req := params{}
+	for i, port := range ports {
+		prefix := "IpPermissions." + strconv.Itoa(i+1)
+		req.set(prefix+".IpProtocol", "tcp").
+			set(prefix+".FromPort", strconv.Itoa(port)).
+			set(prefix+".ToPort", strconv.Itoa(port)).
+			set(prefix+".IpRanges.1.CidrIp", "0.0.0.0/0").
+			set(prefix+".Ipv6Ranges.1.CidrIpv6", "::/0")
+	}
+	return req
+}
+
+func (p *Provider) authorize(ctx context.Context, groupID string, ports []int) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	if err := p.call(ctx, "AuthorizeSecurityGroupIngress", url.Values(permissions(ports).set("GroupId", groupID)), nil); err != nil {
+		return fmt.Errorf("failed to open ports of security group %s: %w", groupID, err)
+	}
+	return nil
+}
+
+func (p *Provider) instances(ctx context.Context, req params) ([]instance, error) {
+	var instances []instance
+	for {
+		var resp struct {
+			Reservations []struct {
+				Instances []instance `xml:"instancesSet>item"`
+			} `xml:"reservationSet>item"`
+			NextToken string `xml:"nextToken"`
+		}
+		if err := p.call(ctx, "DescribeInstances", url.Values(req), &resp); err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+		if resp.NextToken == "" {
+			return instances, nil
+		}
+		req.set("NextToken", resp.NextToken)
+	}
+}
+
+func (p *Provider) instance(ctx context.Context, id string) (*instance, error) {
+	instances, err := p.instances(ctx, params{}.list("InstanceId", id))
+	if hasCode(err, "InvalidInstanceID.NotFound", "InvalidInstanceID.Malformed") || err == nil && len(instances) == 0 {
+		return nil, provider.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instances[0], nil
+}
+
+// Get implements provider.Provider. Terminated instances are not found.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	i, err := p.instance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if i.terminated() {
+		return nil, provider.ErrNotFound
+	}
+	return i.machine(), nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	if err := p.call(ctx, "StartInstances", url.Values(params{}.list("InstanceId", id)), nil); err != nil {
+		if hasCode(err, "InvalidInstanceID.NotFound", "InvalidInstanceID.Malformed") {
+			return provider.ErrNotFound
+		}
+		return err
+	}
+	return p.waitState(ctx, id, "running")
+}
+
+// Stop implements provider.Provider.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	if err := p.call(ctx, "StopInstances", url.Values(params{}.list("InstanceId", id)), nil); err != nil {
+		if hasCode(err, "InvalidInstanceID.NotFound", "InvalidInstanceID.Malformed") {
+			return provider.ErrNotFound
+		}
+		return err
+	}
+	return p.waitState(ctx, id, "stopped")
+}
+
+// ConsoleOutput implements provider.ConsoleReader.
+func (p *Provider) ConsoleOutput(ctx context.Context, id string) (string, error) {
+	var resp struct {
+		Output string `xml:"output"`
+	}
+	err := p.call(ctx, "GetConsoleOutput", url.Values(params{}.set("InstanceId", id)), &resp)
+	if hasCode(err, "InvalidInstanceID.NotFound", "InvalidInstanceID.Malformed") {
+		return "", provider.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	out, err := base64.StdEncoding.DecodeString(resp.Output)
+	if err != nil {
+		return "", fmt.Errorf("GetConsoleOutput: invalid output: %w", err)
+	}
+	return string(out), nil
+}
+
+// Destroy implements provider.Provider. Besides the recorded resources, it
+// deletes all the resources tagged with the environment name, so that the
+// resources of failed creations are deleted too.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	byTag := params{}.filter("tag:"+envTag, m.Name)
+
+	// Persistent spot requests would launch new instances.
+	var spot struct {
+		Requests []struct {
+			ID string `xml:"spotInstanceRequestId"`
+		} `xml:"spotInstanceRequestSet>item"`
+	}
+	req := params{}.filter("tag:"+envTag, m.Name).filter("state", "open", "active", "disabled")
+	if err := p.call(ctx, "DescribeSpotInstanceRequests", url.Values(req), &spot); err != nil {
+		return fmt.Errorf("failed to find spot requests: %w", err)
+	}
+	if len(spot.Requests) > 0 {
+		cancel := params{}
+		for i, r := range spot.Requests {
+			cancel.set("SpotInstanceRequestId."+strconv.Itoa(i+1), r.ID)
+		}
+		if err := p.call(ctx, "CancelSpotInstanceRequests", url.Values(cancel), nil); err != nil {
+			return fmt.Errorf("failed to cancel spot requests: %w", err)
+		}
+	}
+
+	instanceIDs := newSet(m.Resources[provider.ResourceInstance])
+	tagged, err := p.instances(ctx, params{}.filter("tag:"+envTag, m.Name))
+	if err != nil {
+		return fmt.Errorf("failed to find instances: %w", err)
+	}
+	for _, i := range tagged {
+		if !i.terminated() {
+			instanceIDs.add(i.InstanceID)
+		}
+	}
+	for _, id := range instanceIDs.list() {
+		err := p.call(ctx, "TerminateInstances", url.Values(params{}.list("InstanceId", id)), nil)
+		if err != nil && !hasCode(err, "InvalidInstanceID.NotFound", "InvalidInstanceID.Malformed") {
+			return fmt.Errorf("failed to terminate instance %s: %w", id, err)
+		}
+	}
+	// Security groups can be deleted once their instances are terminated.
+	for _, id := range instanceIDs.list() {
+		err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			i, err := p.instance(ctx, id)
+			if errors.Is(err, provider.ErrNotFound) {
+				return true, nil
+			}
+			return err == nil && i.InstanceState.Name == "terminated", err
+		})
+		if err != nil {
+			return fmt.Errorf("failed waiting for instance %s to terminate: %w", id, err)
+		}
+	}
+
+	groupIDs := newSet(m.Resources[provider.ResourceFirewall])
+	var groups struct {
+		Groups []struct {
+			GroupID string `xml:"groupId"`
+		} `xml:"securityGroupInfo>item"`
+	}
+	if err := p.call(ctx, "DescribeSecurityGroups", url.Values(byTag), &groups); err != nil {
+		return fmt.Errorf("failed to find security groups: %w", err)
+	}
+	for _, g := range groups.Groups {
+		groupIDs.add(g.GroupID)
+	}
+	for _, id := range groupIDs.list() {
+		// The network interfaces of terminated instances may still be
+		// using the group for a while.
+		err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			err := p.call(ctx, "DeleteSecurityGroup", url.Values(params{}.set("GroupId", id)), nil)
+			if hasCode(err, "DependencyViolation") {
+				return false, nil
+			}
+			return true, err
+		})
+		if err != nil && !hasCode(err, "InvalidGroup.NotFound", "InvalidGroupId.Malformed") {
+			return fmt.Errorf("failed to delete security group %s: %w", id, err)
+		}
+	}
+
+	keyNames := newSet(m.Resources[provider.ResourceKey])
+	var keys struct {
+		Keys []struct {
+			KeyName string `xml:"keyName"`
+		} `xml:"keySet>item"`
+	}
+	if err := p.call(ctx, "DescribeKeyPairs", url.Values(byTag), &keys); err != nil {
+		return fmt.Errorf("failed to find key pairs: %w", err)
+	}
+	for _, k := range keys.Keys {
+		keyNames.add(k.KeyName)
+	}
+	for _, name := range keyNames.list() {
+		err := p.call(ctx, "DeleteKeyPair", url.Values(params{}.set("KeyName", name)), nil)
+		if err != nil && !hasCode(err, "InvalidKeyPair.NotFound") {
+			return fmt.Errorf("failed to delete key pair %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	instances, err := p.instances(ctx, params{}.
+		filter("tag-key", envTag).
+		filter("instance-state-name", "pending", "running", "stopping", "stopped"))
+	if err != nil {
+		return nil, err
+	}
+	machines := make([]*provider.Machine, len(instances))
+	for i := range instances {
+		machines[i] = instances[i].machine()
+	}
+	return machines, nil
+}
+
+// Plan implements provider.Provider. The instance type, the ports and
+// growing the root volume are updated in place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	i, err := p.instance(ctx, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	if i.terminated() {
+		return nil, provider.ErrNotFound
+	}
+
+	var changes []provider.Change
+	if old := tagValue(i.Tags, imageTag); old != imageFilter(c) {
+		changes = append(changes, provider.Change{Field: "image", Old: old, New: imageFilter(c), Replace: true})
+	}
+	if it := p.instanceType(c); it != i.InstanceType {
+		changes = append(changes, provider.Change{Field: "machine_type", Old: i.InstanceType, New: it})
+	}
+	if old, new := i.InstanceLifecycle == "spot", p.opts.Spot; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.spot", Old: strconv.FormatBool(old), New: strconv.FormatBool(new), Replace: true})
+	}
+
+	if id := i.rootVolume(); id != "" {
+		var volumes struct {
+			Volumes []struct {
+				Size int `xml:"size"`
+			} `xml:"volumeSet>item"`
+		}
+		if err := p.call(ctx, "DescribeVolumes", url.Values(params{}.list("VolumeId", id)), &volumes); err != nil {
+			return nil, err
+		}
+		if len(volumes.Volumes) > 0 && volumes.Volumes[0].Size != c.Disk.SizeGB {
+			size := volumes.Volumes[0].Size
+			changes = append(changes, provider.Change{
+				Field:   "disk.size_gb",
+				Old:     strconv.Itoa(size),
+				New:     strconv.Itoa(c.Disk.SizeGB),
+				Replace: c.Disk.SizeGB < size,
+			})
+		}
+	}
+
+	if len(i.Groups) > 0 {
+		ports, err := p.ports(ctx, i.Groups[0].GroupID)
+		if err != nil {
+			return nil, err
+		}
+		if old, new := provider.FormatPorts(ports), provider.FormatPorts(c.Ports); old != new {
+			changes = append(changes, provider.Change{Field: "ports", Old: old, New: new})
+		}
+	}
+	return changes, nil
+}
+
+// ports returns the TCP ports open by the security group.
+func (p *Provider) ports(ctx context.Context, groupID string) ([]int, error) {
+	var resp struct {
+		Groups []struct {
+			Permissions []struct {
+				IPProtocol string `xml:"ipProtocol"`
+				FromPort   int    `xml:"fromPort"`
+				ToPort     int    `xml:"toPort"`
+			} `xml:"ipPermissions>item"`
+		} `xml:"securityGroupInfo>item"`
+	}
+	if err := p.call(ctx, "DescribeSecurityGroups", url.Values(params{}.list("GroupId", groupID)), &resp); err != nil {
+		return nil, err
+	}
+	var ports []int
+	for _, g := range resp.Groups {
+		for _, perm := range g.Permissions {
+			if perm.IPProtocol == "tcp" && perm.FromPort == perm.ToPort {
+				ports = append(ports, perm.FromPort)
+			}
+		}
+	}
+	return ports, nil
+}
+
+// Update implements provider.Updater.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	for _, ch := range changes {
+		switch ch.Field {
+		case "machine_type":
+			// The instance type of a running instance can't be changed.
+			if m.Status == provider.StatusRunning {
+				if err := p.Stop(ctx, m.ID); err != nil {
+					return err
+				}
+			}
+			if err := p.call(ctx, "ModifyInstanceAttribute", url.Values(params{}.
+				set("InstanceId", m.ID).
+				set("InstanceType.Value", ch.New)), nil); err != nil {
+				return fmt.Errorf("failed to change the type of instance %s: %w", m.ID, err)
+			}
+			if m.Status == provider.StatusRunning {
+				if err := p.Start(ctx, m.ID); err != nil {
+					return err
+				}
+			}
+		case "disk.size_gb":
+			i, err := p.instance(ctx, m.ID)
+			if err != nil {
+				return err
+			}
+			if err := p.call(ctx, "ModifyVolume", url.Values(params{}.
+				set("VolumeId", i.rootVolume()).
+				set("Size", ch.New)), nil); err != nil {
+				return fmt.Errorf("failed to resize volume %s: %w", i.rootVolume(), err)
+			}
+		case "ports":
+			if err := p.updatePorts(ctx, m.Resources[provider.ResourceFirewall], spec.Config.Ports); err != nil {
+				return err
+			}
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+	return nil
+}
+
+// updatePorts opens the ports missing from the security group and closes
+// the ones no longer configured.
+func (p *Provider) updatePorts(ctx context.Context, groupID string, ports []int) error {
+	open, err := p.ports(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	var revoke, authorize []int
+	for _, port := range open {
+		if !contains(ports, port) {
+			revoke = append(revoke, port)
+		}
+	}
+	for _, port := range ports {
+		if !contains(open, port) {
+			authorize = append(authorize, port)
+		}
+	}
+	if len(revoke) > 0 {
+		if err := p.call(ctx, "RevokeSecurityGroupIngress", url.Values(permissions(revoke).set("GroupId", groupID)), nil); err != nil {
+			return fmt.Errorf("failed to close ports of security group %s: %w", groupID, err)
+		}
+	}
+	return p.authorize(ctx, groupID, authorize)
+}
+
+func contains(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// set is an ordered set of resource IDs.
+type set struct {
+	ids  []string
+	seen map[string]bool
+}
+
+func newSet(ids ...string) *set {
+	s := &set{seen: map[string]bool{}}
+	for _, id := range ids {
+		s.add(id)
+	}
+	return s
+}
+
+func (s *set) add(id string) {
+	if id != "" && !s.seen[id] {
+		s.seen[id] = true
+		s.ids = append(s.ids, id)
+	}
+}
+
+func (s *set) list() []string {
+	return s.ids
+}
@@ -0,0 +1,142 @@
+package aws_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/aws"
+	"github.com/darkowlzz/clouddev/provider/aws/awstest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// newTestProvider returns a provider of the spec against an API stand-in.
+func newTestProvider(t *testing.T, s *awstest.Server, spec *provider.Spec, opts map[string]interface{}) *aws.Provider {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", awstest.AccessKeyID)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", awstest.SecretAccessKey)
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	spec.Config.Region = "us-east-1"
+	spec.Config.Image = "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-*"
+	spec.Config.ProviderOptions = map[string]interface{}{"endpoint": s.URL}
+	for k, v := range opts {
+		spec.Config.ProviderOptions[k] = v
+	}
+	p := aws.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *awstest.Server {
+	s := awstest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// failAction makes the server fail the calls of the action.
+func failAction(s *awstest.Server, action string) {
+	handler := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("Action") == action {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("<Response><Errors><Error><Code>Unavailable</Code><Message>The service is unavailable</Message></Error></Errors></Response>"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(aws.Name)
+	providertest.Run(t, newTestProvider(t, s, spec, nil), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after the suite", n)
+	}
+}
+
+func TestDestroyDeletesTaggedResourcesOfFailedCreate(t *testing.T) {
+	s := newServer(t)
+	failAction(s, "DescribeInstanceStatus")
+	spec := providertest.Spec(aws.Name)
+	p := newTestProvider(t, s, spec, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := p.Create(ctx, spec); err == nil {
+		t.Fatal("Create() error = nil, want the status check error")
+	}
+	if s.Resources() == 0 {
+		t.Fatal("the failed Create() created no resources")
+	}
+
+	// The resources of the machine are lost, e.g. the process was killed
+	// before it recorded them.
+	if err := p.Destroy(context.Background(), &provider.Machine{Name: spec.Config.Name}); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d tagged resources are left after Destroy()", n)
+	}
+}
+
+func TestSpotInstance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(aws.Name)
+	p := newTestProvider(t, s, spec, map[string]interface{}{"spot": true, "spot_max_price": "0.05"})
+	if errs := p.Validate(spec.Config); len(errs) > 0 {
+		t.Fatalf("Validate() = %v", errs)
+	}
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	changes, err := p.Plan(ctx, spec, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("Plan() = %v, want no changes", changes)
+	}
+
+	// Spot instances are stopped on interruption, so they can be stopped
+	// and started.
+	if err := p.Stop(ctx, m.ID); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if err := p.Start(ctx, m.ID); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	onDemand := providertest.Spec(aws.Name)
+	changes, err = newTestProvider(t, s, onDemand, nil).Plan(ctx, onDemand, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) != 1 || changes[0].Field != "provider_options.spot" || !changes[0].Replace {
+		t.Errorf("Plan() of an on-demand instance = %v, want to replace the spot instance", changes)
+	}
+
+	// The persistent spot request must be cancelled, or it would launch
+	// another instance.
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy(), including the spot request", n)
+	}
+}
+
+func TestSpotMaxPriceRequiresSpot(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(aws.Name)
+	p := newTestProvider(t, s, spec, map[string]interface{}{"spot_max_price": "0.05"})
+	errs := p.Validate(spec.Config)
+	if len(errs) != 1 || errs[0].Path != "provider_options.spot_max_price" {
+		t.Errorf("Validate() = %v, want an error on provider_options.spot_max_price", errs)
+	}
+}
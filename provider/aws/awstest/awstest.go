@@ -0,0 +1,666 @@
+// Package awstest implements an in-memory stand-in for the EC2 query API
+// for testing the AWS provider.
+//
+// The stand-in implements the actions used by the provider. Instances are
+// running with passing status checks on their first read after their
+// launch, and state changes complete immediately.
+package awstest
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// The credentials accepted by the stand-in.
+const (
+	AccessKeyID     = "AKIAAWSTEST"
+	SecretAccessKey = "awstest-secret"
+)
+
+// Image is the AMI of the stand-in matching the default image filter of
+// the provider.
+var Image = image{
+	ImageID:        "ami-0123456789abcdef0",
+	Name:           "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240101",
+	Owner:          "099720109477",
+	CreationDate:   "2024-01-01T00:00:00.000Z",
+	RootDeviceName: "/dev/sda1",
+}
+
+// Server is an EC2 query API stand-in.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	nextID    int
+	images    []image
+	keys      map[string][]item
+	groups    map[string]*group
+	instances map[string]*instance
+	volumes   map[string]*volume
+	spot      map[string]*spotRequest
+}
+
+type image struct {
+	ImageID        string `xml:"imageId"`
+	Name           string `xml:"name"`
+	Owner          string `xml:"imageOwnerId"`
+	CreationDate   string `xml:"creationDate"`
+	RootDeviceName string `xml:"rootDeviceName"`
+}
+
+type item struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type permission struct {
+	IPProtocol string `xml:"ipProtocol"`
+	FromPort   int    `xml:"fromPort"`
+	ToPort     int    `xml:"toPort"`
+}
+
+type group struct {
+	GroupID     string       `xml:"groupId"`
+	GroupName   string       `xml:"groupName"`
+	Permissions []permission `xml:"ipPermissions>item"`
+	Tags        []item       `xml:"tagSet>item"`
+}
+
+type instance struct {
+	InstanceID         string `xml:"instanceId"`
+	ImageID            string `xml:"imageId"`
+	InstanceType       string `xml:"instanceType"`
+	State              string `xml:"instanceState>name"`
+	IPAddress          string `xml:"ipAddress,omitempty"`
+	RootDeviceName     string `xml:"rootDeviceName"`
+	BlockDeviceMapping []struct {
+		DeviceName string `xml:"deviceName"`
+		VolumeID   string `xml:"ebs>volumeId"`
+	} `xml:"blockDeviceMapping>item"`
+	InstanceLifecycle string `xml:"instanceLifecycle,omitempty"`
+	Groups            []struct {
+		GroupID string `xml:"groupId"`
+	} `xml:"groupSet>item"`
+	Tags       []item `xml:"tagSet>item"`
+	LaunchTime string `xml:"launchTime"`
+}
+
+type volume struct {
+	VolumeID string `xml:"volumeId"`
+	Size     int    `xml:"size"`
+	Type     string `xml:"volumeType"`
+	Tags     []item `xml:"tagSet>item"`
+}
+
+type spotRequest struct {
+	ID    string `xml:"spotInstanceRequestId"`
+	State string `xml:"state"`
+	Tags  []item `xml:"tagSet>item"`
+}
+
+// NewServer starts a stand-in serving Image. The caller must close it.
+func NewServer() *Server {
+	s := &Server{
+		images:    []image{Image},
+		keys:      map[string][]item{},
+		groups:    map[string]*group{},
+		instances: map[string]*instance{},
+		volumes:   map[string]*volume{},
+		spot:      map[string]*spotRequest{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Resources returns the number of key pairs, security groups, volumes,
+// open spot requests and instances not terminated, to check for leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.keys) + len(s.groups) + len(s.volumes)
+	for _, i := range s.instances {
+		if i.State != "terminated" {
+			n++
+		}
+	}
+	for _, r := range s.spot {
+		if r.State != "cancelled" {
+			n++
+		}
+	}
+	return n
+}
+
+// apiError is an error response.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func errorf(code, format string, a ...interface{}) *apiError {
+	return &apiError{status: http.StatusBadRequest, code: code, message: fmt.Sprintf(format, a...)}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+AccessKeyID+"/") {
+		writeError(w, &apiError{status: http.StatusUnauthorized, code: "AuthFailure", message: "AWS was not able to validate the provided access credentials"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, errorf("MalformedQueryString", "%v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	action := r.PostForm.Get("Action")
+	handlers := map[string]func(url.Values) (interface{}, *apiError){
+		"DescribeImages":                s.describeImages,
+		"ImportKeyPair":                 s.importKeyPair,
+		"DescribeKeyPairs":              s.describeKeyPairs,
+		"DeleteKeyPair":                 s.deleteKeyPair,
+		"CreateSecurityGroup":           s.createSecurityGroup,
+		"DescribeSecurityGroups":        s.describeSecurityGroups,
+		"AuthorizeSecurityGroupIngress": s.authorizeIngress,
+		"RevokeSecurityGroupIngress":    s.revokeIngress,
+		"DeleteSecurityGroup":           s.deleteSecurityGroup,
+		"RunInstances":                  s.runInstances,
+		"DescribeInstances":             s.describeInstances,
+		"DescribeInstanceStatus":        s.describeInstanceStatus,
+		"GetConsoleOutput":              s.getConsoleOutput,
+		"StartInstances":                s.setState("running"),
+		"StopInstances":                 s.setState("stopped"),
+		"TerminateInstances":            s.setState("terminated"),
+		"ModifyInstanceAttribute":       s.modifyInstanceAttribute,
+		"DescribeVolumes":               s.describeVolumes,
+		"ModifyVolume":                  s.modifyVolume,
+		"DescribeSpotInstanceRequests":  s.describeSpotRequests,
+		"CancelSpotInstanceRequests":    s.cancelSpotRequests,
+	}
+	handler, ok := handlers[action]
+	if !ok {
+		writeError(w, errorf("InvalidAction", "The action %s is not valid for this web service.", action))
+		return
+	}
+	resp, apiErr := handler(r.PostForm)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+	if resp == nil {
+		resp = &struct{}{}
+	}
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	start := xml.StartElement{
+		Name: xml.Name{Space: "http://ec2.amazonaws.com/doc/2016-11-15/", Local: action + "Response"},
+	}
+	if err := xml.NewEncoder(w).EncodeElement(resp, start); err != nil {
+		panic(err)
+	}
+}
+
+func (s *Server) id(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s-%017x", prefix, s.nextID)
+}
+
+// list returns the values of the list parameter prefix.1, prefix.2, ...
+func list(form url.Values, prefix string) []string {
+	var values []string
+	for n := 1; ; n++ {
+		v, ok := form[prefix+"."+strconv.Itoa(n)]
+		if !ok {
+			return values
+		}
+		values = append(values, v[0])
+	}
+}
+
+// filter is a filter of a describe action.
+type filter struct {
+	name   string
+	values []string
+}
+
+func filters(form url.Values) []filter {
+	var fs []filter
+	for n := 1; ; n++ {
+		prefix := "Filter." + strconv.Itoa(n)
+		name := form.Get(prefix + ".Name")
+		if name == "" {
+			return fs
+		}
+		fs = append(fs, filter{name: name, values: list(form, prefix+".Value")})
+	}
+}
+
+// match returns true if the resource with the tags and attributes matches
+// all the filters. The values of the filters are globs.
+func match(fs []filter, tags []item, attrs map[string]string) bool {
+	for _, f := range fs {
+		var values []string
+		switch {
+		case strings.HasPrefix(f.name, "tag:"):
+			for _, t := range tags {
+				if t.Key == strings.TrimPrefix(f.name, "tag:") {
+					values = append(values, t.Value)
+				}
+			}
+		case f.name == "tag-key":
+			for _, t := range tags {
+				values = append(values, t.Key)
+			}
+		default:
+			v, ok := attrs[f.name]
+			if !ok {
+				return false
+			}
+			values = []string{v}
+		}
+		if !matchAny(f.values, values) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns, values []string) bool {
+	for _, p := range patterns {
+		re := regexp.MustCompile("^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(p)) + "$")
+		for _, v := range values {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tags returns the tags of the tag specification of the resource type.
+func tags(form url.Values, resourceType string) []item {
+	for n := 1; ; n++ {
+		prefix := "TagSpecification." + strconv.Itoa(n)
+		rt := form.Get(prefix + ".ResourceType")
+		if rt == "" {
+			return nil
+		}
+		if rt != resourceType {
+			continue
+		}
+		var tags []item
+		for m := 1; form.Get(prefix+".Tag."+strconv.Itoa(m)+".Key") != ""; m++ {
+			tp := prefix + ".Tag." + strconv.Itoa(m)
+			tags = append(tags, item{Key: form.Get(tp + ".Key"), Value: form.Get(tp + ".Value")})
+		}
+		return tags
+	}
+}
+
+func (s *Server) describeImages(form url.Values) (interface{}, *apiError) {
+	ids, owners := list(form, "ImageId"), list(form, "Owner")
+	fs := filters(form)
+	var resp struct {
+		Images []image `xml:"imagesSet>item"`
+	}
+	for _, img := range s.images {
+		if len(ids) > 0 && !matchAny(ids, []string{img.ImageID}) ||
+			len(owners) > 0 && !matchAny(owners, []string{img.Owner}) ||
+			!match(fs, nil, map[string]string{"name": img.Name, "state": "available"}) {
+			continue
+		}
+		resp.Images = append(resp.Images, img)
+	}
+	return &resp, nil
+}
+
+func (s *Server) importKeyPair(form url.Values) (interface{}, *apiError) {
+	name := form.Get("KeyName")
+	if _, ok := s.keys[name]; ok {
+		return nil, errorf("InvalidKeyPair.Duplicate", "The keypair '%s' already exists.", name)
+	}
+	s.keys[name] = tags(form, "key-pair")
+	return &struct {
+		KeyName   string `xml:"keyName"`
+		KeyPairID string `xml:"keyPairId"`
+	}{name, s.id("key")}, nil
+}
+
+func (s *Server) describeKeyPairs(form url.Values) (interface{}, *apiError) {
+	var resp struct {
+		Keys []struct {
+			KeyName string `xml:"keyName"`
+			Tags    []item `xml:"tagSet>item"`
+		} `xml:"keySet>item"`
+	}
+	fs := filters(form)
+	for name, tags := range s.keys {
+		if match(fs, tags, map[string]string{"key-name": name}) {
+			resp.Keys = append(resp.Keys, struct {
+				KeyName string `xml:"keyName"`
+				Tags    []item `xml:"tagSet>item"`
+			}{name, tags})
+		}
+	}
+	return &resp, nil
+}
+
+func (s *Server) deleteKeyPair(form url.Values) (interface{}, *apiError) {
+	delete(s.keys, form.Get("KeyName"))
+	return nil, nil
+}
+
+func (s *Server) createSecurityGroup(form url.Values) (interface{}, *apiError) {
+	name := form.Get("GroupName")
+	for _, g := range s.groups {
+		if g.GroupName == name {
+			return nil, errorf("InvalidGroup.Duplicate", "The security group '%s' already exists", name)
+		}
+	}
+	g := &group{GroupID: s.id("sg"), GroupName: name, Tags: tags(form, "security-group")}
+	s.groups[g.GroupID] = g
+	return &struct {
+		GroupID string `xml:"groupId"`
+	}{g.GroupID}, nil
+}
+
+func (s *Server) describeSecurityGroups(form url.Values) (interface{}, *apiError) {
+	ids, fs := list(form, "GroupId"), filters(form)
+	var resp struct {
+		Groups []*group `xml:"securityGroupInfo>item"`
+	}
+	for _, id := range ids {
+		if _, ok := s.groups[id]; !ok {
+			return nil, errorf("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+		}
+	}
+	for _, g := range s.groups {
+		if (len(ids) == 0 || matchAny(ids, []string{g.GroupID})) && match(fs, g.Tags, map[string]string{"group-name": g.GroupName}) {
+			resp.Groups = append(resp.Groups, g)
+		}
+	}
+	return &resp, nil
+}
+
+func permissions(form url.Values) []permission {
+	var perms []permission
+	for n := 1; form.Get("IpPermissions."+strconv.Itoa(n)+".IpProtocol") != ""; n++ {
+		prefix := "IpPermissions." + strconv.Itoa(n)
+		from, _ := strconv.Atoi(form.Get(prefix + ".FromPort"))
+		to, _ := strconv.Atoi(form.Get(prefix + ".ToPort"))
+		perms = append(perms, permission{IPProtocol: form.Get(prefix + ".IpProtocol"), FromPort: from, ToPort: to})
+	}
+	return perms
+}
+
+func (s *Server) authorizeIngress(form url.Values) (interface{}, *apiError) {
+	g, ok := s.groups[form.Get("GroupId")]
+	if !ok {
+		return nil, errorf("InvalidGroup.NotFound", "The security group '%s' does not exist", form.Get("GroupId"))
+	}
+	for _, perm := range permissions(form) {
+		for _, p := range g.Permissions {
+			if p == perm {
+				return nil, errorf("InvalidPermission.Duplicate", "the specified rule already exists")
+			}
+		}
+		g.Permissions = append(g.Permissions, perm)
+	}
+	return nil, nil
+}
+
+func (s *Server) revokeIngress(form url.Values) (interface{}, *apiError) {
+	g, ok := s.groups[form.Get("GroupId")]
+	if !ok {
+		return nil, errorf("InvalidGroup.NotFound", "The security group '%s' does not exist", form.Get("GroupId"))
+	}
+	revoke := permissions(form)
+	var kept []permission
+	for _, p := range g.Permissions {
+		found := false
+		for _, r := range revoke {
+			found = found || p == r
+		}
+		if !found {
+			kept = append(kept, p)
+		}
+	}
+	g.Permissions = kept
+	return nil, nil
+}
+
+func (s *Server) deleteSecurityGroup(form url.Values) (interface{}, *apiError) {
+	id := form.Get("GroupId")
+	if _, ok := s.groups[id]; !ok {
+		return nil, errorf("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+	}
+	for _, i := range s.instances {
+		for _, g := range i.Groups {
+			if g.GroupID == id && i.State != "terminated" {
+				return nil, errorf("DependencyViolation", "resource %s has a dependent object", id)
+			}
+		}
+	}
+	delete(s.groups, id)
+	return nil, nil
+}
+
+func (s *Server) runInstances(form url.Values) (interface{}, *apiError) {
+	var img *image
+	for i := range s.images {
+		if s.images[i].ImageID == form.Get("ImageId") {
+			img = &s.images[i]
+		}
+	}
+	if img == nil {
+		return nil, errorf("InvalidAMIID.NotFound", "The image id '[%s]' does not exist", form.Get("ImageId"))
+	}
+	if _, ok := s.keys[form.Get("KeyName")]; !ok {
+		return nil, errorf("InvalidKeyPair.NotFound", "The key pair '%s' does not exist", form.Get("KeyName"))
+	}
+
+	i := &instance{
+		InstanceID:     s.id("i"),
+		ImageID:        img.ImageID,
+		InstanceType:   form.Get("InstanceType"),
+		State:          "pending",
+		RootDeviceName: img.RootDeviceName,
+		Tags:           tags(form, "instance"),
+		LaunchTime:     time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, id := range list(form, "SecurityGroupId") {
+		if _, ok := s.groups[id]; !ok {
+			return nil, errorf("InvalidGroup.NotFound", "The security group '%s' does not exist", id)
+		}
+		i.Groups = append(i.Groups, struct {
+			GroupID string `xml:"groupId"`
+		}{id})
+	}
+	size, _ := strconv.Atoi(form.Get("BlockDeviceMapping.1.Ebs.VolumeSize"))
+	v := &volume{VolumeID: s.id("vol"), Size: size, Type: form.Get("BlockDeviceMapping.1.Ebs.VolumeType"), Tags: tags(form, "volume")}
+	s.volumes[v.VolumeID] = v
+	i.BlockDeviceMapping = append(i.BlockDeviceMapping, struct {
+		DeviceName string `xml:"deviceName"`
+		VolumeID   string `xml:"ebs>volumeId"`
+	}{img.RootDeviceName, v.VolumeID})
+	if form.Get("InstanceMarketOptions.MarketType") == "spot" {
+		i.InstanceLifecycle = "spot"
+		r := &spotRequest{ID: s.id("sir"), State: "active", Tags: tags(form, "spot-instances-request")}
+		s.spot[r.ID] = r
+	}
+	s.instances[i.InstanceID] = i
+
+	return &struct {
+		Instances []*instance `xml:"instancesSet>item"`
+	}{[]*instance{i}}, nil
+}
+
+func (s *Server) describeInstances(form url.Values) (interface{}, *apiError) {
+	ids, fs := list(form, "InstanceId"), filters(form)
+	for _, id := range ids {
+		if _, ok := s.instances[id]; !ok {
+			return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+		}
+	}
+	var matches []*instance
+	for _, i := range s.instances {
+		if (len(ids) == 0 || matchAny(ids, []string{i.InstanceID})) && match(fs, i.Tags, map[string]string{"instance-state-name": i.State}) {
+			if i.State == "pending" {
+				i.State = "running"
+				i.IPAddress = "192.0.2.10"
+			}
+			matches = append(matches, i)
+		}
+	}
+	sort.Slice(matches, func(a, b int) bool { return matches[a].InstanceID < matches[b].InstanceID })
+	type reservation struct {
+		Instances []*instance `xml:"instancesSet>item"`
+	}
+	var resp struct {
+		Reservations []reservation `xml:"reservationSet>item"`
+	}
+	for _, i := range matches {
+		resp.Reservations = append(resp.Reservations, reservation{[]*instance{i}})
+	}
+	return &resp, nil
+}
+
+func (s *Server) describeInstanceStatus(form url.Values) (interface{}, *apiError) {
+	type status struct {
+		InstanceID     string `xml:"instanceId"`
+		InstanceStatus string `xml:"instanceStatus>status"`
+		SystemStatus   string `xml:"systemStatus>status"`
+	}
+	var resp struct {
+		Statuses []status `xml:"instanceStatusSet>item"`
+	}
+	for _, id := range list(form, "InstanceId") {
+		i, ok := s.instances[id]
+		if !ok {
+			return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+		}
+		if i.State == "running" {
+			resp.Statuses = append(resp.Statuses, status{id, "ok", "ok"})
+		}
+	}
+	return &resp, nil
+}
+
+func (s *Server) getConsoleOutput(form url.Values) (interface{}, *apiError) {
+	id := form.Get("InstanceId")
+	if _, ok := s.instances[id]; !ok {
+		return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+	}
+	return &struct {
+		InstanceID string `xml:"instanceId"`
+		Output     string `xml:"output"`
+	}{id, base64.StdEncoding.EncodeToString([]byte(providertest.ConsoleOutput))}, nil
+}
+
+func (s *Server) setState(state string) func(url.Values) (interface{}, *apiError) {
+	return func(form url.Values) (interface{}, *apiError) {
+		for _, id := range list(form, "InstanceId") {
+			i, ok := s.instances[id]
+			if !ok {
+				return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+			}
+			if i.State == "terminated" && state != "terminated" {
+				return nil, errorf("IncorrectInstanceState", "The instance '%s' is not in a state from which it can be %s.", id, state)
+			}
+			i.State = state
+			if state == "terminated" {
+				for _, b := range i.BlockDeviceMapping {
+					delete(s.volumes, b.VolumeID)
+				}
+			}
+		}
+		return nil, nil
+	}
+}
+
+func (s *Server) modifyInstanceAttribute(form url.Values) (interface{}, *apiError) {
+	i, ok := s.instances[form.Get("InstanceId")]
+	if !ok {
+		return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", form.Get("InstanceId"))
+	}
+	if t := form.Get("InstanceType.Value"); t != "" {
+		if i.State != "stopped" {
+			return nil, errorf("IncorrectInstanceState", "The instance '%s' is not in the 'stopped' state.", i.InstanceID)
+		}
+		i.InstanceType = t
+	}
+	return nil, nil
+}
+
+func (s *Server) describeVolumes(form url.Values) (interface{}, *apiError) {
+	var resp struct {
+		Volumes []*volume `xml:"volumeSet>item"`
+	}
+	for _, id := range list(form, "VolumeId") {
+		v, ok := s.volumes[id]
+		if !ok {
+			return nil, errorf("InvalidVolume.NotFound", "The volume '%s' does not exist.", id)
+		}
+		resp.Volumes = append(resp.Volumes, v)
+	}
+	return &resp, nil
+}
+
+func (s *Server) modifyVolume(form url.Values) (interface{}, *apiError) {
+	v, ok := s.volumes[form.Get("VolumeId")]
+	if !ok {
+		return nil, errorf("InvalidVolume.NotFound", "The volume '%s' does not exist.", form.Get("VolumeId"))
+	}
+	size, _ := strconv.Atoi(form.Get("Size"))
+	if size < v.Size {
+		return nil, errorf("InvalidParameterValue", "New size cannot be smaller than existing size")
+	}
+	v.Size = size
+	return nil, nil
+}
+
+func (s *Server) describeSpotRequests(form url.Values) (interface{}, *apiError) {
+	var resp struct {
+		Requests []*spotRequest `xml:"spotInstanceRequestSet>item"`
+	}
+	fs := filters(form)
+	for _, r := range s.spot {
+		if match(fs, r.Tags, map[string]string{"state": r.State}) {
+			resp.Requests = append(resp.Requests, r)
+		}
+	}
+	return &resp, nil
+}
+
+func (s *Server) cancelSpotRequests(form url.Values) (interface{}, *apiError) {
+	for _, id := range list(form, "SpotInstanceRequestId") {
+		if r, ok := s.spot[id]; ok {
+			r.State = "cancelled"
+		}
+	}
+	return nil, nil
+}
+
+func writeError(w http.ResponseWriter, e *apiError) {
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.WriteHeader(e.status)
+	fmt.Fprint(w, "<Response><Errors><Error><Code>")
+	xml.EscapeText(w, []byte(e.code))
+	fmt.Fprint(w, "</Code><Message>")
+	xml.EscapeText(w, []byte(e.message))
+	fmt.Fprint(w, "</Message></Error></Errors><RequestID>awstest</RequestID></Response>")
+}
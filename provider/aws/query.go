@@ -0,0 +1,153 @@
+package aws
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/darkowlzz/clouddev/internal/sigv4"
+)
+
+// apiVersion is the version of the EC2 query API.
+const apiVersion = "2016-11-15"
+
+// apiError is an error returned by the EC2 API.
+type apiError struct {
+	StatusCode int
+	Action     string
+	Code       string
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Action, e.Code, e.Message)
+}
+
+// hasCode returns true if the error is an API error with one of the codes.
+func hasCode(err error, codes ...string) bool {
+	e, ok := err.(*apiError)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// call calls an action of the EC2 query API with the parameters and decodes
+// the XML response into out, unless nil.
+func (p *Provider) call(ctx context.Context, action string, params url.Values, out interface{}) error {
+	creds, err := sigv4.EnvCredentials()
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("Action", action)
+	form.Set("Version", apiVersion)
+	body := form.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signer := &sigv4.Signer{Credentials: creds, Region: p.region, Service: "ec2"}
+	signer.Sign(req, sigv4.PayloadHash([]byte(body)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Errors []struct {
+				Code    string `xml:"Code"`
+				Message string `xml:"Message"`
+			} `xml:"Errors>Error"`
+		}
+		apiErr := &apiError{StatusCode: resp.StatusCode, Action: action, Code: resp.Status}
+		if xml.Unmarshal(data, &e) == nil && len(e.Errors) > 0 {
+			apiErr.Code, apiErr.Message = e.Errors[0].Code, e.Errors[0].Message
+		}
+		return apiErr
+	}
+	if out != nil {
+		if err := xml.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s: invalid response: %w", action, err)
+		}
+	}
+	return nil
+}
+
+// params are the parameters of an API call, with helpers for the list and
+// structure parameters.
+type params url.Values
+
+func (p params) set(key, value string) params {
+	url.Values(p).Set(key, value)
+	return p
+}
+
+// list sets the list parameter prefix.1, prefix.2, ...
+func (p params) list(prefix string, values ...string) params {
+	for i, v := range values {
+		p.set(prefix+"."+strconv.Itoa(i+1), v)
+	}
+	return p
+}
+
+// filter adds the filter with the values.
+func (p params) filter(name string, values ...string) params {
+	n := 1
+	for url.Values(p).Get("Filter."+strconv.Itoa(n)+".Name") != "" {
+		n++
+	}
+	prefix := "Filter." + strconv.Itoa(n)
+	p.set(prefix+".Name", name)
+	return p.list(prefix+".Value", values...)
+}
+
+// tags adds the tag specification of a resource of the environment.
+func (p params) tags(resourceType, env string) params {
+	n := 1
+	for url.Values(p).Get("TagSpecification."+strconv.Itoa(n)+".ResourceType") != "" {
+		n++
+	}
+	prefix := "TagSpecification." + strconv.Itoa(n)
+	return p.set(prefix+".ResourceType", resourceType).
+		set(prefix+".Tag.1.Key", envTag).
+		set(prefix+".Tag.1.Value", env).
+		set(prefix+".Tag.2.Key", "Name").
+		set(prefix+".Tag.2.Value", resourceName(env))
+}
+
+// tag is a resource tag.
+type tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+func tagValue(tags []tag, key string) string {
+	for _, t := range tags {
+		if t.Key == key {
+			return t.Value
+		}
+	}
+	return ""
+}
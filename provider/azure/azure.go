@@ -0,0 +1,704 @@
+// Package azure implements a provider that provisions environments on Azure
+// virtual machines, through the Azure Resource Manager API.
+//
+// Every environment gets its own resource group, deleted with everything in
+// it by clean. See credentials for how the API is authenticated.
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/internal/rest"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "azure"
+
+const (
+	defaultAPIURL   = "https://management.azure.com"
+	defaultVMSize   = "Standard_B2s"
+	defaultImage    = "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest"
+	defaultDiskType = "StandardSSD_LRS"
+	// tag marks the resources created by clouddev, its value is the
+	// environment name.
+	tag = "clouddev"
+	// imageTag is the VM tag recording the configured image.
+	imageTag = "clouddev-image"
+)
+
+// The API versions of the resource providers.
+const (
+	resourcesVersion = "2021-04-01"
+	networkVersion   = "2023-04-01"
+	computeVersion   = "2023-03-01"
+	diskVersion      = "2023-04-02"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the Azure provider_options.
+type options struct {
+	// SubscriptionID is the subscription of the environment, the
+	// AZURE_SUBSCRIPTION_ID environment variable if empty.
+	SubscriptionID string `mapstructure:"subscription_id"`
+	// ResourceGroup is the resource group created for the environment,
+	// clouddev-<name> if empty.
+	ResourceGroup string `mapstructure:"resource_group"`
+	// AddressSpace is the address space of the virtual network and Subnet
+	// the prefix of its subnet.
+	AddressSpace string `mapstructure:"address_space"`
+	Subnet       string `mapstructure:"subnet"`
+	// APIURL and LoginURL are the URLs of the Resource Manager API and of
+	// the Azure AD token endpoint.
+	APIURL   string `mapstructure:"api_url"`
+	LoginURL string `mapstructure:"login_url"`
+}
+
+// Provider provisions Azure virtual machines.
+type Provider struct {
+	cfg  *config.Config
+	opts options
+	api  *rest.Client
+	// PollInterval is the interval between the checks of the progress of
+	// long running operations.
+	PollInterval time.Duration
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns an Azure provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	if opts.SubscriptionID == "" {
+		opts.SubscriptionID = os.Getenv("AZURE_SUBSCRIPTION_ID")
+	}
+	if opts.ResourceGroup == "" {
+		opts.ResourceGroup = "clouddev-" + c.Name
+	}
+	if opts.AddressSpace == "" {
+		opts.AddressSpace = "10.0.0.0/16"
+	}
+	if opts.Subnet == "" {
+		opts.Subnet = "10.0.0.0/24"
+	}
+	if opts.APIURL == "" {
+		opts.APIURL = defaultAPIURL
+	}
+	if opts.LoginURL == "" {
+		opts.LoginURL = defaultLoginURL
+	}
+	return &Provider{
+		cfg:  c,
+		opts: opts,
+		api: &rest.Client{
+			BaseURL:      opts.APIURL,
+			Authorize:    (&credentials{loginURL: opts.LoginURL}).authorize,
+			ErrorMessage: errorMessage,
+		},
+		PollInterval: 5 * time.Second,
+	}
+}
+
+func errorMessage(body []byte) string {
+	var e struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &e)
+	if e.Error.Message == "" {
+		return ""
+	}
+	return e.Error.Code + ": " + e.Error.Message
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	if c.Region == "" {
+		errs = append(errs, &config.FieldError{Path: "region", Message: "is required, the location, e.g. westeurope"})
+	}
+	if c.Image != "" && len(strings.Split(c.Image, ":")) != 4 {
+		errs = append(errs, &config.FieldError{Path: "image", Message: "must be an image URN, publisher:offer:sku:version"})
+	}
+	return errs
+}
+
+func (p *Provider) vmSize(c *config.Config) string {
+	if c.MachineType == "" {
+		return defaultVMSize
+	}
+	return c.MachineType
+}
+
+func (p *Provider) image(c *config.Config) string {
+	if c.Image == "" {
+		return defaultImage
+	}
+	return c.Image
+}
+
+func (p *Provider) diskType(c *config.Config) string {
+	if c.Disk.Type == "" {
+		return defaultDiskType
+	}
+	return c.Disk.Type
+}
+
+// groupID returns the ID of the resource group of the environment.
+func (p *Provider) groupID() (string, error) {
+	if p.opts.SubscriptionID == "" {
+		return "", errors.New("no Azure subscription, set provider_options.subscription_id or AZURE_SUBSCRIPTION_ID")
+	}
+	return "/subscriptions/" + url.PathEscape(p.opts.SubscriptionID) + "/resourceGroups/" + url.PathEscape(p.opts.ResourceGroup), nil
+}
+
+// resourceID returns the ID of a resource of the resource group.
+func resourceID(groupID, resourceType, name string) string {
+	return groupID + "/providers/" + resourceType + "/" + url.PathEscape(name)
+}
+
+func withVersion(id, version string) string {
+	return id + "?api-version=" + version
+}
+
+// do sends a request and waits for the long running operation it starts,
+// if any, to complete. out is the response to the request, not the final
+// state of the resource.
+func (p *Provider) do(ctx context.Context, method, path string, in, out interface{}) error {
+	resp, err := p.api.DoResponse(ctx, method, path, in, out)
+	if err != nil {
+		return err
+	}
+	if op := resp.Header.Get("Azure-AsyncOperation"); op != "" {
+		return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			var status struct {
+				Status string `json:"status"`
+				Error  struct {
+					Code    string `json:"code"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if err := p.api.Do(ctx, http.MethodGet, op, nil, &status); err != nil {
+				return false, err
+			}
+			switch status.Status {
+			case "Succeeded":
+				return true, nil
+			case "Failed", "Canceled":
+				return false, fmt.Errorf("%s %s: %s: %s: %s", method, resp.Request.URL.Path, status.Status, status.Error.Code, status.Error.Message)
+			}
+			return false, nil
+		})
+	}
+	if location := resp.Header.Get("Location"); resp.StatusCode == http.StatusAccepted && location != "" {
+		return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			resp, err := p.api.DoResponse(ctx, http.MethodGet, location, nil, nil)
+			if err != nil {
+				return false, err
+			}
+			return resp.StatusCode != http.StatusAccepted, nil
+		})
+	}
+	return nil
+}
+
+// vm is a virtual machine as returned by the API.
+type vm struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Location   string            `json:"location"`
+	Tags       map[string]string `json:"tags"`
+	Properties struct {
+		HardwareProfile struct {
+			VMSize string `json:"vmSize"`
+		} `json:"hardwareProfile"`
+		StorageProfile struct {
+			OSDisk struct {
+				DiskSizeGB  int `json:"diskSizeGB"`
+				ManagedDisk struct {
+					ID string `json:"id"`
+				} `json:"managedDisk"`
+			} `json:"osDisk"`
+		} `json:"storageProfile"`
+		InstanceView *struct {
+			Statuses []struct {
+				Code string `json:"code"`
+			} `json:"statuses"`
+		} `json:"instanceView"`
+		TimeCreated time.Time `json:"timeCreated"`
+	} `json:"properties"`
+}
+
+func (v *vm) machine() *provider.Machine {
+	groupID := v.ID[:strings.Index(strings.ToLower(v.ID), "/providers/")]
+	m := &provider.Machine{
+		ID:     v.ID,
+		Name:   v.Name,
+		Status: provider.StatusUnknown,
+		Resources: map[string]string{
+			provider.ResourceGroup:    groupID,
+			provider.ResourceInstance: v.ID,
+		},
+		CreatedAt: v.Properties.TimeCreated,
+	}
+	if disk := v.Properties.StorageProfile.OSDisk.ManagedDisk.ID; disk != "" {
+		m.Resources[provider.ResourceDisk] = disk
+	}
+	if v.Properties.InstanceView != nil {
+		m.Status = provider.StatusPending
+		for _, s := range v.Properties.InstanceView.Statuses {
+			if strings.HasPrefix(s.Code, "PowerState/") {
+				m.Status = status(strings.TrimPrefix(s.Code, "PowerState/"))
+			}
+		}
+	}
+	return m
+}
+
+func status(powerState string) provider.Status {
+	switch powerState {
+	case "starting":
+		return provider.StatusPending
+	case "running":
+		return provider.StatusRunning
+	case "stopping", "stopped", "deallocating", "deallocated":
+		return provider.StatusStopped
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// UserDataLimit implements provider.UserDataLimiter. The base64 encoded
+// custom data is limited to 64 KiB.
+func (p *Provider) UserDataLimit() int {
+	return 49152
+}
+
+// MachineSizes implements provider.Sizer with the burstable and general
+// purpose VM sizes.
+func (p *Provider) MachineSizes() []provider.MachineSize {
+	return []provider.MachineSize{
+		{Name: "Standard_B1s", CPUs: 1, MemoryMB: 1024},
+		{Name: "Standard_B2s", CPUs: 2, MemoryMB: 4096},
+		{Name: "Standard_D2s_v5", CPUs: 2, MemoryMB: 8192},
+		{Name: "Standard_D4s_v5", CPUs: 4, MemoryMB: 16384},
+		{Name: "Standard_D8s_v5", CPUs: 8, MemoryMB: 32768},
+		{Name: "Standard_D16s_v5", CPUs: 16, MemoryMB: 65536},
+		{Name: "Standard_D32s_v5", CPUs: 32, MemoryMB: 131072},
+		{Name: "Standard_D48s_v5", CPUs: 48, MemoryMB: 196608},
+		{Name: "Standard_D64s_v5", CPUs: 64, MemoryMB: 262144},
+	}
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}, CreatedAt: time.Now().UTC()}
+	groupID, err := p.groupID()
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{tag: c.Name}
+
+	if err := p.do(ctx, http.MethodPut, withVersion(groupID, resourcesVersion), map[string]interface{}{
+		"location": c.Region,
+		"tags":     tags,
+	}, nil); err != nil {
+		return nil, fmt.Errorf("failed to create resource group: %w", err)
+	}
+	m.Resources[provider.ResourceGroup] = groupID
+
+	nsgID := resourceID(groupID, "Microsoft.Network/networkSecurityGroups", c.Name+"-nsg")
+	if err := p.do(ctx, http.MethodPut, withVersion(nsgID, networkVersion), p.securityGroup(c, tags), nil); err != nil {
+		return m, fmt.Errorf("failed to create network security group: %w", err)
+	}
+	m.Resources[provider.ResourceFirewall] = nsgID
+
+	vnetID := resourceID(groupID, "Microsoft.Network/virtualNetworks", c.Name+"-vnet")
+	if err := p.do(ctx, http.MethodPut, withVersion(vnetID, networkVersion), map[string]interface{}{
+		"location": c.Region,
+		"tags":     tags,
+		"properties": map[string]interface{}{
+			"addressSpace": map[string]interface{}{"addressPrefixes": []string{p.opts.AddressSpace}},
+			"subnets": []interface{}{map[string]interface{}{
+				"name": "default",
+				"properties": map[string]interface{}{
+					"addressPrefix":        p.opts.Subnet,
+					"networkSecurityGroup": map[string]string{"id": nsgID},
+				},
+			}},
+		},
+	}, nil); err != nil {
+		return m, fmt.Errorf("failed to create virtual network: %w", err)
+	}
+
+	ipID := resourceID(groupID, "Microsoft.Network/publicIPAddresses", c.Name+"-ip")
+	if err := p.do(ctx, http.MethodPut, withVersion(ipID, networkVersion), map[string]interface{}{
+		"location":   c.Region,
+		"tags":       tags,
+		"sku":        map[string]string{"name": "Standard"},
+		"properties": map[string]string{"publicIPAllocationMethod": "Static"},
+	}, nil); err != nil {
+		return m, fmt.Errorf("failed to create public IP address: %w", err)
+	}
+	m.Resources[provider.ResourceIP] = ipID
+
+	nicID := resourceID(groupID, "Microsoft.Network/networkInterfaces", c.Name+"-nic")
+	if err := p.do(ctx, http.MethodPut, withVersion(nicID, networkVersion), map[string]interface{}{
+		"location": c.Region,
+		"tags":     tags,
+		"properties": map[string]interface{}{
+			"ipConfigurations": []interface{}{map[string]interface{}{
+				"name": "ipconfig",
+				"properties": map[string]interface{}{
+					"subnet":          map[string]string{"id": vnetID + "/subnets/default"},
+					"publicIPAddress": map[string]string{"id": ipID},
+				},
+			}},
+		},
+	}, nil); err != nil {
+		return m, fmt.Errorf("failed to create network interface: %w", err)
+	}
+
+	urn := strings.Split(p.image(c), ":")
+	vmID := resourceID(groupID, "Microsoft.Compute/virtualMachines", c.Name)
+	vmTags := map[string]string{tag: c.Name, imageTag: p.image(c)}
+	if err := p.do(ctx, http.MethodPut, withVersion(vmID, computeVersion), map[string]interface{}{
+		"location": c.Region,
+		"tags":     vmTags,
+		"properties": map[string]interface{}{
+			"hardwareProfile": map[string]string{"vmSize": p.vmSize(c)},
+			"storageProfile": map[string]interface{}{
+				"imageReference": map[string]string{
+					"publisher": urn[0],
+					"offer":     urn[1],
+					"sku":       urn[2],
+					"version":   urn[3],
+				},
+				"osDisk": map[string]interface{}{
+					"createOption": "FromImage",
+					"diskSizeGB":   c.Disk.SizeGB,
+					"managedDisk":  map[string]string{"storageAccountType": p.diskType(c)},
+					"deleteOption": "Delete",
+				},
+			},
+			"osProfile": map[string]interface{}{
+				"computerName":  c.Name,
+				"adminUsername": c.SSH.User,
+				"customData":    base64.StdEncoding.EncodeToString(spec.UserData),
+				"linuxConfiguration": map[string]interface{}{
+					"disablePasswordAuthentication": true,
+					"ssh": map[string]interface{}{
+						"publicKeys": []interface{}{map[string]string{
+							"path":    "/home/" + c.SSH.User + "/.ssh/authorized_keys",
+							"keyData": spec.SSHPublicKey,
+						}},
+					},
+				},
+			},
+			"networkProfile": map[string]interface{}{
+				"networkInterfaces": []interface{}{map[string]string{"id": nicID}},
+			},
+			// The serial console log, with the host keys cloud-init
+			// prints, is kept in a managed storage account.
+			"diagnosticsProfile": map[string]interface{}{
+				"bootDiagnostics": map[string]bool{"enabled": true},
+			},
+		},
+	}, nil); err != nil {
+		m.ID = vmID
+		m.Resources[provider.ResourceInstance] = vmID
+		return m, fmt.Errorf("failed to create virtual machine: %w", err)
+	}
+	m.ID = vmID
+	m.Resources[provider.ResourceInstance] = vmID
+
+	got, err := p.Get(ctx, vmID)
+	if err != nil {
+		return m, err
+	}
+	for k, v := range m.Resources {
+		got.Resources[k] = v
+	}
+	return got, nil
+}
+
+// securityGroup returns the network security group opening the ports.
+func (p *Provider) securityGroup(c *config.Config, tags map[string]string) map[string]interface{} {
+	rules := make([]interface{}, len(c.Ports))
+	for i, port := range c.Ports {
+		rules[i] = map[string]interface{}{
+			"name": "port-" + strconv.Itoa(port),
+			"properties": map[string]interface{}{
+				"protocol":                 "Tcp",
+				"sourcePortRange":          "*",
+				"destinationPortRange":     strconv.Itoa(port),
+				"sourceAddressPrefix":      "*",
+				"destinationAddressPrefix": "*",
+				"access":                   "Allow",
+				"priority":                 1000 + i,
+				"direction":                "Inbound",
+			},
+		}
+	}
+	return map[string]interface{}{
+		"location":   c.Region,
+		"tags":       tags,
+		"properties": map[string]interface{}{"securityRules": rules},
+	}
+}
+
+// isVM returns true if the ID is the ID of a virtual machine.
+func isVM(id string) bool {
+	return strings.HasPrefix(id, "/subscriptions/") &&
+		strings.Contains(strings.ToLower(id), "/providers/microsoft.compute/virtualmachines/")
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	if !isVM(id) {
+		return nil, provider.ErrNotFound
+	}
+	var v vm
+	if err := p.api.Do(ctx, http.MethodGet, withVersion(id, computeVersion)+"&$expand=instanceView", nil, &v); err != nil {
+		if rest.IsNotFound(err) {
+			return nil, provider.ErrNotFound
+		}
+		return nil, err
+	}
+	m := v.machine()
+
+	ipID := resourceID(m.Resources[provider.ResourceGroup], "Microsoft.Network/publicIPAddresses", v.Name+"-ip")
+	var ip struct {
+		Properties struct {
+			IPAddress string `json:"ipAddress"`
+		} `json:"properties"`
+	}
+	if err := p.api.Do(ctx, http.MethodGet, withVersion(ipID, networkVersion), nil, &ip); err != nil && !rest.IsNotFound(err) {
+		return nil, err
+	}
+	m.Address = ip.Properties.IPAddress
+	return m, nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	return p.vmAction(ctx, id, "start")
+}
+
+// Stop implements provider.Provider. The machine is deallocated, so that it
+// isn't billed while stopped.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	return p.vmAction(ctx, id, "deallocate")
+}
+
+func (p *Provider) vmAction(ctx context.Context, id, action string) error {
+	if !isVM(id) {
+		return provider.ErrNotFound
+	}
+	err := p.do(ctx, http.MethodPost, withVersion(id+"/"+action, computeVersion), nil, nil)
+	if rest.IsNotFound(err) {
+		return provider.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("virtual machine %s %s: %w", id, action, err)
+	}
+	return nil
+}
+
+// ConsoleOutput implements provider.ConsoleReader with the serial console
+// log of the boot diagnostics.
+func (p *Provider) ConsoleOutput(ctx context.Context, id string) (string, error) {
+	if !isVM(id) {
+		return "", provider.ErrNotFound
+	}
+	var diag struct {
+		SerialConsoleLogBlobURI string `json:"serialConsoleLogBlobUri"`
+	}
+	err := p.api.Do(ctx, http.MethodPost, withVersion(id+"/retrieveBootDiagnosticsData", computeVersion)+"&sasUriExpirationTimeInMinutes=5", nil, &diag)
+	if rest.IsNotFound(err) {
+		return "", provider.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if diag.SerialConsoleLogBlobURI == "" {
+		return "", nil
+	}
+	// The blob is read with its SAS URI, the access token of the API
+	// isn't valid for the storage account.
+	var out []byte
+	blob := &rest.Client{HTTPClient: p.api.HTTPClient}
+	if err := blob.Do(ctx, http.MethodGet, diag.SerialConsoleLogBlobURI, nil, &out); err != nil && !rest.IsNotFound(err) {
+		return "", fmt.Errorf("failed to read the serial console log of virtual machine %s: %w", id, err)
+	}
+	return string(out), nil
+}
+
+// Destroy implements provider.Provider. The resource group is deleted with
+// all its resources.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	groupID := m.Resources[provider.ResourceGroup]
+	if groupID == "" {
+		return nil
+	}
+	err := p.do(ctx, http.MethodDelete, withVersion(groupID, resourcesVersion), nil, nil)
+	if err != nil && !rest.IsNotFound(err) {
+		return fmt.Errorf("failed to delete resource group %s: %w", groupID, err)
+	}
+	return nil
+}
+
+// List implements provider.Provider. The status of the listed machines is
+// unknown.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	if p.opts.SubscriptionID == "" {
+		return nil, errors.New("no Azure subscription, set provider_options.subscription_id or AZURE_SUBSCRIPTION_ID")
+	}
+	var machines []*provider.Machine
+	path := withVersion("/subscriptions/"+url.PathEscape(p.opts.SubscriptionID)+"/providers/Microsoft.Compute/virtualMachines", computeVersion)
+	for path != "" {
+		var resp struct {
+			Value    []vm   `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if err := p.api.Do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+		for i := range resp.Value {
+			if _, ok := resp.Value[i].Tags[tag]; ok {
+				machines = append(machines, resp.Value[i].machine())
+			}
+		}
+		path = resp.NextLink
+	}
+	return machines, nil
+}
+
+// Plan implements provider.Provider. The VM size, the ports and growing the
+// OS disk are updated in place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	if !isVM(m.ID) {
+		return nil, provider.ErrNotFound
+	}
+	var v vm
+	if err := p.api.Do(ctx, http.MethodGet, withVersion(m.ID, computeVersion), nil, &v); err != nil {
+		if rest.IsNotFound(err) {
+			return nil, provider.ErrNotFound
+		}
+		return nil, err
+	}
+
+	var changes []provider.Change
+	if !strings.EqualFold(strings.ReplaceAll(c.Region, " ", ""), v.Location) {
+		changes = append(changes, provider.Change{Field: "region", Old: v.Location, New: c.Region, Replace: true})
+	}
+	if old := v.Tags[imageTag]; old != p.image(c) {
+		changes = append(changes, provider.Change{Field: "image", Old: old, New: p.image(c), Replace: true})
+	}
+	if size := v.Properties.HardwareProfile.VMSize; size != p.vmSize(c) {
+		changes = append(changes, provider.Change{Field: "machine_type", Old: size, New: p.vmSize(c)})
+	}
+	if size := v.Properties.StorageProfile.OSDisk.DiskSizeGB; size != c.Disk.SizeGB {
+		changes = append(changes, provider.Change{
+			Field:   "disk.size_gb",
+			Old:     strconv.Itoa(size),
+			New:     strconv.Itoa(c.Disk.SizeGB),
+			Replace: c.Disk.SizeGB < size,
+		})
+	}
+
+	if id := m.Resources[provider.ResourceFirewall]; id != "" {
+		var nsg struct {
+			Properties struct {
+				SecurityRules []struct {
+					Properties struct {
+						DestinationPortRange string `json:"destinationPortRange"`
+						Direction            string `json:"direction"`
+						Access               string `json:"access"`
+					} `json:"properties"`
+				} `json:"securityRules"`
+			} `json:"properties"`
+		}
+		if err := p.api.Do(ctx, http.MethodGet, withVersion(id, networkVersion), nil, &nsg); err != nil && !rest.IsNotFound(err) {
+			return nil, err
+		}
+		var ports []int
+		for _, r := range nsg.Properties.SecurityRules {
+			if port, err := strconv.Atoi(r.Properties.DestinationPortRange); err == nil && r.Properties.Direction == "Inbound" && r.Properties.Access == "Allow" {
+				ports = append(ports, port)
+			}
+		}
+		if old, new := provider.FormatPorts(ports), provider.FormatPorts(c.Ports); old != new {
+			changes = append(changes, provider.Change{Field: "ports", Old: old, New: new})
+		}
+	}
+	return changes, nil
+}
+
+// Update implements provider.Updater.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	c := spec.Config
+	for _, ch := range changes {
+		switch ch.Field {
+		case "machine_type":
+			// Azure restarts the machine to resize it.
+			if err := p.do(ctx, http.MethodPatch, withVersion(m.ID, computeVersion), map[string]interface{}{
+				"properties": map[string]interface{}{"hardwareProfile": map[string]string{"vmSize": ch.New}},
+			}, nil); err != nil {
+				return fmt.Errorf("failed to resize virtual machine %s: %w", m.ID, err)
+			}
+		case "disk.size_gb":
+			// Attached OS disks are resized deallocated.
+			if m.Status == provider.StatusRunning {
+				if err := p.Stop(ctx, m.ID); err != nil {
+					return err
+				}
+			}
+			disk := m.Resources[provider.ResourceDisk]
+			if err := p.do(ctx, http.MethodPatch, withVersion(disk, diskVersion), map[string]interface{}{
+				"properties": map[string]int{"diskSizeGB": c.Disk.SizeGB},
+			}, nil); err != nil {
+				return fmt.Errorf("failed to resize disk %s: %w", disk, err)
+			}
+			if m.Status == provider.StatusRunning {
+				if err := p.Start(ctx, m.ID); err != nil {
+					return err
+				}
+			}
+		case "ports":
+			id := m.Resources[provider.ResourceFirewall]
+			if err := p.do(ctx, http.MethodPut, withVersion(id, networkVersion), p.securityGroup(c, map[string]string{tag: c.Name}), nil); err != nil {
+				return fmt.Errorf("failed to update network security group %s: %w", id, err)
+			}
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package azure_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/azure"
+	"github.com/darkowlzz/clouddev/provider/azure/azuretest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// newTestProvider returns a provider of the spec against an API stand-in.
+func newTestProvider(t *testing.T, s *azuretest.Server, spec *provider.Spec) *azure.Provider {
+	t.Helper()
+	t.Setenv("AZURE_ACCESS_TOKEN", azuretest.Token)
+	spec.Config.Region = "westeurope"
+	spec.Config.Image = "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest"
+	spec.Config.ProviderOptions = map[string]interface{}{
+		"subscription_id": "00000000-0000-0000-0000-000000000000",
+		"api_url":         s.URL,
+	}
+	p := azure.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *azuretest.Server {
+	s := azuretest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// intercept serves the requests for which fn returns true with fn instead
+// of the stand-in. It returns the number of polls of the operations.
+func intercept(s *azuretest.Server, fn func(w http.ResponseWriter, r *http.Request) bool) func() int {
+	var mu sync.Mutex
+	var polls int
+	handler := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/operations/") {
+			mu.Lock()
+			polls++
+			mu.Unlock()
+		}
+		if fn != nil && fn(w, r) {
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return polls
+	}
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(azure.Name)
+	providertest.Run(t, newTestProvider(t, s, spec), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after the suite", n)
+	}
+}
+
+func TestAsyncOperationsArePolledUntilDone(t *testing.T) {
+	s := newServer(t)
+	polls := intercept(s, nil)
+	spec := providertest.Spec(azure.Name)
+	p := newTestProvider(t, s, spec)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer p.Destroy(ctx, m)
+
+	// The stand-in reports the operations in progress on their first poll.
+	before := polls()
+	if err := p.Stop(ctx, m.ID); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if n := polls() - before; n != 2 {
+		t.Errorf("Stop() polled its operation %d times, want 2", n)
+	}
+	got, err := p.Get(ctx, m.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Status != provider.StatusStopped {
+		t.Errorf("Get() status = %q, want %q", got.Status, provider.StatusStopped)
+	}
+}
+
+func TestFailedAsyncOperationIsReported(t *testing.T) {
+	s := newServer(t)
+	intercept(s, func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasPrefix(r.URL.Path, "/operations/") {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "Failed", "error": {"code": "QuotaExceeded", "message": "Operation could not be completed as it results in exceeding approved quota."}}`))
+		return true
+	})
+	spec := providertest.Spec(azure.Name)
+	p := newTestProvider(t, s, spec)
+
+	_, err := p.Create(context.Background(), spec)
+	if err == nil || !strings.Contains(err.Error(), "Failed: QuotaExceeded: Operation could not be completed") {
+		t.Errorf("Create() error = %v, want the operation error", err)
+	}
+}
+
+func TestDestroyDeletesResourceGroup(t *testing.T) {
+	s := newServer(t)
+	intercept(s, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/virtualMachines/") {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error": {"code": "SkuNotAvailable", "message": "The requested size is not available."}}`))
+		return true
+	})
+	spec := providertest.Spec(azure.Name)
+	p := newTestProvider(t, s, spec)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err == nil {
+		t.Fatal("Create() error = nil, want the VM error")
+	}
+	if s.Resources() == 0 {
+		t.Fatal("the failed Create() created no resources")
+	}
+	want := "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/clouddev-conformance"
+	if got := m.Resources[provider.ResourceGroup]; got != want {
+		t.Fatalf("Create() resource group = %q, want %q", got, want)
+	}
+
+	// Only the resource group is recorded, its resources are deleted
+	// with it.
+	if err := p.Destroy(ctx, &provider.Machine{Name: m.Name, Resources: map[string]string{provider.ResourceGroup: want}}); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy()", n)
+	}
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Errorf("Destroy() of a deleted resource group error = %v", err)
+	}
+}
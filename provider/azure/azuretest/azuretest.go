@@ -0,0 +1,331 @@
+// Package azuretest implements an in-memory stand-in for the Azure Resource
+// Manager API for testing the Azure provider.
+//
+// The stand-in implements the resources and actions used by the provider.
+// Long running operations are reported in progress once, then succeeded.
+// The boot diagnostics of the virtual machines have the host keys in their
+// serial console log.
+package azuretest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// Token is the access token accepted by the stand-in.
+const Token = "azuretest-token"
+
+// Server is an ARM API stand-in.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	nextID int
+	// resources are keyed by their lowercase ID.
+	resources  map[string]map[string]interface{}
+	operations map[string]int
+}
+
+// NewServer starts a stand-in. The caller must close it.
+func NewServer() *Server {
+	s := &Server{
+		resources:  map[string]map[string]interface{}{},
+		operations: map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Resources returns the number of resources, including the resource
+// groups, that exist, to check for leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.resources)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/bootdiagnostics/") {
+		s.serveBlob(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		writeError(w, http.StatusUnauthorized, "AuthenticationFailed", "Authentication failed.")
+		return
+	}
+	if r.URL.Query().Get("api-version") == "" {
+		writeError(w, http.StatusBadRequest, "MissingApiVersionParameter", "The api-version query parameter (?api-version=) is required for all requests.")
+		return
+	}
+	var in map[string]interface{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.URL.Path
+	key := strings.ToLower(id)
+	if strings.HasPrefix(key, "/operations/") {
+		s.serveOperation(w, key)
+		return
+	}
+	if strings.HasSuffix(key, "/providers/microsoft.compute/virtualmachines") && r.Method == http.MethodGet {
+		value := []interface{}{}
+		for k, res := range s.resources {
+			if strings.Contains(k, "/providers/microsoft.compute/virtualmachines/") {
+				value = append(value, res)
+			}
+		}
+		write(w, http.StatusOK, map[string]interface{}{"value": value})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if parent := parentGroup(key); parent != "" && s.resources[parent] == nil {
+			writeError(w, http.StatusNotFound, "ResourceGroupNotFound", "Resource group '"+path.Base(parent)+"' could not be found.")
+			return
+		}
+		status := http.StatusCreated
+		if s.resources[key] != nil {
+			status = http.StatusOK
+		}
+		if err := s.put(id, key, in); err != "" {
+			writeError(w, http.StatusBadRequest, "InvalidResourceReference", err)
+			return
+		}
+		s.async(w, r)
+		write(w, status, s.resources[key])
+	case http.MethodGet:
+		res, ok := s.resources[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "ResourceNotFound", "The Resource '"+id+"' was not found.")
+			return
+		}
+		if r.URL.Query().Get("$expand") != "instanceView" {
+			res = without(res, "instanceView")
+		}
+		write(w, http.StatusOK, res)
+	case http.MethodPatch:
+		res, ok := s.resources[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "ResourceNotFound", "The Resource '"+id+"' was not found.")
+			return
+		}
+		if strings.Contains(key, "/providers/microsoft.compute/disks/") {
+			if err := s.resizeDisk(res, in); err != "" {
+				writeError(w, http.StatusConflict, "OperationNotAllowed", err)
+				return
+			}
+		}
+		merge(res, in)
+		s.async(w, r)
+		write(w, http.StatusOK, res)
+	case http.MethodDelete:
+		if _, ok := s.resources[key]; !ok {
+			writeError(w, http.StatusNotFound, "ResourceNotFound", "The Resource '"+id+"' was not found.")
+			return
+		}
+		for k := range s.resources {
+			if k == key || strings.HasPrefix(k, key+"/") {
+				delete(s.resources, k)
+			}
+		}
+		// Resource groups are deleted with a Location polled operation.
+		s.nextID++
+		op := fmt.Sprintf("/operations/%d", s.nextID)
+		s.operations[op] = 0
+		w.Header().Set("Location", s.URL+op+"?api-version=2021-04-01&location=1")
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPost:
+		action := path.Base(key)
+		vm, ok := s.resources[path.Dir(key)]
+		if !ok {
+			writeError(w, http.StatusNotFound, "ResourceNotFound", "The Resource '"+path.Dir(id)+"' was not found.")
+			return
+		}
+		switch action {
+		case "start":
+			setPowerState(vm, "running")
+		case "deallocate", "poweroff":
+			setPowerState(vm, "deallocated")
+		case "retrievebootdiagnosticsdata":
+			vmName := path.Base(path.Dir(key))
+			write(w, http.StatusOK, map[string]string{
+				"serialConsoleLogBlobUri": s.URL + "/bootdiagnostics/" + vmName + "/serialconsole.log?sig=azuretest",
+			})
+			return
+		default:
+			writeError(w, http.StatusBadRequest, "InvalidAction", action)
+			return
+		}
+		s.async(w, r)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// serveBlob serves the serial console log blobs of the boot diagnostics,
+// which are read with their SAS URI only.
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "" || r.URL.Query().Get("sig") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "AuthenticationFailed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, providertest.ConsoleOutput)
+}
+
+// parentGroup returns the resource group of a resource, "" for resource
+// groups.
+func parentGroup(key string) string {
+	i := strings.Index(key, "/providers/")
+	if i < 0 {
+		return ""
+	}
+	return key[:i]
+}
+
+func (s *Server) put(id, key string, in map[string]interface{}) string {
+	in["id"] = id
+	in["name"] = path.Base(id)
+	props, _ := in["properties"].(map[string]interface{})
+	if props == nil {
+		props = map[string]interface{}{}
+		in["properties"] = props
+	}
+	props["provisioningState"] = "Succeeded"
+	switch {
+	case strings.Contains(key, "/publicipaddresses/"):
+		s.nextID++
+		props["ipAddress"] = fmt.Sprintf("20.0.0.%d", s.nextID%250+1)
+	case strings.Contains(key, "/virtualmachines/"):
+		for _, nic := range props["networkProfile"].(map[string]interface{})["networkInterfaces"].([]interface{}) {
+			nicID := nic.(map[string]interface{})["id"].(string)
+			if s.resources[strings.ToLower(nicID)] == nil {
+				return "network interface " + nicID + " not found"
+			}
+		}
+		if s.resources[key] == nil {
+			props["timeCreated"] = time.Now().UTC().Format(time.RFC3339)
+			osDisk := props["storageProfile"].(map[string]interface{})["osDisk"].(map[string]interface{})
+			diskID := parentGroup(id) + "/providers/Microsoft.Compute/disks/" + path.Base(id) + "_OsDisk"
+			osDisk["managedDisk"].(map[string]interface{})["id"] = diskID
+			s.resources[strings.ToLower(diskID)] = map[string]interface{}{
+				"id":         diskID,
+				"properties": map[string]interface{}{"diskSizeGB": osDisk["diskSizeGB"], "vm": id},
+			}
+			setPowerState(in, "running")
+		}
+	}
+	s.resources[key] = in
+	return ""
+}
+
+// resizeDisk resizes the OS disk of a virtual machine, which must be
+// deallocated.
+func (s *Server) resizeDisk(disk, patch map[string]interface{}) string {
+	size := patch["properties"].(map[string]interface{})["diskSizeGB"]
+	vm := s.resources[strings.ToLower(disk["properties"].(map[string]interface{})["vm"].(string))]
+	if vm == nil {
+		return ""
+	}
+	props := vm["properties"].(map[string]interface{})
+	for _, st := range props["instanceView"].(map[string]interface{})["statuses"].([]interface{}) {
+		if st.(map[string]string)["code"] == "PowerState/running" {
+			return "Disks attached to running virtual machines can't be resized."
+		}
+	}
+	props["storageProfile"].(map[string]interface{})["osDisk"].(map[string]interface{})["diskSizeGB"] = size
+	return ""
+}
+
+// async starts a long running operation reported with the
+// Azure-AsyncOperation header.
+func (s *Server) async(w http.ResponseWriter, r *http.Request) {
+	s.nextID++
+	op := fmt.Sprintf("/operations/%d", s.nextID)
+	s.operations[op] = 0
+	w.Header().Set("Azure-AsyncOperation", s.URL+op+"?api-version="+r.URL.Query().Get("api-version"))
+}
+
+func (s *Server) serveOperation(w http.ResponseWriter, key string) {
+	polls, ok := s.operations[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound", "operation not found")
+		return
+	}
+	s.operations[key] = polls + 1
+	if polls == 0 {
+		// Location polled operations are in progress while accepted.
+		write(w, http.StatusAccepted, map[string]string{"status": "InProgress"})
+		return
+	}
+	write(w, http.StatusOK, map[string]string{"status": "Succeeded"})
+}
+
+func setPowerState(vm map[string]interface{}, state string) {
+	props := vm["properties"].(map[string]interface{})
+	props["instanceView"] = map[string]interface{}{
+		"statuses": []interface{}{
+			map[string]string{"code": "ProvisioningState/succeeded"},
+			map[string]string{"code": "PowerState/" + state},
+		},
+	}
+}
+
+// merge merges the patch into the resource, recursively.
+func merge(res, patch map[string]interface{}) {
+	for k, v := range patch {
+		if pm, ok := v.(map[string]interface{}); ok {
+			if rm, ok := res[k].(map[string]interface{}); ok {
+				merge(rm, pm)
+				continue
+			}
+		}
+		res[k] = v
+	}
+}
+
+// without returns a copy of the resource without the property.
+func without(res map[string]interface{}, property string) map[string]interface{} {
+	props, ok := res["properties"].(map[string]interface{})
+	if !ok || props[property] == nil {
+		return res
+	}
+	c := map[string]interface{}{}
+	for k, v := range res {
+		c[k] = v
+	}
+	cp := map[string]interface{}{}
+	for k, v := range props {
+		if k != property {
+			cp[k] = v
+		}
+	}
+	c["properties"] = cp
+	return c
+}
+
+func write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	write(w, status, map[string]interface{}{"error": map[string]string{"code": code, "message": message}})
+}
@@ -0,0 +1,630 @@
+// Package digitalocean implements a provider that provisions environments on
+// DigitalOcean droplets.
+//
+// The API token is read from the DIGITALOCEAN_TOKEN environment variable.
+package digitalocean
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/internal/rest"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "digitalocean"
+
+const (
+	defaultAPIURL = "https://api.digitalocean.com"
+	defaultSize   = "s-1vcpu-2gb"
+	defaultImage  = "ubuntu-22-04-x64"
+	// tag marks the droplets created by clouddev.
+	tag = "clouddev"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the DigitalOcean provider_options.
+type options struct {
+	// SSHKey is the ID or fingerprint of an existing SSH key to authorize
+	// instead of uploading the configured public key.
+	SSHKey string `mapstructure:"ssh_key"`
+	// VolumeSizeGB is the size of a block storage volume to attach to the
+	// droplet, none if zero.
+	VolumeSizeGB int `mapstructure:"volume_size_gb"`
+	// VPCUUID is the VPC of the droplet, the default VPC of the region if
+	// empty.
+	VPCUUID    string   `mapstructure:"vpc_uuid"`
+	Monitoring bool     `mapstructure:"monitoring"`
+	Tags       []string `mapstructure:"tags"`
+	// APIURL is the URL of the DigitalOcean API.
+	APIURL string `mapstructure:"api_url"`
+}
+
+// Provider provisions droplets.
+type Provider struct {
+	cfg  *config.Config
+	opts options
+	api  *rest.Client
+	// PollInterval is the interval between the checks of the progress of
+	// droplet actions.
+	PollInterval time.Duration
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns a DigitalOcean provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	if opts.APIURL == "" {
+		opts.APIURL = defaultAPIURL
+	}
+	return &Provider{
+		cfg:  c,
+		opts: opts,
+		api: &rest.Client{
+			BaseURL:      opts.APIURL,
+			Authorize:    authorize,
+			ErrorMessage: errorMessage,
+		},
+		PollInterval: 5 * time.Second,
+	}
+}
+
+func authorize(req *http.Request) error {
+	token := os.Getenv("DIGITALOCEAN_TOKEN")
+	if token == "" {
+		return errors.New("DIGITALOCEAN_TOKEN is not set")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func errorMessage(body []byte) string {
+	var e struct {
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(body, &e)
+	return e.Message
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	if c.Region == "" {
+		errs = append(errs, &config.FieldError{Path: "region", Message: "is required, e.g. nyc3"})
+	}
+	if opts.VolumeSizeGB < 0 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.volume_size_gb", Message: "must not be negative"})
+	}
+	if opts.APIURL != "" {
+		if _, err := url.Parse(opts.APIURL); err != nil {
+			errs = append(errs, &config.FieldError{Path: "provider_options.api_url", Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+func (p *Provider) size(c *config.Config) string {
+	if c.MachineType == "" {
+		return defaultSize
+	}
+	return c.MachineType
+}
+
+func (p *Provider) image(c *config.Config) string {
+	if c.Image == "" {
+		return defaultImage
+	}
+	return c.Image
+}
+
+// droplet is a droplet as returned by the API.
+type droplet struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	SizeSlug string `json:"size_slug"`
+	Image    struct {
+		ID   int    `json:"id"`
+		Slug string `json:"slug"`
+	} `json:"image"`
+	Region struct {
+		Slug string `json:"slug"`
+	} `json:"region"`
+	Networks struct {
+		V4 []struct {
+			IPAddress string `json:"ip_address"`
+			Type      string `json:"type"`
+		} `json:"v4"`
+	} `json:"networks"`
+	VolumeIDs []string  `json:"volume_ids"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (d *droplet) machine() *provider.Machine {
+	m := &provider.Machine{
+		ID:        strconv.Itoa(d.ID),
+		Name:      d.Name,
+		Status:    status(d.Status),
+		Resources: map[string]string{provider.ResourceInstance: strconv.Itoa(d.ID)},
+		CreatedAt: d.CreatedAt,
+	}
+	for _, n := range d.Networks.V4 {
+		if n.Type == "public" {
+			m.Address = n.IPAddress
+		}
+	}
+	if len(d.VolumeIDs) > 0 {
+		m.Resources[provider.ResourceDisk] = d.VolumeIDs[0]
+	}
+	return m
+}
+
+func status(s string) provider.Status {
+	switch s {
+	case "new":
+		return provider.StatusPending
+	case "active":
+		return provider.StatusRunning
+	case "off":
+		return provider.StatusStopped
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// UserDataLimit implements provider.UserDataLimiter. Droplet user data is
+// limited to 64 KiB.
+func (p *Provider) UserDataLimit() int {
+	return 65536
+}
+
+// MachineSizes implements provider.Sizer with the basic and general purpose
+// droplet sizes.
+func (p *Provider) MachineSizes() []provider.MachineSize {
+	return []provider.MachineSize{
+		{Name: "s-1vcpu-1gb", CPUs: 1, MemoryMB: 1024},
+		{Name: "s-1vcpu-2gb", CPUs: 1, MemoryMB: 2048},
+		{Name: "s-2vcpu-2gb", CPUs: 2, MemoryMB: 2048},
+		{Name: "s-2vcpu-4gb", CPUs: 2, MemoryMB: 4096},
+		{Name: "s-4vcpu-8gb", CPUs: 4, MemoryMB: 8192},
+		{Name: "s-8vcpu-16gb", CPUs: 8, MemoryMB: 16384},
+		{Name: "g-8vcpu-32gb", CPUs: 8, MemoryMB: 32768},
+		{Name: "g-16vcpu-64gb", CPUs: 16, MemoryMB: 65536},
+		{Name: "g-32vcpu-128gb", CPUs: 32, MemoryMB: 131072},
+		{Name: "g-40vcpu-160gb", CPUs: 40, MemoryMB: 163840},
+	}
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}, CreatedAt: time.Now().UTC()}
+	resourceName := "clouddev-" + c.Name
+
+	keyID, created, err := p.sshKey(ctx, resourceName, spec.SSHPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		m.Resources[provider.ResourceKey] = keyID
+	}
+
+	req := map[string]interface{}{
+		"name":       c.Name,
+		"region":     c.Region,
+		"size":       p.size(c),
+		"image":      p.image(c),
+		"ssh_keys":   []string{keyID},
+		"user_data":  string(spec.UserData),
+		"monitoring": p.opts.Monitoring,
+		"tags":       append([]string{tag}, p.opts.Tags...),
+	}
+	if p.opts.VPCUUID != "" {
+		req["vpc_uuid"] = p.opts.VPCUUID
+	}
+
+	if p.opts.VolumeSizeGB > 0 {
+		var resp struct {
+			Volume struct {
+				ID string `json:"id"`
+			} `json:"volume"`
+		}
+		if err := p.api.Do(ctx, http.MethodPost, "/v2/volumes", map[string]interface{}{
+			"name":            resourceName,
+			"region":          c.Region,
+			"size_gigabytes":  p.opts.VolumeSizeGB,
+			"filesystem_type": "ext4",
+			"tags":            []string{tag},
+		}, &resp); err != nil {
+			return m, fmt.Errorf("failed to create volume: %w", err)
+		}
+		m.Resources[provider.ResourceDisk] = resp.Volume.ID
+		req["volumes"] = []string{resp.Volume.ID}
+	}
+
+	var resp struct {
+		Droplet droplet `json:"droplet"`
+	}
+	if err := p.api.Do(ctx, http.MethodPost, "/v2/droplets", req, &resp); err != nil {
+		return m, fmt.Errorf("failed to create droplet: %w", err)
+	}
+	m.ID = strconv.Itoa(resp.Droplet.ID)
+	m.Resources[provider.ResourceInstance] = m.ID
+
+	fw, err := p.createFirewall(ctx, resourceName, m.ID, c.Ports)
+	if err != nil {
+		return m, err
+	}
+	m.Resources[provider.ResourceFirewall] = fw
+
+	var d *droplet
+	if err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		var err error
+		d, err = p.droplet(ctx, m.ID)
+		return err == nil && d.Status == "active", err
+	}); err != nil {
+		return m, fmt.Errorf("failed waiting for droplet %s to be active: %w", m.ID, err)
+	}
+	dm := d.machine()
+	dm.Resources = m.Resources
+	return dm, nil
+}
+
+// sshKey returns the ID of the SSH key to authorize, uploading the public
+// key unless it's already uploaded, and whether it was uploaded.
+func (p *Provider) sshKey(ctx context.Context, name, publicKey string) (string, bool, error) {
+	if p.opts.SSHKey != "" {
+		return p.opts.SSHKey, false, nil
+	}
+	fingerprint, err := fingerprint(publicKey)
+	if err != nil {
+		return "", false, err
+	}
+
+	var key struct {
+		SSHKey struct {
+			ID int `json:"id"`
+		} `json:"ssh_key"`
+	}
+	err = p.api.Do(ctx, http.MethodGet, "/v2/account/keys/"+fingerprint, nil, &key)
+	if err == nil {
+		return strconv.Itoa(key.SSHKey.ID), false, nil
+	}
+	if !rest.IsNotFound(err) {
+		return "", false, fmt.Errorf("failed to get SSH key: %w", err)
+	}
+	if err := p.api.Do(ctx, http.MethodPost, "/v2/account/keys", map[string]string{
+		"name":       name,
+		"public_key": publicKey,
+	}, &key); err != nil {
+		return "", false, fmt.Errorf("failed to upload SSH key: %w", err)
+	}
+	return strconv.Itoa(key.SSHKey.ID), true, nil
+}
+
+// fingerprint returns the MD5 fingerprint of a public key, by which
+// DigitalOcean identifies keys.
+func fingerprint(publicKey string) (string, error) {
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return "", errors.New("invalid SSH public key")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid SSH public key: %w", err)
+	}
+	sum := md5.Sum(blob)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hex, ":"), nil
+}
+
+// firewall is a cloud firewall as sent to and returned by the API.
+type firewall struct {
+	ID            string         `json:"id,omitempty"`
+	Name          string         `json:"name"`
+	InboundRules  []firewallRule `json:"inbound_rules"`
+	OutboundRules []firewallRule `json:"outbound_rules"`
+	DropletIDs    []int          `json:"droplet_ids"`
+}
+
+type firewallRule struct {
+	Protocol     string         `json:"protocol"`
+	Ports        string         `json:"ports,omitempty"`
+	Sources      *firewallHosts `json:"sources,omitempty"`
+	Destinations *firewallHosts `json:"destinations,omitempty"`
+}
+
+type firewallHosts struct {
+	Addresses []string `json:"addresses"`
+}
+
+var anywhere = &firewallHosts{Addresses: []string{"0.0.0.0/0", "::/0"}}
+
+func newFirewall(name, dropletID string, ports []int) (*firewall, error) {
+	id, err := strconv.Atoi(dropletID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid droplet ID %q", dropletID)
+	}
+	fw := &firewall{
+		Name: name,
+		OutboundRules: []firewallRule{
+			{Protocol: "tcp", Ports: "all", Destinations: anywhere},
+			{Protocol: "udp", Ports: "all", Destinations: anywhere},
+			{Protocol: "icmp", Destinations: anywhere},
+		},
+		DropletIDs: []int{id},
+	}
+	for _, port := range ports {
+		fw.InboundRules = append(fw.InboundRules, firewallRule{Protocol: "tcp", Ports: strconv.Itoa(port), Sources: anywhere})
+	}
+	return fw, nil
+}
+
+func (p *Provider) createFirewall(ctx context.Context, name, dropletID string, ports []int) (string, error) {
+	fw, err := newFirewall(name, dropletID, ports)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Firewall firewall `json:"firewall"`
+	}
+	if err := p.api.Do(ctx, http.MethodPost, "/v2/firewalls", fw, &resp); err != nil {
+		return "", fmt.Errorf("failed to create firewall: %w", err)
+	}
+	return resp.Firewall.ID, nil
+}
+
+func (p *Provider) droplet(ctx context.Context, id string) (*droplet, error) {
+	var resp struct {
+		Droplet droplet `json:"droplet"`
+	}
+	if err := p.api.Do(ctx, http.MethodGet, "/v2/droplets/"+url.PathEscape(id), nil, &resp); err != nil {
+		if rest.IsNotFound(err) {
+			return nil, provider.ErrNotFound
+		}
+		return nil, err
+	}
+	return &resp.Droplet, nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	if _, err := strconv.Atoi(id); err != nil {
+		// Droplet IDs are numbers.
+		return nil, provider.ErrNotFound
+	}
+	d, err := p.droplet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return d.machine(), nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	return p.action(ctx, id, map[string]interface{}{"type": "power_on"})
+}
+
+// Stop implements provider.Provider.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	return p.action(ctx, id, map[string]interface{}{"type": "shutdown"})
+}
+
+// action runs a droplet action and waits for it to complete.
+func (p *Provider) action(ctx context.Context, id string, action map[string]interface{}) error {
+	var resp struct {
+		Action struct {
+			ID     int    `json:"id"`
+			Status string `json:"status"`
+		} `json:"action"`
+	}
+	if err := p.api.Do(ctx, http.MethodPost, "/v2/droplets/"+url.PathEscape(id)+"/actions", action, &resp); err != nil {
+		if rest.IsNotFound(err) {
+			return provider.ErrNotFound
+		}
+		return fmt.Errorf("droplet %s %s: %w", id, action["type"], err)
+	}
+
+	actionID := strconv.Itoa(resp.Action.ID)
+	return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		if err := p.api.Do(ctx, http.MethodGet, "/v2/actions/"+actionID, nil, &resp); err != nil {
+			return false, err
+		}
+		switch resp.Action.Status {
+		case "completed":
+			return true, nil
+		case "errored":
+			return false, fmt.Errorf("droplet %s %s failed", id, action["type"])
+		}
+		return false, nil
+	})
+}
+
+// Destroy implements provider.Provider.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	if id := m.Resources[provider.ResourceInstance]; id != "" {
+		if err := p.delete(ctx, "/v2/droplets/"+url.PathEscape(id)); err != nil {
+			return fmt.Errorf("failed to delete droplet %s: %w", id, err)
+		}
+		// Volumes can be deleted only once detached from the deleted
+		// droplet.
+		if err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			_, err := p.droplet(ctx, id)
+			if errors.Is(err, provider.ErrNotFound) {
+				return true, nil
+			}
+			return false, err
+		}); err != nil {
+			return fmt.Errorf("failed waiting for droplet %s to be deleted: %w", id, err)
+		}
+	}
+	if id := m.Resources[provider.ResourceDisk]; id != "" {
+		err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			err := p.delete(ctx, "/v2/volumes/"+url.PathEscape(id))
+			if rest.HasStatus(err, http.StatusConflict) || rest.HasStatus(err, http.StatusPreconditionFailed) {
+				// Still attached.
+				return false, nil
+			}
+			return err == nil, err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete volume %s: %w", id, err)
+		}
+	}
+	if id := m.Resources[provider.ResourceFirewall]; id != "" {
+		if err := p.delete(ctx, "/v2/firewalls/"+url.PathEscape(id)); err != nil {
+			return fmt.Errorf("failed to delete firewall %s: %w", id, err)
+		}
+	}
+	if id := m.Resources[provider.ResourceKey]; id != "" {
+		if err := p.delete(ctx, "/v2/account/keys/"+url.PathEscape(id)); err != nil {
+			return fmt.Errorf("failed to delete SSH key %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// delete deletes a resource, ignoring the resources that don't exist.
+func (p *Provider) delete(ctx context.Context, path string) error {
+	err := p.api.Do(ctx, http.MethodDelete, path, nil, nil)
+	if rest.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	var machines []*provider.Machine
+	for page := 1; ; page++ {
+		var resp struct {
+			Droplets []droplet `json:"droplets"`
+			Links    struct {
+				Pages struct {
+					Next string `json:"next"`
+				} `json:"pages"`
+			} `json:"links"`
+		}
+		path := fmt.Sprintf("/v2/droplets?tag_name=%s&per_page=200&page=%d", tag, page)
+		if err := p.api.Do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+		for i := range resp.Droplets {
+			machines = append(machines, resp.Droplets[i].machine())
+		}
+		if resp.Links.Pages.Next == "" {
+			return machines, nil
+		}
+	}
+}
+
+// Plan implements provider.Provider. The droplet size and the firewall
+// ports are updated in place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	d, err := p.droplet(ctx, m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []provider.Change
+	if d.Region.Slug != c.Region {
+		changes = append(changes, provider.Change{Field: "region", Old: d.Region.Slug, New: c.Region, Replace: true})
+	}
+	if image := p.image(c); image != d.Image.Slug && image != strconv.Itoa(d.Image.ID) {
+		changes = append(changes, provider.Change{Field: "image", Old: d.Image.Slug, New: image, Replace: true})
+	}
+	if size := p.size(c); size != d.SizeSlug {
+		changes = append(changes, provider.Change{Field: "machine_type", Old: d.SizeSlug, New: size})
+	}
+	if p.opts.VolumeSizeGB > 0 != (len(d.VolumeIDs) > 0) {
+		changes = append(changes, provider.Change{
+			Field:   "provider_options.volume_size_gb",
+			Old:     strconv.Itoa(len(d.VolumeIDs)) + " volumes",
+			New:     strconv.Itoa(p.opts.VolumeSizeGB),
+			Replace: true,
+		})
+	}
+
+	if id := m.Resources[provider.ResourceFirewall]; id != "" {
+		var resp struct {
+			Firewall firewall `json:"firewall"`
+		}
+		if err := p.api.Do(ctx, http.MethodGet, "/v2/firewalls/"+url.PathEscape(id), nil, &resp); err != nil && !rest.IsNotFound(err) {
+			return nil, err
+		}
+		var ports []int
+		for _, r := range resp.Firewall.InboundRules {
+			if port, err := strconv.Atoi(r.Ports); err == nil && r.Protocol == "tcp" {
+				ports = append(ports, port)
+			}
+		}
+		if old, new := provider.FormatPorts(ports), provider.FormatPorts(c.Ports); old != new {
+			changes = append(changes, provider.Change{Field: "ports", Old: old, New: new})
+		}
+	}
+	return changes, nil
+}
+
+// Update implements provider.Updater.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	for _, ch := range changes {
+		switch ch.Field {
+		case "machine_type":
+			// Droplets are resized powered off. The disk isn't resized so
+			// that the droplet can be resized down later.
+			if m.Status == provider.StatusRunning {
+				if err := p.action(ctx, m.ID, map[string]interface{}{"type": "power_off"}); err != nil {
+					return err
+				}
+			}
+			if err := p.action(ctx, m.ID, map[string]interface{}{"type": "resize", "size": ch.New, "disk": false}); err != nil {
+				return err
+			}
+			if m.Status == provider.StatusRunning {
+				if err := p.action(ctx, m.ID, map[string]interface{}{"type": "power_on"}); err != nil {
+					return err
+				}
+			}
+		case "ports":
+			id := m.Resources[provider.ResourceFirewall]
+			fw, err := newFirewall("clouddev-"+spec.Config.Name, m.ID, spec.Config.Ports)
+			if err != nil {
+				return err
+			}
+			if err := p.api.Do(ctx, http.MethodPut, "/v2/firewalls/"+url.PathEscape(id), fw, nil); err != nil {
+				return fmt.Errorf("failed to update firewall %s: %w", id, err)
+			}
+		default:
+			return fmt.Errorf("can't update %s in place", ch.Field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package digitalocean_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/digitalocean"
+	"github.com/darkowlzz/clouddev/provider/digitalocean/digitaloceantest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// newTestProvider returns a provider of the spec against a fake API server.
+func newTestProvider(t *testing.T, s *digitaloceantest.Server, spec *provider.Spec) *digitalocean.Provider {
+	t.Helper()
+	t.Setenv("DIGITALOCEAN_TOKEN", digitaloceantest.Token)
+	spec.Config.Region = "nyc3"
+	if spec.Config.ProviderOptions == nil {
+		spec.Config.ProviderOptions = map[string]interface{}{}
+	}
+	spec.Config.ProviderOptions["api_url"] = s.URL
+	p := digitalocean.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *digitaloceantest.Server {
+	s := digitaloceantest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(digitalocean.Name)
+	providertest.Run(t, newTestProvider(t, s, spec), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after the suite", n)
+	}
+}
+
+func TestCreateReusesKeyByFingerprint(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(digitalocean.Name)
+	p := newTestProvider(t, s, spec)
+	ctx := context.Background()
+
+	// The key the user already uploaded.
+	body, _ := json.Marshal(map[string]string{"name": "laptop", "public_key": spec.SSHPublicKey})
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/v2/account/keys", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+digitaloceantest.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if id, ok := m.Resources[provider.ResourceKey]; ok {
+		t.Errorf("Create() machine resources include the existing key %s", id)
+	}
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 1 {
+		t.Errorf("%d resources are left after Destroy(), want the existing key only", n)
+	}
+}
+
+func TestCreateAttachesVolume(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(digitalocean.Name)
+	spec.Config.ProviderOptions = map[string]interface{}{"volume_size_gb": 20}
+	p := newTestProvider(t, s, spec)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	volume := m.Resources[provider.ResourceDisk]
+	if volume == "" {
+		t.Fatalf("Create() machine resources %v don't include the volume", m.Resources)
+	}
+	got, err := p.Get(ctx, m.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Resources[provider.ResourceDisk] != volume {
+		t.Errorf("Get() volume = %q, want %q attached", got.Resources[provider.ResourceDisk], volume)
+	}
+	changes, err := p.Plan(ctx, spec, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("Plan() = %v, want no changes", changes)
+	}
+
+	// The volume is deleted once the droplet is.
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy()", n)
+	}
+}
+
+func TestCreateReturnsPartialResources(t *testing.T) {
+	s := newServer(t)
+	handler := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v2/firewalls" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"id":"unprocessable_entity","message":"too many firewalls"}`))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	spec := providertest.Spec(digitalocean.Name)
+	spec.Config.ProviderOptions = map[string]interface{}{"volume_size_gb": 20}
+	p := newTestProvider(t, s, spec)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err == nil {
+		t.Fatal("Create() error = nil, want the firewall error")
+	}
+	if m == nil {
+		t.Fatal("Create() returned no machine with the created resources")
+	}
+	for _, r := range []string{provider.ResourceKey, provider.ResourceDisk, provider.ResourceInstance} {
+		if m.Resources[r] == "" {
+			t.Errorf("Create() machine resources %v don't include the %s", m.Resources, r)
+		}
+	}
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy() of the partial machine", n)
+	}
+}
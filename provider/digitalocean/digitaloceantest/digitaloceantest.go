@@ -0,0 +1,306 @@
+// Package digitaloceantest implements an in-memory fake of the DigitalOcean
+// v2 API for testing the DigitalOcean provider.
+//
+// The fake implements the endpoints used by the provider. Droplets become
+// active on the first read after their creation and actions complete
+// immediately.
+package digitaloceantest
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token is the API token accepted by the fake.
+const Token = "digitaloceantest-token"
+
+// Server is a fake DigitalOcean API server.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	nextID    int
+	keys      map[string]map[string]interface{}
+	volumes   map[string]map[string]interface{}
+	droplets  map[string]map[string]interface{}
+	firewalls map[string]map[string]interface{}
+}
+
+// NewServer starts a fake API server. The caller must close it.
+func NewServer() *Server {
+	s := &Server{
+		nextID:    1000,
+		keys:      map[string]map[string]interface{}{},
+		volumes:   map[string]map[string]interface{}{},
+		droplets:  map[string]map[string]interface{}{},
+		firewalls: map[string]map[string]interface{}{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Resources returns the number of keys, volumes, droplets and firewalls
+// that exist, to check for leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys) + len(s.volumes) + len(s.droplets) + len(s.firewalls)
+}
+
+func (s *Server) id() int {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unable to authenticate you")
+		return
+	}
+	var in map[string]interface{}
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v2" {
+		writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+		return
+	}
+	switch {
+	case parts[1] == "account" && len(parts) >= 3 && parts[2] == "keys":
+		s.serveKeys(w, r, parts[3:], in)
+	case parts[1] == "volumes":
+		s.serveVolumes(w, r, parts[2:], in)
+	case parts[1] == "droplets":
+		s.serveDroplets(w, r, parts[2:], in)
+	case parts[1] == "actions" && len(parts) == 3 && r.Method == http.MethodGet:
+		id, _ := strconv.Atoi(parts[2])
+		write(w, http.StatusOK, map[string]interface{}{"action": map[string]interface{}{"id": id, "status": "completed"}})
+	case parts[1] == "firewalls":
+		s.serveFirewalls(w, r, parts[2:], in)
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+	}
+}
+
+func (s *Server) serveKeys(w http.ResponseWriter, r *http.Request, parts []string, in map[string]interface{}) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		id := s.id()
+		publicKey, _ := in["public_key"].(string)
+		key := map[string]interface{}{
+			"id":          id,
+			"name":        in["name"],
+			"public_key":  publicKey,
+			"fingerprint": fingerprint(publicKey),
+		}
+		s.keys[strconv.Itoa(id)] = key
+		write(w, http.StatusCreated, map[string]interface{}{"ssh_key": key})
+	case len(parts) == 1:
+		id, key := s.key(parts[0])
+		if key == nil {
+			writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			write(w, http.StatusOK, map[string]interface{}{"ssh_key": key})
+		case http.MethodDelete:
+			delete(s.keys, id)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+}
+
+// key looks a key up by ID or fingerprint.
+func (s *Server) key(idOrFingerprint string) (string, map[string]interface{}) {
+	if key, ok := s.keys[idOrFingerprint]; ok {
+		return idOrFingerprint, key
+	}
+	for id, key := range s.keys {
+		if key["fingerprint"] == idOrFingerprint {
+			return id, key
+		}
+	}
+	return "", nil
+}
+
+func (s *Server) serveVolumes(w http.ResponseWriter, r *http.Request, parts []string, in map[string]interface{}) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		id := fmt.Sprintf("vol-%d", s.id())
+		volume := map[string]interface{}{
+			"id":             id,
+			"name":           in["name"],
+			"size_gigabytes": in["size_gigabytes"],
+			"droplet_ids":    []string{},
+		}
+		s.volumes[id] = volume
+		write(w, http.StatusCreated, map[string]interface{}{"volume": volume})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if _, ok := s.volumes[parts[0]]; !ok {
+			writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+			return
+		}
+		for _, d := range s.droplets {
+			for _, v := range d["volume_ids"].([]string) {
+				if v == parts[0] {
+					writeError(w, http.StatusConflict, "conflict", "Volume is currently attached to a Droplet")
+					return
+				}
+			}
+		}
+		delete(s.volumes, parts[0])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+}
+
+func (s *Server) serveDroplets(w http.ResponseWriter, r *http.Request, parts []string, in map[string]interface{}) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		id := s.id()
+		var volumes []string
+		if v, ok := in["volumes"].([]interface{}); ok {
+			for _, id := range v {
+				volumes = append(volumes, fmt.Sprint(id))
+			}
+		}
+		if volumes == nil {
+			volumes = []string{}
+		}
+		d := map[string]interface{}{
+			"id":         id,
+			"name":       in["name"],
+			"status":     "new",
+			"size_slug":  in["size"],
+			"image":      map[string]interface{}{"id": 1, "slug": in["image"]},
+			"region":     map[string]interface{}{"slug": in["region"]},
+			"networks":   map[string]interface{}{"v4": []interface{}{}},
+			"volume_ids": volumes,
+			"tags":       in["tags"],
+			"created_at": time.Now().UTC().Format(time.RFC3339),
+		}
+		s.droplets[strconv.Itoa(id)] = d
+		write(w, http.StatusAccepted, map[string]interface{}{"droplet": d})
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		tag := r.URL.Query().Get("tag_name")
+		droplets := []interface{}{}
+		for _, d := range s.droplets {
+			tags, _ := d["tags"].([]interface{})
+			for _, t := range tags {
+				if t == tag {
+					droplets = append(droplets, d)
+				}
+			}
+		}
+		write(w, http.StatusOK, map[string]interface{}{"droplets": droplets, "links": map[string]interface{}{}})
+	case len(parts) >= 1:
+		d, ok := s.droplets[parts[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			if d["status"] == "new" {
+				d["status"] = "active"
+				d["networks"] = map[string]interface{}{"v4": []interface{}{
+					map[string]interface{}{"ip_address": "203.0.113.10", "type": "public"},
+				}}
+			}
+			write(w, http.StatusOK, map[string]interface{}{"droplet": d})
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			delete(s.droplets, parts[0])
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && parts[1] == "actions" && r.Method == http.MethodPost:
+			switch in["type"] {
+			case "power_on":
+				d["status"] = "active"
+			case "shutdown", "power_off":
+				d["status"] = "off"
+			case "resize":
+				d["size_slug"] = in["size"]
+			default:
+				writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", fmt.Sprintf("unknown action %v", in["type"]))
+				return
+			}
+			write(w, http.StatusCreated, map[string]interface{}{"action": map[string]interface{}{"id": s.id(), "status": "in-progress"}})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+}
+
+func (s *Server) serveFirewalls(w http.ResponseWriter, r *http.Request, parts []string, in map[string]interface{}) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		id := fmt.Sprintf("fw-%d", s.id())
+		in["id"] = id
+		s.firewalls[id] = in
+		write(w, http.StatusAccepted, map[string]interface{}{"firewall": in})
+	case len(parts) == 1:
+		fw, ok := s.firewalls[parts[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			write(w, http.StatusOK, map[string]interface{}{"firewall": fw})
+		case http.MethodPut:
+			in["id"] = parts[0]
+			s.firewalls[parts[0]] = in
+			write(w, http.StatusOK, map[string]interface{}{"firewall": in})
+		case http.MethodDelete:
+			delete(s.firewalls, parts[0])
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+}
+
+func fingerprint(publicKey string) string {
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return ""
+	}
+	blob, _ := base64.StdEncoding.DecodeString(fields[1])
+	sum := md5.Sum(blob)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+func write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, id, message string) {
+	write(w, status, map[string]string{"id": id, "message": message})
+}
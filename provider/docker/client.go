@@ -0,0 +1,202 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/darkowlzz/clouddev/internal/rest"
+)
+
+// apiVersion is the Engine API version used, supported since Docker 20.10.
+const apiVersion = "v1.41"
+
+// newClient returns a client of the Engine API at host, a unix:// or
+// tcp:// address as in DOCKER_HOST. The client is returned along with the
+// error for an invalid host, and fails all its requests.
+func newClient(host string) (*rest.Client, error) {
+	c := &rest.Client{ErrorMessage: errorMessage}
+	u, err := url.Parse(host)
+	if err != nil {
+		return c, fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		c.BaseURL = "http://docker/" + apiVersion
+		c.HTTPClient = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}}
+	case "tcp", "http":
+		c.BaseURL = "http://" + u.Host + "/" + apiVersion
+	default:
+		return c, fmt.Errorf("unsupported docker host %q, want unix:// or tcp://", host)
+	}
+	return c, nil
+}
+
+func errorMessage(body []byte) string {
+	var e struct {
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(body, &e)
+	return e.Message
+}
+
+// send sends a request with a raw body, e.g. an archive.
+func send(ctx context.Context, c *rest.Client, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Send(req, nil)
+}
+
+// stream sends a request to an endpoint that streams JSON progress
+// messages, e.g. a pull, and returns the first error message of the
+// stream.
+func stream(ctx context.Context, c *rest.Client, method, path, contentType string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		msg := errorMessage(data)
+		if msg == "" {
+			msg = strings.TrimSpace(string(data))
+		}
+		return &rest.Error{StatusCode: resp.StatusCode, Method: req.Method, URL: req.URL.Path, Message: msg}
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: invalid response: %w", req.Method, req.URL.Path, err)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+// demux returns the output of a container without a TTY from its
+// multiplexed logs, in which every frame has an 8 byte header: the stream,
+// 3 zero bytes and the big endian size of the frame.
+func demux(logs []byte) ([]byte, error) {
+	var out []byte
+	for len(logs) > 0 {
+		if len(logs) < 8 {
+			return nil, errors.New("truncated log frame header")
+		}
+		size := int(binary.BigEndian.Uint32(logs[4:8]))
+		if len(logs) < 8+size {
+			return nil, errors.New("truncated log frame")
+		}
+		out = append(out, logs[8:8+size]...)
+		logs = logs[8+size:]
+	}
+	return out, nil
+}
+
+// tarFiles returns a tar archive of the files, keyed by path.
+func tarFiles(files map[string][]byte, modTime time.Time) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	return &buf, tw.Close()
+}
+
+// tarDir returns a tar archive of the directory, the build context of an
+// image.
+func tarDir(dir string) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &buf, tw.Close()
+}
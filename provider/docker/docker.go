@@ -0,0 +1,589 @@
+// Package docker implements a provider that runs environments in Docker
+// containers, for quick experiments without a virtual machine.
+//
+// The containers run an SSH server and are set up by cloud-init from the
+// same user data as the machines of the other providers, so the
+// configurations stay portable.
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/internal/containerinit"
+	"github.com/darkowlzz/clouddev/internal/rest"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "docker"
+
+const (
+	defaultHost  = "unix:///var/run/docker.sock"
+	defaultImage = "ubuntu:22.04"
+	// namePrefix prefixes the names of the containers and volumes created
+	// by clouddev.
+	namePrefix = "clouddev-"
+	// Labels of the containers and volumes.
+	labelEnv    = "clouddev.env"
+	labelImage  = "clouddev.image"
+	labelPorts  = "clouddev.ports"
+	labelMounts = "clouddev.mounts"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the docker provider_options.
+type options struct {
+	// Host is the Engine API address, DOCKER_HOST or the local socket if
+	// empty.
+	Host string `mapstructure:"host"`
+	// Build is the path of a build context to build the image from instead
+	// of pulling image.
+	Build      string `mapstructure:"build"`
+	Dockerfile string `mapstructure:"dockerfile"`
+	// Mounts are bind mounts of host paths and volumes, as
+	// source:target[:ro]. Sources that aren't paths name volumes created
+	// for the environment.
+	Mounts []string `mapstructure:"mounts"`
+	// HostIP is the host address the ports are published on.
+	HostIP string `mapstructure:"host_ip"`
+	// SSHPort is the host port of the SSH server, a free port if 0.
+	SSHPort  int     `mapstructure:"ssh_port"`
+	CPUs     float64 `mapstructure:"cpus"`
+	MemoryMB int     `mapstructure:"memory_mb"`
+}
+
+// Provider runs environments in Docker containers.
+type Provider struct {
+	cfg    *config.Config
+	opts   options
+	client *rest.Client
+	// PollInterval is the interval between the checks of the state of the
+	// containers.
+	PollInterval time.Duration
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns a docker provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	if opts.Host == "" {
+		opts.Host = os.Getenv("DOCKER_HOST")
+	}
+	if opts.Host == "" {
+		opts.Host = defaultHost
+	}
+	if opts.Dockerfile == "" {
+		opts.Dockerfile = "Dockerfile"
+	}
+	if opts.HostIP == "" {
+		opts.HostIP = "127.0.0.1"
+	}
+	// An invalid host is reported by Validate.
+	client, _ := newClient(opts.Host)
+	return &Provider{
+		cfg:          c,
+		opts:         opts,
+		client:       client,
+		PollInterval: time.Second,
+	}
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	if opts.Host != "" {
+		if _, err := newClient(opts.Host); err != nil {
+			errs = append(errs, &config.FieldError{Path: "provider_options.host", Message: err.Error()})
+		}
+	}
+	for i, m := range opts.Mounts {
+		if _, err := parseMount(c.Name, m); err != nil {
+			errs = append(errs, &config.FieldError{Path: fmt.Sprintf("provider_options.mounts[%d]", i), Message: err.Error()})
+		}
+	}
+	if opts.SSHPort < 0 || opts.SSHPort > 65535 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.ssh_port", Message: "must be a port number"})
+	}
+	if opts.CPUs < 0 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.cpus", Message: "must not be negative"})
+	}
+	if opts.MemoryMB < 0 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.memory_mb", Message: "must not be negative"})
+	}
+	return errs
+}
+
+// image returns the image of the containers, the tag of the built image if
+// built.
+func (p *Provider) image(c *config.Config) string {
+	if p.opts.Build != "" {
+		return "clouddev/" + c.Name + ":latest"
+	}
+	if c.Image == "" {
+		return defaultImage
+	}
+	return c.Image
+}
+
+// mount is a bind mount or a volume of a container.
+type mount struct {
+	Type     string `json:"Type"`
+	Source   string `json:"Source"`
+	Target   string `json:"Target"`
+	ReadOnly bool   `json:"ReadOnly,omitempty"`
+}
+
+// parseMount parses a mount option of the environment.
+func parseMount(env, s string) (*mount, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		return nil, errors.New("must be source:target[:ro]")
+	}
+	m := &mount{Type: "volume", Source: parts[0], Target: parts[1]}
+	if !strings.HasPrefix(m.Target, "/") {
+		return nil, errors.New("the target must be an absolute path")
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return nil, fmt.Errorf("invalid mode %q, want ro or rw", parts[2])
+		}
+	}
+	if strings.ContainsAny(m.Source[:1], "/~.") {
+		source, err := homedir.Expand(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		if m.Source, err = filepath.Abs(source); err != nil {
+			return nil, err
+		}
+		m.Type = "bind"
+	} else {
+		m.Source = namePrefix + env + "-" + m.Source
+	}
+	return m, nil
+}
+
+// container is an inspected container.
+type container struct {
+	ID      string    `json:"Id"`
+	Created time.Time `json:"Created"`
+	State   struct {
+		Status string `json:"Status"`
+	} `json:"State"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	HostConfig struct {
+		NanoCPUs int64 `json:"NanoCpus"`
+		Memory   int64 `json:"Memory"`
+	} `json:"HostConfig"`
+	NetworkSettings struct {
+		Ports map[string][]portBinding `json:"Ports"`
+	} `json:"NetworkSettings"`
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+func (p *Provider) machine(ct *container) *provider.Machine {
+	m := &provider.Machine{
+		ID:        ct.ID,
+		Name:      ct.Config.Labels[labelEnv],
+		Status:    status(ct.State.Status),
+		Resources: map[string]string{provider.ResourceInstance: ct.ID},
+		CreatedAt: ct.Created,
+	}
+	if m.Status == provider.StatusRunning {
+		for _, b := range ct.NetworkSettings.Ports["22/tcp"] {
+			m.Address = p.address(b.HostIP)
+			m.SSHPort, _ = strconv.Atoi(b.HostPort)
+			break
+		}
+	}
+	return m
+}
+
+// address returns the address the published ports are reachable on from
+// this host.
+func (p *Provider) address(hostIP string) string {
+	if u, err := url.Parse(p.opts.Host); err == nil && u.Scheme != "unix" {
+		return u.Hostname()
+	}
+	if hostIP == "" || hostIP == "0.0.0.0" || hostIP == "::" {
+		return "127.0.0.1"
+	}
+	return hostIP
+}
+
+func status(s string) provider.Status {
+	switch s {
+	case "running":
+		return provider.StatusRunning
+	case "created", "restarting":
+		return provider.StatusPending
+	case "exited", "paused", "dead":
+		return provider.StatusStopped
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	image := p.image(c)
+	if err := p.ensureImage(ctx, image); err != nil {
+		return nil, err
+	}
+
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}}
+	labels := map[string]string{labelEnv: c.Name}
+	var mounts []*mount
+	var volumes []string
+	for _, s := range p.opts.Mounts {
+		mt, err := parseMount(c.Name, s)
+		if err != nil {
+			return m, err
+		}
+		mounts = append(mounts, mt)
+		if mt.Type != "volume" {
+			continue
+		}
+		in := map[string]interface{}{"Name": mt.Source, "Labels": labels}
+		if err := p.client.Do(ctx, http.MethodPost, "/volumes/create", in, nil); err != nil {
+			return m, fmt.Errorf("failed to create volume %s: %w", mt.Source, err)
+		}
+		volumes = append(volumes, mt.Source)
+		m.Resources[provider.ResourceDisk] = strings.Join(volumes, ",")
+	}
+
+	exposed := map[string]struct{}{}
+	bindings := map[string][]portBinding{}
+	for _, port := range append([]int{22}, c.Ports...) {
+		key := strconv.Itoa(port) + "/tcp"
+		hostPort := strconv.Itoa(port)
+		if port == 22 {
+			hostPort = ""
+			if p.opts.SSHPort != 0 {
+				hostPort = strconv.Itoa(p.opts.SSHPort)
+			}
+		}
+		exposed[key] = struct{}{}
+		bindings[key] = []portBinding{{HostIP: p.opts.HostIP, HostPort: hostPort}}
+	}
+	in := map[string]interface{}{
+		"Image":    image,
+		"Hostname": c.Name,
+		"Cmd":      containerinit.Command(),
+		"Labels": map[string]string{
+			labelEnv:    c.Name,
+			labelImage:  image,
+			labelPorts:  provider.FormatPorts(c.Ports),
+			labelMounts: strings.Join(p.opts.Mounts, ","),
+		},
+		"ExposedPorts": exposed,
+		"HostConfig": map[string]interface{}{
+			"PortBindings":  bindings,
+			"Mounts":        mounts,
+			"NanoCpus":      int64(p.opts.CPUs * 1e9),
+			"Memory":        int64(p.opts.MemoryMB) << 20,
+			"MemorySwap":    memorySwap(p.opts.MemoryMB),
+			"RestartPolicy": map[string]string{"Name": "unless-stopped"},
+		},
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := p.client.Do(ctx, http.MethodPost, "/containers/create?name="+url.QueryEscape(namePrefix+c.Name), in, &created); err != nil {
+		return m, fmt.Errorf("failed to create container: %w", err)
+	}
+	m.ID = created.ID
+	m.Resources[provider.ResourceInstance] = created.ID
+
+	// cloud-init reads the user data from the NoCloud seed directory.
+	seedDir := strings.TrimPrefix(containerinit.SeedDir, "/")
+	seed, err := tarFiles(map[string][]byte{
+		seedDir + "/user-data": spec.UserData,
+		seedDir + "/meta-data": containerinit.MetaData(created.ID, c.Name),
+	}, time.Now())
+	if err != nil {
+		return m, err
+	}
+	if _, err := send(ctx, p.client, http.MethodPut, "/containers/"+created.ID+"/archive?path=/", "application/x-tar", seed); err != nil {
+		return m, fmt.Errorf("failed to copy the user data: %w", err)
+	}
+	if err := p.Start(ctx, created.ID); err != nil {
+		return m, fmt.Errorf("failed to start container: %w", err)
+	}
+
+	var got *provider.Machine
+	if err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		var err error
+		got, err = p.Get(ctx, created.ID)
+		if err == nil && got.Status == provider.StatusStopped {
+			return false, fmt.Errorf("container exited, see docker logs %s", created.ID)
+		}
+		return err == nil && got.Status == provider.StatusRunning, err
+	}); err != nil {
+		return m, fmt.Errorf("failed waiting for container %s to run: %w", created.ID, err)
+	}
+	got.Resources = m.Resources
+	return got, nil
+}
+
+// memorySwap returns the swap limit of the memory limit, no swap limit.
+func memorySwap(memoryMB int) int64 {
+	if memoryMB == 0 {
+		return 0
+	}
+	return -1
+}
+
+// ensureImage builds the image, or pulls it if it doesn't exist.
+func (p *Provider) ensureImage(ctx context.Context, image string) error {
+	if p.opts.Build != "" {
+		dir, err := homedir.Expand(p.opts.Build)
+		if err != nil {
+			return err
+		}
+		buildContext, err := tarDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read the build context: %w", err)
+		}
+		q := url.Values{"t": {image}, "dockerfile": {p.opts.Dockerfile}, "rm": {"1"}}
+		if err := stream(ctx, p.client, http.MethodPost, "/build?"+q.Encode(), "application/x-tar", buildContext); err != nil {
+			return fmt.Errorf("failed to build image: %w", err)
+		}
+		return nil
+	}
+
+	err := p.client.Do(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil)
+	if !rest.IsNotFound(err) {
+		return err
+	}
+	q := url.Values{"fromImage": {image}}
+	if !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") && !strings.Contains(image, "@") {
+		q.Set("tag", "latest")
+	}
+	if err := stream(ctx, p.client, http.MethodPost, "/images/create?"+q.Encode(), "", nil); err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", image, err)
+	}
+	return nil
+}
+
+func (p *Provider) container(ctx context.Context, id string) (*container, error) {
+	var ct container
+	err := p.client.Do(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/json", nil, &ct)
+	if rest.IsNotFound(err) {
+		return nil, provider.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ct, nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	ct, err := p.container(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return p.machine(ct), nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	err := p.client.Do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/start", nil, nil)
+	return p.containerError(err)
+}
+
+// Stop implements provider.Provider.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	err := p.client.Do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/stop?t=30", nil, nil)
+	return p.containerError(err)
+}
+
+// ConsoleOutput implements provider.ConsoleReader with the recent logs of
+// the container, in which the bootstrap prints the SSH host keys.
+func (p *Provider) ConsoleOutput(ctx context.Context, id string) (string, error) {
+	if _, err := p.container(ctx, id); err != nil {
+		return "", err
+	}
+	var logs []byte
+	err := p.client.Do(ctx, http.MethodGet, "/containers/"+url.PathEscape(id)+"/logs?stdout=1&stderr=1&tail=1000", nil, &logs)
+	if err != nil {
+		return "", p.containerError(err)
+	}
+	out, err := demux(logs)
+	if err != nil {
+		return "", fmt.Errorf("invalid logs of container %s: %w", id, err)
+	}
+	return string(out), nil
+}
+
+// containerError maps the error of a container request, ignoring the 304
+// responses to starting started and stopping stopped containers.
+func (p *Provider) containerError(err error) error {
+	switch {
+	case rest.HasStatus(err, http.StatusNotModified):
+		return nil
+	case rest.IsNotFound(err):
+		return provider.ErrNotFound
+	default:
+		return err
+	}
+}
+
+// Destroy implements provider.Provider. The volumes of the environment are
+// deleted with the container.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	if id := m.Resources[provider.ResourceInstance]; id != "" {
+		err := p.client.Do(ctx, http.MethodDelete, "/containers/"+url.PathEscape(id)+"?force=1&v=1", nil, nil)
+		if err != nil && !rest.IsNotFound(err) {
+			return fmt.Errorf("failed to remove container %s: %w", id, err)
+		}
+	}
+
+	volumes := map[string]bool{}
+	if v := m.Resources[provider.ResourceDisk]; v != "" {
+		for _, name := range strings.Split(v, ",") {
+			volumes[name] = true
+		}
+	}
+	if m.Name != "" {
+		filters, err := json.Marshal(map[string][]string{"label": {labelEnv + "=" + m.Name}})
+		if err != nil {
+			return err
+		}
+		var list struct {
+			Volumes []struct {
+				Name string `json:"Name"`
+			} `json:"Volumes"`
+		}
+		if err := p.client.Do(ctx, http.MethodGet, "/volumes?filters="+url.QueryEscape(string(filters)), nil, &list); err != nil {
+			return err
+		}
+		for _, v := range list.Volumes {
+			volumes[v.Name] = true
+		}
+	}
+	for name := range volumes {
+		err := p.client.Do(ctx, http.MethodDelete, "/volumes/"+url.PathEscape(name), nil, nil)
+		if err != nil && !rest.IsNotFound(err) {
+			return fmt.Errorf("failed to remove volume %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {labelEnv}})
+	if err != nil {
+		return nil, err
+	}
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	if err := p.client.Do(ctx, http.MethodGet, "/containers/json?all=1&filters="+url.QueryEscape(string(filters)), nil, &list); err != nil {
+		return nil, err
+	}
+	var machines []*provider.Machine
+	for _, ct := range list {
+		m, err := p.Get(ctx, ct.ID)
+		if errors.Is(err, provider.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// Plan implements provider.Provider. The CPU and memory limits are updated
+// in place, except for removing them.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	ct, err := p.container(ctx, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	labels := ct.Config.Labels
+
+	var changes []provider.Change
+	if old, new := labels[labelImage], p.image(c); old != new {
+		changes = append(changes, provider.Change{Field: "image", Old: old, New: new, Replace: true})
+	}
+	if old, new := labels[labelPorts], provider.FormatPorts(c.Ports); old != new {
+		changes = append(changes, provider.Change{Field: "ports", Old: old, New: new, Replace: true})
+	}
+	if old, new := labels[labelMounts], strings.Join(p.opts.Mounts, ","); old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.mounts", Old: old, New: new, Replace: true})
+	}
+	if old, new := float64(ct.HostConfig.NanoCPUs)/1e9, p.opts.CPUs; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.cpus", Old: formatCPUs(old), New: formatCPUs(new), Replace: new == 0})
+	}
+	if old, new := int(ct.HostConfig.Memory>>20), p.opts.MemoryMB; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.memory_mb", Old: strconv.Itoa(old), New: strconv.Itoa(new), Replace: new == 0})
+	}
+	return changes, nil
+}
+
+func formatCPUs(cpus float64) string {
+	return strconv.FormatFloat(cpus, 'f', -1, 64)
+}
+
+// Update implements provider.Updater. The limits of a container are
+// updated while it runs.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	for _, ch := range changes {
+		switch ch.Field {
+		case "provider_options.cpus", "provider_options.memory_mb":
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+	in := map[string]interface{}{
+		"NanoCpus":   int64(p.opts.CPUs * 1e9),
+		"Memory":     int64(p.opts.MemoryMB) << 20,
+		"MemorySwap": memorySwap(p.opts.MemoryMB),
+	}
+	if err := p.client.Do(ctx, http.MethodPost, "/containers/"+url.PathEscape(m.ID)+"/update", in, nil); err != nil {
+		return fmt.Errorf("failed to update the limits of container %s: %w", m.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package docker_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/internal/containerinit"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/docker"
+	"github.com/darkowlzz/clouddev/provider/docker/dockertest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// newTestProvider returns a provider of the spec against a fake Engine API
+// on a unix socket.
+func newTestProvider(t *testing.T, s *dockertest.Server, spec *provider.Spec, opts map[string]interface{}) *docker.Provider {
+	t.Helper()
+	spec.Config.ProviderOptions = map[string]interface{}{"host": s.Host}
+	for k, v := range opts {
+		spec.Config.ProviderOptions[k] = v
+	}
+	p := docker.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *dockertest.Server {
+	s, err := dockertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(docker.Name)
+	providertest.Run(t, newTestProvider(t, s, spec, nil), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after the suite", n)
+	}
+}
+
+func TestCreatePublishesPortsAndCopiesUserData(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(docker.Name)
+	spec.Config.Ports = []int{8080}
+	p := newTestProvider(t, s, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer p.Destroy(ctx, m)
+	// The fake publishes the SSH port on the next free port, like Docker
+	// without a host port.
+	if m.Address != "127.0.0.1" || m.SSHPort <= 32768 {
+		t.Errorf("Create() SSH address = %s:%d, want a published port on 127.0.0.1", m.Address, m.SSHPort)
+	}
+	for name, want := range map[string]string{
+		"user-data": string(spec.UserData),
+		"meta-data": string(containerinit.MetaData(m.ID, spec.Config.Name)),
+	} {
+		got, ok := s.File(m.ID, containerinit.SeedDir+"/"+name)
+		if !ok {
+			t.Errorf("Create() didn't copy the %s to the container", name)
+		} else if string(got) != want {
+			t.Errorf("container %s = %q, want %q", name, got, want)
+		}
+	}
+
+	changed := providertest.Spec(docker.Name)
+	changes, err := newTestProvider(t, s, changed, nil).Plan(ctx, changed, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) != 1 || changes[0].Field != "ports" || !changes[0].Replace {
+		t.Errorf("Plan() without the published port = %v, want to replace the container", changes)
+	}
+}
+
+func TestMountsAndLimits(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(docker.Name)
+	opts := map[string]interface{}{
+		"mounts":    []string{"home:/home/dev", t.TempDir() + ":/workspace:ro"},
+		"cpus":      1.5,
+		"memory_mb": 2048,
+	}
+	p := newTestProvider(t, s, spec, opts)
+	if errs := p.Validate(spec.Config); len(errs) > 0 {
+		t.Fatalf("Validate() = %v", errs)
+	}
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if got := m.Resources[provider.ResourceDisk]; got != "clouddev-conformance-home" {
+		t.Errorf("Create() volumes = %q, want the volume of the home mount only", got)
+	}
+	changes, err := p.Plan(ctx, spec, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("Plan() = %v, want no changes", changes)
+	}
+
+	larger := providertest.Spec(docker.Name)
+	opts["cpus"] = 4
+	opts["memory_mb"] = 8192
+	p = newTestProvider(t, s, larger, opts)
+	changes, err = p.Plan(ctx, larger, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) != 2 || changes[0].Replace || changes[1].Replace {
+		t.Fatalf("Plan() of larger limits = %v, want to update the CPUs and the memory in place", changes)
+	}
+	if err := p.Update(ctx, larger, m, changes); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if changes, err := p.Plan(ctx, larger, m); err != nil || len(changes) > 0 {
+		t.Errorf("Plan() after Update() = %v, %v, want no changes", changes, err)
+	}
+
+	// The volumes are found by their labels when they aren't recorded.
+	if err := p.Destroy(ctx, &provider.Machine{Name: m.Name, Resources: map[string]string{provider.ResourceInstance: m.ID}}); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy(), including the volume", n)
+	}
+}
+
+func TestInvalidMounts(t *testing.T) {
+	s := newServer(t)
+	tests := map[string]string{
+		"home":               "must be source:target[:ro]",
+		"home:dev":           "the target must be an absolute path",
+		"home:/home/dev:rx":  `invalid mode "rx", want ro or rw`,
+		"home:/home/dev:ro:": "must be source:target[:ro]",
+	}
+	for mount, want := range tests {
+		spec := providertest.Spec(docker.Name)
+		p := newTestProvider(t, s, spec, map[string]interface{}{"mounts": []string{mount}})
+		errs := p.Validate(spec.Config)
+		if len(errs) != 1 || errs[0].Path != "provider_options.mounts[0]" || !strings.Contains(errs[0].Message, want) {
+			t.Errorf("Validate() of mount %q = %v, want %s", mount, errs, want)
+		}
+	}
+}
+
+func TestBuildImage(t *testing.T) {
+	s := newServer(t)
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM ubuntu:22.04\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	spec := providertest.Spec(docker.Name)
+	p := newTestProvider(t, s, spec, map[string]interface{}{"build": dir})
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+
+	spec = providertest.Spec(docker.Name)
+	p = newTestProvider(t, s, spec, map[string]interface{}{"build": dir, "dockerfile": "dev.Dockerfile"})
+	if _, err := p.Create(ctx, spec); err == nil || !strings.Contains(err.Error(), "Cannot locate specified Dockerfile") {
+		t.Errorf("Create() without the Dockerfile error = %v, want the build error", err)
+	}
+}
+
+func TestPullError(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(docker.Name)
+	spec.Config.Image = "missing/image"
+	p := newTestProvider(t, s, spec, nil)
+	if _, err := p.Create(context.Background(), spec); err == nil || !strings.Contains(err.Error(), "pull access denied") {
+		t.Errorf("Create() error = %v, want the pull error", err)
+	}
+}
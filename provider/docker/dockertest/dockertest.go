@@ -0,0 +1,466 @@
+// Package dockertest implements an in-memory fake of the Docker Engine API,
+// served on a unix socket, for testing the docker provider.
+//
+// The fake implements the endpoints used by the provider. Containers don't
+// run anything, they only change state.
+package dockertest
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// Server is a fake Docker Engine API server.
+type Server struct {
+	// Host is the address of the server, in the DOCKER_HOST format.
+	Host string
+
+	dir      string
+	listener net.Listener
+	server   *http.Server
+
+	mu         sync.Mutex
+	nextID     int
+	nextPort   int
+	images     map[string]bool
+	volumes    map[string]map[string]string
+	containers map[string]*container
+}
+
+type container struct {
+	ID      string
+	Name    string
+	Created time.Time
+	Status  string
+	Config  map[string]interface{}
+	Labels  map[string]string
+	Host    hostConfig
+	Ports   map[string][]binding
+	Files   map[string][]byte
+	// Logs is the output of the container.
+	Logs string
+}
+
+type hostConfig struct {
+	PortBindings map[string][]binding `json:"PortBindings"`
+	Mounts       []struct {
+		Type   string `json:"Type"`
+		Source string `json:"Source"`
+		Target string `json:"Target"`
+	} `json:"Mounts"`
+	NanoCPUs int64 `json:"NanoCpus"`
+	Memory   int64 `json:"Memory"`
+}
+
+type binding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+// NewServer starts a fake API server on a unix socket in a temporary
+// directory. The caller must close it.
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "dockertest")
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &Server{
+		Host:       "unix://" + socket,
+		dir:        dir,
+		listener:   l,
+		nextPort:   32768,
+		images:     map[string]bool{},
+		volumes:    map[string]map[string]string{},
+		containers: map[string]*container{},
+	}
+	s.server = &http.Server{Handler: http.HandlerFunc(s.serve)}
+	go s.server.Serve(l)
+	return s, nil
+}
+
+// Close stops the server and removes its socket.
+func (s *Server) Close() error {
+	err := s.server.Close()
+	os.RemoveAll(s.dir)
+	return err
+}
+
+// Resources returns the number of containers and volumes that exist, to
+// check for leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.containers) + len(s.volumes)
+}
+
+// File returns the content of a file copied to a container, and false if
+// none was copied to the path.
+func (s *Server) File(id, path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct := s.find(id)
+	if ct == nil {
+		return nil, false
+	}
+	data, ok := ct.Files[path]
+	return data, ok
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := r.URL.Path
+	if i := strings.Index(path[1:], "/"); i >= 0 && strings.HasPrefix(path, "/v1.") {
+		path = path[i+1:]
+	}
+	switch {
+	case path == "/images/create" && r.Method == http.MethodPost:
+		s.pull(w, r)
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json") && r.Method == http.MethodGet:
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+		if !s.images[normalize(name)] {
+			writeError(w, http.StatusNotFound, "No such image: "+name)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"Id": name})
+	case path == "/build" && r.Method == http.MethodPost:
+		s.build(w, r)
+	case path == "/volumes/create" && r.Method == http.MethodPost:
+		var in struct {
+			Name   string            `json:"Name"`
+			Labels map[string]string `json:"Labels"`
+		}
+		if !decode(w, r, &in) {
+			return
+		}
+		if _, ok := s.volumes[in.Name]; !ok {
+			s.volumes[in.Name] = in.Labels
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"Name": in.Name})
+	case path == "/volumes" && r.Method == http.MethodGet:
+		var volumes []map[string]interface{}
+		for name, labels := range s.volumes {
+			if matchLabels(r, labels) {
+				volumes = append(volumes, map[string]interface{}{"Name": name, "Labels": labels})
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"Volumes": volumes})
+	case strings.HasPrefix(path, "/volumes/") && r.Method == http.MethodDelete:
+		name := strings.TrimPrefix(path, "/volumes/")
+		if _, ok := s.volumes[name]; !ok {
+			writeError(w, http.StatusNotFound, "get "+name+": no such volume")
+			return
+		}
+		for _, ct := range s.containers {
+			for _, m := range ct.Host.Mounts {
+				if m.Type == "volume" && m.Source == name {
+					writeError(w, http.StatusConflict, "remove "+name+": volume is in use")
+					return
+				}
+			}
+		}
+		delete(s.volumes, name)
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/containers/create" && r.Method == http.MethodPost:
+		s.create(w, r)
+	case path == "/containers/json" && r.Method == http.MethodGet:
+		var list []map[string]interface{}
+		for _, ct := range s.containers {
+			if matchLabels(r, ct.Labels) && (ct.Status == "running" || r.URL.Query().Get("all") != "") {
+				list = append(list, map[string]interface{}{"Id": ct.ID, "Names": []string{"/" + ct.Name}, "Labels": ct.Labels, "State": ct.Status})
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case strings.HasPrefix(path, "/containers/"):
+		s.serveContainer(w, r, strings.TrimPrefix(path, "/containers/"))
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func (s *Server) pull(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("fromImage")
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		name += ":" + tag
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]string{"status": "Pulling from " + name})
+	if strings.HasPrefix(name, "missing") {
+		enc.Encode(map[string]string{"error": "pull access denied for " + name})
+		return
+	}
+	s.images[normalize(name)] = true
+	enc.Encode(map[string]string{"status": "Downloaded newer image for " + name})
+}
+
+func (s *Server) build(w http.ResponseWriter, r *http.Request) {
+	dockerfile := r.URL.Query().Get("dockerfile")
+	found := false
+	tr := tar.NewReader(r.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid build context: "+err.Error())
+			return
+		}
+		found = found || hdr.Name == dockerfile
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if !found {
+		enc.Encode(map[string]string{"error": "Cannot locate specified Dockerfile: " + dockerfile})
+		return
+	}
+	enc.Encode(map[string]string{"stream": "Successfully built"})
+	s.images[normalize(r.URL.Query().Get("t"))] = true
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Image      string            `json:"Image"`
+		Labels     map[string]string `json:"Labels"`
+		HostConfig hostConfig        `json:"HostConfig"`
+	}
+	var raw map[string]interface{}
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &in)
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if s.find(name) != nil {
+		writeError(w, http.StatusConflict, "Conflict. The container name \"/"+name+"\" is already in use")
+		return
+	}
+	if !s.images[normalize(in.Image)] {
+		writeError(w, http.StatusNotFound, "No such image: "+in.Image)
+		return
+	}
+	for _, m := range in.HostConfig.Mounts {
+		if m.Type == "volume" {
+			if _, ok := s.volumes[m.Source]; !ok {
+				s.volumes[m.Source] = nil
+			}
+		}
+	}
+	s.nextID++
+	ct := &container{
+		ID:      fmt.Sprintf("%064x", s.nextID),
+		Name:    name,
+		Created: time.Now().UTC(),
+		Status:  "created",
+		Config:  raw,
+		Labels:  in.Labels,
+		Host:    in.HostConfig,
+		Files:   map[string][]byte{},
+	}
+	s.containers[ct.ID] = ct
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"Id": ct.ID, "Warnings": []string{}})
+}
+
+// normalize adds the latest tag to the image names without a tag.
+func normalize(image string) string {
+	if strings.Contains(image, "@") || strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+		return image
+	}
+	return image + ":latest"
+}
+
+// find returns the container with the ID or name, or nil.
+func (s *Server) find(idOrName string) *container {
+	if ct, ok := s.containers[idOrName]; ok {
+		return ct
+	}
+	for _, ct := range s.containers {
+		if ct.Name == idOrName {
+			return ct
+		}
+	}
+	return nil
+}
+
+func (s *Server) serveContainer(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.SplitN(path, "/", 2)
+	ct := s.find(parts[0])
+	if ct == nil {
+		writeError(w, http.StatusNotFound, "No such container: "+parts[0])
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "json" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"Id":      ct.ID,
+			"Name":    "/" + ct.Name,
+			"Created": ct.Created.Format(time.RFC3339Nano),
+			"State":   map[string]interface{}{"Status": ct.Status, "Running": ct.Status == "running"},
+			"Config":  map[string]interface{}{"Image": ct.Config["Image"], "Labels": ct.Labels},
+			"HostConfig": map[string]interface{}{
+				"NanoCpus": ct.Host.NanoCPUs,
+				"Memory":   ct.Host.Memory,
+			},
+			"NetworkSettings": map[string]interface{}{"Ports": ct.Ports},
+		})
+	case action == "archive" && r.Method == http.MethodPut:
+		dir := r.URL.Query().Get("path")
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid archive: "+err.Error())
+				return
+			}
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid archive: "+err.Error())
+				return
+			}
+			ct.Files[filepath.Join(dir, hdr.Name)] = data
+		}
+		w.WriteHeader(http.StatusOK)
+	case action == "start" && r.Method == http.MethodPost:
+		if ct.Status == "running" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		ct.Status = "running"
+		// The bootstrap prints the SSH host keys.
+		ct.Logs += providertest.ConsoleOutput
+		ct.Ports = map[string][]binding{}
+		for port, bindings := range ct.Host.PortBindings {
+			for _, b := range bindings {
+				if b.HostPort == "" {
+					s.nextPort++
+					b.HostPort = strconv.Itoa(s.nextPort)
+				}
+				if b.HostIP == "" {
+					b.HostIP = "0.0.0.0"
+				}
+				ct.Ports[port] = append(ct.Ports[port], b)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "logs" && r.Method == http.MethodGet:
+		// Without a TTY, the logs are multiplexed in frames, one per line
+		// of stdout here.
+		var b bytes.Buffer
+		for _, line := range strings.SplitAfter(ct.Logs, "\n") {
+			if line == "" {
+				continue
+			}
+			header := [8]byte{1}
+			binary.BigEndian.PutUint32(header[4:], uint32(len(line)))
+			b.Write(header[:])
+			b.WriteString(line)
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+		w.Write(b.Bytes())
+	case action == "stop" && r.Method == http.MethodPost:
+		if ct.Status != "running" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		ct.Status = "exited"
+		ct.Ports = nil
+		w.WriteHeader(http.StatusNoContent)
+	case action == "update" && r.Method == http.MethodPost:
+		var in struct {
+			NanoCPUs int64 `json:"NanoCpus"`
+			Memory   int64 `json:"Memory"`
+		}
+		if !decode(w, r, &in) {
+			return
+		}
+		if in.NanoCPUs != 0 {
+			ct.Host.NanoCPUs = in.NanoCPUs
+		}
+		if in.Memory != 0 {
+			ct.Host.Memory = in.Memory
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"Warnings": []string{}})
+	case action == "" && r.Method == http.MethodDelete:
+		if ct.Status == "running" && r.URL.Query().Get("force") == "" {
+			writeError(w, http.StatusConflict, "You cannot remove a running container "+ct.ID)
+			return
+		}
+		delete(s.containers, ct.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+// matchLabels returns true if the labels match the label filters of the
+// request, each a key or a key=value.
+func matchLabels(r *http.Request, labels map[string]string) bool {
+	var filters map[string][]string
+	if f := r.URL.Query().Get("filters"); f != "" {
+		if err := json.Unmarshal([]byte(f), &filters); err != nil {
+			return false
+		}
+	}
+	for _, f := range filters["label"] {
+		kv := strings.SplitN(f, "=", 2)
+		v, ok := labels[kv[0]]
+		if !ok || len(kv) == 2 && v != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"message": msg})
+}
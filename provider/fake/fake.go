@@ -0,0 +1,177 @@
+// Package fake implements an in-memory provider for testing.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Provider is an in-memory provider. Machines are created running and get an
+// address from the 192.0.2.0/24 documentation range.
+type Provider struct {
+	mu       sync.Mutex
+	nextID   int
+	machines map[string]*machine
+}
+
+// machine is a machine with the configuration it was created with.
+type machine struct {
+	provider.Machine
+	config config.Config
+}
+
+var _ provider.Provider = &Provider{}
+
+// New returns an empty in-memory provider.
+func New() *Provider {
+	return &Provider{machines: map[string]*machine{}}
+}
+
+// Register registers the provider under the given name. All the
+// configurations share the returned provider.
+func Register(name string) *Provider {
+	p := New()
+	provider.Register(name, func(*config.Config) (provider.Provider, error) {
+		return p, nil
+	})
+	return p
+}
+
+// Validate implements provider.Provider. The fake provider has no options.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts struct{}
+	return c.DecodeOptions(&opts)
+}
+
+// Plan implements provider.Provider.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fm, ok := p.machines[m.ID]
+	if !ok {
+		return nil, provider.ErrNotFound
+	}
+
+	old, c := fm.config, spec.Config
+	var changes []provider.Change
+	for _, f := range []struct {
+		field    string
+		old, new string
+	}{
+		{"region", old.Region, c.Region},
+		{"machine_type", old.MachineType, c.MachineType},
+		{"image", old.Image, c.Image},
+		{"disk.size_gb", strconv.Itoa(old.Disk.SizeGB), strconv.Itoa(c.Disk.SizeGB)},
+		{"disk.type", old.Disk.Type, c.Disk.Type},
+		{"ports", fmt.Sprint(old.Ports), fmt.Sprint(c.Ports)},
+	} {
+		if f.old != f.new {
+			changes = append(changes, provider.Change{Field: f.field, Old: f.old, New: f.new, Replace: true})
+		}
+	}
+	return changes, nil
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	id := fmt.Sprintf("fake-%d", p.nextID)
+	m := &machine{
+		Machine: provider.Machine{
+			ID:      id,
+			Name:    spec.Config.Name,
+			Status:  provider.StatusRunning,
+			Address: fmt.Sprintf("192.0.2.%d", p.nextID%254+1),
+			Resources: map[string]string{
+				provider.ResourceInstance: id,
+				provider.ResourceDisk:     id + "-disk",
+				provider.ResourceFirewall: id + "-firewall",
+			},
+			CreatedAt: time.Now().UTC(),
+		},
+		config: *spec.Config,
+	}
+	p.machines[id] = m
+	return m.copy(), nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.machines[id]
+	if !ok {
+		return nil, provider.ErrNotFound
+	}
+	return m.copy(), nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	return p.setStatus(id, provider.StatusRunning)
+}
+
+// Stop implements provider.Provider.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	return p.setStatus(id, provider.StatusStopped)
+}
+
+func (p *Provider) setStatus(id string, status provider.Status) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.machines[id]
+	if !ok {
+		return provider.ErrNotFound
+	}
+	m.Status = status
+	return nil
+}
+
+// Destroy implements provider.Provider.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.machines, m.Resources[provider.ResourceInstance])
+	return nil
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	machines := make([]*provider.Machine, 0, len(p.machines))
+	for _, m := range p.machines {
+		machines = append(machines, m.copy())
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].ID < machines[j].ID
+	})
+	return machines, nil
+}
+
+func (m *machine) copy() *provider.Machine {
+	c := m.Machine
+	c.Resources = make(map[string]string, len(m.Resources))
+	for k, v := range m.Resources {
+		c.Resources[k] = v
+	}
+	return &c
+}
+
+// MachineSizes implements provider.Sizer.
+func (p *Provider) MachineSizes() []provider.MachineSize {
+	return []provider.MachineSize{
+		{Name: "small", CPUs: 1, MemoryMB: 2048},
+		{Name: "medium", CPUs: 2, MemoryMB: 4096},
+		{Name: "large", CPUs: 4, MemoryMB: 16384},
+	}
+}
@@ -0,0 +1,12 @@
+package fake_test
+
+import (
+	"testing"
+
+	"github.com/darkowlzz/clouddev/provider/fake"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, fake.New(), providertest.Spec("fake"))
+}
@@ -0,0 +1,187 @@
+package gce
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+const (
+	defaultTokenURL = "https://oauth2.googleapis.com/token"
+	scope           = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// credentials are the Google credentials the API access tokens are
+// obtained with, in order of preference:
+//
+//   - the GOOGLE_OAUTH_ACCESS_TOKEN environment variable,
+//   - the credentials file named by GOOGLE_APPLICATION_CREDENTIALS, a
+//     service account key or an authorized user file,
+//   - the application default credentials of gcloud.
+type credentials struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// credentialsFile is a service account key or an authorized user
+// credentials file.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// Service account keys.
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	// Authorized users.
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (c *credentials) authorize(req *http.Request) error {
+	token, err := c.accessToken(req.Context())
+	if err != nil {
+		return fmt.Errorf("failed to get a Google access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (c *credentials) accessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expiry) > time.Minute {
+		return c.token, nil
+	}
+
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		var err error
+		path, err = homedir.Expand("~/.config/gcloud/application_default_credentials.json")
+		if err != nil {
+			return "", err
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", errors.New("no credentials found, set GOOGLE_APPLICATION_CREDENTIALS or run gcloud auth application-default login")
+	}
+	if err != nil {
+		return "", err
+	}
+	var f credentialsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return "", fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+
+	var form url.Values
+	tokenURL := defaultTokenURL
+	switch f.Type {
+	case "service_account":
+		if f.TokenURI != "" {
+			tokenURL = f.TokenURI
+		}
+		assertion, err := f.assertion(tokenURL, time.Now())
+		if err != nil {
+			return "", fmt.Errorf("invalid credentials file %s: %w", path, err)
+		}
+		form = url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+	case "authorized_user":
+		form = url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {f.ClientID},
+			"client_secret": {f.ClientSecret},
+			"refresh_token": {f.RefreshToken},
+		}
+	default:
+		return "", fmt.Errorf("unsupported credentials type %q in %s", f.Type, path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, token.ErrorDescription)
+	}
+	c.token = token.AccessToken
+	c.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// assertion returns the signed JWT a service account exchanges for an
+// access token.
+func (f *credentialsFile) assertion(audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(f.PrivateKey))
+	if block == nil {
+		return "", errors.New("invalid private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("invalid private key: %w", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private key is not an RSA key")
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   f.ClientEmail,
+		"scope": scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,698 @@
+// Package gce implements a provider that provisions environments on Google
+// Compute Engine instances.
+//
+// See credentials for how the API is authenticated.
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/internal/rest"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "gce"
+
+const (
+	defaultAPIURL       = "https://compute.googleapis.com/compute/v1"
+	defaultMachineType  = "e2-medium"
+	defaultImage        = "ubuntu-2204-lts"
+	defaultImageProject = "ubuntu-os-cloud"
+	defaultDiskType     = "pd-balanced"
+	// label marks the instances created by clouddev.
+	label = "clouddev"
+	// imageKey is the instance metadata key recording the image the
+	// instance was created from.
+	imageKey = "clouddev-image"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the GCE provider_options.
+type options struct {
+	Project string `mapstructure:"project"`
+	// Zone is the zone of the instance, <region>-a if empty.
+	Zone string `mapstructure:"zone"`
+	// ImageProject is the project of the image family.
+	ImageProject string   `mapstructure:"image_project"`
+	Network      string   `mapstructure:"network"`
+	Subnetwork   string   `mapstructure:"subnetwork"`
+	Tags         []string `mapstructure:"tags"`
+	// ServiceAccount is the email of the service account of the instance,
+	// the default compute service account if empty.
+	ServiceAccount string   `mapstructure:"service_account"`
+	Scopes         []string `mapstructure:"scopes"`
+	Preemptible    bool     `mapstructure:"preemptible"`
+	Spot           bool     `mapstructure:"spot"`
+	// StaticIP reserves a static external IP address for the instance.
+	StaticIP bool `mapstructure:"static_ip"`
+	// APIURL is the URL of the Compute Engine API.
+	APIURL string `mapstructure:"api_url"`
+}
+
+// Provider provisions Compute Engine instances.
+type Provider struct {
+	cfg  *config.Config
+	opts options
+	api  *rest.Client
+	// PollInterval is the interval between the checks of the progress of
+	// operations.
+	PollInterval time.Duration
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns a GCE provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	if opts.APIURL == "" {
+		opts.APIURL = defaultAPIURL
+	}
+	if opts.Zone == "" && c.Region != "" {
+		opts.Zone = c.Region + "-a"
+	}
+	if opts.ImageProject == "" {
+		opts.ImageProject = defaultImageProject
+	}
+	if opts.Network == "" {
+		opts.Network = "default"
+	}
+	if opts.ServiceAccount == "" {
+		opts.ServiceAccount = "default"
+	}
+	if len(opts.Scopes) == 0 {
+		opts.Scopes = []string{scope}
+	}
+	return &Provider{
+		cfg:  c,
+		opts: opts,
+		api: &rest.Client{
+			BaseURL:      opts.APIURL,
+			Authorize:    (&credentials{}).authorize,
+			ErrorMessage: errorMessage,
+		},
+		PollInterval: 2 * time.Second,
+	}
+}
+
+func errorMessage(body []byte) string {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &e)
+	return e.Error.Message
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	if c.Region == "" {
+		errs = append(errs, &config.FieldError{Path: "region", Message: "is required, e.g. us-central1"})
+	}
+	if opts.Project == "" {
+		errs = append(errs, &config.FieldError{Path: "provider_options.project", Message: "is required"})
+	}
+	if opts.Zone != "" && c.Region != "" && !strings.HasPrefix(opts.Zone, c.Region+"-") {
+		errs = append(errs, &config.FieldError{Path: "provider_options.zone", Message: fmt.Sprintf("must be a zone of region %s", c.Region)})
+	}
+	if opts.Preemptible && opts.Spot {
+		errs = append(errs, &config.FieldError{Path: "provider_options.spot", Message: "can't be used with preemptible"})
+	}
+	// Resource names are at most 63 characters.
+	if max := 63 - len(namePrefix); len(c.Name) > max {
+		errs = append(errs, &config.FieldError{Path: "name", Message: fmt.Sprintf("must be at most %d characters on gce, got %d", max, len(c.Name))})
+	}
+	return errs
+}
+
+func (p *Provider) machineType(c *config.Config) string {
+	if c.MachineType == "" {
+		return defaultMachineType
+	}
+	return c.MachineType
+}
+
+// image returns the source image, the configured image family in the image
+// project unless the image is a path.
+func (p *Provider) image(c *config.Config) string {
+	image := c.Image
+	if image == "" {
+		image = defaultImage
+	}
+	if strings.Contains(image, "/") {
+		return image
+	}
+	return fmt.Sprintf("projects/%s/global/images/family/%s", p.opts.ImageProject, image)
+}
+
+func (p *Provider) diskType(c *config.Config) string {
+	if c.Disk.Type == "" {
+		return defaultDiskType
+	}
+	return c.Disk.Type
+}
+
+// namePrefix prefixes the names of the instances, firewall rules and
+// static IPs of the environments, so that they don't clash with the other
+// resources of the project.
+const namePrefix = "clouddev-"
+
+// resourceName is the name of the instance, the firewall rule and the static
+// IP of the environment.
+func resourceName(name string) string {
+	return namePrefix + name
+}
+
+// networkTag is the network tag the firewall rule of the environment
+// targets.
+func networkTag(name string) string {
+	return namePrefix + name
+}
+
+func (p *Provider) projectPath() string {
+	return "/projects/" + url.PathEscape(p.opts.Project)
+}
+
+func (p *Provider) zonePath() string {
+	return p.projectPath() + "/zones/" + url.PathEscape(p.opts.Zone)
+}
+
+func (p *Provider) regionPath() string {
+	return p.projectPath() + "/regions/" + url.PathEscape(p.cfg.Region)
+}
+
+func (p *Provider) globalPath() string {
+	return p.projectPath() + "/global"
+}
+
+// instance is an instance as returned by the API.
+type instance struct {
+	Name        string            `json:"name"`
+	Zone        string            `json:"zone"`
+	Status      string            `json:"status"`
+	MachineType string            `json:"machineType"`
+	Labels      map[string]string `json:"labels"`
+	Tags        struct {
+		Items       []string `json:"items"`
+		Fingerprint string   `json:"fingerprint"`
+	} `json:"tags"`
+	Disks []struct {
+		Source     string `json:"source"`
+		Boot       bool   `json:"boot"`
+		DiskSizeGB int64  `json:"diskSizeGb,string"`
+	} `json:"disks"`
+	NetworkInterfaces []struct {
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+	Scheduling struct {
+		Preemptible       bool   `json:"preemptible"`
+		ProvisioningModel string `json:"provisioningModel"`
+	} `json:"scheduling"`
+	Metadata struct {
+		Items []metadataItem `json:"items"`
+	} `json:"metadata"`
+	CreationTimestamp time.Time `json:"creationTimestamp"`
+}
+
+type metadataItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (i *instance) machine() *provider.Machine {
+	m := &provider.Machine{
+		ID:        i.Name,
+		Name:      strings.TrimPrefix(i.Name, namePrefix),
+		Status:    status(i.Status),
+		Resources: map[string]string{provider.ResourceInstance: i.Name},
+		CreatedAt: i.CreationTimestamp,
+	}
+	for _, n := range i.NetworkInterfaces {
+		for _, ac := range n.AccessConfigs {
+			if ac.NatIP != "" {
+				m.Address = ac.NatIP
+			}
+		}
+	}
+	return m
+}
+
+func (i *instance) metadata(key string) string {
+	for _, item := range i.Metadata.Items {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return ""
+}
+
+func (i *instance) bootDisk() (name string, sizeGB int64) {
+	for _, d := range i.Disks {
+		if d.Boot {
+			return path.Base(d.Source), d.DiskSizeGB
+		}
+	}
+	return "", 0
+}
+
+func status(s string) provider.Status {
+	switch s {
+	case "PROVISIONING", "STAGING":
+		return provider.StatusPending
+	case "RUNNING":
+		return provider.StatusRunning
+	case "STOPPING", "STOPPED", "TERMINATED", "SUSPENDING", "SUSPENDED":
+		return provider.StatusStopped
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// operation is a long running operation.
+type operation struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// do sends a request that starts an operation of the scope, e.g. the zone
+// path, and waits for the operation to be done.
+func (p *Provider) do(ctx context.Context, method, scopePath, path string, in interface{}) error {
+	var op operation
+	if err := p.api.Do(ctx, method, path, in, &op); err != nil {
+		return err
+	}
+	opPath := scopePath + "/operations/" + url.PathEscape(op.Name)
+	return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		if op.Status == "DONE" {
+			if op.Error != nil && len(op.Error.Errors) > 0 {
+				msgs := make([]string, len(op.Error.Errors))
+				for i, e := range op.Error.Errors {
+					msgs[i] = e.Message
+				}
+				return false, fmt.Errorf("operation %s failed: %s", op.Name, strings.Join(msgs, "; "))
+			}
+			return true, nil
+		}
+		return false, p.api.Do(ctx, http.MethodGet, opPath, nil, &op)
+	})
+}
+
+// UserDataLimit implements provider.UserDataLimiter. Metadata values are
+// limited to 256 KiB.
+func (p *Provider) UserDataLimit() int {
+	return 262144
+}
+
+// MachineSizes implements provider.Sizer with the E2 machine types.
+func (p *Provider) MachineSizes() []provider.MachineSize {
+	return []provider.MachineSize{
+		{Name: "e2-small", CPUs: 2, MemoryMB: 2048},
+		{Name: "e2-medium", CPUs: 2, MemoryMB: 4096},
+		{Name: "e2-standard-2", CPUs: 2, MemoryMB: 8192},
+		{Name: "e2-standard-4", CPUs: 4, MemoryMB: 16384},
+		{Name: "e2-standard-8", CPUs: 8, MemoryMB: 32768},
+		{Name: "e2-standard-16", CPUs: 16, MemoryMB: 65536},
+		{Name: "e2-standard-32", CPUs: 32, MemoryMB: 131072},
+	}
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}, CreatedAt: time.Now().UTC()}
+	name := resourceName(c.Name)
+
+	var address string
+	if p.opts.StaticIP {
+		if err := p.do(ctx, http.MethodPost, p.regionPath(), p.regionPath()+"/addresses", map[string]interface{}{
+			"name":   name,
+			"labels": map[string]string{label: "true"},
+		}); err != nil {
+			return m, fmt.Errorf("failed to reserve static IP: %w", err)
+		}
+		m.Resources[provider.ResourceIP] = name
+		var resp struct {
+			Address string `json:"address"`
+		}
+		if err := p.api.Do(ctx, http.MethodGet, p.regionPath()+"/addresses/"+name, nil, &resp); err != nil {
+			return m, fmt.Errorf("failed to get static IP: %w", err)
+		}
+		address = resp.Address
+	}
+
+	if err := p.do(ctx, http.MethodPost, p.globalPath(), p.globalPath()+"/firewalls", p.firewall(name, c)); err != nil {
+		return m, fmt.Errorf("failed to create firewall rule: %w", err)
+	}
+	m.Resources[provider.ResourceFirewall] = name
+
+	accessConfig := map[string]interface{}{"name": "External NAT", "type": "ONE_TO_ONE_NAT"}
+	if address != "" {
+		accessConfig["natIP"] = address
+	}
+	networkInterface := map[string]interface{}{
+		"network":       "global/networks/" + p.opts.Network,
+		"accessConfigs": []interface{}{accessConfig},
+	}
+	if p.opts.Subnetwork != "" {
+		networkInterface["subnetwork"] = fmt.Sprintf("regions/%s/subnetworks/%s", c.Region, p.opts.Subnetwork)
+	}
+	scheduling := map[string]interface{}{}
+	switch {
+	case p.opts.Spot:
+		scheduling["provisioningModel"] = "SPOT"
+		scheduling["instanceTerminationAction"] = "STOP"
+	case p.opts.Preemptible:
+		scheduling["preemptible"] = true
+		scheduling["automaticRestart"] = false
+	}
+	image := p.image(c)
+	req := map[string]interface{}{
+		"name":        name,
+		"machineType": fmt.Sprintf("zones/%s/machineTypes/%s", p.opts.Zone, p.machineType(c)),
+		"labels":      map[string]string{label: "true"},
+		"tags":        map[string]interface{}{"items": append([]string{networkTag(c.Name)}, p.opts.Tags...)},
+		"disks": []interface{}{map[string]interface{}{
+			"boot":       true,
+			"autoDelete": true,
+			"initializeParams": map[string]interface{}{
+				"sourceImage": image,
+				"diskSizeGb":  strconv.Itoa(c.Disk.SizeGB),
+				"diskType":    fmt.Sprintf("zones/%s/diskTypes/%s", p.opts.Zone, p.diskType(c)),
+			},
+		}},
+		"networkInterfaces": []interface{}{networkInterface},
+		"serviceAccounts": []interface{}{map[string]interface{}{
+			"email":  p.opts.ServiceAccount,
+			"scopes": p.opts.Scopes,
+		}},
+		"scheduling": scheduling,
+		"metadata": map[string]interface{}{"items": []metadataItem{
+			{Key: "ssh-keys", Value: c.SSH.User + ":" + spec.SSHPublicKey},
+			{Key: "user-data", Value: string(spec.UserData)},
+			{Key: imageKey, Value: image},
+		}},
+	}
+	if err := p.do(ctx, http.MethodPost, p.zonePath(), p.zonePath()+"/instances", req); err != nil {
+		if !rest.HasStatus(err, http.StatusConflict) {
+			// The instance may exist when the operation fails.
+			m.ID = name
+			m.Resources[provider.ResourceInstance] = name
+		}
+		return m, fmt.Errorf("failed to create instance: %w", err)
+	}
+	m.ID = name
+	m.Resources[provider.ResourceInstance] = name
+
+	// The instance is provisioned and staged before it runs.
+	var i *instance
+	err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		var err error
+		if i, err = p.instance(ctx, name); err != nil {
+			return false, err
+		}
+		if s := status(i.Status); s == provider.StatusStopped || s == provider.StatusUnknown {
+			return false, fmt.Errorf("instance %s is %s", name, i.Status)
+		}
+		return i.Status == "RUNNING", nil
+	})
+	if err != nil {
+		return m, fmt.Errorf("failed waiting for instance %s to be running: %w", name, err)
+	}
+	im := i.machine()
+	im.Resources = m.Resources
+	return im, nil
+}
+
+// firewall returns the firewall rule opening the configured ports to the
+// instance of the environment.
+func (p *Provider) firewall(name string, c *config.Config) map[string]interface{} {
+	ports := make([]string, len(c.Ports))
+	for i, port := range c.Ports {
+		ports[i] = strconv.Itoa(port)
+	}
+	return map[string]interface{}{
+		"name":         name,
+		"network":      "global/networks/" + p.opts.Network,
+		"direction":    "INGRESS",
+		"allowed":      []interface{}{map[string]interface{}{"IPProtocol": "tcp", "ports": ports}},
+		"sourceRanges": []string{"0.0.0.0/0"},
+		"targetTags":   []string{networkTag(c.Name)},
+	}
+}
+
+func (p *Provider) instance(ctx context.Context, name string) (*instance, error) {
+	var i instance
+	if err := p.api.Do(ctx, http.MethodGet, p.zonePath()+"/instances/"+url.PathEscape(name), nil, &i); err != nil {
+		if rest.IsNotFound(err) {
+			return nil, provider.ErrNotFound
+		}
+		return nil, err
+	}
+	return &i, nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	i, err := p.instance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return i.machine(), nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	return p.instanceAction(ctx, id, "start", nil)
+}
+
+// Stop implements provider.Provider.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	return p.instanceAction(ctx, id, "stop", nil)
+}
+
+// ConsoleOutput implements provider.ConsoleReader with the output of the
+// first serial port.
+func (p *Provider) ConsoleOutput(ctx context.Context, id string) (string, error) {
+	var out struct {
+		Contents string `json:"contents"`
+	}
+	if err := p.api.Do(ctx, http.MethodGet, p.zonePath()+"/instances/"+url.PathEscape(id)+"/serialPort?port=1", nil, &out); err != nil {
+		if rest.IsNotFound(err) {
+			return "", provider.ErrNotFound
+		}
+		return "", err
+	}
+	return out.Contents, nil
+}
+
+func (p *Provider) instanceAction(ctx context.Context, id, action string, in interface{}) error {
+	err := p.do(ctx, http.MethodPost, p.zonePath(), p.zonePath()+"/instances/"+url.PathEscape(id)+"/"+action, in)
+	if rest.IsNotFound(err) {
+		return provider.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("instance %s %s: %w", id, action, err)
+	}
+	return nil
+}
+
+// Destroy implements provider.Provider.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	if name := m.Resources[provider.ResourceInstance]; name != "" {
+		if err := p.delete(ctx, p.zonePath(), p.zonePath()+"/instances/"+url.PathEscape(name)); err != nil {
+			return fmt.Errorf("failed to delete instance %s: %w", name, err)
+		}
+	}
+	if name := m.Resources[provider.ResourceFirewall]; name != "" {
+		if err := p.delete(ctx, p.globalPath(), p.globalPath()+"/firewalls/"+url.PathEscape(name)); err != nil {
+			return fmt.Errorf("failed to delete firewall rule %s: %w", name, err)
+		}
+	}
+	if name := m.Resources[provider.ResourceIP]; name != "" {
+		if err := p.delete(ctx, p.regionPath(), p.regionPath()+"/addresses/"+url.PathEscape(name)); err != nil {
+			return fmt.Errorf("failed to release static IP %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// delete deletes a resource, ignoring the resources that don't exist.
+func (p *Provider) delete(ctx context.Context, scopePath, path string) error {
+	err := p.do(ctx, http.MethodDelete, scopePath, path, nil)
+	if rest.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List implements provider.Provider. Only the instances in the configured
+// zone are listed.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	var machines []*provider.Machine
+	query := url.Values{"filter": {"labels." + label + "=true"}}
+	for {
+		var resp struct {
+			Items         []instance `json:"items"`
+			NextPageToken string     `json:"nextPageToken"`
+		}
+		if err := p.api.Do(ctx, http.MethodGet, p.zonePath()+"/instances?"+query.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		for i := range resp.Items {
+			machines = append(machines, resp.Items[i].machine())
+		}
+		if resp.NextPageToken == "" {
+			return machines, nil
+		}
+		query.Set("pageToken", resp.NextPageToken)
+	}
+}
+
+// Plan implements provider.Provider. The machine type, the network tags,
+// the firewall ports and growing the boot disk are updated in place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	i, err := p.instance(ctx, m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []provider.Change
+	if zone := path.Base(i.Zone); zone != p.opts.Zone {
+		changes = append(changes, provider.Change{Field: "provider_options.zone", Old: zone, New: p.opts.Zone, Replace: true})
+	}
+	if image := p.image(c); image != i.metadata(imageKey) {
+		changes = append(changes, provider.Change{Field: "image", Old: i.metadata(imageKey), New: image, Replace: true})
+	}
+	if mt := path.Base(i.MachineType); mt != p.machineType(c) {
+		changes = append(changes, provider.Change{Field: "machine_type", Old: mt, New: p.machineType(c)})
+	}
+	if _, size := i.bootDisk(); size != int64(c.Disk.SizeGB) {
+		changes = append(changes, provider.Change{
+			Field:   "disk.size_gb",
+			Old:     strconv.FormatInt(size, 10),
+			New:     strconv.Itoa(c.Disk.SizeGB),
+			Replace: int64(c.Disk.SizeGB) < size,
+		})
+	}
+	if old, new := i.Scheduling.ProvisioningModel == "SPOT", p.opts.Spot; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.spot", Old: strconv.FormatBool(old), New: strconv.FormatBool(new), Replace: true})
+	}
+	if old, new := i.Scheduling.Preemptible, p.opts.Preemptible; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.preemptible", Old: strconv.FormatBool(old), New: strconv.FormatBool(new), Replace: true})
+	}
+	tags := strings.Join(append([]string{networkTag(c.Name)}, p.opts.Tags...), ",")
+	if old := strings.Join(i.Tags.Items, ","); old != tags {
+		changes = append(changes, provider.Change{Field: "provider_options.tags", Old: old, New: tags})
+	}
+
+	if name := m.Resources[provider.ResourceFirewall]; name != "" {
+		var fw struct {
+			Allowed []struct {
+				Ports []string `json:"ports"`
+			} `json:"allowed"`
+		}
+		if err := p.api.Do(ctx, http.MethodGet, p.globalPath()+"/firewalls/"+url.PathEscape(name), nil, &fw); err != nil && !rest.IsNotFound(err) {
+			return nil, err
+		}
+		var ports []int
+		for _, a := range fw.Allowed {
+			for _, s := range a.Ports {
+				if port, err := strconv.Atoi(s); err == nil {
+					ports = append(ports, port)
+				}
+			}
+		}
+		if old, new := provider.FormatPorts(ports), provider.FormatPorts(c.Ports); old != new {
+			changes = append(changes, provider.Change{Field: "ports", Old: old, New: new})
+		}
+	}
+	return changes, nil
+}
+
+// Update implements provider.Updater.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	c := spec.Config
+	for _, ch := range changes {
+		switch ch.Field {
+		case "machine_type":
+			// The machine type of a running instance can't be changed.
+			if m.Status == provider.StatusRunning {
+				if err := p.Stop(ctx, m.ID); err != nil {
+					return err
+				}
+			}
+			if err := p.instanceAction(ctx, m.ID, "setMachineType", map[string]string{
+				"machineType": fmt.Sprintf("zones/%s/machineTypes/%s", p.opts.Zone, ch.New),
+			}); err != nil {
+				return err
+			}
+			if m.Status == provider.StatusRunning {
+				if err := p.Start(ctx, m.ID); err != nil {
+					return err
+				}
+			}
+		case "disk.size_gb":
+			i, err := p.instance(ctx, m.ID)
+			if err != nil {
+				return err
+			}
+			disk, _ := i.bootDisk()
+			if err := p.do(ctx, http.MethodPost, p.zonePath(), p.zonePath()+"/disks/"+url.PathEscape(disk)+"/resize", map[string]string{
+				"sizeGb": ch.New,
+			}); err != nil {
+				return fmt.Errorf("failed to resize disk %s: %w", disk, err)
+			}
+		case "provider_options.tags":
+			i, err := p.instance(ctx, m.ID)
+			if err != nil {
+				return err
+			}
+			if err := p.instanceAction(ctx, m.ID, "setTags", map[string]interface{}{
+				"items":       strings.Split(ch.New, ","),
+				"fingerprint": i.Tags.Fingerprint,
+			}); err != nil {
+				return err
+			}
+		case "ports":
+			name := m.Resources[provider.ResourceFirewall]
+			if err := p.do(ctx, http.MethodPatch, p.globalPath(), p.globalPath()+"/firewalls/"+url.PathEscape(name), p.firewall(name, c)); err != nil {
+				return fmt.Errorf("failed to update firewall rule %s: %w", name, err)
+			}
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+	return nil
+}
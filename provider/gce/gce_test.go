@@ -0,0 +1,179 @@
+package gce_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/gce"
+	"github.com/darkowlzz/clouddev/provider/gce/gcetest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// newTestProvider returns a provider of the spec against a fake API server.
+func newTestProvider(t *testing.T, s *gcetest.Server, spec *provider.Spec, opts map[string]interface{}) *gce.Provider {
+	t.Helper()
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", gcetest.Token)
+	spec.Config.Region = "us-central1"
+	spec.Config.ProviderOptions = map[string]interface{}{"project": "clouddev-test", "api_url": s.URL}
+	for k, v := range opts {
+		spec.Config.ProviderOptions[k] = v
+	}
+	p := gce.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *gcetest.Server {
+	s := gcetest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// requests records the paths of the requests to the server.
+type requests struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func record(s *gcetest.Server) *requests {
+	r := &requests{}
+	handler := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.paths = append(r.paths, req.Method+" "+req.URL.Path)
+		r.mu.Unlock()
+		handler.ServeHTTP(w, req)
+	})
+	return r
+}
+
+func (r *requests) count(prefix string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, p := range r.paths {
+		if strings.HasPrefix(p, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(gce.Name)
+	providertest.Run(t, newTestProvider(t, s, spec, nil), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after the suite", n)
+	}
+}
+
+func TestZoneOperationsArePolled(t *testing.T) {
+	s := newServer(t)
+	reqs := record(s)
+	spec := providertest.Spec(gce.Name)
+	p := newTestProvider(t, s, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer p.Destroy(ctx, m)
+	polls := "GET /projects/clouddev-test/zones/us-central1-a/operations/"
+	if n := reqs.count(polls); n != 1 {
+		t.Errorf("Create() polled %d zone operations, want 1", n)
+	}
+	if err := p.Stop(ctx, m.ID); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if n := reqs.count(polls); n != 2 {
+		t.Errorf("Stop() polled %d zone operations, want 1", n-1)
+	}
+	got, err := p.Get(ctx, m.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Status != provider.StatusStopped {
+		t.Errorf("Get() status = %q, want %q", got.Status, provider.StatusStopped)
+	}
+}
+
+func TestStaticIPIsReleased(t *testing.T) {
+	s := newServer(t)
+	reqs := record(s)
+	spec := providertest.Spec(gce.Name)
+	p := newTestProvider(t, s, spec, map[string]interface{}{"static_ip": true})
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if got := m.Resources[provider.ResourceIP]; got != "clouddev-conformance" {
+		t.Errorf("Create() static IP resource = %q, want clouddev-conformance", got)
+	}
+	if !strings.HasPrefix(m.Address, "203.0.113.") {
+		t.Errorf("Create() address = %q, want the reserved static IP", m.Address)
+	}
+	if n := reqs.count("GET /projects/clouddev-test/regions/us-central1/operations/"); n != 1 {
+		t.Errorf("Create() polled %d region operations, want the address insertion", n)
+	}
+
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := reqs.count("DELETE /projects/clouddev-test/regions/us-central1/addresses/clouddev-conformance"); n != 1 {
+		t.Errorf("Destroy() released the static IP %d times, want 1", n)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy()", n)
+	}
+}
+
+func TestCreateWaitsForTheInstance(t *testing.T) {
+	s := newServer(t)
+	reqs := record(s)
+	spec := providertest.Spec(gce.Name)
+	p := newTestProvider(t, s, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	// The instance is named like the other resources of the environment.
+	instance := "/projects/clouddev-test/zones/us-central1-a/instances/clouddev-conformance"
+	if m.ID != "clouddev-conformance" || m.Name != "conformance" || m.Resources[provider.ResourceInstance] != m.ID {
+		t.Errorf("Create() = ID %q, name %q, resources %v, want the instance clouddev-conformance", m.ID, m.Name, m.Resources)
+	}
+	// The fake provisions and stages the instance before it runs.
+	if m.Status != provider.StatusRunning {
+		t.Errorf("Create() status = %q, want %q", m.Status, provider.StatusRunning)
+	}
+	if n := reqs.count("GET " + instance); n != 3 {
+		t.Errorf("Create() got the instance %d times, want 3", n)
+	}
+
+	got, err := p.Get(ctx, m.ID)
+	if err != nil || got.Name != "conformance" {
+		t.Errorf("Get() = %+v, %v, want the environment conformance", got, err)
+	}
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := reqs.count("DELETE " + instance); n != 1 {
+		t.Errorf("Destroy() deleted the instance %d times, want 1", n)
+	}
+
+	// The prefixed name must fit in the 63 characters of a resource name.
+	spec.Config.Name = strings.Repeat("a", 55)
+	if errs := p.Validate(spec.Config); len(errs) != 1 || errs[0].Path != "name" {
+		t.Errorf("Validate() of a long name = %v, want an error on name", errs)
+	}
+}
@@ -0,0 +1,263 @@
+// Package gcetest implements an in-memory fake of the Compute Engine REST
+// API for testing the GCE provider.
+//
+// The fake implements the endpoints used by the provider for any project,
+// zone and region. Operations complete on their first poll. Instances are
+// provisioned, staged and then running on their first three gets.
+package gcetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// Token is the access token accepted by the fake.
+const Token = "gcetest-token"
+
+// Server is a fake Compute Engine API server.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	nextID int
+	// resources are keyed by their path relative to the project, e.g.
+	// zones/us-central1-a/instances/dev.
+	resources  map[string]map[string]interface{}
+	operations map[string]bool
+}
+
+// NewServer starts a fake API server. The caller must close it.
+func NewServer() *Server {
+	s := &Server{
+		resources:  map[string]map[string]interface{}{},
+		operations: map[string]bool{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Resources returns the number of instances, disks, firewall rules and
+// addresses that exist, to check for leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.resources)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		writeError(w, http.StatusUnauthorized, "Request had invalid authentication credentials.")
+		return
+	}
+	var in map[string]interface{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// /projects/<project>/<scope...>/<collection>[/<name>[/<method>]]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "projects" {
+		writeError(w, http.StatusNotFound, "The resource was not found.")
+		return
+	}
+	parts = parts[2:]
+	scope := 1
+	if parts[0] == "zones" || parts[0] == "regions" {
+		scope = 2
+	}
+	if len(parts) <= scope {
+		writeError(w, http.StatusNotFound, "The resource was not found.")
+		return
+	}
+	scopePath := strings.Join(parts[:scope], "/")
+	collection := parts[scope]
+	rest := parts[scope+1:]
+
+	if collection == "operations" && len(rest) == 1 && r.Method == http.MethodGet {
+		if _, ok := s.operations[rest[0]]; !ok {
+			writeError(w, http.StatusNotFound, "The resource was not found.")
+			return
+		}
+		s.operations[rest[0]] = true
+		write(w, map[string]interface{}{"name": rest[0], "status": "DONE"})
+		return
+	}
+
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		s.list(w, r, scopePath+"/"+collection+"/")
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		name, _ := in["name"].(string)
+		key := scopePath + "/" + collection + "/" + name
+		if _, ok := s.resources[key]; ok {
+			writeError(w, http.StatusConflict, fmt.Sprintf("The resource '%s' already exists", key))
+			return
+		}
+		s.insert(scopePath, collection, key, in)
+		s.operation(w)
+	default:
+		key := scopePath + "/" + collection + "/" + rest[0]
+		res, ok := s.resources[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("The resource '%s' was not found", key))
+			return
+		}
+		switch {
+		case len(rest) == 1 && r.Method == http.MethodGet:
+			write(w, res)
+			if collection == "instances" {
+				advance(res)
+			}
+		case len(rest) == 1 && r.Method == http.MethodPatch:
+			for k, v := range in {
+				res[k] = v
+			}
+			s.operation(w)
+		case len(rest) == 1 && r.Method == http.MethodDelete:
+			delete(s.resources, key)
+			if collection == "instances" {
+				delete(s.resources, scopePath+"/disks/"+rest[0])
+			}
+			s.operation(w)
+		case len(rest) == 2 && rest[1] == "serialPort" && r.Method == http.MethodGet:
+			write(w, map[string]interface{}{"kind": "compute#serialPortOutput", "contents": providertest.ConsoleOutput})
+		case len(rest) == 2 && r.Method == http.MethodPost:
+			if err := s.method(res, rest[1], in); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			s.operation(w)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, r.Method)
+		}
+	}
+}
+
+func (s *Server) insert(scopePath, collection, key string, in map[string]interface{}) {
+	in["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	switch collection {
+	case "addresses":
+		s.nextID++
+		in["address"] = fmt.Sprintf("203.0.113.%d", s.nextID%250+1)
+	case "instances":
+		name := in["name"].(string)
+		in["zone"] = scopePath
+		in["status"] = "PROVISIONING"
+		in["tags"].(map[string]interface{})["fingerprint"] = "fp"
+		for _, d := range in["disks"].([]interface{}) {
+			disk := d.(map[string]interface{})
+			params := disk["initializeParams"].(map[string]interface{})
+			disk["source"] = scopePath + "/disks/" + name
+			disk["diskSizeGb"] = params["diskSizeGb"]
+			s.resources[scopePath+"/disks/"+name] = map[string]interface{}{"name": name, "sizeGb": params["diskSizeGb"]}
+		}
+		for _, n := range in["networkInterfaces"].([]interface{}) {
+			for _, ac := range n.(map[string]interface{})["accessConfigs"].([]interface{}) {
+				ac := ac.(map[string]interface{})
+				if ac["natIP"] == nil {
+					ac["natIP"] = "198.51.100.10"
+				}
+			}
+		}
+	}
+	s.resources[key] = in
+}
+
+// advance moves a new instance to its next status.
+func advance(instance map[string]interface{}) {
+	switch instance["status"] {
+	case "PROVISIONING":
+		instance["status"] = "STAGING"
+	case "STAGING":
+		instance["status"] = "RUNNING"
+	}
+}
+
+func (s *Server) method(res map[string]interface{}, method string, in map[string]interface{}) error {
+	switch method {
+	case "start":
+		res["status"] = "RUNNING"
+	case "stop":
+		res["status"] = "TERMINATED"
+	case "setMachineType":
+		if res["status"] != "TERMINATED" {
+			return fmt.Errorf("instance must be stopped to set its machine type")
+		}
+		res["machineType"] = in["machineType"]
+	case "setTags":
+		in["fingerprint"] = "fp"
+		res["tags"] = in
+	case "resize":
+		res["sizeGb"] = in["sizeGb"]
+		for _, r := range s.resources {
+			disks, _ := r["disks"].([]interface{})
+			for _, d := range disks {
+				disk := d.(map[string]interface{})
+				if path.Base(disk["source"].(string)) == res["name"] {
+					disk["diskSizeGb"] = in["sizeGb"]
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown method %s", method)
+	}
+	return nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, prefix string) {
+	// Only the label filters of the form labels.<key>=<value> are
+	// supported.
+	var key, value string
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		kv := strings.SplitN(strings.TrimPrefix(filter, "labels."), "=", 2)
+		key, value = kv[0], kv[1]
+	}
+	items := []interface{}{}
+	for k, res := range s.resources {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if key != "" {
+			labels, _ := res["labels"].(map[string]interface{})
+			if labels[key] != value {
+				continue
+			}
+		}
+		items = append(items, res)
+	}
+	write(w, map[string]interface{}{"items": items})
+}
+
+func (s *Server) operation(w http.ResponseWriter) {
+	s.nextID++
+	name := fmt.Sprintf("operation-%d", s.nextID)
+	s.operations[name] = false
+	write(w, map[string]interface{}{"name": name, "status": "RUNNING"})
+}
+
+func write(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message},
+	})
+}
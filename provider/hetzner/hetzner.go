@@ -0,0 +1,725 @@
+// Package hetzner implements a provider that provisions environments on
+// Hetzner Cloud servers.
+//
+// The API token is read from the HCLOUD_TOKEN environment variable.
+package hetzner
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/internal/rest"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "hetzner"
+
+const (
+	defaultAPIURL     = "https://api.hetzner.cloud/v1"
+	defaultServerType = "cpx21"
+	defaultImage      = "ubuntu-22.04"
+	// label marks the resources created by clouddev, its value is the
+	// environment name.
+	label = "clouddev"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the Hetzner provider_options.
+type options struct {
+	// SSHKey is the name or ID of an existing SSH key to authorize instead
+	// of uploading the configured public key.
+	SSHKey string `mapstructure:"ssh_key"`
+	// VolumeSizeGB is the size of a volume to attach to the server, none
+	// if zero.
+	VolumeSizeGB int `mapstructure:"volume_size_gb"`
+	// IPv4 and IPv6 enable the primary IPs of the server, both by default.
+	IPv4 *bool `mapstructure:"ipv4"`
+	IPv6 *bool `mapstructure:"ipv6"`
+	// APIURL is the URL of the Hetzner Cloud API.
+	APIURL string `mapstructure:"api_url"`
+}
+
+// Provider provisions Hetzner Cloud servers.
+type Provider struct {
+	cfg  *config.Config
+	opts options
+	api  *rest.Client
+	// PollInterval is the interval between the checks of the progress of
+	// actions.
+	PollInterval time.Duration
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns a Hetzner provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	if opts.APIURL == "" {
+		opts.APIURL = defaultAPIURL
+	}
+	enabled := true
+	if opts.IPv4 == nil {
+		opts.IPv4 = &enabled
+	}
+	if opts.IPv6 == nil {
+		opts.IPv6 = &enabled
+	}
+	return &Provider{
+		cfg:  c,
+		opts: opts,
+		api: &rest.Client{
+			BaseURL:      opts.APIURL,
+			Authorize:    authorize,
+			ErrorMessage: errorMessage,
+		},
+		PollInterval: 2 * time.Second,
+	}
+}
+
+func authorize(req *http.Request) error {
+	token := os.Getenv("HCLOUD_TOKEN")
+	if token == "" {
+		return errors.New("HCLOUD_TOKEN is not set")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func errorMessage(body []byte) string {
+	var e struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &e)
+	if e.Error.Message == "" {
+		return ""
+	}
+	return e.Error.Code + ": " + e.Error.Message
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	if c.Region == "" {
+		errs = append(errs, &config.FieldError{Path: "region", Message: "is required, the location, e.g. fsn1"})
+	}
+	if opts.VolumeSizeGB != 0 && opts.VolumeSizeGB < 10 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.volume_size_gb", Message: "must be at least 10"})
+	}
+	if opts.IPv4 != nil && !*opts.IPv4 && opts.IPv6 != nil && !*opts.IPv6 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.ipv6", Message: "can't be disabled with ipv4, the server would be unreachable"})
+	}
+	return errs
+}
+
+func (p *Provider) serverType(c *config.Config) string {
+	if c.MachineType == "" {
+		return defaultServerType
+	}
+	return c.MachineType
+}
+
+func (p *Provider) image(c *config.Config) string {
+	if c.Image == "" {
+		return defaultImage
+	}
+	return c.Image
+}
+
+func resourceName(env string) string {
+	return "clouddev-" + env
+}
+
+// action is an asynchronous action.
+type action struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	Error  *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// wait waits for the actions to complete.
+func (p *Provider) wait(ctx context.Context, actions ...action) error {
+	for _, a := range actions {
+		id := strconv.Itoa(a.ID)
+		err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			switch a.Status {
+			case "success":
+				return true, nil
+			case "error":
+				if a.Error != nil {
+					return false, fmt.Errorf("action %s failed: %s: %s", id, a.Error.Code, a.Error.Message)
+				}
+				return false, fmt.Errorf("action %s failed", id)
+			}
+			var resp struct {
+				Action action `json:"action"`
+			}
+			err := p.api.Do(ctx, http.MethodGet, "/actions/"+id, nil, &resp)
+			a = resp.Action
+			return false, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// server is a server as returned by the API.
+type server struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	PublicNet struct {
+		IPv4 *struct {
+			IP string `json:"ip"`
+		} `json:"ipv4"`
+		IPv6 *struct {
+			IP string `json:"ip"`
+		} `json:"ipv6"`
+		Firewalls []struct {
+			ID int `json:"id"`
+		} `json:"firewalls"`
+	} `json:"public_net"`
+	ServerType struct {
+		Name string `json:"name"`
+	} `json:"server_type"`
+	Image *struct {
+		Name string `json:"name"`
+	} `json:"image"`
+	Datacenter struct {
+		Location struct {
+			Name string `json:"name"`
+		} `json:"location"`
+	} `json:"datacenter"`
+	Volumes []int             `json:"volumes"`
+	Labels  map[string]string `json:"labels"`
+	Created time.Time         `json:"created"`
+}
+
+func (s *server) machine() *provider.Machine {
+	m := &provider.Machine{
+		ID:        strconv.Itoa(s.ID),
+		Name:      s.Name,
+		Status:    status(s.Status),
+		Resources: map[string]string{provider.ResourceInstance: strconv.Itoa(s.ID)},
+		CreatedAt: s.Created,
+	}
+	switch {
+	case s.PublicNet.IPv4 != nil:
+		m.Address = s.PublicNet.IPv4.IP
+	case s.PublicNet.IPv6 != nil:
+		// The server is assigned a /64 network, with its first address
+		// configured.
+		m.Address = strings.TrimSuffix(s.PublicNet.IPv6.IP, "/64") + "1"
+	}
+	if len(s.PublicNet.Firewalls) > 0 {
+		m.Resources[provider.ResourceFirewall] = strconv.Itoa(s.PublicNet.Firewalls[0].ID)
+	}
+	if len(s.Volumes) > 0 {
+		m.Resources[provider.ResourceDisk] = strconv.Itoa(s.Volumes[0])
+	}
+	return m
+}
+
+func status(s string) provider.Status {
+	switch s {
+	case "initializing", "starting":
+		return provider.StatusPending
+	case "running":
+		return provider.StatusRunning
+	case "stopping", "off":
+		return provider.StatusStopped
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// UserDataLimit implements provider.UserDataLimiter. Server user data is
+// limited to 32 KiB.
+func (p *Provider) UserDataLimit() int {
+	return 32768
+}
+
+// MachineSizes implements provider.Sizer with the shared and dedicated vCPU
+// server types.
+func (p *Provider) MachineSizes() []provider.MachineSize {
+	return []provider.MachineSize{
+		{Name: "cpx11", CPUs: 2, MemoryMB: 2048},
+		{Name: "cpx21", CPUs: 3, MemoryMB: 4096},
+		{Name: "cpx31", CPUs: 4, MemoryMB: 8192},
+		{Name: "cpx41", CPUs: 8, MemoryMB: 16384},
+		{Name: "cpx51", CPUs: 16, MemoryMB: 32768},
+		{Name: "ccx33", CPUs: 8, MemoryMB: 32768},
+		{Name: "ccx43", CPUs: 16, MemoryMB: 65536},
+		{Name: "ccx53", CPUs: 32, MemoryMB: 131072},
+		{Name: "ccx63", CPUs: 48, MemoryMB: 196608},
+	}
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}, CreatedAt: time.Now().UTC()}
+	name := resourceName(c.Name)
+	labels := map[string]string{label: c.Name}
+
+	keyID, created, err := p.sshKey(ctx, name, spec.SSHPublicKey, labels)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		m.Resources[provider.ResourceKey] = keyID
+	}
+
+	var fw struct {
+		Firewall struct {
+			ID int `json:"id"`
+		} `json:"firewall"`
+		Actions []action `json:"actions"`
+	}
+	if err := p.api.Do(ctx, http.MethodPost, "/firewalls", map[string]interface{}{
+		"name":   name,
+		"labels": labels,
+		"rules":  rules(c.Ports),
+	}, &fw); err != nil {
+		return m, fmt.Errorf("failed to create firewall: %w", err)
+	}
+	m.Resources[provider.ResourceFirewall] = strconv.Itoa(fw.Firewall.ID)
+	if err := p.wait(ctx, fw.Actions...); err != nil {
+		return m, fmt.Errorf("failed to create firewall: %w", err)
+	}
+
+	req := map[string]interface{}{
+		"name":        c.Name,
+		"server_type": p.serverType(c),
+		"location":    c.Region,
+		"image":       p.image(c),
+		"ssh_keys":    []string{keyID},
+		"user_data":   string(spec.UserData),
+		"labels":      labels,
+		"firewalls":   []interface{}{map[string]int{"firewall": fw.Firewall.ID}},
+		"public_net": map[string]bool{
+			"enable_ipv4": *p.opts.IPv4,
+			"enable_ipv6": *p.opts.IPv6,
+		},
+	}
+
+	if p.opts.VolumeSizeGB > 0 {
+		var resp struct {
+			Volume struct {
+				ID int `json:"id"`
+			} `json:"volume"`
+			Action      action   `json:"action"`
+			NextActions []action `json:"next_actions"`
+		}
+		if err := p.api.Do(ctx, http.MethodPost, "/volumes", map[string]interface{}{
+			"name":     name,
+			"size":     p.opts.VolumeSizeGB,
+			"location": c.Region,
+			"format":   "ext4",
+			"labels":   labels,
+		}, &resp); err != nil {
+			return m, fmt.Errorf("failed to create volume: %w", err)
+		}
+		m.Resources[provider.ResourceDisk] = strconv.Itoa(resp.Volume.ID)
+		if err := p.wait(ctx, append([]action{resp.Action}, resp.NextActions...)...); err != nil {
+			return m, fmt.Errorf("failed to create volume: %w", err)
+		}
+		req["volumes"] = []int{resp.Volume.ID}
+		req["automount"] = true
+	}
+
+	var resp struct {
+		Server      server   `json:"server"`
+		Action      action   `json:"action"`
+		NextActions []action `json:"next_actions"`
+	}
+	if err := p.api.Do(ctx, http.MethodPost, "/servers", req, &resp); err != nil {
+		return m, fmt.Errorf("failed to create server: %w", err)
+	}
+	m.ID = strconv.Itoa(resp.Server.ID)
+	m.Resources[provider.ResourceInstance] = m.ID
+	if err := p.wait(ctx, append([]action{resp.Action}, resp.NextActions...)...); err != nil {
+		return m, fmt.Errorf("failed to create server: %w", err)
+	}
+
+	s, err := p.server(ctx, m.ID)
+	if err != nil {
+		return m, err
+	}
+	sm := s.machine()
+	sm.Resources = m.Resources
+	return sm, nil
+}
+
+// sshKey returns the ID of the SSH key to authorize, uploading the public
+// key unless it's already uploaded, and whether it was uploaded.
+func (p *Provider) sshKey(ctx context.Context, name, publicKey string, labels map[string]string) (string, bool, error) {
+	if p.opts.SSHKey != "" {
+		return p.opts.SSHKey, false, nil
+	}
+	fingerprint, err := fingerprint(publicKey)
+	if err != nil {
+		return "", false, err
+	}
+
+	var keys struct {
+		SSHKeys []struct {
+			ID int `json:"id"`
+		} `json:"ssh_keys"`
+	}
+	if err := p.api.Do(ctx, http.MethodGet, "/ssh_keys?fingerprint="+url.QueryEscape(fingerprint), nil, &keys); err != nil {
+		return "", false, fmt.Errorf("failed to get SSH key: %w", err)
+	}
+	if len(keys.SSHKeys) > 0 {
+		return strconv.Itoa(keys.SSHKeys[0].ID), false, nil
+	}
+	var key struct {
+		SSHKey struct {
+			ID int `json:"id"`
+		} `json:"ssh_key"`
+	}
+	if err := p.api.Do(ctx, http.MethodPost, "/ssh_keys", map[string]interface{}{
+		"name":       name,
+		"public_key": publicKey,
+		"labels":     labels,
+	}, &key); err != nil {
+		return "", false, fmt.Errorf("failed to upload SSH key: %w", err)
+	}
+	return strconv.Itoa(key.SSHKey.ID), true, nil
+}
+
+// fingerprint returns the MD5 fingerprint of a public key, by which Hetzner
+// identifies keys.
+func fingerprint(publicKey string) (string, error) {
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return "", errors.New("invalid SSH public key")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid SSH public key: %w", err)
+	}
+	sum := md5.Sum(blob)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hex, ":"), nil
+}
+
+// rule is a firewall rule.
+type rule struct {
+	Direction string   `json:"direction"`
+	Protocol  string   `json:"protocol"`
+	Port      string   `json:"port"`
+	SourceIPs []string `json:"source_ips"`
+}
+
+// rules returns the firewall rules opening the ports. Outgoing traffic is
+// allowed when there are no outgoing rules.
+func rules(ports []int) []rule {
+	rules := make([]rule, len(ports))
+	for i, port := range ports {
+		rules[i] = rule{Direction: "in", Protocol: "tcp", Port: strconv.Itoa(port), SourceIPs: []string{"0.0.0.0/0", "::/0"}}
+	}
+	return rules
+}
+
+func (p *Provider) server(ctx context.Context, id string) (*server, error) {
+	var resp struct {
+		Server server `json:"server"`
+	}
+	if err := p.api.Do(ctx, http.MethodGet, "/servers/"+url.PathEscape(id), nil, &resp); err != nil {
+		if rest.IsNotFound(err) {
+			return nil, provider.ErrNotFound
+		}
+		return nil, err
+	}
+	return &resp.Server, nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	if _, err := strconv.Atoi(id); err != nil {
+		// Server IDs are numbers.
+		return nil, provider.ErrNotFound
+	}
+	s, err := p.server(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.machine(), nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	return p.serverAction(ctx, id, "poweron", nil)
+}
+
+// Stop implements provider.Provider. The server is shut down gracefully.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	if err := p.serverAction(ctx, id, "shutdown", nil); err != nil {
+		return err
+	}
+	// The shutdown action completes once the ACPI signal is sent.
+	return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		s, err := p.server(ctx, id)
+		return err == nil && s.Status == "off", err
+	})
+}
+
+// serverAction runs a server action and waits for it to complete.
+func (p *Provider) serverAction(ctx context.Context, id, name string, in interface{}) error {
+	var resp struct {
+		Action action `json:"action"`
+	}
+	if err := p.api.Do(ctx, http.MethodPost, "/servers/"+url.PathEscape(id)+"/actions/"+name, in, &resp); err != nil {
+		if rest.IsNotFound(err) {
+			return provider.ErrNotFound
+		}
+		return fmt.Errorf("server %s %s: %w", id, name, err)
+	}
+	if err := p.wait(ctx, resp.Action); err != nil {
+		return fmt.Errorf("server %s %s: %w", id, name, err)
+	}
+	return nil
+}
+
+// Destroy implements provider.Provider.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	if id := m.Resources[provider.ResourceInstance]; id != "" {
+		var resp struct {
+			Action action `json:"action"`
+		}
+		err := p.api.Do(ctx, http.MethodDelete, "/servers/"+url.PathEscape(id), nil, &resp)
+		if err == nil {
+			// The firewall and the volume can be deleted once the
+			// server is.
+			err = p.wait(ctx, resp.Action)
+		}
+		if err != nil && !rest.IsNotFound(err) {
+			return fmt.Errorf("failed to delete server %s: %w", id, err)
+		}
+	}
+	if id := m.Resources[provider.ResourceDisk]; id != "" {
+		// Volumes are detached asynchronously from deleted servers.
+		err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			err := p.delete(ctx, "/volumes/"+url.PathEscape(id))
+			if rest.HasStatus(err, http.StatusLocked) || rest.HasStatus(err, http.StatusConflict) {
+				return false, nil
+			}
+			return err == nil, err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete volume %s: %w", id, err)
+		}
+	}
+	if id := m.Resources[provider.ResourceFirewall]; id != "" {
+		err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			err := p.delete(ctx, "/firewalls/"+url.PathEscape(id))
+			if rest.HasStatus(err, http.StatusLocked) || rest.HasStatus(err, http.StatusConflict) {
+				// Still applied to the deleted server.
+				return false, nil
+			}
+			return err == nil, err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete firewall %s: %w", id, err)
+		}
+	}
+	if id := m.Resources[provider.ResourceKey]; id != "" {
+		if err := p.delete(ctx, "/ssh_keys/"+url.PathEscape(id)); err != nil {
+			return fmt.Errorf("failed to delete SSH key %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// delete deletes a resource, ignoring the resources that don't exist.
+func (p *Provider) delete(ctx context.Context, path string) error {
+	err := p.api.Do(ctx, http.MethodDelete, path, nil, nil)
+	if rest.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	var machines []*provider.Machine
+	for page := 1; ; page++ {
+		var resp struct {
+			Servers []server `json:"servers"`
+			Meta    struct {
+				Pagination struct {
+					NextPage *int `json:"next_page"`
+				} `json:"pagination"`
+			} `json:"meta"`
+		}
+		path := fmt.Sprintf("/servers?label_selector=%s&per_page=50&page=%d", label, page)
+		if err := p.api.Do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+		for i := range resp.Servers {
+			machines = append(machines, resp.Servers[i].machine())
+		}
+		if resp.Meta.Pagination.NextPage == nil {
+			return machines, nil
+		}
+	}
+}
+
+// Plan implements provider.Provider. The server type, the firewall ports
+// and growing the volume are updated in place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	s, err := p.server(ctx, m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []provider.Change
+	if location := s.Datacenter.Location.Name; location != c.Region {
+		changes = append(changes, provider.Change{Field: "region", Old: location, New: c.Region, Replace: true})
+	}
+	if s.Image != nil && s.Image.Name != p.image(c) {
+		changes = append(changes, provider.Change{Field: "image", Old: s.Image.Name, New: p.image(c), Replace: true})
+	}
+	if st := p.serverType(c); st != s.ServerType.Name {
+		changes = append(changes, provider.Change{Field: "machine_type", Old: s.ServerType.Name, New: st})
+	}
+	if old, new := s.PublicNet.IPv4 != nil, *p.opts.IPv4; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.ipv4", Old: strconv.FormatBool(old), New: strconv.FormatBool(new), Replace: true})
+	}
+	if old, new := s.PublicNet.IPv6 != nil, *p.opts.IPv6; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.ipv6", Old: strconv.FormatBool(old), New: strconv.FormatBool(new), Replace: true})
+	}
+
+	size := 0
+	if len(s.Volumes) > 0 {
+		var resp struct {
+			Volume struct {
+				Size int `json:"size"`
+			} `json:"volume"`
+		}
+		if err := p.api.Do(ctx, http.MethodGet, "/volumes/"+strconv.Itoa(s.Volumes[0]), nil, &resp); err != nil {
+			return nil, err
+		}
+		size = resp.Volume.Size
+	}
+	if size != p.opts.VolumeSizeGB {
+		changes = append(changes, provider.Change{
+			Field:   "provider_options.volume_size_gb",
+			Old:     strconv.Itoa(size),
+			New:     strconv.Itoa(p.opts.VolumeSizeGB),
+			Replace: size == 0 || p.opts.VolumeSizeGB < size,
+		})
+	}
+
+	if id := m.Resources[provider.ResourceFirewall]; id != "" {
+		var resp struct {
+			Firewall struct {
+				Rules []rule `json:"rules"`
+			} `json:"firewall"`
+		}
+		if err := p.api.Do(ctx, http.MethodGet, "/firewalls/"+url.PathEscape(id), nil, &resp); err != nil && !rest.IsNotFound(err) {
+			return nil, err
+		}
+		var ports []int
+		for _, r := range resp.Firewall.Rules {
+			if port, err := strconv.Atoi(r.Port); err == nil && r.Direction == "in" && r.Protocol == "tcp" {
+				ports = append(ports, port)
+			}
+		}
+		if old, new := provider.FormatPorts(ports), provider.FormatPorts(c.Ports); old != new {
+			changes = append(changes, provider.Change{Field: "ports", Old: old, New: new})
+		}
+	}
+	return changes, nil
+}
+
+// Update implements provider.Updater.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	for _, ch := range changes {
+		switch ch.Field {
+		case "machine_type":
+			// Servers change type powered off. The disk isn't upgraded so
+			// that the server can be downgraded later.
+			if m.Status == provider.StatusRunning {
+				if err := p.Stop(ctx, m.ID); err != nil {
+					return err
+				}
+			}
+			if err := p.serverAction(ctx, m.ID, "change_type", map[string]interface{}{
+				"server_type":  ch.New,
+				"upgrade_disk": false,
+			}); err != nil {
+				return err
+			}
+			if m.Status == provider.StatusRunning {
+				if err := p.Start(ctx, m.ID); err != nil {
+					return err
+				}
+			}
+		case "provider_options.volume_size_gb":
+			id := m.Resources[provider.ResourceDisk]
+			var resp struct {
+				Action action `json:"action"`
+			}
+			if err := p.api.Do(ctx, http.MethodPost, "/volumes/"+url.PathEscape(id)+"/actions/resize", map[string]interface{}{
+				"size": p.opts.VolumeSizeGB,
+			}, &resp); err != nil {
+				return fmt.Errorf("failed to resize volume %s: %w", id, err)
+			}
+			if err := p.wait(ctx, resp.Action); err != nil {
+				return fmt.Errorf("failed to resize volume %s: %w", id, err)
+			}
+		case "ports":
+			id := m.Resources[provider.ResourceFirewall]
+			var resp struct {
+				Actions []action `json:"actions"`
+			}
+			if err := p.api.Do(ctx, http.MethodPost, "/firewalls/"+url.PathEscape(id)+"/actions/set_rules", map[string]interface{}{
+				"rules": rules(spec.Config.Ports),
+			}, &resp); err != nil {
+				return fmt.Errorf("failed to update firewall %s: %w", id, err)
+			}
+			if err := p.wait(ctx, resp.Actions...); err != nil {
+				return fmt.Errorf("failed to update firewall %s: %w", id, err)
+			}
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+	return nil
+}
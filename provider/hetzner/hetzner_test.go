@@ -0,0 +1,106 @@
+package hetzner_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/hetzner"
+	"github.com/darkowlzz/clouddev/provider/hetzner/hetznertest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// newTestProvider returns a provider of the spec against a fake API server.
+func newTestProvider(t *testing.T, s *hetznertest.Server, spec *provider.Spec, opts map[string]interface{}) *hetzner.Provider {
+	t.Helper()
+	t.Setenv("HCLOUD_TOKEN", hetznertest.Token)
+	spec.Config.Region = "fsn1"
+	spec.Config.ProviderOptions = map[string]interface{}{"api_url": s.URL + "/v1"}
+	for k, v := range opts {
+		spec.Config.ProviderOptions[k] = v
+	}
+	p := hetzner.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *hetznertest.Server {
+	s := hetznertest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(hetzner.Name)
+	providertest.Run(t, newTestProvider(t, s, spec, nil), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after the suite", n)
+	}
+	if n := s.PendingActions(); n != 0 {
+		t.Errorf("%d actions were never waited for", n)
+	}
+}
+
+func TestCreateWaitsForAllActions(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(hetzner.Name)
+	p := newTestProvider(t, s, spec, map[string]interface{}{"volume_size_gb": 10})
+	ctx := context.Background()
+
+	// The firewall, volume and server creations return actions and next
+	// actions.
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if n := s.PendingActions(); n != 0 {
+		t.Errorf("Create() didn't wait for %d actions", n)
+	}
+	if m.Resources[provider.ResourceDisk] == "" {
+		t.Errorf("Create() machine resources %v don't include the volume", m.Resources)
+	}
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.PendingActions(); n != 0 {
+		t.Errorf("Destroy() didn't wait for %d actions", n)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy()", n)
+	}
+}
+
+func TestFailedActionIsReported(t *testing.T) {
+	s := newServer(t)
+	handler := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/actions/") {
+			id := strings.TrimPrefix(r.URL.Path, "/v1/actions/")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"action": {"id": ` + id + `, "status": "error", "error": {"code": "action_failed", "message": "firewall rules are invalid"}}}`))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	spec := providertest.Spec(hetzner.Name)
+	p := newTestProvider(t, s, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err == nil || !strings.Contains(err.Error(), "failed: action_failed: firewall rules are invalid") {
+		t.Fatalf("Create() error = %v, want the action error", err)
+	}
+	if m == nil || m.Resources[provider.ResourceFirewall] == "" {
+		t.Fatalf("Create() machine = %+v, want the firewall of the failed action", m)
+	}
+	if err := p.Destroy(ctx, m); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy()", n)
+	}
+}
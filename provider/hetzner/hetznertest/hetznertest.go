@@ -0,0 +1,342 @@
+// Package hetznertest implements an in-memory fake of the Hetzner Cloud API
+// for testing the Hetzner provider.
+//
+// The fake implements the endpoints used by the provider. Actions are
+// returned running and complete on their first read.
+package hetznertest
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token is the API token accepted by the fake.
+const Token = "hetznertest-token"
+
+// Server is a fake Hetzner Cloud API server.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	nextID  int
+	actions map[int]bool
+	// resources are keyed by collection, e.g. "servers", and ID.
+	resources map[string]map[int]map[string]interface{}
+}
+
+// NewServer starts a fake API server. The caller must close it.
+func NewServer() *Server {
+	s := &Server{
+		actions: map[int]bool{},
+		resources: map[string]map[int]map[string]interface{}{
+			"ssh_keys":  {},
+			"firewalls": {},
+			"volumes":   {},
+			"servers":   {},
+		},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Resources returns the number of SSH keys, firewalls, volumes and servers
+// that exist, to check for leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.resources {
+		n += len(c)
+	}
+	return n
+}
+
+// PendingActions returns the number of actions that were never read since
+// they were returned, to check that the provider waits for all of them.
+func (s *Server) PendingActions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, done := range s.actions {
+		if !done {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "unable to authenticate")
+		return
+	}
+	var in map[string]interface{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "json_error", err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" {
+		writeError(w, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+	collection := parts[1]
+	if collection == "actions" && len(parts) == 3 && r.Method == http.MethodGet {
+		id, _ := strconv.Atoi(parts[2])
+		if _, ok := s.actions[id]; !ok {
+			writeError(w, http.StatusNotFound, "not_found", "action not found")
+			return
+		}
+		s.actions[id] = true
+		write(w, http.StatusOK, map[string]interface{}{"action": map[string]interface{}{"id": id, "status": "success"}})
+		return
+	}
+	resources, ok := s.resources[collection]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+	singular := strings.TrimSuffix(collection, "s")
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.list(w, r, collection)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		for _, res := range resources {
+			if res["name"] == in["name"] {
+				writeError(w, http.StatusConflict, "uniqueness_error", "name is already used")
+				return
+			}
+		}
+		if err := s.create(collection, in); err != "" {
+			writeError(w, http.StatusUnprocessableEntity, "invalid_input", err)
+			return
+		}
+		resp := map[string]interface{}{singular: in}
+		switch collection {
+		case "firewalls":
+			resp["actions"] = []interface{}{s.action()}
+		case "volumes", "servers":
+			resp["action"] = s.action()
+			resp["next_actions"] = []interface{}{s.action()}
+		}
+		write(w, http.StatusCreated, resp)
+	default:
+		id, _ := strconv.Atoi(parts[2])
+		res, ok := resources[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", singular+" not found")
+			return
+		}
+		switch {
+		case len(parts) == 3 && r.Method == http.MethodGet:
+			write(w, http.StatusOK, map[string]interface{}{singular: res})
+		case len(parts) == 3 && r.Method == http.MethodDelete:
+			if err := s.delete(collection, id); err != "" {
+				writeError(w, http.StatusConflict, "resource_in_use", err)
+				return
+			}
+			if collection == "servers" {
+				write(w, http.StatusOK, map[string]interface{}{"action": s.action()})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 5 && parts[3] == "actions" && r.Method == http.MethodPost:
+			if err := s.runAction(res, parts[4], in); err != "" {
+				writeError(w, http.StatusConflict, "conflict", err)
+				return
+			}
+			if collection == "firewalls" {
+				write(w, http.StatusCreated, map[string]interface{}{"actions": []interface{}{s.action()}})
+				return
+			}
+			write(w, http.StatusCreated, map[string]interface{}{"action": s.action()})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+		}
+	}
+}
+
+func (s *Server) id() int {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Server) action() map[string]interface{} {
+	id := s.id()
+	s.actions[id] = false
+	return map[string]interface{}{"id": id, "status": "running"}
+}
+
+func (s *Server) create(collection string, in map[string]interface{}) string {
+	id := s.id()
+	in["id"] = id
+	in["created"] = time.Now().UTC().Format(time.RFC3339)
+	switch collection {
+	case "ssh_keys":
+		publicKey, _ := in["public_key"].(string)
+		in["fingerprint"] = fingerprint(publicKey)
+	case "firewalls":
+		if in["rules"] == nil {
+			in["rules"] = []interface{}{}
+		}
+	case "servers":
+		for _, k := range in["ssh_keys"].([]interface{}) {
+			kid, _ := strconv.Atoi(fmt.Sprint(k))
+			if _, ok := s.resources["ssh_keys"][kid]; !ok {
+				return fmt.Sprintf("ssh key %v not found", k)
+			}
+		}
+		publicNet := map[string]interface{}{"firewalls": []interface{}{}}
+		enable, _ := in["public_net"].(map[string]interface{})
+		if enable["enable_ipv4"] != false {
+			publicNet["ipv4"] = map[string]interface{}{"ip": "192.0.2.20"}
+		}
+		if enable["enable_ipv6"] != false {
+			publicNet["ipv6"] = map[string]interface{}{"ip": "2001:db8:1::/64"}
+		}
+		if fws, ok := in["firewalls"].([]interface{}); ok {
+			for _, fw := range fws {
+				fid := int(fw.(map[string]interface{})["firewall"].(float64))
+				publicNet["firewalls"] = append(publicNet["firewalls"].([]interface{}), map[string]interface{}{"id": fid})
+			}
+		}
+		volumes := []interface{}{}
+		if vs, ok := in["volumes"].([]interface{}); ok {
+			for _, v := range vs {
+				vid := int(v.(float64))
+				vol, ok := s.resources["volumes"][vid]
+				if !ok {
+					return fmt.Sprintf("volume %d not found", vid)
+				}
+				vol["server"] = id
+				volumes = append(volumes, vid)
+			}
+		}
+		server := map[string]interface{}{
+			"id":          id,
+			"name":        in["name"],
+			"status":      "running",
+			"created":     in["created"],
+			"labels":      in["labels"],
+			"public_net":  publicNet,
+			"server_type": map[string]interface{}{"name": in["server_type"]},
+			"image":       map[string]interface{}{"name": in["image"]},
+			"datacenter":  map[string]interface{}{"location": map[string]interface{}{"name": in["location"]}},
+			"volumes":     volumes,
+		}
+		for k := range in {
+			delete(in, k)
+		}
+		for k, v := range server {
+			in[k] = v
+		}
+	}
+	s.resources[collection][id] = in
+	return ""
+}
+
+func (s *Server) delete(collection string, id int) string {
+	switch collection {
+	case "volumes":
+		if s.resources["volumes"][id]["server"] != nil {
+			return "volume is attached"
+		}
+	case "firewalls":
+		for _, srv := range s.resources["servers"] {
+			for _, fw := range srv["public_net"].(map[string]interface{})["firewalls"].([]interface{}) {
+				if fw.(map[string]interface{})["id"] == id {
+					return "firewall is applied"
+				}
+			}
+		}
+	case "servers":
+		for _, vol := range s.resources["volumes"] {
+			if vol["server"] == id {
+				vol["server"] = nil
+			}
+		}
+	}
+	delete(s.resources[collection], id)
+	return ""
+}
+
+func (s *Server) runAction(res map[string]interface{}, name string, in map[string]interface{}) string {
+	switch name {
+	case "poweron":
+		res["status"] = "running"
+	case "shutdown", "poweroff":
+		res["status"] = "off"
+	case "change_type":
+		if res["status"] != "off" {
+			return "server must be off"
+		}
+		res["server_type"] = map[string]interface{}{"name": in["server_type"]}
+	case "resize":
+		res["size"] = in["size"]
+	case "set_rules":
+		res["rules"] = in["rules"]
+	default:
+		return "unknown action " + name
+	}
+	return ""
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, collection string) {
+	q := r.URL.Query()
+	items := []interface{}{}
+	for _, res := range s.resources[collection] {
+		if fp := q.Get("fingerprint"); fp != "" && res["fingerprint"] != fp {
+			continue
+		}
+		if selector := q.Get("label_selector"); selector != "" {
+			labels, _ := res["labels"].(map[string]interface{})
+			if _, ok := labels[selector]; !ok {
+				continue
+			}
+		}
+		items = append(items, res)
+	}
+	write(w, http.StatusOK, map[string]interface{}{
+		collection: items,
+		"meta":     map[string]interface{}{"pagination": map[string]interface{}{"next_page": nil}},
+	})
+}
+
+func fingerprint(publicKey string) string {
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return ""
+	}
+	blob, _ := base64.StdEncoding.DecodeString(fields[1])
+	sum := md5.Sum(blob)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+func write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	write(w, status, map[string]interface{}{"error": map[string]string{"code": code, "message": message}})
+}
@@ -0,0 +1,319 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"gopkg.in/yaml.v2"
+)
+
+// inClusterDir holds the service account credentials of the pods.
+const inClusterDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeconfig is the subset of a kubeconfig file clouddev reads.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string      `yaml:"name"`
+		Cluster kubeCluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string   `yaml:"name"`
+		User kubeUser `yaml:"user"`
+	} `yaml:"users"`
+}
+
+type kubeCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+type kubeUser struct {
+	Token                 string      `yaml:"token"`
+	TokenFile             string      `yaml:"tokenFile"`
+	ClientCertificate     string      `yaml:"client-certificate"`
+	ClientCertificateData string      `yaml:"client-certificate-data"`
+	ClientKey             string      `yaml:"client-key"`
+	ClientKeyData         string      `yaml:"client-key-data"`
+	Username              string      `yaml:"username"`
+	Password              string      `yaml:"password"`
+	Exec                  *execConfig `yaml:"exec"`
+}
+
+// execConfig is a credential plugin, e.g. the cloud CLIs issuing tokens.
+type execConfig struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Command    string   `yaml:"command"`
+	Args       []string `yaml:"args"`
+	Env        []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+}
+
+// cluster is the API server of a kubeconfig context.
+type cluster struct {
+	server    string
+	namespace string
+	client    *http.Client
+	authorize func(req *http.Request) error
+}
+
+// kubeconfigPath returns the path of the kubeconfig file: the configured
+// one, the first of KUBECONFIG, or ~/.kube/config.
+func kubeconfigPath(path string) (string, error) {
+	if path == "" {
+		path = strings.Split(os.Getenv("KUBECONFIG"), string(os.PathListSeparator))[0]
+	}
+	if path == "" {
+		path = "~/.kube/config"
+	}
+	return homedir.Expand(path)
+}
+
+// loadCluster returns the cluster of the kubeconfig context, the current
+// context if empty. The service account of the pod is used if there's no
+// kubeconfig file and clouddev runs in a cluster.
+func loadCluster(path, context string) (*cluster, error) {
+	path, err := kubeconfigPath(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && context == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return inCluster()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig: %w", err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+
+	if context == "" {
+		context = kc.CurrentContext
+	}
+	if context == "" {
+		return nil, fmt.Errorf("kubeconfig %s has no current context, set provider_options.context", path)
+	}
+	c := &cluster{}
+	var clusterName, userName string
+	found := false
+	for _, ctx := range kc.Contexts {
+		if ctx.Name == context {
+			clusterName, userName, c.namespace = ctx.Context.Cluster, ctx.Context.User, ctx.Context.Namespace
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %s not found in kubeconfig %s", context, path)
+	}
+
+	var kcluster *kubeCluster
+	for i := range kc.Clusters {
+		if kc.Clusters[i].Name == clusterName {
+			kcluster = &kc.Clusters[i].Cluster
+		}
+	}
+	if kcluster == nil {
+		return nil, fmt.Errorf("cluster %s of context %s not found in kubeconfig %s", clusterName, context, path)
+	}
+	var user kubeUser
+	for _, u := range kc.Users {
+		if u.Name == userName {
+			user = u.User
+		}
+	}
+
+	c.server = strings.TrimSuffix(kcluster.Server, "/")
+	tlsConfig := &tls.Config{InsecureSkipVerify: kcluster.InsecureSkipTLSVerify}
+	ca, err := fileOrData(dir, kcluster.CertificateAuthority, kcluster.CertificateAuthorityData)
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("invalid certificate authority of cluster %s", clusterName)
+		}
+	}
+	cert, err := fileOrData(dir, user.ClientCertificate, user.ClientCertificateData)
+	if err != nil {
+		return nil, err
+	}
+	key, err := fileOrData(dir, user.ClientKey, user.ClientKeyData)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate of user %s: %w", userName, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	c.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}
+
+	switch {
+	case user.Token != "":
+		c.authorize = bearer(func() (string, error) { return user.Token, nil })
+	case user.TokenFile != "":
+		file := resolve(dir, user.TokenFile)
+		c.authorize = bearer(func() (string, error) { return readToken(file) })
+	case user.Username != "":
+		c.authorize = func(req *http.Request) error {
+			req.SetBasicAuth(user.Username, user.Password)
+			return nil
+		}
+	case user.Exec != nil:
+		// Relative paths of commands are relative to the kubeconfig, the
+		// other commands are looked up in PATH.
+		if strings.Contains(user.Exec.Command, "/") {
+			user.Exec.Command = resolve(dir, user.Exec.Command)
+		}
+		c.authorize = bearer((&execToken{config: user.Exec}).token)
+	default:
+		c.authorize = func(*http.Request) error { return nil }
+	}
+	return c, nil
+}
+
+// inCluster returns the cluster clouddev runs in.
+func inCluster() (*cluster, error) {
+	ca, err := ioutil.ReadFile(filepath.Join(inClusterDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := ioutil.ReadFile(filepath.Join(inClusterDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	return &cluster{
+		server:    "https://" + os.Getenv("KUBERNETES_SERVICE_HOST") + ":" + os.Getenv("KUBERNETES_SERVICE_PORT"),
+		namespace: strings.TrimSpace(string(namespace)),
+		client:    &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+		// The token is rotated, read it for every request.
+		authorize: bearer(func() (string, error) { return readToken(filepath.Join(inClusterDir, "token")) }),
+	}, nil
+}
+
+func bearer(token func() (string, error)) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		t, err := token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+t)
+		return nil
+	}
+}
+
+func readToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// fileOrData returns the decoded data, or the content of the file relative
+// to the kubeconfig directory, or nil if both are empty.
+func fileOrData(dir, file, data string) ([]byte, error) {
+	if data != "" {
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kubeconfig data: %w", err)
+		}
+		return b, nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(resolve(dir, file))
+}
+
+func resolve(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// execToken runs a credential plugin, caching its token until it expires.
+type execToken struct {
+	config *execConfig
+
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+}
+
+func (t *execToken) token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.value != "" && (t.expires.IsZero() || time.Now().Add(time.Minute).Before(t.expires)) {
+		return t.value, nil
+	}
+
+	info, err := json.Marshal(map[string]interface{}{
+		"apiVersion": t.config.APIVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]bool{"interactive": false},
+	})
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(t.config.Command, t.config.Args...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+	for _, e := range t.config.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("kubeconfig credential plugin %s: %v: %s", t.config.Command, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var cred struct {
+		Status struct {
+			Token               string    `json:"token"`
+			ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(out, &cred); err != nil {
+		return "", fmt.Errorf("kubeconfig credential plugin %s: invalid output: %w", t.config.Command, err)
+	}
+	if cred.Status.Token == "" {
+		return "", errors.New("kubeconfig credential plugin " + t.config.Command + " returned no token")
+	}
+	t.value, t.expires = cred.Status.Token, cred.Status.ExpirationTimestamp
+	return t.value, nil
+}
@@ -0,0 +1,853 @@
+// Package kubernetes implements a provider that runs environments in pods
+// of a Kubernetes cluster.
+//
+// An environment is a StatefulSet of one pod with a persistent volume for
+// the home directories, and a Service exposing the SSH server and the
+// ports. The pods are set up by cloud-init from the same user data as the
+// machines of the other providers.
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/internal/containerinit"
+	"github.com/darkowlzz/clouddev/internal/rest"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "kubernetes"
+
+const (
+	defaultImage = "ubuntu:22.04"
+	// namePrefix prefixes the names of the objects created by clouddev.
+	namePrefix = "clouddev-"
+	// Labels and annotations of the objects.
+	labelManagedBy      = "app.kubernetes.io/managed-by"
+	labelEnv            = "clouddev.env"
+	annotationRequests  = "clouddev.requests"
+	annotationLimits    = "clouddev.limits"
+	containerName       = "dev"
+	homeVolume          = "home"
+	seedVolume          = "seed"
+	resourceService     = "service"
+	resourceSecret      = "secret"
+	mergePatchMediaType = "application/merge-patch+json"
+)
+
+func statefulSetsPath(ns string) string {
+	return "/apis/apps/v1/namespaces/" + url.PathEscape(ns) + "/statefulsets"
+}
+
+func corePath(ns, resource string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(ns) + "/" + resource
+}
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the kubernetes provider_options.
+type options struct {
+	// Kubeconfig is the path of the kubeconfig file, KUBECONFIG or
+	// ~/.kube/config if empty.
+	Kubeconfig string `mapstructure:"kubeconfig"`
+	// Context is the kubeconfig context, the current context if empty.
+	Context string `mapstructure:"context"`
+	// Namespace is the namespace of the environment, the namespace of the
+	// context if empty.
+	Namespace string `mapstructure:"namespace"`
+	// ServiceType is the type of the Service: LoadBalancer, NodePort or
+	// ClusterIP.
+	ServiceType  string            `mapstructure:"service_type"`
+	Requests     map[string]string `mapstructure:"requests"`
+	Limits       map[string]string `mapstructure:"limits"`
+	NodeSelector map[string]string `mapstructure:"node_selector"`
+}
+
+// Provider runs environments in a Kubernetes cluster.
+type Provider struct {
+	cfg  *config.Config
+	opts options
+	// PollInterval is the interval between the checks of the state of the
+	// StatefulSets.
+	PollInterval time.Duration
+
+	mu        sync.Mutex
+	client    *rest.Client
+	namespace string
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns a kubernetes provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	if opts.ServiceType == "" {
+		opts.ServiceType = "LoadBalancer"
+	}
+	return &Provider{cfg: c, opts: opts, PollInterval: 2 * time.Second}
+}
+
+// api returns the client of the API server and the namespace of the
+// environment, loading the kubeconfig on first use.
+func (p *Provider) api() (*rest.Client, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		return p.client, p.namespace, nil
+	}
+	cl, err := loadCluster(p.opts.Kubeconfig, p.opts.Context)
+	if err != nil {
+		return nil, "", err
+	}
+	p.client = &rest.Client{
+		BaseURL:      cl.server,
+		HTTPClient:   cl.client,
+		Authorize:    cl.authorize,
+		ErrorMessage: errorMessage,
+	}
+	p.namespace = p.opts.Namespace
+	if p.namespace == "" {
+		p.namespace = cl.namespace
+	}
+	if p.namespace == "" {
+		p.namespace = "default"
+	}
+	return p.client, p.namespace, nil
+}
+
+func errorMessage(body []byte) string {
+	var status struct {
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(body, &status)
+	return status.Message
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	switch opts.ServiceType {
+	case "", "LoadBalancer", "NodePort", "ClusterIP":
+	default:
+		errs = append(errs, &config.FieldError{Path: "provider_options.service_type", Message: "must be LoadBalancer, NodePort or ClusterIP"})
+	}
+	// Object names are DNS labels.
+	if len(namePrefix+c.Name) > 52 {
+		errs = append(errs, &config.FieldError{Path: "name", Message: "is too long for Kubernetes object names"})
+	}
+	return errs
+}
+
+func (p *Provider) image(c *config.Config) string {
+	if c.Image == "" {
+		return defaultImage
+	}
+	return c.Image
+}
+
+// objectMeta is the metadata of an object.
+type objectMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	Generation        int64             `json:"generation,omitempty"`
+	CreationTimestamp *time.Time        `json:"creationTimestamp,omitempty"`
+}
+
+type statefulSet struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   objectMeta      `json:"metadata"`
+	Spec       statefulSetSpec `json:"spec"`
+	Status     struct {
+		ObservedGeneration int64 `json:"observedGeneration"`
+		Replicas           int   `json:"replicas"`
+		ReadyReplicas      int   `json:"readyReplicas"`
+		UpdatedReplicas    int   `json:"updatedReplicas"`
+	} `json:"status"`
+}
+
+type statefulSetSpec struct {
+	Replicas    *int   `json:"replicas"`
+	ServiceName string `json:"serviceName"`
+	Selector    struct {
+		MatchLabels map[string]string `json:"matchLabels"`
+	} `json:"selector"`
+	Template struct {
+		Metadata objectMeta `json:"metadata"`
+		Spec     podSpec    `json:"spec"`
+	} `json:"template"`
+	VolumeClaimTemplates []persistentVolumeClaim `json:"volumeClaimTemplates"`
+}
+
+type podSpec struct {
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	Containers   []containerSpec   `json:"containers"`
+	Volumes      []volume          `json:"volumes,omitempty"`
+	NodeName     string            `json:"nodeName,omitempty"`
+}
+
+type containerSpec struct {
+	Name         string               `json:"name"`
+	Image        string               `json:"image"`
+	Command      []string             `json:"command,omitempty"`
+	Ports        []containerPort      `json:"ports,omitempty"`
+	Resources    resourceRequirements `json:"resources"`
+	VolumeMounts []volumeMount        `json:"volumeMounts,omitempty"`
+}
+
+type containerPort struct {
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+type resourceRequirements struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+type volumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+type volume struct {
+	Name   string `json:"name"`
+	Secret struct {
+		SecretName string `json:"secretName"`
+	} `json:"secret"`
+}
+
+type persistentVolumeClaim struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		AccessModes      []string             `json:"accessModes"`
+		StorageClassName *string              `json:"storageClassName,omitempty"`
+		Resources        resourceRequirements `json:"resources"`
+	} `json:"spec"`
+}
+
+type service struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	Spec       struct {
+		Type      string            `json:"type"`
+		Selector  map[string]string `json:"selector"`
+		Ports     []servicePort     `json:"ports"`
+		ClusterIP string            `json:"clusterIP,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				IP       string `json:"ip"`
+				Hostname string `json:"hostname"`
+			} `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+type servicePort struct {
+	Name       string `json:"name"`
+	Protocol   string `json:"protocol"`
+	Port       int    `json:"port"`
+	TargetPort int    `json:"targetPort"`
+	NodePort   int    `json:"nodePort,omitempty"`
+}
+
+// split returns the namespace and the name of an object ID.
+func split(id string) (string, string, bool) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// names returns the namespace and the name of the StatefulSet of a machine
+// ID.
+func names(id string) (string, string, bool) {
+	ns, name, ok := split(id)
+	return ns, name, ok && strings.HasPrefix(name, namePrefix)
+}
+
+func labels(env string) map[string]string {
+	return map[string]string{labelManagedBy: "clouddev", labelEnv: env}
+}
+
+// ports returns the ports of the environment, the SSH server first.
+func ports(c *config.Config) []int {
+	ports := []int{22}
+	for _, port := range c.Ports {
+		if port != 22 {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+func (p *Provider) container(c *config.Config) containerSpec {
+	ct := containerSpec{
+		Name:    containerName,
+		Image:   p.image(c),
+		Command: containerinit.Command(),
+		Resources: resourceRequirements{
+			Requests: p.opts.Requests,
+			Limits:   p.opts.Limits,
+		},
+		VolumeMounts: []volumeMount{
+			{Name: homeVolume, MountPath: "/home"},
+			{Name: seedVolume, MountPath: containerinit.SeedDir, ReadOnly: true},
+		},
+	}
+	for _, port := range ports(c) {
+		ct.Ports = append(ct.Ports, containerPort{ContainerPort: port, Protocol: "TCP"})
+	}
+	return ct
+}
+
+func (p *Provider) servicePorts(c *config.Config) []servicePort {
+	var sp []servicePort
+	for _, port := range ports(c) {
+		name := "tcp-" + strconv.Itoa(port)
+		if port == 22 {
+			name = "ssh"
+		}
+		sp = append(sp, servicePort{Name: name, Protocol: "TCP", Port: port, TargetPort: port})
+	}
+	return sp
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	client, ns, err := p.api()
+	if err != nil {
+		return nil, err
+	}
+	name := namePrefix + c.Name
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}}
+
+	// cloud-init reads the user data from the seed directory the secret is
+	// mounted on.
+	secret := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   objectMeta{Name: name + "-userdata", Labels: labels(c.Name)},
+		"type":       "Opaque",
+		"data": map[string][]byte{
+			"user-data": spec.UserData,
+			"meta-data": containerinit.MetaData(name, c.Name),
+		},
+	}
+	if err := client.Do(ctx, http.MethodPost, corePath(ns, "secrets"), secret, nil); err != nil {
+		return m, fmt.Errorf("failed to create secret: %w", err)
+	}
+	m.Resources[resourceSecret] = ns + "/" + name + "-userdata"
+
+	svc := &service{APIVersion: "v1", Kind: "Service", Metadata: objectMeta{Name: name, Labels: labels(c.Name)}}
+	svc.Spec.Type = p.opts.ServiceType
+	svc.Spec.Selector = labels(c.Name)
+	svc.Spec.Ports = p.servicePorts(c)
+	if err := client.Do(ctx, http.MethodPost, corePath(ns, "services"), svc, nil); err != nil {
+		return m, fmt.Errorf("failed to create service: %w", err)
+	}
+	m.Resources[resourceService] = ns + "/" + name
+
+	one := 1
+	sts := &statefulSet{APIVersion: "apps/v1", Kind: "StatefulSet", Metadata: objectMeta{
+		Name:   name,
+		Labels: labels(c.Name),
+		Annotations: map[string]string{
+			annotationRequests: formatMap(p.opts.Requests),
+			annotationLimits:   formatMap(p.opts.Limits),
+		},
+	}}
+	sts.Spec.Replicas = &one
+	sts.Spec.ServiceName = name
+	sts.Spec.Selector.MatchLabels = labels(c.Name)
+	sts.Spec.Template.Metadata.Labels = labels(c.Name)
+	sts.Spec.Template.Spec = podSpec{
+		NodeSelector: p.opts.NodeSelector,
+		Containers:   []containerSpec{p.container(c)},
+	}
+	seed := volume{Name: seedVolume}
+	seed.Secret.SecretName = name + "-userdata"
+	sts.Spec.Template.Spec.Volumes = []volume{seed}
+	home := persistentVolumeClaim{Metadata: objectMeta{Name: homeVolume, Labels: labels(c.Name)}}
+	home.Spec.AccessModes = []string{"ReadWriteOnce"}
+	if c.Disk.Type != "" {
+		home.Spec.StorageClassName = &c.Disk.Type
+	}
+	home.Spec.Resources.Requests = map[string]string{"storage": diskSize(c)}
+	sts.Spec.VolumeClaimTemplates = []persistentVolumeClaim{home}
+	if err := client.Do(ctx, http.MethodPost, statefulSetsPath(ns), sts, nil); err != nil {
+		return m, fmt.Errorf("failed to create statefulset: %w", err)
+	}
+	m.ID = ns + "/" + name
+	m.Resources[provider.ResourceInstance] = m.ID
+	// The claim of the pod is named after the claim template and the pod.
+	m.Resources[provider.ResourceDisk] = ns + "/" + homeVolume + "-" + name + "-0"
+
+	got, err := p.wait(ctx, m.ID)
+	if err != nil {
+		return m, err
+	}
+	got.Resources = m.Resources
+	return got, nil
+}
+
+func diskSize(c *config.Config) string {
+	return strconv.Itoa(c.Disk.SizeGB) + "Gi"
+}
+
+// formatMap formats a map in a canonical, sorted form.
+func formatMap(m map[string]string) string {
+	s := make([]string, 0, len(m))
+	for k, v := range m {
+		s = append(s, k+"="+v)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// wait waits for the pod of the StatefulSet to be ready and reachable.
+func (p *Provider) wait(ctx context.Context, id string) (*provider.Machine, error) {
+	var m *provider.Machine
+	if err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		var err error
+		m, err = p.Get(ctx, id)
+		return err == nil && m.Status == provider.StatusRunning && m.Address != "", err
+	}); err != nil {
+		return nil, fmt.Errorf("failed waiting for statefulset %s to be ready: %w", id, err)
+	}
+	return m, nil
+}
+
+func (p *Provider) statefulSet(ctx context.Context, id string) (*statefulSet, error) {
+	ns, name, ok := names(id)
+	if !ok {
+		return nil, provider.ErrNotFound
+	}
+	client, _, err := p.api()
+	if err != nil {
+		return nil, err
+	}
+	var sts statefulSet
+	err = client.Do(ctx, http.MethodGet, statefulSetsPath(ns)+"/"+name, nil, &sts)
+	if rest.IsNotFound(err) {
+		return nil, provider.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sts, nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	sts, err := p.statefulSet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	m := &provider.Machine{
+		ID:        id,
+		Name:      sts.Metadata.Labels[labelEnv],
+		Status:    status(sts),
+		Resources: map[string]string{provider.ResourceInstance: id},
+	}
+	if sts.Metadata.CreationTimestamp != nil {
+		m.CreatedAt = *sts.Metadata.CreationTimestamp
+	}
+	if m.Status == provider.StatusRunning {
+		if m.Address, m.SSHPort, err = p.address(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func status(sts *statefulSet) provider.Status {
+	switch {
+	case sts.Spec.Replicas != nil && *sts.Spec.Replicas == 0 && sts.Status.Replicas == 0:
+		return provider.StatusStopped
+	case sts.Spec.Replicas != nil && *sts.Spec.Replicas > 0 && sts.Status.ReadyReplicas == *sts.Spec.Replicas:
+		return provider.StatusRunning
+	default:
+		return provider.StatusPending
+	}
+}
+
+// address returns the address and port the SSH server is reachable on:
+// the load balancer, the node of the pod, or the cluster IP.
+func (p *Provider) address(ctx context.Context, id string) (string, int, error) {
+	client, _, err := p.api()
+	if err != nil {
+		return "", 0, err
+	}
+	ns, name, _ := names(id)
+	var svc service
+	err = client.Do(ctx, http.MethodGet, corePath(ns, "services")+"/"+name, nil, &svc)
+	if rest.IsNotFound(err) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	var ssh servicePort
+	for _, sp := range svc.Spec.Ports {
+		if sp.TargetPort == 22 {
+			ssh = sp
+		}
+	}
+
+	switch svc.Spec.Type {
+	case "LoadBalancer":
+		ingress := svc.Status.LoadBalancer.Ingress
+		if len(ingress) == 0 {
+			return "", 0, nil
+		}
+		if ingress[0].IP != "" {
+			return ingress[0].IP, ssh.Port, nil
+		}
+		return ingress[0].Hostname, ssh.Port, nil
+	case "NodePort":
+		var pod struct {
+			Spec podSpec `json:"spec"`
+		}
+		if err := client.Do(ctx, http.MethodGet, corePath(ns, "pods")+"/"+name+"-0", nil, &pod); err != nil {
+			return "", 0, err
+		}
+		var node struct {
+			Status struct {
+				Addresses []struct {
+					Type    string `json:"type"`
+					Address string `json:"address"`
+				} `json:"addresses"`
+			} `json:"status"`
+		}
+		if err := client.Do(ctx, http.MethodGet, "/api/v1/nodes/"+url.PathEscape(pod.Spec.NodeName), nil, &node); err != nil {
+			return "", 0, err
+		}
+		address := ""
+		for _, a := range node.Status.Addresses {
+			if a.Type == "ExternalIP" || (a.Type == "InternalIP" && address == "") {
+				address = a.Address
+			}
+		}
+		return address, ssh.NodePort, nil
+	default:
+		return svc.Spec.ClusterIP, ssh.Port, nil
+	}
+}
+
+// patch applies a JSON merge patch to an object.
+func (p *Provider) patch(ctx context.Context, path string, patch interface{}) error {
+	client, _, err := p.api()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, client.BaseURL+path, strings.NewReader(string(data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mergePatchMediaType)
+	req.Header.Set("Accept", "application/json")
+	_, err = client.Send(req, nil)
+	return err
+}
+
+// scale sets the number of replicas of the StatefulSet.
+func (p *Provider) scale(ctx context.Context, id string, replicas int) error {
+	ns, name, ok := names(id)
+	if !ok {
+		return provider.ErrNotFound
+	}
+	err := p.patch(ctx, statefulSetsPath(ns)+"/"+name, map[string]interface{}{
+		"spec": map[string]int{"replicas": replicas},
+	})
+	if rest.IsNotFound(err) {
+		return provider.ErrNotFound
+	}
+	return err
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	if err := p.scale(ctx, id, 1); err != nil {
+		return err
+	}
+	_, err := p.wait(ctx, id)
+	return err
+}
+
+// Stop implements provider.Provider. The StatefulSet is scaled to zero,
+// keeping the home volume.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	if err := p.scale(ctx, id, 0); err != nil {
+		return err
+	}
+	return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		m, err := p.Get(ctx, id)
+		return err == nil && m.Status == provider.StatusStopped, err
+	})
+}
+
+// ConsoleOutput implements provider.ConsoleReader with the recent logs of
+// the pod, in which the bootstrap prints the SSH host keys. A stopped
+// environment has no pod and no output.
+func (p *Provider) ConsoleOutput(ctx context.Context, id string) (string, error) {
+	if _, err := p.statefulSet(ctx, id); err != nil {
+		return "", err
+	}
+	ns, name, _ := names(id)
+	client, _, err := p.api()
+	if err != nil {
+		return "", err
+	}
+	var logs []byte
+	err = client.Do(ctx, http.MethodGet, corePath(ns, "pods")+"/"+name+"-0/log?container="+containerName+"&tailLines=1000", nil, &logs)
+	if rest.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(logs), nil
+}
+
+// Destroy implements provider.Provider. The home volumes of the environment
+// are deleted with the StatefulSet.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	client, ns, err := p.api()
+	if err != nil {
+		return err
+	}
+	kinds := []struct {
+		kind string
+		path func(ns string) string
+	}{
+		{provider.ResourceInstance, statefulSetsPath},
+		{resourceService, func(ns string) string { return corePath(ns, "services") }},
+		{resourceSecret, func(ns string) string { return corePath(ns, "secrets") }},
+		{provider.ResourceDisk, func(ns string) string { return corePath(ns, "persistentvolumeclaims") }},
+	}
+	// The objects are named after the StatefulSet, so that they're found
+	// even if they weren't recorded.
+	resources := map[string]string{}
+	if sns, name, ok := names(m.Resources[provider.ResourceInstance]); ok {
+		resources[resourceService] = sns + "/" + name
+		resources[resourceSecret] = sns + "/" + name + "-userdata"
+	}
+	for k, v := range m.Resources {
+		resources[k] = v
+	}
+	for _, k := range kinds {
+		ons, name, ok := split(resources[k.kind])
+		if !ok {
+			continue
+		}
+		if k.kind == provider.ResourceInstance {
+			ns = ons
+		}
+		err := client.Do(ctx, http.MethodDelete, k.path(ons)+"/"+url.PathEscape(name), nil, nil)
+		if err != nil && !rest.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s %s: %w", k.kind, resources[k.kind], err)
+		}
+	}
+	// Claims of replicas that aren't recorded are found by label.
+	if m.Name != "" {
+		selector := url.QueryEscape(labelEnv + "=" + m.Name)
+		if err := client.Do(ctx, http.MethodDelete, corePath(ns, "persistentvolumeclaims")+"?labelSelector="+selector, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List implements provider.Provider. Only the configured namespace is
+// listed.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	client, ns, err := p.api()
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []statefulSet `json:"items"`
+	}
+	selector := url.QueryEscape(labelManagedBy + "=clouddev")
+	if err := client.Do(ctx, http.MethodGet, statefulSetsPath(ns)+"?labelSelector="+selector, nil, &list); err != nil {
+		return nil, err
+	}
+	var machines []*provider.Machine
+	for _, sts := range list.Items {
+		m, err := p.Get(ctx, ns+"/"+sts.Metadata.Name)
+		if errors.Is(err, provider.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// Plan implements provider.Provider. Everything but the namespace and the
+// home volume size is updated in place, restarting the pod.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	client, ns, err := p.api()
+	if err != nil {
+		return nil, err
+	}
+	sts, err := p.statefulSet(ctx, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	sns, name, _ := names(m.ID)
+
+	var changes []provider.Change
+	if sns != ns {
+		changes = append(changes, provider.Change{Field: "provider_options.namespace", Old: sns, New: ns, Replace: true})
+	}
+	if len(sts.Spec.VolumeClaimTemplates) > 0 {
+		if old, new := sts.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests["storage"], diskSize(c); old != new {
+			changes = append(changes, provider.Change{Field: "disk.size_gb", Old: old, New: new, Replace: true})
+		}
+	}
+	if len(sts.Spec.Template.Spec.Containers) > 0 {
+		if old, new := sts.Spec.Template.Spec.Containers[0].Image, p.image(c); old != new {
+			changes = append(changes, provider.Change{Field: "image", Old: old, New: new})
+		}
+	}
+	if old, new := sts.Metadata.Annotations[annotationRequests], formatMap(p.opts.Requests); old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.requests", Old: old, New: new})
+	}
+	if old, new := sts.Metadata.Annotations[annotationLimits], formatMap(p.opts.Limits); old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.limits", Old: old, New: new})
+	}
+	if old, new := formatMap(sts.Spec.Template.Spec.NodeSelector), formatMap(p.opts.NodeSelector); old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.node_selector", Old: old, New: new})
+	}
+
+	var svc service
+	err = client.Do(ctx, http.MethodGet, corePath(sns, "services")+"/"+name, nil, &svc)
+	if err != nil && !rest.IsNotFound(err) {
+		return nil, err
+	}
+	if old, new := svc.Spec.Type, p.opts.ServiceType; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.service_type", Old: old, New: new})
+	}
+	var open []int
+	for _, sp := range svc.Spec.Ports {
+		if sp.TargetPort != 22 {
+			open = append(open, sp.TargetPort)
+		}
+	}
+	if old, new := provider.FormatPorts(open), provider.FormatPorts(ports(c)[1:]); old != new {
+		changes = append(changes, provider.Change{Field: "ports", Old: old, New: new})
+	}
+	return changes, nil
+}
+
+// Update implements provider.Updater. The pod template and the service are
+// patched, and the pod of a running environment is recreated.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	c := spec.Config
+	updateService := false
+	for _, ch := range changes {
+		switch ch.Field {
+		case "image", "provider_options.requests", "provider_options.limits", "provider_options.node_selector":
+		case "ports", "provider_options.service_type":
+			updateService = true
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+	sts, err := p.statefulSet(ctx, m.ID)
+	if err != nil {
+		return err
+	}
+	ns, name, _ := names(m.ID)
+
+	// Merge patches remove the keys set to null.
+	nodeSelector := map[string]interface{}{}
+	for k := range sts.Spec.Template.Spec.NodeSelector {
+		nodeSelector[k] = nil
+	}
+	for k, v := range p.opts.NodeSelector {
+		nodeSelector[k] = v
+	}
+	err = p.patch(ctx, statefulSetsPath(ns)+"/"+name, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				annotationRequests: formatMap(p.opts.Requests),
+				annotationLimits:   formatMap(p.opts.Limits),
+			},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"nodeSelector": nodeSelector,
+					"containers":   []containerSpec{p.container(c)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update statefulset %s: %w", m.ID, err)
+	}
+	if updateService {
+		err := p.patch(ctx, corePath(ns, "services")+"/"+name, map[string]interface{}{
+			"spec": map[string]interface{}{
+				"type":  p.opts.ServiceType,
+				"ports": p.servicePorts(c),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update service %s: %w", m.ID, err)
+		}
+	}
+
+	if sts.Spec.Replicas == nil || *sts.Spec.Replicas == 0 {
+		return nil
+	}
+	// Wait for the rollout of the new pod.
+	return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		sts, err := p.statefulSet(ctx, m.ID)
+		if err != nil {
+			return false, err
+		}
+		return sts.Status.ObservedGeneration >= sts.Metadata.Generation &&
+			sts.Status.UpdatedReplicas == *sts.Spec.Replicas &&
+			sts.Status.ReadyReplicas == *sts.Spec.Replicas, nil
+	})
+}
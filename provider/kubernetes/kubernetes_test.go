@@ -0,0 +1,224 @@
+package kubernetes_test
+
+import (
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/kubernetes"
+	"github.com/darkowlzz/clouddev/provider/kubernetes/kubernetestest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// namespace is the namespace of the kubeconfig context of the tests.
+const namespace = "dev"
+
+// newTestProvider returns a provider of the spec against a fake API server,
+// through a kubeconfig with a context for it.
+func newTestProvider(t *testing.T, s *kubernetestest.Server, spec *provider.Spec, opts map[string]interface{}) *kubernetes.Provider {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := s.WriteKubeconfig(path, namespace); err != nil {
+		t.Fatal(err)
+	}
+	spec.Config.ProviderOptions = map[string]interface{}{"kubeconfig": path}
+	for k, v := range opts {
+		spec.Config.ProviderOptions[k] = v
+	}
+	p := kubernetes.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *kubernetestest.Server {
+	s := kubernetestest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(kubernetes.Name)
+	providertest.Run(t, newTestProvider(t, s, spec, nil), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d objects are left after the suite", n)
+	}
+}
+
+func TestStopKeepsHomeVolume(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(kubernetes.Name)
+	p := newTestProvider(t, s, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if want := namespace + "/home-clouddev-conformance-0"; m.Resources[provider.ResourceDisk] != want {
+		t.Errorf("Create() home volume = %q, want %q", m.Resources[provider.ResourceDisk], want)
+	}
+	if err := p.Stop(ctx, m.ID); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	sts := s.Object("statefulsets", namespace, "clouddev-conformance")
+	if replicas := sts["spec"].(map[string]interface{})["replicas"]; replicas != float64(0) {
+		t.Errorf("Stop() left %v replicas, want the statefulset scaled to zero", replicas)
+	}
+	if s.Object("pods", namespace, "clouddev-conformance-0") != nil {
+		t.Error("the pod still exists after Stop()")
+	}
+	if s.Object("persistentvolumeclaims", namespace, "home-clouddev-conformance-0") == nil {
+		t.Fatal("Stop() deleted the home volume")
+	}
+
+	if err := p.Start(ctx, m.ID); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	got, err := p.Get(ctx, m.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Status != provider.StatusRunning || got.Address == "" {
+		t.Errorf("Get() after Start() = %s at %q, want running with an address", got.Status, got.Address)
+	}
+
+	// The claim is found by label, and the service and the secret by name,
+	// when only the statefulset is recorded.
+	if err := p.Destroy(ctx, &provider.Machine{Name: m.Name, Resources: map[string]string{provider.ResourceInstance: m.ID}}); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d objects are left after Destroy(), including the home volume", n)
+	}
+}
+
+func TestUserDataSecret(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(kubernetes.Name)
+	p := newTestProvider(t, s, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer p.Destroy(ctx, m)
+	secret := s.Object("secrets", namespace, "clouddev-conformance-userdata")
+	if secret == nil {
+		t.Fatal("Create() didn't create the user data secret")
+	}
+	data := secret["data"].(map[string]interface{})
+	userData, err := base64.StdEncoding.DecodeString(data["user-data"].(string))
+	if err != nil || string(userData) != string(spec.UserData) {
+		t.Errorf("secret user-data = %q, %v, want %q", userData, err, spec.UserData)
+	}
+}
+
+func TestServiceTypes(t *testing.T) {
+	tests := []struct {
+		serviceType string
+		address     string
+		port        func(int) bool
+	}{
+		{"LoadBalancer", "203.0.113.", func(port int) bool { return port == 22 }},
+		{"NodePort", kubernetestest.NodeAddress, func(port int) bool { return port > 30000 }},
+		{"ClusterIP", "10.96.0.", func(port int) bool { return port == 22 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serviceType, func(t *testing.T) {
+			s := newServer(t)
+			spec := providertest.Spec(kubernetes.Name)
+			spec.Config.Ports = []int{8080}
+			p := newTestProvider(t, s, spec, map[string]interface{}{"service_type": tt.serviceType})
+			ctx := context.Background()
+
+			m, err := p.Create(ctx, spec)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			defer p.Destroy(ctx, m)
+			if !strings.HasPrefix(m.Address, tt.address) || !tt.port(m.SSHPort) {
+				t.Errorf("Create() SSH address = %s:%d, want the %s address", m.Address, m.SSHPort, tt.serviceType)
+			}
+			svc := s.Object("services", namespace, "clouddev-conformance")
+			if ports := svc["spec"].(map[string]interface{})["ports"].([]interface{}); len(ports) != 2 {
+				t.Errorf("service ports = %v, want SSH and 8080", ports)
+			}
+		})
+	}
+}
+
+func TestUpdateResourcesInPlace(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(kubernetes.Name)
+	opts := map[string]interface{}{
+		"requests":      map[string]string{"cpu": "1", "memory": "2Gi"},
+		"limits":        map[string]string{"memory": "4Gi"},
+		"node_selector": map[string]string{"pool": "dev"},
+	}
+	p := newTestProvider(t, s, spec, opts)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer p.Destroy(ctx, m)
+	podSpec := s.Object("pods", namespace, "clouddev-conformance-0")["spec"].(map[string]interface{})
+	if got := podSpec["nodeSelector"].(map[string]interface{})["pool"]; got != "dev" {
+		t.Errorf("pod node selector pool = %v, want dev", got)
+	}
+	resources := podSpec["containers"].([]interface{})[0].(map[string]interface{})["resources"].(map[string]interface{})
+	if got := resources["limits"].(map[string]interface{})["memory"]; got != "4Gi" {
+		t.Errorf("container memory limit = %v, want 4Gi", got)
+	}
+	if changes, err := p.Plan(ctx, spec, m); err != nil || len(changes) > 0 {
+		t.Fatalf("Plan() = %v, %v, want no changes", changes, err)
+	}
+
+	changed := providertest.Spec(kubernetes.Name)
+	opts["limits"] = map[string]string{"memory": "8Gi"}
+	opts["node_selector"] = map[string]string{"zone": "a"}
+	p = newTestProvider(t, s, changed, opts)
+	changes, err := p.Plan(ctx, changed, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Plan() = %v, want the limits and the node selector", changes)
+	}
+	if err := p.Update(ctx, changed, m, changes); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if changes, err := p.Plan(ctx, changed, m); err != nil || len(changes) > 0 {
+		t.Errorf("Plan() after Update() = %v, %v, want no changes", changes, err)
+	}
+	podSpec = s.Object("pods", namespace, "clouddev-conformance-0")["spec"].(map[string]interface{})
+	if got := podSpec["nodeSelector"].(map[string]interface{}); len(got) != 1 || got["zone"] != "a" {
+		t.Errorf("pod node selector after Update() = %v, want only zone a", got)
+	}
+
+	bigger := providertest.Spec(kubernetes.Name)
+	bigger.Config.Disk.SizeGB = spec.Config.Disk.SizeGB + 10
+	changes, err = p.Plan(ctx, bigger, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) != 1 || changes[0].Field != "disk.size_gb" || !changes[0].Replace {
+		t.Errorf("Plan() of a larger home volume = %v, want to replace the statefulset", changes)
+	}
+}
+
+func TestUnknownContext(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(kubernetes.Name)
+	p := newTestProvider(t, s, spec, map[string]interface{}{"context": "staging"})
+	if _, err := p.Get(context.Background(), namespace+"/clouddev-conformance"); err == nil || !strings.Contains(err.Error(), "context staging not found") {
+		t.Errorf("Get() error = %v, want the unknown context", err)
+	}
+}
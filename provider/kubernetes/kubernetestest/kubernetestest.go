@@ -0,0 +1,411 @@
+// Package kubernetestest implements an in-memory fake of the Kubernetes API
+// server for testing the kubernetes provider.
+//
+// The fake stores the objects as they're sent, and stands in for the
+// controllers: StatefulSets get their pods and claims at once and are
+// ready immediately, and load balancers get an address.
+package kubernetestest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// Token is the bearer token accepted by the fake.
+const Token = "kubernetestest-token"
+
+// Node is the node the pods run on.
+const Node = "node-1"
+
+// NodeAddress is the external address of the node.
+const NodeAddress = "198.51.100.1"
+
+// Server is a fake Kubernetes API server.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	version  int
+	nextPort int
+	nextIP   int
+	// objects are keyed by resource, e.g. "statefulsets", then by
+	// namespace/name.
+	objects map[string]map[string]map[string]interface{}
+}
+
+// NewServer starts a fake API server. The caller must close it.
+func NewServer() *Server {
+	s := &Server{
+		nextPort: 30000,
+		objects: map[string]map[string]map[string]interface{}{
+			"statefulsets":           {},
+			"services":               {},
+			"secrets":                {},
+			"persistentvolumeclaims": {},
+			"pods":                   {},
+			"nodes": {"/" + Node: {
+				"metadata": map[string]interface{}{"name": Node},
+				"status": map[string]interface{}{"addresses": []interface{}{
+					map[string]interface{}{"type": "InternalIP", "address": "10.0.0.1"},
+					map[string]interface{}{"type": "ExternalIP", "address": NodeAddress},
+				}},
+			}},
+		},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// WriteKubeconfig writes a kubeconfig file with a context named fake for
+// the server, using the namespace.
+func (s *Server) WriteKubeconfig(path, namespace string) error {
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: fake
+clusters:
+- name: fake
+  cluster:
+    server: %s
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: fake
+    namespace: %s
+users:
+- name: fake
+  user:
+    token: %s
+`, s.URL, namespace, Token)
+	return ioutil.WriteFile(path, []byte(kubeconfig), 0o600)
+}
+
+// Resources returns the number of StatefulSets, services, secrets and
+// claims that exist, to check for leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, resource := range []string{"statefulsets", "services", "secrets", "persistentvolumeclaims"} {
+		n += len(s.objects[resource])
+	}
+	return n
+}
+
+// Object returns a copy of an object, or nil if it doesn't exist.
+func (s *Server) Object(resource, namespace, name string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[resource][namespace+"/"+name]
+	if !ok {
+		return nil
+	}
+	return deepCopy(obj)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		writeStatus(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// /api/v1/namespaces/{ns}/{resource}[/{name}],
+	// /apis/apps/v1/namespaces/{ns}/statefulsets[/{name}],
+	// /api/v1/namespaces/{ns}/pods/{name}/log or
+	// /api/v1/nodes/{name}.
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/apis/apps/v1/"), "/api/v1/")
+	parts := strings.Split(path, "/")
+	if len(parts) == 5 && parts[0] == "namespaces" && parts[2] == "pods" && parts[4] == "log" && r.Method == http.MethodGet {
+		// The pods print the host keys as the bootstrap does.
+		if _, ok := s.objects["pods"][parts[1]+"/"+parts[3]]; !ok {
+			writeStatus(w, http.StatusNotFound, fmt.Sprintf("pods %q not found", parts[3]))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, providertest.ConsoleOutput)
+		return
+	}
+	var ns, resource, name string
+	switch {
+	case len(parts) == 2 && parts[0] == "nodes":
+		resource, name = parts[0], parts[1]
+	case len(parts) >= 3 && parts[0] == "namespaces" && len(parts) <= 4:
+		ns, resource = parts[1], parts[2]
+		if len(parts) == 4 {
+			name = parts[3]
+		}
+	default:
+		writeStatus(w, http.StatusNotFound, "the server could not find the requested resource")
+		return
+	}
+	objects, ok := s.objects[resource]
+	if !ok || (resource == "statefulsets") != strings.HasPrefix(r.URL.Path, "/apis/apps/v1/") {
+		writeStatus(w, http.StatusNotFound, "the server could not find the requested resource")
+		return
+	}
+	key := ns + "/" + name
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		items := []interface{}{}
+		for k, obj := range objects {
+			if strings.HasPrefix(k, ns+"/") && matchLabels(r, obj) {
+				items = append(items, obj)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "List", "items": items})
+	case name == "" && r.Method == http.MethodPost:
+		var obj map[string]interface{}
+		if !decode(w, r, &obj) {
+			return
+		}
+		meta, _ := obj["metadata"].(map[string]interface{})
+		name, _ := meta["name"].(string)
+		if name == "" {
+			writeStatus(w, http.StatusUnprocessableEntity, "metadata.name: Required value")
+			return
+		}
+		key := ns + "/" + name
+		if _, ok := objects[key]; ok {
+			writeStatus(w, http.StatusConflict, fmt.Sprintf("%s %q already exists", resource, name))
+			return
+		}
+		meta["namespace"] = ns
+		meta["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+		meta["generation"] = 1
+		delete(obj, "status")
+		objects[key] = obj
+		s.touch(obj)
+		s.reconcile()
+		writeJSON(w, http.StatusCreated, obj)
+	case name == "" && r.Method == http.MethodDelete:
+		for k, obj := range objects {
+			if strings.HasPrefix(k, ns+"/") && matchLabels(r, obj) {
+				delete(objects, k)
+			}
+		}
+		s.reconcile()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "List", "items": []interface{}{}})
+	case r.Method == http.MethodGet:
+		obj, ok := objects[key]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, fmt.Sprintf("%s %q not found", resource, name))
+			return
+		}
+		writeJSON(w, http.StatusOK, obj)
+	case r.Method == http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			writeStatus(w, http.StatusUnsupportedMediaType, "unsupported patch type "+r.Header.Get("Content-Type"))
+			return
+		}
+		obj, ok := objects[key]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, fmt.Sprintf("%s %q not found", resource, name))
+			return
+		}
+		var patch map[string]interface{}
+		if !decode(w, r, &patch) {
+			return
+		}
+		oldSpec := deepCopy(obj)["spec"]
+		merged := mergePatch(obj, patch).(map[string]interface{})
+		if !reflect.DeepEqual(oldSpec, merged["spec"]) {
+			meta := merged["metadata"].(map[string]interface{})
+			meta["generation"] = toInt(meta["generation"]) + 1
+		}
+		objects[key] = merged
+		s.touch(merged)
+		s.reconcile()
+		writeJSON(w, http.StatusOK, merged)
+	case r.Method == http.MethodDelete:
+		if _, ok := objects[key]; !ok {
+			writeStatus(w, http.StatusNotFound, fmt.Sprintf("%s %q not found", resource, name))
+			return
+		}
+		delete(objects, key)
+		s.reconcile()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "Status", "status": "Success"})
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// touch bumps the resource version of an object.
+func (s *Server) touch(obj map[string]interface{}) {
+	s.version++
+	obj["metadata"].(map[string]interface{})["resourceVersion"] = fmt.Sprint(s.version)
+}
+
+// reconcile stands in for the controllers.
+func (s *Server) reconcile() {
+	for key, sts := range s.objects["statefulsets"] {
+		ns := strings.SplitN(key, "/", 2)[0]
+		meta := sts["metadata"].(map[string]interface{})
+		spec := sts["spec"].(map[string]interface{})
+		name := meta["name"].(string)
+		replicas := toInt(spec["replicas"])
+		template := spec["template"].(map[string]interface{})
+		podMeta, _ := template["metadata"].(map[string]interface{})
+
+		for i := 0; i < replicas; i++ {
+			pod := fmt.Sprintf("%s-%d", name, i)
+			for _, t := range asSlice(spec["volumeClaimTemplates"]) {
+				claimMeta := t.(map[string]interface{})["metadata"].(map[string]interface{})
+				claim := fmt.Sprintf("%s-%s", claimMeta["name"], pod)
+				if _, ok := s.objects["persistentvolumeclaims"][ns+"/"+claim]; !ok {
+					c := deepCopy(t.(map[string]interface{}))
+					m := c["metadata"].(map[string]interface{})
+					m["name"], m["namespace"] = claim, ns
+					s.objects["persistentvolumeclaims"][ns+"/"+claim] = c
+				}
+			}
+			podSpec := deepCopy(template["spec"].(map[string]interface{}))
+			podSpec["nodeName"] = Node
+			s.objects["pods"][ns+"/"+pod] = map[string]interface{}{
+				"metadata": map[string]interface{}{"name": pod, "namespace": ns, "labels": podMeta["labels"]},
+				"spec":     podSpec,
+			}
+		}
+		for k := range s.objects["pods"] {
+			if strings.HasPrefix(k, key+"-") {
+				var i int
+				if _, err := fmt.Sscanf(strings.TrimPrefix(k, key+"-"), "%d", &i); err == nil && i >= replicas {
+					delete(s.objects["pods"], k)
+				}
+			}
+		}
+		sts["status"] = map[string]interface{}{
+			"observedGeneration": meta["generation"],
+			"replicas":           replicas,
+			"readyReplicas":      replicas,
+			"updatedReplicas":    replicas,
+		}
+	}
+	for k := range s.objects["pods"] {
+		i := strings.LastIndex(k, "-")
+		if _, ok := s.objects["statefulsets"][k[:i]]; !ok {
+			delete(s.objects["pods"], k)
+		}
+	}
+
+	for _, svc := range s.objects["services"] {
+		spec := svc["spec"].(map[string]interface{})
+		if spec["clusterIP"] == nil {
+			s.nextIP++
+			spec["clusterIP"] = fmt.Sprintf("10.96.0.%d", s.nextIP)
+		}
+		typ := spec["type"]
+		for _, p := range asSlice(spec["ports"]) {
+			port := p.(map[string]interface{})
+			if typ == "ClusterIP" {
+				delete(port, "nodePort")
+			} else if port["nodePort"] == nil {
+				s.nextPort++
+				port["nodePort"] = s.nextPort
+			}
+		}
+		status := map[string]interface{}{}
+		if typ == "LoadBalancer" {
+			status["loadBalancer"] = map[string]interface{}{
+				"ingress": []interface{}{map[string]interface{}{"ip": "203.0.113." + strings.TrimPrefix(spec["clusterIP"].(string), "10.96.0.")}},
+			}
+		}
+		svc["status"] = status
+	}
+}
+
+// mergePatch applies a JSON merge patch, RFC 7386.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// matchLabels returns true if the object matches the equality based label
+// selector of the request.
+func matchLabels(r *http.Request, obj map[string]interface{}) bool {
+	selector := r.URL.Query().Get("labelSelector")
+	if selector == "" {
+		return true
+	}
+	meta, _ := obj["metadata"].(map[string]interface{})
+	labels, _ := meta["labels"].(map[string]interface{})
+	for _, req := range strings.Split(selector, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		v, ok := labels[kv[0]]
+		if !ok || len(kv) == 2 && v != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func deepCopy(obj map[string]interface{}) map[string]interface{} {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	var c map[string]interface{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func asSlice(v interface{}) []interface{} {
+	s, _ := v.([]interface{})
+	return s
+}
+
+func toInt(v interface{}) int {
+	switch v := v.(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeStatus(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]interface{}{"kind": "Status", "status": "Failure", "message": msg, "code": code})
+}
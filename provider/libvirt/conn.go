@@ -0,0 +1,144 @@
+package libvirt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ErrNoDomain is returned by a Conn for the domains that don't exist.
+var ErrNoDomain = errors.New("domain not found")
+
+// Conn is a connection to libvirt.
+type Conn interface {
+	// Define defines, or redefines, a domain from its XML description.
+	Define(ctx context.Context, xml string) error
+	Undefine(ctx context.Context, name string) error
+	Start(ctx context.Context, name string) error
+	// Shutdown asks the guest to shut down.
+	Shutdown(ctx context.Context, name string) error
+	// Destroy powers the domain off.
+	Destroy(ctx context.Context, name string) error
+	// State returns the state of the domain, as reported by virsh
+	// domstate, e.g. running or shut off.
+	State(ctx context.Context, name string) (string, error)
+	// XML returns the XML description of the domain.
+	XML(ctx context.Context, name string) (string, error)
+	// List returns the names of all the domains.
+	List(ctx context.Context) ([]string, error)
+	// Leases returns the DHCP leases of the network.
+	Leases(ctx context.Context, network string) ([]Lease, error)
+}
+
+// Lease is a DHCP lease.
+type Lease struct {
+	MAC string
+	IP  string
+}
+
+// virsh is a Conn running virsh.
+type virsh struct {
+	uri string
+}
+
+// NewVirshConn returns a connection to the libvirt URI through the virsh
+// command.
+func NewVirshConn(uri string) Conn {
+	return &virsh{uri: uri}
+}
+
+func (v *virsh) run(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "virsh", append([]string{"--connect", v.uri, "--quiet"}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(msg, "failed to get domain") || strings.Contains(msg, "Domain not found") {
+			return "", ErrNoDomain
+		}
+		if msg == "" {
+			return "", fmt.Errorf("virsh %s: %w", args[0], err)
+		}
+		return "", fmt.Errorf("virsh %s: %s", args[0], msg)
+	}
+	return stdout.String(), nil
+}
+
+func (v *virsh) Define(ctx context.Context, xml string) error {
+	f, err := ioutil.TempFile("", "clouddev-domain-*.xml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(xml); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_, err = v.run(ctx, "define", f.Name())
+	return err
+}
+
+func (v *virsh) Undefine(ctx context.Context, name string) error {
+	_, err := v.run(ctx, "undefine", name)
+	return err
+}
+
+func (v *virsh) Start(ctx context.Context, name string) error {
+	_, err := v.run(ctx, "start", name)
+	return err
+}
+
+func (v *virsh) Shutdown(ctx context.Context, name string) error {
+	_, err := v.run(ctx, "shutdown", name)
+	return err
+}
+
+func (v *virsh) Destroy(ctx context.Context, name string) error {
+	_, err := v.run(ctx, "destroy", name)
+	return err
+}
+
+func (v *virsh) State(ctx context.Context, name string) (string, error) {
+	out, err := v.run(ctx, "domstate", name)
+	return strings.TrimSpace(out), err
+}
+
+func (v *virsh) XML(ctx context.Context, name string) (string, error) {
+	return v.run(ctx, "dumpxml", name)
+}
+
+func (v *virsh) List(ctx context.Context) ([]string, error) {
+	out, err := v.run(ctx, "list", "--all", "--name")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+func (v *virsh) Leases(ctx context.Context, network string) ([]Lease, error) {
+	out, err := v.run(ctx, "net-dhcp-leases", network)
+	if err != nil {
+		return nil, err
+	}
+	// Expiry date, expiry time, MAC, protocol, IP/prefix, hostname, ...
+	var leases []Lease
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || strings.Count(fields[2], ":") != 5 {
+			continue
+		}
+		leases = append(leases, Lease{MAC: fields[2], IP: strings.SplitN(fields[4], "/", 2)[0]})
+	}
+	return leases, s.Err()
+}
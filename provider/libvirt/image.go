@@ -0,0 +1,71 @@
+package libvirt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// cachedImage returns the path of the cloud image, downloading it to the
+// cache directory unless it's a local path or already cached.
+func cachedImage(ctx context.Context, image, cacheDir, checksum string) (string, error) {
+	if !strings.HasPrefix(image, "http://") && !strings.HasPrefix(image, "https://") {
+		if _, err := os.Stat(image); err != nil {
+			return "", fmt.Errorf("invalid image: %w", err)
+		}
+		return filepath.Abs(image)
+	}
+
+	// The cache is keyed by the URL, to keep the images of different
+	// releases with the same file name apart.
+	sum := sha256.Sum256([]byte(image))
+	dst := filepath.Join(cacheDir, hex.EncodeToString(sum[:8])+"-"+path.Base(image))
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, image, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download image %s: %s", image, resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(cacheDir, ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to download image: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); checksum != "" && !strings.EqualFold(got, checksum) {
+		return "", fmt.Errorf("image %s checksum is %s, want %s", image, got, checksum)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return "", err
+	}
+	return dst, os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,153 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const sectorSize = 2048
+
+// writeISO writes an ISO 9660 image with the volume ID and the files in its
+// root directory, as expected by the cloud-init NoCloud data source. Linux
+// maps the plain ISO 9660 names, e.g. USER-DATA;1, to lowercase without
+// version, e.g. user-data.
+func writeISO(w io.Writer, volumeID string, files map[string][]byte, now time.Time) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// System area, volume descriptors, path tables, root directory, then
+	// the files.
+	const (
+		pvdSector       = 16
+		lPathSector     = 18
+		mPathSector     = 19
+		rootSector      = 20
+		firstDataSector = 21
+		minSectors      = 32
+	)
+	extents := make([]uint32, len(names))
+	sector := uint32(firstDataSector)
+	for i, name := range names {
+		extents[i] = sector
+		sector += uint32((len(files[name]) + sectorSize - 1) / sectorSize)
+	}
+	// Some readers expect more than the descriptors, pad small images.
+	total := sector
+	if total < minSectors {
+		total = minSectors
+	}
+
+	var root bytes.Buffer
+	root.Write(dirRecord([]byte{0}, rootSector, sectorSize, true, now))
+	root.Write(dirRecord([]byte{1}, rootSector, sectorSize, true, now))
+	for i, name := range names {
+		root.Write(dirRecord([]byte(strings.ToUpper(name)+";1"), extents[i], uint32(len(files[name])), false, now))
+	}
+
+	img := make([]byte, int(total)*sectorSize)
+
+	pvd := img[pvdSector*sectorSize:]
+	pvd[0] = 1
+	copy(pvd[1:6], "CD001")
+	pvd[6] = 1
+	padCopy(pvd[8:40], "LINUX")
+	padCopy(pvd[40:72], volumeID)
+	bothEndian32(pvd[80:88], total)
+	bothEndian16(pvd[120:124], 1)
+	bothEndian16(pvd[124:128], 1)
+	bothEndian16(pvd[128:132], sectorSize)
+	bothEndian32(pvd[132:140], 10)
+	binary.LittleEndian.PutUint32(pvd[140:144], lPathSector)
+	binary.BigEndian.PutUint32(pvd[148:152], mPathSector)
+	copy(pvd[156:190], dirRecord([]byte{0}, rootSector, sectorSize, true, now))
+	for _, field := range [][2]int{{190, 318}, {318, 446}, {446, 574}, {574, 702}, {702, 739}, {739, 776}, {776, 813}} {
+		padCopy(pvd[field[0]:field[1]], "")
+	}
+	copy(pvd[813:830], volumeTime(now))
+	copy(pvd[830:847], volumeTime(now))
+	copy(pvd[847:864], volumeTime(time.Time{}))
+	copy(pvd[864:881], volumeTime(time.Time{}))
+	pvd[881] = 1
+
+	term := img[(pvdSector+1)*sectorSize:]
+	term[0] = 255
+	copy(term[1:6], "CD001")
+	term[6] = 1
+
+	// The path tables only hold the root directory.
+	lPath := img[lPathSector*sectorSize:]
+	lPath[0] = 1
+	binary.LittleEndian.PutUint32(lPath[2:6], rootSector)
+	binary.LittleEndian.PutUint16(lPath[6:8], 1)
+	mPath := img[mPathSector*sectorSize:]
+	mPath[0] = 1
+	binary.BigEndian.PutUint32(mPath[2:6], rootSector)
+	binary.BigEndian.PutUint16(mPath[6:8], 1)
+
+	copy(img[rootSector*sectorSize:], root.Bytes())
+	for i, name := range names {
+		copy(img[int(extents[i])*sectorSize:], files[name])
+	}
+	_, err := w.Write(img)
+	return err
+}
+
+func dirRecord(name []byte, extent, size uint32, dir bool, t time.Time) []byte {
+	n := 33 + len(name)
+	if n%2 == 1 {
+		n++
+	}
+	r := make([]byte, n)
+	r[0] = byte(n)
+	bothEndian32(r[2:10], extent)
+	bothEndian32(r[10:18], size)
+	t = t.UTC()
+	r[18] = byte(t.Year() - 1900)
+	r[19] = byte(t.Month())
+	r[20] = byte(t.Day())
+	r[21] = byte(t.Hour())
+	r[22] = byte(t.Minute())
+	r[23] = byte(t.Second())
+	if dir {
+		r[25] = 2
+	}
+	bothEndian16(r[28:32], 1)
+	r[32] = byte(len(name))
+	copy(r[33:], name)
+	return r
+}
+
+// volumeTime formats a volume descriptor time, all zeros for the zero time.
+func volumeTime(t time.Time) []byte {
+	b := make([]byte, 17)
+	if t.IsZero() {
+		copy(b, "0000000000000000")
+		return b
+	}
+	copy(b, t.UTC().Format("20060102150405")+"00")
+	return b
+}
+
+func padCopy(dst []byte, s string) {
+	for i := range dst {
+		dst[i] = ' '
+	}
+	copy(dst, s)
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], v)
+	binary.BigEndian.PutUint16(b[2:4], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
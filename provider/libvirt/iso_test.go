@@ -0,0 +1,184 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isoFile is a file read back from the root directory of an ISO image.
+type isoFile struct {
+	name   string
+	extent uint32
+	data   []byte
+}
+
+// readISO reads the volume ID and the files in the root directory of an
+// ISO 9660 image, checking the fields writeISO writes as it goes.
+func readISO(t *testing.T, img []byte) (string, []isoFile) {
+	t.Helper()
+	if len(img)%sectorSize != 0 {
+		t.Fatalf("image size %d isn't a multiple of the sector size", len(img))
+	}
+	sector := func(n uint32) []byte {
+		t.Helper()
+		if int(n+1)*sectorSize > len(img) {
+			t.Fatalf("sector %d is beyond the end of the image", n)
+		}
+		return img[int(n)*sectorSize : int(n+1)*sectorSize]
+	}
+	both32 := func(b []byte) uint32 {
+		t.Helper()
+		le, be := binary.LittleEndian.Uint32(b[0:4]), binary.BigEndian.Uint32(b[4:8])
+		if le != be {
+			t.Fatalf("both-endian field is %d little endian but %d big endian", le, be)
+		}
+		return le
+	}
+
+	pvd := sector(16)
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" || pvd[6] != 1 {
+		t.Fatalf("sector 16 isn't a primary volume descriptor: % x", pvd[:7])
+	}
+	if n := both32(pvd[80:88]); int(n)*sectorSize != len(img) {
+		t.Errorf("volume space size is %d sectors, want %d", n, len(img)/sectorSize)
+	}
+	if n := binary.LittleEndian.Uint16(pvd[128:130]); n != sectorSize {
+		t.Errorf("logical block size is %d, want %d", n, sectorSize)
+	}
+	term := sector(17)
+	if term[0] != 255 || string(term[1:6]) != "CD001" {
+		t.Errorf("sector 17 isn't a volume descriptor set terminator: % x", term[:7])
+	}
+	for _, table := range []uint32{binary.LittleEndian.Uint32(pvd[140:144]), binary.BigEndian.Uint32(pvd[148:152])} {
+		if entry := sector(table); entry[0] != 1 {
+			t.Errorf("path table at sector %d doesn't hold the root directory", table)
+		}
+	}
+
+	root := pvd[156:190]
+	if root[0] != 34 || root[25]&2 == 0 || root[32] != 1 || root[33] != 0 {
+		t.Fatalf("invalid root directory record: % x", root)
+	}
+	rootExtent := both32(root[2:10])
+	dir := sector(rootExtent)[:both32(root[10:18])]
+
+	var files []isoFile
+	for i := 0; i < len(dir) && dir[i] != 0; i += int(dir[i]) {
+		r := dir[i : i+int(dir[i])]
+		if len(r)%2 != 0 {
+			t.Errorf("directory record at offset %d has odd length %d", i, len(r))
+		}
+		name := string(r[33 : 33+int(r[32])])
+		extent, size := both32(r[2:10]), both32(r[10:18])
+		if name == "\x00" || name == "\x01" {
+			if r[25]&2 == 0 || extent != rootExtent {
+				t.Errorf("%q record doesn't point to the root directory", name)
+			}
+			continue
+		}
+		if r[25]&2 != 0 {
+			t.Errorf("%s is a directory", name)
+		}
+		data := img[int(extent)*sectorSize:]
+		if int(size) > len(data) {
+			t.Fatalf("%s extends beyond the end of the image", name)
+		}
+		files = append(files, isoFile{name: name, extent: extent, data: data[:size]})
+	}
+	return strings.TrimRight(string(pvd[40:72]), " "), files
+}
+
+func TestWriteISO(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 300)
+	now := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	var b bytes.Buffer
+	err := writeISO(&b, "cidata", map[string][]byte{
+		"user-data":      large,
+		"meta-data":      []byte("instance-id: conformance\n"),
+		"network-config": nil,
+	}, now)
+	if err != nil {
+		t.Fatalf("writeISO() error = %v", err)
+	}
+
+	volumeID, files := readISO(t, b.Bytes())
+	if volumeID != "cidata" {
+		t.Errorf("volume ID = %q, want cidata", volumeID)
+	}
+	want := []struct {
+		name string
+		data []byte
+	}{
+		{"META-DATA;1", []byte("instance-id: conformance\n")},
+		{"NETWORK-CONFIG;1", nil},
+		{"USER-DATA;1", large},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("root directory has %d files, want %d", len(files), len(want))
+	}
+	end := uint32(21)
+	for i, w := range want {
+		f := files[i]
+		if f.name != w.name {
+			t.Errorf("file %d is %s, want %s", i, f.name, w.name)
+		}
+		if !bytes.Equal(f.data, w.data) {
+			t.Errorf("%s holds %d bytes that differ from the %d written", f.name, len(f.data), len(w.data))
+		}
+		// The extents follow the root directory and don't overlap.
+		if f.extent < end {
+			t.Errorf("%s starts at sector %d, overlapping the previous extent ending at %d", f.name, f.extent, end)
+		}
+		end = f.extent + uint32((len(f.data)+sectorSize-1)/sectorSize)
+	}
+	if n := b.Len() / sectorSize; n != 32 {
+		t.Errorf("small image has %d sectors, want it padded to 32", n)
+	}
+}
+
+func TestWriteISOLargeImage(t *testing.T) {
+	userData := bytes.Repeat([]byte{'x'}, 40*sectorSize+1)
+	var b bytes.Buffer
+	if err := writeISO(&b, "cidata", map[string][]byte{"user-data": userData}, time.Now()); err != nil {
+		t.Fatalf("writeISO() error = %v", err)
+	}
+	_, files := readISO(t, b.Bytes())
+	if len(files) != 1 || !bytes.Equal(files[0].data, userData) {
+		t.Fatalf("root directory = %d files, want the user data", len(files))
+	}
+	if n := b.Len() / sectorSize; n != 21+41 {
+		t.Errorf("image has %d sectors, want %d", n, 21+41)
+	}
+}
+
+func TestWriteSeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.iso")
+	now := time.Unix(1680674828, 0)
+	if err := writeSeed(path, "conformance", []byte("#cloud-config\n"), now); err != nil {
+		t.Fatalf("writeSeed() error = %v", err)
+	}
+	img, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID, files := readISO(t, img)
+	if volumeID != "cidata" {
+		t.Errorf("volume ID = %q, want cidata for the NoCloud data source", volumeID)
+	}
+	got := map[string]string{}
+	for _, f := range files {
+		got[f.name] = string(f.data)
+	}
+	want := map[string]string{
+		"META-DATA;1": "instance-id: conformance-1680674828\nlocal-hostname: conformance\n",
+		"USER-DATA;1": "#cloud-config\n",
+	}
+	if len(got) != len(want) || got["META-DATA;1"] != want["META-DATA;1"] || got["USER-DATA;1"] != want["USER-DATA;1"] {
+		t.Errorf("seed files = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,630 @@
+// Package libvirt implements a provider that provisions environments on
+// local QEMU/KVM virtual machines managed by libvirt, for working without a
+// cloud.
+//
+// The machines boot a copy-on-write overlay of a cached cloud image and get
+// the cloud-init user data from a NoCloud seed ISO.
+package libvirt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "libvirt"
+
+const (
+	defaultURI        = "qemu:///system"
+	defaultImage      = "https://cloud-images.ubuntu.com/jammy/current/jammy-server-cloudimg-amd64.img"
+	defaultStorageDir = "~/.clouddev/libvirt"
+	defaultCacheDir   = "~/.clouddev/images"
+	// domainPrefix prefixes the names of the domains created by clouddev.
+	domainPrefix = "clouddev-"
+	// metadataNamespace is the namespace of the clouddev domain metadata.
+	metadataNamespace = "https://github.com/darkowlzz/clouddev"
+	// resourceSeed is the resource kind of the seed ISO.
+	resourceSeed = "seed"
+	// resourceConsoleLog is the resource kind of the serial console log.
+	resourceConsoleLog = "console_log"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the libvirt provider_options.
+type options struct {
+	URI     string `mapstructure:"uri"`
+	Network string `mapstructure:"network"`
+	// StorageDir holds the overlays and the seed ISOs of the machines. It
+	// must be accessible to the QEMU processes.
+	StorageDir string `mapstructure:"storage_dir"`
+	// ImageCacheDir holds the downloaded cloud images.
+	ImageCacheDir string `mapstructure:"image_cache_dir"`
+	// ImageSHA256 is the expected checksum of the downloaded image.
+	ImageSHA256 string `mapstructure:"image_sha256"`
+	VCPUs       int    `mapstructure:"vcpus"`
+	MemoryMB    int    `mapstructure:"memory_mb"`
+	// DomainType is kvm, or qemu where KVM isn't available.
+	DomainType string `mapstructure:"domain_type"`
+}
+
+// Provider provisions libvirt domains.
+type Provider struct {
+	cfg  *config.Config
+	opts options
+	// Conn is the connection to libvirt, through virsh by default.
+	Conn Conn
+	// QemuImg runs qemu-img with the arguments.
+	QemuImg func(ctx context.Context, args ...string) error
+	// PollInterval is the interval between the checks of the state and
+	// the address of the domains.
+	PollInterval time.Duration
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns a libvirt provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	if opts.URI == "" {
+		opts.URI = defaultURI
+	}
+	if opts.Network == "" {
+		opts.Network = "default"
+	}
+	if opts.StorageDir == "" {
+		opts.StorageDir = defaultStorageDir
+	}
+	if opts.ImageCacheDir == "" {
+		opts.ImageCacheDir = defaultCacheDir
+	}
+	if opts.VCPUs == 0 {
+		opts.VCPUs = 2
+	}
+	if opts.MemoryMB == 0 {
+		opts.MemoryMB = 4096
+	}
+	if opts.DomainType == "" {
+		opts.DomainType = "kvm"
+	}
+	return &Provider{
+		cfg:          c,
+		opts:         opts,
+		Conn:         NewVirshConn(opts.URI),
+		QemuImg:      qemuImg,
+		PollInterval: 2 * time.Second,
+	}
+}
+
+func qemuImg(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, "qemu-img", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img %s: %v: %s", args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	if opts.VCPUs < 0 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.vcpus", Message: "must not be negative"})
+	}
+	if opts.MemoryMB < 0 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.memory_mb", Message: "must not be negative"})
+	}
+	if opts.DomainType != "" && opts.DomainType != "kvm" && opts.DomainType != "qemu" {
+		errs = append(errs, &config.FieldError{Path: "provider_options.domain_type", Message: "must be kvm or qemu"})
+	}
+	return errs
+}
+
+func (p *Provider) image(c *config.Config) string {
+	if c.Image == "" {
+		return defaultImage
+	}
+	return c.Image
+}
+
+// domain is the part of a domain XML description clouddev reads.
+type domain struct {
+	Name   string `xml:"name"`
+	Memory struct {
+		Value int    `xml:",chardata"`
+		Unit  string `xml:"unit,attr"`
+	} `xml:"memory"`
+	VCPU     int         `xml:"vcpu"`
+	Metadata envMetadata `xml:"metadata>env"`
+	Disks    []struct {
+		Device string `xml:"device,attr"`
+		Source struct {
+			File string `xml:"file,attr"`
+		} `xml:"source"`
+	} `xml:"devices>disk"`
+	Interfaces []struct {
+		MAC struct {
+			Address string `xml:"address,attr"`
+		} `xml:"mac"`
+	} `xml:"devices>interface"`
+	Serials []struct {
+		Log struct {
+			File string `xml:"file,attr"`
+		} `xml:"log"`
+	} `xml:"devices>serial"`
+}
+
+// envMetadata is the clouddev metadata of a domain.
+type envMetadata struct {
+	XMLName    xml.Name  `xml:"https://github.com/darkowlzz/clouddev env"`
+	Name       string    `xml:"name"`
+	Image      string    `xml:"image"`
+	DiskSizeGB int       `xml:"disk_size_gb"`
+	Created    time.Time `xml:"created"`
+}
+
+// memoryMB returns the memory of the domain in MiB.
+func (d *domain) memoryMB() int {
+	switch d.Memory.Unit {
+	case "b", "bytes":
+		return d.Memory.Value >> 20
+	case "MiB", "M":
+		return d.Memory.Value
+	case "GiB", "G":
+		return d.Memory.Value << 10
+	default:
+		return d.Memory.Value >> 10
+	}
+}
+
+func (d *domain) mac() string {
+	if len(d.Interfaces) == 0 {
+		return ""
+	}
+	return d.Interfaces[0].MAC.Address
+}
+
+// domainSpec is the data of the domain XML template.
+type domainSpec struct {
+	Type       string
+	Name       string
+	MemoryMB   int
+	VCPUs      int
+	Overlay    string
+	Seed       string
+	ConsoleLog string
+	Network    string
+	MAC        string
+	Metadata   string
+}
+
+var domainTemplate = template.Must(template.New("domain").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<domain type='{{.Type}}'>
+  <name>{{xml .Name}}</name>
+  <metadata>
+    {{.Metadata}}
+  </metadata>
+  <memory unit='MiB'>{{.MemoryMB}}</memory>
+  <vcpu>{{.VCPUs}}</vcpu>
+  <os>
+    <type arch='x86_64' machine='q35'>hvm</type>
+    <boot dev='hd'/>
+  </os>
+  <features>
+    <acpi/>
+    <apic/>
+  </features>
+  <cpu mode='host-passthrough'/>
+  <devices>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2'/>
+      <source file='{{xml .Overlay}}'/>
+      <target dev='vda' bus='virtio'/>
+    </disk>
+    <disk type='file' device='cdrom'>
+      <driver name='qemu' type='raw'/>
+      <source file='{{xml .Seed}}'/>
+      <target dev='sda' bus='sata'/>
+      <readonly/>
+    </disk>
+    <interface type='network'>
+      <source network='{{xml .Network}}'/>
+      <mac address='{{.MAC}}'/>
+      <model type='virtio'/>
+    </interface>
+    <serial type='pty'>
+      <log file='{{xml .ConsoleLog}}' append='off'/>
+    </serial>
+    <console type='pty'/>
+    <channel type='unix'>
+      <target type='virtio' name='org.qemu.guest_agent.0'/>
+    </channel>
+  </devices>
+</domain>
+`))
+
+func xmlEscape(s string) (string, error) {
+	var b strings.Builder
+	err := xml.EscapeText(&b, []byte(s))
+	return b.String(), err
+}
+
+// domainXML returns the XML description of the domain of the environment.
+func (p *Provider) domainXML(c *config.Config, name string, md envMetadata) (string, error) {
+	metadata, err := xml.Marshal(&md)
+	if err != nil {
+		return "", err
+	}
+	dir, err := homedir.Expand(p.opts.StorageDir)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = domainTemplate.Execute(&b, &domainSpec{
+		Type:       p.opts.DomainType,
+		Name:       name,
+		MemoryMB:   p.opts.MemoryMB,
+		VCPUs:      p.opts.VCPUs,
+		Overlay:    filepath.Join(dir, name+".qcow2"),
+		Seed:       filepath.Join(dir, name+"-seed.iso"),
+		ConsoleLog: filepath.Join(dir, name+"-console.log"),
+		Network:    p.opts.Network,
+		MAC:        mac(name),
+		Metadata:   string(metadata),
+	})
+	return b.String(), err
+}
+
+// mac returns the MAC address of the domain, derived from its name so
+// that its DHCP lease can be found.
+func mac(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[0], sum[1], sum[2])
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	name := domainPrefix + c.Name
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}, CreatedAt: time.Now().UTC()}
+
+	cacheDir, err := homedir.Expand(p.opts.ImageCacheDir)
+	if err != nil {
+		return nil, err
+	}
+	base, err := cachedImage(ctx, p.image(c), cacheDir, p.opts.ImageSHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := homedir.Expand(p.opts.StorageDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	overlay := filepath.Join(dir, name+".qcow2")
+	if err := p.QemuImg(ctx, "create", "-f", "qcow2", "-F", "qcow2", "-b", base, overlay, strconv.Itoa(c.Disk.SizeGB)+"G"); err != nil {
+		return nil, fmt.Errorf("failed to create disk: %w", err)
+	}
+	m.Resources[provider.ResourceDisk] = overlay
+
+	seed := filepath.Join(dir, name+"-seed.iso")
+	if err := writeSeed(seed, c.Name, spec.UserData, m.CreatedAt); err != nil {
+		return m, fmt.Errorf("failed to create seed ISO: %w", err)
+	}
+	m.Resources[resourceSeed] = seed
+	m.Resources[resourceConsoleLog] = filepath.Join(dir, name+"-console.log")
+
+	xml, err := p.domainXML(c, name, envMetadata{Name: c.Name, Image: p.image(c), DiskSizeGB: c.Disk.SizeGB, Created: m.CreatedAt})
+	if err != nil {
+		return m, err
+	}
+	if err := p.Conn.Define(ctx, xml); err != nil {
+		return m, fmt.Errorf("failed to define domain: %w", err)
+	}
+	m.ID = name
+	m.Resources[provider.ResourceInstance] = name
+	if err := p.Conn.Start(ctx, name); err != nil {
+		return m, fmt.Errorf("failed to start domain: %w", err)
+	}
+
+	var got *provider.Machine
+	if err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		var err error
+		got, err = p.Get(ctx, name)
+		return err == nil && got.Address != "", err
+	}); err != nil {
+		return m, fmt.Errorf("failed waiting for the address of domain %s: %w", name, err)
+	}
+	got.Resources = m.Resources
+	return got, nil
+}
+
+// writeSeed writes the NoCloud seed ISO with the user data.
+func writeSeed(path, hostname string, userData []byte, now time.Time) error {
+	metaData := fmt.Sprintf("instance-id: %s-%d\nlocal-hostname: %s\n", hostname, now.Unix(), hostname)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	err = writeISO(f, "cidata", map[string][]byte{
+		"user-data": userData,
+		"meta-data": []byte(metaData),
+	}, now)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (p *Provider) domain(ctx context.Context, name string) (*domain, string, error) {
+	if !strings.HasPrefix(name, domainPrefix) {
+		return nil, "", provider.ErrNotFound
+	}
+	state, err := p.Conn.State(ctx, name)
+	if err == nil {
+		var out string
+		out, err = p.Conn.XML(ctx, name)
+		if err == nil {
+			var d domain
+			if err := xml.Unmarshal([]byte(out), &d); err != nil {
+				return nil, "", fmt.Errorf("invalid description of domain %s: %w", name, err)
+			}
+			return &d, state, nil
+		}
+	}
+	if errors.Is(err, ErrNoDomain) {
+		return nil, "", provider.ErrNotFound
+	}
+	return nil, "", err
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	d, state, err := p.domain(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	m := &provider.Machine{
+		ID:        id,
+		Name:      d.Metadata.Name,
+		Status:    status(state),
+		Resources: map[string]string{provider.ResourceInstance: id},
+		CreatedAt: d.Metadata.Created,
+	}
+	for _, disk := range d.Disks {
+		if disk.Device == "disk" {
+			m.Resources[provider.ResourceDisk] = disk.Source.File
+		} else if disk.Device == "cdrom" {
+			m.Resources[resourceSeed] = disk.Source.File
+		}
+	}
+	for _, serial := range d.Serials {
+		if serial.Log.File != "" {
+			m.Resources[resourceConsoleLog] = serial.Log.File
+		}
+	}
+	if m.Status == provider.StatusRunning {
+		leases, err := p.Conn.Leases(ctx, p.opts.Network)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range leases {
+			if strings.EqualFold(l.MAC, d.mac()) {
+				m.Address = l.IP
+			}
+		}
+	}
+	return m, nil
+}
+
+func status(state string) provider.Status {
+	switch state {
+	case "running", "idle":
+		return provider.StatusRunning
+	case "shut off", "in shutdown", "paused", "pmsuspended", "crashed":
+		return provider.StatusStopped
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	if _, _, err := p.domain(ctx, id); err != nil {
+		return err
+	}
+	return p.Conn.Start(ctx, id)
+}
+
+// Stop implements provider.Provider. The guest is shut down gracefully.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	if _, _, err := p.domain(ctx, id); err != nil {
+		return err
+	}
+	if err := p.Conn.Shutdown(ctx, id); err != nil {
+		return err
+	}
+	return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		state, err := p.Conn.State(ctx, id)
+		return state == "shut off", err
+	})
+}
+
+// ConsoleOutput implements provider.ConsoleReader with the log of the
+// serial console of the domain, which cloud-init prints the SSH host keys
+// to. The log is kept from the last start of the domain.
+func (p *Provider) ConsoleOutput(ctx context.Context, id string) (string, error) {
+	d, _, err := p.domain(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	var out []byte
+	for _, serial := range d.Serials {
+		if serial.Log.File == "" {
+			continue
+		}
+		out, err = ioutil.ReadFile(serial.Log.File)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read the console log %s: %w", serial.Log.File, err)
+		}
+	}
+	return string(out), nil
+}
+
+// Destroy implements provider.Provider.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	if name := m.Resources[provider.ResourceInstance]; name != "" {
+		state, err := p.Conn.State(ctx, name)
+		switch {
+		case errors.Is(err, ErrNoDomain):
+		case err != nil:
+			return err
+		default:
+			if state != "shut off" {
+				if err := p.Conn.Destroy(ctx, name); err != nil && !errors.Is(err, ErrNoDomain) {
+					return fmt.Errorf("failed to power off domain %s: %w", name, err)
+				}
+			}
+			if err := p.Conn.Undefine(ctx, name); err != nil && !errors.Is(err, ErrNoDomain) {
+				return fmt.Errorf("failed to undefine domain %s: %w", name, err)
+			}
+		}
+	}
+	for _, kind := range []string{provider.ResourceDisk, resourceSeed, resourceConsoleLog} {
+		if path := m.Resources[kind]; path != "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	names, err := p.Conn.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var machines []*provider.Machine
+	for _, name := range names {
+		if !strings.HasPrefix(name, domainPrefix) {
+			continue
+		}
+		m, err := p.Get(ctx, name)
+		if errors.Is(err, provider.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m.Name != "" {
+			machines = append(machines, m)
+		}
+	}
+	return machines, nil
+}
+
+// Plan implements provider.Provider. The CPUs, the memory and growing the
+// disk are updated in place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	d, _, err := p.domain(ctx, m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []provider.Change
+	if d.Metadata.Image != p.image(c) {
+		changes = append(changes, provider.Change{Field: "image", Old: d.Metadata.Image, New: p.image(c), Replace: true})
+	}
+	if d.VCPU != p.opts.VCPUs {
+		changes = append(changes, provider.Change{Field: "provider_options.vcpus", Old: strconv.Itoa(d.VCPU), New: strconv.Itoa(p.opts.VCPUs)})
+	}
+	if d.memoryMB() != p.opts.MemoryMB {
+		changes = append(changes, provider.Change{Field: "provider_options.memory_mb", Old: strconv.Itoa(d.memoryMB()), New: strconv.Itoa(p.opts.MemoryMB)})
+	}
+	if size := d.Metadata.DiskSizeGB; size != c.Disk.SizeGB {
+		changes = append(changes, provider.Change{
+			Field:   "disk.size_gb",
+			Old:     strconv.Itoa(size),
+			New:     strconv.Itoa(c.Disk.SizeGB),
+			Replace: c.Disk.SizeGB < size,
+		})
+	}
+	return changes, nil
+}
+
+// Update implements provider.Updater. The domain is shut down, redefined
+// and started again.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	c := spec.Config
+	d, _, err := p.domain(ctx, m.ID)
+	if err != nil {
+		return err
+	}
+	for _, ch := range changes {
+		switch ch.Field {
+		case "provider_options.vcpus", "provider_options.memory_mb", "disk.size_gb":
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+
+	if m.Status == provider.StatusRunning {
+		if err := p.Stop(ctx, m.ID); err != nil {
+			return err
+		}
+	}
+	md := d.Metadata
+	for _, ch := range changes {
+		if ch.Field == "disk.size_gb" {
+			if err := p.QemuImg(ctx, "resize", m.Resources[provider.ResourceDisk], ch.New+"G"); err != nil {
+				return fmt.Errorf("failed to resize disk: %w", err)
+			}
+			md.DiskSizeGB = c.Disk.SizeGB
+		}
+	}
+	xml, err := p.domainXML(c, m.ID, md)
+	if err != nil {
+		return err
+	}
+	if err := p.Conn.Define(ctx, xml); err != nil {
+		return fmt.Errorf("failed to redefine domain %s: %w", m.ID, err)
+	}
+	if m.Status == provider.StatusRunning {
+		return p.Conn.Start(ctx, m.ID)
+	}
+	return nil
+}
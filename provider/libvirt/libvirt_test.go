@@ -0,0 +1,207 @@
+package libvirt_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/libvirt"
+	"github.com/darkowlzz/clouddev/provider/libvirt/libvirttest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// newTestProvider returns a provider of the spec against a fake libvirt
+// connection, with the storage and the image cache in a temporary
+// directory. The image of the spec is a local file unless it's set.
+func newTestProvider(t *testing.T, conn *libvirttest.Conn, spec *provider.Spec, opts map[string]interface{}) (*libvirt.Provider, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if spec.Config.Image == providertest.Spec(libvirt.Name).Config.Image {
+		spec.Config.Image = filepath.Join(dir, "base.qcow2")
+		if err := ioutil.WriteFile(spec.Config.Image, []byte("base"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage := filepath.Join(dir, "storage")
+	spec.Config.ProviderOptions = map[string]interface{}{
+		"storage_dir":     storage,
+		"image_cache_dir": filepath.Join(dir, "images"),
+	}
+	for k, v := range opts {
+		spec.Config.ProviderOptions[k] = v
+	}
+	p := libvirt.New(spec.Config)
+	p.Conn = conn
+	p.QemuImg = libvirttest.QemuImg
+	p.PollInterval = time.Millisecond
+	return p, storage
+}
+
+func TestConformance(t *testing.T) {
+	conn := libvirttest.NewConn()
+	spec := providertest.Spec(libvirt.Name)
+	p, storage := newTestProvider(t, conn, spec, nil)
+	providertest.Run(t, p, spec)
+	if n := conn.Domains(); n != 0 {
+		t.Errorf("%d domains are left after the suite", n)
+	}
+	files, err := ioutil.ReadDir(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d files are left in the storage directory after the suite", len(files))
+	}
+}
+
+func TestCreateWritesOverlayAndSeed(t *testing.T) {
+	conn := libvirttest.NewConn()
+	spec := providertest.Spec(libvirt.Name)
+	p, storage := newTestProvider(t, conn, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if !strings.HasPrefix(m.Address, "192.168.122.") {
+		t.Errorf("Create() address = %q, want the address of the DHCP lease", m.Address)
+	}
+	for _, name := range []string{"clouddev-conformance.qcow2", "clouddev-conformance-seed.iso"} {
+		if _, err := os.Stat(filepath.Join(storage, name)); err != nil {
+			t.Errorf("Create() didn't write %s: %v", name, err)
+		}
+	}
+
+	// The domain is found, and its files removed, from the resources in
+	// its description.
+	got, err := p.Get(ctx, m.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if err := p.Destroy(ctx, got); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := conn.Domains(); n != 0 {
+		t.Errorf("%d domains are left after Destroy()", n)
+	}
+	files, err := ioutil.ReadDir(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d files are left in the storage directory after Destroy()", len(files))
+	}
+}
+
+func TestUpdateInPlace(t *testing.T) {
+	conn := libvirttest.NewConn()
+	spec := providertest.Spec(libvirt.Name)
+	p, _ := newTestProvider(t, conn, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer p.Destroy(ctx, m)
+
+	bigger := providertest.Spec(libvirt.Name)
+	bigger.Config.Image = spec.Config.Image
+	bigger.Config.Disk.SizeGB = spec.Config.Disk.SizeGB + 10
+	opts := spec.Config.ProviderOptions
+	opts["vcpus"] = 4
+	opts["memory_mb"] = 8192
+	p, _ = newTestProvider(t, conn, bigger, opts)
+	changes, err := p.Plan(ctx, bigger, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("Plan() = %v, want the CPUs, the memory and the disk size", changes)
+	}
+	for _, ch := range changes {
+		if ch.Replace {
+			t.Errorf("Plan() change %v replaces the domain, want an update in place", ch)
+		}
+	}
+	if err := p.Update(ctx, bigger, m, changes); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if changes, err := p.Plan(ctx, bigger, m); err != nil || len(changes) > 0 {
+		t.Errorf("Plan() after Update() = %v, %v, want no changes", changes, err)
+	}
+	got, err := p.Get(ctx, m.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Status != provider.StatusRunning {
+		t.Errorf("Get() status after Update() = %q, want %q", got.Status, provider.StatusRunning)
+	}
+
+	smaller := providertest.Spec(libvirt.Name)
+	smaller.Config.Image = spec.Config.Image
+	smaller.Config.Disk.SizeGB = spec.Config.Disk.SizeGB
+	changes, err = p.Plan(ctx, smaller, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) != 1 || changes[0].Field != "disk.size_gb" || !changes[0].Replace {
+		t.Errorf("Plan() of a smaller disk = %v, want to replace the domain", changes)
+	}
+}
+
+func TestImageIsDownloadedOnce(t *testing.T) {
+	const image = "cloud image"
+	var mu sync.Mutex
+	var downloads int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		downloads++
+		mu.Unlock()
+		w.Write([]byte(image))
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256([]byte(image))
+	ctx := context.Background()
+
+	conn := libvirttest.NewConn()
+	spec := providertest.Spec(libvirt.Name)
+	spec.Config.Image = srv.URL + "/jammy-server-cloudimg-amd64.img"
+	p, _ := newTestProvider(t, conn, spec, map[string]interface{}{"image_sha256": strings.Repeat("0", 64)})
+	if _, err := p.Create(ctx, spec); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Create() error = %v, want the checksum mismatch", err)
+	}
+
+	opts := spec.Config.ProviderOptions
+	opts["image_sha256"] = hex.EncodeToString(sum[:])
+	p, _ = newTestProvider(t, conn, spec, opts)
+	for i := 0; i < 2; i++ {
+		m, err := p.Create(ctx, spec)
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if err := p.Destroy(ctx, m); err != nil {
+			t.Fatalf("Destroy() error = %v", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if downloads != 2 {
+		t.Errorf("the image was downloaded %d times, want once after the checksum mismatch", downloads)
+	}
+	cached, err := filepath.Glob(filepath.Join(opts["image_cache_dir"].(string), "*-jammy-server-cloudimg-amd64.img"))
+	if err != nil || len(cached) != 1 {
+		t.Errorf("image cache = %v, %v, want the downloaded image", cached, err)
+	}
+}
@@ -0,0 +1,218 @@
+// Package libvirttest implements an in-memory fake of a libvirt connection
+// for testing the libvirt provider.
+//
+// Started domains get a DHCP lease on the network of their interface and
+// write the host keys to the log of their serial console, as cloud-init
+// does. Shut down domains are off immediately.
+package libvirttest
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/darkowlzz/clouddev/provider/libvirt"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// Conn is a fake libvirt connection.
+type Conn struct {
+	mu      sync.Mutex
+	domains map[string]*domain
+	nextIP  int
+}
+
+type domain struct {
+	xml        string
+	mac        string
+	network    string
+	consoleLog string
+	state      string
+	ip         string
+}
+
+var _ libvirt.Conn = &Conn{}
+
+// NewConn returns a fake connection without domains.
+func NewConn() *Conn {
+	return &Conn{domains: map[string]*domain{}}
+}
+
+// Domains returns the number of defined domains, to check for leaks.
+func (c *Conn) Domains() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.domains)
+}
+
+// Define implements libvirt.Conn.
+func (c *Conn) Define(ctx context.Context, desc string) error {
+	var d struct {
+		Name      string `xml:"name"`
+		Interface struct {
+			MAC struct {
+				Address string `xml:"address,attr"`
+			} `xml:"mac"`
+			Source struct {
+				Network string `xml:"network,attr"`
+			} `xml:"source"`
+		} `xml:"devices>interface"`
+		Serial struct {
+			Log struct {
+				File string `xml:"file,attr"`
+			} `xml:"log"`
+		} `xml:"devices>serial"`
+	}
+	if err := xml.Unmarshal([]byte(desc), &d); err != nil {
+		return fmt.Errorf("invalid domain XML: %w", err)
+	}
+	if d.Name == "" {
+		return fmt.Errorf("domain XML without a name")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.domains[d.Name]; ok {
+		old.xml = desc
+		old.consoleLog = d.Serial.Log.File
+		return nil
+	}
+	c.domains[d.Name] = &domain{
+		xml:        desc,
+		mac:        d.Interface.MAC.Address,
+		network:    d.Interface.Source.Network,
+		consoleLog: d.Serial.Log.File,
+		state:      "shut off",
+	}
+	return nil
+}
+
+func (c *Conn) domain(name string) (*domain, error) {
+	d, ok := c.domains[name]
+	if !ok {
+		return nil, libvirt.ErrNoDomain
+	}
+	return d, nil
+}
+
+// Undefine implements libvirt.Conn.
+func (c *Conn) Undefine(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.domain(name)
+	if err != nil {
+		return err
+	}
+	if d.state != "shut off" {
+		return fmt.Errorf("cannot undefine running domain %s", name)
+	}
+	delete(c.domains, name)
+	return nil
+}
+
+// Start implements libvirt.Conn.
+func (c *Conn) Start(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.domain(name)
+	if err != nil {
+		return err
+	}
+	if d.state == "running" {
+		return fmt.Errorf("domain %s is already active", name)
+	}
+	if d.consoleLog != "" {
+		if err := ioutil.WriteFile(d.consoleLog, []byte(providertest.ConsoleOutput), 0o644); err != nil {
+			return err
+		}
+	}
+	d.state = "running"
+	if d.ip == "" {
+		c.nextIP++
+		d.ip = fmt.Sprintf("192.168.122.%d", c.nextIP+1)
+	}
+	return nil
+}
+
+// Shutdown implements libvirt.Conn.
+func (c *Conn) Shutdown(ctx context.Context, name string) error {
+	return c.Destroy(ctx, name)
+}
+
+// Destroy implements libvirt.Conn.
+func (c *Conn) Destroy(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.domain(name)
+	if err != nil {
+		return err
+	}
+	if d.state != "running" {
+		return fmt.Errorf("domain %s is not running", name)
+	}
+	d.state = "shut off"
+	return nil
+}
+
+// State implements libvirt.Conn.
+func (c *Conn) State(ctx context.Context, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.domain(name)
+	if err != nil {
+		return "", err
+	}
+	return d.state, nil
+}
+
+// XML implements libvirt.Conn.
+func (c *Conn) XML(ctx context.Context, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.domain(name)
+	if err != nil {
+		return "", err
+	}
+	return d.xml, nil
+}
+
+// List implements libvirt.Conn.
+func (c *Conn) List(ctx context.Context) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Leases implements libvirt.Conn.
+func (c *Conn) Leases(ctx context.Context, network string) ([]libvirt.Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var leases []libvirt.Lease
+	for _, d := range c.domains {
+		if d.network == network && d.state == "running" {
+			leases = append(leases, libvirt.Lease{MAC: d.mac, IP: d.ip})
+		}
+	}
+	return leases, nil
+}
+
+// QemuImg is a fake of qemu-img that creates empty images and checks the
+// resized ones exist.
+func QemuImg(ctx context.Context, args ...string) error {
+	switch args[0] {
+	case "create":
+		return ioutil.WriteFile(args[len(args)-2], nil, 0o644)
+	case "resize":
+		_, err := ioutil.ReadFile(args[1])
+		return err
+	default:
+		return fmt.Errorf("qemu-img: unsupported command %s", args[0])
+	}
+}
@@ -0,0 +1,315 @@
+package openstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"gopkg.in/yaml.v2"
+)
+
+// cloudsFiles are the clouds.yaml files looked up, in order of preference,
+// after OS_CLIENT_CONFIG_FILE.
+var cloudsFiles = []string{"clouds.yaml", "~/.config/openstack/clouds.yaml", "/etc/openstack/clouds.yaml"}
+
+// cloud is a cloud of clouds.yaml.
+type cloud struct {
+	Auth       authConfig `yaml:"auth"`
+	AuthType   string     `yaml:"auth_type"`
+	RegionName string     `yaml:"region_name"`
+	Interface  string     `yaml:"interface"`
+	Verify     *bool      `yaml:"verify"`
+	CACert     string     `yaml:"cacert"`
+}
+
+type authConfig struct {
+	AuthURL                     string `yaml:"auth_url"`
+	Username                    string `yaml:"username"`
+	UserID                      string `yaml:"user_id"`
+	Password                    string `yaml:"password"`
+	ProjectName                 string `yaml:"project_name"`
+	ProjectID                   string `yaml:"project_id"`
+	UserDomainName              string `yaml:"user_domain_name"`
+	UserDomainID                string `yaml:"user_domain_id"`
+	ProjectDomainName           string `yaml:"project_domain_name"`
+	ProjectDomainID             string `yaml:"project_domain_id"`
+	ApplicationCredentialID     string `yaml:"application_credential_id"`
+	ApplicationCredentialName   string `yaml:"application_credential_name"`
+	ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+}
+
+// loadCloud returns the named cloud of the clouds.yaml file, the first
+// file found if path is empty. Without a cloud name, the cloud is
+// configured by the OS_* environment variables of the openrc files.
+func loadCloud(path, name string) (*cloud, error) {
+	if name == "" {
+		name = os.Getenv("OS_CLOUD")
+	}
+	if name == "" {
+		return envCloud(), nil
+	}
+
+	paths := cloudsFiles
+	if path != "" {
+		paths = []string{path}
+	} else if env := os.Getenv("OS_CLIENT_CONFIG_FILE"); env != "" {
+		paths = []string{env}
+	}
+	for _, p := range paths {
+		p, err := homedir.Expand(p)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) && len(paths) > 1 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read clouds.yaml: %w", err)
+		}
+		var f struct {
+			Clouds map[string]*cloud `yaml:"clouds"`
+		}
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("invalid clouds.yaml %s: %w", p, err)
+		}
+		c, ok := f.Clouds[name]
+		if !ok {
+			return nil, fmt.Errorf("cloud %s not found in %s", name, p)
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("no clouds.yaml found in %s", strings.Join(paths, ", "))
+}
+
+func envCloud() *cloud {
+	c := &cloud{
+		Auth: authConfig{
+			AuthURL:                     os.Getenv("OS_AUTH_URL"),
+			Username:                    os.Getenv("OS_USERNAME"),
+			UserID:                      os.Getenv("OS_USER_ID"),
+			Password:                    os.Getenv("OS_PASSWORD"),
+			ProjectName:                 os.Getenv("OS_PROJECT_NAME"),
+			ProjectID:                   os.Getenv("OS_PROJECT_ID"),
+			UserDomainName:              os.Getenv("OS_USER_DOMAIN_NAME"),
+			UserDomainID:                os.Getenv("OS_USER_DOMAIN_ID"),
+			ProjectDomainName:           os.Getenv("OS_PROJECT_DOMAIN_NAME"),
+			ProjectDomainID:             os.Getenv("OS_PROJECT_DOMAIN_ID"),
+			ApplicationCredentialID:     os.Getenv("OS_APPLICATION_CREDENTIAL_ID"),
+			ApplicationCredentialName:   os.Getenv("OS_APPLICATION_CREDENTIAL_NAME"),
+			ApplicationCredentialSecret: os.Getenv("OS_APPLICATION_CREDENTIAL_SECRET"),
+		},
+		AuthType:   os.Getenv("OS_AUTH_TYPE"),
+		RegionName: os.Getenv("OS_REGION_NAME"),
+		Interface:  os.Getenv("OS_INTERFACE"),
+		CACert:     os.Getenv("OS_CACERT"),
+	}
+	if os.Getenv("OS_INSECURE") == "true" {
+		verify := false
+		c.Verify = &verify
+	}
+	return c
+}
+
+// httpClient returns the HTTP client of the cloud, verifying its
+// certificates with its CA certificate if set.
+func (c *cloud) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if c.Verify != nil && !*c.Verify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if c.CACert != "" {
+		path, err := homedir.Expand(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid CA certificate %s", c.CACert)
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}, nil
+}
+
+// keystone issues Keystone v3 tokens, with a password or an application
+// credential.
+type keystone struct {
+	cloud  *cloud
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	catalog []catalogEntry
+}
+
+type catalogEntry struct {
+	Type      string `json:"type"`
+	Endpoints []struct {
+		Interface string `json:"interface"`
+		Region    string `json:"region"`
+		RegionID  string `json:"region_id"`
+		URL       string `json:"url"`
+	} `json:"endpoints"`
+}
+
+func (k *keystone) authorize(req *http.Request) error {
+	token, err := k.issue(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	return nil
+}
+
+// authURL returns the Keystone v3 URL.
+func (k *keystone) authURL() string {
+	u := strings.TrimSuffix(k.cloud.Auth.AuthURL, "/")
+	if !strings.HasSuffix(u, "/v3") {
+		u += "/v3"
+	}
+	return u
+}
+
+// issue returns a valid token, issuing a new one if needed.
+func (k *keystone) issue(ctx context.Context) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.token != "" && time.Until(k.expires) > time.Minute {
+		return k.token, nil
+	}
+
+	a := k.cloud.Auth
+	if a.AuthURL == "" {
+		return "", errors.New("no OpenStack auth_url, set provider_options.cloud or OS_CLOUD, or the OS_* variables")
+	}
+	var identity map[string]interface{}
+	if k.cloud.AuthType == "v3applicationcredential" || a.ApplicationCredentialID != "" || a.ApplicationCredentialName != "" {
+		cred := map[string]interface{}{"secret": a.ApplicationCredentialSecret}
+		if a.ApplicationCredentialID != "" {
+			cred["id"] = a.ApplicationCredentialID
+		} else {
+			cred["name"] = a.ApplicationCredentialName
+			cred["user"] = user(a)
+		}
+		identity = map[string]interface{}{
+			"methods":                []string{"application_credential"},
+			"application_credential": cred,
+		}
+	} else {
+		u := user(a)
+		u["password"] = a.Password
+		identity = map[string]interface{}{
+			"methods":  []string{"password"},
+			"password": map[string]interface{}{"user": u},
+		}
+	}
+	auth := map[string]interface{}{"identity": identity}
+	// Application credentials are bound to their project.
+	if _, ok := identity["password"]; ok && (a.ProjectID != "" || a.ProjectName != "") {
+		project := map[string]interface{}{}
+		if a.ProjectID != "" {
+			project["id"] = a.ProjectID
+		} else {
+			project["name"] = a.ProjectName
+			project["domain"] = domain(a.ProjectDomainID, a.ProjectDomainName)
+		}
+		auth["scope"] = map[string]interface{}{"project": project}
+	}
+	data, err := json.Marshal(map[string]interface{}{"auth": auth})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.authURL()+"/auth/tokens", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to authenticate with Keystone: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		msg := errorMessage(data)
+		if msg == "" {
+			msg = resp.Status
+		}
+		return "", fmt.Errorf("failed to authenticate with Keystone: %s", msg)
+	}
+	var out struct {
+		Token struct {
+			ExpiresAt time.Time      `json:"expires_at"`
+			Catalog   []catalogEntry `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return "", fmt.Errorf("invalid Keystone token: %w", err)
+	}
+	k.token = resp.Header.Get("X-Subject-Token")
+	k.expires = out.Token.ExpiresAt
+	k.catalog = out.Token.Catalog
+	return k.token, nil
+}
+
+func user(a authConfig) map[string]interface{} {
+	if a.UserID != "" {
+		return map[string]interface{}{"id": a.UserID}
+	}
+	return map[string]interface{}{"name": a.Username, "domain": domain(a.UserDomainID, a.UserDomainName)}
+}
+
+func domain(id, name string) map[string]string {
+	if id != "" {
+		return map[string]string{"id": id}
+	}
+	if name == "" {
+		name = "Default"
+	}
+	return map[string]string{"name": name}
+}
+
+// endpoint returns the URL of the service of the type in the catalog, e.g.
+// compute, for the region.
+func (k *keystone) endpoint(ctx context.Context, serviceType, region string) (string, error) {
+	if _, err := k.issue(ctx); err != nil {
+		return "", err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	iface := strings.TrimSuffix(k.cloud.Interface, "URL")
+	if iface == "" {
+		iface = "public"
+	}
+	for _, e := range k.catalog {
+		if e.Type != serviceType {
+			continue
+		}
+		for _, ep := range e.Endpoints {
+			if ep.Interface == iface && (region == "" || ep.Region == region || ep.RegionID == region) {
+				return strings.TrimSuffix(ep.URL, "/"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no %s %s endpoint in region %q in the service catalog", iface, serviceType, region)
+}
@@ -0,0 +1,904 @@
+// Package openstack implements a provider that provisions environments on
+// OpenStack clouds, through the Keystone, Nova, Neutron and Glance APIs.
+package openstack
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/internal/rest"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "openstack"
+
+const (
+	defaultFlavor = "m1.small"
+	// novaVersion is the compute API microversion, the first reporting the
+	// flavor names of the servers.
+	novaVersion = "2.47"
+	// Metadata of the servers.
+	metadataEnv    = "clouddev:env"
+	metadataImage  = "clouddev:image"
+	metadataVolume = "clouddev:volume_size_gb"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the openstack provider_options.
+type options struct {
+	// Cloud is the cloud of clouds.yaml, OS_CLOUD if empty. Without a cloud
+	// the OS_* variables of the openrc files are used.
+	Cloud string `mapstructure:"cloud"`
+	// CloudsYAML is the path of clouds.yaml, found in the standard
+	// locations if empty.
+	CloudsYAML string `mapstructure:"clouds_yaml"`
+	// Network is the name of the network of the server. The cloud
+	// allocates one if empty.
+	Network string `mapstructure:"network"`
+	// FloatingNetwork is the name of the external network to allocate a
+	// floating IP address from, none if empty.
+	FloatingNetwork string `mapstructure:"floating_network"`
+	// BootFromVolume boots from a disk.size_gb volume instead of the
+	// flavor disk.
+	BootFromVolume   bool   `mapstructure:"boot_from_volume"`
+	AvailabilityZone string `mapstructure:"availability_zone"`
+}
+
+// Provider provisions OpenStack servers.
+type Provider struct {
+	cfg  *config.Config
+	opts options
+	// PollInterval is the interval between the checks of the state of the
+	// servers.
+	PollInterval time.Duration
+
+	mu      sync.Mutex
+	compute *rest.Client
+	network *rest.Client
+	image   *rest.Client
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns an openstack provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	return &Provider{cfg: c, opts: opts, PollInterval: 5 * time.Second}
+}
+
+// clients returns the clients of the compute, network and image APIs,
+// authenticating and reading the service catalog on first use.
+func (p *Provider) clients(ctx context.Context) (compute, network, image *rest.Client, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.compute != nil {
+		return p.compute, p.network, p.image, nil
+	}
+	cl, err := loadCloud(p.opts.CloudsYAML, p.opts.Cloud)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hc, err := cl.httpClient()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ks := &keystone{cloud: cl, client: hc}
+	region := p.cfg.Region
+	if region == "" {
+		region = cl.RegionName
+	}
+	endpoints := map[string]string{}
+	for _, t := range []string{"compute", "network", "image"} {
+		if endpoints[t], err = ks.endpoint(ctx, t, region); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	p.compute = &rest.Client{
+		BaseURL:    endpoints["compute"],
+		HTTPClient: hc,
+		Authorize: func(req *http.Request) error {
+			req.Header.Set("X-OpenStack-Nova-API-Version", novaVersion)
+			return ks.authorize(req)
+		},
+		ErrorMessage: errorMessage,
+	}
+	p.network = &rest.Client{BaseURL: endpoints["network"] + "/v2.0", HTTPClient: hc, Authorize: ks.authorize, ErrorMessage: errorMessage}
+	p.image = &rest.Client{BaseURL: endpoints["image"] + "/v2", HTTPClient: hc, Authorize: ks.authorize, ErrorMessage: errorMessage}
+	return p.compute, p.network, p.image, nil
+}
+
+// errorMessage extracts the message of the errors of the OpenStack APIs,
+// wrapped in an object keyed by the error type, e.g.
+// {"itemNotFound": {"message": "..."}}.
+func errorMessage(body []byte) string {
+	var e map[string]json.RawMessage
+	if err := json.Unmarshal(body, &e); err != nil {
+		return ""
+	}
+	for _, v := range e {
+		var m struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(v, &m) == nil && m.Message != "" {
+			return m.Message
+		}
+	}
+	return ""
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	if c.Image == "" {
+		errs = append(errs, &config.FieldError{Path: "image", Message: "is required, the name of an image of the cloud"})
+	}
+	return errs
+}
+
+func (p *Provider) flavor(c *config.Config) string {
+	if c.MachineType == "" {
+		return defaultFlavor
+	}
+	return c.MachineType
+}
+
+func resourceName(env string) string {
+	return "clouddev-" + env
+}
+
+// description is the description of the security group and the floating
+// IP of the environment, to find them.
+func description(env string) string {
+	return "clouddev environment " + env
+}
+
+type server struct {
+	ID       string            `json:"id"`
+	Status   string            `json:"status"`
+	Created  time.Time         `json:"created"`
+	Metadata map[string]string `json:"metadata"`
+	Flavor   struct {
+		OriginalName string `json:"original_name"`
+	} `json:"flavor"`
+	Addresses map[string][]struct {
+		Addr    string `json:"addr"`
+		Version int    `json:"version"`
+		Type    string `json:"OS-EXT-IPS:type"`
+	} `json:"addresses"`
+	Fault *struct {
+		Message string `json:"message"`
+	} `json:"fault"`
+}
+
+func (s *server) machine() *provider.Machine {
+	m := &provider.Machine{
+		ID:        s.ID,
+		Name:      s.Metadata[metadataEnv],
+		Status:    status(s.Status),
+		Resources: map[string]string{provider.ResourceInstance: s.ID},
+		CreatedAt: s.Created,
+	}
+	m.Address = s.address("floating")
+	if m.Address == "" {
+		m.Address = s.address("fixed")
+	}
+	return m
+}
+
+// address returns the IPv4 address of the type, fixed or floating, of the
+// first network in name order.
+func (s *server) address(typ string) string {
+	networks := make([]string, 0, len(s.Addresses))
+	for n := range s.Addresses {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+	for _, n := range networks {
+		for _, a := range s.Addresses[n] {
+			if a.Version == 4 && a.Type == typ {
+				return a.Addr
+			}
+		}
+	}
+	return ""
+}
+
+func status(s string) provider.Status {
+	switch s {
+	case "ACTIVE":
+		return provider.StatusRunning
+	case "SHUTOFF", "SUSPENDED", "PAUSED", "SHELVED", "SHELVED_OFFLOADED":
+		return provider.StatusStopped
+	case "BUILD", "REBOOT", "HARD_REBOOT", "RESIZE", "VERIFY_RESIZE", "MIGRATING":
+		return provider.StatusPending
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// UserDataLimit implements provider.UserDataLimiter. Nova limits the base64
+// encoded user data to 65535 bytes.
+func (p *Provider) UserDataLimit() int {
+	return 49149
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	compute, network, _, err := p.clients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := resourceName(c.Name)
+	flavorID, err := p.flavorID(ctx, p.flavor(c))
+	if err != nil {
+		return nil, err
+	}
+	imageID, err := p.imageID(ctx, c.Image)
+	if err != nil {
+		return nil, err
+	}
+	networks := interface{}("auto")
+	if p.opts.Network != "" {
+		id, err := p.networkID(ctx, p.opts.Network)
+		if err != nil {
+			return nil, err
+		}
+		networks = []map[string]string{{"uuid": id}}
+	}
+	var floatingNetworkID string
+	if p.opts.FloatingNetwork != "" {
+		if floatingNetworkID, err = p.networkID(ctx, p.opts.FloatingNetwork); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}}
+	in := map[string]interface{}{"keypair": map[string]string{"name": name, "public_key": spec.SSHPublicKey}}
+	if err := compute.Do(ctx, http.MethodPost, "/os-keypairs", in, nil); err != nil {
+		return m, fmt.Errorf("failed to create keypair: %w", err)
+	}
+	m.Resources[provider.ResourceKey] = name
+
+	var sg struct {
+		SecurityGroup struct {
+			ID string `json:"id"`
+		} `json:"security_group"`
+	}
+	in = map[string]interface{}{"security_group": map[string]string{"name": name, "description": description(c.Name)}}
+	if err := network.Do(ctx, http.MethodPost, "/security-groups", in, &sg); err != nil {
+		return m, fmt.Errorf("failed to create security group: %w", err)
+	}
+	m.Resources[provider.ResourceFirewall] = sg.SecurityGroup.ID
+	if err := p.allowPorts(ctx, sg.SecurityGroup.ID, c.Ports); err != nil {
+		return m, err
+	}
+
+	metadata := map[string]string{metadataEnv: c.Name, metadataImage: c.Image}
+	s := map[string]interface{}{
+		"name":            name,
+		"flavorRef":       flavorID,
+		"key_name":        name,
+		"security_groups": []map[string]string{{"name": sg.SecurityGroup.ID}},
+		"networks":        networks,
+		"user_data":       base64.StdEncoding.EncodeToString(spec.UserData),
+		"metadata":        metadata,
+	}
+	if p.opts.BootFromVolume {
+		metadata[metadataVolume] = strconv.Itoa(c.Disk.SizeGB)
+		s["block_device_mapping_v2"] = []map[string]interface{}{{
+			"boot_index":            0,
+			"uuid":                  imageID,
+			"source_type":           "image",
+			"destination_type":      "volume",
+			"volume_size":           c.Disk.SizeGB,
+			"delete_on_termination": true,
+		}}
+	} else {
+		s["imageRef"] = imageID
+	}
+	if p.opts.AvailabilityZone != "" {
+		s["availability_zone"] = p.opts.AvailabilityZone
+	}
+	var created struct {
+		Server struct {
+			ID string `json:"id"`
+		} `json:"server"`
+	}
+	if err := compute.Do(ctx, http.MethodPost, "/servers", map[string]interface{}{"server": s}, &created); err != nil {
+		return m, fmt.Errorf("failed to create server: %w", err)
+	}
+	id := created.Server.ID
+	m.ID = id
+	m.Resources[provider.ResourceInstance] = id
+	if err := p.waitStatus(ctx, id, "ACTIVE"); err != nil {
+		return m, err
+	}
+
+	if floatingNetworkID != "" {
+		ip, err := p.allocateFloatingIP(ctx, floatingNetworkID, id, c.Name)
+		if ip != "" {
+			m.Resources[provider.ResourceIP] = ip
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+
+	got, err := p.Get(ctx, id)
+	if err != nil {
+		return m, err
+	}
+	got.Resources = m.Resources
+	return got, nil
+}
+
+// allocateFloatingIP allocates a floating IP address to the port of the
+// server and returns its ID.
+func (p *Provider) allocateFloatingIP(ctx context.Context, networkID, serverID, env string) (string, error) {
+	_, network, _, err := p.clients(ctx)
+	if err != nil {
+		return "", err
+	}
+	var ports struct {
+		Ports []struct {
+			ID string `json:"id"`
+		} `json:"ports"`
+	}
+	if err := network.Do(ctx, http.MethodGet, "/ports?device_id="+url.QueryEscape(serverID), nil, &ports); err != nil {
+		return "", err
+	}
+	if len(ports.Ports) == 0 {
+		return "", fmt.Errorf("server %s has no port to allocate a floating IP to", serverID)
+	}
+	in := map[string]interface{}{"floatingip": map[string]string{
+		"floating_network_id": networkID,
+		"port_id":             ports.Ports[0].ID,
+		"description":         description(env),
+	}}
+	var fip struct {
+		FloatingIP struct {
+			ID string `json:"id"`
+		} `json:"floatingip"`
+	}
+	if err := network.Do(ctx, http.MethodPost, "/floatingips", in, &fip); err != nil {
+		return "", fmt.Errorf("failed to allocate floating IP: %w", err)
+	}
+	// The address shows up in the server addresses once associated.
+	return fip.FloatingIP.ID, provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		s, err := p.server(ctx, serverID)
+		return err == nil && s.address("floating") != "", err
+	})
+}
+
+// allowPorts adds the rules allowing inbound traffic on the ports to the
+// security group.
+func (p *Provider) allowPorts(ctx context.Context, groupID string, ports []int) error {
+	_, network, _, err := p.clients(ctx)
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		for _, ethertype := range []string{"IPv4", "IPv6"} {
+			in := map[string]interface{}{"security_group_rule": map[string]interface{}{
+				"security_group_id": groupID,
+				"direction":         "ingress",
+				"ethertype":         ethertype,
+				"protocol":          "tcp",
+				"port_range_min":    port,
+				"port_range_max":    port,
+			}}
+			if err := network.Do(ctx, http.MethodPost, "/security-group-rules", in, nil); err != nil {
+				return fmt.Errorf("failed to open port %d: %w", port, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flavorID returns the ID of the flavor with the name or ID.
+func (p *Provider) flavorID(ctx context.Context, name string) (string, error) {
+	compute, _, _, err := p.clients(ctx)
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Flavors []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"flavors"`
+	}
+	if err := compute.Do(ctx, http.MethodGet, "/flavors/detail", nil, &out); err != nil {
+		return "", err
+	}
+	for _, f := range out.Flavors {
+		if f.Name == name || f.ID == name {
+			return f.ID, nil
+		}
+	}
+	return "", fmt.Errorf("flavor %s not found", name)
+}
+
+// imageID returns the ID of the latest active image with the name, or of
+// the image with the ID.
+func (p *Provider) imageID(ctx context.Context, name string) (string, error) {
+	_, _, image, err := p.clients(ctx)
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Images []struct {
+			ID        string    `json:"id"`
+			CreatedAt time.Time `json:"created_at"`
+		} `json:"images"`
+	}
+	q := url.Values{"name": {name}, "status": {"active"}, "sort": {"created_at:desc"}}
+	if err := image.Do(ctx, http.MethodGet, "/images?"+q.Encode(), nil, &out); err != nil {
+		return "", err
+	}
+	if len(out.Images) > 0 {
+		sort.Slice(out.Images, func(i, j int) bool { return out.Images[i].CreatedAt.After(out.Images[j].CreatedAt) })
+		return out.Images[0].ID, nil
+	}
+	var img struct {
+		ID string `json:"id"`
+	}
+	err = image.Do(ctx, http.MethodGet, "/images/"+url.PathEscape(name), nil, &img)
+	if rest.IsNotFound(err) || rest.HasStatus(err, http.StatusBadRequest) {
+		return "", fmt.Errorf("image %s not found", name)
+	}
+	return img.ID, err
+}
+
+// networkID returns the ID of the network with the name or ID.
+func (p *Provider) networkID(ctx context.Context, name string) (string, error) {
+	_, network, _, err := p.clients(ctx)
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Networks []struct {
+			ID string `json:"id"`
+		} `json:"networks"`
+	}
+	if err := network.Do(ctx, http.MethodGet, "/networks?name="+url.QueryEscape(name), nil, &out); err != nil {
+		return "", err
+	}
+	if len(out.Networks) == 0 {
+		if err := network.Do(ctx, http.MethodGet, "/networks?id="+url.QueryEscape(name), nil, &out); err != nil {
+			return "", err
+		}
+	}
+	switch len(out.Networks) {
+	case 0:
+		return "", fmt.Errorf("network %s not found", name)
+	case 1:
+		return out.Networks[0].ID, nil
+	default:
+		return "", fmt.Errorf("several networks are named %s, use the ID", name)
+	}
+}
+
+func (p *Provider) server(ctx context.Context, id string) (*server, error) {
+	compute, _, _, err := p.clients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Server server `json:"server"`
+	}
+	err = compute.Do(ctx, http.MethodGet, "/servers/"+url.PathEscape(id), nil, &out)
+	if rest.IsNotFound(err) {
+		return nil, provider.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out.Server, nil
+}
+
+// waitStatus waits for the server to reach the status, failing if it
+// errors.
+func (p *Provider) waitStatus(ctx context.Context, id string, want ...string) error {
+	err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		s, err := p.server(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if s.Status == "ERROR" {
+			msg := "unknown error"
+			if s.Fault != nil {
+				msg = s.Fault.Message
+			}
+			return false, fmt.Errorf("server %s failed: %s", id, msg)
+		}
+		for _, w := range want {
+			if s.Status == w {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for server %s: %w", id, err)
+	}
+	return nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	s, err := p.server(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.machine(), nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	return p.serverAction(ctx, id, "os-start", "ACTIVE")
+}
+
+// Stop implements provider.Provider.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	return p.serverAction(ctx, id, "os-stop", "SHUTOFF")
+}
+
+// serverAction runs the action, unless the server already has the status
+// it results in, and waits for the status.
+func (p *Provider) serverAction(ctx context.Context, id, action, want string) error {
+	s, err := p.server(ctx, id)
+	if err != nil {
+		return err
+	}
+	if s.Status == want {
+		return nil
+	}
+	compute, _, _, err := p.clients(ctx)
+	if err != nil {
+		return err
+	}
+	if err := compute.Do(ctx, http.MethodPost, "/servers/"+url.PathEscape(id)+"/action", map[string]interface{}{action: nil}, nil); err != nil {
+		return err
+	}
+	return p.waitStatus(ctx, id, want)
+}
+
+// ConsoleOutput implements provider.ConsoleReader.
+func (p *Provider) ConsoleOutput(ctx context.Context, id string) (string, error) {
+	compute, _, _, err := p.clients(ctx)
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Output string `json:"output"`
+	}
+	err = compute.Do(ctx, http.MethodPost, "/servers/"+url.PathEscape(id)+"/action", map[string]interface{}{"os-getConsoleOutput": map[string]interface{}{}}, &out)
+	if rest.IsNotFound(err) {
+		return "", provider.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return out.Output, nil
+}
+
+// Destroy implements provider.Provider. The resources of the environment
+// are also found by name, so that they're deleted even if they weren't
+// recorded.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	compute, network, _, err := p.clients(ctx)
+	if err != nil {
+		return err
+	}
+	ips := map[string]bool{}
+	if id := m.Resources[provider.ResourceIP]; id != "" {
+		ips[id] = true
+	}
+	if m.Name != "" {
+		var out struct {
+			FloatingIPs []struct {
+				ID string `json:"id"`
+			} `json:"floatingips"`
+		}
+		if err := network.Do(ctx, http.MethodGet, "/floatingips?description="+url.QueryEscape(description(m.Name)), nil, &out); err != nil {
+			return err
+		}
+		for _, ip := range out.FloatingIPs {
+			ips[ip.ID] = true
+		}
+	}
+	for id := range ips {
+		if err := network.Do(ctx, http.MethodDelete, "/floatingips/"+url.PathEscape(id), nil, nil); err != nil && !rest.IsNotFound(err) {
+			return fmt.Errorf("failed to release floating IP %s: %w", id, err)
+		}
+	}
+
+	servers := map[string]bool{}
+	if id := m.Resources[provider.ResourceInstance]; id != "" {
+		servers[id] = true
+	}
+	if m.Name != "" {
+		all, err := p.servers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range all {
+			if s.Metadata[metadataEnv] == m.Name {
+				servers[s.ID] = true
+			}
+		}
+	}
+	for id := range servers {
+		if err := compute.Do(ctx, http.MethodDelete, "/servers/"+url.PathEscape(id), nil, nil); err != nil && !rest.IsNotFound(err) {
+			return fmt.Errorf("failed to delete server %s: %w", id, err)
+		}
+		if err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			_, err := p.server(ctx, id)
+			if errors.Is(err, provider.ErrNotFound) {
+				return true, nil
+			}
+			return false, err
+		}); err != nil {
+			return fmt.Errorf("failed waiting for server %s to be deleted: %w", id, err)
+		}
+	}
+
+	groups := map[string]bool{}
+	if id := m.Resources[provider.ResourceFirewall]; id != "" {
+		groups[id] = true
+	}
+	if m.Name != "" {
+		ids, err := p.securityGroups(ctx, resourceName(m.Name))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			groups[id] = true
+		}
+	}
+	for id := range groups {
+		// The ports of the deleted server may hold the group for a while.
+		err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+			err := network.Do(ctx, http.MethodDelete, "/security-groups/"+url.PathEscape(id), nil, nil)
+			if rest.HasStatus(err, http.StatusConflict) {
+				return false, nil
+			}
+			return true, err
+		})
+		if err != nil && !rest.IsNotFound(err) {
+			return fmt.Errorf("failed to delete security group %s: %w", id, err)
+		}
+	}
+
+	keys := map[string]bool{}
+	if name := m.Resources[provider.ResourceKey]; name != "" {
+		keys[name] = true
+	}
+	if m.Name != "" {
+		keys[resourceName(m.Name)] = true
+	}
+	for name := range keys {
+		if err := compute.Do(ctx, http.MethodDelete, "/os-keypairs/"+url.PathEscape(name), nil, nil); err != nil && !rest.IsNotFound(err) {
+			return fmt.Errorf("failed to delete keypair %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// securityGroups returns the IDs of the security groups with the name.
+func (p *Provider) securityGroups(ctx context.Context, name string) ([]string, error) {
+	_, network, _, err := p.clients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		SecurityGroups []struct {
+			ID string `json:"id"`
+		} `json:"security_groups"`
+	}
+	if err := network.Do(ctx, http.MethodGet, "/security-groups?name="+url.QueryEscape(name), nil, &out); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, sg := range out.SecurityGroups {
+		ids = append(ids, sg.ID)
+	}
+	return ids, nil
+}
+
+// servers returns the servers created by clouddev.
+func (p *Provider) servers(ctx context.Context) ([]*server, error) {
+	compute, _, _, err := p.clients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Servers []*server `json:"servers"`
+	}
+	if err := compute.Do(ctx, http.MethodGet, "/servers/detail?name="+url.QueryEscape("^clouddev-"), nil, &out); err != nil {
+		return nil, err
+	}
+	var servers []*server
+	for _, s := range out.Servers {
+		if s.Metadata[metadataEnv] != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers, nil
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	servers, err := p.servers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	machines := make([]*provider.Machine, len(servers))
+	for i, s := range servers {
+		machines[i] = s.machine()
+	}
+	return machines, nil
+}
+
+// Plan implements provider.Provider. The flavor and the ports are updated
+// in place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	s, err := p.server(ctx, m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []provider.Change
+	if old := s.Metadata[metadataImage]; old != c.Image {
+		changes = append(changes, provider.Change{Field: "image", Old: old, New: c.Image, Replace: true})
+	}
+	if old, new := s.Metadata[metadataVolume], ""; p.opts.BootFromVolume || old != "" {
+		if p.opts.BootFromVolume {
+			new = strconv.Itoa(c.Disk.SizeGB)
+		}
+		if old != new {
+			changes = append(changes, provider.Change{Field: "disk.size_gb", Old: old, New: new, Replace: true})
+		}
+	}
+	if old, new := s.address("floating") != "", p.opts.FloatingNetwork != ""; old != new {
+		changes = append(changes, provider.Change{Field: "provider_options.floating_network", Old: strconv.FormatBool(old), New: strconv.FormatBool(new), Replace: true})
+	}
+	if old, new := s.Flavor.OriginalName, p.flavor(c); old != new {
+		changes = append(changes, provider.Change{Field: "machine_type", Old: old, New: new})
+	}
+
+	ports, err := p.openPorts(ctx, m.Name)
+	if err != nil {
+		return nil, err
+	}
+	if old, new := provider.FormatPorts(ports), provider.FormatPorts(c.Ports); old != new {
+		changes = append(changes, provider.Change{Field: "ports", Old: old, New: new})
+	}
+	return changes, nil
+}
+
+type securityGroupRule struct {
+	ID           string `json:"id"`
+	Direction    string `json:"direction"`
+	Ethertype    string `json:"ethertype"`
+	Protocol     string `json:"protocol"`
+	PortRangeMin int    `json:"port_range_min"`
+	PortRangeMax int    `json:"port_range_max"`
+}
+
+// rules returns the ingress rules of the security group of the
+// environment.
+func (p *Provider) rules(ctx context.Context, env string) (string, []securityGroupRule, error) {
+	_, network, _, err := p.clients(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	ids, err := p.securityGroups(ctx, resourceName(env))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(ids) == 0 {
+		return "", nil, nil
+	}
+	var out struct {
+		Rules []securityGroupRule `json:"security_group_rules"`
+	}
+	if err := network.Do(ctx, http.MethodGet, "/security-group-rules?direction=ingress&security_group_id="+url.QueryEscape(ids[0]), nil, &out); err != nil {
+		return "", nil, err
+	}
+	return ids[0], out.Rules, nil
+}
+
+// openPorts returns the TCP ports open to IPv4 traffic by the security
+// group of the environment.
+func (p *Provider) openPorts(ctx context.Context, env string) ([]int, error) {
+	_, rules, err := p.rules(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	var ports []int
+	for _, r := range rules {
+		if r.Direction == "ingress" && r.Ethertype == "IPv4" && r.Protocol == "tcp" && r.PortRangeMin == r.PortRangeMax {
+			ports = append(ports, r.PortRangeMin)
+		}
+	}
+	return ports, nil
+}
+
+// Update implements provider.Updater. The server is resized to change its
+// flavor.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	c := spec.Config
+	compute, network, _, err := p.clients(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ch := range changes {
+		switch ch.Field {
+		case "machine_type":
+			flavorID, err := p.flavorID(ctx, p.flavor(c))
+			if err != nil {
+				return err
+			}
+			action := "/servers/" + url.PathEscape(m.ID) + "/action"
+			if err := compute.Do(ctx, http.MethodPost, action, map[string]interface{}{"resize": map[string]string{"flavorRef": flavorID}}, nil); err != nil {
+				return fmt.Errorf("failed to resize server %s: %w", m.ID, err)
+			}
+			if err := p.waitStatus(ctx, m.ID, "VERIFY_RESIZE"); err != nil {
+				return err
+			}
+			if err := compute.Do(ctx, http.MethodPost, action, map[string]interface{}{"confirmResize": nil}, nil); err != nil {
+				return fmt.Errorf("failed to confirm the resize of server %s: %w", m.ID, err)
+			}
+			if err := p.waitStatus(ctx, m.ID, "ACTIVE", "SHUTOFF"); err != nil {
+				return err
+			}
+		case "ports":
+			groupID, rules, err := p.rules(ctx, m.Name)
+			if err != nil {
+				return err
+			}
+			if groupID == "" {
+				return fmt.Errorf("security group %s not found", resourceName(m.Name))
+			}
+			for _, r := range rules {
+				if r.Protocol != "tcp" {
+					continue
+				}
+				if err := network.Do(ctx, http.MethodDelete, "/security-group-rules/"+url.PathEscape(r.ID), nil, nil); err != nil && !rest.IsNotFound(err) {
+					return err
+				}
+			}
+			if err := p.allowPorts(ctx, groupID, c.Ports); err != nil {
+				return err
+			}
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+	return nil
+}
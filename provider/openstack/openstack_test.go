@@ -0,0 +1,150 @@
+package openstack_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/openstack"
+	"github.com/darkowlzz/clouddev/provider/openstack/openstacktest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// newTestProvider returns a provider of the spec against a fake cloud,
+// authenticating as the cloud of its clouds.yaml, password or credential.
+func newTestProvider(t *testing.T, s *openstacktest.Server, spec *provider.Spec, cloud string, opts map[string]interface{}) *openstack.Provider {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clouds.yaml")
+	if err := ioutil.WriteFile(path, []byte(s.CloudsYAML()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spec.Config.ProviderOptions = map[string]interface{}{"cloud": cloud, "clouds_yaml": path}
+	for k, v := range opts {
+		spec.Config.ProviderOptions[k] = v
+	}
+	p := openstack.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *openstacktest.Server {
+	s := openstacktest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(openstack.Name)
+	providertest.Run(t, newTestProvider(t, s, spec, "password", nil), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after the suite", n)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := newServer(t)
+	tests := []struct {
+		name    string
+		cloud   string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "password", cloud: "password"},
+		{name: "application credential", cloud: "credential"},
+		{
+			name: "openrc password",
+			env: map[string]string{
+				"OS_AUTH_URL":            s.AuthURL(),
+				"OS_USERNAME":            openstacktest.Username,
+				"OS_PASSWORD":            openstacktest.Password,
+				"OS_PROJECT_NAME":        openstacktest.Project,
+				"OS_USER_DOMAIN_NAME":    "Default",
+				"OS_PROJECT_DOMAIN_NAME": "Default",
+				"OS_REGION_NAME":         openstacktest.Region,
+			},
+		},
+		{
+			name: "openrc application credential",
+			env: map[string]string{
+				"OS_AUTH_URL":                      s.AuthURL(),
+				"OS_AUTH_TYPE":                     "v3applicationcredential",
+				"OS_APPLICATION_CREDENTIAL_ID":     openstacktest.ApplicationCredentialID,
+				"OS_APPLICATION_CREDENTIAL_SECRET": openstacktest.ApplicationCredentialSecret,
+				"OS_REGION_NAME":                   openstacktest.Region,
+			},
+		},
+		{
+			name: "wrong password",
+			env: map[string]string{
+				"OS_AUTH_URL":     s.AuthURL(),
+				"OS_USERNAME":     openstacktest.Username,
+				"OS_PASSWORD":     "wrong",
+				"OS_PROJECT_NAME": openstacktest.Project,
+				"OS_REGION_NAME":  openstacktest.Region,
+			},
+			wantErr: "failed to authenticate with Keystone",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OS_CLOUD", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			spec := providertest.Spec(openstack.Name)
+			p := newTestProvider(t, s, spec, tt.cloud, nil)
+			_, err := p.Get(context.Background(), "does-not-exist")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Get() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if !errors.Is(err, provider.ErrNotFound) {
+				t.Errorf("Get() error = %v, want %v once authenticated", err, provider.ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestFloatingIP(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(openstack.Name)
+	p := newTestProvider(t, s, spec, "credential", map[string]interface{}{
+		"network":          openstacktest.PrivateNetwork,
+		"floating_network": openstacktest.PublicNetwork,
+	})
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if m.Resources[provider.ResourceIP] == "" {
+		t.Errorf("Create() machine resources %v don't include the floating IP", m.Resources)
+	}
+	if !strings.HasPrefix(m.Address, "203.0.113.") {
+		t.Errorf("Create() address = %q, want the floating IP", m.Address)
+	}
+	changes, err := p.Plan(ctx, spec, m)
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("Plan() = %v, want no changes", changes)
+	}
+
+	// The floating IP is found by its description when it isn't recorded.
+	if err := p.Destroy(ctx, &provider.Machine{Name: m.Name, Resources: map[string]string{}}); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d resources are left after Destroy(), including the floating IP", n)
+	}
+}
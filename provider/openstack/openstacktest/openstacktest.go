@@ -0,0 +1,557 @@
+// Package openstacktest implements an in-memory fake of the Keystone, Nova,
+// Neutron and Glance APIs for testing the openstack provider.
+//
+// The fake implements the endpoints used by the provider, behind a single
+// server whose service catalog points back at itself. Servers are built on
+// their first read, and the other actions complete at once.
+package openstacktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider/providertest"
+)
+
+// Credentials accepted by the fake.
+const (
+	Username                    = "demo"
+	Password                    = "openstacktest-password"
+	Project                     = "demo"
+	ApplicationCredentialID     = "openstacktest-credential"
+	ApplicationCredentialSecret = "openstacktest-secret"
+)
+
+// Region is the region of the endpoints of the catalog.
+const Region = "RegionOne"
+
+// Networks of the fake. The public network is external, to allocate
+// floating IP addresses from.
+const (
+	PrivateNetwork = "private"
+	PublicNetwork  = "public"
+)
+
+// token is the token issued by the fake.
+const token = "openstacktest-token"
+
+// Server is a fake OpenStack cloud.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	nextID int
+	// resources are keyed by collection, e.g. "servers", and ID.
+	resources map[string]map[string]map[string]interface{}
+}
+
+// NewServer starts a fake cloud with the flavors m1.small and m1.medium,
+// the images conformance-image and ubuntu-22.04, and the private and
+// public networks. The caller must close it.
+func NewServer() *Server {
+	s := &Server{resources: map[string]map[string]map[string]interface{}{
+		"flavors": {
+			"1": {"id": "1", "name": "m1.small", "vcpus": 1, "ram": 2048, "disk": 20},
+			"2": {"id": "2", "name": "m1.medium", "vcpus": 2, "ram": 4096, "disk": 40},
+		},
+		"images": {},
+		"networks": {
+			"net-private": {"id": "net-private", "name": PrivateNetwork, "router:external": false},
+			"net-public":  {"id": "net-public", "name": PublicNetwork, "router:external": true},
+		},
+		"os-keypairs":          {},
+		"servers":              {},
+		"ports":                {},
+		"security-groups":      {},
+		"security-group-rules": {},
+		"floatingips":          {},
+	}}
+	for _, name := range []string{"conformance-image", "ubuntu-22.04"} {
+		id := s.id()
+		s.resources["images"][id] = map[string]interface{}{"id": id, "name": name, "status": "active", "created_at": time.Now().UTC().Format(time.RFC3339)}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AuthURL returns the Keystone URL of the fake.
+func (s *Server) AuthURL() string {
+	return s.URL + "/identity/v3"
+}
+
+// CloudsYAML returns a clouds.yaml document with a cloud named password,
+// authenticating with the username and password, and a cloud named
+// credential, authenticating with the application credential.
+func (s *Server) CloudsYAML() string {
+	return fmt.Sprintf(`clouds:
+  password:
+    auth:
+      auth_url: %[1]s
+      username: %[2]s
+      password: %[3]s
+      project_name: %[4]s
+      user_domain_name: Default
+      project_domain_name: Default
+    region_name: %[5]s
+  credential:
+    auth_type: v3applicationcredential
+    auth:
+      auth_url: %[1]s
+      application_credential_id: %[6]s
+      application_credential_secret: %[7]s
+    region_name: %[5]s
+`, s.AuthURL(), Username, Password, Project, Region, ApplicationCredentialID, ApplicationCredentialSecret)
+}
+
+// Resources returns the number of keypairs, security groups, servers and
+// floating IPs that exist, to check for leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range []string{"os-keypairs", "security-groups", "servers", "floatingips"} {
+		n += len(s.resources[c])
+	}
+	return n
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	var in map[string]interface{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeError(w, http.StatusBadRequest, "badRequest", err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := r.URL.Path
+	if path == "/identity/v3/auth/tokens" && r.Method == http.MethodPost {
+		s.issue(w, in)
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != token {
+		writeError(w, http.StatusUnauthorized, "error", "The request you have made requires authentication.")
+		return
+	}
+	switch {
+	case strings.HasPrefix(path, "/compute/v2.1/"):
+		s.compute(w, r, strings.Split(strings.TrimPrefix(path, "/compute/v2.1/"), "/"), in)
+	case strings.HasPrefix(path, "/network/v2.0/"):
+		s.network(w, r, strings.Split(strings.TrimPrefix(path, "/network/v2.0/"), "/"), in)
+	case strings.HasPrefix(path, "/image/v2/images"):
+		s.image(w, r, strings.Split(strings.TrimPrefix(path, "/image/v2/"), "/"))
+	default:
+		writeError(w, http.StatusNotFound, "itemNotFound", "not found")
+	}
+}
+
+// issue implements the Keystone token endpoint.
+func (s *Server) issue(w http.ResponseWriter, in map[string]interface{}) {
+	var auth struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+				ApplicationCredential struct {
+					ID     string `json:"id"`
+					Secret string `json:"secret"`
+				} `json:"application_credential"`
+			} `json:"identity"`
+		} `json:"auth"`
+	}
+	data, _ := json.Marshal(in)
+	_ = json.Unmarshal(data, &auth)
+	id := auth.Auth.Identity
+	ok := false
+	if len(id.Methods) == 1 {
+		switch id.Methods[0] {
+		case "password":
+			ok = id.Password.User.Name == Username && id.Password.User.Password == Password
+		case "application_credential":
+			ok = id.ApplicationCredential.ID == ApplicationCredentialID && id.ApplicationCredential.Secret == ApplicationCredentialSecret
+		}
+	}
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "error", "The request you have made requires authentication.")
+		return
+	}
+	endpoint := func(typ, path string) map[string]interface{} {
+		return map[string]interface{}{"type": typ, "endpoints": []interface{}{
+			map[string]interface{}{"interface": "public", "region": Region, "region_id": Region, "url": s.URL + path},
+			map[string]interface{}{"interface": "internal", "region": Region, "region_id": Region, "url": "http://internal.invalid" + path},
+		}}
+	}
+	w.Header().Set("X-Subject-Token", token)
+	write(w, http.StatusCreated, map[string]interface{}{"token": map[string]interface{}{
+		"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		"catalog": []interface{}{
+			endpoint("identity", "/identity/v3"),
+			endpoint("compute", "/compute/v2.1"),
+			endpoint("network", "/network"),
+			endpoint("image", "/image"),
+		},
+	}})
+}
+
+func (s *Server) compute(w http.ResponseWriter, r *http.Request, parts []string, in map[string]interface{}) {
+	switch {
+	case parts[0] == "flavors" && len(parts) == 2 && parts[1] == "detail" && r.Method == http.MethodGet:
+		write(w, http.StatusOK, map[string]interface{}{"flavors": values(s.resources["flavors"], nil)})
+	case parts[0] == "os-keypairs" && len(parts) == 1 && r.Method == http.MethodPost:
+		kp, _ := in["keypair"].(map[string]interface{})
+		name, _ := kp["name"].(string)
+		if _, ok := s.resources["os-keypairs"][name]; ok {
+			writeError(w, http.StatusConflict, "conflictingRequest", "Key pair '"+name+"' already exists.")
+			return
+		}
+		kp["created_at"] = now()
+		s.resources["os-keypairs"][name] = kp
+		write(w, http.StatusOK, map[string]interface{}{"keypair": kp})
+	case parts[0] == "os-keypairs" && len(parts) == 2 && r.Method == http.MethodDelete:
+		if _, ok := s.resources["os-keypairs"][parts[1]]; !ok {
+			writeError(w, http.StatusNotFound, "itemNotFound", "Keypair "+parts[1]+" not found.")
+			return
+		}
+		delete(s.resources["os-keypairs"], parts[1])
+		w.WriteHeader(http.StatusAccepted)
+	case parts[0] == "servers" && len(parts) == 1 && r.Method == http.MethodPost:
+		srv, _ := in["server"].(map[string]interface{})
+		if err := s.createServer(srv); err != "" {
+			writeError(w, http.StatusBadRequest, "badRequest", err)
+			return
+		}
+		write(w, http.StatusAccepted, map[string]interface{}{"server": map[string]interface{}{"id": srv["id"]}})
+	case parts[0] == "servers" && len(parts) == 2 && parts[1] == "detail" && r.Method == http.MethodGet:
+		var servers []interface{}
+		for _, srv := range values(s.resources["servers"], nil) {
+			servers = append(servers, s.view(srv))
+		}
+		write(w, http.StatusOK, map[string]interface{}{"servers": servers})
+	case parts[0] == "servers" && len(parts) >= 2:
+		srv, ok := s.resources["servers"][parts[1]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "itemNotFound", "Instance "+parts[1]+" could not be found.")
+			return
+		}
+		switch {
+		case len(parts) == 2 && r.Method == http.MethodGet:
+			if srv["status"] == "BUILD" {
+				srv["status"] = "ACTIVE"
+			}
+			write(w, http.StatusOK, map[string]interface{}{"server": s.view(srv)})
+		case len(parts) == 2 && r.Method == http.MethodDelete:
+			s.deleteServer(parts[1])
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 3 && parts[2] == "action" && r.Method == http.MethodPost && hasKey(in, "os-getConsoleOutput"):
+			write(w, http.StatusOK, map[string]interface{}{"output": providertest.ConsoleOutput})
+		case len(parts) == 3 && parts[2] == "action" && r.Method == http.MethodPost:
+			if err := s.serverAction(srv, in); err != "" {
+				writeError(w, http.StatusConflict, "conflictingRequest", err)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "badRequest", r.Method)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "itemNotFound", "not found")
+	}
+}
+
+func (s *Server) createServer(srv map[string]interface{}) string {
+	flavor := s.resources["flavors"][fmt.Sprint(srv["flavorRef"])]
+	if flavor == nil {
+		return fmt.Sprintf("Flavor %v could not be found.", srv["flavorRef"])
+	}
+	if bdm, ok := srv["block_device_mapping_v2"].([]interface{}); ok && len(bdm) > 0 {
+		srv["imageRef"] = bdm[0].(map[string]interface{})["uuid"]
+	}
+	if s.resources["images"][fmt.Sprint(srv["imageRef"])] == nil {
+		return fmt.Sprintf("Image %v could not be found.", srv["imageRef"])
+	}
+	if name, _ := srv["key_name"].(string); name != "" && s.resources["os-keypairs"][name] == nil {
+		return "Invalid key_name provided."
+	}
+	var groups []interface{}
+	if sgs, ok := srv["security_groups"].([]interface{}); ok {
+		for _, sg := range sgs {
+			name := fmt.Sprint(sg.(map[string]interface{})["name"])
+			found := ""
+			for id, g := range s.resources["security-groups"] {
+				if id == name || g["name"] == name {
+					found = id
+				}
+			}
+			if found == "" {
+				return "Security group " + name + " not found."
+			}
+			groups = append(groups, found)
+		}
+	}
+	network := s.resources["networks"]["net-private"]
+	if nets, ok := srv["networks"].([]interface{}); ok && len(nets) > 0 {
+		uuid := fmt.Sprint(nets[0].(map[string]interface{})["uuid"])
+		if network = s.resources["networks"][uuid]; network == nil {
+			return "Network " + uuid + " could not be found."
+		}
+	}
+
+	id := s.id()
+	srv["id"] = id
+	srv["status"] = "BUILD"
+	srv["created"] = now()
+	srv["flavor_id"] = flavor["id"]
+	if srv["metadata"] == nil {
+		srv["metadata"] = map[string]interface{}{}
+	}
+	s.resources["servers"][id] = srv
+	port := s.id()
+	s.resources["ports"][port] = map[string]interface{}{
+		"id":              port,
+		"device_id":       id,
+		"network":         network["name"],
+		"fixed_ip":        fmt.Sprintf("10.0.0.%d", len(s.resources["ports"])+10),
+		"security_groups": groups,
+	}
+	return ""
+}
+
+// view returns the API representation of the server.
+func (s *Server) view(srv map[string]interface{}) map[string]interface{} {
+	v := map[string]interface{}{}
+	for k, val := range srv {
+		switch k {
+		case "user_data", "block_device_mapping_v2", "networks", "flavorRef", "flavor_id", "previous_status":
+		default:
+			v[k] = val
+		}
+	}
+	flavor := s.resources["flavors"][srv["flavor_id"].(string)]
+	v["flavor"] = map[string]interface{}{"original_name": flavor["name"], "vcpus": flavor["vcpus"], "ram": flavor["ram"], "disk": flavor["disk"]}
+	addresses := map[string][]interface{}{}
+	for _, port := range s.resources["ports"] {
+		if port["device_id"] != srv["id"] {
+			continue
+		}
+		network := port["network"].(string)
+		addresses[network] = append(addresses[network], map[string]interface{}{"addr": port["fixed_ip"], "version": 4, "OS-EXT-IPS:type": "fixed"})
+		for _, fip := range s.resources["floatingips"] {
+			if fip["port_id"] == port["id"] {
+				addresses[network] = append(addresses[network], map[string]interface{}{"addr": fip["floating_ip_address"], "version": 4, "OS-EXT-IPS:type": "floating"})
+			}
+		}
+	}
+	v["addresses"] = addresses
+	return v
+}
+
+func (s *Server) serverAction(srv, in map[string]interface{}) string {
+	status := srv["status"]
+	switch {
+	case hasKey(in, "os-start"):
+		if status != "SHUTOFF" {
+			return "Cannot 'start' instance while it is in vm_state " + fmt.Sprint(status)
+		}
+		srv["status"] = "ACTIVE"
+	case hasKey(in, "os-stop"):
+		if status != "ACTIVE" {
+			return "Cannot 'stop' instance while it is in vm_state " + fmt.Sprint(status)
+		}
+		srv["status"] = "SHUTOFF"
+	case hasKey(in, "resize"):
+		if status != "ACTIVE" && status != "SHUTOFF" {
+			return "Cannot 'resize' instance while it is in vm_state " + fmt.Sprint(status)
+		}
+		ref := fmt.Sprint(in["resize"].(map[string]interface{})["flavorRef"])
+		if s.resources["flavors"][ref] == nil {
+			return "Flavor " + ref + " could not be found."
+		}
+		srv["previous_status"] = status
+		srv["flavor_id"] = ref
+		srv["status"] = "VERIFY_RESIZE"
+	case hasKey(in, "confirmResize"):
+		if status != "VERIFY_RESIZE" {
+			return "Cannot 'confirmResize' instance while it is in vm_state " + fmt.Sprint(status)
+		}
+		srv["status"] = srv["previous_status"]
+	default:
+		return "unsupported action"
+	}
+	return ""
+}
+
+// deleteServer deletes the server and its ports, disassociating their
+// floating IPs.
+func (s *Server) deleteServer(id string) {
+	delete(s.resources["servers"], id)
+	for pid, port := range s.resources["ports"] {
+		if port["device_id"] != id {
+			continue
+		}
+		for _, fip := range s.resources["floatingips"] {
+			if fip["port_id"] == pid {
+				fip["port_id"] = nil
+			}
+		}
+		delete(s.resources["ports"], pid)
+	}
+}
+
+func (s *Server) network(w http.ResponseWriter, r *http.Request, parts []string, in map[string]interface{}) {
+	collection := parts[0]
+	resources, ok := s.resources[collection]
+	if !ok || collection == "flavors" || collection == "images" || collection == "servers" || collection == "os-keypairs" {
+		writeError(w, http.StatusNotFound, "NeutronError", "The resource could not be found.")
+		return
+	}
+	singular := strings.ReplaceAll(strings.TrimSuffix(collection, "s"), "-", "_")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		query := map[string]string{}
+		for k, v := range r.URL.Query() {
+			query[k] = v[0]
+		}
+		list := values(resources, query)
+		if collection == "ports" {
+			for i, port := range list {
+				list[i] = map[string]interface{}{"id": port["id"], "device_id": port["device_id"]}
+			}
+		}
+		write(w, http.StatusOK, map[string]interface{}{strings.ReplaceAll(collection, "-", "_"): list})
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		res, _ := in[singular].(map[string]interface{})
+		if err := s.createNetworkResource(collection, res); err != "" {
+			writeError(w, http.StatusBadRequest, "NeutronError", err)
+			return
+		}
+		write(w, http.StatusCreated, map[string]interface{}{singular: res})
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		if _, ok := resources[parts[1]]; !ok {
+			writeError(w, http.StatusNotFound, "NeutronError", strings.ReplaceAll(singular, "_", " ")+" "+parts[1]+" could not be found.")
+			return
+		}
+		if collection == "security-groups" {
+			for _, port := range s.resources["ports"] {
+				for _, g := range port["security_groups"].([]interface{}) {
+					if g == parts[1] {
+						writeError(w, http.StatusConflict, "NeutronError", "Security Group "+parts[1]+" in use.")
+						return
+					}
+				}
+			}
+			for id, rule := range s.resources["security-group-rules"] {
+				if rule["security_group_id"] == parts[1] {
+					delete(s.resources["security-group-rules"], id)
+				}
+			}
+		}
+		delete(resources, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "NeutronError", r.Method)
+	}
+}
+
+func (s *Server) createNetworkResource(collection string, res map[string]interface{}) string {
+	if res == nil {
+		return "missing body"
+	}
+	switch collection {
+	case "security-groups":
+	case "security-group-rules":
+		if s.resources["security-groups"][fmt.Sprint(res["security_group_id"])] == nil {
+			return fmt.Sprintf("Security group %v does not exist", res["security_group_id"])
+		}
+	case "floatingips":
+		network := s.resources["networks"][fmt.Sprint(res["floating_network_id"])]
+		if network == nil || network["router:external"] != true {
+			return fmt.Sprintf("Network %v is not a valid external network", res["floating_network_id"])
+		}
+		if port := res["port_id"]; port != nil && s.resources["ports"][fmt.Sprint(port)] == nil {
+			return fmt.Sprintf("Port %v could not be found", port)
+		}
+		res["floating_ip_address"] = fmt.Sprintf("203.0.113.%d", len(s.resources["floatingips"])+10)
+	default:
+		return "unsupported resource"
+	}
+	id := s.id()
+	res["id"] = id
+	s.resources[collection][id] = res
+	return ""
+}
+
+func (s *Server) image(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "error", r.Method)
+		return
+	}
+	if len(parts) == 2 {
+		img, ok := s.resources["images"][parts[1]]
+		if !ok {
+			http.Error(w, "No image found with ID "+parts[1], http.StatusNotFound)
+			return
+		}
+		write(w, http.StatusOK, img)
+		return
+	}
+	query := map[string]string{}
+	for _, k := range []string{"name", "status"} {
+		if v := r.URL.Query().Get(k); v != "" {
+			query[k] = v
+		}
+	}
+	write(w, http.StatusOK, map[string]interface{}{"images": values(s.resources["images"], query)})
+}
+
+func (s *Server) id() string {
+	s.nextID++
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", s.nextID, s.nextID)
+}
+
+// values returns the resources matching the filters, on their string
+// values.
+func values(resources map[string]map[string]interface{}, filters map[string]string) []map[string]interface{} {
+	list := []map[string]interface{}{}
+outer:
+	for _, res := range resources {
+		for k, v := range filters {
+			if fmt.Sprint(res[k]) != v {
+				continue outer
+			}
+		}
+		list = append(list, res)
+	}
+	return list
+}
+
+func hasKey(m map[string]interface{}, k string) bool {
+	_, ok := m[k]
+	return ok
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+func write(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, kind, message string) {
+	write(w, code, map[string]interface{}{kind: map[string]interface{}{"code": code, "message": message}})
+}
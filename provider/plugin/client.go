@@ -0,0 +1,278 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+var (
+	// HandshakeTimeout is the time a plugin has to answer the handshake.
+	HandshakeTimeout = 10 * time.Second
+	// CloseTimeout is the time a plugin has to exit once its stdin is
+	// closed before it's killed.
+	CloseTimeout = 5 * time.Second
+)
+
+// stderrTail is the size of the end of the plugin stderr kept for the error
+// messages.
+const stderrTail = 4096
+
+// process is a running plugin.
+type process struct {
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *tailBuffer
+
+	// wmu serializes the writes to stdin.
+	wmu sync.Mutex
+	enc *json.Encoder
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan *response
+
+	// done is closed once the process exited, with err set to the reason.
+	done chan struct{}
+	err  error
+
+	handshake HandshakeResult
+}
+
+// start starts the plugin executable and shakes hands with it.
+func start(ctx context.Context, name, path string, params *HandshakeParams) (*process, error) {
+	// The process outlives the context of the operation that started it.
+	cmd := exec.Command(path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p := &process{
+		name:    name,
+		cmd:     cmd,
+		stdin:   stdin,
+		stderr:  &tailBuffer{},
+		enc:     json.NewEncoder(stdin),
+		pending: map[int64]chan *response{},
+		done:    make(chan struct{}),
+	}
+	cmd.Stderr = p.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %s: %w", name, err)
+	}
+	go p.read(stdout)
+
+	hctx, cancel := context.WithTimeout(ctx, HandshakeTimeout)
+	defer cancel()
+	if err := p.call(hctx, MethodHandshake, params, &p.handshake); err != nil {
+		p.close()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			err = fmt.Errorf("no answer in %s", HandshakeTimeout)
+		}
+		return nil, fmt.Errorf("plugin %s handshake failed: %w", name, err)
+	}
+	if !supported(p.handshake.Version) {
+		p.close()
+		return nil, fmt.Errorf("plugin %s picked protocol version %d, clouddev supports %s", name, p.handshake.Version, formatVersions(protocolVersions))
+	}
+	return p, nil
+}
+
+func supported(version int) bool {
+	for _, v := range protocolVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func formatVersions(versions []int) string {
+	s := make([]string, len(versions))
+	for i, v := range versions {
+		s[i] = fmt.Sprint(v)
+	}
+	return strings.Join(s, ", ")
+}
+
+// read dispatches the responses of the plugin until it exits or breaks the
+// protocol, then fails the pending calls.
+func (p *process) read(stdout io.Reader) {
+	dec := json.NewDecoder(stdout)
+	var protoErr error
+	for {
+		var resp response
+		if err := dec.Decode(&resp); err != nil {
+			if err != io.EOF {
+				protoErr = fmt.Errorf("invalid message: %w", err)
+				_ = p.cmd.Process.Kill()
+			}
+			break
+		}
+		if resp.ID == nil {
+			// Notifications from plugins aren't part of the protocol.
+			continue
+		}
+		p.mu.Lock()
+		ch, ok := p.pending[*resp.ID]
+		delete(p.pending, *resp.ID)
+		p.mu.Unlock()
+		if ok {
+			ch <- &resp
+		}
+	}
+
+	werr := p.cmd.Wait()
+	switch {
+	case protoErr != nil:
+		p.err = fmt.Errorf("plugin %s broke the protocol: %v%s", p.name, protoErr, p.stderr.String())
+	case werr != nil:
+		p.err = fmt.Errorf("plugin %s crashed: %v%s", p.name, werr, p.stderr.String())
+	default:
+		p.err = fmt.Errorf("plugin %s exited%s", p.name, p.stderr.String())
+	}
+	close(p.done)
+}
+
+// exited returns true if the process exited.
+func (p *process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// call sends a request and decodes the result into result, unless nil.
+func (p *process) call(ctx context.Context, method string, params, result interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *response, 1)
+	p.mu.Lock()
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = ch
+	p.mu.Unlock()
+
+	if err := p.send(&request{JSONRPC: "2.0", ID: &id, Method: method, Params: data}); err != nil {
+		p.forget(id)
+		<-p.done
+		return p.err
+	}
+
+	var resp *response
+	select {
+	case resp = <-ch:
+	case <-p.done:
+		// The response may have been read before the plugin exited.
+		select {
+		case resp = <-ch:
+		default:
+			return p.err
+		}
+	case <-ctx.Done():
+		p.forget(id)
+		_ = p.notify(MethodCancel, &CancelParams{ID: id})
+		return ctx.Err()
+	}
+
+	if resp.Error != nil {
+		if resp.Error.Code == CodeNotFound {
+			return provider.ErrNotFound
+		}
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("plugin %s: invalid %s result: %w", p.name, method, err)
+	}
+	return nil
+}
+
+func (p *process) forget(id int64) {
+	p.mu.Lock()
+	delete(p.pending, id)
+	p.mu.Unlock()
+}
+
+// notify sends a notification.
+func (p *process) notify(method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return p.send(&request{JSONRPC: "2.0", Method: method, Params: data})
+}
+
+func (p *process) send(req *request) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.enc.Encode(req)
+}
+
+// close closes the stdin of the plugin, which asks it to exit, and kills it
+// if it doesn't in CloseTimeout.
+func (p *process) close() {
+	p.wmu.Lock()
+	p.stdin.Close()
+	p.wmu.Unlock()
+	select {
+	case <-p.done:
+	case <-time.After(CloseTimeout):
+		_ = p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// tailBuffer keeps the end of what's written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, data...)
+	if len(b.buf) > stderrTail {
+		b.buf = b.buf[len(b.buf)-stderrTail:]
+	}
+	return len(data), nil
+}
+
+// String returns the complete lines kept, indented on new lines after a
+// colon, or "" if nothing was written.
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := string(b.buf)
+	if len(b.buf) == stderrTail {
+		// Drop the partial first line.
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[i+1:]
+		}
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+	return ":\n  " + strings.ReplaceAll(s, "\n", "\n  ")
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// Prefix is the prefix of the plugin executable names: the plugin of the
+// provider "foo" is the executable clouddev-provider-foo.
+const Prefix = "clouddev-provider-"
+
+// Info is a plugin executable found by Discover.
+type Info struct {
+	// Name is the provider name of the plugin.
+	Name string
+	// Path is the path of the executable.
+	Path string
+}
+
+// Dirs returns the directories searched for plugins, in order of
+// precedence: $HOME/.clouddev/plugins and the directories in PATH.
+func Dirs() []string {
+	var dirs []string
+	if home, err := homedir.Dir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".clouddev", "plugins"))
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// Discover returns the plugins in the given directories, sorted by name.
+// When several directories have a plugin of the same name, the first one
+// wins. Directories that can't be read are skipped.
+func Discover(dirs []string) []Info {
+	found := map[string]Info{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.Mode()&os.ModeSymlink != 0 {
+				// Check the mode of the target.
+				fi, err := os.Stat(filepath.Join(dir, e.Name()))
+				if err != nil {
+					continue
+				}
+				e = namedFileInfo{FileInfo: fi, name: e.Name()}
+			}
+			name, ok := pluginName(e)
+			if !ok {
+				continue
+			}
+			if _, ok := found[name]; !ok {
+				found[name] = Info{Name: name, Path: filepath.Join(dir, e.Name())}
+			}
+		}
+	}
+
+	plugins := make([]Info, 0, len(found))
+	for _, info := range found {
+		plugins = append(plugins, info)
+	}
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].Name < plugins[j].Name
+	})
+	return plugins
+}
+
+// pluginName returns the provider name of a plugin executable, or false if
+// the file isn't one.
+func pluginName(fi os.FileInfo) (string, bool) {
+	name := fi.Name()
+	if fi.IsDir() || !strings.HasPrefix(name, Prefix) {
+		return "", false
+	}
+	if runtime.GOOS == "windows" {
+		if !strings.EqualFold(filepath.Ext(name), ".exe") {
+			return "", false
+		}
+		name = name[:len(name)-len(".exe")]
+	} else if fi.Mode()&0111 == 0 {
+		return "", false
+	}
+	name = strings.TrimPrefix(name, Prefix)
+	return name, name != ""
+}
+
+// namedFileInfo is the file info of a symlink target under the name of the
+// symlink.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string {
+	return fi.name
+}
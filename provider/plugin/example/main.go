@@ -0,0 +1,108 @@
+// Command example is an example provider plugin, serving the in-memory fake
+// provider. It's used by the plugin tests and is a starting point for new
+// plugins. Install it as a plugin of the provider "example" with:
+//
+//	go build -o ~/.clouddev/plugins/clouddev-provider-example ./provider/plugin/example
+//
+// The machines only live as long as the plugin process, i.e. one clouddev
+// command.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/fake"
+	"github.com/darkowlzz/clouddev/provider/plugin"
+)
+
+// schema describes the options.
+var schema = plugin.Schema{Options: []plugin.Option{
+	{Name: "zone", Type: plugin.TypeString, Default: "zone-a", Description: "zone of the machines"},
+	{Name: "crash_on", Type: plugin.TypeString, Description: "operation on which the plugin exits with status 2, to test crash handling"},
+}}
+
+// options are the provider_options.
+type options struct {
+	Zone    string `mapstructure:"zone"`
+	CrashOn string `mapstructure:"crash_on"`
+}
+
+// example is the fake provider with options.
+type example struct {
+	*fake.Provider
+	opts options
+}
+
+func main() {
+	p := fake.New()
+	factory := func(c *config.Config) (provider.Provider, error) {
+		e := &example{Provider: p}
+		// Invalid options are reported by Validate.
+		_ = c.DecodeOptions(&e.opts)
+		return e, nil
+	}
+	if err := plugin.Serve(factory, schema); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Validate implements provider.Provider.
+func (e *example) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	switch opts.CrashOn {
+	case "", "create", "get", "start", "stop", "destroy", "list":
+	default:
+		errs = append(errs, &config.FieldError{Path: "provider_options.crash_on", Message: fmt.Sprintf("%q is not an operation", opts.CrashOn)})
+	}
+	return errs
+}
+
+// crash exits if the plugin is configured to crash on the operation.
+func (e *example) crash(op string) {
+	if e.opts.CrashOn == op {
+		fmt.Fprintf(os.Stderr, "crashing on %s as configured\n", op)
+		os.Exit(2)
+	}
+}
+
+// Create implements provider.Provider.
+func (e *example) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	e.crash("create")
+	return e.Provider.Create(ctx, spec)
+}
+
+// Get implements provider.Provider.
+func (e *example) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	e.crash("get")
+	return e.Provider.Get(ctx, id)
+}
+
+// Start implements provider.Provider.
+func (e *example) Start(ctx context.Context, id string) error {
+	e.crash("start")
+	return e.Provider.Start(ctx, id)
+}
+
+// Stop implements provider.Provider.
+func (e *example) Stop(ctx context.Context, id string) error {
+	e.crash("stop")
+	return e.Provider.Stop(ctx, id)
+}
+
+// Destroy implements provider.Provider.
+func (e *example) Destroy(ctx context.Context, m *provider.Machine) error {
+	e.crash("destroy")
+	return e.Provider.Destroy(ctx, m)
+}
+
+// List implements provider.Provider.
+func (e *example) List(ctx context.Context) ([]*provider.Machine, error) {
+	e.crash("list")
+	return e.Provider.List(ctx)
+}
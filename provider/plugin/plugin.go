@@ -0,0 +1,320 @@
+// Package plugin implements providers in external executables, for clouds
+// that aren't built into clouddev.
+//
+// The plugin of the provider "foo" is an executable named
+// clouddev-provider-foo in $HOME/.clouddev/plugins or in PATH. clouddev runs
+// it and speaks JSON-RPC 2.0 with it, one JSON message per line, on its
+// stdin and stdout. The plugin logs to stderr, and exits when its stdin is
+// closed.
+//
+// The first request is the handshake, in which clouddev offers the protocol
+// versions it supports and the plugin answers with the version it picked,
+// the schema of its provider_options and its optional capabilities. The
+// other methods mirror the operations of provider.Provider. A plugin that
+// crashes fails the pending operations with the end of its stderr, and is
+// restarted by the next one.
+//
+// Plugins written in Go implement provider.Provider and call Serve.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/version"
+)
+
+// Provider is a provider implemented by a plugin executable.
+type Provider struct {
+	cfg  *config.Config
+	info Info
+
+	mu   sync.Mutex
+	proc *process
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns the provider of the plugin for the configuration. The plugin
+// is started by the first operation.
+func New(info Info, c *config.Config) *Provider {
+	return &Provider{cfg: c, info: info}
+}
+
+// RegisterAll registers the plugins found in the plugin directories, except
+// the ones named after already registered providers.
+func RegisterAll() {
+	registered := map[string]bool{}
+	for _, name := range provider.Names() {
+		registered[name] = true
+	}
+	for _, info := range Discover(Dirs()) {
+		if registered[info.Name] {
+			continue
+		}
+		info := info
+		provider.Register(info.Name, func(c *config.Config) (provider.Provider, error) {
+			return New(info, c), nil
+		})
+	}
+}
+
+// process returns the running plugin process, starting it if it isn't
+// running, e.g. after a crash.
+func (p *Provider) process(ctx context.Context) (*process, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.proc != nil && !p.proc.exited() {
+		return p.proc, nil
+	}
+	proc, err := start(ctx, p.info.Name, p.info.Path, &HandshakeParams{
+		Versions:        protocolVersions,
+		ClouddevVersion: version.Version,
+		Config:          p.cfg.Settings(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.proc = proc
+	return proc, nil
+}
+
+// call calls a method of the plugin.
+func (p *Provider) call(ctx context.Context, method string, params, result interface{}) error {
+	proc, err := p.process(ctx)
+	if err != nil {
+		return err
+	}
+	return proc.call(ctx, method, params, result)
+}
+
+// Schema returns the schema of the provider options of the plugin.
+func (p *Provider) Schema(ctx context.Context) (*Schema, error) {
+	proc, err := p.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &proc.handshake.Schema, nil
+}
+
+// Close asks the plugin to exit.
+func (p *Provider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.proc != nil {
+		p.proc.close()
+		p.proc = nil
+	}
+	return nil
+}
+
+// Validate implements provider.Provider. The options are checked against
+// the schema of the plugin, then validated by the plugin.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	schema, err := p.Schema(ctx)
+	if err != nil {
+		return []*config.FieldError{{Path: "provider", Message: err.Error()}}
+	}
+	errs := validateOptions(schema, c.ProviderOptions)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	var result ValidateResult
+	if err := p.call(ctx, MethodValidate, &ConfigParams{Config: c.Settings()}, &result); err != nil {
+		return []*config.FieldError{{Path: "provider", Message: fmt.Sprintf("plugin %s: %v", p.info.Name, err)}}
+	}
+	for _, fe := range result.Errors {
+		errs = append(errs, &config.FieldError{Path: fe.Path, Message: fe.Message})
+	}
+	return errs
+}
+
+// validateOptions checks the provider options against the schema.
+func validateOptions(schema *Schema, opts map[string]interface{}) []*config.FieldError {
+	var errs []*config.FieldError
+	add := func(name, format string, args ...interface{}) {
+		errs = append(errs, &config.FieldError{Path: "provider_options." + name, Message: fmt.Sprintf(format, args...)})
+	}
+
+	known := map[string]bool{}
+	for _, o := range schema.Options {
+		known[o.Name] = true
+		v, ok := opts[o.Name]
+		if !ok {
+			if o.Required {
+				add(o.Name, "is required")
+			}
+			continue
+		}
+		if !hasType(v, o.Type) {
+			add(o.Name, "must be a %s, got %v", o.Type, v)
+		}
+	}
+	var unknown []string
+	for k := range opts {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		add(k, "unknown key")
+	}
+	return errs
+}
+
+// hasType returns true if the value decodes as the option type, as weakly
+// as config.Config.DecodeOptions decodes the options of the built in
+// providers.
+func hasType(v interface{}, typ string) bool {
+	s := fmt.Sprint(v)
+	switch typ {
+	case TypeString:
+		switch v.(type) {
+		case []interface{}, map[string]interface{}, map[interface{}]interface{}:
+			return false
+		}
+		return true
+	case TypeInt:
+		_, err := strconv.ParseInt(s, 10, 64)
+		return err == nil
+	case TypeFloat:
+		_, err := strconv.ParseFloat(s, 64)
+		return err == nil
+	case TypeBool:
+		_, err := strconv.ParseBool(s)
+		return err == nil
+	case TypeDuration:
+		_, err := time.ParseDuration(s)
+		return err == nil
+	case TypeList:
+		switch v.(type) {
+		case []interface{}, string:
+			return true
+		}
+		return false
+	case TypeMap:
+		switch v.(type) {
+		case map[string]interface{}, map[interface{}]interface{}:
+			return true
+		}
+		return false
+	}
+	// Types of newer protocol versions are left to the plugin.
+	return true
+}
+
+// Plan implements provider.Provider. The changes of a plugin without the
+// update capability all replace the machine, since it can't update it in
+// place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	proc, err := p.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result ChangesResult
+	if err := proc.call(ctx, MethodPlan, &PlanParams{Spec: toSpec(spec), Machine: toMachine(m)}, &result); err != nil {
+		return nil, err
+	}
+	if !proc.handshake.hasCapability(CapabilityUpdate) {
+		for i := range result.Changes {
+			result.Changes[i].Replace = true
+		}
+	}
+	return result.Changes, nil
+}
+
+// Create implements provider.Provider. The partially created machine a
+// plugin returns with an error is returned with it.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	var result MachineResult
+	err := p.call(ctx, MethodCreate, &SpecParams{Spec: toSpec(spec)}, &result)
+	if e, ok := err.(*Error); ok && len(e.Data) > 0 {
+		var partial MachineResult
+		if json.Unmarshal(e.Data, &partial) == nil && partial.Machine != nil {
+			return fromMachine(partial.Machine), err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.Machine == nil {
+		return nil, fmt.Errorf("plugin %s returned no machine", p.info.Name)
+	}
+	return fromMachine(result.Machine), nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	var result MachineResult
+	if err := p.call(ctx, MethodGet, &IDParams{ID: id}, &result); err != nil {
+		return nil, err
+	}
+	if result.Machine == nil {
+		return nil, provider.ErrNotFound
+	}
+	return fromMachine(result.Machine), nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	return p.call(ctx, MethodStart, &IDParams{ID: id}, nil)
+}
+
+// Stop implements provider.Provider.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	return p.call(ctx, MethodStop, &IDParams{ID: id}, nil)
+}
+
+// Destroy implements provider.Provider.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	return p.call(ctx, MethodDestroy, &MachineParams{Machine: toMachine(m)}, nil)
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	var result MachinesResult
+	if err := p.call(ctx, MethodList, struct{}{}, &result); err != nil {
+		return nil, err
+	}
+	machines := make([]*provider.Machine, len(result.Machines))
+	for i := range result.Machines {
+		machines[i] = fromMachine(&result.Machines[i])
+	}
+	return machines, nil
+}
+
+// Update implements provider.Updater, for the plugins with the update
+// capability.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	proc, err := p.process(ctx)
+	if err != nil {
+		return err
+	}
+	if !proc.handshake.hasCapability(CapabilityUpdate) {
+		return fmt.Errorf("plugin %s can't update machines in place", p.info.Name)
+	}
+	return proc.call(ctx, MethodUpdate, &UpdateParams{Spec: toSpec(spec), Machine: toMachine(m), Changes: changes}, nil)
+}
+
+func (r *HandshakeResult) hasCapability(c string) bool {
+	for _, have := range r.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package plugin_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/plan"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/fake"
+	"github.com/darkowlzz/clouddev/provider/plugin"
+	"github.com/darkowlzz/clouddev/provider/plugin/plugintest"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+func TestConformance(t *testing.T) {
+	info := plugintest.Build(t)
+	spec := providertest.Spec(info.Name)
+	p := plugintest.New(t, info, spec.Config)
+	providertest.Run(t, p, spec)
+}
+
+func TestDiscover(t *testing.T) {
+	info := plugintest.Build(t)
+	// Other files in the directory aren't plugins.
+	dir := filepath.Dir(info.Path)
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	got := plugin.Discover([]string{dir, filepath.Join(dir, "missing")})
+	if len(got) != 1 || got[0] != info {
+		t.Errorf("Discover() = %v, want %v", got, info)
+	}
+}
+
+func TestHandshakeSchema(t *testing.T) {
+	info := plugintest.Build(t)
+	spec := providertest.Spec(info.Name)
+	p := plugintest.New(t, info, spec.Config)
+
+	schema, err := p.Schema(context.Background())
+	if err != nil {
+		t.Fatalf("Schema() error = %v", err)
+	}
+	var names []string
+	for _, o := range schema.Options {
+		names = append(names, o.Name)
+		if o.Name == "zone" && (o.Type != plugin.TypeString || o.Default != "zone-a") {
+			t.Errorf("Schema() zone option = %+v, want a string defaulting to zone-a", o)
+		}
+	}
+	if strings.Join(names, ",") != "zone,crash_on" {
+		t.Errorf("Schema() options = %v, want zone and crash_on", names)
+	}
+}
+
+func TestValidateAgainstSchema(t *testing.T) {
+	info := plugintest.Build(t)
+	tests := []struct {
+		name string
+		opts map[string]interface{}
+		// want are the errors, empty if the options are valid.
+		want []string
+	}{
+		{
+			name: "valid",
+			opts: map[string]interface{}{"zone": "zone-b", "crash_on": "stop"},
+		},
+		{
+			name: "unknown key",
+			opts: map[string]interface{}{"foo": "bar"},
+			want: []string{"provider_options.foo: unknown key"},
+		},
+		{
+			name: "wrong type",
+			opts: map[string]interface{}{"zone": []interface{}{"zone-a"}},
+			want: []string{"provider_options.zone: must be a string"},
+		},
+		{
+			// Checked by the plugin itself.
+			name: "invalid crash_on",
+			opts: map[string]interface{}{"crash_on": "reboot"},
+			want: []string{`provider_options.crash_on: "reboot" is not an operation`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := providertest.Spec(info.Name)
+			spec.Config.ProviderOptions = tt.opts
+			p := plugintest.New(t, info, spec.Config)
+
+			errs := p.Validate(spec.Config)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("Validate() = %v, want %v", errs, tt.want)
+			}
+			for i, err := range errs {
+				if !strings.HasPrefix(err.Error(), tt.want[i]) {
+					t.Errorf("Validate() error = %q, want %q", err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCrashIsReportedAndRestarted(t *testing.T) {
+	info := plugintest.Build(t)
+	spec := providertest.Spec(info.Name)
+	spec.Config.ProviderOptions = map[string]interface{}{"crash_on": "get"}
+	p := plugintest.New(t, info, spec.Config)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	_, err = p.Get(ctx, m.ID)
+	if err == nil || !strings.Contains(err.Error(), "plugin example crashed") || !strings.Contains(err.Error(), "crashing on get as configured") {
+		t.Fatalf("Get() error = %v, want the crash with the stderr of the plugin", err)
+	}
+	// The next operation restarts the plugin, whose machines died with it.
+	machines, err := p.List(ctx)
+	if err != nil {
+		t.Fatalf("List() after the crash error = %v", err)
+	}
+	if len(machines) != 0 {
+		t.Errorf("List() after the crash = %v, want the machines of the new process", machines)
+	}
+}
+
+func TestPluginPicksUnsupportedVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in plugin is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), plugin.Prefix+"future")
+	script := `#!/bin/sh
+read request
+echo '{"jsonrpc": "2.0", "id": 1, "result": {"version": 99, "schema": {}}}'
+cat >/dev/null
+`
+	if err := ioutil.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p := plugintest.New(t, plugin.Info{Name: "future", Path: path}, config.Default())
+
+	_, err := p.Schema(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "plugin future picked protocol version 99, clouddev supports 1") {
+		t.Errorf("Schema() error = %v, want the unsupported version", err)
+	}
+	errs := p.Validate(config.Default())
+	if len(errs) != 1 || errs[0].Path != "provider" {
+		t.Errorf("Validate() = %v, want the handshake failure", errs)
+	}
+}
+
+func TestServeRejectsUnsupportedVersions(t *testing.T) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		factory := func(c *config.Config) (provider.Provider, error) {
+			return fake.New(), nil
+		}
+		served <- plugin.ServeConn(stdinR, stdoutW, factory, plugin.Schema{})
+		stdoutW.Close()
+	}()
+
+	params, err := json.Marshal(&plugin.HandshakeParams{Versions: []int{98, 99}, ClouddevVersion: "v9.0.0", Config: config.Default().Settings()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		json.NewEncoder(stdinW).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      1,
+			"method":  plugin.MethodHandshake,
+			"params":  json.RawMessage(params),
+		})
+	}()
+
+	var resp struct {
+		ID    int64         `json:"id"`
+		Error *plugin.Error `json:"error"`
+	}
+	line, err := bufio.NewReader(stdoutR).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 1 || resp.Error == nil || resp.Error.Code != plugin.CodeIncompatible {
+		t.Fatalf("handshake response = %s, want the incompatible error", line)
+	}
+	if want := "clouddev v9.0.0 offered protocol versions 98, 99, the plugin supports 1"; resp.Error.Message != want {
+		t.Errorf("handshake error = %q, want %q", resp.Error.Message, want)
+	}
+
+	// Closing stdin ends the plugin.
+	stdinW.Close()
+	if err := <-served; err != nil && !errors.Is(err, io.EOF) {
+		t.Errorf("ServeConn() error = %v", err)
+	}
+}
+
+// scriptedPlugin writes a plugin with the capabilities that plans an in
+// place change of machine vm-1.
+func scriptedPlugin(t *testing.T, capabilities string) plugin.Info {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), plugin.Prefix+"scripted")
+	script := `#!/bin/sh
+while read -r request; do
+  case "$request" in
+  '{"jsonrpc":"2.0","method"'*) continue ;;
+  esac
+  id=$(printf '%s\n' "$request" | sed 's/^{"jsonrpc":"2.0","id":\([0-9]*\),.*/\1/')
+  case "$request" in
+  *'"method":"handshake"'*) result='{"version": 1, "schema": {}, "capabilities": [` + capabilities + `]}' ;;
+  *'"method":"get"'*) result='{"machine": {"id": "vm-1", "name": "conformance", "status": "running", "resources": {"instance": "vm-1"}, "created_at": "2024-01-02T03:04:05Z"}}' ;;
+  *'"method":"plan"'*) result='{"changes": [{"field": "machine_type", "old": "small", "new": "large"}]}' ;;
+  *) result='null' ;;
+  esac
+  echo "{\"jsonrpc\": \"2.0\", \"id\": $id, \"result\": $result}"
+done
+`
+	if err := ioutil.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return plugin.Info{Name: "scripted", Path: path}
+}
+
+func TestPlanReplacesWithoutUpdateCapability(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in plugin is a shell script")
+	}
+	tests := []struct {
+		name         string
+		capabilities string
+		want         plan.ActionType
+	}{
+		{name: "without update", want: plan.Replace},
+		{name: "with update", capabilities: `"` + plugin.CapabilityUpdate + `"`, want: plan.Update},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := providertest.Spec("scripted")
+			p := plugintest.New(t, scriptedPlugin(t, tt.capabilities), spec.Config)
+			env := &state.Environment{Name: spec.Config.Name, Provider: "scripted", Resources: map[string]string{provider.ResourceInstance: "vm-1"}}
+
+			pl, err := plan.Build(context.Background(), p, spec, env)
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if len(pl.Actions) != 1 || pl.Actions[0].Type != tt.want {
+				t.Errorf("Build() actions = %+v, want a %s action", pl.Actions, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Package plugintest builds the example plugin for testing the plugin
+// protocol:
+//
+//	func TestConformance(t *testing.T) {
+//		info := plugintest.Build(t)
+//		spec := providertest.Spec(info.Name)
+//		p := plugintest.New(t, info, spec.Config)
+//		providertest.Run(t, p, spec)
+//	}
+package plugintest
+
+import (
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider/plugin"
+)
+
+// Name is the provider name of the example plugin.
+const Name = "example"
+
+// examplePackage is the import path of the example plugin.
+const examplePackage = "github.com/darkowlzz/clouddev/provider/plugin/example"
+
+// Build builds the example plugin into a temporary directory, which can be
+// passed to plugin.Discover or added to PATH.
+func Build(t *testing.T) plugin.Info {
+	t.Helper()
+	dir := t.TempDir()
+	name := plugin.Prefix + Name
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	path := filepath.Join(dir, name)
+	out, err := exec.Command("go", "build", "-o", path, examplePackage).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build the example plugin: %v\n%s", err, out)
+	}
+	return plugin.Info{Name: Name, Path: path}
+}
+
+// New returns the provider of the plugin for the configuration, closed
+// when the test ends.
+func New(t *testing.T, info plugin.Info, c *config.Config) *plugin.Provider {
+	t.Helper()
+	p := plugin.New(info, c)
+	t.Cleanup(func() {
+		if err := p.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	})
+	return p
+}
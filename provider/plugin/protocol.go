@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// ProtocolVersion is the latest version of the plugin protocol spoken by
+// this version of clouddev.
+const ProtocolVersion = 1
+
+// protocolVersions are the protocol versions clouddev supports, newest first.
+var protocolVersions = []int{ProtocolVersion}
+
+// Methods of the protocol.
+const (
+	MethodHandshake = "handshake"
+	MethodValidate  = "validate"
+	MethodPlan      = "plan"
+	MethodCreate    = "create"
+	MethodGet       = "get"
+	MethodStart     = "start"
+	MethodStop      = "stop"
+	MethodDestroy   = "destroy"
+	MethodList      = "list"
+	MethodUpdate    = "update"
+	// MethodCancel is a notification that the request with the given ID
+	// was cancelled, e.g. on interrupt.
+	MethodCancel = "$/cancel"
+)
+
+// Error codes of the protocol, in the JSON-RPC 2.0 range reserved for
+// implementations.
+const (
+	// CodeError is a failed provider operation.
+	CodeError = -32000
+	// CodeNotFound maps to provider.ErrNotFound.
+	CodeNotFound = -32001
+	// CodeIncompatible is returned by the handshake when the plugin doesn't
+	// speak any of the offered protocol versions.
+	CodeIncompatible = -32002
+
+	codeParse          = -32700
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+)
+
+// CapabilityUpdate is the capability of the plugins implementing
+// provider.Updater.
+const CapabilityUpdate = "update"
+
+// request is a JSON-RPC 2.0 request, or a notification if ID is nil.
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// response is a JSON-RPC 2.0 response.
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is a JSON-RPC error returned by a plugin.
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// HandshakeParams are the parameters of the handshake, the first request
+// sent to a plugin.
+type HandshakeParams struct {
+	// Versions are the protocol versions clouddev supports, newest first.
+	Versions []int `json:"versions"`
+	// ClouddevVersion is the version of clouddev.
+	ClouddevVersion string `json:"clouddev_version"`
+	// Config is the environment configuration, as returned by
+	// config.Config.Settings.
+	Config map[string]interface{} `json:"config"`
+}
+
+// HandshakeResult is the result of the handshake.
+type HandshakeResult struct {
+	// Version is the protocol version picked by the plugin from the offered
+	// ones.
+	Version int `json:"version"`
+	// Schema describes the provider_options of the plugin.
+	Schema Schema `json:"schema"`
+	// Capabilities are the optional operations the plugin implements, e.g.
+	// CapabilityUpdate.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Schema describes the provider_options of a plugin, so that clouddev can
+// validate them without knowing the plugin.
+type Schema struct {
+	Options []Option `json:"options"`
+}
+
+// Option types.
+const (
+	TypeString   = "string"
+	TypeInt      = "int"
+	TypeFloat    = "float"
+	TypeBool     = "bool"
+	TypeDuration = "duration"
+	TypeList     = "list"
+	TypeMap      = "map"
+)
+
+// Option is a provider option of a plugin.
+type Option struct {
+	// Name is the key of the option under provider_options.
+	Name string `json:"name"`
+	// Type is one of the Type constants.
+	Type        string      `json:"type"`
+	Required    bool        `json:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// ConfigParams are the parameters of validate.
+type ConfigParams struct {
+	Config map[string]interface{} `json:"config"`
+}
+
+// ValidateResult is the result of validate.
+type ValidateResult struct {
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a config.FieldError on the wire.
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// Spec is a provider.Spec on the wire.
+type Spec struct {
+	Config       map[string]interface{} `json:"config"`
+	SSHPublicKey string                 `json:"ssh_public_key"`
+	UserData     string                 `json:"user_data"`
+}
+
+// Machine is a provider.Machine on the wire.
+type Machine struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Status    string            `json:"status"`
+	Address   string            `json:"address,omitempty"`
+	SSHPort   int               `json:"ssh_port,omitempty"`
+	Resources map[string]string `json:"resources,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// PlanParams are the parameters of plan.
+type PlanParams struct {
+	Spec    Spec    `json:"spec"`
+	Machine Machine `json:"machine"`
+}
+
+// ChangesResult is the result of plan.
+type ChangesResult struct {
+	Changes []provider.Change `json:"changes"`
+}
+
+// SpecParams are the parameters of create.
+type SpecParams struct {
+	Spec Spec `json:"spec"`
+}
+
+// MachineResult is the result of create and get. A create error carries the
+// partially created machine as its data.
+type MachineResult struct {
+	Machine *Machine `json:"machine"`
+}
+
+// IDParams are the parameters of get, start and stop.
+type IDParams struct {
+	ID string `json:"id"`
+}
+
+// MachineParams are the parameters of destroy.
+type MachineParams struct {
+	Machine Machine `json:"machine"`
+}
+
+// MachinesResult is the result of list.
+type MachinesResult struct {
+	Machines []Machine `json:"machines"`
+}
+
+// UpdateParams are the parameters of update.
+type UpdateParams struct {
+	Spec    Spec              `json:"spec"`
+	Machine Machine           `json:"machine"`
+	Changes []provider.Change `json:"changes"`
+}
+
+// CancelParams are the parameters of the cancel notification.
+type CancelParams struct {
+	ID int64 `json:"id"`
+}
+
+func toSpec(s *provider.Spec) Spec {
+	return Spec{
+		Config:       s.Config.Settings(),
+		SSHPublicKey: s.SSHPublicKey,
+		UserData:     string(s.UserData),
+	}
+}
+
+func fromSpec(s Spec) (*provider.Spec, error) {
+	c, err := config.FromSettings(s.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &provider.Spec{Config: c, SSHPublicKey: s.SSHPublicKey, UserData: []byte(s.UserData)}, nil
+}
+
+func toMachine(m *provider.Machine) Machine {
+	return Machine{
+		ID:        m.ID,
+		Name:      m.Name,
+		Status:    string(m.Status),
+		Address:   m.Address,
+		SSHPort:   m.SSHPort,
+		Resources: m.Resources,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+func fromMachine(m *Machine) *provider.Machine {
+	return &provider.Machine{
+		ID:        m.ID,
+		Name:      m.Name,
+		Status:    provider.Status(m.Status),
+		Address:   m.Address,
+		SSHPort:   m.SSHPort,
+		Resources: m.Resources,
+		CreatedAt: m.CreatedAt,
+	}
+}
@@ -0,0 +1,288 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Serve serves the provider created by factory as a plugin on stdin and
+// stdout, until stdin is closed. It's the main function of the plugins
+// written in Go. The provider is created from the configuration sent in the
+// handshake, and has the update capability if it implements
+// provider.Updater.
+func Serve(factory provider.Factory, schema Schema) error {
+	return ServeConn(os.Stdin, os.Stdout, factory, schema)
+}
+
+// ServeConn is like Serve on the given connection.
+func ServeConn(r io.Reader, w io.Writer, factory provider.Factory, schema Schema) error {
+	s := &server{
+		factory: factory,
+		schema:  schema,
+		enc:     json.NewEncoder(w),
+		cancels: map[int64]context.CancelFunc{},
+	}
+	return s.serve(r)
+}
+
+type server struct {
+	factory provider.Factory
+	schema  Schema
+	// p is the provider created by the handshake.
+	p provider.Provider
+
+	wmu sync.Mutex
+	enc *json.Encoder
+
+	mu      sync.Mutex
+	cancels map[int64]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func (s *server) serve(r io.Reader) error {
+	// Finish the running operations once clouddev is gone.
+	defer s.wg.Wait()
+
+	dec := json.NewDecoder(r)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			s.reply(nil, nil, &Error{Code: codeParse, Message: err.Error()})
+			return err
+		}
+
+		switch {
+		case req.Method == MethodCancel:
+			var params CancelParams
+			if json.Unmarshal(req.Params, &params) == nil {
+				s.mu.Lock()
+				if cancel, ok := s.cancels[params.ID]; ok {
+					cancel()
+				}
+				s.mu.Unlock()
+			}
+		case req.ID == nil:
+			// Unknown notifications are ignored.
+		case req.Method == MethodHandshake:
+			// The other requests need the provider, so the handshake isn't
+			// concurrent with them.
+			result, err := s.handshake(req.Params)
+			s.reply(req.ID, result, err)
+		default:
+			ctx, cancel := context.WithCancel(context.Background())
+			s.mu.Lock()
+			s.cancels[*req.ID] = cancel
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func(req request) {
+				defer s.wg.Done()
+				result, err := s.handle(ctx, req.Method, req.Params)
+				s.mu.Lock()
+				delete(s.cancels, *req.ID)
+				s.mu.Unlock()
+				cancel()
+				s.reply(req.ID, result, err)
+			}(req)
+		}
+	}
+}
+
+// reply sends the response to a request.
+func (s *server) reply(id *int64, result interface{}, err error) {
+	resp := &response{JSONRPC: "2.0", ID: id}
+	if err != nil {
+		resp.Error = toError(err)
+	} else {
+		data, merr := json.Marshal(result)
+		if merr != nil {
+			resp.Error = &Error{Code: CodeError, Message: merr.Error()}
+		} else {
+			resp.Result = data
+		}
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	// A write error means clouddev is gone, and the next read fails.
+	_ = s.enc.Encode(resp)
+}
+
+// toError converts an operation error to a protocol error.
+func toError(err error) *Error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, provider.ErrNotFound):
+		return &Error{Code: CodeNotFound, Message: err.Error()}
+	default:
+		return &Error{Code: CodeError, Message: err.Error()}
+	}
+}
+
+func (s *server) handshake(raw json.RawMessage) (interface{}, error) {
+	var params HandshakeParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &Error{Code: codeInvalidParams, Message: err.Error()}
+	}
+	version := 0
+	for _, v := range params.Versions {
+		if supported(v) && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return nil, &Error{
+			Code:    CodeIncompatible,
+			Message: fmt.Sprintf("clouddev %s offered protocol versions %s, the plugin supports %s", params.ClouddevVersion, formatVersions(params.Versions), formatVersions(protocolVersions)),
+		}
+	}
+
+	c, err := config.FromSettings(params.Config)
+	if err != nil {
+		return nil, &Error{Code: codeInvalidParams, Message: err.Error()}
+	}
+	if s.p, err = s.factory(c); err != nil {
+		return nil, err
+	}
+	result := &HandshakeResult{Version: version, Schema: s.schema}
+	if _, ok := s.p.(provider.Updater); ok {
+		result.Capabilities = append(result.Capabilities, CapabilityUpdate)
+	}
+	return result, nil
+}
+
+// handle runs the operation of a request.
+func (s *server) handle(ctx context.Context, method string, raw json.RawMessage) (interface{}, error) {
+	if s.p == nil {
+		return nil, errors.New("no handshake")
+	}
+	decode := func(params interface{}) error {
+		if err := json.Unmarshal(raw, params); err != nil {
+			return &Error{Code: codeInvalidParams, Message: err.Error()}
+		}
+		return nil
+	}
+
+	switch method {
+	case MethodValidate:
+		var params ConfigParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		c, err := config.FromSettings(params.Config)
+		if err != nil {
+			return nil, &Error{Code: codeInvalidParams, Message: err.Error()}
+		}
+		result := &ValidateResult{}
+		for _, fe := range s.p.Validate(c) {
+			result.Errors = append(result.Errors, FieldError{Path: fe.Path, Message: fe.Message})
+		}
+		return result, nil
+
+	case MethodPlan:
+		var params PlanParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		spec, err := fromSpec(params.Spec)
+		if err != nil {
+			return nil, &Error{Code: codeInvalidParams, Message: err.Error()}
+		}
+		changes, err := s.p.Plan(ctx, spec, fromMachine(&params.Machine))
+		if err != nil {
+			return nil, err
+		}
+		return &ChangesResult{Changes: changes}, nil
+
+	case MethodCreate:
+		var params SpecParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		spec, err := fromSpec(params.Spec)
+		if err != nil {
+			return nil, &Error{Code: codeInvalidParams, Message: err.Error()}
+		}
+		m, err := s.p.Create(ctx, spec)
+		if err != nil {
+			e := toError(err)
+			if m != nil {
+				e.Data, _ = json.Marshal(&MachineResult{Machine: machinePtr(m)})
+			}
+			return nil, e
+		}
+		return &MachineResult{Machine: machinePtr(m)}, nil
+
+	case MethodGet:
+		var params IDParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		m, err := s.p.Get(ctx, params.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &MachineResult{Machine: machinePtr(m)}, nil
+
+	case MethodStart, MethodStop:
+		var params IDParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		op := s.p.Start
+		if method == MethodStop {
+			op = s.p.Stop
+		}
+		return struct{}{}, op(ctx, params.ID)
+
+	case MethodDestroy:
+		var params MachineParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		return struct{}{}, s.p.Destroy(ctx, fromMachine(&params.Machine))
+
+	case MethodList:
+		machines, err := s.p.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result := &MachinesResult{Machines: make([]Machine, len(machines))}
+		for i, m := range machines {
+			result.Machines[i] = toMachine(m)
+		}
+		return result, nil
+
+	case MethodUpdate:
+		u, ok := s.p.(provider.Updater)
+		if !ok {
+			break
+		}
+		var params UpdateParams
+		if err := decode(&params); err != nil {
+			return nil, err
+		}
+		spec, err := fromSpec(params.Spec)
+		if err != nil {
+			return nil, &Error{Code: codeInvalidParams, Message: err.Error()}
+		}
+		return struct{}{}, u.Update(ctx, spec, fromMachine(&params.Machine), params.Changes)
+	}
+	return nil, &Error{Code: codeMethodNotFound, Message: fmt.Sprintf("unknown method %q", method)}
+}
+
+func machinePtr(m *provider.Machine) *Machine {
+	wm := toMachine(m)
+	return &wm
+}
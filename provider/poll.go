@@ -0,0 +1,24 @@
+package provider
+
+import (
+	"context"
+	"time"
+)
+
+// Poll calls condition every interval until it returns true or an error, or
+// the context is done.
+func Poll(ctx context.Context, interval time.Duration, condition func(ctx context.Context) (bool, error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		done, err := condition(ctx)
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
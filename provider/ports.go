@@ -0,0 +1,19 @@
+package provider
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FormatPorts formats ports in a canonical, sorted form for comparing the
+// configured ports with the ports open on a machine.
+func FormatPorts(ports []int) string {
+	sorted := append([]int(nil), ports...)
+	sort.Ints(sorted)
+	s := make([]string, len(sorted))
+	for i, port := range sorted {
+		s[i] = strconv.Itoa(port)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,152 @@
+// Package provider defines the interface of the cloud providers clouddev
+// provisions environments on, and a registry of their implementations keyed
+// by the provider config key.
+package provider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+// ErrNotFound is returned when a machine doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// Status is the status of a machine.
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusRunning Status = "running"
+	StatusStopped Status = "stopped"
+	StatusUnknown Status = "unknown"
+)
+
+// Resource kinds created for a machine.
+const (
+	ResourceInstance = "instance"
+	ResourceDisk     = "disk"
+	ResourceFirewall = "firewall"
+	ResourceIP       = "ip"
+	ResourceKey      = "key"
+	// ResourceGroup is a group holding all the other resources, deleted
+	// with them.
+	ResourceGroup = "group"
+)
+
+// Spec is the desired environment.
+type Spec struct {
+	// Config is the validated environment configuration.
+	Config *config.Config
+	// SSHPublicKey is the authorized key of the SSH user, in the
+	// authorized_keys format.
+	SSHPublicKey string
+	// UserData is the cloud-init user data that sets up the machine on
+	// first boot.
+	UserData []byte
+}
+
+// Machine is a provisioned environment as reported by a provider.
+type Machine struct {
+	// ID is the provider ID of the machine.
+	ID string
+	// Name is the environment name.
+	Name   string
+	Status Status
+	// Address is the public IP address of the machine.
+	Address string
+	// SSHPort is the port of the SSH server on Address, 22 if zero.
+	SSHPort int
+	// Resources are the provider IDs of all the resources created for the
+	// machine, including the machine itself, keyed by resource kind.
+	Resources map[string]string
+	CreatedAt time.Time
+}
+
+// Change is a difference between the desired and the provisioned machine.
+type Change struct {
+	// Field is the configuration key that differs.
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+	// Replace is true if the machine has to be recreated to apply the
+	// change.
+	Replace bool `json:"replace"`
+}
+
+// Provider provisions machines on a cloud.
+type Provider interface {
+	// Validate checks the provider specific configuration and returns all
+	// the problems found. It must not contact the provider.
+	Validate(c *config.Config) []*config.FieldError
+	// Plan compares the spec with the provisioned machine and returns the
+	// changes needed to make the machine match the spec.
+	Plan(ctx context.Context, spec *Spec, m *Machine) ([]Change, error)
+	// Create provisions a machine and all its resources, and waits for it to
+	// be running. If it fails after creating some of the resources, it
+	// returns a machine with the resources created so far along with the
+	// error, so that they can be recorded and destroyed.
+	Create(ctx context.Context, spec *Spec) (*Machine, error)
+	// Get returns the machine with the given ID, or ErrNotFound.
+	Get(ctx context.Context, id string) (*Machine, error)
+	// Start starts a stopped machine.
+	Start(ctx context.Context, id string) error
+	// Stop stops a running machine, keeping its resources.
+	Stop(ctx context.Context, id string) error
+	// Destroy deletes the machine and all the resources in m.Resources. The
+	// resources that don't exist anymore are skipped.
+	Destroy(ctx context.Context, m *Machine) error
+	// List returns all the machines created by clouddev.
+	List(ctx context.Context) ([]*Machine, error)
+}
+
+// Updater is implemented by the providers that can apply some changes to a
+// machine in place, e.g. to its firewall. Changes to providers that aren't
+// Updaters are applied by replacing the machine.
+type Updater interface {
+	// Update applies the changes returned by Plan that don't require a
+	// replacement.
+	Update(ctx context.Context, spec *Spec, m *Machine, changes []Change) error
+}
+
+// ConsoleReader is implemented by the providers that can read the serial
+// console output of a machine, where cloud-init prints the SSH host keys so
+// that they can be pinned before the first connection.
+type ConsoleReader interface {
+	// ConsoleOutput returns the recent console output of the machine with
+	// the given ID.
+	ConsoleOutput(ctx context.Context, id string) (string, error)
+}
+
+// UserDataLimiter is implemented by the providers that limit the size of
+// the user data.
+type UserDataLimiter interface {
+	// UserDataLimit returns the maximum size of Spec.UserData in bytes.
+	UserDataLimit() int
+}
+
+// Find returns the machine of the named environment, or ErrNotFound.
+func Find(ctx context.Context, p Provider, name string) (*Machine, error) {
+	machines, err := p.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range machines {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Close releases the resources held by the provider, e.g. the process of a
+// plugin, if it's an io.Closer.
+func Close(p Provider) error {
+	if c, ok := p.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Package providertest implements the conformance test suite that every
+// provider implementation must pass.
+//
+// A provider package runs the suite from its tests against a fake of its
+// cloud API:
+//
+//	func TestConformance(t *testing.T) {
+//		providertest.Run(t, newTestProvider(t), providertest.Spec("digitalocean"))
+//	}
+package providertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Timeout is the time the whole suite is allowed to take.
+var Timeout = 5 * time.Minute
+
+// ConsoleOutput is the console output the fakes of the cloud APIs return
+// for the machines, with the SSH host keys block cloud-init prints.
+const ConsoleOutput = `[   12.345678] cloud-init[1024]: Cloud-init v. 23.1 running 'modules:final'
+-----BEGIN SSH HOST KEY KEYS-----
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA4hqLexDK4NVEcos7eRMj2zccCytvXY8vD3/Hyy4vlx root@conformance
+-----END SSH HOST KEY KEYS-----
+[   13.456789] cloud-init[1024]: Cloud-init v. 23.1 finished
+`
+
+// Spec returns a spec of a small environment on the named provider. The
+// provider specific fields are left for the caller to fill in.
+func Spec(providerName string) *provider.Spec {
+	c := config.Default()
+	c.Name = "conformance"
+	c.Provider = providerName
+	c.Image = "conformance-image"
+	return &provider.Spec{
+		Config:       c,
+		SSHPublicKey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl conformance",
+		UserData:     []byte("#cloud-config\n"),
+	}
+}
+
+// Run runs the conformance suite against the provider. The spec must be
+// valid for the provider. The suite creates, stops, starts and destroys one
+// machine from the spec.
+func Run(t *testing.T, p provider.Provider, spec *provider.Spec) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	if errs := p.Validate(spec.Config); len(errs) > 0 {
+		t.Fatalf("Validate() returned errors for the spec: %v", errs)
+	}
+
+	t.Run("get unknown machine", func(t *testing.T) {
+		if _, err := p.Get(ctx, "clouddev-does-not-exist"); !errors.Is(err, provider.ErrNotFound) {
+			t.Errorf("Get() error = %v, want %v", err, provider.ErrNotFound)
+		}
+	})
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	// Don't leak the machine if the suite fails half way.
+	defer func() {
+		if err := p.Destroy(ctx, m); err != nil {
+			t.Errorf("cleanup Destroy() error = %v", err)
+		}
+	}()
+
+	t.Run("create", func(t *testing.T) {
+		if m.ID == "" {
+			t.Error("Create() returned a machine without an ID")
+		}
+		if m.Name != spec.Config.Name {
+			t.Errorf("Create() machine name = %q, want %q", m.Name, spec.Config.Name)
+		}
+		if m.Status != provider.StatusRunning {
+			t.Errorf("Create() machine status = %q, want %q", m.Status, provider.StatusRunning)
+		}
+		if m.Resources[provider.ResourceInstance] == "" {
+			t.Errorf("Create() machine resources %v don't include the %s", m.Resources, provider.ResourceInstance)
+		}
+		if m.CreatedAt.IsZero() {
+			t.Error("Create() returned a machine without a creation time")
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		got, err := p.Get(ctx, m.ID)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if got.ID != m.ID || got.Name != m.Name {
+			t.Errorf("Get() = %s/%s, want %s/%s", got.ID, got.Name, m.ID, m.Name)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		if _, err := provider.Find(ctx, p, spec.Config.Name); err != nil {
+			t.Errorf("List() doesn't include the created machine: %v", err)
+		}
+	})
+
+	if r, ok := p.(provider.ConsoleReader); ok {
+		t.Run("console output", func(t *testing.T) {
+			out, err := r.ConsoleOutput(ctx, m.ID)
+			if err != nil {
+				t.Fatalf("ConsoleOutput() error = %v", err)
+			}
+			if out == "" {
+				t.Error("ConsoleOutput() is empty")
+			}
+			if _, err := r.ConsoleOutput(ctx, "clouddev-does-not-exist"); !errors.Is(err, provider.ErrNotFound) {
+				t.Errorf("ConsoleOutput() of an unknown machine error = %v, want %v", err, provider.ErrNotFound)
+			}
+		})
+	}
+
+	if sz, ok := p.(provider.Sizer); ok {
+		t.Run("machine sizes", func(t *testing.T) {
+			sizes := sz.MachineSizes()
+			if len(sizes) == 0 {
+				t.Fatal("MachineSizes() is empty")
+			}
+			seen := map[string]bool{}
+			for _, s := range sizes {
+				if s.Name == "" || s.CPUs <= 0 || s.MemoryMB <= 0 {
+					t.Errorf("MachineSizes() has invalid size %+v", s)
+				}
+				if seen[s.Name] {
+					t.Errorf("MachineSizes() has %s more than once", s.Name)
+				}
+				seen[s.Name] = true
+			}
+		})
+	}
+
+	t.Run("plan without changes", func(t *testing.T) {
+		changes, err := p.Plan(ctx, spec, m)
+		if err != nil {
+			t.Fatalf("Plan() error = %v", err)
+		}
+		if len(changes) > 0 {
+			t.Errorf("Plan() with the creation spec = %v, want no changes", changes)
+		}
+	})
+
+	t.Run("plan with changes", func(t *testing.T) {
+		changed := *spec
+		c := *spec.Config
+		c.Image += "-changed"
+		changed.Config = &c
+		changes, err := p.Plan(ctx, &changed, m)
+		if err != nil {
+			t.Fatalf("Plan() error = %v", err)
+		}
+		if len(changes) == 0 {
+			t.Error("Plan() with another image returned no changes")
+		}
+	})
+
+	t.Run("stop and start", func(t *testing.T) {
+		if err := p.Stop(ctx, m.ID); err != nil {
+			t.Fatalf("Stop() error = %v", err)
+		}
+		assertStatus(ctx, t, p, m.ID, provider.StatusStopped)
+		if err := p.Start(ctx, m.ID); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		assertStatus(ctx, t, p, m.ID, provider.StatusRunning)
+	})
+
+	t.Run("destroy", func(t *testing.T) {
+		if err := p.Destroy(ctx, m); err != nil {
+			t.Fatalf("Destroy() error = %v", err)
+		}
+		if _, err := p.Get(ctx, m.ID); !errors.Is(err, provider.ErrNotFound) {
+			t.Errorf("Get() after Destroy() error = %v, want %v", err, provider.ErrNotFound)
+		}
+		if _, err := provider.Find(ctx, p, spec.Config.Name); !errors.Is(err, provider.ErrNotFound) {
+			t.Errorf("List() after Destroy() still includes the machine")
+		}
+	})
+
+	t.Run("destroy twice", func(t *testing.T) {
+		if err := p.Destroy(ctx, m); err != nil {
+			t.Errorf("second Destroy() error = %v, want nil", err)
+		}
+	})
+}
+
+func assertStatus(ctx context.Context, t *testing.T, p provider.Provider, id string, want provider.Status) {
+	t.Helper()
+	m, err := p.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if m.Status != want {
+		t.Errorf("Get() status = %q, want %q", m.Status, want)
+	}
+}
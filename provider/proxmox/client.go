@@ -0,0 +1,188 @@
+package proxmox
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+
+	"github.com/darkowlzz/clouddev/internal/rest"
+)
+
+// ticketLifetime is how long an authentication ticket is used, tickets
+// being valid for two hours.
+const ticketLifetime = time.Hour
+
+// client is a client of the Proxmox VE API, authenticating with an API
+// token or with a ticket issued for a username and password.
+type client struct {
+	rest     *rest.Client
+	tokenID  string
+	secret   string
+	username string
+	password string
+
+	mu      sync.Mutex
+	ticket  string
+	csrf    string
+	expires time.Time
+}
+
+func newClient(opts *options) (*client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if opts.CACert != "" {
+		path, err := homedir.Expand(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid CA certificate %s", opts.CACert)
+		}
+	}
+	c := &client{
+		tokenID:  opts.TokenID,
+		secret:   opts.TokenSecret,
+		username: opts.Username,
+		password: opts.Password,
+	}
+	c.rest = &rest.Client{
+		BaseURL:    strings.TrimSuffix(opts.URL, "/") + "/api2/json",
+		HTTPClient: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}},
+	}
+	return c, nil
+}
+
+// login returns a valid ticket and its CSRF prevention token, logging in
+// if needed.
+func (c *client) login(ctx context.Context) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ticket != "" && time.Now().Before(c.expires) {
+		return c.ticket, c.csrf, nil
+	}
+	if c.username == "" {
+		return "", "", errors.New("no Proxmox credentials, set provider_options.token_id and token_secret, or username and password")
+	}
+	var out struct {
+		Ticket string `json:"ticket"`
+		CSRF   string `json:"CSRFPreventionToken"`
+	}
+	req, err := newRequest(ctx, http.MethodPost, c.rest.BaseURL+"/access/ticket", url.Values{"username": {c.username}, "password": {c.password}})
+	if err != nil {
+		return "", "", err
+	}
+	if err := c.send(req, &out); err != nil {
+		return "", "", fmt.Errorf("failed to log in to Proxmox: %w", err)
+	}
+	c.ticket, c.csrf, c.expires = out.Ticket, out.CSRF, time.Now().Add(ticketLifetime)
+	return c.ticket, c.csrf, nil
+}
+
+// do sends a request with the parameters, in the query string of GET and
+// DELETE requests and form encoded otherwise, and decodes the data of the
+// response into out, unless nil.
+func (c *client) do(ctx context.Context, method, path string, params url.Values, out interface{}) error {
+	req, err := newRequest(ctx, method, c.rest.BaseURL+path, params)
+	if err != nil {
+		return err
+	}
+	if c.tokenID != "" {
+		req.Header.Set("Authorization", "PVEAPIToken="+c.tokenID+"="+c.secret)
+	} else {
+		ticket, csrf, err := c.login(ctx)
+		if err != nil {
+			return err
+		}
+		req.AddCookie(&http.Cookie{Name: "PVEAuthCookie", Value: ticket})
+		if method != http.MethodGet {
+			req.Header.Set("CSRFPreventionToken", csrf)
+		}
+	}
+	return c.send(req, out)
+}
+
+func newRequest(ctx context.Context, method, u string, params url.Values) (*http.Request, error) {
+	query := method == http.MethodGet || method == http.MethodDelete
+	body := ""
+	if query && len(params) > 0 {
+		u += "?" + params.Encode()
+	} else if !query {
+		body = params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if !query {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req, nil
+}
+
+// send sends the request and decodes the data of the response into out,
+// unless nil.
+func (c *client) send(req *http.Request, out interface{}) error {
+	var data struct {
+		Data json.RawMessage `json:"data"`
+	}
+	resp, err := c.rest.Send(req, &data)
+	var e *rest.Error
+	if errors.As(err, &e) && resp != nil {
+		// The API reports the parameter errors in the body, and the other
+		// errors in the status line.
+		if e.Message = errorMessage([]byte(e.Message)); e.Message == "" {
+			e.Message = strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if out != nil && len(data.Data) > 0 && string(data.Data) != "null" {
+		if err := json.Unmarshal(data.Data, out); err != nil {
+			return fmt.Errorf("%s %s: invalid response: %w", req.Method, req.URL.Path, err)
+		}
+	}
+	return nil
+}
+
+// errorMessage returns the parameter errors of the body of an error
+// response.
+func errorMessage(body []byte) string {
+	var e struct {
+		Errors map[string]string `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		return ""
+	}
+	var msgs []string
+	for k, v := range e.Errors {
+		msgs = append(msgs, k+": "+strings.TrimSpace(v))
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, ", ")
+}
+
+// isNotFound returns true if the error reports a missing VM. The API
+// reports them as internal errors.
+func isNotFound(err error) bool {
+	var e *rest.Error
+	return rest.IsNotFound(err) || errors.As(err, &e) && e.StatusCode == http.StatusInternalServerError && strings.Contains(e.Message, "does not exist")
+}
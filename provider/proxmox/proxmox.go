@@ -0,0 +1,757 @@
+// Package proxmox implements a provider that provisions environments on a
+// Proxmox VE cluster, by cloning template VMs.
+//
+// The clones are set up by the cloud-init fields of Proxmox, for the user,
+// the SSH key and the network, and their address is read from the QEMU
+// guest agent, which the template must run.
+package proxmox
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+)
+
+// Name is the name of the provider in the config.
+const Name = "proxmox"
+
+const (
+	// vmPrefix prefixes the names of the VMs created by clouddev.
+	vmPrefix = "clouddev-"
+	// metadataPrefix prefixes the clouddev lines of the VM descriptions.
+	metadataPrefix = "clouddev-"
+)
+
+func init() {
+	provider.Register(Name, func(c *config.Config) (provider.Provider, error) {
+		return New(c), nil
+	})
+}
+
+// options are the proxmox provider_options.
+type options struct {
+	// URL is the URL of the API of a node of the cluster, e.g.
+	// https://pve.example.com:8006, PROXMOX_URL if empty.
+	URL string `mapstructure:"url"`
+	// Node is the node the VMs run on.
+	Node string `mapstructure:"node"`
+	// TokenID and TokenSecret are an API token, e.g. clouddev@pve!dev,
+	// PROXMOX_TOKEN_ID and PROXMOX_TOKEN_SECRET if empty. Otherwise the
+	// username and the password are used.
+	TokenID     string `mapstructure:"token_id"`
+	TokenSecret string `mapstructure:"token_secret"`
+	// Username and Password, PROXMOX_USERNAME and PROXMOX_PASSWORD if
+	// empty, e.g. root@pam.
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Insecure skips the verification of the certificate of the API, self
+	// signed by default.
+	Insecure bool   `mapstructure:"insecure"`
+	CACert   string `mapstructure:"ca_cert"`
+	// Storage is the storage of the disks of full clones, the storage of
+	// the template if empty.
+	Storage string `mapstructure:"storage"`
+	// LinkedClone makes linked clones instead of full clones.
+	LinkedClone bool   `mapstructure:"linked_clone"`
+	Pool        string `mapstructure:"pool"`
+	// Bridge replaces the network device of the template with one on the
+	// bridge.
+	Bridge string `mapstructure:"bridge"`
+	// IPConfig is the cloud-init network configuration, e.g.
+	// ip=10.0.0.5/24,gw=10.0.0.1, DHCP if empty.
+	IPConfig   string `mapstructure:"ip_config"`
+	Nameserver string `mapstructure:"nameserver"`
+	// CICustom are custom cloud-init snippets, e.g.
+	// user=local:snippets/dev.yaml.
+	CICustom string `mapstructure:"cicustom"`
+	// Disk is the disk of the template to resize.
+	Disk     string `mapstructure:"disk"`
+	Cores    int    `mapstructure:"cores"`
+	MemoryMB int    `mapstructure:"memory_mb"`
+}
+
+// Provider provisions Proxmox VE VMs.
+type Provider struct {
+	cfg  *config.Config
+	opts options
+	// PollInterval is the interval between the checks of the tasks and of
+	// the guest agent.
+	PollInterval time.Duration
+
+	mu sync.Mutex
+	cl *client
+}
+
+var (
+	_ provider.Provider = &Provider{}
+	_ provider.Updater  = &Provider{}
+)
+
+// New returns a proxmox provider for the configuration.
+func New(c *config.Config) *Provider {
+	var opts options
+	// Invalid options are reported by Validate.
+	_ = c.DecodeOptions(&opts)
+	setDefaults(&opts)
+	return &Provider{cfg: c, opts: opts, PollInterval: 2 * time.Second}
+}
+
+func setDefaults(opts *options) {
+	for _, o := range []struct {
+		value *string
+		env   string
+	}{
+		{&opts.URL, "PROXMOX_URL"},
+		{&opts.TokenID, "PROXMOX_TOKEN_ID"},
+		{&opts.TokenSecret, "PROXMOX_TOKEN_SECRET"},
+		{&opts.Username, "PROXMOX_USERNAME"},
+		{&opts.Password, "PROXMOX_PASSWORD"},
+	} {
+		if *o.value == "" {
+			*o.value = os.Getenv(o.env)
+		}
+	}
+	if opts.IPConfig == "" {
+		opts.IPConfig = "ip=dhcp"
+	}
+	if opts.Disk == "" {
+		opts.Disk = "scsi0"
+	}
+	if opts.Cores == 0 {
+		opts.Cores = 2
+	}
+	if opts.MemoryMB == 0 {
+		opts.MemoryMB = 4096
+	}
+}
+
+// Validate implements provider.Provider.
+func (p *Provider) Validate(c *config.Config) []*config.FieldError {
+	var opts options
+	errs := c.DecodeOptions(&opts)
+	setDefaults(&opts)
+	if opts.URL == "" {
+		errs = append(errs, &config.FieldError{Path: "provider_options.url", Message: "is required, or PROXMOX_URL"})
+	}
+	if opts.Node == "" {
+		errs = append(errs, &config.FieldError{Path: "provider_options.node", Message: "is required"})
+	}
+	if opts.TokenID == "" && opts.Username == "" {
+		errs = append(errs, &config.FieldError{Path: "provider_options.token_id", Message: "is required, or username and password"})
+	}
+	if c.Image == "" {
+		errs = append(errs, &config.FieldError{Path: "image", Message: "is required, the name or the ID of a template VM"})
+	}
+	if opts.Cores < 0 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.cores", Message: "must not be negative"})
+	}
+	if opts.MemoryMB < 0 {
+		errs = append(errs, &config.FieldError{Path: "provider_options.memory_mb", Message: "must not be negative"})
+	}
+	return errs
+}
+
+// client returns the API client, reusing its ticket across calls.
+func (p *Provider) client() (*client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cl == nil {
+		cl, err := newClient(&p.opts)
+		if err != nil {
+			return nil, err
+		}
+		p.cl = cl
+	}
+	return p.cl, nil
+}
+
+// vmResource is a VM of the cluster resources.
+type vmResource struct {
+	VMID     int    `json:"vmid"`
+	Name     string `json:"name"`
+	Node     string `json:"node"`
+	Template int    `json:"template"`
+}
+
+func (r *vmResource) id() string {
+	return r.Node + "/" + strconv.Itoa(r.VMID)
+}
+
+// vms returns the VMs of the cluster.
+func (p *Provider) vms(ctx context.Context, cl *client) ([]vmResource, error) {
+	var vms []vmResource
+	if err := cl.do(ctx, http.MethodGet, "/cluster/resources", url.Values{"type": {"vm"}}, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// template returns the template VM with the name or the ID.
+func (p *Provider) template(ctx context.Context, cl *client, name string) (*vmResource, error) {
+	vms, err := p.vms(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		if vm.Template == 1 && (vm.Name == name || strconv.Itoa(vm.VMID) == name) {
+			return &vm, nil
+		}
+	}
+	return nil, fmt.Errorf("template VM %s not found", name)
+}
+
+// metadata is the clouddev metadata of a VM, in lines of its description.
+type metadata struct {
+	Env        string
+	Template   string
+	DiskSizeGB int
+	Created    time.Time
+}
+
+func (md *metadata) String() string {
+	return fmt.Sprintf("Managed by clouddev.\n%senv: %s\n%stemplate: %s\n%sdisk-size-gb: %d\n%screated: %s\n",
+		metadataPrefix, md.Env, metadataPrefix, md.Template, metadataPrefix, md.DiskSizeGB, metadataPrefix, md.Created.Format(time.RFC3339))
+}
+
+func parseMetadata(description string) *metadata {
+	md := &metadata{}
+	sc := bufio.NewScanner(strings.NewReader(description))
+	for sc.Scan() {
+		kv := strings.SplitN(strings.TrimPrefix(sc.Text(), metadataPrefix), ": ", 2)
+		if len(kv) != 2 || !strings.HasPrefix(sc.Text(), metadataPrefix) {
+			continue
+		}
+		switch kv[0] {
+		case "env":
+			md.Env = kv[1]
+		case "template":
+			md.Template = kv[1]
+		case "disk-size-gb":
+			md.DiskSizeGB, _ = strconv.Atoi(kv[1])
+		case "created":
+			md.Created, _ = time.Parse(time.RFC3339, kv[1])
+		}
+	}
+	return md
+}
+
+// vmConfig is the part of the configuration of a VM clouddev reads.
+type vmConfig map[string]interface{}
+
+func (c vmConfig) int(key string) int {
+	switch v := c[key].(type) {
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+func (c vmConfig) string(key string) string {
+	s, _ := c[key].(string)
+	return s
+}
+
+// diskSizeGB returns the size of the disk of the configuration in GiB,
+// from its size property, e.g. local-lvm:vm-100-disk-0,size=10G.
+func (c vmConfig) diskSizeGB(disk string) int {
+	for _, prop := range strings.Split(c.string(disk), ",") {
+		if !strings.HasPrefix(prop, "size=") {
+			continue
+		}
+		size := strings.TrimPrefix(prop, "size=")
+		if size == "" {
+			return 0
+		}
+		n, _ := strconv.ParseFloat(size[:len(size)-1], 64)
+		switch size[len(size)-1] {
+		case 'T':
+			return int(n * 1024)
+		case 'G':
+			return int(n)
+		case 'M':
+			return int(n / 1024)
+		case 'K':
+			return int(n / 1024 / 1024)
+		}
+	}
+	return 0
+}
+
+// parseID returns the node and the VMID of a machine ID, node/vmid.
+func parseID(id string) (node string, vmid int, ok bool) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, false
+	}
+	vmid, err := strconv.Atoi(parts[1])
+	return parts[0], vmid, err == nil
+}
+
+func vmPath(node string, vmid int) string {
+	return "/nodes/" + url.PathEscape(node) + "/qemu/" + strconv.Itoa(vmid)
+}
+
+// Create implements provider.Provider.
+func (p *Provider) Create(ctx context.Context, spec *provider.Spec) (*provider.Machine, error) {
+	c := spec.Config
+	cl, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := p.template(ctx, cl, c.Image)
+	if err != nil {
+		return nil, err
+	}
+	var next interface{}
+	if err := cl.do(ctx, http.MethodGet, "/cluster/nextid", nil, &next); err != nil {
+		return nil, err
+	}
+	vmid, err := strconv.Atoi(fmt.Sprint(next))
+	if err != nil {
+		return nil, fmt.Errorf("invalid next VM ID %v", next)
+	}
+
+	m := &provider.Machine{Name: c.Name, Resources: map[string]string{}, CreatedAt: time.Now().UTC()}
+	md := &metadata{Env: c.Name, Template: c.Image, DiskSizeGB: c.Disk.SizeGB, Created: m.CreatedAt}
+	params := url.Values{
+		"newid":       {strconv.Itoa(vmid)},
+		"name":        {vmPrefix + c.Name},
+		"target":      {p.opts.Node},
+		"description": {md.String()},
+		"full":        {"1"},
+	}
+	if p.opts.LinkedClone {
+		params.Set("full", "0")
+	} else if p.opts.Storage != "" {
+		params.Set("storage", p.opts.Storage)
+	}
+	if p.opts.Pool != "" {
+		params.Set("pool", p.opts.Pool)
+	}
+	var upid string
+	if err := cl.do(ctx, http.MethodPost, vmPath(tmpl.Node, tmpl.VMID)+"/clone", params, &upid); err != nil {
+		return nil, fmt.Errorf("failed to clone template %s: %w", c.Image, err)
+	}
+	m.ID = p.opts.Node + "/" + strconv.Itoa(vmid)
+	m.Resources[provider.ResourceInstance] = m.ID
+	if err := p.wait(ctx, cl, upid); err != nil {
+		return m, fmt.Errorf("failed to clone template %s: %w", c.Image, err)
+	}
+
+	path := vmPath(p.opts.Node, vmid)
+	params = url.Values{
+		"cores":     {strconv.Itoa(p.opts.Cores)},
+		"memory":    {strconv.Itoa(p.opts.MemoryMB)},
+		"agent":     {"1"},
+		"ciuser":    {c.SSH.User},
+		"sshkeys":   {encodeSSHKeys(spec.SSHPublicKey)},
+		"ipconfig0": {p.opts.IPConfig},
+	}
+	if p.opts.Nameserver != "" {
+		params.Set("nameserver", p.opts.Nameserver)
+	}
+	if p.opts.CICustom != "" {
+		params.Set("cicustom", p.opts.CICustom)
+	}
+	if p.opts.Bridge != "" {
+		params.Set("net0", "virtio,bridge="+p.opts.Bridge)
+	}
+	if err := cl.do(ctx, http.MethodPut, path+"/config", params, nil); err != nil {
+		return m, fmt.Errorf("failed to configure VM %s: %w", m.ID, err)
+	}
+	var cfg vmConfig
+	if err := cl.do(ctx, http.MethodGet, path+"/config", nil, &cfg); err != nil {
+		return m, err
+	}
+	if cfg.diskSizeGB(p.opts.Disk) < c.Disk.SizeGB {
+		if err := p.resize(ctx, cl, p.opts.Node, vmid, c.Disk.SizeGB); err != nil {
+			return m, err
+		}
+	}
+	if err := p.Start(ctx, m.ID); err != nil {
+		return m, fmt.Errorf("failed to start VM %s: %w", m.ID, err)
+	}
+
+	var got *provider.Machine
+	if err := provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		var err error
+		got, err = p.Get(ctx, m.ID)
+		return err == nil && got.Address != "", err
+	}); err != nil {
+		return m, fmt.Errorf("failed waiting for the address of VM %s from the guest agent: %w", m.ID, err)
+	}
+	got.Resources = m.Resources
+	return got, nil
+}
+
+// encodeSSHKeys encodes the keys as the API expects them, URL encoded.
+func encodeSSHKeys(keys string) string {
+	return strings.ReplaceAll(url.QueryEscape(keys), "+", "%20")
+}
+
+// resize grows the disk of the VM to the size.
+func (p *Provider) resize(ctx context.Context, cl *client, node string, vmid, sizeGB int) error {
+	var upid string
+	params := url.Values{"disk": {p.opts.Disk}, "size": {strconv.Itoa(sizeGB) + "G"}}
+	if err := cl.do(ctx, http.MethodPut, vmPath(node, vmid)+"/resize", params, &upid); err != nil {
+		return fmt.Errorf("failed to resize disk %s: %w", p.opts.Disk, err)
+	}
+	// Recent versions resize in a task.
+	if upid != "" {
+		return p.wait(ctx, cl, upid)
+	}
+	return nil
+}
+
+// wait waits for the task to end, and returns its error.
+func (p *Provider) wait(ctx context.Context, cl *client, upid string) error {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 2 {
+		return fmt.Errorf("invalid task ID %q", upid)
+	}
+	path := "/nodes/" + url.PathEscape(parts[1]) + "/tasks/" + url.PathEscape(upid) + "/status"
+	return provider.Poll(ctx, p.PollInterval, func(ctx context.Context) (bool, error) {
+		var task struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		if err := cl.do(ctx, http.MethodGet, path, nil, &task); err != nil {
+			return false, err
+		}
+		if task.Status != "stopped" {
+			return false, nil
+		}
+		if task.ExitStatus != "OK" {
+			return false, fmt.Errorf("task failed: %s", task.ExitStatus)
+		}
+		return true, nil
+	})
+}
+
+type vmStatus struct {
+	Status string `json:"status"`
+	Lock   string `json:"lock"`
+}
+
+// vm returns the configuration, the metadata and the status of the
+// clouddev VM with the ID.
+func (p *Provider) vm(ctx context.Context, cl *client, id string) (vmConfig, *metadata, *vmStatus, error) {
+	node, vmid, ok := parseID(id)
+	if !ok {
+		return nil, nil, nil, provider.ErrNotFound
+	}
+	var cfg vmConfig
+	err := cl.do(ctx, http.MethodGet, vmPath(node, vmid)+"/config", nil, &cfg)
+	if isNotFound(err) {
+		return nil, nil, nil, provider.ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	md := parseMetadata(cfg.string("description"))
+	if md.Env == "" {
+		return nil, nil, nil, provider.ErrNotFound
+	}
+	var st vmStatus
+	err = cl.do(ctx, http.MethodGet, vmPath(node, vmid)+"/status/current", nil, &st)
+	if isNotFound(err) {
+		return nil, nil, nil, provider.ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cfg, md, &st, nil
+}
+
+// Get implements provider.Provider.
+func (p *Provider) Get(ctx context.Context, id string) (*provider.Machine, error) {
+	cl, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	_, md, st, err := p.vm(ctx, cl, id)
+	if err != nil {
+		return nil, err
+	}
+	m := &provider.Machine{
+		ID:        id,
+		Name:      md.Env,
+		Status:    status(st),
+		Resources: map[string]string{provider.ResourceInstance: id},
+		CreatedAt: md.Created,
+	}
+	if m.Status == provider.StatusRunning {
+		node, vmid, _ := parseID(id)
+		// The agent doesn't answer until the guest booted.
+		m.Address, _ = p.agentAddress(ctx, cl, node, vmid)
+	}
+	return m, nil
+}
+
+func status(st *vmStatus) provider.Status {
+	if st.Lock != "" {
+		return provider.StatusPending
+	}
+	switch st.Status {
+	case "running":
+		return provider.StatusRunning
+	case "stopped":
+		return provider.StatusStopped
+	default:
+		return provider.StatusUnknown
+	}
+}
+
+// agentAddress returns the first global IPv4 address reported by the
+// guest agent of the VM.
+func (p *Provider) agentAddress(ctx context.Context, cl *client, node string, vmid int) (string, error) {
+	var out struct {
+		Result []struct {
+			Name        string `json:"name"`
+			IPAddresses []struct {
+				Type    string `json:"ip-address-type"`
+				Address string `json:"ip-address"`
+			} `json:"ip-addresses"`
+		} `json:"result"`
+	}
+	if err := cl.do(ctx, http.MethodGet, vmPath(node, vmid)+"/agent/network-get-interfaces", nil, &out); err != nil {
+		return "", err
+	}
+	for _, iface := range out.Result {
+		for _, a := range iface.IPAddresses {
+			ip := net.ParseIP(a.Address)
+			if a.Type == "ipv4" && ip != nil && ip.IsGlobalUnicast() {
+				return a.Address, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// Start implements provider.Provider.
+func (p *Provider) Start(ctx context.Context, id string) error {
+	return p.setStatus(ctx, id, "start", "running", nil)
+}
+
+// Stop implements provider.Provider. The guest is shut down gracefully,
+// and powered off if it doesn't shut down in a minute.
+func (p *Provider) Stop(ctx context.Context, id string) error {
+	return p.setStatus(ctx, id, "shutdown", "stopped", url.Values{"timeout": {"60"}, "forceStop": {"1"}})
+}
+
+// setStatus runs the status command, unless the VM already has the status
+// it results in, and waits for its task.
+func (p *Provider) setStatus(ctx context.Context, id, command, want string, params url.Values) error {
+	cl, err := p.client()
+	if err != nil {
+		return err
+	}
+	_, _, st, err := p.vm(ctx, cl, id)
+	if err != nil {
+		return err
+	}
+	if st.Status == want {
+		return nil
+	}
+	node, vmid, _ := parseID(id)
+	var upid string
+	if err := cl.do(ctx, http.MethodPost, vmPath(node, vmid)+"/status/"+command, params, &upid); err != nil {
+		return err
+	}
+	return p.wait(ctx, cl, upid)
+}
+
+// Destroy implements provider.Provider. The VMs of the environment are
+// also found by name, so that they're deleted even if they weren't
+// recorded.
+func (p *Provider) Destroy(ctx context.Context, m *provider.Machine) error {
+	cl, err := p.client()
+	if err != nil {
+		return err
+	}
+	ids := map[string]bool{}
+	if id := m.Resources[provider.ResourceInstance]; id != "" {
+		ids[id] = true
+	}
+	if m.Name != "" {
+		vms, err := p.vms(ctx, cl)
+		if err != nil {
+			return err
+		}
+		for _, vm := range vms {
+			if vm.Template != 1 && vm.Name == vmPrefix+m.Name {
+				ids[vm.id()] = true
+			}
+		}
+	}
+	for id := range ids {
+		_, md, st, err := p.vm(ctx, cl, id)
+		if errors.Is(err, provider.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if m.Name != "" && md.Env != m.Name {
+			continue
+		}
+		node, vmid, _ := parseID(id)
+		if st.Status != "stopped" {
+			var upid string
+			if err := cl.do(ctx, http.MethodPost, vmPath(node, vmid)+"/status/stop", nil, &upid); err != nil {
+				return fmt.Errorf("failed to stop VM %s: %w", id, err)
+			}
+			if err := p.wait(ctx, cl, upid); err != nil {
+				return fmt.Errorf("failed to stop VM %s: %w", id, err)
+			}
+		}
+		var upid string
+		params := url.Values{"purge": {"1"}, "destroy-unreferenced-disks": {"1"}}
+		err = cl.do(ctx, http.MethodDelete, vmPath(node, vmid), params, &upid)
+		if isNotFound(err) {
+			continue
+		}
+		if err == nil {
+			err = p.wait(ctx, cl, upid)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to destroy VM %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// List implements provider.Provider.
+func (p *Provider) List(ctx context.Context) ([]*provider.Machine, error) {
+	cl, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	vms, err := p.vms(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+	var machines []*provider.Machine
+	for _, vm := range vms {
+		if vm.Template == 1 || !strings.HasPrefix(vm.Name, vmPrefix) {
+			continue
+		}
+		m, err := p.Get(ctx, vm.id())
+		if errors.Is(err, provider.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// Plan implements provider.Provider. The cores, the memory and growing the
+// disk are updated in place.
+func (p *Provider) Plan(ctx context.Context, spec *provider.Spec, m *provider.Machine) ([]provider.Change, error) {
+	c := spec.Config
+	cl, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	cfg, md, _, err := p.vm(ctx, cl, m.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []provider.Change
+	if md.Template != c.Image {
+		changes = append(changes, provider.Change{Field: "image", Old: md.Template, New: c.Image, Replace: true})
+	}
+	if node, _, _ := parseID(m.ID); node != p.opts.Node {
+		changes = append(changes, provider.Change{Field: "provider_options.node", Old: node, New: p.opts.Node, Replace: true})
+	}
+	if cores := cfg.int("cores"); cores != p.opts.Cores {
+		changes = append(changes, provider.Change{Field: "provider_options.cores", Old: strconv.Itoa(cores), New: strconv.Itoa(p.opts.Cores)})
+	}
+	if memory := cfg.int("memory"); memory != p.opts.MemoryMB {
+		changes = append(changes, provider.Change{Field: "provider_options.memory_mb", Old: strconv.Itoa(memory), New: strconv.Itoa(p.opts.MemoryMB)})
+	}
+	if size := md.DiskSizeGB; size != c.Disk.SizeGB {
+		changes = append(changes, provider.Change{
+			Field:   "disk.size_gb",
+			Old:     strconv.Itoa(size),
+			New:     strconv.Itoa(c.Disk.SizeGB),
+			Replace: c.Disk.SizeGB < size,
+		})
+	}
+	return changes, nil
+}
+
+// Update implements provider.Updater. The VM is shut down to change its
+// cores and memory, and started again.
+func (p *Provider) Update(ctx context.Context, spec *provider.Spec, m *provider.Machine, changes []provider.Change) error {
+	c := spec.Config
+	cl, err := p.client()
+	if err != nil {
+		return err
+	}
+	cfg, md, _, err := p.vm(ctx, cl, m.ID)
+	if err != nil {
+		return err
+	}
+	node, vmid, _ := parseID(m.ID)
+	params := url.Values{}
+	grow := false
+	for _, ch := range changes {
+		switch ch.Field {
+		case "provider_options.cores":
+			params.Set("cores", strconv.Itoa(p.opts.Cores))
+		case "provider_options.memory_mb":
+			params.Set("memory", strconv.Itoa(p.opts.MemoryMB))
+		case "disk.size_gb":
+			grow = true
+		default:
+			return errors.New("can't update " + ch.Field + " in place")
+		}
+	}
+
+	restart := len(params) > 0 && m.Status == provider.StatusRunning
+	if restart {
+		if err := p.Stop(ctx, m.ID); err != nil {
+			return err
+		}
+	}
+	if len(params) > 0 {
+		if err := cl.do(ctx, http.MethodPut, vmPath(node, vmid)+"/config", params, nil); err != nil {
+			return fmt.Errorf("failed to configure VM %s: %w", m.ID, err)
+		}
+	}
+	if grow {
+		if cfg.diskSizeGB(p.opts.Disk) < c.Disk.SizeGB {
+			if err := p.resize(ctx, cl, node, vmid, c.Disk.SizeGB); err != nil {
+				return err
+			}
+		}
+		md.DiskSizeGB = c.Disk.SizeGB
+		if err := cl.do(ctx, http.MethodPut, vmPath(node, vmid)+"/config", url.Values{"description": {md.String()}}, nil); err != nil {
+			return err
+		}
+	}
+	if restart {
+		return p.Start(ctx, m.ID)
+	}
+	return nil
+}
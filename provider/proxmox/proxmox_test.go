@@ -0,0 +1,132 @@
+package proxmox_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/providertest"
+	"github.com/darkowlzz/clouddev/provider/proxmox"
+	"github.com/darkowlzz/clouddev/provider/proxmox/proxmoxtest"
+)
+
+// newTestProvider returns a provider of the spec against a fake API server,
+// authenticated with an API token.
+func newTestProvider(t *testing.T, s *proxmoxtest.Server, spec *provider.Spec, opts map[string]interface{}) *proxmox.Provider {
+	t.Helper()
+	spec.Config.ProviderOptions = map[string]interface{}{
+		"url":          s.URL,
+		"node":         proxmoxtest.Node,
+		"token_id":     proxmoxtest.TokenID,
+		"token_secret": proxmoxtest.TokenSecret,
+	}
+	for k, v := range opts {
+		spec.Config.ProviderOptions[k] = v
+	}
+	p := proxmox.New(spec.Config)
+	p.PollInterval = time.Millisecond
+	return p
+}
+
+func newServer(t *testing.T) *proxmoxtest.Server {
+	s := proxmoxtest.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(proxmox.Name)
+	providertest.Run(t, newTestProvider(t, s, spec, nil), spec)
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d VMs are left after the suite", n)
+	}
+}
+
+func TestConformanceWithTicket(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(proxmox.Name)
+	p := newTestProvider(t, s, spec, map[string]interface{}{
+		"token_id":     "",
+		"token_secret": "",
+		"username":     proxmoxtest.Username,
+		"password":     proxmoxtest.Password,
+	})
+	providertest.Run(t, p, spec)
+}
+
+func TestAddressFromGuestAgent(t *testing.T) {
+	s := newServer(t)
+	spec := providertest.Spec(proxmox.Name)
+	p := newTestProvider(t, s, spec, nil)
+	ctx := context.Background()
+
+	// The agent of the fake doesn't answer its first call after the VM
+	// started, and reports loopback and link-local addresses first.
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer p.Destroy(ctx, m)
+	if !strings.HasPrefix(m.Address, "192.0.2.") {
+		t.Errorf("Create() address = %q, want the global IPv4 address of the agent", m.Address)
+	}
+	got, err := p.Get(ctx, m.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Address != m.Address {
+		t.Errorf("Get() address = %q, want %q", got.Address, m.Address)
+	}
+
+	if err := p.Stop(ctx, m.ID); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	got, err = p.Get(ctx, m.ID)
+	if err != nil {
+		t.Fatalf("Get() of a stopped VM error = %v", err)
+	}
+	if got.Address != "" {
+		t.Errorf("Get() address of a stopped VM = %q, want none", got.Address)
+	}
+}
+
+func TestDestroyStopsRunningVM(t *testing.T) {
+	s := newServer(t)
+	var mu sync.Mutex
+	var calls []string
+	handler := s.Server.Config.Handler
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/qemu/") && (r.Method == http.MethodDelete || strings.Contains(r.URL.Path, "/status/stop")) {
+			mu.Lock()
+			calls = append(calls, r.Method+" "+r.URL.Path[strings.LastIndex(r.URL.Path, "/qemu/"):])
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	})
+	spec := providertest.Spec(proxmox.Name)
+	p := newTestProvider(t, s, spec, nil)
+	ctx := context.Background()
+
+	m, err := p.Create(ctx, spec)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	// The fake refuses to destroy running VMs, like Proxmox VE. The VM is
+	// found by name when it isn't recorded.
+	if err := p.Destroy(ctx, &provider.Machine{Name: m.Name}); err != nil {
+		t.Fatalf("Destroy() error = %v", err)
+	}
+	if n := s.Resources(); n != 0 {
+		t.Errorf("%d VMs are left after Destroy()", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 2 || !strings.HasPrefix(calls[0], "POST ") || !strings.HasPrefix(calls[1], "DELETE ") {
+		t.Errorf("Destroy() calls = %v, want to stop the VM, then delete it", calls)
+	}
+}
@@ -0,0 +1,402 @@
+// Package proxmoxtest implements an in-memory fake of the Proxmox VE API for
+// testing the proxmox provider.
+//
+// The fake implements the endpoints used by the provider. Tasks complete at
+// once, and the guest agent of a VM answers from its second call after
+// the VM started.
+package proxmoxtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials accepted by the fake.
+const (
+	TokenID     = "clouddev@pve!test"
+	TokenSecret = "proxmoxtest-secret"
+	Username    = "root@pam"
+	Password    = "proxmoxtest-password"
+)
+
+// Nodes of the cluster.
+const (
+	Node      = "pve1"
+	OtherNode = "pve2"
+)
+
+// Templates of the fake, by VMID. The templates have a 10G scsi0 disk.
+var Templates = map[int]string{9000: "conformance-image", 9001: "ubuntu-22.04"}
+
+const (
+	ticket = "PVE:root@pam:proxmoxtest"
+	csrf   = "proxmoxtest-csrf"
+)
+
+type vm struct {
+	node     string
+	template bool
+	status   string
+	lock     string
+	config   map[string]string
+	// agentCalls counts the calls to the guest agent since the VM
+	// started.
+	agentCalls int
+}
+
+// Server is a fake Proxmox VE API server.
+type Server struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	task  int
+	tasks map[string]bool
+	vms   map[int]*vm
+}
+
+// NewServer starts a fake API server. The caller must close it.
+func NewServer() *Server {
+	s := &Server{tasks: map[string]bool{}, vms: map[int]*vm{}}
+	for vmid, name := range Templates {
+		node := Node
+		if vmid%2 == 1 {
+			node = OtherNode
+		}
+		s.vms[vmid] = &vm{node: node, template: true, status: "stopped", config: map[string]string{
+			"name":     name,
+			"template": "1",
+			"cores":    "1",
+			"memory":   "2048",
+			"scsi0":    fmt.Sprintf("local-lvm:base-%d-disk-0,size=10G", vmid),
+			"net0":     "virtio=BC:24:11:00:00:01,bridge=vmbr0",
+			"ide2":     fmt.Sprintf("local-lvm:vm-%d-cloudinit,media=cdrom", vmid),
+		}}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Resources returns the number of VMs that aren't templates, to check for
+// leaks.
+func (s *Server) Resources() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, v := range s.vms {
+		if !v.template {
+			n++
+		}
+	}
+	return n
+}
+
+// Config returns the configuration of the VM, nil if it doesn't exist.
+func (s *Server) Config(vmid int) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vms[vmid]
+	if !ok {
+		return nil
+	}
+	cfg := map[string]string{}
+	for k, val := range v.config {
+		cfg[k] = val
+	}
+	return cfg
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api2/json")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if path == "/access/ticket" && r.Method == http.MethodPost {
+		if r.PostForm.Get("username") != Username || r.PostForm.Get("password") != Password {
+			writeError(w, http.StatusUnauthorized, "authentication failure", nil)
+			return
+		}
+		write(w, map[string]interface{}{"ticket": ticket, "CSRFPreventionToken": csrf, "username": Username})
+		return
+	}
+	if !authorized(r) {
+		writeError(w, http.StatusUnauthorized, "authentication failure", nil)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/cluster/resources" && r.Method == http.MethodGet:
+		s.resources(w)
+	case path == "/cluster/nextid" && r.Method == http.MethodGet:
+		write(w, strconv.Itoa(s.nextID()))
+	case len(parts) == 5 && parts[0] == "nodes" && parts[2] == "tasks" && parts[4] == "status" && r.Method == http.MethodGet:
+		if _, ok := s.tasks[parts[3]]; !ok {
+			writeError(w, http.StatusInternalServerError, "no such task", nil)
+			return
+		}
+		write(w, map[string]interface{}{"upid": parts[3], "status": "stopped", "exitstatus": "OK"})
+	case len(parts) >= 4 && parts[0] == "nodes" && parts[2] == "qemu":
+		vmid, _ := strconv.Atoi(parts[3])
+		v, ok := s.vms[vmid]
+		if !ok || v.node != parts[1] {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("Configuration file 'nodes/%s/qemu-server/%s.conf' does not exist", parts[1], parts[3]), nil)
+			return
+		}
+		s.vm(w, r, vmid, v, strings.Join(parts[4:], "/"))
+	default:
+		writeError(w, http.StatusNotImplemented, "Method '"+r.Method+" "+path+"' not implemented", nil)
+	}
+}
+
+func authorized(r *http.Request) bool {
+	if r.Header.Get("Authorization") == "PVEAPIToken="+TokenID+"="+TokenSecret {
+		return true
+	}
+	c, err := r.Cookie("PVEAuthCookie")
+	if err != nil || c.Value != ticket {
+		return false
+	}
+	return r.Method == http.MethodGet || r.Header.Get("CSRFPreventionToken") == csrf
+}
+
+func (s *Server) resources(w http.ResponseWriter) {
+	ids := make([]int, 0, len(s.vms))
+	for vmid := range s.vms {
+		ids = append(ids, vmid)
+	}
+	sort.Ints(ids)
+	list := []interface{}{}
+	for _, vmid := range ids {
+		v := s.vms[vmid]
+		template := 0
+		if v.template {
+			template = 1
+		}
+		list = append(list, map[string]interface{}{
+			"id":       fmt.Sprintf("qemu/%d", vmid),
+			"type":     "qemu",
+			"vmid":     vmid,
+			"name":     v.config["name"],
+			"node":     v.node,
+			"status":   v.status,
+			"template": template,
+		})
+	}
+	write(w, list)
+}
+
+func (s *Server) nextID() int {
+	id := 100
+	for s.vms[id] != nil {
+		id++
+	}
+	return id
+}
+
+func (s *Server) newTask(node, typ string, vmid int) string {
+	s.task++
+	upid := fmt.Sprintf("UPID:%s:%08X:%08X:%08X:%s:%d:%s:", node, s.task, s.task, time.Now().Unix(), typ, vmid, Username)
+	s.tasks[upid] = true
+	return upid
+}
+
+func (s *Server) vm(w http.ResponseWriter, r *http.Request, vmid int, v *vm, action string) {
+	form := r.Form
+	switch {
+	case action == "config" && r.Method == http.MethodGet:
+		cfg := map[string]interface{}{"digest": "0"}
+		for k, val := range v.config {
+			if n, err := strconv.Atoi(val); err == nil && (k == "cores" || k == "memory" || k == "agent") {
+				cfg[k] = n
+			} else {
+				cfg[k] = val
+			}
+		}
+		write(w, cfg)
+	case action == "config" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		if v.lock != "" {
+			writeError(w, http.StatusInternalServerError, "VM is locked ("+v.lock+")", nil)
+			return
+		}
+		if keys := form.Get("sshkeys"); keys != "" {
+			if _, err := url.QueryUnescape(keys); err != nil || strings.Contains(keys, " ") {
+				writeError(w, http.StatusBadRequest, "Parameter verification failed.", map[string]string{"sshkeys": "invalid urlencoded string"})
+				return
+			}
+		}
+		for k := range form {
+			v.config[k] = form.Get(k)
+		}
+		if r.Method == http.MethodPost {
+			write(w, s.newTask(v.node, "qmconfig", vmid))
+			return
+		}
+		write(w, nil)
+	case action == "clone" && r.Method == http.MethodPost:
+		s.clone(w, vmid, v, form)
+	case action == "resize" && r.Method == http.MethodPut:
+		disk := form.Get("disk")
+		current, ok := v.config[disk]
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "disk '"+disk+"' does not exist", nil)
+			return
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(form.Get("size"), "+"), "G"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Parameter verification failed.", map[string]string{"size": "invalid size"})
+			return
+		}
+		old := diskSize(current)
+		if strings.HasPrefix(form.Get("size"), "+") {
+			size += old
+		}
+		if size < old {
+			writeError(w, http.StatusInternalServerError, "shrinking disks is not supported", nil)
+			return
+		}
+		v.config[disk] = strings.Replace(current, fmt.Sprintf("size=%dG", old), fmt.Sprintf("size=%dG", size), 1)
+		write(w, s.newTask(v.node, "resize", vmid))
+	case action == "status/current" && r.Method == http.MethodGet:
+		st := map[string]interface{}{"vmid": vmid, "name": v.config["name"], "status": v.status, "agent": v.config["agent"] == "1"}
+		if v.lock != "" {
+			st["lock"] = v.lock
+		}
+		write(w, st)
+	case strings.HasPrefix(action, "status/") && r.Method == http.MethodPost:
+		switch command := strings.TrimPrefix(action, "status/"); {
+		case v.template:
+			writeError(w, http.StatusInternalServerError, "you can't start a vm if it's a template", nil)
+		case command == "start" && v.status == "running":
+			writeError(w, http.StatusInternalServerError, "VM already running", nil)
+		case command == "start":
+			v.status = "running"
+			v.agentCalls = 0
+			write(w, s.newTask(v.node, "qmstart", vmid))
+		case command == "stop" || command == "shutdown":
+			v.status = "stopped"
+			write(w, s.newTask(v.node, "qm"+command, vmid))
+		default:
+			writeError(w, http.StatusNotImplemented, "Method 'POST "+action+"' not implemented", nil)
+		}
+	case action == "" && r.Method == http.MethodDelete:
+		if v.status == "running" {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d is running - destroy failed", vmid), nil)
+			return
+		}
+		delete(s.vms, vmid)
+		write(w, s.newTask(v.node, "qmdestroy", vmid))
+	case action == "agent/network-get-interfaces" && r.Method == http.MethodGet:
+		switch {
+		case v.status != "running":
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("VM %d is not running", vmid), nil)
+		case v.config["agent"] != "1" && !strings.HasPrefix(v.config["agent"], "1,") && !strings.HasPrefix(v.config["agent"], "enabled=1"):
+			writeError(w, http.StatusInternalServerError, "No QEMU guest agent configured", nil)
+		default:
+			v.agentCalls++
+			if v.agentCalls == 1 {
+				writeError(w, http.StatusInternalServerError, "QEMU guest agent is not running", nil)
+				return
+			}
+			write(w, map[string]interface{}{"result": []interface{}{
+				map[string]interface{}{"name": "lo", "ip-addresses": []interface{}{
+					map[string]interface{}{"ip-address-type": "ipv4", "ip-address": "127.0.0.1", "prefix": 8},
+					map[string]interface{}{"ip-address-type": "ipv6", "ip-address": "::1", "prefix": 128},
+				}},
+				map[string]interface{}{"name": "eth0", "ip-addresses": []interface{}{
+					map[string]interface{}{"ip-address-type": "ipv6", "ip-address": "fe80::be24:11ff:fe00:1", "prefix": 64},
+					map[string]interface{}{"ip-address-type": "ipv4", "ip-address": fmt.Sprintf("192.0.2.%d", vmid%200+10), "prefix": 24},
+				}},
+			}})
+		}
+	default:
+		writeError(w, http.StatusNotImplemented, "Method '"+r.Method+" "+action+"' not implemented", nil)
+	}
+}
+
+func (s *Server) clone(w http.ResponseWriter, vmid int, v *vm, form url.Values) {
+	newid, err := strconv.Atoi(form.Get("newid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Parameter verification failed.", map[string]string{"newid": "invalid VM ID"})
+		return
+	}
+	if s.vms[newid] != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to create VM %d: config file already exists", newid), nil)
+		return
+	}
+	target := form.Get("target")
+	if target == "" {
+		target = v.node
+	}
+	if target != Node && target != OtherNode {
+		writeError(w, http.StatusInternalServerError, "no such cluster node '"+target+"'", nil)
+		return
+	}
+	if form.Get("full") == "0" && !v.template {
+		writeError(w, http.StatusInternalServerError, "linked clone feature is not supported for a VM that isn't a template", nil)
+		return
+	}
+	cfg := map[string]string{}
+	for k, val := range v.config {
+		cfg[k] = strings.ReplaceAll(val, fmt.Sprintf("base-%d-", vmid), fmt.Sprintf("vm-%d-", newid))
+	}
+	delete(cfg, "template")
+	cfg["name"] = form.Get("name")
+	if d := form.Get("description"); d != "" {
+		cfg["description"] = d
+	}
+	s.vms[newid] = &vm{node: target, status: "stopped", config: cfg}
+	write(w, s.newTask(v.node, "qmclone", vmid))
+}
+
+// diskSize returns the size in GiB of a disk property value.
+func diskSize(disk string) int {
+	for _, prop := range strings.Split(disk, ",") {
+		if strings.HasPrefix(prop, "size=") {
+			n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(prop, "size="), "G"))
+			return n
+		}
+	}
+	return 0
+}
+
+func write(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+// writeError writes an error the way the API does, with the message in
+// the status line.
+func writeError(w http.ResponseWriter, code int, message string, errors map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	body := map[string]interface{}{"data": nil}
+	if errors != nil {
+		body["errors"] = errors
+	}
+	// http.ResponseWriter doesn't set custom reason phrases, so the fake
+	// hijacks the connection to write the status line.
+	if hj, ok := w.(http.Hijacker); ok {
+		conn, buf, err := hj.Hijack()
+		if err == nil {
+			data, _ := json.Marshal(body)
+			fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", code, message, len(data), data)
+			_ = buf.Flush()
+			_ = conn.Close()
+			return
+		}
+	}
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
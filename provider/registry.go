@@ -0,0 +1,73 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+// Factory creates a provider for the given configuration. Factories must not
+// contact the provider, and must not fail on invalid configurations, which
+// are reported by the provider's Validate.
+type Factory func(c *config.Config) (Provider, error)
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Factory{}
+)
+
+// Register makes a provider available by the given name. It panics if the
+// name is already registered.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("provider %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Names returns the sorted names of the registered providers.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the provider named by the provider config key.
+func New(c *config.Config) (Provider, error) {
+	mu.RLock()
+	factory, ok := registry[c.Provider]
+	mu.RUnlock()
+	if !ok {
+		names := Names()
+		if len(names) == 0 {
+			return nil, fmt.Errorf("unknown provider %q, no providers are available", c.Provider)
+		}
+		return nil, fmt.Errorf("unknown provider %q, available providers: %s", c.Provider, strings.Join(names, ", "))
+	}
+	return factory(c)
+}
+
+// Validate checks that the configured provider is registered and validates
+// the configuration with it.
+func Validate(c *config.Config) []*config.FieldError {
+	if c.Provider == "" {
+		// Reported by the config validation.
+		return nil
+	}
+	p, err := New(c)
+	if err != nil {
+		return []*config.FieldError{{Path: "provider", Message: err.Error()}}
+	}
+	defer Close(p)
+	return p.Validate(c)
+}
@@ -0,0 +1,62 @@
+package provider_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/provider"
+	"github.com/darkowlzz/clouddev/provider/fake"
+)
+
+func TestRegisterTwicePanics(t *testing.T) {
+	fake.Register("registry-test-twice")
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("second Register() didn't panic")
+		}
+		if msg, _ := r.(string); !strings.Contains(msg, `"registry-test-twice" registered twice`) {
+			t.Errorf("second Register() panic = %v, want the provider name", r)
+		}
+	}()
+	fake.Register("registry-test-twice")
+}
+
+func TestNewUnknownProvider(t *testing.T) {
+	fake.Register("registry-test-a")
+	fake.Register("registry-test-b")
+
+	c := config.Default()
+	c.Provider = "registry-test-unknown"
+	_, err := provider.New(c)
+	if err == nil {
+		t.Fatal("New() with an unknown provider returned no error")
+	}
+	for _, want := range []string{`unknown provider "registry-test-unknown"`, "registry-test-a, registry-test-b"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("New() error = %q, want it to contain %q", err, want)
+		}
+	}
+
+	errs := provider.Validate(c)
+	if len(errs) != 1 || errs[0].Path != "provider" {
+		t.Errorf("Validate() = %v, want one error on provider", errs)
+	}
+}
+
+func TestNewRegisteredProvider(t *testing.T) {
+	want := fake.Register("registry-test-known")
+	c := config.Default()
+	c.Provider = "registry-test-known"
+	p, err := provider.New(c)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if p != want {
+		t.Errorf("New() = %p, want the registered provider %p", p, want)
+	}
+	if errs := provider.Validate(c); len(errs) > 0 {
+		t.Errorf("Validate() = %v, want no errors", errs)
+	}
+}
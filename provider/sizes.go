@@ -0,0 +1,36 @@
+package provider
+
+import "fmt"
+
+// MachineSize is the size of a machine type.
+type MachineSize struct {
+	Name     string
+	CPUs     int
+	MemoryMB int
+}
+
+// Sizer is implemented by the providers that know the sizes of their
+// machine types, to pick one for requirements, e.g. the hostRequirements of
+// a devcontainer.
+type Sizer interface {
+	// MachineSizes returns the sizes of the general purpose machine types,
+	// cheapest first.
+	MachineSizes() []MachineSize
+}
+
+// MachineTypeFor returns the configured machine type if it has at least the
+// CPUs and memory, or the cheapest one that has.
+func MachineTypeFor(s Sizer, configured string, cpus, memoryMB int) (string, error) {
+	sizes := s.MachineSizes()
+	for _, size := range sizes {
+		if size.Name == configured && size.CPUs >= cpus && size.MemoryMB >= memoryMB {
+			return configured, nil
+		}
+	}
+	for _, size := range sizes {
+		if size.CPUs >= cpus && size.MemoryMB >= memoryMB {
+			return size.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no machine type has %d CPUs and %d MiB of memory", cpus, memoryMB)
+}
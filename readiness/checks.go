@@ -0,0 +1,143 @@
+package readiness
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// DefaultCheckTimeout is the time allowed for a check to pass if it has no
+// timeout.
+const DefaultCheckTimeout = 2 * time.Minute
+
+// attemptTimeout is the time allowed for a tcp or http check attempt.
+const attemptTimeout = 10 * time.Second
+
+// Name returns the name of a check in the output.
+func Name(c config.Check) string {
+	switch {
+	case c.Name != "":
+		return c.Name
+	case c.Command != "":
+		return c.Command
+	case c.TCP != 0:
+		return "tcp " + strconv.Itoa(c.TCP)
+	default:
+		return c.HTTP
+	}
+}
+
+// check retries the check with backoff until it passes or times out.
+func (g *Gate) check(ctx context.Context, c *remote.Client, check config.Check) error {
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = DefaultCheckTimeout
+	}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	fmt.Fprintf(g.Log, "Checking %s...\n", Name(check))
+	var b backoff
+	for {
+		err := g.attempt(cctx, c, check)
+		if err == nil {
+			return nil
+		}
+		if werr := b.wait(cctx); werr != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("check %s didn't pass within %s: %w", Name(check), timeout, err)
+		}
+	}
+}
+
+// attempt runs the check once.
+func (g *Gate) attempt(ctx context.Context, c *remote.Client, check config.Check) error {
+	switch {
+	case check.Command != "":
+		return runCommand(ctx, c, check.Command, check.ExitCode)
+	case check.TCP != 0:
+		d := net.Dialer{Timeout: attemptTimeout}
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(g.Host, strconv.Itoa(check.TCP)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		return g.get(ctx, check.HTTP, check.Status)
+	}
+}
+
+// runCommand runs the command on the machine and checks its exit code.
+func runCommand(ctx context.Context, c *remote.Client, cmd string, want int) error {
+	var out bytes.Buffer
+	err := c.Run(ctx, cmd, nil, &out, &out)
+	code := 0
+	var exit *ssh.ExitError
+	if errors.As(err, &exit) {
+		code = exit.ExitStatus()
+	} else if err != nil {
+		return err
+	}
+	if code != want {
+		msg := fmt.Sprintf("exited with %d, expected %d", code, want)
+		if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); lines[len(lines)-1] != "" {
+			msg += ": " + lines[len(lines)-1]
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// get requests the URL, on the machine if it has no host, and checks the
+// response status.
+func (g *Gate) get(ctx context.Context, rawURL string, status int) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Hostname() == "" {
+		if port := u.Port(); port != "" {
+			u.Host = net.JoinHostPort(g.Host, port)
+		} else if strings.Contains(g.Host, ":") {
+			u.Host = "[" + g.Host + "]"
+		} else {
+			u.Host = g.Host
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, attemptTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	// Redirects are responses of the endpoint, not to follow.
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case status != 0 && resp.StatusCode != status:
+		return fmt.Errorf("GET %s: %s, expected %d", u, resp.Status, status)
+	case status == 0 && resp.StatusCode >= 400:
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return nil
+}
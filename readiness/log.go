@@ -0,0 +1,59 @@
+package readiness
+
+import (
+	"bytes"
+	"strings"
+)
+
+// lineWriter calls line with each line written to it, without the line
+// ending.
+type lineWriter struct {
+	line func(string)
+	buf  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush calls line with the last line if it has no line ending.
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.line(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// logTail keeps the last lines of a log.
+type logTail struct {
+	max  int
+	tail []string
+}
+
+func newLogTail(max int) *logTail {
+	return &logTail{max: max}
+}
+
+func (t *logTail) add(line string) {
+	t.tail = append(t.tail, line)
+	if len(t.tail) > t.max {
+		t.tail = t.tail[len(t.tail)-t.max:]
+	}
+}
+
+// lines returns the last lines, none for a nil tail.
+func (t *logTail) lines() []string {
+	if t == nil {
+		return nil
+	}
+	return t.tail
+}
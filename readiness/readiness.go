@@ -0,0 +1,244 @@
+// Package readiness waits for a newly provisioned machine to be ready: for
+// its SSH server to accept connections, for its bootstrap to finish and for
+// its health checks to pass.
+package readiness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// LogPath is the path of the cloud-init output log on the machine.
+const LogPath = "/var/log/cloud-init-output.log"
+
+// tailLines is the number of lines of the log kept for the error of a
+// failed bootstrap.
+const tailLines = 40
+
+// Gate waits for a machine to be ready.
+type Gate struct {
+	// Dial connects to the machine over SSH. Errors marked with Permanent
+	// aren't retried.
+	Dial func(ctx context.Context) (*remote.Client, error)
+	// Host is the address of the machine the tcp and http checks connect
+	// to.
+	Host   string
+	Config *config.Readiness
+	// Log is where the progress and the output of cloud-init are written.
+	Log io.Writer
+}
+
+// Wait waits until the machine accepts SSH connections, its bootstrap is
+// done and its health checks pass. SSH and the bootstrap have the configured
+// timeout, the checks their own. The error of a failed or timed out
+// bootstrap includes the last lines of the cloud-init output log.
+func (g *Gate) Wait(ctx context.Context) error {
+	r := g.Config
+	wctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	c, err := g.waitSSH(wctx)
+	if err != nil {
+		return g.timedOut(ctx, err, "SSH")
+	}
+	defer c.Close()
+
+	var log *logTail
+	switch r.Wait {
+	case "cloud-init":
+		log, err = g.waitCloudInit(wctx, c)
+		err = g.timedOut(ctx, err, "cloud-init")
+	case "sentinel":
+		log, err = g.waitSentinel(wctx, c)
+		err = g.timedOut(ctx, err, r.Sentinel)
+	}
+	if err != nil {
+		return g.failed(ctx, c, err, log)
+	}
+
+	for _, check := range r.Checks {
+		if err := g.check(ctx, c, check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timedOut returns the error of a wait for what, saying so if it's the
+// timeout of the gate that ended it rather than ctx.
+func (g *Gate) timedOut(ctx context.Context, err error, what string) error {
+	if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s waiting for %s", g.Config.Timeout, what)
+	}
+	return err
+}
+
+// permanentError is a dial error waiting won't fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a dial error as permanent, e.g. a changed host key, so
+// that the gate fails without retrying.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// waitSSH connects to the machine, retrying until its SSH server is up and
+// the SSH user is created.
+func (g *Gate) waitSSH(ctx context.Context) (*remote.Client, error) {
+	fmt.Fprintln(g.Log, "Waiting for SSH...")
+	var b backoff
+	for {
+		c, err := g.Dial(ctx)
+		if err == nil {
+			return c, nil
+		}
+		var perr *permanentError
+		if errors.As(err, &perr) {
+			return nil, perr.err
+		}
+		if werr := b.wait(ctx); werr != nil {
+			if errors.Is(werr, context.DeadlineExceeded) {
+				return nil, fmt.Errorf("%w, last error: %v", werr, err)
+			}
+			return nil, werr
+		}
+	}
+}
+
+// waitScript runs the wait command, streaming the cloud-init output log
+// meanwhile if the pending command says the bootstrap isn't done yet, and
+// exits with the exit status of the wait command. The log isn't readable by
+// the SSH user on all images, it's read as root when sudo allows it.
+const waitScript = `if %[2]s; then
+  sudo=
+  if sudo -n true 2>/dev/null; then sudo="sudo -n"; fi
+  $sudo tail -n +1 -F %[1]s 2>/dev/null &
+  tail=$!
+fi
+%[3]s
+status=$?
+if [ -n "$tail" ]; then
+  sleep 1
+  kill $tail 2>/dev/null
+fi
+exit $status
+`
+
+// waitCloudInit waits for cloud-init to finish, which it reports with
+// status 1 if it failed and 2 if it recovered from errors.
+func (g *Gate) waitCloudInit(ctx context.Context, c *remote.Client) (*logTail, error) {
+	fmt.Fprintln(g.Log, "Waiting for cloud-init...")
+	code, log, err := g.runWait(ctx, c,
+		`cloud-init status 2>/dev/null | grep -qE 'running|not (started|run)'`,
+		`command -v cloud-init >/dev/null 2>&1 || exit 127
+cloud-init status --wait >/dev/null 2>&1`)
+	if err != nil {
+		return log, err
+	}
+	switch code {
+	case 0:
+	case 2:
+		fmt.Fprintf(g.Log, "Warning: cloud-init recovered from errors, see %s on the machine\n", LogPath)
+	case 127:
+		fmt.Fprintln(g.Log, "Warning: cloud-init isn't installed on the machine, not waiting for it")
+	default:
+		return log, fmt.Errorf("cloud-init failed with status %d", code)
+	}
+	return log, nil
+}
+
+// waitSentinel waits for the sentinel file to exist.
+func (g *Gate) waitSentinel(ctx context.Context, c *remote.Client) (*logTail, error) {
+	path := remote.Quote(g.Config.Sentinel)
+	fmt.Fprintf(g.Log, "Waiting for %s...\n", g.Config.Sentinel)
+	code, log, err := g.runWait(ctx, c,
+		fmt.Sprintf(`[ ! -e %s ]`, path),
+		fmt.Sprintf(`while [ ! -e %s ]; do sleep 2; done`, path))
+	if err == nil && code != 0 {
+		err = fmt.Errorf("waiting for %s failed with status %d", g.Config.Sentinel, code)
+	}
+	return log, err
+}
+
+// runWait runs the waitScript with the pending and wait commands, streaming
+// the log to the gate's log. It returns the exit status of the wait command
+// and the last lines of the log.
+func (g *Gate) runWait(ctx context.Context, c *remote.Client, pending, wait string) (int, *logTail, error) {
+	log := newLogTail(tailLines)
+	out := &lineWriter{line: func(line string) {
+		fmt.Fprintf(g.Log, "  | %s\n", line)
+		log.add(line)
+	}}
+	err := c.Run(ctx, fmt.Sprintf(waitScript, LogPath, pending, wait), nil, out, ioutil.Discard)
+	out.Flush()
+	var exit *ssh.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitStatus(), log, nil
+	}
+	return 0, log, err
+}
+
+// failed returns the error of a failed bootstrap with the last lines of the
+// log, read from the machine if none were streamed.
+func (g *Gate) failed(ctx context.Context, c *remote.Client, err error, log *logTail) error {
+	lines := log.lines()
+	if len(lines) == 0 && ctx.Err() == nil {
+		rctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		out, rerr := c.Output(rctx, fmt.Sprintf(`sudo -n tail -n %[1]d %[2]s 2>/dev/null || tail -n %[1]d %[2]s`, tailLines, LogPath))
+		if rerr == nil && len(out) > 0 {
+			lines = strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+		}
+	}
+	if len(lines) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w, the last lines of %s:\n%s", err, LogPath, strings.Join(lines, "\n"))
+}
+
+// Backoff delays between the attempts.
+const (
+	minDelay = time.Second
+	maxDelay = 15 * time.Second
+)
+
+// backoff waits between attempts, doubling the delay each time.
+type backoff struct {
+	delay time.Duration
+}
+
+// wait waits for the next attempt, or for the context to be done.
+func (b *backoff) wait(ctx context.Context) error {
+	switch {
+	case b.delay == 0:
+		b.delay = minDelay
+	case b.delay < maxDelay:
+		b.delay *= 2
+		if b.delay > maxDelay {
+			b.delay = maxDelay
+		}
+	}
+	t := time.NewTimer(b.delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,181 @@
+package readiness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/config"
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+func TestBackoffIsCapped(t *testing.T) {
+	// The waits return at once with a done context, the delays still grow.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var b backoff
+	var delays []time.Duration
+	for i := 0; i < 7; i++ {
+		if err := b.wait(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("wait() error = %v, want %v", err, context.Canceled)
+		}
+		delays = append(delays, b.delay)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 15 * time.Second, 15 * time.Second, 15 * time.Second}
+	if fmt.Sprint(delays) != fmt.Sprint(want) {
+		t.Errorf("backoff delays = %v, want %v", delays, want)
+	}
+}
+
+func TestFailedHasTheLogTail(t *testing.T) {
+	log := newLogTail(tailLines)
+	w := &lineWriter{line: log.add}
+	for i := 1; i < 100; i++ {
+		fmt.Fprintf(w, "line %d\r\n", i)
+	}
+	// The last line has no line ending.
+	fmt.Fprint(w, "line ")
+	fmt.Fprint(w, "100")
+	w.Flush()
+
+	var want []string
+	for i := 100 - tailLines + 1; i <= 100; i++ {
+		want = append(want, "line "+strconv.Itoa(i))
+	}
+	failure := errors.New("cloud-init failed with status 1")
+	g := &Gate{Log: ioutil.Discard}
+	err := g.failed(context.Background(), nil, failure, log)
+	if !errors.Is(err, failure) {
+		t.Errorf("failed() error = %v, want it to wrap %v", err, failure)
+	}
+	wantMsg := "cloud-init failed with status 1, the last lines of " + LogPath + ":\n" + strings.Join(want, "\n")
+	if err == nil || err.Error() != wantMsg {
+		t.Errorf("failed() error =\n%v\nwant\n%s", err, wantMsg)
+	}
+
+	// The log isn't read from the machine once the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := g.failed(ctx, nil, failure, nil); err != failure {
+		t.Errorf("failed() without a log error = %v, want %v", err, failure)
+	}
+}
+
+// closedPort returns a local port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func TestCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.WriteHeader(http.StatusOK)
+		case "/login":
+			http.Redirect(w, r, "/sso", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	closed := closedPort(t)
+
+	tests := []struct {
+		name  string
+		check config.Check
+		err   string
+	}{
+		{name: "tcp", check: config.Check{TCP: port}},
+		{name: "http on the machine", check: config.Check{HTTP: fmt.Sprintf("http://:%d/healthz", port)}},
+		{name: "http status", check: config.Check{HTTP: srv.URL + "/login", Status: http.StatusFound}},
+		{
+			name:  "tcp timeout",
+			check: config.Check{TCP: closed, Timeout: 100 * time.Millisecond},
+			err:   fmt.Sprintf("check tcp %d didn't pass within 100ms: ", closed),
+		},
+		{
+			name:  "http timeout",
+			check: config.Check{Name: "api", HTTP: fmt.Sprintf("http://:%d/api", port), Timeout: 100 * time.Millisecond},
+			err:   fmt.Sprintf("check api didn't pass within 100ms: GET http://127.0.0.1:%d/api: 503 Service Unavailable", port),
+		},
+		{
+			name:  "http unexpected status",
+			check: config.Check{HTTP: srv.URL + "/healthz", Status: http.StatusNoContent, Timeout: 100 * time.Millisecond},
+			err:   "200 OK, expected 204",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Gate{Host: "127.0.0.1", Log: ioutil.Discard}
+			start := time.Now()
+			err := g.check(context.Background(), nil, tt.check)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("check() error = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("check() error = %v, want %q", err, tt.err)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("check() took %s, past its timeout", d)
+			}
+		})
+	}
+
+	// The check stops with the context of the gate.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g := &Gate{Host: "127.0.0.1", Log: ioutil.Discard}
+	if err := g.check(ctx, nil, config.Check{TCP: closed}); !errors.Is(err, context.Canceled) {
+		t.Errorf("check() with a done context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWaitSSH(t *testing.T) {
+	dialErr := errors.New("connection refused")
+	tests := []struct {
+		name string
+		dial func(ctx context.Context) (*remote.Client, error)
+		err  string
+	}{
+		{
+			name: "timeout",
+			dial: func(ctx context.Context) (*remote.Client, error) { return nil, dialErr },
+			err:  "timed out after 100ms waiting for SSH",
+		},
+		{
+			name: "permanent",
+			dial: func(ctx context.Context) (*remote.Client, error) {
+				return nil, Permanent(errors.New("the host key of 192.0.2.1 changed"))
+			},
+			err: "the host key of 192.0.2.1 changed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Gate{
+				Dial:   tt.dial,
+				Config: &config.Readiness{Timeout: 100 * time.Millisecond, Wait: "none"},
+				Log:    ioutil.Discard,
+			}
+			if err := g.Wait(context.Background()); err == nil || err.Error() != tt.err {
+				t.Errorf("Wait() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultKnownHosts returns the path of the known_hosts file of the machines
+// provisioned by clouddev, $HOME/.clouddev/known_hosts. It's kept apart from
+// ~/.ssh/known_hosts because the addresses of throwaway machines get
+// reused.
+func DefaultKnownHosts() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".clouddev", "known_hosts"), nil
+}
+
+// knownHostsMu serializes the updates of the known_hosts files.
+var knownHostsMu sync.Mutex
+
+// KnownHosts returns a host key callback that checks the host keys against
+// the known_hosts file at the given path, and trusts and records the key of
+// hosts that aren't in the file yet.
+func KnownHosts(path string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return appendKnownHost(path, hostname, key)
+		}
+		check, err := knownhosts.New(path)
+		if err != nil {
+			return err
+		}
+		err = check(hostname, remote, key)
+		var kerr *knownhosts.KeyError
+		if errors.As(err, &kerr) {
+			if len(kerr.Want) == 0 {
+				return appendKnownHost(path, hostname, key)
+			}
+			return fmt.Errorf("the host key of %s changed, it's not the machine clouddev provisioned: remove it from %s if it was recreated", hostname, path)
+		}
+		return err
+	}
+}
+
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Known returns true if the known_hosts file at the given path has a key of
+// the host:port address.
+func Known(path, addr string) (bool, error) {
+	lines, err := readKnownHosts(path)
+	if err != nil {
+		return false, err
+	}
+	host := knownhosts.Normalize(addr)
+	for _, l := range lines {
+		if knownHost(l) == host {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Pin replaces the keys of the host:port address in the known_hosts file at
+// the given path with the given keys.
+func Pin(path, addr string, keys []ssh.PublicKey) error {
+	var add []string
+	for _, k := range keys {
+		add = append(add, knownhosts.Line([]string{knownhosts.Normalize(addr)}, k))
+	}
+	return replaceKnownHost(path, addr, add)
+}
+
+// Forget removes the keys of the host:port address from the known_hosts file
+// at the given path, e.g. once the machine is destroyed and its address may
+// be reused.
+func Forget(path, addr string) error {
+	return replaceKnownHost(path, addr, nil)
+}
+
+func replaceKnownHost(path, addr string, add []string) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	lines, err := readKnownHosts(path)
+	if err != nil {
+		return err
+	}
+	host := knownhosts.Normalize(addr)
+	var kept []string
+	for _, l := range lines {
+		if knownHost(l) != host {
+			kept = append(kept, l)
+		}
+	}
+	if len(kept) == len(lines) && len(add) == 0 {
+		return nil
+	}
+	kept = append(kept, add...)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data := ""
+	if len(kept) > 0 {
+		data = strings.Join(kept, "\n") + "\n"
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readKnownHosts(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+// knownHost returns the host field of a known_hosts line written by
+// clouddev, which has a single host.
+func knownHost(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// Markers of the host keys block cloud-init prints on the console.
+const (
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// ConsoleHostKeys returns the SSH host keys cloud-init printed in the
+// console output, from the last block of keys printed.
+func ConsoleHostKeys(output string) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	in := false
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.Contains(line, hostKeysBegin):
+			in = true
+			keys = nil
+		case strings.Contains(line, hostKeysEnd):
+			in = false
+		case in:
+			// Console lines may be prefixed, e.g. with timestamps.
+			for _, prefix := range []string{"ssh-", "ecdsa-"} {
+				if i := strings.Index(line, prefix); i >= 0 {
+					if k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line[i:])); err == nil {
+						keys = append(keys, k)
+					}
+					break
+				}
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,103 @@
+package remote_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// hostKey returns a new host key in the authorized_keys format.
+func hostKey(t *testing.T, ecdsaKey bool) string {
+	t.Helper()
+	var pub interface{}
+	if ecdsaKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub = &k.PublicKey
+	} else {
+		var err error
+		if pub, _, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k)))
+}
+
+func TestConsoleHostKeys(t *testing.T) {
+	ed, ec, old := hostKey(t, false), hostKey(t, true), hostKey(t, false)
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{
+			name: "cloud-init",
+			output: "Cloud-init v. 23.1 running 'modules:final'\n" +
+				"-----BEGIN SSH HOST KEY KEYS-----\n" +
+				ec + " root@dev\n" +
+				ed + " root@dev\n" +
+				"-----END SSH HOST KEY KEYS-----\n" +
+				"Cloud-init v. 23.1 finished\n",
+			want: []string{ec, ed},
+		},
+		{
+			name: "prefixed lines",
+			output: "[   12.345678] cloud-init[812]: -----BEGIN SSH HOST KEY KEYS-----\r\n" +
+				"[   12.345690] cloud-init[812]: " + ed + " root@dev\r\n" +
+				"ec2: " + ec + " root@dev\r\n" +
+				"[   12.345702] cloud-init[812]: -----END SSH HOST KEY KEYS-----\r\n",
+			want: []string{ed, ec},
+		},
+		{
+			name: "last block",
+			output: "-----BEGIN SSH HOST KEY KEYS-----\n" + old + "\n-----END SSH HOST KEY KEYS-----\n" +
+				"reboot\n" +
+				"-----BEGIN SSH HOST KEY KEYS-----\n" + ed + "\n-----END SSH HOST KEY KEYS-----\n",
+			want: []string{ed},
+		},
+		{
+			name: "invalid lines",
+			output: "-----BEGIN SSH HOST KEY KEYS-----\n" +
+				"ssh-ed25519 not-base64 root@dev\n" +
+				"garbled output\n" +
+				ed + "\n" +
+				"-----END SSH HOST KEY KEYS-----\n",
+			want: []string{ed},
+		},
+		{
+			name:   "keys outside the block",
+			output: ed + "\n-----BEGIN SSH HOST KEY KEYS-----\n-----END SSH HOST KEY KEYS-----\n" + ec + "\n",
+		},
+		{
+			name:   "no block",
+			output: "Ubuntu 22.04 LTS dev ttyS0\n\ndev login:",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, k := range remote.ConsoleHostKeys(tt.output) {
+				got = append(got, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k))))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("ConsoleHostKeys() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
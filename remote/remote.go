@@ -0,0 +1,116 @@
+// Package remote runs commands on the provisioned machines over SSH.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DialTimeout is the time allowed to connect and authenticate.
+var DialTimeout = 30 * time.Second
+
+// Target is an SSH server to connect to.
+type Target struct {
+	Host string
+	// Port is the port of the SSH server, 22 if zero.
+	Port   int
+	User   string
+	Signer ssh.Signer
+	// HostKeyCallback checks the host key of the server, see KnownHosts.
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// Addr returns the host:port address of the target.
+func (t *Target) Addr() string {
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(port))
+}
+
+// Client is an SSH connection to a machine.
+type Client struct {
+	*ssh.Client
+}
+
+// Dial connects to the target and authenticates with its signer.
+func Dial(ctx context.Context, t *Target) (*Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.Addr())
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.Addr(), &ssh.ClientConfig{
+		User:            t.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(t.Signer)},
+		HostKeyCallback: t.HostKeyCallback,
+		Timeout:         DialTimeout,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh %s@%s: %w", t.User, t.Addr(), err)
+	}
+	// The deadline was for the handshake only.
+	_ = conn.SetDeadline(time.Time{})
+	return &Client{Client: ssh.NewClient(c, chans, reqs)}, nil
+}
+
+// Run runs a shell command on the machine, with the given stdin, unless nil,
+// and output streams. The session is closed if the context is done.
+func (c *Client) Run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	s, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.Stdin = stdin
+	s.Stdout = stdout
+	s.Stderr = stderr
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+	err = s.Run(cmd)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Output runs a shell command on the machine and returns its stdout. The
+// error includes the stderr of a failed command.
+func (c *Client) Output(ctx context.Context, cmd string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	if err := c.Run(ctx, cmd, nil, &stdout, &stderr); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// Quote quotes a string for the POSIX shell.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
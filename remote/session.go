@@ -0,0 +1,109 @@
+package remote
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// WindowSize is the size of a terminal in characters.
+type WindowSize struct {
+	Width, Height int
+}
+
+// PTY is the pseudo terminal of a session.
+type PTY struct {
+	// Term is the TERM of the remote terminal, xterm-256color if empty.
+	Term string
+	Size WindowSize
+	// Resize receives the new sizes of the local terminal.
+	Resize <-chan WindowSize
+}
+
+// Session is an interactive session on the machine: a login shell, or a
+// command.
+type Session struct {
+	// Command is the shell command to run, a login shell if empty.
+	Command string
+	// PTY allocates a pseudo terminal, unless nil.
+	PTY *PTY
+	// ForwardAgent forwards the agent to the session, unless nil.
+	ForwardAgent agent.Agent
+
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+}
+
+// Attach runs the session on the machine until it exits. The error of a
+// command that exits with a non-zero status is an *ssh.ExitError.
+func (c *Client) Attach(ctx context.Context, s *Session) error {
+	if s.ForwardAgent != nil {
+		if err := agent.ForwardToAgent(c.Client, s.ForwardAgent); err != nil {
+			return err
+		}
+	}
+	sess, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	sess.Stdin = s.Stdin
+	sess.Stdout = s.Stdout
+	sess.Stderr = s.Stderr
+
+	if s.ForwardAgent != nil {
+		if err := agent.RequestAgentForwarding(sess); err != nil {
+			return err
+		}
+	}
+	if s.PTY != nil {
+		term := s.PTY.Term
+		if term == "" {
+			term = "xterm-256color"
+		}
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := sess.RequestPty(term, s.PTY.Size.Height, s.PTY.Size.Width, modes); err != nil {
+			return err
+		}
+	}
+
+	if s.Command == "" {
+		err = sess.Shell()
+	} else {
+		err = sess.Start(s.Command)
+	}
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var resize <-chan WindowSize
+		if s.PTY != nil {
+			resize = s.PTY.Resize
+		}
+		for {
+			select {
+			case size := <-resize:
+				_ = sess.WindowChange(size.Height, size.Width)
+			case <-ctx.Done():
+				sess.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	err = sess.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// DefaultSSHConfig returns the path of the user's OpenSSH client config,
+// $HOME/.ssh/config.
+func DefaultSSHConfig() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh", "config"), nil
+}
+
+// HostAlias returns the ssh config host alias of an environment.
+func HostAlias(env string) string {
+	return "clouddev-" + env
+}
+
+// HostEntry is the ssh config entry of an environment.
+type HostEntry struct {
+	Env  string
+	Host string
+	// Port is the port of the SSH server, 22 if zero.
+	Port int
+	User string
+	// IdentityFile is the path of the private key.
+	IdentityFile string
+	// KnownHosts is the path of the known_hosts file with the host keys.
+	KnownHosts string
+	// LocalForwards are the ports of the machine forwarded to the same
+	// local ports.
+	LocalForwards []int
+}
+
+func (e *HostEntry) block() []string {
+	lines := []string{
+		beginMarker(e.Env),
+		"Host " + HostAlias(e.Env),
+		"  HostName " + e.Host,
+	}
+	if e.Port != 0 && e.Port != 22 {
+		lines = append(lines, "  Port "+strconv.Itoa(e.Port))
+	}
+	lines = append(lines, "  User "+e.User)
+	if e.IdentityFile != "" {
+		lines = append(lines,
+			"  IdentityFile "+quoteConfig(e.IdentityFile),
+			"  IdentitiesOnly yes",
+		)
+	}
+	if e.KnownHosts != "" {
+		lines = append(lines,
+			"  UserKnownHostsFile "+quoteConfig(e.KnownHosts),
+			"  StrictHostKeyChecking yes",
+		)
+	}
+	for _, port := range e.LocalForwards {
+		lines = append(lines, fmt.Sprintf("  LocalForward %d localhost:%d", port, port))
+	}
+	return append(lines, endMarker(e.Env))
+}
+
+func beginMarker(env string) string {
+	return "# BEGIN " + HostAlias(env) + " (managed by clouddev, edits are overwritten)"
+}
+
+func endMarker(env string) string {
+	return "# END " + HostAlias(env)
+}
+
+// quoteConfig quotes an ssh config argument with spaces.
+func quoteConfig(s string) string {
+	if strings.ContainsAny(s, " \t") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// WriteHostEntry writes the entry of an environment to the ssh config file
+// at the given path, replacing the entry written before if any. The rest of
+// the file is left as is.
+func WriteHostEntry(path string, e *HostEntry) error {
+	return editSSHConfig(path, e.Env, e.block())
+}
+
+// RemoveHostEntry removes the entry of an environment from the ssh config
+// file at the given path, if any.
+func RemoveHostEntry(path, env string) error {
+	return editSSHConfig(path, env, nil)
+}
+
+// editSSHConfig replaces the block of lines of the environment with block,
+// appending it if the file has none.
+func editSSHConfig(path, env string, block []string) error {
+	// Edit the target of a symlinked config, e.g. from a dotfiles repo.
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	mode := os.FileMode(0600)
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if block == nil {
+			return nil
+		}
+	case err != nil:
+		return err
+	default:
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	}
+
+	// The lines keep their line endings, so that the rest of the file is
+	// written back as it was.
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	nl := "\n"
+	if len(lines) > 0 && strings.HasSuffix(lines[0], "\r\n") {
+		nl = "\r\n"
+	}
+	begin, end := -1, -1
+	for i, l := range lines {
+		switch strings.TrimSpace(l) {
+		case endMarker(env):
+			if begin >= 0 && end < 0 {
+				end = i
+			}
+		default:
+			if begin < 0 && strings.HasPrefix(strings.TrimSpace(l), "# BEGIN "+HostAlias(env)+" ") {
+				begin = i
+			}
+		}
+	}
+	if begin >= 0 && end < 0 {
+		return fmt.Errorf("%s has the start of the %s entry but not its end, fix or remove it", path, HostAlias(env))
+	}
+
+	var out []string
+	if begin >= 0 {
+		// Drop the blank line the entry was appended after when it's
+		// removed.
+		if block == nil && begin > 0 && strings.TrimSpace(lines[begin-1]) == "" &&
+			(end+1 == len(lines) || strings.TrimSpace(lines[end+1]) == "") {
+			begin--
+		}
+		out = append(out, lines[:begin]...)
+		for _, l := range block {
+			out = append(out, l+nl)
+		}
+		out = append(out, lines[end+1:]...)
+	} else {
+		if block == nil {
+			return nil
+		}
+		out = lines
+		// The entry is appended, after the host blocks of the user, so that
+		// their settings take precedence.
+		if len(out) > 0 {
+			last := out[len(out)-1]
+			if !strings.HasSuffix(last, "\n") {
+				out[len(out)-1] += nl
+			}
+			if strings.TrimSpace(last) != "" {
+				out = append(out, nl)
+			}
+		}
+		for _, l := range block {
+			out = append(out, l+nl)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	content := strings.Join(out, "")
+	tmp := path + ".clouddev"
+	if err := ioutil.WriteFile(tmp, []byte(content), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,156 @@
+package remote_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/remote"
+)
+
+// entryText returns the text of the ssh config entry with the given line
+// ending.
+func entryText(t *testing.T, e *remote.HostEntry, nl string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := remote.WriteHostEntry(path, e); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.ReplaceAll(string(data), "\n", nl)
+}
+
+func TestHostEntryKeepsTheRestOfTheFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		nl     string
+		before string
+		after  string
+	}{
+		{
+			name:   "in the middle",
+			nl:     "\n",
+			before: "Host *\n  ServerAliveInterval 60\n",
+			after:  "\nHost work\n  HostName work.example.com\n",
+		},
+		{
+			name:   "without a final newline",
+			nl:     "\n",
+			before: "Host *\n  ServerAliveInterval 60\n",
+			after:  "\nHost work\n  HostName work.example.com",
+		},
+		{
+			name:   "CRLF line endings",
+			nl:     "\r\n",
+			before: "Host *\r\n  ServerAliveInterval 60\r\n",
+			after:  "\r\nHost work\r\n  HostName work.example.com\r\n",
+		},
+		{
+			name:   "at the end",
+			nl:     "\n",
+			before: "# keep\tthis   spacing  \n\n\nHost *\n\tForwardAgent no\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config")
+			if err := ioutil.WriteFile(path, []byte(tt.before), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			read := func() string {
+				t.Helper()
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(data)
+			}
+			old := &remote.HostEntry{Env: "dev", Host: "203.0.113.10", User: "dev"}
+			updated := &remote.HostEntry{Env: "dev", Host: "203.0.113.20", Port: 2222, User: "dev"}
+
+			if err := remote.WriteHostEntry(path, old); err != nil {
+				t.Fatalf("WriteHostEntry() error = %v", err)
+			}
+			if got, want := read(), tt.before+tt.nl+entryText(t, old, tt.nl); got != want {
+				t.Fatalf("appended entry:\n%q\nwant\n%q", got, want)
+			}
+			// The user adds hosts after the entry.
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteString(tt.after); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := remote.WriteHostEntry(path, updated); err != nil {
+				t.Fatalf("WriteHostEntry() error = %v", err)
+			}
+			if got, want := read(), tt.before+tt.nl+entryText(t, updated, tt.nl)+tt.after; got != want {
+				t.Errorf("replaced entry:\n%q\nwant\n%q", got, want)
+			}
+			if err := remote.RemoveHostEntry(path, "dev"); err != nil {
+				t.Fatalf("RemoveHostEntry() error = %v", err)
+			}
+			if got, want := read(), tt.before+tt.after; got != want {
+				t.Errorf("removed entry:\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestHostEntryOfAnotherEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := remote.WriteHostEntry(path, &remote.HostEntry{Env: "dev", Host: "203.0.113.10", User: "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entries of environments with a name prefixed by another are
+	// left alone.
+	if err := remote.RemoveHostEntry(path, "de"); err != nil {
+		t.Fatalf("RemoveHostEntry() error = %v", err)
+	}
+	if err := remote.WriteHostEntry(path, &remote.HostEntry{Env: "dev2", Host: "203.0.113.11", User: "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.RemoveHostEntry(path, "dev2"); err != nil {
+		t.Fatalf("RemoveHostEntry() error = %v", err)
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("the entry of dev changed:\n%q\nwant\n%q", after, before)
+	}
+}
+
+func TestHostEntryWithoutItsEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := remote.WriteHostEntry(path, &remote.HostEntry{Env: "dev", Host: "203.0.113.10", User: "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := strings.Replace(string(data), "# END clouddev-dev\n", "", 1)
+	if err := ioutil.WriteFile(path, []byte(truncated), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err = remote.RemoveHostEntry(path, "dev")
+	if err == nil || !strings.Contains(err.Error(), "has the start of the clouddev-dev entry but not its end") {
+		t.Errorf("RemoveHostEntry() error = %v, want the missing end", err)
+	}
+}
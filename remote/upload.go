@@ -0,0 +1,116 @@
+package remote
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uploadScript extracts the archive read from stdin in a directory, given as
+// argument, replacing its content once it's extracted.
+const uploadScript = `set -e
+dir=%s
+rm -rf "$dir.clouddev"
+mkdir -p "$dir.clouddev"
+tar -xzf - -C "$dir.clouddev"
+rm -rf "$dir"
+mv "$dir.clouddev" "$dir"
+`
+
+// Upload copies the local directory to the remote directory, relative to
+// the home directory of the user, replacing it. The files and directories
+// with an excluded name are skipped.
+func (c *Client) Upload(ctx context.Context, local, dir string, exclude ...string) error {
+	pr, pw := io.Pipe()
+	werrc := make(chan error, 1)
+	go func() {
+		err := writeArchive(pw, local, exclude)
+		pw.CloseWithError(err)
+		werrc <- err
+	}()
+	var stderr bytes.Buffer
+	err := c.Run(ctx, fmt.Sprintf(uploadScript, Quote(dir)), pr, ioutil.Discard, &stderr)
+	// Unblock the archive if the command exited before reading it all.
+	pr.Close()
+	if werr := <-werrc; werr != nil && !errors.Is(werr, io.ErrClosedPipe) {
+		return fmt.Errorf("failed to upload %s: %w", local, werr)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return fmt.Errorf("failed to upload %s: %w", local, err)
+	}
+	return nil
+}
+
+// writeArchive writes the gzipped tar archive of the files of the directory
+// to w, without the excluded names. Symlinks are archived as symlinks.
+func writeArchive(w io.Writer, dir string, exclude []string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		for _, name := range exclude {
+			if fi.Name() == name {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		mode := fi.Mode()
+		if !mode.IsRegular() && !mode.IsDir() && mode&os.ModeSymlink == 0 {
+			// Sockets, devices and pipes can't be uploaded.
+			return nil
+		}
+
+		var link string
+		if mode&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		h, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		h.Name = filepath.ToSlash(rel)
+		// The files belong to the user extracting them.
+		h.Uid, h.Gid, h.Uname, h.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if !mode.IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
@@ -0,0 +1,165 @@
+package remote
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// uploadDir returns a directory of files to upload, with git metadata, a
+// symlink and a socket.
+func uploadDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]os.FileMode{
+		".bashrc":           0o644,
+		"bin/tool":          0o755,
+		".git/config":       0o644,
+		"vendor/lib/.git":   0o644,
+		".config/app/a.yml": 0o600,
+	}
+	for name, mode := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name+"\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The modes of the directories don't depend on the umask.
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		return os.Chmod(path, 0o755)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".bashrc", filepath.Join(dir, ".profile")); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return dir
+}
+
+func TestWriteArchive(t *testing.T) {
+	dir := uploadDir(t)
+	var buf bytes.Buffer
+	if err := writeArchive(&buf, dir, []string{".git"}); err != nil {
+		t.Fatalf("writeArchive() error = %v", err)
+	}
+
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	got := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Uid != 0 || h.Gid != 0 || h.Uname != "" || h.Gname != "" {
+			t.Errorf("%s belongs to %d:%d (%s:%s), want no owner", h.Name, h.Uid, h.Gid, h.Uname, h.Gname)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := fmt.Sprintf("%v", h.FileInfo().Mode())
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			entry += " -> " + h.Linkname
+		case tar.TypeReg:
+			entry += " " + string(data)
+		}
+		got[h.Name] = entry
+	}
+	want := map[string]string{
+		".bashrc":           "-rw-r--r-- .bashrc\n",
+		".profile":          "Lrwxrwxrwx -> .bashrc",
+		"bin":               "drwxr-xr-x",
+		"bin/tool":          "-rwxr-xr-x bin/tool\n",
+		".config":           "drwxr-xr-x",
+		".config/app":       "drwxr-xr-x",
+		".config/app/a.yml": "-rw------- .config/app/a.yml\n",
+		"vendor":            "drwxr-xr-x",
+		"vendor/lib":        "drwxr-xr-x",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("archive =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestUploadScript(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+	src := uploadDir(t)
+	dst := filepath.Join(t.TempDir(), "dotfiles")
+	// The files uploaded before are replaced.
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "removed"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := writeArchive(&archive, src, []string{".git"}); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", fmt.Sprintf(uploadScript, Quote(dst)))
+	cmd.Stdin = &archive
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("upload script error = %v, output:\n%s", err, out)
+	}
+
+	var got []string
+	err := filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dst, path)
+		got = append(got, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".", ".bashrc", ".config", ".config/app", ".config/app/a.yml", ".profile", "bin", "bin/tool", "vendor", "vendor/lib"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uploaded files = %q, want %q", got, want)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "bin/tool")); err != nil || fi.Mode().Perm() != 0o755 {
+		t.Errorf("bin/tool = %v, %v, want it executable", fi, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, ".profile")); err != nil || link != ".bashrc" {
+		t.Errorf(".profile links to %q, %v, want .bashrc", link, err)
+	}
+	if _, err := os.Stat(dst + ".clouddev"); !os.IsNotExist(err) {
+		t.Errorf("upload script left its temporary directory: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/darkowlzz/clouddev/config"
+)
+
+// Backend stores the state of the environments.
+type Backend interface {
+	// Get returns the state of the named environment, or ErrNotFound.
+	Get(ctx context.Context, name string) (*Environment, error)
+	// Put writes the state of an environment.
+	Put(ctx context.Context, env *Environment) error
+	// Delete removes the state of the named environment.
+	Delete(ctx context.Context, name string) error
+	// List returns the state of all the environments, sorted by name.
+	List(ctx context.Context) ([]*Environment, error)
+	// Lock takes an exclusive lock on the named environment, so that
+	// concurrent clouddev runs don't provision or destroy it at the same
+	// time. It returns an error wrapping ErrLocked if the lock is held
+	// elsewhere. The returned context is derived from ctx and is cancelled
+	// if the lock is lost before it's released, so the work done under the
+	// lock must use it. The returned function releases the lock, and
+	// reports its loss.
+	Lock(ctx context.Context, name string) (context.Context, func() error, error)
+	// ForceUnlock releases the lock of the named environment held by
+	// another, e.g. crashed, run.
+	ForceUnlock(ctx context.Context, name string) error
+}
+
+// Marshal encodes the state of an environment in the current version of the
+// state format.
+func Marshal(env *Environment) ([]byte, error) {
+	data, err := json.MarshalIndent(&document{Version: Version, Environment: env}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Unmarshal decodes the state of an environment encoded in any version of
+// the state format up to Version.
+func Unmarshal(data []byte) (*Environment, error) {
+	doc, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckName(doc.Environment.Name); err != nil {
+		return nil, err
+	}
+	return doc.Environment, nil
+}
+
+// CheckName returns an error if name isn't a valid environment name. The
+// backends check the names they put in paths and keys, so that a name like
+// ../x doesn't escape their directory or prefix.
+func CheckName(name string) error {
+	if err := config.ValidName(name); err != nil {
+		return fmt.Errorf("invalid environment name: %w", err)
+	}
+	return nil
+}
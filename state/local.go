@@ -0,0 +1,167 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+const (
+	stateExt = ".json"
+	lockExt  = ".lock"
+)
+
+// DefaultDir returns the default directory of the local state,
+// $HOME/.clouddev/state.
+func DefaultDir() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".clouddev", "state"), nil
+}
+
+// Local is a backend that stores the state of every environment in its own
+// JSON file in a local directory.
+type Local struct {
+	dir string
+}
+
+var _ Backend = &Local{}
+
+// NewLocal returns a local backend in the given directory. The directory is
+// created on the first write.
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+func (s *Local) path(name, ext string) string {
+	return filepath.Join(s.dir, name+ext)
+}
+
+// Get implements Backend.
+func (s *Local) Get(ctx context.Context, name string) (*Environment, error) {
+	data, err := ioutil.ReadFile(s.path(name, stateExt))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	env, err := Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", s.path(name, stateExt), err)
+	}
+	return env, nil
+}
+
+// Put implements Backend. The file is replaced atomically, so readers never
+// see a partially written state.
+func (s *Local) Put(ctx context.Context, env *Environment) error {
+	if err := CheckName(env.Name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	data, err := Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, "."+env.Name+"-*"+stateExt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(env.Name, stateExt))
+}
+
+// Delete implements Backend.
+func (s *Local) Delete(ctx context.Context, name string) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(name, stateExt))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List implements Backend.
+func (s *Local) List(ctx context.Context) ([]*Environment, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var envs []*Environment
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != stateExt {
+			continue
+		}
+		env, err := s.Get(ctx, strings.TrimSuffix(name, stateExt))
+		if err == ErrNotFound {
+			// Deleted since the directory was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, env)
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].Name < envs[j].Name
+	})
+	return envs, nil
+}
+
+// Lock implements Backend. The lock is an advisory lock on a file next to
+// the state file, held until released.
+func (s *Local) Lock(ctx context.Context, name string) (context.Context, func() error, error) {
+	if err := CheckName(name); err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	unlock, err := lockFile(s.path(name, lockExt))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx, unlock, nil
+}
+
+// ForceUnlock implements Backend. The lock file is removed, so that the next
+// process locks a new file regardless of the current holder.
+func (s *Local) ForceUnlock(ctx context.Context, name string) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(name, lockExt))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package state_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/darkowlzz/clouddev/state"
+)
+
+func TestLocalGetPutListDelete(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	s := state.NewLocal(dir)
+	ctx := context.Background()
+
+	if _, err := s.Get(ctx, "dev"); !errors.Is(err, state.ErrNotFound) {
+		t.Errorf("Get() of a missing environment error = %v, want %v", err, state.ErrNotFound)
+	}
+	if envs, err := s.List(ctx); err != nil || len(envs) != 0 {
+		t.Errorf("List() without a directory = %v, %v, want none", envs, err)
+	}
+	for _, name := range []string{"web", "dev"} {
+		env := &state.Environment{Name: name, Provider: "fake", Resources: map[string]string{"instance": name + "-1"}}
+		if err := s.Put(ctx, env); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	// Locks and temporary files aren't environments.
+	if _, unlock, err := s.Lock(ctx, "dev"); err != nil {
+		t.Fatal(err)
+	} else {
+		defer unlock()
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".dev-123.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := s.Get(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if env.Name != "dev" || env.Resources["instance"] != "dev-1" {
+		t.Errorf("Get() = %+v, want the environment put", env)
+	}
+	envs, err := s.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(envs) != 2 || envs[0].Name != "dev" || envs[1].Name != "web" {
+		t.Errorf("List() = %v, want dev and web", envs)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o700 {
+		t.Errorf("state directory mode = %v, want 0700", fi.Mode().Perm())
+	}
+
+	if err := s.Delete(ctx, "dev"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := s.Get(ctx, "dev"); !errors.Is(err, state.ErrNotFound) {
+		t.Errorf("Get() after Delete() error = %v, want %v", err, state.ErrNotFound)
+	}
+	if err := s.Delete(ctx, "dev"); err != nil {
+		t.Errorf("Delete() of a deleted environment error = %v", err)
+	}
+}
+
+func TestLocalPutIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	s := state.NewLocal(dir)
+	ctx := context.Background()
+	env := func(i int) *state.Environment {
+		// Large enough not to be written at once.
+		resources := map[string]string{}
+		for r := 0; r < 2000; r++ {
+			resources[fmt.Sprintf("resource-%d", r)] = strconv.Itoa(i)
+		}
+		return &state.Environment{Name: "dev", Provider: "fake", Resources: resources}
+	}
+	if err := s.Put(ctx, env(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 1; i <= 20; i++ {
+			if err := s.Put(ctx, env(i)); err != nil {
+				t.Errorf("Put() error = %v", err)
+				return
+			}
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		got, err := s.Get(ctx, "dev")
+		if err != nil {
+			t.Fatalf("Get() while writing error = %v", err)
+		}
+		if len(got.Resources) != 2000 {
+			t.Fatalf("Get() while writing has %d resources, want 2000", len(got.Resources))
+		}
+	}
+	wg.Wait()
+
+	// A failed write leaves the state as it was.
+	bad := &state.Environment{Name: "dev", Provider: "other", AnsibleVars: map[string]interface{}{"bad": make(chan int)}}
+	if err := s.Put(ctx, bad); err == nil {
+		t.Error("Put() of a state JSON can't encode error = nil")
+	}
+	if got, err := s.Get(ctx, "dev"); err != nil || got.Provider != "fake" || got.Resources["resource-0"] != "20" {
+		t.Errorf("Get() after a failed Put() = %+v, %v, want the last state written", got, err)
+	}
+	// No temporary file is left.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "dev.json" {
+			t.Errorf("Put() left %s", e.Name())
+		}
+	}
+}
+
+func TestLocalLock(t *testing.T) {
+	s := state.NewLocal(t.TempDir())
+	ctx := context.Background()
+
+	lockCtx, unlock, err := s.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	if lockCtx == nil || lockCtx.Err() != nil {
+		t.Errorf("Lock() context = %v, want a live context", lockCtx)
+	}
+	_, _, err = s.Lock(ctx, "dev")
+	if !errors.Is(err, state.ErrLocked) || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Errorf("Lock() of a held lock error = %v, want %v by this process", err, state.ErrLocked)
+	}
+	if _, other, err := s.Lock(ctx, "web"); err != nil {
+		t.Errorf("Lock() of another environment error = %v", err)
+	} else {
+		other()
+	}
+	if err := unlock(); err != nil {
+		t.Fatalf("unlock() error = %v", err)
+	}
+	_, unlock, err = s.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() after unlock() error = %v", err)
+	}
+
+	// A lock left behind is broken by ForceUnlock.
+	if err := s.ForceUnlock(ctx, "dev"); err != nil {
+		t.Fatalf("ForceUnlock() error = %v", err)
+	}
+	_, forced, err := s.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() after ForceUnlock() error = %v", err)
+	}
+	forced()
+	unlock()
+	if err := s.ForceUnlock(ctx, "dev"); err != nil {
+		t.Errorf("ForceUnlock() of a released lock error = %v", err)
+	}
+}
+
+func TestLocalRejectsInvalidNames(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "home", ".clouddev", "state")
+	s := state.NewLocal(dir)
+	ctx := context.Background()
+
+	for _, name := range []string{"../../x", "/tmp/x", "Dev", ""} {
+		if err := s.Put(ctx, &state.Environment{Name: name, Provider: "fake"}); err == nil || !strings.Contains(err.Error(), "invalid environment name") {
+			t.Errorf("Put() of %q error = %v, want the invalid name", name, err)
+		}
+		if _, _, err := s.Lock(ctx, name); err == nil {
+			t.Errorf("Lock() of %q error = nil", name)
+		}
+		if err := s.Delete(ctx, name); err == nil {
+			t.Errorf("Delete() of %q error = nil", name)
+		}
+		if err := s.ForceUnlock(ctx, name); err == nil {
+			t.Errorf("ForceUnlock() of %q error = nil", name)
+		}
+	}
+	// Nothing was written outside the state directory.
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			t.Errorf("invalid names wrote %s", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
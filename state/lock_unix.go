@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockFile takes an exclusive advisory lock on the file at the given path.
+// The lock is released by the kernel if the process dies. The lock holder
+// writes its PID in the file for the error messages of the other processes.
+func lockFile(path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w by process %s", ErrLocked, lockHolder(path))
+		}
+		return nil, err
+	}
+
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return func() error {
+		// Closing the file releases the lock.
+		return f.Close()
+	}, nil
+}
+
+func lockHolder(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
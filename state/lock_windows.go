@@ -0,0 +1,41 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lockFile takes an exclusive lock by creating the file at the given path.
+// Unlike on unix, the lock outlives a crashed process and the file has to be
+// removed by hand.
+func lockFile(path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%w by process %s, remove %s if it isn't running", ErrLocked, lockHolder(path), path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(strconv.Itoa(os.Getpid()))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return func() error {
+		return os.Remove(path)
+	}, nil
+}
+
+func lockHolder(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,47 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// migrations upgrade a decoded state document by one version:
+// migrations[i] upgrades a version i+1 document to version i+2.
+var migrations = []func(doc map[string]interface{}) error{}
+
+// decode decodes a state document of any version up to Version, migrating it
+// to the current version.
+func decode(data []byte) (*document, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	v, ok := raw["version"].(float64)
+	if !ok || v < 1 || v != float64(int(v)) {
+		return nil, fmt.Errorf("invalid state version %v", raw["version"])
+	}
+
+	version := int(v)
+	if version > Version {
+		return nil, fmt.Errorf("state version %d is newer than the supported version %d, upgrade clouddev", version, Version)
+	}
+	for ; version < Version; version++ {
+		if err := migrations[version-1](raw); err != nil {
+			return nil, fmt.Errorf("failed to migrate state from version %d: %w", version, err)
+		}
+		raw["version"] = version + 1
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Environment == nil {
+		return nil, fmt.Errorf("state has no environment")
+	}
+	return &doc, nil
+}
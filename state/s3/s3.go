@@ -0,0 +1,457 @@
+// Package s3 implements a state backend on S3 compatible object storage, so
+// that several machines can share the state of the environments.
+//
+// The state of every environment is stored in its own object. Environments
+// are locked with a lock object created with a conditional write, which
+// holds a lease that the lock holder renews until it unlocks. A lock whose
+// lease expired, e.g. because its holder crashed, can be taken over.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkowlzz/clouddev/internal/sigv4"
+	"github.com/darkowlzz/clouddev/state"
+)
+
+const (
+	stateExt = ".json"
+	lockExt  = ".lock"
+)
+
+// DefaultLease is the default duration of a lock lease.
+const DefaultLease = 2 * time.Minute
+
+// errPrecondition is returned when a conditional request fails.
+var errPrecondition = errors.New("precondition failed")
+
+// Options configure an S3 backend.
+type Options struct {
+	// Bucket is the name of the bucket to store the state in.
+	Bucket string
+	// Prefix is the key prefix of the state objects.
+	Prefix string
+	// Endpoint is the URL of the object storage, e.g.
+	// http://localhost:9000. Defaults to the AWS S3 endpoint of the region.
+	Endpoint string
+	Region   string
+	// PathStyle addresses the bucket in the URL path instead of the host
+	// name, as most self-hosted object stores expect.
+	PathStyle bool
+	// Lease is the duration of the lock leases, DefaultLease if zero.
+	Lease       time.Duration
+	Credentials sigv4.Credentials
+	// HTTPClient is the client to make requests with,
+	// http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// Backend is a state backend on S3 compatible object storage.
+type Backend struct {
+	opts     Options
+	endpoint *url.URL
+	signer   *sigv4.Signer
+}
+
+var _ state.Backend = &Backend{}
+
+// New returns an S3 backend.
+func New(opts Options) (*Backend, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", opts.Region)
+	}
+	if opts.Lease == 0 {
+		opts.Lease = DefaultLease
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	return &Backend{
+		opts:     opts,
+		endpoint: endpoint,
+		signer: &sigv4.Signer{
+			Credentials: opts.Credentials,
+			Region:      opts.Region,
+			Service:     "s3",
+		},
+	}, nil
+}
+
+func (b *Backend) key(name, ext string) string {
+	if b.opts.Prefix == "" {
+		return name + ext
+	}
+	return strings.TrimSuffix(b.opts.Prefix, "/") + "/" + name + ext
+}
+
+// Get implements state.Backend.
+func (b *Backend) Get(ctx context.Context, name string) (*state.Environment, error) {
+	data, _, err := b.getObject(ctx, b.key(name, stateExt))
+	if err != nil {
+		return nil, err
+	}
+	env, err := state.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state object %s: %w", b.key(name, stateExt), err)
+	}
+	return env, nil
+}
+
+// Put implements state.Backend.
+func (b *Backend) Put(ctx context.Context, env *state.Environment) error {
+	if err := state.CheckName(env.Name); err != nil {
+		return err
+	}
+	data, err := state.Marshal(env)
+	if err != nil {
+		return err
+	}
+	_, err = b.putObject(ctx, b.key(env.Name, stateExt), data, nil)
+	return err
+}
+
+// Delete implements state.Backend.
+func (b *Backend) Delete(ctx context.Context, name string) error {
+	if err := state.CheckName(name); err != nil {
+		return err
+	}
+	return b.deleteObject(ctx, b.key(name, stateExt))
+}
+
+// List implements state.Backend.
+func (b *Backend) List(ctx context.Context) ([]*state.Environment, error) {
+	prefix := b.key("", "")
+	var envs []*state.Environment
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, body, err := b.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, responseError(resp, body)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("invalid list objects response: %w", err)
+		}
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if !strings.HasSuffix(name, stateExt) || strings.Contains(name, "/") {
+				continue
+			}
+			env, err := b.Get(ctx, strings.TrimSuffix(name, stateExt))
+			if errors.Is(err, state.ErrNotFound) {
+				// Deleted since listed.
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			envs = append(envs, env)
+		}
+		if !result.IsTruncated {
+			// Keys are listed in lexicographic order, so are the names.
+			return envs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// lease is the content of a lock object.
+type lease struct {
+	// ID identifies the lock holder's lease.
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Lock implements state.Backend. The lock object is created only if it
+// doesn't exist, or replaced only if its lease expired, with conditional
+// writes. The lease is renewed in the background until unlocked, and the
+// returned context is cancelled if it can't be renewed before it expires,
+// e.g. because another run took the lock over.
+func (b *Backend) Lock(ctx context.Context, name string) (context.Context, func() error, error) {
+	if err := state.CheckName(name); err != nil {
+		return nil, nil, err
+	}
+	key := b.key(name, lockExt)
+	l := &lease{ID: randomID(), Owner: owner()}
+
+	etag, err := b.acquire(ctx, key, l)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lockCtx, lost := context.WithCancel(ctx)
+	renewCtx, cancel := context.WithCancel(context.Background())
+	var (
+		wg       sync.WaitGroup
+		renewErr error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(b.opts.Lease / 3)
+		defer ticker.Stop()
+		expires := l.Expires
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				l.Expires = time.Now().Add(b.opts.Lease).UTC()
+				data, _ := json.Marshal(l)
+				newETag, err := b.putObject(renewCtx, key, data, map[string]string{"If-Match": etag})
+				if renewCtx.Err() != nil {
+					return
+				}
+				// Transient errors are retried until the lease expires.
+				if err != nil && (errors.Is(err, errPrecondition) || !time.Now().Add(b.opts.Lease/3).Before(expires)) {
+					renewErr = fmt.Errorf("lost the lock of environment %s: %w", name, err)
+					lost()
+					return
+				}
+				if err == nil {
+					etag, expires = newETag, l.Expires
+				}
+			}
+		}
+	}()
+
+	return lockCtx, func() error {
+		cancel()
+		wg.Wait()
+		lost()
+		if renewErr != nil {
+			return renewErr
+		}
+		// Unlock even if the run was interrupted.
+		ctx, done := context.WithTimeout(context.Background(), 30*time.Second)
+		defer done()
+		return b.release(ctx, key, l.ID)
+	}, nil
+}
+
+// acquire creates the lock object, or takes it over if its lease expired,
+// and returns its ETag.
+func (b *Backend) acquire(ctx context.Context, key string, l *lease) (string, error) {
+	for {
+		l.Expires = time.Now().Add(b.opts.Lease).UTC()
+		data, err := json.Marshal(l)
+		if err != nil {
+			return "", err
+		}
+
+		etag, err := b.putObject(ctx, key, data, map[string]string{"If-None-Match": "*"})
+		if err == nil {
+			return etag, nil
+		}
+		if !errors.Is(err, errPrecondition) {
+			return "", err
+		}
+
+		// The lock exists, take it over only if its lease expired.
+		current, currentETag, err := b.getObject(ctx, key)
+		if errors.Is(err, state.ErrNotFound) {
+			// Unlocked in the meantime.
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		var held lease
+		if err := json.Unmarshal(current, &held); err != nil {
+			return "", fmt.Errorf("invalid lock object %s: %w", key, err)
+		}
+		if time.Now().Before(held.Expires) {
+			return "", fmt.Errorf("%w by %s until %s", state.ErrLocked, held.Owner, held.Expires.Local().Format(time.RFC3339))
+		}
+
+		etag, err = b.putObject(ctx, key, data, map[string]string{"If-Match": currentETag})
+		if errors.Is(err, errPrecondition) {
+			// Taken over or renewed by someone else in the meantime.
+			continue
+		}
+		return etag, err
+	}
+}
+
+// release deletes the lock object if it still holds the given lease.
+func (b *Backend) release(ctx context.Context, key, id string) error {
+	data, _, err := b.getObject(ctx, key)
+	if errors.Is(err, state.ErrNotFound) {
+		return fmt.Errorf("lock %s was removed while held", key)
+	}
+	if err != nil {
+		return err
+	}
+	var held lease
+	if err := json.Unmarshal(data, &held); err != nil {
+		return fmt.Errorf("invalid lock object %s: %w", key, err)
+	}
+	if held.ID != id {
+		return fmt.Errorf("lock %s was taken over by %s while held", key, held.Owner)
+	}
+	return b.deleteObject(ctx, key)
+}
+
+// ForceUnlock implements state.Backend.
+func (b *Backend) ForceUnlock(ctx context.Context, name string) error {
+	if err := state.CheckName(name); err != nil {
+		return err
+	}
+	return b.deleteObject(ctx, b.key(name, lockExt))
+}
+
+func (b *Backend) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	resp, body, err := b.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, resp.Header.Get("ETag"), nil
+	case http.StatusNotFound:
+		return nil, "", state.ErrNotFound
+	default:
+		return nil, "", responseError(resp, body)
+	}
+}
+
+// putObject writes an object with the given conditional headers and returns
+// its ETag.
+func (b *Backend) putObject(ctx context.Context, key string, data []byte, header map[string]string) (string, error) {
+	resp, body, err := b.do(ctx, http.MethodPut, key, nil, data, header)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("ETag"), nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// S3 answers a conflicting concurrent conditional write with 409.
+		return "", errPrecondition
+	case http.StatusNotFound:
+		// S3 answers If-Match for a missing object with 404.
+		if header["If-Match"] != "" {
+			return "", errPrecondition
+		}
+		return "", responseError(resp, body)
+	default:
+		return "", responseError(resp, body)
+	}
+}
+
+func (b *Backend) deleteObject(ctx context.Context, key string) error {
+	resp, body, err := b.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return responseError(resp, body)
+	}
+	return nil
+}
+
+// do sends a signed request for the given object key, or for the bucket if
+// the key is empty, and returns the response with its body read.
+func (b *Backend) do(ctx context.Context, method, key string, query url.Values, data []byte, header map[string]string) (*http.Response, []byte, error) {
+	u := *b.endpoint
+	if b.opts.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.opts.Bucket + "/" + key
+	} else {
+		u.Host = b.opts.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	b.signer.Sign(req, sigv4.PayloadHash(data))
+
+	resp, err := b.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// responseError returns the error described by an S3 error response.
+func responseError(resp *http.Response, body []byte) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	if err := xml.Unmarshal(body, &e); err != nil || e.Code == "" {
+		return fmt.Errorf("s3: %s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	}
+	return fmt.Errorf("s3: %s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, e.Code, e.Message)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// owner describes this process in the lock objects.
+func owner() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s (pid %d)", name, host, os.Getpid())
+}
@@ -0,0 +1,290 @@
+package s3_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/internal/sigv4"
+	"github.com/darkowlzz/clouddev/state"
+	"github.com/darkowlzz/clouddev/state/s3"
+	"github.com/darkowlzz/clouddev/state/s3/s3test"
+)
+
+// newTestBackend returns a backend on the stand-in, with the lease.
+func newTestBackend(t *testing.T, s *s3test.Server, lease time.Duration) *s3.Backend {
+	t.Helper()
+	b, err := s3.New(s3.Options{
+		Bucket:    s3test.Bucket,
+		Prefix:    "envs",
+		Endpoint:  s.URL,
+		PathStyle: true,
+		Lease:     lease,
+		Credentials: sigv4.Credentials{
+			AccessKeyID:     s3test.AccessKeyID,
+			SecretAccessKey: s3test.SecretAccessKey,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newServer(t *testing.T) *s3test.Server {
+	s := s3test.NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestGetPutListDelete(t *testing.T) {
+	s := newServer(t)
+	s.PageSize = 1
+	b := newTestBackend(t, s, 0)
+	ctx := context.Background()
+
+	if _, err := b.Get(ctx, "dev"); !errors.Is(err, state.ErrNotFound) {
+		t.Errorf("Get() of a missing environment error = %v, want %v", err, state.ErrNotFound)
+	}
+	for _, name := range []string{"web", "dev"} {
+		if err := b.Put(ctx, &state.Environment{Name: name, Provider: "fake"}); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	// Locks and the objects of other prefixes aren't environments.
+	s.PutObject("envs/dev.lock", []byte("{}"))
+	s.PutObject("envs/archive/old.json", []byte("{}"))
+	s.PutObject("other.json", []byte("{}"))
+
+	env, err := b.Get(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if env.Name != "dev" || env.Provider != "fake" {
+		t.Errorf("Get() = %+v, want the environment put", env)
+	}
+	envs, err := b.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(envs) != 2 || envs[0].Name != "dev" || envs[1].Name != "web" {
+		t.Errorf("List() = %v, want dev and web across pages", envs)
+	}
+
+	if err := b.Delete(ctx, "dev"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, ok := s.Object("envs/dev.json"); ok {
+		t.Error("Delete() left the state object")
+	}
+	if err := b.Delete(ctx, "dev"); err != nil {
+		t.Errorf("Delete() of a deleted environment error = %v", err)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	s := newServer(t)
+	b := newTestBackend(t, s, 0)
+	ctx := context.Background()
+
+	name := "../other/x"
+	if err := b.Put(ctx, &state.Environment{Name: name, Provider: "fake"}); err == nil || !strings.Contains(err.Error(), "invalid environment name") {
+		t.Errorf("Put() error = %v, want the invalid name", err)
+	}
+	if _, _, err := b.Lock(ctx, name); err == nil {
+		t.Error("Lock() error = nil")
+	}
+	if err := b.Delete(ctx, name); err == nil {
+		t.Error("Delete() error = nil")
+	}
+	if err := b.ForceUnlock(ctx, name); err == nil {
+		t.Error("ForceUnlock() error = nil")
+	}
+	for _, key := range []string{"other/x.json", "envs/../other/x.json", "other/x.lock", "envs/../other/x.lock"} {
+		if _, ok := s.Object(key); ok {
+			t.Errorf("invalid name wrote object %s", key)
+		}
+	}
+}
+
+func TestLockHeld(t *testing.T) {
+	s := newServer(t)
+	a, b := newTestBackend(t, s, time.Minute), newTestBackend(t, s, time.Minute)
+	ctx := context.Background()
+
+	_, unlock, err := a.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	if _, _, err := b.Lock(ctx, "dev"); !errors.Is(err, state.ErrLocked) || !strings.Contains(err.Error(), "pid") {
+		t.Errorf("Lock() of a held lock error = %v, want %v by its owner", err, state.ErrLocked)
+	}
+	if _, other, err := b.Lock(ctx, "web"); err != nil {
+		t.Errorf("Lock() of another environment error = %v", err)
+	} else {
+		other()
+	}
+	if err := unlock(); err != nil {
+		t.Fatalf("unlock() error = %v", err)
+	}
+	if _, ok := s.Object("envs/dev.lock"); ok {
+		t.Error("unlock() left the lock object")
+	}
+	_, unlock, err = b.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() after unlock() error = %v", err)
+	}
+	unlock()
+}
+
+func TestLeaseIsRenewed(t *testing.T) {
+	s := newServer(t)
+	const lease = 60 * time.Millisecond
+	a, b := newTestBackend(t, s, lease), newTestBackend(t, s, lease)
+	ctx := context.Background()
+
+	lockCtx, unlock, err := a.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	time.Sleep(4 * lease)
+	if _, _, err := b.Lock(ctx, "dev"); !errors.Is(err, state.ErrLocked) {
+		t.Errorf("Lock() of a renewed lock error = %v, want %v", err, state.ErrLocked)
+	}
+	if lockCtx.Err() != nil {
+		t.Errorf("the context of a renewed lock is done: %v", lockCtx.Err())
+	}
+	if err := unlock(); err != nil {
+		t.Errorf("unlock() error = %v", err)
+	}
+	if lockCtx.Err() == nil {
+		t.Error("the context of the lock isn't done after unlock()")
+	}
+}
+
+func TestTransientRenewalErrorIsRetried(t *testing.T) {
+	s := newServer(t)
+	var mu sync.Mutex
+	failures := 1
+	handler := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := r.Method == http.MethodPut && r.Header.Get("If-Match") != "" && failures > 0
+		if fail {
+			failures--
+		}
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	const lease = 90 * time.Millisecond
+	b := newTestBackend(t, s, lease)
+
+	lockCtx, unlock, err := b.Lock(context.Background(), "dev")
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	time.Sleep(3 * lease)
+	if lockCtx.Err() != nil {
+		t.Errorf("a failed renewal within the lease cancelled the context of the lock")
+	}
+	if err := unlock(); err != nil {
+		t.Errorf("unlock() error = %v", err)
+	}
+}
+
+func TestExpiredLeaseIsTakenOver(t *testing.T) {
+	s := newServer(t)
+	b := newTestBackend(t, s, time.Minute)
+	ctx := context.Background()
+
+	// The holder crashed without unlocking.
+	s.PutObject("envs/dev.lock", []byte(`{"id": "crashed", "owner": "dev@laptop (pid 1)", "expires": "2023-01-01T00:00:00Z"}`))
+	_, unlock, err := b.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() of an expired lock error = %v", err)
+	}
+	data, _ := s.Object("envs/dev.lock")
+	if strings.Contains(string(data), "crashed") {
+		t.Errorf("lock object = %s, want the lease of the new holder", data)
+	}
+	if err := unlock(); err != nil {
+		t.Errorf("unlock() error = %v", err)
+	}
+}
+
+func TestLostLeaseCancelsContext(t *testing.T) {
+	s := newServer(t)
+	const lease = 60 * time.Millisecond
+	a, b := newTestBackend(t, s, lease), newTestBackend(t, s, time.Minute)
+	ctx := context.Background()
+
+	lockCtx, unlock, err := a.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	// Another run forces the lock and takes it.
+	if err := b.ForceUnlock(ctx, "dev"); err != nil {
+		t.Fatalf("ForceUnlock() error = %v", err)
+	}
+	_, unlockB, err := b.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() after ForceUnlock() error = %v", err)
+	}
+	defer unlockB()
+
+	select {
+	case <-lockCtx.Done():
+	case <-time.After(10 * lease):
+		t.Fatal("the context of the lost lock isn't cancelled")
+	}
+	if err := unlock(); err == nil || !strings.Contains(err.Error(), "lost the lock of environment dev") {
+		t.Errorf("unlock() of a lost lock error = %v, want the loss", err)
+	}
+	// The lock of the other run is left alone.
+	if _, _, err := a.Lock(ctx, "dev"); !errors.Is(err, state.ErrLocked) {
+		t.Errorf("Lock() error = %v, want the lock of the other run held", err)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	s := newServer(t)
+	b := newTestBackend(t, s, time.Minute)
+	ctx := context.Background()
+
+	if err := b.ForceUnlock(ctx, "dev"); err != nil {
+		t.Errorf("ForceUnlock() of an unlocked environment error = %v", err)
+	}
+	s.PutObject("envs/dev.lock", []byte(`{"id": "held", "owner": "dev@laptop (pid 1)", "expires": "2999-01-01T00:00:00Z"}`))
+	if err := b.ForceUnlock(ctx, "dev"); err != nil {
+		t.Fatalf("ForceUnlock() error = %v", err)
+	}
+	_, unlock, err := b.Lock(ctx, "dev")
+	if err != nil {
+		t.Fatalf("Lock() after ForceUnlock() error = %v", err)
+	}
+	unlock()
+}
+
+func TestInvalidCredentials(t *testing.T) {
+	s := newServer(t)
+	b, err := s3.New(s3.Options{
+		Bucket:      s3test.Bucket,
+		Endpoint:    s.URL,
+		PathStyle:   true,
+		Credentials: sigv4.Credentials{AccessKeyID: "unknown", SecretAccessKey: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(context.Background(), "dev"); err == nil || !strings.Contains(err.Error(), "InvalidAccessKeyId") {
+		t.Errorf("Get() error = %v, want the S3 error", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Package s3test implements an in-memory stand-in for an S3 compatible
+// object store, MinIO style, for testing the S3 state backend.
+//
+// The stand-in serves a single bucket addressed in the URL path, and
+// implements the object requests used by the backend, with the If-Match and
+// If-None-Match conditional writes.
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The credentials accepted by the stand-in.
+const (
+	AccessKeyID     = "S3TESTACCESSKEY"
+	SecretAccessKey = "s3test-secret"
+)
+
+// Bucket is the name of the bucket of the stand-in.
+const Bucket = "clouddev-state"
+
+// Server is an S3 stand-in.
+type Server struct {
+	*httptest.Server
+	// PageSize is the maximum number of keys returned by a list request.
+	PageSize int
+
+	mu      sync.Mutex
+	objects map[string]*object
+}
+
+type object struct {
+	data []byte
+	etag string
+}
+
+// NewServer starts a stand-in with an empty bucket. The caller must close
+// it.
+func NewServer() *Server {
+	s := &Server{PageSize: 1000, objects: map[string]*object{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Object returns the content of an object, and false if it doesn't exist.
+func (s *Server) Object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), o.data...), true
+}
+
+// PutObject writes an object, e.g. to plant the lock of a crashed run.
+func (s *Server) PutObject(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(key, data)
+}
+
+func (s *Server) put(key string, data []byte) string {
+	sum := md5.Sum(data)
+	o := &object{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+	s.objects[key] = o
+	return o.etag
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+AccessKeyID+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			writeError(w, http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented")
+			return
+		}
+		s.list(w, r)
+		return
+	}
+	key := parts[1]
+	o, exists := s.objects[key]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", o.etag)
+		w.Write(o.data)
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" {
+			if !exists {
+				writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+				return
+			}
+			if match != o.etag {
+				writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+				return
+			}
+		}
+		w.Header().Set("ETag", s.put(key, data))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+// list serves a ListObjectsV2 request. The continuation token is the last
+// key of the previous page.
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("continuation-token")
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key  string
+		Size int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: Bucket, Prefix: prefix}
+	if len(keys) > s.PageSize {
+		keys = keys[:s.PageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{Key: key, Size: len(s.objects[key].data)})
+	}
+	result.KeyCount = len(keys)
+	writeXML(w, http.StatusOK, result)
+}
+
+func writeXML(w http.ResponseWriter, code int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s%s", xml.Header, data)
+}
+
+func writeError(w http.ResponseWriter, code int, errCode, msg string) {
+	writeXML(w, code, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: errCode, Message: msg})
+}
@@ -0,0 +1,61 @@
+// Package state records the environments provisioned by clouddev, so that
+// they can be found and destroyed later.
+package state
+
+import (
+	"errors"
+	"time"
+)
+
+// Version is the version of the state file format written by this version
+// of clouddev.
+const Version = 1
+
+var (
+	// ErrNotFound is returned when there's no state for an environment.
+	ErrNotFound = errors.New("environment state not found")
+	// ErrLocked is returned when an environment is locked by another
+	// clouddev process.
+	ErrLocked = errors.New("environment state is locked")
+)
+
+// Environment is the record of a provisioned environment.
+type Environment struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	// Resources are the provider IDs of the resources created for the
+	// environment, keyed by resource kind.
+	Resources map[string]string `json:"resources"`
+	CreatedAt time.Time         `json:"created_at"`
+	// ConfigHash is the hash of the configuration the environment was
+	// created with.
+	ConfigHash string `json:"config_hash"`
+	// Address is the address of the machine as of the last up.
+	Address string `json:"address,omitempty"`
+	// SSHPort is the port of the SSH server on Address, 22 if zero.
+	SSHPort int `json:"ssh_port,omitempty"`
+	// SSHUser is the login user.
+	SSHUser string `json:"ssh_user,omitempty"`
+	// SSHKey is the path of the private key to log in with.
+	SSHKey string `json:"ssh_key,omitempty"`
+	// Dotfiles is the hash of the dotfiles configuration last installed on
+	// the machine.
+	Dotfiles string `json:"dotfiles,omitempty"`
+	// Devcontainer is the path of the devcontainer.json run on the machine.
+	Devcontainer string `json:"devcontainer,omitempty"`
+	// ForwardPorts are the ports of the devcontainer forwarded by the ssh
+	// config entry.
+	ForwardPorts []int `json:"forward_ports,omitempty"`
+	// Ansible is the hash of the playbooks last applied to the machine, with
+	// their configuration.
+	Ansible string `json:"ansible,omitempty"`
+	// AnsibleVars are the variables of the environment the playbooks were
+	// applied with, for the inventory.
+	AnsibleVars map[string]interface{} `json:"ansible_vars,omitempty"`
+}
+
+// document is the versioned format of a state file.
+type document struct {
+	Version     int          `json:"version"`
+	Environment *Environment `json:"environment"`
+}
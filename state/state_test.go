@@ -0,0 +1,72 @@
+package state_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkowlzz/clouddev/state"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+	env := &state.Environment{
+		Name:        "dev",
+		Provider:    "fake",
+		Resources:   map[string]string{"instance": "fake-1"},
+		CreatedAt:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		ConfigHash:  "abc",
+		Address:     "192.0.2.1",
+		AnsibleVars: map[string]interface{}{"editor": "vim"},
+	}
+	data, err := state.Marshal(env)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if !strings.Contains(string(data), `"version": 1`) {
+		t.Errorf("Marshal() =\n%s\nwant the version", data)
+	}
+	got, err := state.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, env) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, env)
+	}
+}
+
+func TestUnmarshalVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{name: "current", data: `{"version": 1, "environment": {"name": "dev"}}`},
+		{name: "newer", data: `{"version": 2, "environment": {"name": "dev"}}`, err: "state version 2 is newer than the supported version 1, upgrade clouddev"},
+		{name: "missing", data: `{"environment": {"name": "dev"}}`, err: "invalid state version <nil>"},
+		{name: "zero", data: `{"version": 0, "environment": {"name": "dev"}}`, err: "invalid state version 0"},
+		{name: "fraction", data: `{"version": 1.5, "environment": {"name": "dev"}}`, err: "invalid state version 1.5"},
+		{name: "string", data: `{"version": "1", "environment": {"name": "dev"}}`, err: "invalid state version 1"},
+		{name: "no environment", data: `{"version": 1}`, err: "state has no environment"},
+		{name: "not JSON", data: `{"version": 1`, err: "unexpected end of JSON input"},
+		{
+			name: "path in the name",
+			data: `{"version": 1, "environment": {"name": "../../x"}}`,
+			err:  `invalid environment name: "../../x" must be at most 63 lowercase letters, digits or dashes, starting with a letter`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := state.Unmarshal([]byte(tt.data))
+			if tt.err == "" {
+				if err != nil || env.Name != "dev" {
+					t.Errorf("Unmarshal() = %+v, %v, want environment dev", env, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Unmarshal() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}